@@ -0,0 +1,375 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package bindtest provides an in-memory network of conn.Binds, so that
+// devices in the same process can be tested together without sockets.
+//
+// Datagrams are routed by destination port alone, every bind listening
+// on all addresses. The network may delay, reorder and drop datagrams,
+// drawing from a seeded source so that a given sequence of datagrams
+// always meets the same fate.
+package bindtest
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+var (
+	ErrClosed    = errors.New("bindtest: bind closed")
+	ErrPortInUse = errors.New("bindtest: port in use")
+)
+
+const (
+	firstPort = 49152 // ports given to binds created with port 0 start here
+	queueSize = 1024  // datagrams in flight to, or waiting at, a bind
+
+	HoldTimeout = 50 * time.Millisecond // longest a datagram is held back by Conditions.Reorder
+)
+
+// Conditions are the impairments datagrams meet on a Network.
+type Conditions struct {
+	Latency time.Duration // delay of every datagram
+	Reorder float64       // probability a datagram is held back behind the next one to the same bind
+	Loss    float64       // probability a datagram is dropped
+}
+
+// Network connects the binds created from it.
+type Network struct {
+	mu         sync.Mutex
+	binds      map[uint16]*Bind
+	nextPort   uint16
+	rand       *rand.Rand
+	conditions Conditions
+}
+
+// NewNetwork creates a Network without impairments, drawing from seed
+// once impaired.
+func NewNetwork(seed int64) *Network {
+	return &Network{
+		binds:    make(map[uint16]*Bind),
+		nextPort: firstPort,
+		rand:     rand.New(rand.NewSource(seed)),
+	}
+}
+
+// SetConditions changes the impairments of datagrams sent from now on.
+func (n *Network) SetConditions(c Conditions) {
+	n.mu.Lock()
+	n.conditions = c
+	n.mu.Unlock()
+}
+
+// CreateBind creates a bind listening on port, or on a free port if zero.
+// It has the signature of device.DeviceOptions.CreateBind.
+func (n *Network) CreateBind(port uint16) (conn.Bind, uint16, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if port == 0 {
+		for start := n.nextPort; ; {
+			if _, ok := n.binds[n.nextPort]; !ok {
+				break
+			}
+			n.nextPort++
+			if n.nextPort == 0 {
+				n.nextPort = firstPort
+			}
+			if n.nextPort == start {
+				return nil, 0, ErrPortInUse
+			}
+		}
+		port = n.nextPort
+		n.nextPort++
+		if n.nextPort == 0 {
+			n.nextPort = firstPort
+		}
+	} else if _, ok := n.binds[port]; ok {
+		return nil, 0, ErrPortInUse
+	}
+
+	bind := &Bind{
+		network: n,
+		port:    port,
+		pending: make(chan datagram, queueSize),
+		ipv4:    make(chan datagram, queueSize),
+		ipv6:    make(chan datagram, queueSize),
+		closed:  make(chan struct{}),
+	}
+	n.binds[port] = bind
+	go bind.routineDeliver()
+	return bind, port, nil
+}
+
+// CreateEndpoint parses an endpoint such as "127.0.0.1:51820".
+// It has the signature of device.DeviceOptions.CreateEndpoint.
+func (n *Network) CreateEndpoint(_ [32]byte, s string) (conn.Endpoint, error) {
+	return CreateEndpoint(s)
+}
+
+/* Routes a datagram from the bind at port src to end, under the
+ * conditions of the network.
+ */
+func (n *Network) send(buff []byte, src uint16, end conn.Endpoint) {
+	dst, err := net.ResolveUDPAddr("udp", end.DstToString())
+	if err != nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	bind, ok := n.binds[uint16(dst.Port)]
+	if !ok {
+		return
+	}
+	if n.conditions.Loss > 0 && n.rand.Float64() < n.conditions.Loss {
+		return
+	}
+
+	d := datagram{
+		packet: append([]byte(nil), buff...),
+		src:    &Endpoint{dst: net.UDPAddr{IP: loopback(dst.IP), Port: int(src)}},
+		at:     time.Now().Add(n.conditions.Latency),
+	}
+	d.src.src = net.UDPAddr{IP: d.src.dst.IP, Port: dst.Port}
+
+	if bind.held != nil {
+		bind.queue(d)
+		held := *bind.held
+		held.at = d.at
+		bind.held = nil
+		bind.queue(held)
+		return
+	}
+	if n.conditions.Reorder > 0 && n.rand.Float64() < n.conditions.Reorder {
+		held := &d
+		bind.held = held
+		time.AfterFunc(HoldTimeout, func() {
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if bind.held == held {
+				bind.held = nil
+				bind.queue(*held)
+			}
+		})
+		return
+	}
+	bind.queue(d)
+}
+
+type datagram struct {
+	packet []byte
+	src    *Endpoint
+	at     time.Time // when it arrives
+}
+
+// Bind is a conn.Bind on a Network.
+type Bind struct {
+	network *Network
+	port    uint16
+	held    *datagram // held back behind the next datagram, under network.mu
+
+	markMu sync.Mutex
+	mark   uint32
+
+	pending    chan datagram // in flight
+	ipv4, ipv6 chan datagram // arrived
+	closeOnce  sync.Once
+	closed     chan struct{}
+}
+
+var _ conn.Bind = (*Bind)(nil)
+
+// Port returns the port the bind listens on.
+func (bind *Bind) Port() uint16 {
+	return bind.port
+}
+
+/* Puts d in flight, dropping it if too many are, as a full socket buffer
+ * would.
+ */
+func (bind *Bind) queue(d datagram) {
+	select {
+	case bind.pending <- d:
+	default:
+	}
+}
+
+/* Hands datagrams in flight over to the receivers as they arrive, in the
+ * order they were sent.
+ */
+func (bind *Bind) routineDeliver() {
+	for {
+		var d datagram
+		select {
+		case <-bind.closed:
+			return
+		case d = <-bind.pending:
+		}
+
+		if wait := time.Until(d.at); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-bind.closed:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+
+		arrived := bind.ipv4
+		if d.src.dst.IP.To4() == nil {
+			arrived = bind.ipv6
+		}
+		select {
+		case arrived <- d:
+		default:
+		}
+	}
+}
+
+func (bind *Bind) receive(arrived chan datagram, buff []byte) (int, conn.Endpoint, *net.UDPAddr, error) {
+	select {
+	case <-bind.closed:
+		return 0, nil, nil, ErrClosed
+	case d := <-arrived:
+		addr := d.src.dst
+		return copy(buff, d.packet), d.src, &addr, nil
+	}
+}
+
+func (bind *Bind) ReceiveIPv4(buff []byte) (int, conn.Endpoint, *net.UDPAddr, error) {
+	return bind.receive(bind.ipv4, buff)
+}
+
+func (bind *Bind) ReceiveIPv6(buff []byte) (int, conn.Endpoint, *net.UDPAddr, error) {
+	return bind.receive(bind.ipv6, buff)
+}
+
+func (bind *Bind) Send(buff []byte, end conn.Endpoint) error {
+	select {
+	case <-bind.closed:
+		return ErrClosed
+	default:
+	}
+	bind.network.send(buff, bind.port, end)
+	return nil
+}
+
+func (bind *Bind) LastMark() uint32 {
+	bind.markMu.Lock()
+	defer bind.markMu.Unlock()
+	return bind.mark
+}
+
+func (bind *Bind) SetMark(value uint32) error {
+	bind.markMu.Lock()
+	bind.mark = value
+	bind.markMu.Unlock()
+	return nil
+}
+
+// Close stops the bind and frees its port. Datagrams in flight to it are
+// lost.
+func (bind *Bind) Close() error {
+	bind.closeOnce.Do(func() {
+		close(bind.closed)
+
+		n := bind.network
+		n.mu.Lock()
+		if n.binds[bind.port] == bind {
+			delete(n.binds, bind.port)
+		}
+		n.mu.Unlock()
+	})
+	return nil
+}
+
+// Endpoint is a conn.Endpoint on a Network.
+type Endpoint struct {
+	src, dst net.UDPAddr
+}
+
+var _ conn.Endpoint = (*Endpoint)(nil)
+
+// CreateEndpoint parses an endpoint such as "127.0.0.1:51820" or
+// "[::1]:51820".
+func CreateEndpoint(s string) (conn.Endpoint, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("bindtest: invalid IP address %q", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bindtest: invalid port %q", port)
+	}
+	return &Endpoint{dst: net.UDPAddr{IP: ip, Port: int(p)}}, nil
+}
+
+func (e *Endpoint) ClearSrc() {
+	e.src = net.UDPAddr{}
+}
+
+func (e *Endpoint) SrcToString() string {
+	if e.src.IP == nil {
+		return ""
+	}
+	return e.src.String()
+}
+
+func (e *Endpoint) DstToString() string {
+	return e.dst.String()
+}
+
+func (e *Endpoint) DstToBytes() []byte {
+	out := e.dst.IP.To4()
+	if out == nil {
+		out = e.dst.IP
+	}
+	return append(append([]byte(nil), out...), byte(e.dst.Port), byte(e.dst.Port>>8))
+}
+
+func (e *Endpoint) DstIP() net.IP {
+	return e.dst.IP
+}
+
+func (e *Endpoint) SrcIP() net.IP {
+	return e.src.IP
+}
+
+func (e *Endpoint) UpdateDst(addr *net.UDPAddr) error {
+	e.dst = *addr
+	return nil
+}
+
+func (e *Endpoint) Addrs() []wgcfg.Endpoint {
+	return []wgcfg.Endpoint{{
+		Host: e.dst.IP.String(),
+		Port: uint16(e.dst.Port),
+	}}
+}
+
+/* Returns the loopback address of the family of ip, which datagrams
+ * appear to come from.
+ */
+func loopback(ip net.IP) net.IP {
+	if ip.To4() != nil {
+		return net.IPv4(127, 0, 0, 1).To4()
+	}
+	return net.IPv6loopback
+}
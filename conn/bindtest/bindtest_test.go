@@ -0,0 +1,158 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package bindtest
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+)
+
+func receive(t *testing.T, bind conn.Bind) (byte, conn.Endpoint) {
+	t.Helper()
+	type result struct {
+		b   byte
+		end conn.Endpoint
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		var buff [16]byte
+		n, end, _, err := bind.ReceiveIPv4(buff[:])
+		if err == nil && n != 1 {
+			t.Errorf("received %d bytes, want 1", n)
+		}
+		ch <- result{buff[0], end, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r.b, r.end
+	case <-time.After(time.Second):
+		t.Fatal("nothing received")
+	}
+	return 0, nil
+}
+
+func TestNetwork(t *testing.T) {
+	network := NewNetwork(1)
+	a, portA, err := network.CreateBind(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, portB, err := network.CreateBind(51820)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if portA == 0 || portB != 51820 {
+		t.Fatalf("ports %d and %d", portA, portB)
+	}
+	if _, _, err := network.CreateBind(51820); err != ErrPortInUse {
+		t.Fatalf("second bind on a port: %v", err)
+	}
+
+	// datagrams come back from the port they were sent from
+
+	end, err := network.CreateEndpoint([32]byte{}, "127.0.0.1:51820")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Send([]byte{1}, end); err != nil {
+		t.Fatal(err)
+	}
+	got, from := receive(t, b)
+	if got != 1 || from.DstToString() != "127.0.0.1:"+strconv.Itoa(int(portA)) {
+		t.Fatalf("received %d from %s", got, from.DstToString())
+	}
+	if err := b.Send([]byte{2}, from); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := receive(t, a); got != 2 {
+		t.Fatalf("reply %d, want 2", got)
+	}
+
+	// latency delays, and reordering swaps, datagrams
+
+	network.SetConditions(Conditions{Latency: 50 * time.Millisecond, Reorder: 1})
+	start := time.Now()
+	a.Send([]byte{3}, end)
+	a.Send([]byte{4}, end)
+	if got, _ := receive(t, b); got != 4 {
+		t.Errorf("first of a reordered pair is %d, want 4", got)
+	}
+	if got, _ := receive(t, b); got != 3 {
+		t.Errorf("second of a reordered pair is %d, want 3", got)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("delivered after %v, before the latency", elapsed)
+	}
+
+	// loss drops datagrams
+
+	network.SetConditions(Conditions{Loss: 1})
+	a.Send([]byte{5}, end)
+	network.SetConditions(Conditions{})
+	a.Send([]byte{6}, end)
+	if got, _ := receive(t, b); got != 6 {
+		t.Errorf("received %d, want only 6", got)
+	}
+
+	// closing ends receives and frees the port
+
+	b.Close()
+	var buff [16]byte
+	if _, _, _, err := b.ReceiveIPv4(buff[:]); err != ErrClosed {
+		t.Errorf("receive after close: %v", err)
+	}
+	if err := b.Send([]byte{7}, end); err != ErrClosed {
+		t.Errorf("send after close: %v", err)
+	}
+	if b, _, err := network.CreateBind(51820); err != nil {
+		t.Errorf("port not freed: %v", err)
+	} else {
+		b.Close()
+	}
+}
+
+func TestLossDeterministic(t *testing.T) {
+	fates := func() []byte {
+		network := NewNetwork(42)
+		network.SetConditions(Conditions{Loss: 0.5})
+		a, _, _ := network.CreateBind(0)
+		defer a.Close()
+		b, port, _ := network.CreateBind(0)
+		defer b.Close()
+		end, _ := CreateEndpoint("127.0.0.1:" + strconv.Itoa(int(port)))
+		for i := 0; i < 32; i++ {
+			a.Send([]byte{byte(i)}, end)
+		}
+		a.Send([]byte{0xff}, end) // may be lost too, so resend unimpaired
+		network.SetConditions(Conditions{})
+		a.Send([]byte{0xff}, end)
+
+		var got []byte
+		for {
+			b, _ := receive(t, b)
+			if b == 0xff {
+				return got
+			}
+			got = append(got, b)
+		}
+	}
+	first, second := fates(), fates()
+	if len(first) == 0 || len(first) == 32 {
+		t.Fatalf("%d of 32 datagrams received at 50%% loss", len(first))
+	}
+	if string(first) != string(second) {
+		t.Errorf("losses differ between runs with the same seed: %v and %v", first, second)
+	}
+}
@@ -7,7 +7,9 @@ package conn
 
 import (
 	"errors"
+	"fmt"
 	"net"
+	"strconv"
 	"strings"
 
 	"github.com/tailscale/wireguard-go/wgcfg"
@@ -15,19 +17,78 @@ import (
 
 const (
 	ConnRoutineNumber = 2
+	MaxBatchSize      = 64 // maximum number of datagrams moved by one batch call
 )
 
 /* A Bind handles listening on a port for both IPv6 and IPv4 UDP traffic
  */
 type Bind interface {
 	LastMark() uint32
-	SetMark(value uint32) error
+	SetMark(value uint32) error // marks outgoing packets, 0 clears the mark
 	ReceiveIPv6(buff []byte) (int, Endpoint, *net.UDPAddr, error)
 	ReceiveIPv4(buff []byte) (int, Endpoint, *net.UDPAddr, error)
 	Send(buff []byte, end Endpoint) error
 	Close() error
 }
 
+/* A Packet is a single datagram within a batch.
+ *
+ * On receive, Buffer is provided by the caller and N, Endpoint and Addr are
+ * filled in by the Bind, as is DS where the platform reports it. On send,
+ * Buffer[:N] is sent to Endpoint, with the DS field (IPv4 TOS / IPv6 Traffic
+ * Class) of the datagram set to DS. IPv6 datagrams are sent with the flow
+ * label FlowLabel, where the platform supports it; IPv4 datagrams have none.
+ */
+type Packet struct {
+	Buffer    []byte
+	N         int
+	Endpoint  Endpoint
+	Addr      *net.UDPAddr
+	DS        byte
+	FlowLabel uint32 // 20-bit IPv6 flow label, 0 for none
+}
+
+/* A BatchBind is a Bind which can move several datagrams per system call.
+ *
+ * The receive functions block until at least one datagram is available
+ * and return the number of packets filled in. They must not be called
+ * concurrently for the same address family.
+ */
+type BatchBind interface {
+	ReceiveIPv6Batch(packets []Packet) (int, error)
+	ReceiveIPv4Batch(packets []Packet) (int, error)
+	SendBatch(packets []Packet) error
+}
+
+// ErrMarkUnsupported is returned by SetMark when the platform
+// has no way of marking outgoing packets.
+var ErrMarkUnsupported = errors.New("conn: packet marks are not supported on this platform")
+
+/* A PathMTUBind can forbid the fragmentation of outgoing datagrams, for
+ * path MTU discovery. While it is forbidden, IPv4 datagrams are sent with
+ * the DF bit set, and sending one larger than the path MTU the OS has
+ * learnt for its destination, from ICMP "packet too big" messages, fails
+ * with ErrMessageTooBig. PathMTU returns that learnt MTU, or the MTU of
+ * the route if nothing has been learnt, in bytes of IP packet.
+ */
+type PathMTUBind interface {
+	SetDontFragment(enabled bool) error
+	PathMTU(end Endpoint) (int, error)
+}
+
+// ErrMessageTooBig is returned when sending a datagram larger than the
+// path MTU, while a PathMTUBind forbids fragmentation.
+var ErrMessageTooBig = errors.New("conn: message exceeds the path MTU")
+
+/* An FDBind is a Bind whose sockets can be handed to another process, as
+ * when it takes over from this one. FDs returns the descriptors of the
+ * IPv4 and IPv6 sockets, -1 for a family not listened on. They stay
+ * owned by the bind, and are closed with it.
+ */
+type FDBind interface {
+	FDs() (ipv4, ipv6 int)
+}
+
 type BindToInterface interface {
 	BindToInterface4(interfaceIndex uint32, blackhole bool) error
 	BindToInterface6(interfaceIndex uint32, blackhole bool) error
@@ -49,6 +110,16 @@ type Endpoint interface {
 	Addrs() []wgcfg.Endpoint
 }
 
+/* Returns the destination of end as a UDP address, as held by the
+ * endpoints of this package, parsing the string form only of others.
+ */
+func endpointUDPAddr(end Endpoint) (*net.UDPAddr, error) {
+	if native, ok := end.(*NativeEndpoint); ok {
+		return native.dstAsUDPAddr(), nil
+	}
+	return parseEndpoint(end.DstToString())
+}
+
 func parseEndpoint(s string) (*net.UDPAddr, error) {
 	// ensure that the host is an IP address
 
@@ -60,6 +131,9 @@ func parseEndpoint(s string) (*net.UDPAddr, error) {
 		// Remove the scope, if any. ResolveUDPAddr below will use it, but here we're just
 		// trying to make sure with a small sanity test that this is a real IP address and
 		// not something that's likely to incur DNS lookups.
+		if err := checkZone(host[i+1:]); err != nil {
+			return nil, err
+		}
 		host = host[:i]
 	}
 	if ip := net.ParseIP(host); ip == nil {
@@ -78,3 +152,89 @@ func parseEndpoint(s string) (*net.UDPAddr, error) {
 	}
 	return addr, err
 }
+
+/* Checks that zone names an interface or is an interface index.
+ */
+func checkZone(zone string) error {
+	if _, err := strconv.ParseUint(zone, 10, 32); err == nil {
+		return nil
+	}
+	if _, err := net.InterfaceByName(zone); err != nil {
+		return fmt.Errorf("unknown interface %q for endpoint zone", zone)
+	}
+	return nil
+}
+
+// zoneName returns the name of the interface with the given index,
+// or the index itself if there is no such interface.
+func zoneName(index uint32) string {
+	if intr, err := net.InterfaceByIndex(int(index)); err == nil {
+		return intr.Name
+	}
+	return strconv.FormatUint(uint64(index), 10)
+}
+
+// ParseListenAddress parses a local address of the form ip or ip%zone,
+// where zone is an interface name or index scoping an IPv6 link-local address.
+func ParseListenAddress(s string) (*net.IPAddr, error) {
+	host, zone := s, ""
+	if i := strings.LastIndexByte(s, '%'); i > 0 {
+		host, zone = s[:i], s[i+1:]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errors.New("Failed to parse IP address: " + host)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		if zone != "" {
+			return nil, errors.New("IPv4 address cannot have a zone: " + s)
+		}
+		ip = ip4
+	}
+	return &net.IPAddr{IP: ip, Zone: zone}, nil
+}
+
+/* Returns the address listening on the whole of an address family, given
+ * by its IP version.
+ */
+func unspecifiedAddress(family int) (*net.IPAddr, error) {
+	switch family {
+	case 4:
+		return &net.IPAddr{IP: net.IPv4zero.To4()}, nil
+	case 6:
+		return &net.IPAddr{IP: net.IPv6unspecified}, nil
+	}
+	return nil, fmt.Errorf("invalid address family %d", family)
+}
+
+/* Verifies that addr is assigned to a local interface, so that binding
+ * to it fails with a clear message rather than EADDRNOTAVAIL.
+ */
+func checkLocalAddress(addr *net.IPAddr) error {
+	var addrs []net.Addr
+	var err error
+	if addr.Zone != "" {
+		intr, err := net.InterfaceByName(addr.Zone)
+		if err != nil {
+			index, perr := strconv.Atoi(addr.Zone)
+			if perr != nil {
+				return fmt.Errorf("unknown interface %q for listen address %v", addr.Zone, addr)
+			}
+			if intr, err = net.InterfaceByIndex(index); err != nil {
+				return fmt.Errorf("unknown interface %q for listen address %v", addr.Zone, addr)
+			}
+		}
+		addrs, err = intr.Addrs()
+	} else {
+		addrs, err = net.InterfaceAddrs()
+	}
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(addr.IP) {
+			return nil
+		}
+	}
+	return fmt.Errorf("listen address %v is not assigned to a local interface", addr)
+}
@@ -9,9 +9,9 @@ package conn
 
 import (
 	"context"
-	"fmt"
 	"net"
 	"os"
+	"strconv"
 	"syscall"
 
 	"github.com/tailscale/wireguard-go/wgcfg"
@@ -56,6 +56,10 @@ func (e *NativeEndpoint) DstToBytes() []byte {
 	return addrToBytes(addr)
 }
 
+func (e *NativeEndpoint) dstAsUDPAddr() *net.UDPAddr {
+	return (*net.UDPAddr)(e)
+}
+
 func addrToBytes(addr *net.UDPAddr) []byte {
 	out := addr.IP.To4()
 	if out == nil {
@@ -80,18 +84,26 @@ func (e *NativeEndpoint) UpdateDst(dst *net.UDPAddr) error {
 }
 
 func (e *NativeEndpoint) Addrs() []wgcfg.Endpoint {
+	host := e.IP.String()
+	if e.Zone != "" {
+		host += "%" + e.Zone
+	}
 	return []wgcfg.Endpoint{{
-		Host: e.IP.String(),
+		Host: host,
 		Port: uint16(e.Port),
 	}}
 }
 
-func listenNet(network string, port int) (*net.UDPConn, int, error) {
+func listenNet(network string, ip *net.IPAddr, port int) (*net.UDPConn, int, error) {
 
 	// listen
 	ctx := context.Background()
 	lc := net.ListenConfig{Control: netControl} // sets SO_REUSEADDR
-	packetConn, err := lc.ListenPacket(ctx, network, fmt.Sprintf(":%d", port))
+	host := ""
+	if ip != nil {
+		host = ip.String()
+	}
+	packetConn, err := lc.ListenPacket(ctx, network, net.JoinHostPort(host, strconv.Itoa(port)))
 	if err != nil {
 		return nil, 0, err
 	}
@@ -123,21 +135,50 @@ func extractErrno(err error) error {
 }
 
 func CreateBind(uport uint16, device interface{}) (Bind, uint16, error) {
+	return createBind(nil, uport)
+}
+
+// CreateBindToAddress is like CreateBind, but only listens on addr.
+// Only the address family of addr is bound.
+func CreateBindToAddress(addr *net.IPAddr, uport uint16, device interface{}) (Bind, uint16, error) {
+	if err := checkLocalAddress(addr); err != nil {
+		return nil, 0, err
+	}
+	return createBind(addr, uport)
+}
+
+// CreateBindToFamily is like CreateBind, but only listens on the address
+// family given by its IP version, 4 or 6.
+func CreateBindToFamily(family int, uport uint16, device interface{}) (Bind, uint16, error) {
+	laddr, err := unspecifiedAddress(family)
+	if err != nil {
+		return nil, 0, err
+	}
+	return createBind(laddr, uport)
+}
+
+func createBind(laddr *net.IPAddr, uport uint16) (Bind, uint16, error) {
 	var err error
 	var bind nativeBind
 
 	port := int(uport)
 
-	bind.ipv4, port, err = listenNet("udp4", port)
-	if err != nil && extractErrno(err) != syscall.EAFNOSUPPORT {
-		return nil, 0, err
+	if laddr == nil || laddr.IP.To4() != nil {
+		bind.ipv4, port, err = listenNet("udp4", laddr, port)
+		if err != nil && (extractErrno(err) != syscall.EAFNOSUPPORT || laddr != nil) {
+			return nil, 0, err
+		}
 	}
 
-	bind.ipv6, port, err = listenNet("udp6", port)
-	if err != nil && extractErrno(err) != syscall.EAFNOSUPPORT {
-		bind.ipv4.Close()
-		bind.ipv4 = nil
-		return nil, 0, err
+	if laddr == nil || laddr.IP.To4() == nil {
+		bind.ipv6, port, err = listenNet("udp6", laddr, port)
+		if err != nil && (extractErrno(err) != syscall.EAFNOSUPPORT || laddr != nil) {
+			if bind.ipv4 != nil {
+				bind.ipv4.Close()
+				bind.ipv4 = nil
+			}
+			return nil, 0, err
+		}
 	}
 
 	return &bind, uint16(port), nil
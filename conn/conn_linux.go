@@ -68,20 +68,30 @@ func (e *NativeEndpoint) Addrs() []wgcfg.Endpoint {
 		port = uint16(e.dst4().Port)
 	}
 
+	host := e.DstIP().String()
+	if zone := e.dstZone(); zone != 0 {
+		host += "%" + zoneName(zone)
+	}
 	return []wgcfg.Endpoint{{
-		Host: e.DstIP().String(),
+		Host: host,
 		Port: uint16(port),
 	}}
 }
 
 type nativeBind struct {
-	sock4    int
-	sock6    int
-	lastMark uint32
+	sock4       int
+	sock6       int
+	lastMark    uint32
+	noMmsg      uint32 // set atomically if the kernel lacks sendmmsg / recvmmsg
+	noFlowLabel uint32 // set atomically once the kernel refuses a flow label
+	batch4      mmsgBuffers
+	batch6      mmsgBuffers
 }
 
 var _ Endpoint = (*NativeEndpoint)(nil)
 var _ Bind = (*nativeBind)(nil)
+var _ BatchBind = (*nativeBind)(nil)
+var _ FDBind = (*nativeBind)(nil)
 
 func CreateEndpoint(s string) (Endpoint, error) {
 	var end NativeEndpoint
@@ -139,31 +149,63 @@ func (e *NativeEndpoint) UpdateDst(addr *net.UDPAddr) error {
 }
 
 func CreateBind(port uint16, device interface{}) (*nativeBind, uint16, error) {
+	return createBind(nil, port)
+}
+
+// CreateBindToAddress is like CreateBind, but only listens on addr.
+// Only the address family of addr is bound.
+func CreateBindToAddress(addr *net.IPAddr, port uint16, device interface{}) (Bind, uint16, error) {
+	if err := checkLocalAddress(addr); err != nil {
+		return nil, 0, err
+	}
+	return createBind(addr, port)
+}
+
+// CreateBindToFamily is like CreateBind, but only listens on the address
+// family given by its IP version, 4 or 6.
+func CreateBindToFamily(family int, port uint16, device interface{}) (Bind, uint16, error) {
+	laddr, err := unspecifiedAddress(family)
+	if err != nil {
+		return nil, 0, err
+	}
+	return createBind(laddr, port)
+}
+
+func createBind(laddr *net.IPAddr, port uint16) (*nativeBind, uint16, error) {
 	var err error
 	var bind nativeBind
 	var newPort uint16
 
+	bind.sock4 = FD_ERR
+	bind.sock6 = FD_ERR
+
 	// attempt ipv6 bind, update port if successful
 
-	bind.sock6, newPort, err = create6(port)
-	if err != nil {
-		if err != syscall.EAFNOSUPPORT {
-			return nil, 0, err
+	if laddr == nil || laddr.IP.To4() == nil {
+		bind.sock6, newPort, err = create6(laddr, port)
+		if err != nil {
+			if err != syscall.EAFNOSUPPORT || laddr != nil {
+				return nil, 0, err
+			}
+		} else {
+			port = newPort
 		}
-	} else {
-		port = newPort
 	}
 
 	// attempt ipv4 bind, update port if successful
 
-	bind.sock4, newPort, err = create4(port)
-	if err != nil {
-		if err != syscall.EAFNOSUPPORT {
-			unix.Close(bind.sock6)
-			return nil, 0, err
+	if laddr == nil || laddr.IP.To4() != nil {
+		bind.sock4, newPort, err = create4(laddr, port)
+		if err != nil {
+			if err != syscall.EAFNOSUPPORT || laddr != nil {
+				if bind.sock6 != FD_ERR {
+					unix.Close(bind.sock6)
+				}
+				return nil, 0, err
+			}
+		} else {
+			port = newPort
 		}
-	} else {
-		port = newPort
 	}
 
 	if bind.sock4 == FD_ERR && bind.sock6 == FD_ERR {
@@ -173,6 +215,79 @@ func CreateBind(port uint16, device interface{}) (*nativeBind, uint16, error) {
 	return &bind, port, nil
 }
 
+// CreateBindFromFDs adopts the sockets of an existing bind, as returned
+// by its FDs, FD_ERR for a family not listened on, as when taking over
+// from another process. The sockets are taken as they are, with their
+// options and mark, and belong to the bind from then on, or are closed
+// on failure. It returns the port the sockets are bound to.
+func CreateBindFromFDs(ipv4, ipv6 int) (Bind, uint16, error) {
+	bind := &nativeBind{
+		sock4: ipv4,
+		sock6: ipv6,
+	}
+	port, err := bind.adopt()
+	if err != nil {
+		bind.Close()
+		return nil, 0, err
+	}
+	return bind, port, nil
+}
+
+/* Checks the sockets of the bind are UDP sockets of their family bound to
+ * the same port, returning the port, and reads their mark.
+ */
+func (bind *nativeBind) adopt() (uint16, error) {
+	if bind.sock4 == FD_ERR && bind.sock6 == FD_ERR {
+		return 0, errors.New("no sockets to adopt")
+	}
+	var port int
+	for _, sock := range []int{bind.sock4, bind.sock6} {
+		if sock == FD_ERR {
+			continue
+		}
+		typ, err := unix.GetsockoptInt(sock, unix.SOL_SOCKET, unix.SO_TYPE)
+		if err != nil {
+			return 0, err
+		}
+		if typ != unix.SOCK_DGRAM {
+			return 0, errors.New("adopted socket is not a datagram socket")
+		}
+		sa, err := unix.Getsockname(sock)
+		if err != nil {
+			return 0, err
+		}
+		var bound int
+		switch sa := sa.(type) {
+		case *unix.SockaddrInet4:
+			if sock != bind.sock4 {
+				return 0, errors.New("adopted IPv6 socket is of the IPv4 family")
+			}
+			bound = sa.Port
+		case *unix.SockaddrInet6:
+			if sock != bind.sock6 {
+				return 0, errors.New("adopted IPv4 socket is of the IPv6 family")
+			}
+			bound = sa.Port
+		default:
+			return 0, errors.New("adopted socket is not an IP socket")
+		}
+		if port != 0 && bound != port {
+			return 0, errors.New("adopted sockets are bound to different ports")
+		}
+		port = bound
+		mark, err := unix.GetsockoptInt(sock, unix.SOL_SOCKET, unix.SO_MARK)
+		if err != nil {
+			return 0, err
+		}
+		bind.lastMark = uint32(mark)
+	}
+	return uint16(port), nil
+}
+
+func (bind *nativeBind) FDs() (ipv4, ipv6 int) {
+	return bind.sock4, bind.sock6
+}
+
 func (bind *nativeBind) LastMark() uint32 {
 	return bind.lastMark
 }
@@ -234,7 +349,7 @@ func (bind *nativeBind) ReceiveIPv6(buff []byte) (int, Endpoint, *net.UDPAddr, e
 	if bind.sock6 == -1 {
 		return 0, nil, nil, syscall.EAFNOSUPPORT
 	}
-	n, addr, err := receive6(
+	n, _, addr, err := receive6(
 		bind.sock6,
 		buff,
 		&end,
@@ -247,7 +362,7 @@ func (bind *nativeBind) ReceiveIPv4(buff []byte) (int, Endpoint, *net.UDPAddr, e
 	if bind.sock4 == -1 {
 		return 0, nil, nil, syscall.EAFNOSUPPORT
 	}
-	n, addr, err := receive4(
+	n, _, addr, err := receive4(
 		bind.sock4,
 		buff,
 		&end,
@@ -261,12 +376,12 @@ func (bind *nativeBind) Send(buff []byte, end Endpoint) error {
 		if bind.sock4 == -1 {
 			return syscall.EAFNOSUPPORT
 		}
-		return send4(bind.sock4, nend, buff)
+		return send4(bind.sock4, nend, buff, 0)
 	} else {
 		if bind.sock6 == -1 {
 			return syscall.EAFNOSUPPORT
 		}
-		return send6(bind.sock6, nend, buff)
+		return send6(bind.sock6, nend, buff, 0, 0)
 	}
 }
 
@@ -318,12 +433,34 @@ func (end *NativeEndpoint) dstAsUDPAddr() *net.UDPAddr {
 		udpAddr.Port = end.dst4().Port
 	} else {
 		udpAddr.Port = end.dst6().Port
+		if zone := end.dstZone(); zone != 0 {
+			udpAddr.Zone = strconv.FormatUint(uint64(zone), 10)
+		}
 	}
 	return &udpAddr
 }
 
+/* Returns the scope of a link-local destination, 0 otherwise. For other
+ * destinations ZoneId only holds the interface of the sticky source.
+ */
+func (end *NativeEndpoint) dstZone() uint32 {
+	if !end.isV6 {
+		return 0
+	}
+	dst := end.dst6()
+	ip := net.IP(dst.Addr[:])
+	if !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() {
+		return 0
+	}
+	return dst.ZoneId
+}
+
 func (end *NativeEndpoint) DstToString() string {
-	return end.dstAsUDPAddr().String()
+	addr := end.dstAsUDPAddr()
+	if zone := end.dstZone(); zone != 0 {
+		addr.Zone = zoneName(zone)
+	}
+	return addr.String()
 }
 
 func (end *NativeEndpoint) ClearDst() {
@@ -342,14 +479,17 @@ func zoneToUint32(zone string) (uint32, error) {
 	if zone == "" {
 		return 0, nil
 	}
-	if intr, err := net.InterfaceByName(zone); err == nil {
-		return uint32(intr.Index), nil
+	if n, err := strconv.ParseUint(zone, 10, 32); err == nil {
+		return uint32(n), nil
 	}
-	n, err := strconv.ParseUint(zone, 10, 32)
-	return uint32(n), err
+	intr, err := net.InterfaceByName(zone)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(intr.Index), nil
 }
 
-func create4(port uint16) (int, uint16, error) {
+func create4(laddr *net.IPAddr, port uint16) (int, uint16, error) {
 
 	// create socket
 
@@ -366,6 +506,9 @@ func create4(port uint16) (int, uint16, error) {
 	addr := unix.SockaddrInet4{
 		Port: int(port),
 	}
+	if laddr != nil {
+		copy(addr.Addr[:], laddr.IP.To4())
+	}
 
 	// set sockopts and bind
 
@@ -388,6 +531,15 @@ func create4(port uint16) (int, uint16, error) {
 			return err
 		}
 
+		if err := unix.SetsockoptInt(
+			fd,
+			unix.IPPROTO_IP,
+			unix.IP_RECVTOS,
+			1,
+		); err != nil {
+			return err
+		}
+
 		return unix.Bind(fd, &addr)
 	}(); err != nil {
 		unix.Close(fd)
@@ -402,7 +554,7 @@ func create4(port uint16) (int, uint16, error) {
 	return fd, uint16(addr.Port), err
 }
 
-func create6(port uint16) (int, uint16, error) {
+func create6(laddr *net.IPAddr, port uint16) (int, uint16, error) {
 
 	// create socket
 
@@ -421,6 +573,15 @@ func create6(port uint16) (int, uint16, error) {
 	addr := unix.SockaddrInet6{
 		Port: int(port),
 	}
+	if laddr != nil {
+		zone, err := zoneToUint32(laddr.Zone)
+		if err != nil {
+			unix.Close(fd)
+			return FD_ERR, 0, err
+		}
+		copy(addr.Addr[:], laddr.IP.To16())
+		addr.ZoneId = zone
+	}
 
 	if err := func() error {
 
@@ -442,6 +603,15 @@ func create6(port uint16) (int, uint16, error) {
 			return err
 		}
 
+		if err := unix.SetsockoptInt(
+			fd,
+			unix.IPPROTO_IPV6,
+			unix.IPV6_RECVTCLASS,
+			1,
+		); err != nil {
+			return err
+		}
+
 		if err := unix.SetsockoptInt(
 			fd,
 			unix.IPPROTO_IPV6,
@@ -466,27 +636,25 @@ func create6(port uint16) (int, uint16, error) {
 	return fd, uint16(addr.Port), err
 }
 
-func send4(sock int, end *NativeEndpoint, buff []byte) error {
+func send4(sock int, end *NativeEndpoint, buff []byte, ds byte) error {
 
 	// construct message header
 
-	cmsg := struct {
-		cmsghdr unix.Cmsghdr
-		pktinfo unix.Inet4Pktinfo
-	}{
-		unix.Cmsghdr{
+	cmsg := cmsg4{
+		cmsghdr: unix.Cmsghdr{
 			Level: unix.IPPROTO_IP,
 			Type:  unix.IP_PKTINFO,
 			Len:   unix.SizeofInet4Pktinfo + unix.SizeofCmsghdr,
 		},
-		unix.Inet4Pktinfo{
+		pktinfo: unix.Inet4Pktinfo{
 			Spec_dst: end.src4().Src,
 			Ifindex:  end.src4().Ifindex,
 		},
 	}
+	oob := (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:cmsg.setTOS(ds)]
 
 	end.Lock()
-	_, err := unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst4(), 0)
+	_, err := unix.SendmsgN(sock, buff, oob, end.dst4(), 0)
 	end.Unlock()
 
 	if err == nil {
@@ -499,27 +667,36 @@ func send4(sock int, end *NativeEndpoint, buff []byte) error {
 		end.ClearSrc()
 		cmsg.pktinfo = unix.Inet4Pktinfo{}
 		end.Lock()
-		_, err = unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst4(), 0)
+		_, err = unix.SendmsgN(sock, buff, oob, end.dst4(), 0)
 		end.Unlock()
 	}
 
+	if err == unix.EMSGSIZE {
+		err = ErrMessageTooBig
+	}
 	return err
 }
 
-func send6(sock int, end *NativeEndpoint, buff []byte) error {
+/* Flow labels are free to use, unless a socket in the network namespace
+ * leases one exclusively (IPV6_FLOWLABEL_MGR), after which sending with a
+ * label not leased to the socket fails with EINVAL.
+ */
+var errFlowLabelRefused = errors.New("conn: flow label refused, sent without")
+
+/* Sends buff from the IPv6 socket, returning errFlowLabelRefused if it
+ * was sent, but only after dropping its flow label.
+ */
+func send6(sock int, end *NativeEndpoint, buff []byte, ds byte, flowLabel uint32) error {
 
 	// construct message header
 
-	cmsg := struct {
-		cmsghdr unix.Cmsghdr
-		pktinfo unix.Inet6Pktinfo
-	}{
-		unix.Cmsghdr{
+	cmsg := cmsg6{
+		cmsghdr: unix.Cmsghdr{
 			Level: unix.IPPROTO_IPV6,
 			Type:  unix.IPV6_PKTINFO,
 			Len:   unix.SizeofInet6Pktinfo + unix.SizeofCmsghdr,
 		},
-		unix.Inet6Pktinfo{
+		pktinfo: unix.Inet6Pktinfo{
 			Addr:    end.src6().src,
 			Ifindex: end.dst6().ZoneId,
 		},
@@ -528,41 +705,54 @@ func send6(sock int, end *NativeEndpoint, buff []byte) error {
 	if cmsg.pktinfo.Addr == [16]byte{} {
 		cmsg.pktinfo.Ifindex = 0
 	}
+	oob := (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:cmsg.setTClass(ds, flowLabel)]
 
 	end.Lock()
-	_, err := unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst6(), 0)
+	_, err := unix.SendmsgN(sock, buff, oob, end.dst6(), 0)
 	end.Unlock()
 
 	if err == nil {
 		return nil
 	}
 
+	// drop the flow label and retry
+
+	if err == unix.EINVAL && flowLabel != 0 {
+		oob = oob[:cmsg.setTClass(ds, 0)]
+		end.Lock()
+		_, err = unix.SendmsgN(sock, buff, oob, end.dst6(), 0)
+		end.Unlock()
+		if err == nil {
+			return errFlowLabelRefused
+		}
+	}
+
 	// clear src and retry
 
 	if err == unix.EINVAL {
 		end.ClearSrc()
 		cmsg.pktinfo = unix.Inet6Pktinfo{}
 		end.Lock()
-		_, err = unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst6(), 0)
+		_, err = unix.SendmsgN(sock, buff, oob, end.dst6(), 0)
 		end.Unlock()
 	}
 
+	if err == unix.EMSGSIZE {
+		err = ErrMessageTooBig
+	}
 	return err
 }
 
-func receive4(sock int, buff []byte, end *NativeEndpoint) (int, *net.UDPAddr, error) {
+func receive4(sock int, buff []byte, end *NativeEndpoint) (int, byte, *net.UDPAddr, error) {
 
 	// construct message header
 
-	var cmsg struct {
-		cmsghdr unix.Cmsghdr
-		pktinfo unix.Inet4Pktinfo
-	}
+	var cmsg cmsg4
 
 	size, _, _, newDst, err := unix.Recvmsg(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], 0)
 
 	if err != nil {
-		return 0, nil, err
+		return 0, 0, nil, err
 	}
 	end.isV6 = false
 
@@ -579,22 +769,19 @@ func receive4(sock int, buff []byte, end *NativeEndpoint) (int, *net.UDPAddr, er
 		end.src4().Ifindex = cmsg.pktinfo.Ifindex
 	}
 
-	return size, end.dstAsUDPAddr(), nil
+	return size, cmsg.receivedTOS(), end.dstAsUDPAddr(), nil
 }
 
-func receive6(sock int, buff []byte, end *NativeEndpoint) (int, *net.UDPAddr, error) {
+func receive6(sock int, buff []byte, end *NativeEndpoint) (int, byte, *net.UDPAddr, error) {
 
 	// construct message header
 
-	var cmsg struct {
-		cmsghdr unix.Cmsghdr
-		pktinfo unix.Inet6Pktinfo
-	}
+	var cmsg cmsg6
 
 	size, _, _, newDst, err := unix.Recvmsg(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], 0)
 
 	if err != nil {
-		return 0, nil, err
+		return 0, 0, nil, err
 	}
 	end.isV6 = true
 
@@ -611,5 +798,5 @@ func receive6(sock int, buff []byte, end *NativeEndpoint) (int, *net.UDPAddr, er
 		end.dst6().ZoneId = cmsg.pktinfo.Ifindex
 	}
 
-	return size, end.dstAsUDPAddr(), nil
+	return size, cmsg.receivedTClass(), end.dstAsUDPAddr(), nil
 }
@@ -0,0 +1,97 @@
+// +build !android
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCreateBindFromFDs(t *testing.T) {
+	a, b, end := newLoopbackPair(t)
+	defer a.Close()
+
+	// a process taking over receives duplicates of the sockets
+
+	ipv4, ipv6 := b.FDs()
+	dup4, err := unix.Dup(ipv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipv6 == FD_ERR {
+		unix.Close(dup4)
+		t.Skip("no IPv6 socket")
+	}
+	dup6, err := unix.Dup(ipv6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adopted, adoptedPort, err := CreateBindFromFDs(dup4, dup6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer adopted.Close()
+	sa, err := unix.Getsockname(ipv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port := sa.(*unix.SockaddrInet4).Port; int(adoptedPort) != port {
+		t.Errorf("adopted port %d, want %d", adoptedPort, port)
+	}
+	b.Close()
+
+	if err := a.Send([]byte("hello"), end); err != nil {
+		t.Fatal(err)
+	}
+	buff := make([]byte, 64)
+	n, _, _, err := adopted.ReceiveIPv4(buff)
+	if err != nil || string(buff[:n]) != "hello" {
+		t.Errorf("adopted bind received %q, %v", buff[:n], err)
+	}
+
+	// sockets of the wrong kind or family are refused
+
+	tcp, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := CreateBindFromFDs(tcp, FD_ERR); err == nil {
+		t.Error("adopted a stream socket")
+	}
+	udp6, err := unix.Socket(unix.AF_INET6, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Skip("no IPv6:", err)
+	}
+	if _, _, err := CreateBindFromFDs(udp6, FD_ERR); err == nil {
+		t.Error("adopted an IPv6 socket as IPv4")
+	}
+	if _, _, err := CreateBindFromFDs(FD_ERR, FD_ERR); err == nil {
+		t.Error("adopted no sockets")
+	}
+}
+
+func TestCreateBindToFamily(t *testing.T) {
+	for _, family := range []int{4, 6} {
+		bind, port, err := CreateBindToFamily(family, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if port == 0 {
+			t.Errorf("IPv%d bind to port 0", family)
+		}
+		ipv4, ipv6 := bind.(FDBind).FDs()
+		if (ipv4 == FD_ERR) != (family == 6) || (ipv6 == FD_ERR) != (family == 4) {
+			t.Errorf("IPv%d bind with sockets %d and %d", family, ipv4, ipv6)
+		}
+		bind.Close()
+	}
+	if _, _, err := CreateBindToFamily(5, 0, nil); err == nil {
+		t.Error("bind to address family 5")
+	}
+}
@@ -0,0 +1,72 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func loopbackInterface(t *testing.T) net.Interface {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, intr := range interfaces {
+		if intr.Flags&net.FlagLoopback != 0 {
+			return intr
+		}
+	}
+	t.Skip("no loopback interface")
+	return net.Interface{}
+}
+
+func TestScopedEndpoint(t *testing.T) {
+	lo := loopbackInterface(t)
+
+	// the zone is kept, by name or by index
+
+	named := "[fe80::1%" + lo.Name + "]:51820"
+	for _, s := range []string{named, "[fe80::1%" + strconv.Itoa(lo.Index) + "]:51820"} {
+		end, err := CreateEndpoint(s)
+		if err != nil {
+			t.Fatalf("CreateEndpoint(%q): %v", s, err)
+		}
+		got := end.DstToString()
+		if got != s && got != named {
+			t.Errorf("CreateEndpoint(%q).DstToString() = %q", s, got)
+		}
+		addrs := end.Addrs()
+		if len(addrs) != 1 || addrs[0].String() != got {
+			t.Errorf("CreateEndpoint(%q).Addrs() = %v, want %s", s, addrs, got)
+		}
+
+		// and survives updates from received packets
+
+		addr, err := net.ResolveUDPAddr("udp6", got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr.Port = 51821
+		if err := end.UpdateDst(addr); err != nil {
+			t.Fatal(err)
+		}
+		if want := got[:len(got)-1] + "1"; end.DstToString() != want {
+			t.Errorf("after UpdateDst: %q, want %q", end.DstToString(), want)
+		}
+	}
+
+	for _, bad := range []string{"[fe80::1%no-such-interface]:51820", "127.0.0.1%" + lo.Name + ":51820"} {
+		if _, err := CreateEndpoint(bad); err == nil {
+			t.Errorf("CreateEndpoint(%q) succeeded", bad)
+		}
+	}
+
+	if end, err := CreateEndpoint("[fe80::1]:51820"); err != nil || end.DstToString() != "[fe80::1]:51820" {
+		t.Errorf("unscoped endpoint: %v, %v", end, err)
+	}
+}
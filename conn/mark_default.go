@@ -8,5 +8,8 @@
 package conn
 
 func (bind *nativeBind) SetMark(mark uint32) error {
-	return nil
+	if mark == 0 {
+		return nil
+	}
+	return ErrMarkUnsupported
 }
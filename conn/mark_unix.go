@@ -29,7 +29,10 @@ func init() {
 func (bind *nativeBind) SetMark(mark uint32) error {
 	var operr error
 	if fwmarkIoctl == 0 {
-		return nil
+		if mark == 0 {
+			return nil
+		}
+		return ErrMarkUnsupported
 	}
 	if bind.ipv4 != nil {
 		fd, err := bind.ipv4.SyscallConn()
@@ -0,0 +1,479 @@
+// +build !android
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+/* Batched I/O using sendmmsg(2) and recvmmsg(2).
+ *
+ * Kernels without these calls are detected on first use,
+ * after which the bind falls back to one datagram per system call.
+ */
+
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+/* Control messages for sending and receiving, optionally followed by
+ * the DS field of the datagram, and for IPv6, its flow label. The layout
+ * matches CMSG_SPACE, and the kernel delivers the packet info before the
+ * DS field on receive.
+ */
+
+type cmsgInt struct {
+	cmsghdr unix.Cmsghdr
+	value   int32
+}
+
+type cmsg4 struct {
+	cmsghdr unix.Cmsghdr
+	pktinfo unix.Inet4Pktinfo
+	tos     cmsgInt
+}
+
+type cmsg6 struct {
+	cmsghdr  unix.Cmsghdr
+	pktinfo  unix.Inet6Pktinfo
+	tclass   cmsgInt
+	flowinfo cmsgInt
+}
+
+const (
+	ipv6FlowInfo  = 0xb     // IPV6_FLOWINFO, missing from x/sys/unix
+	flowLabelMask = 0xfffff // the 20 low bits of the IPv6 flow information
+)
+
+func (cmsg *cmsg4) setTOS(ds byte) int {
+	if ds == 0 {
+		return int(unsafe.Offsetof(cmsg.tos))
+	}
+	cmsg.tos = cmsgInt{
+		unix.Cmsghdr{
+			Level: unix.IPPROTO_IP,
+			Type:  unix.IP_TOS,
+			Len:   unix.SizeofCmsghdr + 4,
+		},
+		int32(ds),
+	}
+	return int(unsafe.Sizeof(*cmsg))
+}
+
+/* Sets the traffic class and flow label of the datagram, returning the
+ * length of the control messages. Fields left at zero are not sent, the
+ * flow label moving up into the place of the traffic class if need be.
+ */
+func (cmsg *cmsg6) setTClass(ds byte, flowLabel uint32) int {
+	slots := [...]*cmsgInt{&cmsg.tclass, &cmsg.flowinfo}
+	n := 0
+	if ds != 0 {
+		*slots[n] = cmsgInt{
+			unix.Cmsghdr{
+				Level: unix.IPPROTO_IPV6,
+				Type:  unix.IPV6_TCLASS,
+				Len:   unix.SizeofCmsghdr + 4,
+			},
+			int32(ds),
+		}
+		n++
+	}
+	if flowLabel != 0 {
+		*slots[n] = cmsgInt{
+			cmsghdr: unix.Cmsghdr{
+				Level: unix.IPPROTO_IPV6,
+				Type:  ipv6FlowInfo,
+				Len:   unix.SizeofCmsghdr + 4,
+			},
+		}
+		binary.BigEndian.PutUint32((*[4]byte)(unsafe.Pointer(&slots[n].value))[:], flowLabel&flowLabelMask)
+		n++
+	}
+	return int(unsafe.Offsetof(cmsg.tclass) + uintptr(n)*unsafe.Sizeof(cmsg.tclass))
+}
+
+/* Returns the DS field of a received datagram, 0 if not delivered.
+ * The kernel passes the IPv4 TOS as a single byte.
+ */
+func (cmsg *cmsg4) receivedTOS() byte {
+	if cmsg.tos.cmsghdr.Level != unix.IPPROTO_IP || cmsg.tos.cmsghdr.Type != unix.IP_TOS {
+		return 0
+	}
+	return *(*byte)(unsafe.Pointer(&cmsg.tos.value))
+}
+
+func (cmsg *cmsg6) receivedTClass() byte {
+	if cmsg.tclass.cmsghdr.Level != unix.IPPROTO_IPV6 || cmsg.tclass.cmsghdr.Type != unix.IPV6_TCLASS {
+		return 0
+	}
+	return byte(cmsg.tclass.value)
+}
+
+/* Scratch space for a single batch call, kept around to avoid
+ * allocating message headers for every call.
+ */
+type mmsgBuffers struct {
+	sync.Mutex
+	msgs   [MaxBatchSize]mmsghdr
+	iovs   [MaxBatchSize]unix.Iovec
+	names  [MaxBatchSize]unix.RawSockaddrInet6 // large enough for either family
+	cmsgs4 [MaxBatchSize]cmsg4
+	cmsgs6 [MaxBatchSize]cmsg6
+}
+
+var mmsgPool = sync.Pool{
+	New: func() interface{} {
+		return new(mmsgBuffers)
+	},
+}
+
+func recvmmsg(sock int, msgs []mmsghdr, flags int) (int, error) {
+	n, _, errno := unix.Syscall6(
+		unix.SYS_RECVMMSG,
+		uintptr(sock),
+		uintptr(unsafe.Pointer(&msgs[0])),
+		uintptr(len(msgs)),
+		uintptr(flags),
+		0,
+		0,
+	)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+func sendmmsg(sock int, msgs []mmsghdr, flags int) (int, error) {
+	n, _, errno := unix.Syscall6(
+		unix.SYS_SENDMMSG,
+		uintptr(sock),
+		uintptr(unsafe.Pointer(&msgs[0])),
+		uintptr(len(msgs)),
+		uintptr(flags),
+		0,
+		0,
+	)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+/* Ports in raw socket addresses are in network byte order */
+
+func rawPort(port *uint16) int {
+	p := (*[2]byte)(unsafe.Pointer(port))
+	return int(p[0])<<8 | int(p[1])
+}
+
+func setRawPort(port *uint16, value int) {
+	p := (*[2]byte)(unsafe.Pointer(port))
+	p[0] = byte(value >> 8)
+	p[1] = byte(value)
+}
+
+func (bind *nativeBind) ReceiveIPv6Batch(packets []Packet) (int, error) {
+	if bind.sock6 == -1 {
+		return 0, syscall.EAFNOSUPPORT
+	}
+	return bind.receiveBatch(bind.sock6, &bind.batch6, true, packets)
+}
+
+func (bind *nativeBind) ReceiveIPv4Batch(packets []Packet) (int, error) {
+	if bind.sock4 == -1 {
+		return 0, syscall.EAFNOSUPPORT
+	}
+	return bind.receiveBatch(bind.sock4, &bind.batch4, false, packets)
+}
+
+func (bind *nativeBind) receiveBatch(sock int, b *mmsgBuffers, isV6 bool, packets []Packet) (int, error) {
+	if len(packets) == 0 {
+		return 0, nil
+	}
+	if atomic.LoadUint32(&bind.noMmsg) != 0 {
+		return receiveSingle(sock, isV6, packets)
+	}
+	if len(packets) > MaxBatchSize {
+		packets = packets[:MaxBatchSize]
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	// construct message headers
+
+	msgs := b.msgs[:len(packets)]
+	for i := range msgs {
+		b.iovs[i].Base = &packets[i].Buffer[0]
+		b.iovs[i].SetLen(len(packets[i].Buffer))
+
+		msgs[i] = mmsghdr{}
+		hdr := &msgs[i].hdr
+		hdr.Name = (*byte)(unsafe.Pointer(&b.names[i]))
+		hdr.Namelen = unix.SizeofSockaddrInet6
+		hdr.Iov = &b.iovs[i]
+		hdr.SetIovlen(1)
+		if isV6 {
+			b.cmsgs6[i] = cmsg6{}
+			hdr.Control = (*byte)(unsafe.Pointer(&b.cmsgs6[i]))
+			hdr.SetControllen(int(unsafe.Sizeof(b.cmsgs6[i])))
+		} else {
+			b.cmsgs4[i] = cmsg4{}
+			hdr.Control = (*byte)(unsafe.Pointer(&b.cmsgs4[i]))
+			hdr.SetControllen(int(unsafe.Sizeof(b.cmsgs4[i])))
+		}
+	}
+
+	n, err := recvmmsg(sock, msgs, unix.MSG_WAITFORONE)
+	if err == unix.ENOSYS {
+		atomic.StoreUint32(&bind.noMmsg, 1)
+		return receiveSingle(sock, isV6, packets)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// update endpoints and source caches
+
+	for i := 0; i < n; i++ {
+		end := new(NativeEndpoint)
+		end.isV6 = isV6
+		if isV6 {
+			raw := (*unix.RawSockaddrInet6)(unsafe.Pointer(&b.names[i]))
+			if raw.Family == unix.AF_INET6 {
+				dst := end.dst6()
+				dst.Port = rawPort(&raw.Port)
+				dst.ZoneId = raw.Scope_id
+				dst.Addr = raw.Addr
+			}
+			cmsg := &b.cmsgs6[i]
+			if cmsg.cmsghdr.Level == unix.IPPROTO_IPV6 &&
+				cmsg.cmsghdr.Type == unix.IPV6_PKTINFO &&
+				cmsg.cmsghdr.Len >= unix.SizeofInet6Pktinfo {
+				end.src6().src = cmsg.pktinfo.Addr
+				end.dst6().ZoneId = cmsg.pktinfo.Ifindex
+			}
+			packets[i].DS = cmsg.receivedTClass()
+		} else {
+			raw := (*unix.RawSockaddrInet4)(unsafe.Pointer(&b.names[i]))
+			if raw.Family == unix.AF_INET {
+				dst := end.dst4()
+				dst.Port = rawPort(&raw.Port)
+				dst.Addr = raw.Addr
+			}
+			cmsg := &b.cmsgs4[i]
+			if cmsg.cmsghdr.Level == unix.IPPROTO_IP &&
+				cmsg.cmsghdr.Type == unix.IP_PKTINFO &&
+				cmsg.cmsghdr.Len >= unix.SizeofInet4Pktinfo {
+				end.src4().Src = cmsg.pktinfo.Spec_dst
+				end.src4().Ifindex = cmsg.pktinfo.Ifindex
+			}
+			packets[i].DS = cmsg.receivedTOS()
+		}
+		packets[i].N = int(msgs[i].len)
+		packets[i].Endpoint = end
+		packets[i].Addr = end.dstAsUDPAddr()
+	}
+
+	return n, nil
+}
+
+func receiveSingle(sock int, isV6 bool, packets []Packet) (int, error) {
+	var (
+		n    int
+		ds   byte
+		addr *net.UDPAddr
+		err  error
+	)
+	end := new(NativeEndpoint)
+	if isV6 {
+		n, ds, addr, err = receive6(sock, packets[0].Buffer, end)
+	} else {
+		n, ds, addr, err = receive4(sock, packets[0].Buffer, end)
+	}
+	if err != nil {
+		return 0, err
+	}
+	packets[0].N = n
+	packets[0].Endpoint = end
+	packets[0].Addr = addr
+	packets[0].DS = ds
+	return 1, nil
+}
+
+func (bind *nativeBind) SendBatch(packets []Packet) error {
+	var err error
+	for len(packets) > 0 {
+
+		// split into runs of the same address family
+
+		isV6 := packets[0].Endpoint.(*NativeEndpoint).isV6
+		n := 1
+		for n < len(packets) && n < MaxBatchSize && packets[n].Endpoint.(*NativeEndpoint).isV6 == isV6 {
+			n++
+		}
+
+		if e := bind.sendBatch(isV6, packets[:n]); e != nil && err == nil {
+			err = e
+		}
+		packets = packets[n:]
+	}
+	return err
+}
+
+func (bind *nativeBind) sendBatch(isV6 bool, packets []Packet) error {
+	sock := bind.sock4
+	if isV6 {
+		sock = bind.sock6
+	}
+	if sock == -1 {
+		return syscall.EAFNOSUPPORT
+	}
+	if len(packets) == 1 || atomic.LoadUint32(&bind.noMmsg) != 0 {
+		return bind.sendSingle(sock, isV6, packets)
+	}
+
+	b := mmsgPool.Get().(*mmsgBuffers)
+	defer mmsgPool.Put(b)
+
+	// construct message headers
+
+	msgs := b.msgs[:len(packets)]
+	for i := range msgs {
+		p := &packets[i]
+		end := p.Endpoint.(*NativeEndpoint)
+
+		b.iovs[i].Base = &p.Buffer[0]
+		b.iovs[i].SetLen(p.N)
+
+		msgs[i] = mmsghdr{}
+		hdr := &msgs[i].hdr
+		hdr.Name = (*byte)(unsafe.Pointer(&b.names[i]))
+		hdr.Iov = &b.iovs[i]
+		hdr.SetIovlen(1)
+
+		end.Lock()
+		if isV6 {
+			dst := end.dst6()
+			raw := (*unix.RawSockaddrInet6)(unsafe.Pointer(&b.names[i]))
+			*raw = unix.RawSockaddrInet6{
+				Family:   unix.AF_INET6,
+				Addr:     dst.Addr,
+				Scope_id: dst.ZoneId,
+			}
+			setRawPort(&raw.Port, dst.Port)
+			hdr.Namelen = unix.SizeofSockaddrInet6
+
+			b.cmsgs6[i] = cmsg6{
+				cmsghdr: unix.Cmsghdr{
+					Level: unix.IPPROTO_IPV6,
+					Type:  unix.IPV6_PKTINFO,
+					Len:   unix.SizeofInet6Pktinfo + unix.SizeofCmsghdr,
+				},
+				pktinfo: unix.Inet6Pktinfo{
+					Addr:    end.src6().src,
+					Ifindex: dst.ZoneId,
+				},
+			}
+			if b.cmsgs6[i].pktinfo.Addr == [16]byte{} {
+				b.cmsgs6[i].pktinfo.Ifindex = 0
+			}
+			hdr.Control = (*byte)(unsafe.Pointer(&b.cmsgs6[i]))
+			hdr.SetControllen(b.cmsgs6[i].setTClass(p.DS, bind.flowLabel(p.FlowLabel)))
+		} else {
+			dst := end.dst4()
+			raw := (*unix.RawSockaddrInet4)(unsafe.Pointer(&b.names[i]))
+			*raw = unix.RawSockaddrInet4{
+				Family: unix.AF_INET,
+				Addr:   dst.Addr,
+			}
+			setRawPort(&raw.Port, dst.Port)
+			hdr.Namelen = unix.SizeofSockaddrInet4
+
+			b.cmsgs4[i] = cmsg4{
+				cmsghdr: unix.Cmsghdr{
+					Level: unix.IPPROTO_IP,
+					Type:  unix.IP_PKTINFO,
+					Len:   unix.SizeofInet4Pktinfo + unix.SizeofCmsghdr,
+				},
+				pktinfo: unix.Inet4Pktinfo{
+					Spec_dst: end.src4().Src,
+					Ifindex:  end.src4().Ifindex,
+				},
+			}
+			hdr.Control = (*byte)(unsafe.Pointer(&b.cmsgs4[i]))
+			hdr.SetControllen(b.cmsgs4[i].setTOS(p.DS))
+		}
+		end.Unlock()
+	}
+
+	var err error
+	for sent := 0; sent < len(msgs); {
+		n, e := sendmmsg(sock, msgs[sent:], 0)
+		if e == unix.ENOSYS {
+			atomic.StoreUint32(&bind.noMmsg, 1)
+			if e := bind.sendSingle(sock, isV6, packets[sent:]); e != nil && err == nil {
+				err = e
+			}
+			break
+		}
+		if e != nil {
+
+			// let the single packet path handle the failing datagram,
+			// which also retries with a cleared source on EINVAL
+
+			if e := bind.sendSingle(sock, isV6, packets[sent:sent+1]); e != nil && err == nil {
+				err = e
+			}
+			sent++
+			continue
+		}
+		sent += n
+	}
+	return err
+}
+
+func (bind *nativeBind) sendSingle(sock int, isV6 bool, packets []Packet) error {
+	var err error
+	for i := range packets {
+		end := packets[i].Endpoint.(*NativeEndpoint)
+		buff := packets[i].Buffer[:packets[i].N]
+		var e error
+		if isV6 {
+			e = send6(sock, end, buff, packets[i].DS, bind.flowLabel(packets[i].FlowLabel))
+			if e == errFlowLabelRefused {
+				atomic.StoreUint32(&bind.noFlowLabel, 1)
+				e = nil
+			}
+		} else {
+			e = send4(sock, end, buff, packets[i].DS)
+		}
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+/* Returns the flow label to send a datagram with, 0 once the kernel has
+ * refused one.
+ */
+func (bind *nativeBind) flowLabel(label uint32) uint32 {
+	if label == 0 || atomic.LoadUint32(&bind.noFlowLabel) != 0 {
+		return 0
+	}
+	return label & flowLabelMask
+}
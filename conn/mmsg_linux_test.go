@@ -0,0 +1,195 @@
+// +build !android
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func newLoopbackPair(tb testing.TB) (*nativeBind, *nativeBind, Endpoint) {
+	tb.Helper()
+	a, _, err := CreateBind(0, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	b, port, err := CreateBind(0, nil)
+	if err != nil {
+		a.Close()
+		tb.Fatal(err)
+	}
+	end, err := CreateEndpoint(fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		a.Close()
+		b.Close()
+		tb.Fatal(err)
+	}
+	return a, b, end
+}
+
+func TestBatchRoundTrip(t *testing.T) {
+	a, b, end := newLoopbackPair(t)
+	defer a.Close()
+	defer b.Close()
+
+	const count = 8
+	send := make([]Packet, count)
+	for i := range send {
+		buf := bytes.Repeat([]byte{byte(i)}, 100+i)
+		send[i] = Packet{Buffer: buf, N: len(buf), Endpoint: end}
+		if i%2 == 1 {
+			send[i].DS = 0xba // EF, ECT(0)
+		}
+	}
+	if err := a.SendBatch(send); err != nil {
+		t.Fatal(err)
+	}
+
+	recv := make([]Packet, MaxBatchSize)
+	for i := range recv {
+		recv[i].Buffer = make([]byte, 1500)
+	}
+	got := 0
+	for got < count {
+		n, err := b.ReceiveIPv4Batch(recv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range recv[:n] {
+			want := send[got].Buffer
+			if !bytes.Equal(p.Buffer[:p.N], want) {
+				t.Fatalf("packet %d: got %d bytes, want %d", got, p.N, len(want))
+			}
+			if p.DS != send[got].DS {
+				t.Fatalf("packet %d: got DS %#x, want %#x", got, p.DS, send[got].DS)
+			}
+			if p.Addr == nil || !p.Addr.IP.IsLoopback() {
+				t.Fatalf("packet %d: unexpected source %v", got, p.Addr)
+			}
+			got++
+		}
+	}
+}
+
+func TestBatchFlowLabel(t *testing.T) {
+	a, _, err := CreateBind(0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if a.sock6 == -1 {
+		t.Skip("no IPv6")
+	}
+
+	// receive on a plain socket, reporting the flow information
+
+	sock, err := unix.Socket(unix.AF_INET6, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer unix.Close(sock)
+	if err := unix.Bind(sock, &unix.SockaddrInet6{Addr: [16]byte{15: 1}}); err != nil {
+		t.Skip(err)
+	}
+	if err := unix.SetsockoptInt(sock, unix.IPPROTO_IPV6, ipv6FlowInfo, 1); err != nil {
+		t.Skip(err)
+	}
+	unix.SetsockoptTimeval(sock, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 1})
+	sa, _ := unix.Getsockname(sock)
+	end, err := CreateEndpoint(fmt.Sprintf("[::1]:%d", sa.(*unix.SockaddrInet6).Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unlabeled datagrams may be labeled by the kernel (auto_flowlabels)
+
+	send := []Packet{
+		{FlowLabel: 0x12345},
+		{FlowLabel: 0xabcde, DS: 0xb8},
+		{DS: 0xb8},
+		{},
+	}
+	for i := range send {
+		send[i].Buffer = []byte{byte(i)}
+		send[i].N = 1
+		send[i].Endpoint = end
+	}
+	for _, batch := range [][]Packet{send, send[:1]} {
+		if err := a.SendBatch(batch); err != nil {
+			t.Fatal(err)
+		}
+		for range batch {
+			buff := make([]byte, 16)
+			oob := make([]byte, 64)
+			n, oobn, _, _, err := unix.Recvmsg(sock, buff, oob, 0)
+			if err != nil || n != 1 {
+				t.Fatalf("received %d bytes: %v", n, err)
+			}
+			msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+			if err != nil {
+				t.Fatal(err)
+			}
+			var label uint32
+			for _, msg := range msgs {
+				if msg.Header.Level == unix.IPPROTO_IPV6 && msg.Header.Type == ipv6FlowInfo && len(msg.Data) >= 4 {
+					label = binary.BigEndian.Uint32(msg.Data) & flowLabelMask
+				}
+			}
+			if want := send[buff[0]].FlowLabel; want != 0 && label != want {
+				t.Errorf("packet %d: flow label %#x, want %#x", buff[0], label, want)
+			}
+		}
+	}
+}
+
+func benchmarkSend(b *testing.B, batch bool) {
+	tx, rx, end := newLoopbackPair(b)
+	defer tx.Close()
+	defer rx.Close()
+
+	go func() {
+		packets := make([]Packet, MaxBatchSize)
+		for i := range packets {
+			packets[i].Buffer = make([]byte, 1500)
+		}
+		for {
+			if _, err := rx.ReceiveIPv4Batch(packets); err != nil {
+				return
+			}
+		}
+	}()
+
+	packets := make([]Packet, MaxBatchSize)
+	buf := make([]byte, 1400)
+	for i := range packets {
+		packets[i] = Packet{Buffer: buf, N: len(buf), Endpoint: end}
+	}
+
+	b.SetBytes(int64(len(buf) * len(packets)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if batch {
+			if err := tx.SendBatch(packets); err != nil {
+				b.Fatal(err)
+			}
+			continue
+		}
+		for _, p := range packets {
+			if err := tx.Send(p.Buffer, p.Endpoint); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkSend(b *testing.B)      { benchmarkSend(b, false) }
+func BenchmarkSendBatch(b *testing.B) { benchmarkSend(b, true) }
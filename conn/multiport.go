@@ -0,0 +1,218 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+/* A multi-port bind listens on several ports at once, with a bind for
+ * each, so that a peer kept from one port by a middlebox can reach the
+ * device on another. Datagrams are received from all of the binds, and
+ * once the receiver has found one authentic, calling Heard on its
+ * endpoint, datagrams to its address leave from the port it arrived on.
+ * Forged datagrams thus cannot move replies to another port. Addresses
+ * not heard from are sent to from the first bind.
+ *
+ * Every bind is read by goroutines of its own, which hand datagrams over
+ * to the receive functions at the cost of a copy each. Batching and path
+ * MTU discovery are not available through the wrapper.
+ */
+
+const (
+	multiPortBufferSize = 1<<16 - 1 // largest UDP payload
+	multiPortHeardMax   = 1 << 12   // addresses heard from remembered, before they are forgotten
+)
+
+// A HeardEndpoint is received from a Bind which needs to be told when a
+// datagram from it was found authentic, such as one listening on several
+// ports. Heard must be called for authentic datagrams only.
+type HeardEndpoint interface {
+	Endpoint
+	Heard()
+}
+
+// A MultiPortEndpoint is received from a Bind listening on several
+// ports. BindIndex returns the index, among the binds given to
+// NewMultiPortBind, of the one it was received from.
+type MultiPortEndpoint interface {
+	Endpoint
+	BindIndex() int
+}
+
+type multiPortEndpoint struct {
+	Endpoint
+	bind  *multiPortBind
+	index int // index of the bind the endpoint was received from
+}
+
+/* Has replies to the address of the endpoint leave from the bind it was
+ * received from.
+ */
+func (end *multiPortEndpoint) Heard() {
+	bind := end.bind
+	bind.heard.RLock()
+	index, ok := bind.heard.index[string(end.DstToBytes())]
+	bind.heard.RUnlock()
+	if ok && index == end.index {
+		return
+	}
+	bind.heard.Lock()
+	if len(bind.heard.index) >= multiPortHeardMax {
+		bind.heard.index = make(map[string]int)
+	}
+	bind.heard.index[string(end.DstToBytes())] = end.index
+	bind.heard.Unlock()
+}
+
+func (end *multiPortEndpoint) BindIndex() int {
+	return end.index
+}
+
+type multiPortDatagram struct {
+	buff *[multiPortBufferSize]byte
+	n    int
+	end  Endpoint
+	addr *net.UDPAddr
+}
+
+type multiPortFamily struct {
+	datagrams chan multiPortDatagram
+	mu        sync.Mutex
+	err       error // last receive error, set before datagrams is closed
+}
+
+type multiPortBind struct {
+	binds   []Bind
+	ipv4    multiPortFamily
+	ipv6    multiPortFamily
+	pool    sync.Pool
+	close   sync.Once
+	closing chan struct{}
+
+	heard struct {
+		sync.RWMutex
+		index map[string]int // bind last heard from, by address
+	}
+}
+
+// NewMultiPortBind returns a Bind receiving on all of binds, typically
+// listening on different ports, and replying through the bind each
+// endpoint was heard on. Closing it closes all of binds.
+func NewMultiPortBind(binds []Bind) Bind {
+	bind := &multiPortBind{
+		binds:   binds,
+		closing: make(chan struct{}),
+	}
+	bind.heard.index = make(map[string]int)
+	bind.pool.New = func() interface{} {
+		return new([multiPortBufferSize]byte)
+	}
+	bind.ipv4.datagrams = make(chan multiPortDatagram)
+	bind.ipv6.datagrams = make(chan multiPortDatagram)
+
+	var ipv4, ipv6 sync.WaitGroup
+	ipv4.Add(len(binds))
+	ipv6.Add(len(binds))
+	for i, inner := range binds {
+		go bind.routineReceive(&bind.ipv4, &ipv4, i, inner.ReceiveIPv4)
+		go bind.routineReceive(&bind.ipv6, &ipv6, i, inner.ReceiveIPv6)
+	}
+	go bind.closeFamily(&bind.ipv4, &ipv4)
+	go bind.closeFamily(&bind.ipv6, &ipv6)
+	return bind
+}
+
+/* Closes the datagrams of family once all binds have stopped receiving it,
+ * so that the receive function returns the error of the last to stop.
+ */
+func (bind *multiPortBind) closeFamily(family *multiPortFamily, receivers *sync.WaitGroup) {
+	receivers.Wait()
+	close(family.datagrams)
+}
+
+func (bind *multiPortBind) routineReceive(family *multiPortFamily, receivers *sync.WaitGroup, index int, receive func([]byte) (int, Endpoint, *net.UDPAddr, error)) {
+	defer receivers.Done()
+	for {
+		buff := bind.pool.Get().(*[multiPortBufferSize]byte)
+		n, end, addr, err := receive(buff[:])
+		if err != nil {
+			bind.pool.Put(buff)
+			family.mu.Lock()
+			family.err = err
+			family.mu.Unlock()
+			return
+		}
+		select {
+		case family.datagrams <- multiPortDatagram{buff, n, &multiPortEndpoint{end, bind, index}, addr}:
+		case <-bind.closing:
+			bind.pool.Put(buff)
+			return
+		}
+	}
+}
+
+func (bind *multiPortBind) receive(family *multiPortFamily, buff []byte) (int, Endpoint, *net.UDPAddr, error) {
+	select {
+	case <-bind.closing:
+		return 0, nil, nil, errors.New("bind closed")
+	case datagram, ok := <-family.datagrams:
+		if !ok {
+			family.mu.Lock()
+			defer family.mu.Unlock()
+			return 0, nil, nil, family.err
+		}
+		n := copy(buff, datagram.buff[:datagram.n])
+		bind.pool.Put(datagram.buff)
+		return n, datagram.end, datagram.addr, nil
+	}
+}
+
+func (bind *multiPortBind) ReceiveIPv6(buff []byte) (int, Endpoint, *net.UDPAddr, error) {
+	return bind.receive(&bind.ipv6, buff)
+}
+
+func (bind *multiPortBind) ReceiveIPv4(buff []byte) (int, Endpoint, *net.UDPAddr, error) {
+	return bind.receive(&bind.ipv4, buff)
+}
+
+func (bind *multiPortBind) Send(buff []byte, end Endpoint) error {
+	if received, ok := end.(*multiPortEndpoint); ok {
+		return bind.binds[received.index].Send(buff, received.Endpoint)
+	}
+	bind.heard.RLock()
+	index := bind.heard.index[string(end.DstToBytes())]
+	bind.heard.RUnlock()
+	return bind.binds[index].Send(buff, end)
+}
+
+func (bind *multiPortBind) SetMark(value uint32) error {
+	for _, inner := range bind.binds {
+		if err := inner.SetMark(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bind *multiPortBind) LastMark() uint32 {
+	return bind.binds[0].LastMark()
+}
+
+func (bind *multiPortBind) Close() error {
+	var err error
+	bind.close.Do(func() {
+		close(bind.closing)
+		for _, inner := range bind.binds {
+			if err1 := inner.Close(); err1 != nil && err == nil {
+				err = err1
+			}
+		}
+	})
+	return err
+}
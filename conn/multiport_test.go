@@ -0,0 +1,97 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+/* A bind receiving IPv4 datagrams from a channel, and recording those sent.
+ */
+type chanBind struct {
+	Bind
+	received chan []byte
+	sent     chan []byte
+	closed   chan struct{}
+}
+
+func newChanBind() *chanBind {
+	return &chanBind{
+		received: make(chan []byte, 1),
+		sent:     make(chan []byte, 1),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (bind *chanBind) ReceiveIPv4(buff []byte) (int, Endpoint, *net.UDPAddr, error) {
+	select {
+	case datagram := <-bind.received:
+		end, _ := CreateEndpoint("192.0.2.1:51820")
+		return copy(buff, datagram), end, nil, nil
+	case <-bind.closed:
+		return 0, nil, nil, errors.New("closed")
+	}
+}
+
+func (bind *chanBind) ReceiveIPv6(buff []byte) (int, Endpoint, *net.UDPAddr, error) {
+	<-bind.closed
+	return 0, nil, nil, errors.New("closed")
+}
+
+func (bind *chanBind) Send(buff []byte, end Endpoint) error {
+	bind.sent <- append([]byte(nil), buff...)
+	return nil
+}
+
+func (bind *chanBind) Close() error {
+	close(bind.closed)
+	return nil
+}
+
+func TestMultiPortBind(t *testing.T) {
+	inner := []*chanBind{newChanBind(), newChanBind()}
+	bind := NewMultiPortBind([]Bind{inner[0], inner[1]})
+	buff := make([]byte, 64)
+	configured, _ := CreateEndpoint("192.0.2.1:51820")
+	sentBy := func(want int) {
+		t.Helper()
+		select {
+		case <-inner[want].sent:
+		case <-inner[1-want].sent:
+			t.Errorf("sent by bind %d, want %d", 1-want, want)
+		}
+	}
+
+	// replies to a received endpoint leave from the bind it came from
+
+	inner[1].received <- []byte("hello")
+	n, end, _, err := bind.ReceiveIPv4(buff)
+	if err != nil || string(buff[:n]) != "hello" {
+		t.Fatalf("received %q, %v", buff[:n], err)
+	}
+	bind.Send([]byte("reply"), end)
+	sentBy(1)
+
+	// as do sends to its address once it was heard
+
+	bind.Send([]byte("hello"), configured)
+	sentBy(0)
+	end.(HeardEndpoint).Heard()
+	bind.Send([]byte("hello"), configured)
+	sentBy(1)
+
+	if err := bind.Close(); err != nil {
+		t.Error(err)
+	}
+	if _, _, _, err := bind.ReceiveIPv4(buff); err == nil {
+		t.Error("received after close")
+	}
+	if _, _, _, err := bind.ReceiveIPv6(buff); err == nil {
+		t.Error("received after close")
+	}
+}
@@ -0,0 +1,200 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/salsa20"
+)
+
+/* An obfuscated bind transforms every datagram with an Obfuscator on its
+ * way to and from the wrapped bind, so that WireGuard messages, with their
+ * recognisable types and lengths, do not appear on the wire as they are.
+ * Both ends must use the same obfuscator with the same shared secret;
+ * datagrams which fail to deobfuscate are dropped.
+ *
+ * Obfuscation is not encryption: the messages are already encrypted, and
+ * the obfuscator only has to keep them from being classified by simple
+ * pattern matching. It does add to the size of datagrams, so the MTU of
+ * the tunnel should be lowered by the overhead of the obfuscator. The
+ * wrapper moves one datagram at a time and does not forbid fragmentation,
+ * so batching, DSCP marking and path MTU discovery are not available
+ * through it.
+ */
+
+const obfuscateBufferSize = 1<<16 - 1 // largest UDP payload
+
+// Obfuscator transforms datagrams to disguise them on the wire.
+// Implementations must be safe for concurrent use.
+type Obfuscator interface {
+	// Obfuscate appends the obfuscated form of src to dst
+	// and returns the extended slice. It must not modify src.
+	Obfuscate(dst, src []byte) []byte
+
+	// Deobfuscate appends the original form of the obfuscated src to
+	// dst and returns the extended slice, or false if src was not
+	// obfuscated by a matching Obfuscator.
+	Deobfuscate(dst, src []byte) ([]byte, bool)
+}
+
+var obfuscators struct {
+	sync.RWMutex
+	constructors map[string]func(key []byte) (Obfuscator, error)
+}
+
+// RegisterObfuscator makes an obfuscator available by name to
+// NewObfuscator. The constructor creates an obfuscator from a shared
+// secret. Registering a name twice panics.
+func RegisterObfuscator(name string, new func(key []byte) (Obfuscator, error)) {
+	if name == "" || strings.ContainsAny(name, ":\n") {
+		panic("conn: invalid obfuscator name " + name)
+	}
+	obfuscators.Lock()
+	defer obfuscators.Unlock()
+	if obfuscators.constructors == nil {
+		obfuscators.constructors = make(map[string]func(key []byte) (Obfuscator, error))
+	}
+	if _, ok := obfuscators.constructors[name]; ok {
+		panic("conn: obfuscator " + name + " registered twice")
+	}
+	obfuscators.constructors[name] = new
+}
+
+// NewObfuscator creates the obfuscator registered by name,
+// with the shared secret key.
+func NewObfuscator(name string, key []byte) (Obfuscator, error) {
+	obfuscators.RLock()
+	new, ok := obfuscators.constructors[name]
+	obfuscators.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown obfuscator %q", name)
+	}
+	return new(key)
+}
+
+// Obfuscators returns the names of the registered obfuscators, sorted.
+func Obfuscators() []string {
+	obfuscators.RLock()
+	defer obfuscators.RUnlock()
+	names := make([]string, 0, len(obfuscators.constructors))
+	for name := range obfuscators.constructors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterObfuscator("stream", func(key []byte) (Obfuscator, error) {
+		return NewStreamObfuscator(key)
+	})
+}
+
+/* The stream obfuscator XORs datagrams with a Salsa20 key stream, keyed by
+ * the BLAKE2s hash of the shared secret, under a random 8-byte nonce sent
+ * in front of each datagram. Every byte on the wire is then uniformly
+ * random to an observer without the secret, at a cost of 8 bytes per
+ * datagram. Datagrams are not authenticated: a tampered datagram
+ * deobfuscates to garbage, which WireGuard drops.
+ */
+
+const streamObfuscatorNonceSize = 8
+
+// StreamObfuscatorOverhead is the number of bytes the stream
+// obfuscator adds to every datagram.
+const StreamObfuscatorOverhead = streamObfuscatorNonceSize
+
+type streamObfuscator struct {
+	key [blake2s.Size]byte
+}
+
+// NewStreamObfuscator returns the reference obfuscator, registered as
+// "stream", which XORs datagrams with a key stream derived from key.
+func NewStreamObfuscator(key []byte) (Obfuscator, error) {
+	if len(key) == 0 {
+		return nil, errors.New("empty obfuscation key")
+	}
+	return &streamObfuscator{key: blake2s.Sum256(key)}, nil
+}
+
+func (obf *streamObfuscator) Obfuscate(dst, src []byte) []byte {
+	n := len(dst)
+	dst = append(dst, make([]byte, streamObfuscatorNonceSize+len(src))...)
+	nonce := dst[n : n+streamObfuscatorNonceSize]
+	rand.Read(nonce)
+	salsa20.XORKeyStream(dst[n+streamObfuscatorNonceSize:], src, nonce, &obf.key)
+	return dst
+}
+
+func (obf *streamObfuscator) Deobfuscate(dst, src []byte) ([]byte, bool) {
+	if len(src) <= streamObfuscatorNonceSize {
+		return dst, false
+	}
+	n := len(dst)
+	dst = append(dst, make([]byte, len(src)-streamObfuscatorNonceSize)...)
+	salsa20.XORKeyStream(dst[n:], src[streamObfuscatorNonceSize:], src[:streamObfuscatorNonceSize], &obf.key)
+	return dst, true
+}
+
+type obfuscatedBind struct {
+	Bind
+	obfuscator Obfuscator
+	pool       sync.Pool
+}
+
+// NewObfuscatedBind returns a Bind which obfuscates the datagrams
+// sent through bind, and deobfuscates those received from it.
+func NewObfuscatedBind(bind Bind, obfuscator Obfuscator) Bind {
+	obfuscated := &obfuscatedBind{
+		Bind:       bind,
+		obfuscator: obfuscator,
+	}
+	obfuscated.pool.New = func() interface{} {
+		return new([obfuscateBufferSize]byte)
+	}
+	return obfuscated
+}
+
+func (bind *obfuscatedBind) Send(buff []byte, end Endpoint) error {
+	obfuscated := bind.pool.Get().(*[obfuscateBufferSize]byte)
+	defer bind.pool.Put(obfuscated)
+	return bind.Bind.Send(bind.obfuscator.Obfuscate(obfuscated[:0], buff), end)
+}
+
+func (bind *obfuscatedBind) ReceiveIPv6(buff []byte) (int, Endpoint, *net.UDPAddr, error) {
+	return bind.receive(bind.Bind.ReceiveIPv6, buff)
+}
+
+func (bind *obfuscatedBind) ReceiveIPv4(buff []byte) (int, Endpoint, *net.UDPAddr, error) {
+	return bind.receive(bind.Bind.ReceiveIPv4, buff)
+}
+
+/* Receives datagrams with receive until one deobfuscates into buff,
+ * dropping the others. Deobfuscating in place spares a copy, unless
+ * the obfuscator needed more room than buff has.
+ */
+func (bind *obfuscatedBind) receive(receive func([]byte) (int, Endpoint, *net.UDPAddr, error), buff []byte) (int, Endpoint, *net.UDPAddr, error) {
+	obfuscated := bind.pool.Get().(*[obfuscateBufferSize]byte)
+	defer bind.pool.Put(obfuscated)
+	for {
+		n, end, addr, err := receive(obfuscated[:])
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		packet, ok := bind.obfuscator.Deobfuscate(buff[:0], obfuscated[:n])
+		if ok && len(packet) <= len(buff) {
+			return copy(buff, packet), end, addr, nil
+		}
+	}
+}
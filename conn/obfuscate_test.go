@@ -0,0 +1,97 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestStreamObfuscator(t *testing.T) {
+	obf, err := NewObfuscator("stream", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := NewStreamObfuscator([]byte("other secret"))
+
+	msg := []byte{1, 0, 0, 0, 'h', 'e', 'l', 'l', 'o'}
+	orig := append([]byte(nil), msg...)
+	obfuscated := obf.Obfuscate(nil, msg)
+	if !bytes.Equal(msg, orig) {
+		t.Fatal("source modified")
+	}
+	if len(obfuscated) != len(msg)+StreamObfuscatorOverhead {
+		t.Errorf("obfuscated to %d bytes, want %d", len(obfuscated), len(msg)+StreamObfuscatorOverhead)
+	}
+	if bytes.Contains(obfuscated, msg[:4]) {
+		t.Error("message type visible")
+	}
+	if again := obf.Obfuscate(nil, msg); bytes.Equal(again, obfuscated) {
+		t.Error("obfuscation is deterministic")
+	}
+
+	got, ok := obf.Deobfuscate(make([]byte, 0, 64), obfuscated)
+	if !ok || !bytes.Equal(got, msg) {
+		t.Errorf("deobfuscated to %x, %t", got, ok)
+	}
+	if got, _ := other.Deobfuscate(nil, obfuscated); bytes.Equal(got, msg) {
+		t.Error("deobfuscated with the wrong key")
+	}
+	if _, ok := obf.Deobfuscate(nil, obfuscated[:StreamObfuscatorOverhead]); ok {
+		t.Error("truncated datagram taken")
+	}
+
+	if _, err := NewObfuscator("stream", nil); err == nil {
+		t.Error("empty key accepted")
+	}
+	if _, err := NewObfuscator("unknown", []byte("secret")); err == nil {
+		t.Error("unknown obfuscator created")
+	}
+}
+
+/* A bind passing datagrams straight back to the receiver.
+ */
+type loopBind struct {
+	Bind
+	datagrams chan []byte
+}
+
+func (bind *loopBind) Send(buff []byte, end Endpoint) error {
+	bind.datagrams <- append([]byte(nil), buff...)
+	return nil
+}
+
+func (bind *loopBind) ReceiveIPv4(buff []byte) (int, Endpoint, *net.UDPAddr, error) {
+	return copy(buff, <-bind.datagrams), nil, nil, nil
+}
+
+func TestObfuscatedBind(t *testing.T) {
+	obf, _ := NewStreamObfuscator([]byte("secret"))
+	inner := &loopBind{datagrams: make(chan []byte, 2)}
+	bind := NewObfuscatedBind(inner, obf)
+
+	// datagrams which fail to deobfuscate are skipped
+
+	inner.datagrams <- []byte{1, 2, 3}
+	if err := bind.Send([]byte("hello"), nil); err != nil {
+		t.Fatal(err)
+	}
+	buff := make([]byte, 64)
+	n, _, _, err := bind.ReceiveIPv4(buff)
+	if err != nil || string(buff[:n]) != "hello" {
+		t.Errorf("received %q, %v", buff[:n], err)
+	}
+
+	// as are those too large for the buffer
+
+	bind.Send(make([]byte, 65), nil)
+	bind.Send([]byte("world"), nil)
+	n, _, _, err = bind.ReceiveIPv4(buff)
+	if err != nil || string(buff[:n]) != "world" {
+		t.Errorf("received %q, %v", buff[:n], err)
+	}
+}
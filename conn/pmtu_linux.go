@@ -0,0 +1,89 @@
+// +build !android
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+func (bind *nativeBind) SetDontFragment(enabled bool) error {
+	v4, v6 := unix.IP_PMTUDISC_WANT, unix.IPV6_PMTUDISC_WANT
+	if enabled {
+		v4, v6 = unix.IP_PMTUDISC_DO, unix.IPV6_PMTUDISC_DO
+	}
+
+	if bind.sock6 != -1 {
+		err := unix.SetsockoptInt(
+			bind.sock6,
+			unix.IPPROTO_IPV6,
+			unix.IPV6_MTU_DISCOVER,
+			v6,
+		)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if bind.sock4 != -1 {
+		err := unix.SetsockoptInt(
+			bind.sock4,
+			unix.IPPROTO_IP,
+			unix.IP_MTU_DISCOVER,
+			v4,
+		)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/* The learnt path MTU is only reported for connected sockets, so a
+ * throwaway socket is connected to the destination, which looks up the
+ * route without sending anything.
+ */
+func (bind *nativeBind) PathMTU(end Endpoint) (int, error) {
+	nend := end.(*NativeEndpoint)
+
+	var (
+		dst    unix.Sockaddr
+		family = unix.AF_INET
+		level  = unix.IPPROTO_IP
+		opt    = unix.IP_MTU
+	)
+	nend.Lock()
+	if nend.isV6 {
+		dst6 := *nend.dst6()
+		dst = &dst6
+		family, level, opt = unix.AF_INET6, unix.IPPROTO_IPV6, unix.IPV6_MTU
+	} else {
+		dst4 := *nend.dst4()
+		dst = &dst4
+	}
+	nend.Unlock()
+
+	fd, err := unix.Socket(family, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(fd)
+
+	// route as the bind does
+
+	if bind.lastMark != 0 {
+		unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, int(bind.lastMark))
+	}
+
+	if err := unix.Connect(fd, dst); err != nil {
+		return 0, err
+	}
+	return unix.GetsockoptInt(fd, level, opt)
+}
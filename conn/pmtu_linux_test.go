@@ -0,0 +1,57 @@
+// +build !android
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPathMTU(t *testing.T) {
+	a, b, end := newLoopbackPair(t)
+	defer a.Close()
+	defer b.Close()
+
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("no loopback interface:", err)
+	}
+
+	var _ PathMTUBind = a
+	if err := a.SetDontFragment(true); err != nil {
+		t.Fatal(err)
+	}
+	mtu, err := a.PathMTU(end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := lo.MTU
+	if want > 0xffff {
+		want = 0xffff // largest IPv4 packet
+	}
+	if mtu != want {
+		t.Errorf("path MTU = %d, want the loopback MTU %d", mtu, want)
+	}
+
+	// datagrams still flow with fragmentation forbidden
+
+	if err := a.Send([]byte("probe"), end); err != nil {
+		t.Fatal(err)
+	}
+	buff := make([]byte, 16)
+	n, _, _, err := b.ReceiveIPv4(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buff[:n]) != "probe" {
+		t.Errorf("received %q", buff[:n])
+	}
+	if err := a.SetDontFragment(false); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,389 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/* A SOCKS5 bind tunnels all datagrams through a SOCKS5 proxy (RFC 1928)
+ * using UDP ASSOCIATE. Endpoints keep the remote addresses of the peers,
+ * while the datagrams themselves are exchanged with the proxy's relay.
+ *
+ * The association lives as long as the TCP control connection. When the
+ * proxy drops it, the bind reconnects and associates again.
+ */
+
+const (
+	socksVersion          = 5
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthUnacceptable = 0xff
+	socksCmdUDPAssociate  = 0x03
+	socksAddrIPv4         = 0x01
+	socksAddrDomain       = 0x03
+	socksAddrIPv6         = 0x04
+
+	socksDialTimeout      = time.Second * 10
+	socksReconnectBackoff = time.Second * 30 // maximum delay between reconnection attempts
+)
+
+// SOCKS5Proxy is the address and credentials of a SOCKS5 proxy.
+type SOCKS5Proxy struct {
+	Addr     string // host:port
+	Username string
+	Password string
+}
+
+// ParseSOCKS5Proxy parses a proxy URL of the form
+// socks5://[user:password@]host:port.
+func ParseSOCKS5Proxy(s string) (*SOCKS5Proxy, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" {
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, err
+	}
+	proxy := &SOCKS5Proxy{Addr: u.Host}
+	if u.User != nil {
+		proxy.Username = u.User.Username()
+		proxy.Password, _ = u.User.Password()
+		if len(proxy.Username) > 255 || len(proxy.Password) > 255 {
+			return nil, errors.New("proxy credentials too long")
+		}
+	}
+	return proxy, nil
+}
+
+// String returns the proxy URL with the user name, but not the password,
+// so that it may be logged and reported.
+func (proxy *SOCKS5Proxy) String() string {
+	u := url.URL{Scheme: "socks5", Host: proxy.Addr}
+	if proxy.Username != "" {
+		u.User = url.User(proxy.Username)
+	}
+	return u.String()
+}
+
+type socksBind struct {
+	proxy *SOCKS5Proxy
+	udp   *net.UDPConn
+
+	sync.RWMutex
+	control net.Conn     // TCP connection keeping the association alive
+	relay   *net.UDPAddr // where the proxy relays datagrams
+	closed  bool
+
+	closing chan struct{}
+}
+
+var _ Bind = (*socksBind)(nil)
+
+// CreateSOCKS5Bind creates a Bind sending all datagrams through the proxy.
+// The local UDP socket listens on port, or a random port if it is 0.
+func CreateSOCKS5Bind(proxy *SOCKS5Proxy, port uint16) (Bind, uint16, error) {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{Port: int(port)})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	bind := &socksBind{
+		proxy:   proxy,
+		udp:     udp,
+		closing: make(chan struct{}),
+	}
+	bind.control, bind.relay, err = bind.associate()
+	if err != nil {
+		udp.Close()
+		return nil, 0, err
+	}
+
+	go bind.routineControl()
+
+	return bind, uint16(udp.LocalAddr().(*net.UDPAddr).Port), nil
+}
+
+/* Connects to the proxy, authenticates and requests a UDP association.
+ */
+func (bind *socksBind) associate() (net.Conn, *net.UDPAddr, error) {
+	control, err := net.DialTimeout("tcp", bind.proxy.Addr, socksDialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	control.SetDeadline(time.Now().Add(socksDialTimeout))
+
+	relay, err := bind.handshake(control)
+	if err != nil {
+		control.Close()
+		return nil, nil, fmt.Errorf("socks5: %v", err)
+	}
+
+	control.SetDeadline(time.Time{})
+	return control, relay, nil
+}
+
+func (bind *socksBind) handshake(control net.Conn) (*net.UDPAddr, error) {
+	var buff [2 + 2*256]byte
+
+	// negotiate authentication method
+
+	methods := []byte{socksVersion, 1, socksAuthNone}
+	if bind.proxy.Username != "" {
+		methods = []byte{socksVersion, 2, socksAuthNone, socksAuthPassword}
+	}
+	if _, err := control.Write(methods); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(control, buff[:2]); err != nil {
+		return nil, err
+	}
+	if buff[0] != socksVersion {
+		return nil, fmt.Errorf("unexpected version %d", buff[0])
+	}
+
+	switch buff[1] {
+	case socksAuthNone:
+	case socksAuthPassword:
+
+		// username/password authentication (RFC 1929)
+
+		auth := append([]byte{1, byte(len(bind.proxy.Username))}, bind.proxy.Username...)
+		auth = append(auth, byte(len(bind.proxy.Password)))
+		auth = append(auth, bind.proxy.Password...)
+		if _, err := control.Write(auth); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(control, buff[:2]); err != nil {
+			return nil, err
+		}
+		if buff[1] != 0 {
+			return nil, errors.New("authentication failed")
+		}
+	case socksAuthUnacceptable:
+		return nil, errors.New("no acceptable authentication method")
+	default:
+		return nil, fmt.Errorf("unexpected authentication method %d", buff[1])
+	}
+
+	// request association, the source of our datagrams is not known in advance
+
+	request := []byte{socksVersion, socksCmdUDPAssociate, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0}
+	if _, err := control.Write(request); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(control, buff[:4]); err != nil {
+		return nil, err
+	}
+	if buff[1] != 0 {
+		return nil, fmt.Errorf("UDP associate failed with code %d", buff[1])
+	}
+
+	var ip net.IP
+	switch buff[3] {
+	case socksAddrIPv4:
+		ip = make(net.IP, net.IPv4len)
+	case socksAddrIPv6:
+		ip = make(net.IP, net.IPv6len)
+	case socksAddrDomain:
+		if _, err := io.ReadFull(control, buff[:1]); err != nil {
+			return nil, err
+		}
+		ip = make(net.IP, buff[0]) // holds the name until resolved below
+	default:
+		return nil, fmt.Errorf("unsupported relay address type %d", buff[3])
+	}
+	if _, err := io.ReadFull(control, ip); err != nil {
+		return nil, err
+	}
+	if buff[3] == socksAddrDomain {
+		addr, err := net.ResolveIPAddr("ip", string(ip))
+		if err != nil {
+			return nil, err
+		}
+		ip = addr.IP
+	}
+	if _, err := io.ReadFull(control, buff[:2]); err != nil {
+		return nil, err
+	}
+	relay := &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(buff[:2]))}
+
+	// an unspecified relay address means the address of the proxy itself
+
+	if relay.IP.IsUnspecified() {
+		relay.IP = control.RemoteAddr().(*net.TCPAddr).IP
+	}
+	if ip4 := relay.IP.To4(); ip4 != nil {
+		relay.IP = ip4
+	}
+	return relay, nil
+}
+
+/* Waits for the proxy to drop the control connection, then associates again.
+ */
+func (bind *socksBind) routineControl() {
+	for {
+		bind.RLock()
+		control := bind.control
+		bind.RUnlock()
+
+		io.Copy(ioutil.Discard, control)
+
+		backoff := time.Second
+		for {
+			select {
+			case <-bind.closing:
+				return
+			default:
+			}
+
+			control, relay, err := bind.associate()
+			if err == nil {
+				bind.Lock()
+				if bind.closed {
+					bind.Unlock()
+					control.Close()
+					return
+				}
+				bind.control = control
+				bind.relay = relay
+				bind.Unlock()
+				break
+			}
+
+			select {
+			case <-bind.closing:
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > socksReconnectBackoff {
+				backoff = socksReconnectBackoff
+			}
+		}
+	}
+}
+
+func (bind *socksBind) Close() error {
+	bind.Lock()
+	if bind.closed {
+		bind.Unlock()
+		return nil
+	}
+	bind.closed = true
+	close(bind.closing)
+	control := bind.control
+	bind.Unlock()
+
+	control.Close()
+	return bind.udp.Close()
+}
+
+func (bind *socksBind) LastMark() uint32 { return 0 }
+
+func (bind *socksBind) SetMark(value uint32) error {
+	if value == 0 {
+		return nil
+	}
+	return ErrMarkUnsupported
+}
+
+/* Datagrams of both address families arrive on the same socket,
+ * so all of them are returned by ReceiveIPv4.
+ */
+func (bind *socksBind) ReceiveIPv4(buff []byte) (int, Endpoint, *net.UDPAddr, error) {
+	for {
+		n, from, err := bind.udp.ReadFromUDP(buff)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+
+		bind.RLock()
+		relay := bind.relay
+		bind.RUnlock()
+
+		if !from.IP.Equal(relay.IP) || from.Port != relay.Port {
+			continue
+		}
+
+		// strip the UDP request header: RSV, FRAG, ATYP, DST.ADDR, DST.PORT
+
+		if n < 4 || buff[2] != 0 {
+			continue // fragments are not supported
+		}
+		var header int
+		switch buff[3] {
+		case socksAddrIPv4:
+			header = 4 + net.IPv4len + 2
+		case socksAddrIPv6:
+			header = 4 + net.IPv6len + 2
+		default:
+			continue
+		}
+		if n < header {
+			continue
+		}
+
+		addr := &net.UDPAddr{
+			IP:   append(net.IP(nil), buff[4:header-2]...),
+			Port: int(binary.BigEndian.Uint16(buff[header-2 : header])),
+		}
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			addr.IP = ip4
+		}
+		end, err := CreateEndpoint(addr.String())
+		if err != nil {
+			continue
+		}
+
+		n = copy(buff, buff[header:n])
+		return n, end, addr, nil
+	}
+}
+
+func (bind *socksBind) ReceiveIPv6(buff []byte) (int, Endpoint, *net.UDPAddr, error) {
+	return 0, nil, nil, syscall.EAFNOSUPPORT
+}
+
+func (bind *socksBind) Send(buff []byte, end Endpoint) error {
+	addr, err := endpointUDPAddr(end)
+	if err != nil {
+		return err
+	}
+	ip := addr.IP
+
+	var packet []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		packet = make([]byte, 4+net.IPv4len+2, 4+net.IPv4len+2+len(buff))
+		packet[3] = socksAddrIPv4
+		copy(packet[4:], ip4)
+	} else {
+		packet = make([]byte, 4+net.IPv6len+2, 4+net.IPv6len+2+len(buff))
+		packet[3] = socksAddrIPv6
+		copy(packet[4:], ip.To16())
+	}
+	binary.BigEndian.PutUint16(packet[len(packet)-2:], uint16(addr.Port))
+	packet = append(packet, buff...)
+
+	bind.RLock()
+	relay := bind.relay
+	bind.RUnlock()
+
+	_, err = bind.udp.WriteToUDP(packet, relay)
+	return err
+}
@@ -0,0 +1,333 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/* A TCP bind carries WireGuard messages over TCP, for networks which block UDP.
+ *
+ * Every message is sent as one frame: a 16-bit big-endian length followed by
+ * the message itself, so message boundaries are preserved. There is one
+ * connection per remote address. A connection is dialed when the first
+ * message is sent to an address, and accepted connections are used to reply
+ * to their remote address. When a connection fails, the message is reported
+ * as not sent and the next send dials again.
+ *
+ * Dialing happens on a goroutine of its own, so that sending never waits
+ * for a connection: up to tcpDialQueue messages sent meanwhile are queued
+ * and written once it is established, further ones are dropped, as are all
+ * of them if dialing fails. At most tcpMaxInbound accepted connections are
+ * served at once, further ones are closed as they are accepted.
+ *
+ * Running WireGuard over TCP trades throughput and latency for reachability:
+ * a lost segment stalls every message behind it until it is retransmitted,
+ * and TCP congestion control stacks up with that of the tunneled traffic.
+ * Endpoints learned from accepted connections point at the ephemeral port of
+ * the dialing side, so only the side which dialed can reconnect; both peers
+ * should therefore be configured with an endpoint where possible.
+ */
+
+const (
+	tcpDialTimeout  = time.Second * 5
+	tcpMaxFrameSize = 1<<16 - 1
+	tcpReceiveQueue = 1024 // received frames waiting for the receive routine
+	tcpDialQueue    = 16   // frames sent to an address while dialing it
+	tcpMaxInbound   = 64   // accepted connections served at once
+)
+
+type tcpFrame struct {
+	buff *[tcpMaxFrameSize]byte
+	n    int
+	addr *net.UDPAddr
+}
+
+type tcpConn struct {
+	net.Conn
+	writeLock sync.Mutex
+	inbound   bool // accepted, holding one of the inbound slots
+}
+
+type tcpBind struct {
+	listener *net.TCPListener
+	frames   chan tcpFrame
+	pool     sync.Pool
+
+	sync.Mutex
+	conns   map[string]*tcpConn // keyed by remote address
+	dialing map[string][][]byte // frames queued for each address being dialed
+	closed  bool
+
+	inbound chan struct{} // one for each accepted connection served
+	closing chan struct{}
+}
+
+var _ Bind = (*tcpBind)(nil)
+
+// CreateTCPBind creates a Bind sending messages over TCP connections.
+// It accepts connections on port, or on a random port if it is 0.
+func CreateTCPBind(port uint16) (Bind, uint16, error) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: int(port)})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	bind := &tcpBind{
+		listener: listener,
+		frames:   make(chan tcpFrame, tcpReceiveQueue),
+		conns:    make(map[string]*tcpConn),
+		dialing:  make(map[string][][]byte),
+		inbound:  make(chan struct{}, tcpMaxInbound),
+		closing:  make(chan struct{}),
+	}
+	bind.pool.New = func() interface{} {
+		return new([tcpMaxFrameSize]byte)
+	}
+
+	go bind.routineAccept()
+
+	return bind, uint16(listener.Addr().(*net.TCPAddr).Port), nil
+}
+
+func tcpToUDPAddr(addr net.Addr) *net.UDPAddr {
+	tcpAddr := addr.(*net.TCPAddr)
+	ip := tcpAddr.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &net.UDPAddr{IP: ip, Port: tcpAddr.Port, Zone: tcpAddr.Zone}
+}
+
+func (bind *tcpBind) routineAccept() {
+	for {
+		conn, err := bind.listener.AcceptTCP()
+		if err != nil {
+			return
+		}
+		select {
+		case bind.inbound <- struct{}{}:
+		default:
+			conn.Close()
+			continue
+		}
+		conn.SetNoDelay(true)
+		bind.add(&tcpConn{Conn: conn, inbound: true})
+	}
+}
+
+/* Registers a connection and starts reading frames from it.
+ * A previous connection to the same address is replaced.
+ */
+func (bind *tcpBind) add(conn *tcpConn) bool {
+	bind.Lock()
+	return bind.addLocked(conn)
+}
+
+/* Like add, but called with bind locked, which it unlocks. */
+func (bind *tcpBind) addLocked(conn *tcpConn) bool {
+	key := conn.RemoteAddr().String()
+
+	if bind.closed {
+		bind.Unlock()
+		conn.Close()
+		if conn.inbound {
+			<-bind.inbound
+		}
+		return false
+	}
+	old := bind.conns[key]
+	bind.conns[key] = conn
+	bind.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	go bind.routineRead(conn)
+	return true
+}
+
+func (bind *tcpBind) remove(conn *tcpConn) {
+	key := conn.RemoteAddr().String()
+
+	bind.Lock()
+	if bind.conns[key] == conn {
+		delete(bind.conns, key)
+	}
+	bind.Unlock()
+
+	conn.Close()
+}
+
+func (bind *tcpBind) routineRead(conn *tcpConn) {
+	defer func() {
+		bind.remove(conn)
+		if conn.inbound {
+			<-bind.inbound
+		}
+	}()
+
+	addr := tcpToUDPAddr(conn.RemoteAddr())
+	var header [2]byte
+
+	for {
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			return
+		}
+		n := int(binary.BigEndian.Uint16(header[:]))
+		buff := bind.pool.Get().(*[tcpMaxFrameSize]byte)
+		if _, err := io.ReadFull(conn, buff[:n]); err != nil {
+			bind.pool.Put(buff)
+			return
+		}
+
+		// block rather than drop when the receive routine falls behind
+
+		select {
+		case bind.frames <- tcpFrame{buff: buff, n: n, addr: addr}:
+		case <-bind.closing:
+			bind.pool.Put(buff)
+			return
+		}
+	}
+}
+
+func (bind *tcpBind) Close() error {
+	bind.Lock()
+	if bind.closed {
+		bind.Unlock()
+		return nil
+	}
+	bind.closed = true
+	close(bind.closing)
+	conns := bind.conns
+	bind.conns = nil
+	bind.Unlock()
+
+	err := bind.listener.Close()
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return err
+}
+
+func (bind *tcpBind) LastMark() uint32 { return 0 }
+
+func (bind *tcpBind) SetMark(value uint32) error {
+	if value == 0 {
+		return nil
+	}
+	return ErrMarkUnsupported
+}
+
+/* Messages of both address families arrive on the same queue,
+ * so all of them are returned by ReceiveIPv4.
+ */
+func (bind *tcpBind) ReceiveIPv4(buff []byte) (int, Endpoint, *net.UDPAddr, error) {
+	for {
+		select {
+		case <-bind.closing:
+			return 0, nil, nil, errors.New("bind closed")
+		case frame := <-bind.frames:
+			n := copy(buff, frame.buff[:frame.n])
+			bind.pool.Put(frame.buff)
+			end, err := CreateEndpoint(frame.addr.String())
+			if err != nil {
+				continue
+			}
+			return n, end, frame.addr, nil
+		}
+	}
+}
+
+func (bind *tcpBind) ReceiveIPv6(buff []byte) (int, Endpoint, *net.UDPAddr, error) {
+	return 0, nil, nil, syscall.EAFNOSUPPORT
+}
+
+/* Dials addr, then writes the frames queued for it meanwhile, in order,
+ * before registering the connection for sends to go through it directly.
+ * Dialing ends and the connection is registered under the same lock, so
+ * that no send in between finds neither and dials again.
+ */
+func (bind *tcpBind) routineDial(addr string) {
+	conn, err := net.DialTimeout("tcp", addr, tcpDialTimeout)
+	if err != nil {
+		bind.Lock()
+		delete(bind.dialing, addr)
+		bind.Unlock()
+		return
+	}
+	conn.(*net.TCPConn).SetNoDelay(true)
+	tc := &tcpConn{Conn: conn}
+
+	for {
+		bind.Lock()
+		frames := bind.dialing[addr]
+		if len(frames) == 0 || bind.closed {
+			delete(bind.dialing, addr)
+			break
+		}
+		bind.dialing[addr] = [][]byte{}
+		bind.Unlock()
+
+		for _, frame := range frames {
+			if _, err := tc.Write(frame); err != nil {
+				bind.Lock()
+				delete(bind.dialing, addr)
+				bind.Unlock()
+				tc.Close()
+				return
+			}
+		}
+	}
+	bind.addLocked(tc)
+}
+
+func (bind *tcpBind) Send(buff []byte, end Endpoint) error {
+	if len(buff) > tcpMaxFrameSize {
+		return errors.New("message too large")
+	}
+	addr := end.DstToString()
+
+	frame := make([]byte, 2+len(buff))
+	binary.BigEndian.PutUint16(frame, uint16(len(buff)))
+	copy(frame[2:], buff)
+
+	bind.Lock()
+	if bind.closed {
+		bind.Unlock()
+		return errors.New("bind closed")
+	}
+	conn := bind.conns[addr]
+	if conn == nil {
+		frames, dialing := bind.dialing[addr]
+		if len(frames) >= tcpDialQueue {
+			bind.Unlock()
+			return errors.New("connection being dialed, message dropped")
+		}
+		bind.dialing[addr] = append(frames, frame)
+		bind.Unlock()
+		if !dialing {
+			go bind.routineDial(addr)
+		}
+		return nil
+	}
+	bind.Unlock()
+
+	conn.writeLock.Lock()
+	_, err := conn.Write(frame)
+	conn.writeLock.Unlock()
+	if err != nil {
+		bind.remove(conn)
+	}
+	return err
+}
@@ -0,0 +1,183 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func receiveTCP(t *testing.T, bind Bind) ([]byte, Endpoint) {
+	t.Helper()
+	type result struct {
+		msg []byte
+		end Endpoint
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		buff := make([]byte, tcpMaxFrameSize)
+		n, end, _, err := bind.ReceiveIPv4(buff)
+		ch <- result{buff[:n], end, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r.msg, r.end
+	case <-time.After(time.Second):
+		t.Fatal("no message received")
+	}
+	return nil, nil
+}
+
+func TestTCPBind(t *testing.T) {
+	bind1, _, err := CreateTCPBind(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind1.Close()
+	bind2, port2, err := CreateTCPBind(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind2.Close()
+
+	end2, err := CreateEndpoint(fmt.Sprintf("127.0.0.1:%d", port2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// message boundaries survive the stream, including empty and maximum sizes
+
+	msgs := [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte{0xaa}, tcpMaxFrameSize)}
+	for _, msg := range msgs {
+		if err := bind1.Send(msg, end2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var end1 Endpoint
+	for _, want := range msgs {
+		var got []byte
+		got, end1 = receiveTCP(t, bind2)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got %d bytes, want %d", len(got), len(want))
+		}
+	}
+
+	// the reply uses the accepted connection
+
+	if err := bind2.Send([]byte("reply"), end1); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := receiveTCP(t, bind1); string(got) != "reply" {
+		t.Fatalf("got %q, want reply", got)
+	}
+
+	// a dropped connection is dialed again on the next send
+
+	tb := bind1.(*tcpBind)
+	tb.Lock()
+	for _, conn := range tb.conns {
+		conn.Close()
+	}
+	tb.Unlock()
+
+	for i := 0; ; i++ {
+		err := bind1.Send([]byte("again"), end2)
+		if err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("send after reconnect: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got, _ := receiveTCP(t, bind2); string(got) != "again" {
+		t.Fatalf("got %q, want again", got)
+	}
+
+	if err := bind1.Send(make([]byte, tcpMaxFrameSize+1), end2); err == nil {
+		t.Error("oversized message sent")
+	}
+}
+
+func TestTCPBindLimits(t *testing.T) {
+	bind1, _, err := CreateTCPBind(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind1.Close()
+	bind2, port2, err := CreateTCPBind(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind2.Close()
+
+	end2, err := CreateEndpoint(fmt.Sprintf("127.0.0.1:%d", port2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// messages sent while dialing are queued up to a limit, in order
+
+	tb := bind1.(*tcpBind)
+	tb.Lock()
+	tb.dialing[end2.DstToString()] = [][]byte{}
+	tb.Unlock()
+	for i := 0; i < tcpDialQueue; i++ {
+		if err := bind1.Send([]byte{byte(i)}, end2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bind1.Send([]byte("dropped"), end2); err == nil {
+		t.Error("message queued past the limit")
+	}
+	go tb.routineDial(end2.DstToString())
+	for i := 0; i < tcpDialQueue; i++ {
+		if got, _ := receiveTCP(t, bind2); !bytes.Equal(got, []byte{byte(i)}) {
+			t.Fatalf("got %x, want %x", got, i)
+		}
+	}
+
+	// the dialed connection is registered as dialing ends
+
+	for {
+		tb.Lock()
+		_, dialing := tb.dialing[end2.DstToString()]
+		conn := tb.conns[end2.DstToString()]
+		tb.Unlock()
+		if !dialing {
+			if conn == nil {
+				t.Fatal("dialing ended without a connection")
+			}
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// accepted connections past the limit are closed
+
+	inbound := bind2.(*tcpBind).inbound
+	for len(inbound) < cap(inbound) {
+		inbound <- struct{}{}
+	}
+	conn, err := net.Dial("tcp", end2.DstToString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("connection past the limit served")
+	} else if err, ok := err.(net.Error); ok && err.Timeout() {
+		t.Errorf("connection past the limit served: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/sys/cpu"
+)
+
+/* AES-GCM transport keys, enabled with aes_gcm=true, replace
+ * ChaCha20-Poly1305 for the transport messages of sessions both peers
+ * agreed on it for, where AES is accelerated in hardware.
+ *
+ * The initiator advertises it with MessageFlagAESGCM in the type of its
+ * initiation, and the responder agrees by setting the flag in the type of
+ * its response. Flagged messages mix their type into the transcript hash,
+ * so the flags are authenticated along with the handshake. Classic
+ * implementations drop flagged initiations, so an initiation advertising
+ * AES-GCM which goes unanswered is retried without the flag, and the peer
+ * is not advertised to again until it advertises AES-GCM itself.
+ *
+ * Both ciphers take the same 96-bit nonce, the counter following four zero
+ * bytes, and append the same 16-byte tag, so transport messages keep their
+ * format.
+ */
+
+const (
+	MessageFlagAESGCM = 1 << 8 // in the type of handshake messages: AES-GCM transport keys are advertised, or agreed on
+
+	messageFlags = MessageFlagAESGCM | MessageFlagPostQuantum | MessageFlagNextPresharedKey // flags taken in the type of handshake messages
+)
+
+var aesGCMSupported = cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ || cpu.ARM64.HasAES && cpu.ARM64.HasPMULL
+
+/* Returns the type of a received message, without the flags of handshake
+ * messages. Unknown flags are left in place, so the type is not recognised.
+ */
+func messageType(raw uint32) uint32 {
+	switch raw &^ messageFlags {
+	case MessageInitiationType, MessageResponseType, MessageHybridInitiationType, MessageHybridResponseType:
+		return raw &^ messageFlags
+	}
+	return raw
+}
+
+/* Mixes the type of a handshake message into the hash if it carries flags,
+ * leaving the hash of classic messages as it is.
+ */
+func mixFlags(hash *[blake2s.Size]byte, msgType uint32) {
+	if msgType&messageFlags == 0 {
+		return
+	}
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], msgType)
+	mixHash(hash, hash, b[:])
+}
+
+/* Returns the AEAD of transport messages under key.
+ */
+func newTransportAEAD(key *[chacha20poly1305.KeySize]byte, aesGCM bool) cipher.AEAD {
+	if !aesGCM {
+		aead, _ := chacha20poly1305.New(key[:])
+		return aead
+	}
+	block, _ := aes.NewCipher(key[:])
+	aead, _ := cipher.NewGCM(block)
+	return aead
+}
+
+/* Enables or disables AES-GCM transport keys. Enabling it advertises
+ * AES-GCM again to peers which went without it.
+ */
+func (device *Device) setAESGCM(enabled bool) {
+	device.aesGCM.Set(enabled)
+	if !enabled {
+		return
+	}
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	for _, peer := range device.peers.keyMap {
+		peer.handshake.mutex.Lock()
+		peer.handshake.aesGCMRefused = false
+		peer.handshake.mutex.Unlock()
+	}
+}
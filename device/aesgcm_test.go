@@ -0,0 +1,214 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tai64n"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+/* Pretends AES is accelerated, until the returned func is called.
+ */
+func withAESGCMSupported() func() {
+	supported := aesGCMSupported
+	aesGCMSupported = true
+	return func() { aesGCMSupported = supported }
+}
+
+func TestAESGCMHandshake(t *testing.T) {
+	defer withAESGCMSupported()()
+
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+	dev1.aesGCM.Set(true)
+	dev2.aesGCM.Set(true)
+
+	peer1, err := dev2.NewPeer(dev1.staticIdentity.privateKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer2, err := dev1.NewPeer(dev2.staticIdentity.privateKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handshake := func(tamper func(*MessageInitiation, *MessageResponse)) bool {
+		msg1, err := dev1.CreateMessageInitiation(peer2)
+		assertNil(t, err)
+		tamper(msg1, nil)
+		peer1.handshake.lastTimestamp = tai64n.Timestamp{} // initiations follow each other too closely
+		if dev2.ConsumeMessageInitiation(msg1) == nil {
+			return false
+		}
+		msg2, err := dev2.CreateMessageResponse(peer1)
+		assertNil(t, err)
+		tamper(nil, msg2)
+		if dev1.ConsumeMessageResponse(msg2) == nil {
+			return false
+		}
+		assertNil(t, peer1.BeginSymmetricSession())
+		assertNil(t, peer2.BeginSymmetricSession())
+		return true
+	}
+
+	// both agree on AES-GCM, with the nonces of ChaCha20-Poly1305
+
+	if !handshake(func(*MessageInitiation, *MessageResponse) {}) {
+		t.Fatal("handshake failed")
+	}
+	key1 := peer1.keypairs.next
+	key2 := peer2.keypairs.current
+	if !key1.aesGCM || !key2.aesGCM {
+		t.Fatal("AES-GCM not agreed on")
+	}
+	var nonce [12]byte
+	binary.LittleEndian.PutUint64(nonce[4:], 7)
+	sealed := key1.send.Seal(nil, nonce[:], []byte("test message"), nil)
+	if len(sealed) != len("test message")+16 {
+		t.Fatalf("sealed %d bytes, want a 16-byte tag", len(sealed))
+	}
+	if opened, err := key2.receive.Open(nil, nonce[:], sealed, nil); err != nil || string(opened) != "test message" {
+		t.Fatalf("opened %q, %v", opened, err)
+	}
+
+	// the flags are authenticated by the response
+
+	strip := func(msg1 *MessageInitiation, _ *MessageResponse) {
+		if msg1 != nil {
+			msg1.Type &^= MessageFlagAESGCM
+		}
+	}
+	if handshake(strip) {
+		t.Error("handshake completed with the flag stripped from the initiation")
+	}
+	dev2.aesGCM.Set(false)
+	add := func(_ *MessageInitiation, msg2 *MessageResponse) {
+		if msg2 != nil {
+			msg2.Type |= MessageFlagAESGCM
+		}
+	}
+	if handshake(add) {
+		t.Error("handshake completed with the flag added to the response")
+	}
+
+	// a responder without AES-GCM answers classic
+
+	if !handshake(func(*MessageInitiation, *MessageResponse) {}) {
+		t.Fatal("handshake with a classic responder failed")
+	}
+	if peer1.keypairs.next.aesGCM || peer2.keypairs.current.aesGCM {
+		t.Error("AES-GCM used with a classic responder")
+	}
+}
+
+/* A bind dropping initiations with flags, as classic implementations do.
+ */
+type classicBind struct {
+	conn.Bind
+}
+
+func (bind classicBind) receive(recv func([]byte) (int, conn.Endpoint, *net.UDPAddr, error), buff []byte) (int, conn.Endpoint, *net.UDPAddr, error) {
+	for {
+		n, end, addr, err := recv(buff)
+		if err != nil || n < 4 || binary.LittleEndian.Uint32(buff)&messageFlags == 0 {
+			return n, end, addr, err
+		}
+	}
+}
+
+func (bind classicBind) ReceiveIPv4(buff []byte) (int, conn.Endpoint, *net.UDPAddr, error) {
+	return bind.receive(bind.Bind.ReceiveIPv4, buff)
+}
+
+func (bind classicBind) ReceiveIPv6(buff []byte) (int, conn.Endpoint, *net.UDPAddr, error) {
+	return bind.receive(bind.Bind.ReceiveIPv6, buff)
+}
+
+func TestAESGCMInterop(t *testing.T) {
+	defer withAESGCMSupported()()
+	dst, src := net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")
+
+	ping := func(t *testing.T, dev1 *Device, tun1, tun2 *tuntest.ChannelTUN, dev2 *Device, cipher string) {
+		t.Helper()
+		tun2.Outbound <- tuntest.Ping(dst, src)
+		select {
+		case <-tun1.Inbound:
+		case <-time.After(2 * time.Second):
+			t.Fatal("ping did not transit")
+		}
+		for _, dev := range []*Device{dev1, dev2} {
+			if !strings.Contains(ipcGet(t, dev), "keypair_cipher="+cipher+"\n") {
+				t.Errorf("keypair cipher is not %s", cipher)
+			}
+		}
+	}
+
+	t.Run("agreed", func(t *testing.T) {
+		dev1, tun1, dev2, tun2 := newBindTestPair(t, bindtest.NewNetwork(1))
+		defer dev1.Close()
+		defer dev2.Close()
+		for _, dev := range []*Device{dev1, dev2} {
+			if err := ipcSet(dev, "aes_gcm=true\n"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ping(t, dev1, tun1, tun2, dev2, "aes-256-gcm")
+	})
+
+	t.Run("classic", func(t *testing.T) {
+		network := bindtest.NewNetwork(1)
+		tun1 := tuntest.NewChannelTUN()
+		dev1 := NewDevice(tun1.TUN(), &DeviceOptions{
+			Logger: NewLogger(LogLevelError, "dev1: "),
+			CreateBind: func(port uint16) (conn.Bind, uint16, error) {
+				bind, port, err := network.CreateBind(port)
+				if err != nil {
+					return nil, 0, err
+				}
+				return classicBind{bind}, port, nil
+			},
+			CreateEndpoint: network.CreateEndpoint,
+		})
+		defer dev1.Close()
+		dev1.Up()
+		if err := ipcSet(dev1, cfg1); err != nil {
+			t.Fatal(err)
+		}
+		tun2 := tuntest.NewChannelTUN()
+		dev2 := NewDevice(tun2.TUN(), &DeviceOptions{
+			Logger:         NewLogger(LogLevelError, "dev2: "),
+			CreateBind:     network.CreateBind,
+			CreateEndpoint: network.CreateEndpoint,
+		})
+		defer dev2.Close()
+		dev2.Up()
+		if err := ipcSet(dev2, cfg2); err != nil {
+			t.Fatal(err)
+		}
+		if err := ipcSet(dev2, "aes_gcm=true\nrekey_timeout=100\nrekey_jitter_max=50\n"); err != nil {
+			t.Fatal(err)
+		}
+		ping(t, dev1, tun1, tun2, dev2, "chacha20-poly1305")
+
+		peer := dev2.LookupPeer(dev1.staticIdentity.publicKey)
+		peer.handshake.mutex.RLock()
+		refused := peer.handshake.aesGCMRefused
+		peer.handshake.mutex.RUnlock()
+		if !refused {
+			t.Error("peer dropping AES-GCM initiations not marked")
+		}
+	})
+}
@@ -0,0 +1,73 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+var ErrAffinityUnsupported = errors.New("worker affinity is not supported on this platform")
+
+// SetWorkerAffinity restricts the encryption and decryption workers, the
+// per-peer senders and receivers, and the socket readers of the device to
+// the given CPUs. An empty set lifts the restriction.
+//
+// Each worker applies the set itself, when it next handles a packet: it
+// locks its goroutine to the OS thread it runs on, with
+// runtime.LockOSThread, and restricts that thread to the set. The Go
+// scheduler then runs nothing else on those threads, and starts other
+// threads for the remaining goroutines, so the pinned workers still count
+// against GOMAXPROCS while running but leave the CPUs outside the set to
+// the rest of the process. A set smaller than the number of workers makes
+// them share its CPUs, see DeviceOptions.Workers.
+//
+// On platforms other than Linux, ErrAffinityUnsupported is returned.
+func (device *Device) SetWorkerAffinity(cpus []int) error {
+	for _, cpu := range cpus {
+		if cpu < 0 || cpu >= maxAffinityCPUs {
+			return fmt.Errorf("invalid CPU %d", cpu)
+		}
+	}
+	if len(cpus) > 0 {
+		if err := checkAffinity(cpus); err != nil {
+			return err
+		}
+	}
+
+	device.affinity.Lock()
+	device.affinity.cpus = append([]int(nil), cpus...)
+	atomic.AddUint32(&device.affinity.generation, 1)
+	device.affinity.Unlock()
+	return nil
+}
+
+/* The affinity a worker has applied to its thread.
+ */
+type workerPin struct {
+	generation uint32 // of Device.affinity, zero before any was set
+	locked     bool   // whether the goroutine is locked to its thread
+}
+
+/* Applies the worker affinity to the calling worker if it changed since
+ * pin was last applied.
+ */
+func (device *Device) pinWorker(pin *workerPin) {
+	generation := atomic.LoadUint32(&device.affinity.generation)
+	if generation == pin.generation {
+		return
+	}
+	pin.generation = generation
+
+	device.affinity.RLock()
+	cpus := device.affinity.cpus
+	device.affinity.RUnlock()
+
+	if err := pin.apply(cpus); err != nil {
+		device.log.Errorf("Failed to set worker affinity: %v", err)
+	}
+}
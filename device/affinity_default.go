@@ -0,0 +1,21 @@
+// +build !linux
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+const maxAffinityCPUs = 1024
+
+func checkAffinity(cpus []int) error {
+	return ErrAffinityUnsupported
+}
+
+func (pin *workerPin) apply(cpus []int) error {
+	if len(cpus) > 0 {
+		return ErrAffinityUnsupported
+	}
+	return nil
+}
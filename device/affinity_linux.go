@@ -0,0 +1,75 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+const maxAffinityCPUs = 1024 // the size of unix.CPUSet
+
+var processAffinity struct {
+	sync.Once
+	set unix.CPUSet
+	err error
+}
+
+/* Returns the CPUs the process may run on, as it started.
+ */
+func defaultAffinity() (*unix.CPUSet, error) {
+	processAffinity.Do(func() {
+		processAffinity.err = unix.SchedGetaffinity(0, &processAffinity.set)
+	})
+	return &processAffinity.set, processAffinity.err
+}
+
+/* Checks that the process may run on at least one of cpus.
+ */
+func checkAffinity(cpus []int) error {
+	allowed, err := defaultAffinity()
+	if err != nil {
+		return err
+	}
+	for _, cpu := range cpus {
+		if allowed.IsSet(cpu) {
+			return nil
+		}
+	}
+	return errors.New("none of the CPUs are available to the process")
+}
+
+func (pin *workerPin) apply(cpus []int) error {
+	allowed, err := defaultAffinity()
+	if err != nil {
+		return err
+	}
+
+	// threads are restored before being handed back to the scheduler
+
+	if len(cpus) == 0 {
+		if !pin.locked {
+			return nil
+		}
+		err := unix.SchedSetaffinity(0, allowed)
+		runtime.UnlockOSThread()
+		pin.locked = false
+		return err
+	}
+
+	var set unix.CPUSet
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	if !pin.locked {
+		runtime.LockOSThread()
+		pin.locked = true
+	}
+	return unix.SchedSetaffinity(0, &set)
+}
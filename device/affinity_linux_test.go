@@ -0,0 +1,100 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+	"golang.org/x/sys/unix"
+)
+
+func TestWorkerAffinity(t *testing.T) {
+	allowed, err := defaultAffinity()
+	if err != nil {
+		t.Skip(err)
+	}
+	cpu := 0
+	for !allowed.IsSet(cpu) {
+		cpu++
+	}
+
+	// a pinned thread runs only on the set, and is restored when lifted
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var pin workerPin
+		if err := pin.apply([]int{cpu}); err != nil {
+			t.Error(err)
+			return
+		}
+		var set unix.CPUSet
+		if err := unix.SchedGetaffinity(0, &set); err != nil {
+			t.Error(err)
+		} else if set.Count() != 1 || !set.IsSet(cpu) {
+			t.Errorf("pinned thread may run on %d CPUs", set.Count())
+		}
+		if err := pin.apply(nil); err != nil {
+			t.Error(err)
+		}
+		if pin.locked {
+			t.Error("goroutine still locked to its thread")
+		}
+	}()
+	<-done
+	var set unix.CPUSet
+	unix.SchedGetaffinity(0, &set)
+	if set != *allowed {
+		t.Error("thread not restored to the process affinity")
+	}
+
+	// devices keep forwarding with their workers pinned
+
+	tun1 := tuntest.NewChannelTUN()
+	dev1 := NewDevice(tun1.TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev1: "),
+	})
+	dev1.Up()
+	defer dev1.Close()
+	tun2 := tuntest.NewChannelTUN()
+	dev2 := NewDevice(tun2.TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev2: "),
+	})
+	dev2.Up()
+	defer dev2.Close()
+	if err := ipcSet(dev1, cfg1); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipcSet(dev2, cfg2); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bad := range [][]int{{-1}, {maxAffinityCPUs}} {
+		if err := dev2.SetWorkerAffinity(bad); err == nil {
+			t.Errorf("affinity %v accepted", bad)
+		}
+	}
+	if err := dev1.SetWorkerAffinity([]int{cpu}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev2.SetWorkerAffinity([]int{cpu}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		tun2.Outbound <- tuntest.Ping(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"))
+		select {
+		case <-tun1.Inbound:
+		case <-time.After(time.Second):
+			t.Fatal("ping did not transit with pinned workers")
+		}
+		if i == 1 {
+			dev1.SetWorkerAffinity(nil)
+		}
+	}
+}
@@ -11,6 +11,8 @@ import (
 	"net"
 	"sync"
 	"unsafe"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
 )
 
 type trieEntry struct {
@@ -80,18 +82,56 @@ func (node *trieEntry) removeByPeer(p *Peer) *trieEntry {
 	node.child[1] = node.child[1].removeByPeer(p)
 
 	if node.peer != p {
+		if node.peer == nil {
+			return node.collapse()
+		}
 		return node
 	}
 
 	// remove peer & merge
 
 	node.peer = nil
+	return node.collapse()
+}
+
+/* Replaces a node without a peer by its only child, or drops it if it
+ * has none. Nodes branching to two children are kept.
+ */
+func (node *trieEntry) collapse() *trieEntry {
+	if node.peer != nil || (node.child[0] != nil && node.child[1] != nil) {
+		return node
+	}
 	if node.child[0] == nil {
 		return node.child[1]
 	}
 	return node.child[0]
 }
 
+/* Removes the entry for exactly ip/cidr if it belongs to peer,
+ * reporting whether it was found.
+ */
+func (node *trieEntry) remove(ip net.IP, cidr uint, peer *Peer) (*trieEntry, bool) {
+	if node == nil || node.cidr > cidr || commonBits(node.bits, ip) < node.cidr {
+		return node, false
+	}
+
+	if node.cidr == cidr {
+		if node.peer != peer {
+			return node, false
+		}
+		node.peer = nil
+		return node.collapse(), true
+	}
+
+	bit := node.choose(ip)
+	child, removed := node.child[bit].remove(ip, cidr, peer)
+	node.child[bit] = child
+	if !removed {
+		return node, false
+	}
+	return node.collapse(), true
+}
+
 func (node *trieEntry) choose(ip net.IP) byte {
 	return (ip[node.bit_at_byte] >> node.bit_at_shift) & 1
 }
@@ -160,6 +200,19 @@ func (node *trieEntry) insert(ip net.IP, cidr uint, peer *Peer) *trieEntry {
 	return parent
 }
 
+/* Returns the peer of the entry for exactly ip/cidr, unlike lookup
+ * ignoring shorter and longer prefixes.
+ */
+func (node *trieEntry) owner(ip net.IP, cidr uint) *Peer {
+	for node != nil && node.cidr <= cidr && commonBits(node.bits, ip) >= node.cidr {
+		if node.cidr == cidr {
+			return node.peer
+		}
+		node = node.child[node.choose(ip)]
+	}
+	return nil
+}
+
 func (node *trieEntry) lookup(ip net.IP) *Peer {
 	var found *Peer
 	size := uint(len(ip))
@@ -192,6 +245,24 @@ func (node *trieEntry) entriesForPeer(p *Peer, results []net.IPNet) []net.IPNet
 	return results
 }
 
+/* Calls fn for every entry with a peer, in address order with shorter
+ * prefixes first.
+ */
+func (node *trieEntry) walk(fn func(prefix net.IPNet, peer *Peer)) {
+	if node == nil {
+		return
+	}
+	if node.peer != nil {
+		mask := net.CIDRMask(int(node.cidr), len(node.bits)*8)
+		fn(net.IPNet{
+			Mask: mask,
+			IP:   node.bits.Mask(mask),
+		}, node.peer)
+	}
+	node.child[0].walk(fn)
+	node.child[1].walk(fn)
+}
+
 type AllowedIPs struct {
 	IPv4  *trieEntry
 	IPv6  *trieEntry
@@ -208,6 +279,30 @@ func (table *AllowedIPs) EntriesForPeer(peer *Peer) []net.IPNet {
 	return allowed
 }
 
+// AllowedIP is a prefix of the allowed IPs and the peer it routes to.
+type AllowedIP struct {
+	Prefix net.IPNet
+	Peer   wgcfg.Key
+}
+
+// Entries returns all prefixes with their peers, IPv4 ones first,
+// taken at a single point in time.
+func (table *AllowedIPs) Entries() []AllowedIP {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+
+	var entries []AllowedIP
+	add := func(prefix net.IPNet, peer *Peer) {
+		entries = append(entries, AllowedIP{
+			Prefix: prefix,
+			Peer:   peer.handshake.remoteStatic,
+		})
+	}
+	table.IPv4.walk(add)
+	table.IPv6.walk(add)
+	return entries
+}
+
 func (table *AllowedIPs) Reset() {
 	table.mutex.Lock()
 	defer table.mutex.Unlock()
@@ -216,6 +311,25 @@ func (table *AllowedIPs) Reset() {
 	table.IPv6 = nil
 }
 
+// Remove deletes the entry for ip/cidr of peer, leaving entries for
+// other prefixes, including nested and overlapping ones, in place. It
+// reports whether there was such an entry; if not, the table is unchanged.
+func (table *AllowedIPs) Remove(ip net.IP, cidr uint, peer *Peer) bool {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	var removed bool
+	switch len(ip) {
+	case net.IPv6len:
+		table.IPv6, removed = table.IPv6.remove(ip, cidr, peer)
+	case net.IPv4len:
+		table.IPv4, removed = table.IPv4.remove(ip, cidr, peer)
+	default:
+		panic(errors.New("removing unknown address type"))
+	}
+	return removed
+}
+
 func (table *AllowedIPs) RemoveByPeer(peer *Peer) {
 	table.mutex.Lock()
 	defer table.mutex.Unlock()
@@ -238,6 +352,45 @@ func (table *AllowedIPs) Insert(ip net.IP, cidr uint, peer *Peer) {
 	}
 }
 
+// Owner returns the peer the prefix ip/cidr itself is assigned to, if any.
+// Prefixes containing it or contained in it are not considered.
+func (table *AllowedIPs) Owner(ip net.IP, cidr uint) *Peer {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+
+	switch len(ip) {
+	case net.IPv6len:
+		return table.IPv6.owner(ip, cidr)
+	case net.IPv4len:
+		return table.IPv4.owner(ip, cidr)
+	default:
+		panic(errors.New("looking up unknown address type"))
+	}
+}
+
+// InsertStrict is like Insert, but leaves a prefix already assigned to
+// another peer in place, returning that peer instead.
+func (table *AllowedIPs) InsertStrict(ip net.IP, cidr uint, peer *Peer) *Peer {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	switch len(ip) {
+	case net.IPv6len:
+		if owner := table.IPv6.owner(ip, cidr); owner != nil && owner != peer {
+			return owner
+		}
+		table.IPv6 = table.IPv6.insert(ip, cidr, peer)
+	case net.IPv4len:
+		if owner := table.IPv4.owner(ip, cidr); owner != nil && owner != peer {
+			return owner
+		}
+		table.IPv4 = table.IPv4.insert(ip, cidr, peer)
+	default:
+		panic(errors.New("inserting unknown address type"))
+	}
+	return nil
+}
+
 func (table *AllowedIPs) LookupIPv4(address []byte) *Peer {
 	table.mutex.RLock()
 	defer table.mutex.RUnlock()
@@ -251,8 +404,8 @@ func (table *AllowedIPs) LookupIPv6(address []byte) *Peer {
 }
 
 func (table *AllowedIPs) LookupIP(a net.IP) *Peer {
-	if a.To4() != nil {
-		return table.LookupIPv4(a)
+	if ip := a.To4(); ip != nil {
+		return table.LookupIPv4(ip)
 	} else {
 		return table.LookupIPv6(a)
 	}
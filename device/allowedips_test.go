@@ -258,3 +258,188 @@ func TestTrieIPv6(t *testing.T) {
 	assertEQ(h, 0x24046800, 0x40040800, 0x10101010, 0x10101010)
 	assertEQ(a, 0x24046800, 0x40040800, 0xdeadbeef, 0xdeadbeef)
 }
+
+func TestTrieRemove(t *testing.T) {
+	a := &Peer{}
+	b := &Peer{}
+	c := &Peer{}
+	d := &Peer{}
+
+	var trie *trieEntry
+
+	insert := func(peer *Peer, a, b, c, d byte, cidr uint) {
+		trie = trie.insert([]byte{a, b, c, d}, cidr, peer)
+	}
+
+	remove := func(peer *Peer, a, b, c, d byte, cidr uint) bool {
+		var removed bool
+		trie, removed = trie.remove([]byte{a, b, c, d}, cidr, peer)
+		return removed
+	}
+
+	assertEQ := func(peer *Peer, a, b, c, d byte) {
+		t.Helper()
+		if p := trie.lookup([]byte{a, b, c, d}); p != peer {
+			t.Errorf("lookup %d.%d.%d.%d failed", a, b, c, d)
+		}
+	}
+
+	// nested prefixes, and overlapping ones of the same peer
+
+	insert(a, 10, 0, 0, 0, 8)
+	insert(b, 10, 1, 0, 0, 16)
+	insert(c, 10, 1, 1, 0, 24)
+	insert(a, 10, 1, 1, 1, 32)
+	insert(d, 10, 2, 0, 0, 16)
+	insert(d, 10, 3, 0, 0, 16)
+
+	if remove(c, 10, 0, 0, 0, 8) {
+		t.Error("removed prefix of another peer")
+	}
+	if remove(a, 10, 4, 0, 0, 16) || remove(a, 10, 0, 0, 0, 16) {
+		t.Error("removed absent prefix")
+	}
+	assertEQ(a, 10, 9, 9, 9)
+
+	if !remove(b, 10, 1, 0, 0, 16) {
+		t.Fatal("failed to remove 10.1.0.0/16")
+	}
+	assertEQ(a, 10, 1, 2, 3)
+	assertEQ(c, 10, 1, 1, 5)
+	assertEQ(a, 10, 1, 1, 1)
+
+	// host bits beyond the prefix length are ignored
+
+	if !remove(c, 10, 1, 1, 77, 24) {
+		t.Fatal("failed to remove 10.1.1.0/24")
+	}
+	assertEQ(a, 10, 1, 1, 5)
+	assertEQ(a, 10, 1, 1, 1)
+
+	if !remove(a, 10, 0, 0, 0, 8) {
+		t.Fatal("failed to remove 10.0.0.0/8")
+	}
+	assertEQ(nil, 10, 9, 9, 9)
+	assertEQ(a, 10, 1, 1, 1)
+	assertEQ(d, 10, 2, 5, 5)
+	assertEQ(d, 10, 3, 5, 5)
+
+	remove(a, 10, 1, 1, 1, 32)
+	remove(d, 10, 2, 0, 0, 16)
+	remove(d, 10, 3, 0, 0, 16)
+	if trie != nil {
+		t.Error("trie not empty after removing all entries")
+	}
+
+	// removing entries in any order collapses the trie completely
+
+	rand.Seed(1)
+	type entry struct {
+		ip   []byte
+		cidr uint
+	}
+	var entries []entry
+	for i := 0; i < 1000; i++ {
+		ip := make([]byte, net.IPv6len)
+		rand.Read(ip)
+		cidr := uint(rand.Intn(129))
+		ip = net.IP(ip).Mask(net.CIDRMask(int(cidr), 128))
+		trie = trie.insert(ip, cidr, a)
+		entries = append(entries, entry{ip, cidr})
+	}
+	for _, i := range rand.Perm(len(entries)) {
+		trie, _ = trie.remove(entries[i].ip, entries[i].cidr, a)
+	}
+	if trie != nil {
+		t.Error("trie not empty after removing all random entries")
+	}
+}
+
+func TestAllowedIPsEntries(t *testing.T) {
+	a := &Peer{}
+	a.handshake.remoteStatic[0] = 'a'
+	b := &Peer{}
+	b.handshake.remoteStatic[0] = 'b'
+
+	var table AllowedIPs
+	insert := func(peer *Peer, s string) {
+		ip, network, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		ones, _ := network.Mask.Size()
+		table.Insert(ip, uint(ones), peer)
+	}
+
+	insert(a, "fd00::1/64")
+	insert(b, "192.168.1.77/24")
+	insert(a, "10.1.2.3/32")
+	insert(b, "10.0.0.0/8")
+	insert(a, "0.0.0.0/0")
+	insert(b, "::/0")
+
+	want := []struct {
+		prefix string
+		peer   *Peer
+	}{
+		{"0.0.0.0/0", a},
+		{"10.0.0.0/8", b},
+		{"10.1.2.3/32", a},
+		{"192.168.1.0/24", b},
+		{"::/0", b},
+		{"fd00::/64", a},
+	}
+	entries := table.Entries()
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries, want %d: %v", len(entries), len(want), entries)
+	}
+	for i, entry := range entries {
+		if entry.Prefix.String() != want[i].prefix || entry.Peer != want[i].peer.handshake.remoteStatic {
+			t.Errorf("entry %d = %v %v, want %v", i, entry.Prefix.String(), entry.Peer, want[i].prefix)
+		}
+	}
+}
+
+func TestAllowedIPsInsertStrict(t *testing.T) {
+	a := &Peer{}
+	b := &Peer{}
+
+	var table AllowedIPs
+	table.Insert([]byte{10, 0, 0, 0}, 16, a)
+
+	// exact match is refused, unless it is the same peer
+
+	if owner := table.InsertStrict([]byte{10, 0, 0, 0}, 16, b); owner != a {
+		t.Errorf("exact match: owner = %p, want %p", owner, a)
+	}
+	if owner := table.InsertStrict([]byte{10, 0, 255, 255}, 16, a); owner != nil {
+		t.Errorf("same peer: owner = %p, want nil", owner)
+	}
+	if p := table.LookupIPv4([]byte{10, 0, 1, 1}); p != a {
+		t.Error("refused insertion changed the owner")
+	}
+
+	// subsets and supersets are allowed
+
+	if owner := table.InsertStrict([]byte{10, 0, 1, 0}, 24, b); owner != nil {
+		t.Errorf("subset: owner = %p, want nil", owner)
+	}
+	if owner := table.InsertStrict([]byte{10, 0, 0, 0}, 8, b); owner != nil {
+		t.Errorf("superset: owner = %p, want nil", owner)
+	}
+	if owner := table.Owner([]byte{10, 0, 0, 0}, 12); owner != nil {
+		t.Errorf("Owner() of unassigned prefix = %p", owner)
+	}
+	if p := table.LookupIPv4([]byte{10, 0, 1, 1}); p != b {
+		t.Error("subset not inserted")
+	}
+	if p := table.LookupIPv4([]byte{10, 0, 2, 1}); p != a {
+		t.Error("superset replaced the existing prefix")
+	}
+	if p := table.LookupIPv4([]byte{10, 1, 0, 0}); p != b {
+		t.Error("superset not inserted")
+	}
+}
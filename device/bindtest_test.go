@@ -0,0 +1,80 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+/* Returns two devices configured with cfg1 and cfg2, connected by network.
+ */
+func newBindTestPair(tb testing.TB, network *bindtest.Network) (*Device, *tuntest.ChannelTUN, *Device, *tuntest.ChannelTUN) {
+	var devs [2]*Device
+	var tuns [2]*tuntest.ChannelTUN
+	for i, cfg := range []string{cfg1, cfg2} {
+		tuns[i] = tuntest.NewChannelTUN()
+		devs[i] = NewDevice(tuns[i].TUN(), &DeviceOptions{
+			Logger:         NewLogger(LogLevelError, "dev: "),
+			CreateBind:     network.CreateBind,
+			CreateEndpoint: network.CreateEndpoint,
+		})
+		devs[i].Up()
+		if err := ipcSet(devs[i], cfg); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return devs[0], tuns[0], devs[1], tuns[1]
+}
+
+func TestBindTestTwoDevices(t *testing.T) {
+	network := bindtest.NewNetwork(1)
+	dev1, tun1, dev2, tun2 := newBindTestPair(t, network)
+	defer dev1.Close()
+	defer dev2.Close()
+	if err := ipcSet(dev2, "rekey_timeout=100\nrekey_jitter_max=50\n"); err != nil {
+		t.Fatal(err)
+	}
+	dst, src := net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")
+
+	// initiations lost on the way are retransmitted
+
+	network.SetConditions(bindtest.Conditions{Loss: 1})
+	tun2.Outbound <- tuntest.Ping(dst, src)
+	for deadline := time.Now().Add(time.Second); dev2.Metrics().HandshakeAttempts < 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("handshake initiation not retransmitted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	network.SetConditions(bindtest.Conditions{Latency: 5 * time.Millisecond})
+	select {
+	case <-tun1.Inbound:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ping did not transit once the network recovered")
+	}
+
+	// reordered packets are all taken by the replay filter
+
+	network.SetConditions(bindtest.Conditions{Reorder: 0.5})
+	const pings = 20
+	go func() {
+		for i := 0; i < pings; i++ {
+			tun2.Outbound <- tuntest.Ping(dst, src)
+		}
+	}()
+	for i := 0; i < pings; i++ {
+		select {
+		case <-tun1.Inbound:
+		case <-time.After(time.Second):
+			t.Fatalf("%d of %d reordered pings received", i, pings)
+		}
+	}
+}
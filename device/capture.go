@@ -0,0 +1,154 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+/* Packet capture, enabled with SetPacketCapture, mirrors the inner packets
+ * of every peer to a writer in the pcap format, for debugging: inbound
+ * packets once decrypted and let through by the inbound filter, outbound
+ * packets as routed to a peer and fit to its MTU, before encryption, so
+ * that packets dropped as too large are left out and fragments are
+ * captured as sent. Packets carry no link layer header, so records are of
+ * LINKTYPE_RAW.
+ *
+ * The data path only copies a packet to a queue of captureQueueSize
+ * packets, which a goroutine writes out; packets arriving while the queue
+ * is full are dropped from the capture, never holding up the data path,
+ * and their count is logged as the capture stops. When capture is off,
+ * the data path only loads an atomic value.
+ */
+
+const (
+	pcapMagic        = 0xa1b2c3d4 // microsecond timestamps
+	pcapLinkTypeRaw  = 101
+	pcapSnapLen      = 65535
+	captureQueueSize = 1024
+	captureStopWait  = time.Second // for the writer of a stopped capture to finish
+)
+
+type capturedPacket struct {
+	at     time.Time
+	packet []byte
+}
+
+type packetCapture struct {
+	queue   chan capturedPacket
+	stop    chan struct{}
+	done    chan struct{}
+	dropped uint64 // atomic
+	failed  int32  // atomic, set once writing failed
+}
+
+// SetPacketCapture starts writing the inner packets of every peer to w
+// in the pcap format, or stops capturing if w is nil. Writes happen on a
+// goroutine of their own, which is stopped with any capture under way
+// before SetPacketCapture returns, so that the writer of that capture
+// may then be closed, unless a write blocks for longer than a second: the
+// goroutine is then abandoned to return once the write does. Capture
+// stops on the first error writing to w.
+func (device *Device) SetPacketCapture(w io.Writer) {
+	var capture *packetCapture
+	if w != nil {
+		capture = &packetCapture{
+			queue: make(chan capturedPacket, captureQueueSize),
+			stop:  make(chan struct{}),
+			done:  make(chan struct{}),
+		}
+		go device.routineCapture(capture, w)
+	}
+
+	device.capture.Lock()
+	defer device.capture.Unlock()
+	old, _ := device.capture.current.Load().(*packetCapture)
+	device.capture.current.Store(capture)
+	if old != nil {
+		close(old.stop)
+		select {
+		case <-old.done:
+		case <-time.After(captureStopWait):
+			device.log.Errorf("Packet capture writer blocked, abandoning it")
+		}
+	}
+}
+
+/* Queues a copy of packet for capture, if capture is on.
+ */
+func (device *Device) capturePacket(packet []byte) {
+	capture, _ := device.capture.current.Load().(*packetCapture)
+	if capture == nil || atomic.LoadInt32(&capture.failed) != 0 {
+		return
+	}
+	select {
+	case capture.queue <- capturedPacket{time.Now(), append([]byte(nil), packet...)}:
+	default:
+		atomic.AddUint64(&capture.dropped, 1)
+	}
+}
+
+func (device *Device) routineCapture(capture *packetCapture, w io.Writer) {
+	defer close(capture.done)
+
+	buffered := bufio.NewWriter(w)
+	var header [24]byte
+	binary.LittleEndian.PutUint32(header[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkTypeRaw)
+	buffered.Write(header[:])
+
+	write := func(p capturedPacket) {
+		var record [16]byte
+		usec := p.at.UnixNano() / int64(time.Microsecond)
+		length := len(p.packet)
+		if length > pcapSnapLen {
+			p.packet = p.packet[:pcapSnapLen]
+		}
+		binary.LittleEndian.PutUint32(record[0:], uint32(usec/1e6))
+		binary.LittleEndian.PutUint32(record[4:], uint32(usec%1e6))
+		binary.LittleEndian.PutUint32(record[8:], uint32(len(p.packet)))
+		binary.LittleEndian.PutUint32(record[12:], uint32(length))
+		buffered.Write(record[:])
+		buffered.Write(p.packet)
+	}
+
+	// flush whenever the queue runs empty, so that the capture can be followed live
+
+	var err error
+	for err == nil {
+		select {
+		case p := <-capture.queue:
+			write(p)
+			if len(capture.queue) == 0 {
+				err = buffered.Flush()
+			}
+		case <-capture.stop:
+			for len(capture.queue) != 0 {
+				write(<-capture.queue)
+			}
+			err = buffered.Flush()
+			if dropped := atomic.LoadUint64(&capture.dropped); dropped != 0 {
+				device.log.Verbosef("Packet capture stopped, %d packets dropped from it", dropped)
+			}
+			if err == nil {
+				return
+			}
+		}
+	}
+	device.log.Errorf("Packet capture failed: %v", err)
+
+	// keep the data path from queuing in vain until capture is replaced
+
+	atomic.StoreInt32(&capture.failed, 1)
+	<-capture.stop
+}
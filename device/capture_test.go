@@ -0,0 +1,107 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+type blockingWriter chan struct{}
+
+func (w blockingWriter) Write(b []byte) (int, error) {
+	<-w
+	return len(b), nil
+}
+
+func TestPacketCapture(t *testing.T) {
+	dev1, tun1, dev2, tun2 := newBindTestPair(t, bindtest.NewNetwork(1))
+	defer dev1.Close()
+	defer dev2.Close()
+
+	transit := func(from, to *tuntest.ChannelTUN, packet []byte) {
+		t.Helper()
+		from.Outbound <- packet
+		select {
+		case <-to.Inbound:
+		case <-time.After(2 * time.Second):
+			t.Fatal("ping did not transit")
+		}
+	}
+	ping := tuntest.Ping(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"))
+	pong := tuntest.Ping(net.ParseIP("1.0.0.2"), net.ParseIP("1.0.0.1"))
+
+	var capture bytes.Buffer
+	dev1.SetPacketCapture(&capture)
+	transit(tun2, tun1, ping)
+	transit(tun1, tun2, pong)
+	dev1.SetPacketCapture(nil)
+	transit(tun2, tun1, ping)
+
+	b := capture.Bytes()
+	if len(b) < 24 {
+		t.Fatalf("capture of %d bytes", len(b))
+	}
+	if magic, linkType := binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint32(b[20:]); magic != pcapMagic || linkType != pcapLinkTypeRaw {
+		t.Errorf("header with magic %x, link type %d", magic, linkType)
+	}
+	b = b[24:]
+	for _, want := range [][]byte{ping, pong} {
+		if len(b) < 16 {
+			t.Fatalf("capture ends early")
+		}
+		seconds := int64(binary.LittleEndian.Uint32(b))
+		length, orig := binary.LittleEndian.Uint32(b[8:]), binary.LittleEndian.Uint32(b[12:])
+		if since := time.Since(time.Unix(seconds, 0)); since < 0 || since > time.Minute {
+			t.Errorf("record timestamped %v ago", since)
+		}
+		if int(length) != len(want) || length != orig || len(b) < 16+int(length) {
+			t.Fatalf("record of %d bytes out of %d", length, orig)
+		}
+		if !bytes.Equal(b[16:16+length], want) {
+			t.Errorf("captured %x, want %x", b[16:16+length], want)
+		}
+		b = b[16+length:]
+	}
+	if len(b) != 0 {
+		t.Errorf("%d bytes captured after disabling capture", len(b))
+	}
+
+	// capture stops on a write error, leaving the data path be
+
+	dev1.SetPacketCapture(failingWriter{})
+	transit(tun2, tun1, ping)
+	transit(tun2, tun1, ping)
+	dev1.SetPacketCapture(nil)
+}
+
+func TestPacketCaptureBlockedWriter(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelSilent, ""),
+	})
+	w := make(blockingWriter)
+	defer close(w)
+
+	device.SetPacketCapture(w)
+	start := time.Now()
+	device.Close()
+	if waited := time.Since(start); waited > 2*captureStopWait {
+		t.Errorf("closing waited %v on a blocked capture writer", waited)
+	}
+}
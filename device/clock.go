@@ -0,0 +1,79 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"time"
+)
+
+/* Handshake initiations carry a TAI64N timestamp of the wall clock, and a
+ * peer refuses an initiation whose timestamp is not after that of the last
+ * it took from us, as a replay. When the wall clock jumps back, as when a
+ * paused VM is resumed and its clock set again, our initiations are refused
+ * until the clock catches up with the last timestamp the peer saw.
+ *
+ * The clock routine compares the time passed by the wall clock with that
+ * of the monotonic clock every ClockCheckInterval, logging backward jumps
+ * of more than ClockJumpThreshold and reporting them to every peer as a
+ * HandshakeClockJump event. Forward jumps, from time spent suspended, leave
+ * timestamps valid. With clock_jump_handshake=true, peers with a session
+ * are sent an initiation at once, so that a refusal shows in the handshake
+ * retries while the session still carries traffic, rather than when it is
+ * about to expire.
+ */
+
+func (device *Device) RoutineClockCheck() {
+	defer func() {
+		device.log.Verbosef("Routine: clock check - stopped")
+		device.state.stopping.Done()
+	}()
+
+	device.log.Verbosef("Routine: clock check - started")
+	device.state.starting.Done()
+
+	ticker := time.NewTicker(ClockCheckInterval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case <-device.signals.stop:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			device.checkClock(now.Sub(last), now.Round(0).Sub(last.Round(0)))
+			last = now
+		}
+	}
+}
+
+/* Handles a jump of the wall clock, given the time passed by the monotonic
+ * clock and by the wall clock over the same span.
+ */
+func (device *Device) checkClock(elapsed, wallElapsed time.Duration) {
+	jump := elapsed - wallElapsed
+	if jump < ClockJumpThreshold {
+		return
+	}
+	device.log.Errorf("Wall clock jumped back by %v, peers may refuse handshake initiations until it catches up", jump)
+
+	device.peers.RLock()
+	peers := make([]*Peer, 0, len(device.peers.keyMap))
+	for _, peer := range device.peers.keyMap {
+		peers = append(peers, peer)
+	}
+	device.peers.RUnlock()
+
+	handshake := device.clockHandshake.Get() && device.isUp.Get()
+	for _, peer := range peers {
+		peer.handshakeEvent(HandshakeClockJump, 0)
+		if handshake && peer.keypairs.Current() != nil {
+			if err := peer.SendHandshakeInitiation(false); err != nil {
+				device.log.Verbosef("%v - Failed to initiate handshake after clock jump: %v", peer, err)
+			}
+		}
+	}
+}
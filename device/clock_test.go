@@ -0,0 +1,70 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+func TestClockJump(t *testing.T) {
+	dev1, tun1, dev2, tun2 := newBindTestPair(t, bindtest.NewNetwork(1))
+	defer dev1.Close()
+	defer dev2.Close()
+
+	tun2.Outbound <- tuntest.Ping(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"))
+	select {
+	case <-tun1.Inbound:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ping did not transit")
+	}
+	if err := ipcSet(dev2, "rekey_timeout=100\nrekey_jitter_max=50\nclock_jump_handshake=true\n"); err != nil {
+		t.Fatal(err)
+	}
+	if get := ipcGet(t, dev2); !strings.Contains(get, "\nclock_jump_handshake=true\n") {
+		t.Errorf("get output missing clock_jump_handshake:\n%s", get)
+	}
+	key, err := wgcfg.ParseHexKey("49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan HandshakeEvent, 1)
+	dev2.SetHandshakeEventHandler(func(event HandshakeEvent) {
+		if event.Reason == HandshakeClockJump {
+			events <- event
+		}
+	})
+	time.Sleep(150 * time.Millisecond)
+	attempts := dev2.Metrics().HandshakeAttempts
+
+	// the wall clock lagging less than the threshold goes unreported
+
+	dev2.checkClock(ClockCheckInterval, ClockCheckInterval-ClockJumpThreshold/2)
+	select {
+	case event := <-events:
+		t.Fatalf("event for a lag under the threshold: %+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	dev2.checkClock(ClockCheckInterval, -time.Minute)
+	select {
+	case event := <-events:
+		if event.PeerKey != key {
+			t.Errorf("event for peer %v", event.PeerKey)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event for a backward jump")
+	}
+	if got := dev2.Metrics().HandshakeAttempts; got != attempts+1 {
+		t.Errorf("%d handshake initiations after the jump, want 1", got-attempts)
+	}
+}
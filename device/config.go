@@ -3,8 +3,11 @@
 package device
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/tailscale/wireguard-go/ipc"
@@ -57,7 +60,7 @@ func (device *Device) Config() *wgcfg.Config {
 func (device *Device) Reconfig(cfg *wgcfg.Config) (err error) {
 	defer func() {
 		if err != nil {
-			device.log.Debug.Printf("device.Reconfig: failed: %v", err)
+			device.log.Verbosef("device.Reconfig: failed: %v", err)
 			device.RemoveAllPeers()
 		}
 	}()
@@ -73,7 +76,7 @@ func (device *Device) Reconfig(cfg *wgcfg.Config) (err error) {
 		delete(oldPeers, p.PublicKey)
 	}
 	for k := range oldPeers {
-		device.log.Debug.Printf("device.Reconfig: removing old peer %s", k.ShortString())
+		device.log.Verbosef("device.Reconfig: removing old peer %s", k.ShortString())
 		device.RemovePeer(k)
 	}
 
@@ -82,7 +85,7 @@ func (device *Device) Reconfig(cfg *wgcfg.Config) (err error) {
 	device.staticIdentity.Unlock()
 
 	if !curPrivKey.Equal(cfg.PrivateKey) {
-		device.log.Debug.Println("device.Reconfig: resetting private key")
+		device.log.Verbosef("device.Reconfig: resetting private key")
 		if err := device.SetPrivateKey(cfg.PrivateKey); err != nil {
 			return err
 		}
@@ -102,7 +105,7 @@ func (device *Device) Reconfig(cfg *wgcfg.Config) (err error) {
 	for _, p := range cfg.Peers {
 		peer := device.LookupPeer(p.PublicKey)
 		if peer == nil {
-			device.log.Debug.Printf("device.Reconfig: new peer %s", p.PublicKey.ShortString())
+			device.log.Verbosef("device.Reconfig: new peer %s", p.PublicKey.ShortString())
 			peer, err = device.NewPeer(p.PublicKey)
 			if err != nil {
 				return err
@@ -112,19 +115,27 @@ func (device *Device) Reconfig(cfg *wgcfg.Config) (err error) {
 			}
 		}
 
+		modified := false
 		if !p.PresharedKey.IsZero() {
 			peer.handshake.mutex.Lock()
-			peer.handshake.presharedKey = p.PresharedKey
+			if !peer.handshake.presharedKey.Equal(p.PresharedKey) {
+				peer.handshake.presharedKey = p.PresharedKey
+				modified = true
+			}
 			peer.handshake.mutex.Unlock()
 
-			device.log.Debug.Printf("device.Reconfig: setting preshared key for peer %s", p.PublicKey.ShortString())
+			device.log.Verbosef("device.Reconfig: setting preshared key for peer %s", p.PublicKey.ShortString())
 		}
 
 		peer.Lock()
-		peer.persistentKeepaliveInterval = p.PersistentKeepalive
-		if len(p.Endpoints) > 0 && (peer.endpoint == nil || !endpointsEqual(p.Endpoints, peer.endpoint.Addrs())) {
-			str := p.Endpoints[0].String()
-			for _, cfgEp := range p.Endpoints[1:] {
+		if peer.persistentKeepaliveInterval != p.PersistentKeepalive {
+			peer.persistentKeepaliveInterval = p.PersistentKeepalive
+			modified = true
+		}
+		endpoints := configEndpointsOfFamily(device.listenFamily(), p.Endpoints)
+		if len(endpoints) > 0 && (peer.endpoint == nil || !endpointsEqual(endpoints, peer.endpoint.Addrs())) {
+			str := endpoints[0].String()
+			for _, cfgEp := range endpoints[1:] {
 				str += "," + cfgEp.String()
 			}
 			ep, err := device.createEndpoint(p.PublicKey, str)
@@ -133,6 +144,10 @@ func (device *Device) Reconfig(cfg *wgcfg.Config) (err error) {
 				return err
 			}
 			peer.endpoint = ep
+			peer.endpointHost = ""
+			peer.endpointRace = nil
+			peer.endpointCandidates = nil
+			modified = true
 
 			// TODO(crawshaw): whether or not a new keepalive is necessary
 			// on changing the endpoint depends on the semantics of the
@@ -142,12 +157,19 @@ func (device *Device) Reconfig(cfg *wgcfg.Config) (err error) {
 
 				// Make sure the new handshake will get fired.
 				peer.handshake.mutex.Lock()
-				peer.handshake.lastSentHandshake = time.Now().Add(-RekeyTimeout)
+				peer.handshake.lastSentHandshake = time.Now().Add(-device.rekeyTimeout())
 				peer.handshake.mutex.Unlock()
 			}
 		}
 		peer.Unlock()
 
+		if !allowedIPsEqual(device.allowedips.EntriesForPeer(peer), p.AllowedIPs) {
+			modified = true
+		}
+		if modified {
+			atomic.StoreInt64(&peer.lifecycle.modifiedNano, time.Now().UnixNano())
+		}
+
 		device.allowedips.RemoveByPeer(peer)
 		// DANGER: allowedIP is a value type. Its contents (the IP and
 		// Mask) are overwritten on every iteration through the
@@ -164,7 +186,7 @@ func (device *Device) Reconfig(cfg *wgcfg.Config) (err error) {
 
 	// Send immediate keepalive if we're turning it on and before it wasn't on.
 	for k, peer := range newKeepalivePeers {
-		device.log.Debug.Printf("device.Reconfig: sending keepalive to peer %s", k.ShortString())
+		device.log.Verbosef("device.Reconfig: sending keepalive to peer %s", k.ShortString())
 		peer.SendKeepalive()
 	}
 
@@ -187,4 +209,138 @@ func endpointsEqual(x, y []wgcfg.Endpoint) bool {
 	return true
 }
 
+/* Reports whether the allowed IPs of a peer, as in the table, are the
+ * prefixes of cidrs.
+ */
+func allowedIPsEqual(allowed []net.IPNet, cidrs []wgcfg.CIDR) bool {
+	prefixes := make(map[string]bool)
+	for _, cidr := range cidrs {
+		ip := cidr.IP.IP()
+		if cidr.IP.Is4() {
+			ip = ip.To4()
+		}
+		mask := net.CIDRMask(int(cidr.Mask), len(ip)*8)
+		prefixes[(&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()] = true
+	}
+	if len(prefixes) != len(allowed) {
+		return false
+	}
+	for _, prefix := range allowed {
+		if !prefixes[prefix.String()] {
+			return false
+		}
+	}
+	return true
+}
+
 var ErrPortInUse = fmt.Errorf("wireguard: local port in use: %w", &IPCError{ipc.IpcErrorPortInUse})
+
+var (
+	ErrPeerExists   = errors.New("wireguard: peer already exists")
+	ErrPeerNotFound = errors.New("wireguard: peer not found")
+)
+
+// PeerConfig is the configuration of a single peer, for use with
+// AddPeer and UpdatePeer.
+type PeerConfig struct {
+	PublicKey           wgcfg.Key
+	Endpoint            string // as in UAPI, empty to keep the current endpoint
+	AllowedIPs          []wgcfg.CIDR
+	PresharedKey        wgcfg.SymmetricKey // zero for none
+	PersistentKeepalive uint16             // in seconds, zero to disable
+}
+
+// AddPeer adds a peer with the given configuration.
+// It returns ErrPeerExists if the peer is already configured.
+func (device *Device) AddPeer(config PeerConfig) error {
+	if device.LookupPeer(config.PublicKey) != nil {
+		return ErrPeerExists
+	}
+	device.staticIdentity.RLock()
+	self := device.staticIdentity.publicKey.Equal(config.PublicKey)
+	device.staticIdentity.RUnlock()
+	if self {
+		return errors.New("wireguard: peer has the public key of the device")
+	}
+
+	p, err := device.peerConfigToSet(config)
+	if err != nil {
+		return err
+	}
+	if device.strictAllowedIPs.Get() {
+		if err := device.checkAllowedIPConflicts([]*ipcSetPeer{p}, false); err != nil {
+			return err
+		}
+	}
+	if err := device.ipcApplyPeer(p); err != nil {
+		return err
+	}
+	if device.LookupPeer(config.PublicKey) == nil {
+		return errors.New("wireguard: invalid peer public key")
+	}
+	return nil
+}
+
+// UpdatePeer replaces the configuration of the peer with publicKey,
+// including its allowed IPs. config.PublicKey must be zero or publicKey.
+// It returns ErrPeerNotFound if there is no such peer.
+func (device *Device) UpdatePeer(publicKey wgcfg.Key, config PeerConfig) error {
+	if !config.PublicKey.IsZero() && !config.PublicKey.Equal(publicKey) {
+		return errors.New("wireguard: peer public key mismatch")
+	}
+	config.PublicKey = publicKey
+	if device.LookupPeer(publicKey) == nil {
+		return ErrPeerNotFound
+	}
+
+	p, err := device.peerConfigToSet(config)
+	if err != nil {
+		return err
+	}
+	p.updateOnly = true
+	if device.strictAllowedIPs.Get() {
+		if err := device.checkAllowedIPConflicts([]*ipcSetPeer{p}, false); err != nil {
+			return err
+		}
+	}
+	return device.ipcApplyPeer(p)
+}
+
+// peerConfigToSet validates config and converts it to the form applied
+// by the UAPI set operation, so that both share the same semantics.
+func (device *Device) peerConfigToSet(config PeerConfig) (*ipcSetPeer, error) {
+	psk := config.PresharedKey
+	keepalive := config.PersistentKeepalive
+	p := &ipcSetPeer{
+		publicKey:           config.PublicKey,
+		presharedKey:        &psk,
+		persistentKeepalive: &keepalive,
+		replaceAllowedIPs:   true,
+	}
+
+	if config.Endpoint != "" {
+		endpoint, race, host, err := device.createEndpointResolving(config.PublicKey, config.Endpoint, device.listenFamily())
+		if err != nil {
+			return nil, fmt.Errorf("wireguard: invalid endpoint %q: %v", config.Endpoint, err)
+		}
+		p.endpoint = endpoint
+		p.endpointRace = race
+		p.endpointHost = host
+	}
+
+	for _, cidr := range config.AllowedIPs {
+		network := cidr.IPNet()
+		if cidr.IP.Is4() {
+			if cidr.Mask > 32 {
+				return nil, fmt.Errorf("wireguard: invalid allowed IP %v/%d", cidr.IP, cidr.Mask)
+			}
+			network.IP = network.IP.To4()
+		} else if cidr.Mask > 128 {
+			return nil, fmt.Errorf("wireguard: invalid allowed IP %v/%d", cidr.IP, cidr.Mask)
+		}
+		network.IP = network.IP.Mask(network.Mask)
+		p.allowedIPs = append(p.allowedIPs, network)
+	}
+
+	return p, nil
+}
@@ -4,9 +4,12 @@ import (
 	"bufio"
 	"bytes"
 	"io"
+	"net"
 	"os"
 	"sort"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/tailscale/wireguard-go/tun"
 	"github.com/tailscale/wireguard-go/wgcfg"
@@ -137,6 +140,8 @@ func TestConfig(t *testing.T) {
 		device1.peers.RLock()
 		originalPeer0 := device1.peers.keyMap[pk2.Public()]
 		device1.peers.RUnlock()
+		modified := atomic.LoadInt64(&originalPeer0.lifecycle.modifiedNano)
+		time.Sleep(time.Millisecond)
 
 		if err := device1.Reconfig(cfg1); err != nil {
 			t.Fatal(err)
@@ -150,6 +155,9 @@ func TestConfig(t *testing.T) {
 		if originalPeer0 != newPeer0 {
 			t.Error("reconfig modified old peer")
 		}
+		if got := atomic.LoadInt64(&newPeer0.lifecycle.modifiedNano); got != modified {
+			t.Error("reconfig changed the modification time of unchanged peer")
+		}
 	})
 
 	t.Run("device1 remove peer", func(t *testing.T) {
@@ -177,6 +185,87 @@ type nilTun struct {
 	closed chan struct{}
 }
 
+func TestPeerConfigAPI(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev: "),
+	})
+	defer device.Close()
+
+	sk, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := device.SetPrivateKey(sk); err != nil {
+		t.Fatal(err)
+	}
+	peerKey, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip1, err := wgcfg.ParseCIDR("10.0.0.1/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip2, err := wgcfg.ParseCIDR("fd00::/64")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := PeerConfig{
+		PublicKey:           peerKey.Public(),
+		Endpoint:            "127.0.0.1:51820",
+		AllowedIPs:          []wgcfg.CIDR{ip1},
+		PersistentKeepalive: 25,
+	}
+	if err := device.AddPeer(config); err != nil {
+		t.Fatal(err)
+	}
+	if err := device.AddPeer(config); err != ErrPeerExists {
+		t.Errorf("AddPeer() of existing peer = %v, want ErrPeerExists", err)
+	}
+	if err := device.AddPeer(PeerConfig{PublicKey: sk.Public()}); err == nil {
+		t.Error("AddPeer() of device key succeeded")
+	}
+	peer := device.LookupPeer(config.PublicKey)
+	if got := device.allowedips.LookupIP(net.ParseIP("10.0.0.1")); got != peer {
+		t.Errorf("allowed IP routed to %v, want %v", got, peer)
+	}
+
+	// updates replace the allowed IPs and keep the endpoint unless set
+
+	config.PublicKey = wgcfg.Key{}
+	config.Endpoint = ""
+	config.AllowedIPs = []wgcfg.CIDR{ip2}
+	config.PersistentKeepalive = 0
+	if err := device.UpdatePeer(peer.handshake.remoteStatic, config); err != nil {
+		t.Fatal(err)
+	}
+	if got := device.allowedips.LookupIP(net.ParseIP("10.0.0.1")); got != nil {
+		t.Error("allowed IP not replaced")
+	}
+	if got := device.allowedips.LookupIP(net.ParseIP("fd00::1")); got != peer {
+		t.Errorf("allowed IP routed to %v, want %v", got, peer)
+	}
+	if peer.endpoint == nil || peer.endpoint.DstToString() != "127.0.0.1:51820" || peer.persistentKeepaliveInterval != 0 {
+		t.Errorf("unexpected peer state after update")
+	}
+
+	config.Endpoint = "not an endpoint"
+	if err := device.UpdatePeer(peer.handshake.remoteStatic, config); err == nil {
+		t.Error("UpdatePeer() with invalid endpoint succeeded")
+	}
+
+	if err := device.RemovePeer(peer.handshake.remoteStatic); err != nil {
+		t.Fatal(err)
+	}
+	if err := device.RemovePeer(peer.handshake.remoteStatic); err != ErrPeerNotFound {
+		t.Errorf("RemovePeer() of removed peer = %v, want ErrPeerNotFound", err)
+	}
+	if err := device.UpdatePeer(peer.handshake.remoteStatic, config); err != ErrPeerNotFound {
+		t.Errorf("UpdatePeer() of removed peer = %v, want ErrPeerNotFound", err)
+	}
+}
+
 func newNilTun() tun.Device {
 	return &nilTun{
 		events: make(chan tun.Event),
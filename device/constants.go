@@ -35,7 +35,47 @@ const (
 /* Implementation constants */
 
 const (
-	UnderLoadQueueSize = QueueHandshakeSize / 8
-	UnderLoadAfterTime = time.Second // how long does the device remain under load after detected
-	MaxPeers           = 1 << 16     // maximum number of configured peers
+	UnderLoadQueueSize  = QueueHandshakeSize / 8
+	UnderLoadAfterTime  = time.Second // how long does the device remain under load after detected
+	MaxPeers            = 1 << 16     // maximum number of configured peers
+	QueueEventSize      = 256         // maximum number of application callbacks pending
+	QueueSubscriberSize = 256         // maximum number of events pending per UAPI subscriber
+	MessageBuffersKept  = 4096        // message buffers kept for reuse, unless preallocated
+	EndpointFailover    = 3           // handshake attempts to an endpoint before failing over to the next candidate
+	MaxListenPorts      = 64          // maximum number of ports listened on at once
+	MaxNonceQueueSize   = 1 << 16     // largest nonce queue a peer may be given
+	MaxPunchPorts       = 1024        // maximum number of candidate ports hole punching sends each initiation to
+	PunchBurst          = 1           // default number of times a hole punching burst sends to each candidate port
+	MaxPunchBurst       = 16          // largest number of times a hole punching burst may send to each candidate port
+	MaxQuarantineAddrs  = 1 << 16     // maximum number of source addresses tracked for quarantine
+	MaxPeerNameLength   = 64          // longest name a peer may be given, in bytes
+
+	MaxHandshakeConcurrency = 1 << 16 // largest number of handshake messages computed at once
+
+	TransportUnreachableErrors = 3 // sends failing in a row as unreachable before the transport of a peer is reported unreachable
+	HybridFallbackAttempts     = 3 // hybrid initiations unanswered in a row before falling back to classic ones
+
+	HandshakeBackoffMax     = time.Second * 60       // default ceiling of the handshake retransmit backoff
+	AdaptiveKeepaliveMax    = time.Second * 120      // default ceiling of the adaptive persistent keepalive interval
+	SuppressedKeepalive     = time.Second * 120      // how often an idle peer without NAT is sent a persistent keepalive
+	EndpointResolveInterval = time.Minute * 5        // default interval of resolving endpoints configured by hostname again
+	EndpointRaceDelay       = time.Millisecond * 50  // head start of IPv6 over IPv4 in racing the endpoints of a dual-stack hostname
+	PunchInterval           = time.Millisecond * 2   // default pace of the sends of a hole punching burst
+	NetworkChangeDebounce   = time.Millisecond * 250 // window within which network changes are handled together
+	PortHopMinInterval      = time.Second            // shortest interval of source port hopping
+	CookieRotationMin       = time.Second * 10       // shortest interval of cookie secret rotation
+	CookieRotationMax       = time.Hour              // longest interval of cookie secret rotation
+	CookieRotationGrace     = RekeyTimeout           // how long cookies made under the previous cookie secret are still taken
+	RateLimitMaxDelay       = time.Millisecond * 10  // longest an outbound batch waits on the peer's rate limit before being dropped
+	NonceQueueTimeout       = time.Millisecond * 10  // default longest a packet waits for room in a full nonce queue with the block policy
+	MaxNonceQueueTimeout    = time.Second            // longest a packet may be made to wait for room in a full nonce queue
+	PathMTUProbeInterval    = time.Second * 60       // how often path MTU discovery probes the path to each peer
+	PathMTUProbeTimeout     = time.Second            // how long after a probe the path MTU learnt from it is read back
+	PathMTUMin              = 576                    // smallest inner MTU path MTU discovery lowers a peer to
+	ICMPErrorBurst          = 10                     // ICMP errors written to the TUN device in a burst
+	ICMPErrorRate           = time.Second / 100      // sustained rate of ICMP errors written to the TUN device
+	QuarantineWindow        = time.Second * 10       // default window of counting authentication failures, and of quarantining for them
+	LossWindow              = time.Second * 30       // span of received messages the loss estimate of a peer is taken over
+	ClockCheckInterval      = time.Second * 10       // how often the wall clock is checked against the monotonic clock
+	ClockJumpThreshold      = time.Second            // smallest backward jump of the wall clock reported
 )
@@ -16,16 +16,28 @@ import (
 	"github.com/tailscale/wireguard-go/wgcfg"
 )
 
+/* The cookie secret is replaced, when a cookie reply is next needed, once
+ * it is older than the rotation interval, CookieRefreshTime unless set
+ * with SetRotationInterval. Cookies made under the previous secret are
+ * still taken for CookieRotationGrace after it is replaced, so that an
+ * initiation retransmitted with a cookie handed out just before is not
+ * met with yet another cookie reply.
+ */
+
 type CookieChecker struct {
 	sync.RWMutex
 	mac1 struct {
 		key [blake2s.Size]byte
 	}
 	mac2 struct {
-		secret        [blake2s.Size]byte
-		secretSet     time.Time
-		encryptionKey [chacha20poly1305.KeySize]byte
+		secret         [blake2s.Size]byte
+		secretSet      time.Time
+		previousSecret [blake2s.Size]byte
+		hasPrevious    bool // previousSecret was replaced at secretSet
+		encryptionKey  [chacha20poly1305.KeySize]byte
 	}
+	interval  time.Duration // rotation interval, 0 for CookieRefreshTime
+	rotations uint64        // secrets replaced
 }
 
 type CookieGenerator struct {
@@ -65,6 +77,43 @@ func (st *CookieChecker) Init(pk wgcfg.Key) {
 	}()
 
 	st.mac2.secretSet = time.Time{}
+	st.mac2.hasPrevious = false
+}
+
+// SetRotationInterval sets how long a cookie secret is used before it is
+// replaced. Zero restores the default of CookieRefreshTime.
+func (st *CookieChecker) SetRotationInterval(interval time.Duration) {
+	st.Lock()
+	defer st.Unlock()
+	st.interval = interval
+}
+
+// RotationInterval returns how long a cookie secret is used before it is
+// replaced.
+func (st *CookieChecker) RotationInterval() time.Duration {
+	st.RLock()
+	defer st.RUnlock()
+	return st.rotationInterval()
+}
+
+func (st *CookieChecker) rotationInterval() time.Duration {
+	if st.interval == 0 {
+		return CookieRefreshTime
+	}
+	return st.interval
+}
+
+// Rotations returns the number of times the cookie secret was replaced.
+func (st *CookieChecker) Rotations() uint64 {
+	st.RLock()
+	defer st.RUnlock()
+	return st.rotations
+}
+
+func (st *CookieChecker) resetRotations() {
+	st.Lock()
+	defer st.Unlock()
+	st.rotations = 0
 }
 
 func (st *CookieChecker) CheckMAC1(msg []byte) bool {
@@ -88,15 +137,23 @@ func (st *CookieChecker) CheckMAC2(msg []byte, src []byte) bool {
 	st.RLock()
 	defer st.RUnlock()
 
-	if time.Since(st.mac2.secretSet) > CookieRefreshTime {
+	age := time.Since(st.mac2.secretSet)
+	if age > st.rotationInterval() {
 		return false
 	}
+	if st.checkMAC2(&st.mac2.secret, msg, src) {
+		return true
+	}
+	return st.mac2.hasPrevious && age <= CookieRotationGrace && st.checkMAC2(&st.mac2.previousSecret, msg, src)
+}
+
+func (st *CookieChecker) checkMAC2(secret *[blake2s.Size]byte, msg []byte, src []byte) bool {
 
 	// derive cookie key
 
 	var cookie [blake2s.Size128]byte
 	func() {
-		mac, _ := blake2s.New128(st.mac2.secret[:])
+		mac, _ := blake2s.New128(secret[:])
 		mac.Write(src)
 		mac.Sum(cookie[:0])
 	}()
@@ -125,15 +182,22 @@ func (st *CookieChecker) CreateReply(
 
 	// refresh cookie secret
 
-	if time.Since(st.mac2.secretSet) > CookieRefreshTime {
+	if time.Since(st.mac2.secretSet) > st.rotationInterval() {
 		st.RUnlock()
 		st.Lock()
-		_, err := rand.Read(st.mac2.secret[:])
-		if err != nil {
-			st.Unlock()
-			return nil, err
+		if time.Since(st.mac2.secretSet) > st.rotationInterval() {
+			previous := st.mac2.secret
+			_, err := rand.Read(st.mac2.secret[:])
+			if err != nil {
+				st.mac2.secret = previous
+				st.Unlock()
+				return nil, err
+			}
+			st.mac2.previousSecret = previous
+			st.mac2.hasPrevious = !st.mac2.secretSet.IsZero()
+			st.mac2.secretSet = time.Now()
+			st.rotations++
 		}
-		st.mac2.secretSet = time.Now()
 		st.Unlock()
 		st.RLock()
 	}
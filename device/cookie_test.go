@@ -7,6 +7,7 @@ package device
 
 import (
 	"testing"
+	"time"
 
 	"github.com/tailscale/wireguard-go/wgcfg"
 )
@@ -191,3 +192,69 @@ func TestCookieMAC1(t *testing.T) {
 		0x7d, 0xa1, 0xd5, 0x85, 0x6d, 0xf0, 0x1b, 0xaa,
 	})
 }
+
+func TestCookieRotation(t *testing.T) {
+	var (
+		generator CookieGenerator
+		checker   CookieChecker
+	)
+
+	sk, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.Public()
+
+	generator.Init(pk)
+	checker.Init(pk)
+	checker.SetRotationInterval(CookieRotationMin)
+
+	src := []byte{192, 168, 13, 37, 10, 10, 10}
+	cookieFor := func() []byte {
+		t.Helper()
+		msg := make([]byte, MessageInitiationSize)
+		generator.AddMacs(msg)
+		reply, err := checker.CreateReply(msg, 1377, src)
+		if err != nil {
+			t.Fatal("Failed to create cookie reply:", err)
+		}
+		if !generator.ConsumeReply(reply) {
+			t.Fatal("Failed to consume cookie reply")
+		}
+		msg = make([]byte, MessageInitiationSize)
+		generator.AddMacs(msg)
+		return msg
+	}
+
+	old := cookieFor()
+	if rotations := checker.Rotations(); rotations != 1 {
+		t.Fatalf("%d rotations, want 1", rotations)
+	}
+	if !checker.CheckMAC2(old, src) {
+		t.Fatal("cookie refused")
+	}
+
+	// a cookie of the previous secret is taken for the grace period
+
+	checker.mac2.secretSet = time.Now().Add(-CookieRotationMin - time.Second)
+	if checker.CheckMAC2(old, src) {
+		t.Error("cookie of a stale secret taken")
+	}
+	current := cookieFor()
+	if rotations := checker.Rotations(); rotations != 2 {
+		t.Fatalf("%d rotations, want 2", rotations)
+	}
+	if !checker.CheckMAC2(current, src) {
+		t.Error("cookie of the current secret refused")
+	}
+	if !checker.CheckMAC2(old, src) {
+		t.Error("cookie of the previous secret refused within the grace period")
+	}
+	checker.mac2.secretSet = time.Now().Add(-CookieRotationGrace - time.Second)
+	if checker.CheckMAC2(old, src) {
+		t.Error("cookie of the previous secret taken after the grace period")
+	}
+	if !checker.CheckMAC2(current, src) {
+		t.Error("cookie of the current secret refused")
+	}
+}
@@ -6,14 +6,17 @@
 package device
 
 import (
+	"context"
+	"math/rand"
 	"net"
-	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/device/tokenbucket"
 	"github.com/tailscale/wireguard-go/ratelimiter"
+	"github.com/tailscale/wireguard-go/replay"
 	"github.com/tailscale/wireguard-go/rwcancel"
 	"github.com/tailscale/wireguard-go/tun"
 	"github.com/tailscale/wireguard-go/wgcfg"
@@ -23,17 +26,59 @@ import (
 
 const (
 	DeviceRoutineNumberPerCPU     = 3
-	DeviceRoutineNumberAdditional = 2
+	DeviceRoutineNumberAdditional = 4
 )
 
 type Device struct {
-	isUp           AtomicBool // device is (going) up
-	isClosed       AtomicBool // device is closed? (acting as guard)
-	log            *Logger
-	handshakeDone  func(peerKey wgcfg.Key, allowedIPs []net.IPNet)
-	skipBindUpdate bool
-	createBind     func(uport uint16, device *Device) (conn.Bind, uint16, error)
-	createEndpoint func(key [32]byte, s string) (conn.Endpoint, error)
+	// These fields are accessed with atomic operations, which must be
+	// 64-bit aligned even on 32-bit platforms. Go guarantees that an
+	// allocated struct will be 64-bit aligned, so they are kept first.
+	timers struct {
+		rekeyTimeout     int64 // time.Duration, see RekeyTimeout
+		keepaliveTimeout int64 // time.Duration, see KeepaliveTimeout
+		rejectAfterTime  int64 // time.Duration, see RejectAfterTime
+		handshakeBackoff int64 // time.Duration, see HandshakeBackoffMax
+		endpointResolve  int64 // time.Duration, see EndpointResolveInterval
+		jitterMax        int64 // time.Duration, see RekeyTimeoutJitterMaxMs
+		rekeyMessages    int64 // messages, see RekeyAfterMessages
+		jitter           struct {
+			sync.Mutex
+			rand *rand.Rand // see SetJitterSource
+		}
+	}
+	stats struct {
+		cookieRepliesSent    uint64              // cookie replies sent to handshakes without a valid mac2 under load
+		cookieRepliesLimited uint64              // cookie replies withheld by the per-source rate limit
+		invalidMACs          uint64              // handshake messages with an invalid mac1
+		rejectedUnderLoad    uint64              // handshake messages refused under load, for lacking a cookie or by the rate limit
+		dropped              [DropReasons]uint64 // packets dropped, by DropReason
+		dropsSeen            uint64              // packets dropped while drop logging was on, for sampling
+	}
+
+	isUp             AtomicBool // device is (going) up
+	isClosed         AtomicBool // device is closed? (acting as guard)
+	isShuttingDown   AtomicBool // device no longer takes packets from the TUN device
+	isPaused         AtomicBool // device is up, but its timers and bind are stopped
+	dscpPassthrough  AtomicBool // copy the DSCP of inner packets to the outer header
+	ecn              AtomicBool // propagate ECN between inner and outer headers (RFC 6040)
+	flowLabelHashing AtomicBool // label outer IPv6 datagrams by inner flow, see flowlabel.go
+	strictAllowedIPs AtomicBool // reject allowed IPs already assigned to another peer
+	stickyPort       AtomicBool // rebind to the last bound port when the listen port is 0
+	passive          AtomicBool // never initiate handshakes, only respond to those of peers
+	eagerHandshake   AtomicBool // initiate a handshake with peers added with an endpoint at once
+	clockHandshake   AtomicBool // initiate a handshake with peers having a session when the wall clock jumps back
+	postQuantum      AtomicBool // take hybrid handshakes, and initiate them with post-quantum peers
+	aesGCM           AtomicBool // advertise and agree on AES-GCM transport keys, see aesgcm.go
+	pathMTUDiscovery AtomicBool // forbid fragmentation of outer packets, fitting inner packets to the path MTU
+	replayWindow     uint32     // bits of the replay window given to new keypairs, see replay.WindowBits
+	dropLogSample    uint32     // log one in this many dropped packets, 0 to never, see drops.go
+	nonceQueueSize   uint32     // capacity of the nonce queue of peers started from now on
+	log              Logger
+	handshakeDone    func(peerKey wgcfg.Key, allowedIPs []net.IPNet)
+	skipBindUpdate   bool
+	createBind       func(uport uint16, device *Device) (conn.Bind, uint16, error)
+	createEndpoint   func(key [32]byte, s string) (conn.Endpoint, error)
+	lookupHost       func(host string) ([]net.IP, error)
 
 	// synchronized resources (locks acquired in order)
 
@@ -51,8 +96,15 @@ type Device struct {
 		sync.RWMutex
 		bind          conn.Bind // bind interface
 		netlinkCancel *rwcancel.RWCancel
-		port          uint16 // listening port
-		fwmark        uint32 // mark value (0 = disabled)
+		port          uint16            // listening port
+		ports         []uint16          // further listening ports, received on alongside port
+		address       *net.IPAddr       // listening address (nil = all)
+		family        int               // only address family listened on, by IP version (0 = both)
+		fwmark        uint32            // mark value (0 = disabled)
+		proxy         *conn.SOCKS5Proxy // tunnel datagrams through this proxy (nil = disabled)
+		tcp           bool              // carry messages over TCP instead of UDP
+		obfuscation   *obfuscation      // disguise datagrams on the wire (nil = disabled)
+		lastPort      uint16            // port of the last bind, reused by sticky ports
 	}
 
 	staticIdentity struct {
@@ -71,17 +123,46 @@ type Device struct {
 	allowedips    AllowedIPs
 	indexTable    IndexTable
 	cookieChecker CookieChecker
+	handshakeGate handshakeGate // see handshakegate.go
 
 	unexpectedip func(key *wgcfg.Key, ip wgcfg.IP)
 
+	filters struct {
+		inbound  atomic.Value // PacketFilter, see SetInboundFilter
+		outbound atomic.Value // PacketFilter, see SetOutboundFilter
+	}
+
+	padding    atomic.Value // paddingConfig, see padding.go
+	nonceQueue atomic.Value // nonceQueuePolicy, see queuepolicy.go
+	flows      atomic.Value // *flowTable, see SetFlowTracking
+
+	capture struct {
+		sync.Mutex              // serializes SetPacketCapture
+		current    atomic.Value // *packetCapture, see capture.go
+	}
+
 	rate struct {
 		underLoadUntil atomic.Value
 		limiter        ratelimiter.Ratelimiter
+		cookieLimiter  ratelimiter.Ratelimiter // cookie replies per source, so floods are not amplified
+		icmp           struct {
+			sync.Mutex
+			limit tokenbucket.TokenBucket // ICMP errors answering oversized packets
+		}
+	}
+
+	quarantine quarantine // sources failing authentication, see quarantine.go
+
+	affinity struct {
+		sync.RWMutex
+		cpus       []int  // see SetWorkerAffinity
+		generation uint32 // atomic, bumped with each change of cpus
 	}
 
 	pool struct {
-		messageBufferPool        *sync.Pool
-		messageBufferReuseChan   chan *[MaxMessageSize]byte
+		messageBufferSize        int32 // atomic, see messageBufferSize
+		packetOffset             int   // offset of packets in message buffers, see DeviceOptions.PacketOffset
+		messageBufferReuseChan   chan []byte
 		inboundElementPool       *sync.Pool
 		inboundElementReuseChan  chan *QueueInboundElement
 		outboundElementPool      *sync.Pool
@@ -92,15 +173,44 @@ type Device struct {
 		encryption chan *QueueOutboundElement
 		decryption chan *QueueInboundElement
 		handshake  chan QueueHandshakeElement
+
+		encryptionHigh queueWatermark
+		decryptionHigh queueWatermark
+		handshakeHigh  queueWatermark
 	}
 
 	signals struct {
 		stop chan struct{}
 	}
 
+	networkChange struct {
+		sync.Mutex
+		timer       *time.Timer // armed for the debounce window of the last change handled, nil if none
+		again       bool        // changed again within the window
+		whilePaused AtomicBool  // changed while paused, to be handled on resume
+	}
+
+	portHop struct {
+		sync.Mutex
+		interval time.Duration // zero if disabled
+		timer    *time.Timer   // armed for the next hop, nil if disabled
+	}
+
+	events struct {
+		sync.RWMutex
+		queue          chan func() // callbacks pending on the event routine
+		endpointChange EndpointChangeHandler
+		handshake      func(HandshakeEvent)
+		pathMTUChange  PathMTUChangeHandler
+		holePunch      HolePunchHandler
+		subscribers    map[*eventSubscriber]struct{} // UAPI subscriptions
+	}
+
 	tun struct {
-		device tun.Device
-		mtu    int32
+		device    tun.Device
+		queues    []tun.Queue // packet queues, the first being device itself
+		nextQueue int         // queue assigned to the next new peer, protected by peers lock
+		mtu       int32
 	}
 }
 
@@ -115,6 +225,10 @@ func unsafeRemovePeer(device *Device, peer *Peer, key wgcfg.Key) {
 
 	// remove from peer map
 	delete(device.peers.keyMap, key)
+	device.forgetFlows(peer)
+	device.forgetEventPeer(peer)
+
+	device.publishPeerEvent(UAPIEventPeerRemoved, key)
 }
 
 func deviceUpdateState(device *Device) {
@@ -142,7 +256,7 @@ func deviceUpdateState(device *Device) {
 	switch newIsUp {
 	case true:
 		if err := device.BindUpdate(); err != nil {
-			device.log.Error.Printf("Unable to update bind: %v\n", err)
+			device.log.Errorf("Unable to update bind: %v\n", err)
 			device.isUp.Set(false)
 			break
 		}
@@ -160,6 +274,7 @@ func deviceUpdateState(device *Device) {
 		device.peers.RUnlock()
 
 	case false:
+		device.isPaused.Set(false)
 		device.BindClose()
 		device.peers.RLock()
 		for _, peer := range device.peers.keyMap {
@@ -202,6 +317,61 @@ func (device *Device) Down() {
 	deviceUpdateState(device)
 }
 
+// Pause stops the timers of all peers and closes the bind, keeping peers,
+// their keys, statistics and allowed IPs. Nothing is sent or received until
+// Resume is called. Unlike Down, Pause keeps the current sessions, so that
+// a device going to sleep does not need to be reconfigured. It has no
+// effect if the device is down or already paused.
+func (device *Device) Pause() {
+	device.state.Lock()
+	defer device.state.Unlock()
+
+	if !device.state.current || device.isPaused.Swap(true) {
+		return
+	}
+	device.log.Verbosef("Device pausing")
+
+	device.peers.RLock()
+	for _, peer := range device.peers.keyMap {
+		peer.timersStop()
+	}
+	device.peers.RUnlock()
+
+	device.BindClose()
+}
+
+// Resume rebinds a paused device and restarts the timers of its peers,
+// initiating a handshake with peers whose session has expired or that
+// have packets waiting for one, or with every peer with a session if
+// NetworkChanged was called while paused. If the bind cannot be created,
+// the device stays paused and the error is returned.
+func (device *Device) Resume() error {
+	device.state.Lock()
+	defer device.state.Unlock()
+
+	if !device.isPaused.Get() {
+		return nil
+	}
+	device.log.Verbosef("Device resuming")
+
+	device.isPaused.Set(false)
+	if err := device.BindUpdate(); err != nil {
+		device.isPaused.Set(true)
+		return err
+	}
+
+	changed := device.networkChange.whilePaused.Swap(false)
+	device.peers.RLock()
+	for _, peer := range device.peers.keyMap {
+		peer.timersResume()
+		if changed {
+			peer.handshakeAfterNetworkChange()
+		}
+	}
+	device.peers.RUnlock()
+	return nil
+}
+
 func (device *Device) IsUnderLoad() bool {
 
 	// check if currently under load
@@ -287,7 +457,9 @@ func (device *Device) SetPrivateKey(sk wgcfg.PrivateKey) error {
 }
 
 type DeviceOptions struct {
-	Logger *Logger
+	// Logger receives the device's log messages.
+	// If nil, only errors are logged, to stdout.
+	Logger Logger
 
 	// UnexpectedIP is called when a packet is received from a
 	// validated peer with an unexpected internal IP address.
@@ -301,6 +473,24 @@ type DeviceOptions struct {
 	CreateEndpoint func(key [32]byte, s string) (conn.Endpoint, error)
 	CreateBind     func(uport uint16) (conn.Bind, uint16, error)
 	SkipBindUpdate bool // if true, CreateBind only ever called once
+
+	// LookupHost resolves the hostnames of endpoints to IP addresses.
+	// If nil, net.LookupIP is used.
+	LookupHost func(host string) ([]net.IP, error)
+
+	// Workers is the number of each of the encryption, decryption and
+	// handshake workers. If zero, there is one per CPU; if WorkersAuto,
+	// one per CPU of the cgroup CPU quota, where that is lower.
+	Workers int
+
+	// PacketOffset is the offset at which packets start in the buffers
+	// passed to the Read and Write methods of the TUN device. The bytes
+	// before it are headroom the TUN device may write headers of its own
+	// into; after it, buffers hold a packet of the MTU, padding and the
+	// authentication tag. If less than MessageTransportHeaderSize, the
+	// default, that is used: the transport header is written in place
+	// just before the packet.
+	PacketOffset int
 }
 
 func NewDevice(tunDevice tun.Device, opts *DeviceOptions) *Device {
@@ -309,6 +499,21 @@ func NewDevice(tunDevice tun.Device, opts *DeviceOptions) *Device {
 	device.isUp.Set(false)
 	device.isClosed.Set(false)
 
+	atomic.StoreInt64(&device.timers.rekeyTimeout, int64(RekeyTimeout))
+	atomic.StoreInt64(&device.timers.keepaliveTimeout, int64(KeepaliveTimeout))
+	atomic.StoreInt64(&device.timers.rejectAfterTime, int64(RejectAfterTime))
+	atomic.StoreInt64(&device.timers.handshakeBackoff, int64(HandshakeBackoffMax))
+	atomic.StoreInt64(&device.timers.endpointResolve, int64(EndpointResolveInterval))
+	atomic.StoreInt64(&device.timers.jitterMax, int64(RekeyTimeoutJitterMaxMs*time.Millisecond))
+	atomic.StoreInt64(&device.timers.rekeyMessages, RekeyAfterMessages)
+	atomic.StoreUint32(&device.replayWindow, replay.CounterBitsTotal)
+	atomic.StoreUint32(&device.nonceQueueSize, QueueOutboundSize)
+	device.SetJitterSource(nil)
+
+	device.log = NewLogger(LogLevelError, "")
+	device.lookupHost = net.LookupIP
+	device.pool.packetOffset = MessageTransportHeaderSize
+
 	if opts != nil {
 		if opts.Logger != nil {
 			device.log = opts.Logger
@@ -317,7 +522,7 @@ func NewDevice(tunDevice tun.Device, opts *DeviceOptions) *Device {
 			device.unexpectedip = opts.UnexpectedIP
 		} else {
 			device.unexpectedip = func(key *wgcfg.Key, ip wgcfg.IP) {
-				device.log.Info.Printf("IPv4 packet with disallowed source address %s from %v", ip, key)
+				device.log.Verbosef("IPv4 packet with disallowed source address %s from %v", ip, key)
 			}
 		}
 		device.handshakeDone = opts.HandshakeDone
@@ -334,23 +539,39 @@ func NewDevice(tunDevice tun.Device, opts *DeviceOptions) *Device {
 			}
 		} else {
 			device.createBind = func(uport uint16, device *Device) (conn.Bind, uint16, error) {
+				if device.net.family != 0 {
+					return conn.CreateBindToFamily(device.net.family, uport, device)
+				}
 				return conn.CreateBind(uport, device)
 			}
 		}
 		device.skipBindUpdate = opts.SkipBindUpdate
+		if opts.LookupHost != nil {
+			device.lookupHost = opts.LookupHost
+		}
+		if opts.PacketOffset > MessageTransportHeaderSize {
+			device.pool.packetOffset = opts.PacketOffset
+		}
 	}
 
 	device.tun.device = tunDevice
+	device.tun.queues = []tun.Queue{tunDevice}
+	if multiQueue, ok := tunDevice.(tun.MultiQueueDevice); ok {
+		device.tun.queues = multiQueue.Queues()
+	}
 	mtu, err := device.tun.device.MTU()
 	if err != nil {
-		device.log.Error.Println("Trouble determining MTU, assuming default:", err)
+		device.log.Errorf("Trouble determining MTU, assuming default: %v", err)
 		mtu = DefaultMTU
 	}
 	device.tun.mtu = int32(mtu)
+	device.resizeMessageBuffers(mtu)
 
 	device.peers.keyMap = make(map[wgcfg.Key]*Peer)
 
 	device.rate.underLoadUntil.Store(time.Time{})
+	device.rate.icmp.limit.Cap = ICMPErrorBurst
+	device.rate.icmp.limit.Fill = ICMPErrorRate
 
 	device.indexTable.Init()
 	device.allowedips.Reset()
@@ -362,6 +583,7 @@ func NewDevice(tunDevice tun.Device, opts *DeviceOptions) *Device {
 	device.queue.handshake = make(chan QueueHandshakeElement, QueueHandshakeSize)
 	device.queue.encryption = make(chan *QueueOutboundElement, QueueOutboundSize)
 	device.queue.decryption = make(chan *QueueInboundElement, QueueInboundSize)
+	device.events.queue = make(chan func(), QueueEventSize)
 
 	// prepare signals
 
@@ -374,19 +596,30 @@ func NewDevice(tunDevice tun.Device, opts *DeviceOptions) *Device {
 
 	// start workers
 
-	cpus := runtime.NumCPU()
+	workers := 0
+	if opts != nil {
+		workers = opts.Workers
+	}
+	cpus := workerCount(workers)
+	device.log.Verbosef("Starting %d workers of each kind", cpus)
+	device.handshakeGate.init(cpus)
 	device.state.starting.Wait()
 	device.state.stopping.Wait()
-	device.state.stopping.Add(DeviceRoutineNumberPerCPU*cpus + DeviceRoutineNumberAdditional)
-	device.state.starting.Add(DeviceRoutineNumberPerCPU*cpus + DeviceRoutineNumberAdditional)
+	routines := DeviceRoutineNumberPerCPU*cpus + DeviceRoutineNumberAdditional + len(device.tun.queues) - 1
+	device.state.stopping.Add(routines)
+	device.state.starting.Add(routines)
 	for i := 0; i < cpus; i += 1 {
 		go device.RoutineEncryption()
 		go device.RoutineDecryption()
 		go device.RoutineHandshake()
 	}
 
-	go device.RoutineReadFromTUN()
+	for _, queue := range device.tun.queues {
+		go device.RoutineReadFromTUN(queue)
+	}
 	go device.RoutineTUNEventReader()
+	go device.RoutineEvents()
+	go device.RoutineClockCheck()
 
 	device.state.starting.Wait()
 
@@ -400,8 +633,34 @@ func (device *Device) LookupPeer(pk wgcfg.Key) *Peer {
 	return device.peers.keyMap[pk]
 }
 
+// LookupPeerByIP returns the peer packets to ip are sent to, found by
+// the same longest prefix match on allowed IPs as the send path, and
+// whether there is one.
+func (device *Device) LookupPeerByIP(ip net.IP) (*Peer, bool) {
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		return nil, false
+	}
+	peer := device.allowedips.LookupIP(ip)
+	return peer, peer != nil
+}
+
+// DumpAllowedIPs returns every prefix of the allowed IPs with the peer
+// owning it, IPv4 ones first, each family in address order.
+func (device *Device) DumpAllowedIPs() []AllowedIP {
+	return device.allowedips.Entries()
+}
+
+// DumpIndexTable returns the receiver indices in use, with the peer
+// owning each and whether it belongs to a handshake in progress or to one
+// of the peer's keypairs. It helps explain transport messages dropped for
+// an unknown index.
+func (device *Device) DumpIndexTable() []Index {
+	return device.indexTable.Entries()
+}
+
 // RemovePeer stops the Peer and removes it from routing.
-func (device *Device) RemovePeer(key wgcfg.Key) {
+// It returns ErrPeerNotFound if there is no such peer.
+func (device *Device) RemovePeer(key wgcfg.Key) error {
 	device.peers.Lock()
 	peer := device.peers.keyMap[key]
 	if peer != nil {
@@ -409,7 +668,26 @@ func (device *Device) RemovePeer(key wgcfg.Key) {
 	}
 	device.peers.Unlock()
 
-	if peer != nil {
+	if peer == nil {
+		return ErrPeerNotFound
+	}
+	peer.Stop()
+	return nil
+}
+
+/* Removes peer itself, rather than whichever peer has its key: nothing is
+ * removed if it already was, even if a peer was added with its key since.
+ */
+func (device *Device) removePeer(peer *Peer) {
+	key := peer.handshake.remoteStatic
+	device.peers.Lock()
+	current := device.peers.keyMap[key] == peer
+	if current {
+		unsafeRemovePeer(device, peer, key)
+	}
+	device.peers.Unlock()
+
+	if current {
 		peer.Stop()
 	}
 }
@@ -457,7 +735,7 @@ func (device *Device) Close() {
 
 	device.state.starting.Wait()
 
-	device.log.Info.Println("Device closing")
+	device.log.Verbosef("Device closing")
 	device.state.changing.Set(true)
 
 	// Grab the state lock while we shut down both the tun device and
@@ -482,11 +760,61 @@ func (device *Device) Close() {
 
 	device.state.stopping.Wait()
 	device.FlushPacketQueues()
+	device.SetPacketCapture(nil)
 
 	device.rate.limiter.Close()
+	device.rate.cookieLimiter.Close()
 
 	device.state.changing.Set(false)
-	device.log.Info.Println("Interface closed")
+	device.log.Verbosef("Interface closed")
+}
+
+// Shutdown closes the device like Close, but first stops taking packets
+// from the TUN device and waits for the packets already queued to be sent,
+// followed by a final keepalive to every peer with a current keypair. If
+// ctx is done before then, the remaining packets are dropped and ctx.Err()
+// is returned. Either way, the device is closed and its key material
+// zeroed when Shutdown returns.
+func (device *Device) Shutdown(ctx context.Context) error {
+	if device.isClosed.Get() {
+		return nil
+	}
+
+	device.log.Verbosef("Device shutting down")
+	device.isShuttingDown.Set(true)
+
+	// queues are drained in order, so the keepalives are sent last
+
+	var pending []<-chan struct{}
+	device.peers.RLock()
+	for _, peer := range device.peers.keyMap {
+		if done := peer.queueFinalKeepalive(); done != nil {
+			pending = append(pending, done)
+		}
+	}
+	device.peers.RUnlock()
+
+	var err error
+drain:
+	for _, done := range pending {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			err = ctx.Err()
+			device.log.Errorf("Shutting down with packets still queued: %v", err)
+			break drain
+		case <-device.signals.stop:
+			break drain
+		}
+	}
+
+	device.Close()
+
+	device.staticIdentity.Lock()
+	device.staticIdentity.privateKey = wgcfg.PrivateKey{}
+	device.staticIdentity.Unlock()
+
+	return err
 }
 
 func (device *Device) Wait() chan struct{} {
@@ -501,7 +829,7 @@ func (device *Device) SendKeepalivesToPeersWithCurrentKeypair() {
 	device.peers.RLock()
 	for _, peer := range device.peers.keyMap {
 		peer.keypairs.RLock()
-		sendKeepalive := peer.keypairs.current != nil && !peer.keypairs.current.created.Add(RejectAfterTime).Before(time.Now())
+		sendKeepalive := peer.keypairs.current != nil && !peer.keypairs.current.created.Add(device.rejectAfterTime()).Before(time.Now())
 		peer.keypairs.RUnlock()
 		if sendKeepalive {
 			peer.SendKeepalive()
@@ -537,12 +865,12 @@ func (device *Device) BindSetMark(mark uint32) error {
 
 	// update fwmark on existing bind
 
-	device.net.fwmark = mark
 	if device.isUp.Get() && device.net.bind != nil {
 		if err := device.net.bind.SetMark(mark); err != nil {
 			return err
 		}
 	}
+	device.net.fwmark = mark
 
 	// clear cached source addresses
 
@@ -550,9 +878,7 @@ func (device *Device) BindSetMark(mark uint32) error {
 	for _, peer := range device.peers.keyMap {
 		peer.Lock()
 		defer peer.Unlock()
-		if peer.endpoint != nil {
-			peer.endpoint.ClearSrc()
-		}
+		peer.clearSrc()
 	}
 	device.peers.RUnlock()
 
@@ -565,7 +891,7 @@ func (device *Device) BindUpdate() error {
 	defer device.net.Unlock()
 
 	if device.skipBindUpdate && device.net.bind != nil {
-		device.log.Debug.Println("UDP bind update skipped")
+		device.log.Verbosef("UDP bind update skipped")
 		return nil
 	}
 
@@ -577,13 +903,35 @@ func (device *Device) BindUpdate() error {
 
 	// open new sockets
 
-	if device.isUp.Get() {
+	if device.isUp.Get() && !device.isPaused.Get() {
 
 		// bind to new port
 
 		var err error
 		netc := &device.net
-		netc.bind, netc.port, err = device.createBind(netc.port, device)
+		create := func(port uint16) (conn.Bind, uint16, error) {
+			if netc.proxy != nil {
+				return conn.CreateSOCKS5Bind(netc.proxy, port)
+			} else if netc.tcp {
+				return conn.CreateTCPBind(port)
+			} else if netc.address != nil {
+				return conn.CreateBindToAddress(netc.address, port, device)
+			}
+			return device.createBind(port, device)
+		}
+
+		// keep the source port seen by NATs, if it is still free
+
+		port := netc.port
+		sticky := port == 0 && netc.lastPort != 0 && device.stickyPort.Get()
+		if sticky {
+			port = netc.lastPort
+		}
+		netc.bind, netc.port, err = create(port)
+		if err != nil && sticky {
+			device.log.Verbosef("Previous port %d unavailable, binding to a new one: %v", port, err)
+			netc.bind, netc.port, err = create(0)
+		}
 		if err != nil {
 			netc.bind = nil
 			netc.port = 0
@@ -596,6 +944,36 @@ func (device *Device) BindUpdate() error {
 			netc.port = 0
 			return err
 		}
+		netc.lastPort = netc.port
+
+		// receive on further ports, replying from the port a peer was heard on
+
+		if len(netc.ports) > 0 {
+			binds := []conn.Bind{netc.bind}
+			for _, port := range netc.ports {
+				bind, _, err := create(port)
+				if err != nil {
+					if netc.netlinkCancel != nil {
+						netc.netlinkCancel.Cancel()
+						netc.netlinkCancel = nil
+					}
+					for _, bind := range binds {
+						bind.Close()
+					}
+					netc.bind = nil
+					netc.port = 0
+					return err
+				}
+				binds = append(binds, bind)
+			}
+			netc.bind = conn.NewMultiPortBind(binds)
+		}
+
+		// disguise datagrams, outside of the route listener's view of the bind
+
+		if netc.obfuscation != nil {
+			netc.bind = conn.NewObfuscatedBind(netc.bind, netc.obfuscation.obfuscator)
+		}
 
 		// set fwmark
 
@@ -606,27 +984,45 @@ func (device *Device) BindUpdate() error {
 			}
 		}
 
-		// clear cached source addresses
+		// forbid fragmentation for path MTU discovery
+
+		if device.pathMTUDiscovery.Get() {
+			if bind, ok := netc.bind.(conn.PathMTUBind); ok {
+				err = bind.SetDontFragment(true)
+				if err != nil {
+					return err
+				}
+			} else {
+				device.log.Verbosef("Path MTU discovery is not supported by the bind")
+			}
+		}
+
+		// clear cached source addresses, and send errors of the old network
 
 		device.peers.RLock()
 		for _, peer := range device.peers.keyMap {
 			peer.Lock()
 			defer peer.Unlock()
-			if peer.endpoint != nil {
-				peer.endpoint.ClearSrc()
-			}
+			peer.clearSrc()
+			peer.transportReset()
 		}
 		device.peers.RUnlock()
 
-		// start receiving routines
+		// start receiving routines, but for a disabled address family; the
+		// TCP and SOCKS5 binds receive all families as IPv4
 
-		device.net.starting.Add(conn.ConnRoutineNumber)
-		device.net.stopping.Add(conn.ConnRoutineNumber)
-		go device.RoutineReceiveIncoming(ipv4.Version, netc.bind)
-		go device.RoutineReceiveIncoming(ipv6.Version, netc.bind)
+		families := []int{ipv4.Version, ipv6.Version}
+		if netc.family != 0 && netc.proxy == nil && !netc.tcp {
+			families = []int{netc.family}
+		}
+		device.net.starting.Add(len(families))
+		device.net.stopping.Add(len(families))
+		for _, family := range families {
+			go device.RoutineReceiveIncoming(family, netc.bind)
+		}
 		device.net.starting.Wait()
 
-		device.log.Debug.Println("UDP bind has been updated")
+		device.log.Verbosef("UDP bind has been updated")
 	}
 
 	return nil
@@ -638,3 +1034,12 @@ func (device *Device) BindClose() error {
 	device.net.Unlock()
 	return err
 }
+
+// Bind returns the bind the device listens with, nil if it has none, as
+// for handing its sockets to another process when it is a conn.FDBind.
+// The bind is replaced as the device rebinds.
+func (device *Device) Bind() conn.Bind {
+	device.net.RLock()
+	defer device.net.RUnlock()
+	return device.net.bind
+}
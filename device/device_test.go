@@ -8,14 +8,20 @@ package device
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/tailscale/wireguard-go/conn/bindtest"
 	"github.com/tailscale/wireguard-go/tun/tuntest"
 	"github.com/tailscale/wireguard-go/wgcfg"
+	"golang.org/x/crypto/blake2s"
 )
 
 // TODO(crawshaw): pick unused ports on localhost
@@ -83,6 +89,185 @@ func TestTwoDevicePing(t *testing.T) {
 			t.Error("return ping did not transit")
 		}
 	})
+
+	t.Run("metrics", func(t *testing.T) {
+		m := dev1.Metrics()
+		if len(m.Peers) != 1 {
+			t.Fatalf("got %d peers, want 1", len(m.Peers))
+		}
+		key, _ := wgcfg.ParseHexKey("f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725")
+		pm, ok := m.Peers[key.Base64()]
+		if !ok {
+			t.Fatalf("peer %v missing from metrics", key)
+		}
+		if pm.HandshakesCompleted == 0 || m.HandshakesCompleted != pm.HandshakesCompleted {
+			t.Errorf("handshakes completed: peer %d, device %d", pm.HandshakesCompleted, m.HandshakesCompleted)
+		}
+		if pm.RxPackets == 0 || pm.TxPackets == 0 || pm.RxBytes == 0 || pm.TxBytes == 0 {
+			t.Errorf("missing traffic counters: %+v", pm)
+		}
+		if pm.KeypairAge <= 0 {
+			t.Errorf("keypair age = %v, want > 0", pm.KeypairAge)
+		}
+		keypair := dev1.LookupPeer(key).keypairs.Current()
+		if pm.KeypairLocalIndex != keypair.localIndex || pm.KeypairRemoteIndex != keypair.remoteIndex || pm.RekeyImminent {
+			t.Errorf("keypair state %+v, want indices %d/%d and no rekey", pm, keypair.localIndex, keypair.remoteIndex)
+		}
+		if get := ipcGet(t, dev1); !strings.Contains(get, fmt.Sprintf("keypair_local_index=%d\nkeypair_remote_index=%d\n", keypair.localIndex, keypair.remoteIndex)) ||
+			!strings.Contains(get, "rekey_imminent=false\n") {
+			t.Errorf("get output missing keypair state:\n%s", get)
+		}
+	})
+}
+
+func TestTwoDevicePingTCP(t *testing.T) {
+	tun1 := tuntest.NewChannelTUN()
+	dev1 := NewDevice(tun1.TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelDebug, "dev1: "),
+	})
+	dev1.Up()
+	defer dev1.Close()
+	if err := ipcSet(dev1, "transport=tcp\n"+cfg1); err != nil {
+		t.Fatal(err)
+	}
+	if get := ipcGet(t, dev1); !strings.Contains(get, "transport=tcp\n") {
+		t.Errorf("get output missing transport:\n%s", get)
+	}
+
+	tun2 := tuntest.NewChannelTUN()
+	dev2 := NewDevice(tun2.TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelDebug, "dev2: "),
+	})
+	dev2.Up()
+	defer dev2.Close()
+	if err := ipcSet(dev2, "transport=tcp\n"+cfg2); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		src, dst *tuntest.ChannelTUN
+		ip, from string
+	}{
+		{tun2, tun1, "1.0.0.1", "1.0.0.2"},
+		{tun1, tun2, "1.0.0.2", "1.0.0.1"},
+	} {
+		msg := tuntest.Ping(net.ParseIP(tc.ip), net.ParseIP(tc.from))
+		tc.src.Outbound <- msg
+		select {
+		case msgRecv := <-tc.dst.Inbound:
+			if !bytes.Equal(msg, msgRecv) {
+				t.Errorf("ping %s did not transit correctly", tc.ip)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("ping %s did not transit", tc.ip)
+		}
+	}
+
+	if err := ipcSet(dev1, "transport=quic\n"); err == nil {
+		t.Error("unknown transport accepted")
+	}
+}
+
+func TestTwoDevicePingPostQuantum(t *testing.T) {
+	if !kemSupported {
+		t.Skip("hybrid handshake not supported by this build")
+	}
+
+	pq := "post_quantum=true\n"
+	tun1 := tuntest.NewChannelTUN()
+	dev1 := NewDevice(tun1.TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev1: "),
+	})
+	dev1.Up()
+	defer dev1.Close()
+	if err := ipcSet(dev1, pq+cfg1+"\n"+pq); err != nil {
+		t.Fatal(err)
+	}
+	if get := ipcGet(t, dev1); strings.Count(get, pq) != 2 {
+		t.Errorf("get output missing post_quantum:\n%s", get)
+	}
+
+	tun2 := tuntest.NewChannelTUN()
+	dev2 := NewDevice(tun2.TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev2: "),
+	})
+	dev2.Up()
+	defer dev2.Close()
+	if err := ipcSet(dev2, pq+cfg2+"\n"+pq); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := tuntest.Ping(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"))
+	tun2.Outbound <- msg
+	select {
+	case msgRecv := <-tun1.Inbound:
+		if !bytes.Equal(msg, msgRecv) {
+			t.Error("ping did not transit correctly")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ping did not transit")
+	}
+
+	key, _ := wgcfg.ParseHexKey("f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725")
+	if keypair := dev1.LookupPeer(key).keypairs.Current(); keypair == nil || !keypair.hybrid {
+		t.Error("session not derived from a hybrid handshake")
+	}
+}
+
+func TestPostQuantumNegotiation(t *testing.T) {
+	if !kemSupported {
+		t.Skip("hybrid handshake not supported by this build")
+	}
+
+	dev1, tun1, dev2, tun2 := newBindTestPair(t, bindtest.NewNetwork(1))
+	defer dev1.Close()
+	defer dev2.Close()
+	if err := ipcSet(dev2, "post_quantum=true\nrekey_timeout=100\nrekey_jitter_max=50\n"); err != nil {
+		t.Fatal(err)
+	}
+	key, _ := wgcfg.ParseHexKey("49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427")
+	peer := dev2.LookupPeer(key)
+
+	// handshakes from dev2 until one completes, returning whether it was hybrid
+
+	handshake := func() bool {
+		t.Helper()
+		old := peer.keypairs.Current()
+		time.Sleep(150 * time.Millisecond)
+		peer.SendHandshakeInitiation(false)
+		for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+			if keypair := peer.keypairs.Current(); keypair != nil && keypair != old {
+				return keypair.hybrid
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("no handshake")
+			}
+		}
+	}
+
+	// classic with a peer not advertising hybrid handshakes
+
+	tun2.Outbound <- tuntest.Ping(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"))
+	select {
+	case <-tun1.Inbound:
+	case <-time.After(time.Second):
+		t.Fatal("ping did not transit")
+	}
+	if peer.keypairs.Current().hybrid || handshake() {
+		t.Error("hybrid handshake with a peer not taking them")
+	}
+
+	// hybrid once the peer advertised them
+
+	if err := ipcSet(dev1, "post_quantum=true\n"); err != nil {
+		t.Fatal(err)
+	}
+	if handshake() {
+		t.Error("hybrid handshake before the peer advertised them")
+	}
+	if !handshake() {
+		t.Error("classic handshake with a peer which advertised hybrid handshakes")
+	}
 }
 
 func TestSimultaneousHandshake(t *testing.T) {
@@ -142,6 +327,213 @@ func TestSimultaneousHandshake(t *testing.T) {
 	}
 }
 
+func TestShutdown(t *testing.T) {
+	tun1 := tuntest.NewChannelTUN()
+	dev1 := NewDevice(tun1.TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev1: "),
+	})
+	dev1.Up()
+	defer dev1.Close()
+	if err := ipcSet(dev1, cfg1); err != nil {
+		t.Fatal(err)
+	}
+
+	tun2 := tuntest.NewChannelTUN()
+	dev2 := NewDevice(tun2.TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev2: "),
+	})
+	dev2.Up()
+	defer dev2.Close()
+	if err := ipcSet(dev2, cfg2); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := tuntest.Ping(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"))
+	tun2.Outbound <- msg
+	select {
+	case <-tun1.Inbound:
+	case <-time.After(time.Second):
+		t.Fatal("ping did not transit")
+	}
+
+	// nothing queued, the device closes right away
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := dev2.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown() = %v", err)
+	}
+	if !dev2.isClosed.Get() {
+		t.Error("device not closed")
+	}
+	if !dev2.staticIdentity.privateKey.IsZero() {
+		t.Error("private key not zeroed")
+	}
+
+	// a packet waiting for a handshake that never completes keeps it busy
+
+	key, _ := wgcfg.ParseHexKey("f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725")
+	peer := dev1.LookupPeer(key)
+	peer.ZeroAndFlushAll()
+	for i := 0; !peer.queue.packetInNonceQueueIsAwaitingKey.Get(); i++ {
+		if i == 100 {
+			t.Fatal("packet not queued")
+		}
+		tun1.Outbound <- tuntest.Ping(net.ParseIP("1.0.0.2"), net.ParseIP("1.0.0.1"))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := dev1.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if !dev1.isClosed.Get() {
+		t.Error("device not closed")
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	tun1 := tuntest.NewChannelTUN()
+	dev1 := NewDevice(tun1.TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev1: "),
+	})
+	dev1.Up()
+	defer dev1.Close()
+	if err := ipcSet(dev1, cfg1); err != nil {
+		t.Fatal(err)
+	}
+
+	tun2 := tuntest.NewChannelTUN()
+	dev2 := NewDevice(tun2.TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev2: "),
+	})
+	dev2.Up()
+	defer dev2.Close()
+	if err := ipcSet(dev2, cfg2); err != nil {
+		t.Fatal(err)
+	}
+
+	ping := func() bool {
+		msg := tuntest.Ping(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"))
+		tun2.Outbound <- msg
+		select {
+		case <-tun1.Inbound:
+			return true
+		case <-time.After(300 * time.Millisecond):
+			return false
+		}
+	}
+	if !ping() {
+		t.Fatal("ping did not transit")
+	}
+
+	key, _ := wgcfg.ParseHexKey("f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725")
+	peer := dev1.LookupPeer(key)
+	keypair := peer.keypairs.Current()
+
+	dev1.Pause()
+	if dev1.net.bind != nil {
+		t.Error("bind still open while paused")
+	}
+	if peer.timers.zeroKeyMaterial.IsPending() {
+		t.Error("timers still armed while paused")
+	}
+	attempts := atomic.LoadUint64(&peer.stats.handshakeAttempts)
+	peer.SendHandshakeInitiation(true)
+	if atomic.LoadUint64(&peer.stats.handshakeAttempts) != attempts {
+		t.Error("handshake initiated while paused")
+	}
+	if ping() {
+		t.Error("ping transited while paused")
+	}
+
+	if err := dev1.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if peer.keypairs.Current() != keypair {
+		t.Error("session not kept across pause")
+	}
+	if !peer.timers.zeroKeyMaterial.IsPending() {
+		t.Error("timers not re-armed on resume")
+	}
+	if !ping() {
+		t.Error("ping did not transit after resume")
+	}
+}
+
+func TestCookieReplyCounters(t *testing.T) {
+	tun1 := tuntest.NewChannelTUN()
+	dev1 := NewDevice(tun1.TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev1: "),
+	})
+	dev1.Up()
+	defer dev1.Close()
+	if err := ipcSet(dev1, cfg1); err != nil {
+		t.Fatal(err)
+	}
+
+	// an initiation of the second device, never sent by it
+
+	dev2 := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev2: "),
+	})
+	defer dev2.Close()
+	if err := ipcSet(dev2, cfg2); err != nil {
+		t.Fatal(err)
+	}
+	key, _ := wgcfg.ParseHexKey("49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427")
+	peer := dev2.LookupPeer(key)
+	msg, err := dev2.CreateMessageInitiation(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, msg)
+	packet := buf.Bytes()
+	peer.cookieGenerator.AddMacs(packet)
+
+	sock, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	dst := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53511}
+
+	dev1.rate.underLoadUntil.Store(time.Now().Add(time.Hour))
+	const initiations = 10
+	for i := 0; i < initiations; i++ {
+		if _, err := sock.WriteToUDP(packet, dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	invalid := append([]byte(nil), packet...)
+	invalid[len(invalid)-2*blake2s.Size128] ^= 1
+	if _, err := sock.WriteToUDP(invalid, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	var m DeviceMetrics
+	for i := 0; ; i++ {
+		m = dev1.Metrics()
+		if m.HandshakesRejected == initiations && m.InvalidMACs == 1 && m.CookieRepliesSent+m.CookieRepliesLimited == initiations {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("unexpected counters: %+v", m)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m.CookieRepliesSent == 0 || m.CookieRepliesLimited == 0 {
+		t.Errorf("cookie replies sent %d, rate limited %d; want both", m.CookieRepliesSent, m.CookieRepliesLimited)
+	}
+	if get := ipcGet(t, dev1); !strings.Contains(get, fmt.Sprintf("cookie_replies_sent=%d\n", m.CookieRepliesSent)) ||
+		!strings.Contains(get, fmt.Sprintf("handshakes_rejected_under_load=%d\n", initiations)) ||
+		!strings.Contains(get, "invalid_mac_packets=1\n") {
+		t.Errorf("get output missing counters:\n%s", get)
+	}
+}
+
 func assertNil(t *testing.T, err error) {
 	if err != nil {
 		t.Fatal(err)
@@ -167,3 +559,66 @@ func randDevice(t *testing.T) *Device {
 	device.SetPrivateKey(sk)
 	return device
 }
+
+func TestInnerDSCP(t *testing.T) {
+	ping4 := tuntest.Ping(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"))
+	ping4[IPv4offsetTOS] = 0xb8 | 0x1 // EF, ECT(1)
+	if got := innerDSCP(ping4); got != 0xb8 {
+		t.Errorf("IPv4: got %#x, want 0xb8", got)
+	}
+
+	ping6 := make([]byte, 40)
+	ping6[0] = 0x60 | 0x0b // version 6, traffic class 0xb9
+	ping6[1] = 0x90
+	if got := innerDSCP(ping6); got != 0xb8 {
+		t.Errorf("IPv6: got %#x, want 0xb8", got)
+	}
+
+	if got := innerDSCP([]byte{0x45}); got != 0 {
+		t.Errorf("truncated: got %#x, want 0", got)
+	}
+}
+
+func TestPostQuantumFallback(t *testing.T) {
+	if !kemSupported {
+		t.Skip("hybrid handshake not supported by this build")
+	}
+
+	dev1, peer, _, dev2 := newProcessPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+	dev1.postQuantum.Set(true)
+
+	// a hybrid initiation going unanswered, returning whether we fell back
+
+	unanswered := func() bool {
+		peer.handshake.mutex.Lock()
+		peer.handshake.postQuantumAdvertised = true
+		peer.handshake.mutex.Unlock()
+		expiredRetransmitHandshake(peer)
+		peer.handshake.mutex.Lock()
+		defer peer.handshake.mutex.Unlock()
+		return peer.handshake.postQuantumRefused
+	}
+
+	for i := 1; i < HybridFallbackAttempts; i++ {
+		if unanswered() {
+			t.Fatalf("fell back after %d unanswered hybrid initiations", i)
+		}
+	}
+	if !unanswered() {
+		t.Fatalf("no fallback after %d unanswered hybrid initiations", HybridFallbackAttempts)
+	}
+
+	// never with a peer which completed a hybrid handshake
+
+	peer.handshake.mutex.Lock()
+	peer.handshake.postQuantumRefused = false
+	peer.handshake.postQuantumCompleted = true
+	peer.handshake.mutex.Unlock()
+	for i := 0; i < 2*HybridFallbackAttempts; i++ {
+		if unanswered() {
+			t.Fatal("fell back with a peer which completed a hybrid handshake")
+		}
+	}
+}
@@ -0,0 +1,88 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+)
+
+/* Packets dropped on the way through the device are counted by reason,
+ * always: the counters are atomics, cheap next to the work done on the
+ * packet. Logging them is opt-in with log_drops, and sampled, one in N
+ * dropped packets, so that a flood does not become a flood of log lines.
+ * Lines are logged at the verbose level, like the other per-packet logs.
+ *
+ * Handshake messages, which have counters of their own, are not counted
+ * here, unless they are malformed.
+ */
+
+// DropReason is why the device dropped a packet.
+type DropReason int
+
+const (
+	DropNoPeer      DropReason = iota // no peer for the destination of a packet to send
+	DropNoKeypair                     // no session to send with, or for the receiver index of a transport message
+	DropDecrypt                       // transport message failed to authenticate
+	DropReplay                        // transport message counter already seen or too old
+	DropRateLimited                   // over the rate limit of the peer
+	DropMTU                           // larger than the MTU of the peer and not to be fragmented
+	DropMalformed                     // too short for its message type, of no known type, or not an IP packet
+	DropQueueFull                     // the nonce queue of the peer was full, see queuepolicy.go
+	DropQuarantined                   // from a source quarantined for failing authentication, see quarantine.go
+	DropTruncated                     // datagram filling the receive buffer, sized for the MTU, so possibly cut short
+	DropNotAllowed                    // source not among the allowed IPs of the peer received from
+	DropFiltered                      // dropped by the inbound or outbound packet filter, see filter.go
+	DropECN                           // marked CE outside, but not ECN-capable inside, see ecn.go
+
+	DropReasons = iota // number of drop reasons
+)
+
+var dropReasonNames = [DropReasons]string{
+	DropNoPeer:      "no_peer",
+	DropNoKeypair:   "no_keypair",
+	DropDecrypt:     "decrypt_failed",
+	DropReplay:      "replay",
+	DropRateLimited: "rate_limited",
+	DropMTU:         "mtu_exceeded",
+	DropMalformed:   "malformed",
+	DropQueueFull:   "queue_full",
+	DropQuarantined: "quarantined",
+	DropTruncated:   "truncated",
+	DropNotAllowed:  "source_not_allowed",
+	DropFiltered:    "filtered",
+	DropECN:         "ce_not_ect",
+}
+
+func (reason DropReason) String() string {
+	if reason < 0 || reason >= DropReasons {
+		return "unknown"
+	}
+	return dropReasonNames[reason]
+}
+
+/* Counts a packet dropped for the reason, logging it if it is sampled.
+ * The peer is nil if not known.
+ */
+func (device *Device) drop(reason DropReason, peer *Peer) {
+	atomic.AddUint64(&device.stats.dropped[reason], 1)
+
+	sample := uint64(atomic.LoadUint32(&device.dropLogSample))
+	if sample == 0 || atomic.AddUint64(&device.stats.dropsSeen, 1)%sample != 0 {
+		return
+	}
+	if peer != nil {
+		device.log.Verbosef("%v - Dropped packet: %v", peer, reason)
+	} else {
+		device.log.Verbosef("Dropped packet: %v", reason)
+	}
+}
+
+func (device *Device) dropCounts() (counts [DropReasons]uint64) {
+	for i := range counts {
+		counts[i] = atomic.LoadUint64(&device.stats.dropped[i])
+	}
+	return counts
+}
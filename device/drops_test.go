@@ -0,0 +1,211 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+type countingLogger struct {
+	sync.Mutex
+	lines []string
+}
+
+func (l *countingLogger) Verbosef(format string, args ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.lines = append(l.lines, format)
+}
+
+func (l *countingLogger) Errorf(format string, args ...interface{}) {}
+
+func TestDropLogging(t *testing.T) {
+	logger := &countingLogger{}
+	device := &Device{log: logger}
+
+	for i := 0; i < 10; i++ {
+		device.drop(DropReplay, nil)
+	}
+	if len(logger.lines) != 0 {
+		t.Errorf("logged %d drops while logging was off", len(logger.lines))
+	}
+
+	device.dropLogSample = 4
+	for i := 0; i < 10; i++ {
+		device.drop(DropMTU, nil)
+	}
+	if len(logger.lines) != 2 {
+		t.Errorf("logged %d of 10 drops sampling 1 in 4, want 2", len(logger.lines))
+	}
+
+	counts := device.dropCounts()
+	if counts[DropReplay] != 10 || counts[DropMTU] != 10 || counts[DropNoPeer] != 0 {
+		t.Errorf("wrong drop counts: %v", counts)
+	}
+	if DropMTU.String() != "mtu_exceeded" || DropReason(DropReasons).String() != "unknown" {
+		t.Error("wrong drop reason names")
+	}
+}
+
+func TestDropCounters(t *testing.T) {
+	dst, src := net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")
+	dev1, tun1, dev2, tun2 := newBindTestPair(t, bindtest.NewNetwork(1))
+	defer dev1.Close()
+	defer dev2.Close()
+
+	// a packet to an address of no peer
+
+	tun2.Outbound <- tuntest.Ping(net.ParseIP("192.0.2.1"), src)
+	for deadline := time.Now().Add(2 * time.Second); dev2.Metrics().Drops[DropNoPeer] != 1; {
+		if time.Now().After(deadline) {
+			t.Fatalf("drop not counted: %v", dev2.Metrics().Drops)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a packet from an address not allowed for the peer
+
+	tun2.Outbound <- tuntest.Ping(dst, src)
+	select {
+	case <-tun1.Inbound:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ping did not transit")
+	}
+	if err := ipcSet(dev1, "public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725\nreplace_allowed_ips=true\nallowed_ip=1.0.0.3/32\n"); err != nil {
+		t.Fatal(err)
+	}
+	tun2.Outbound <- tuntest.Ping(dst, src)
+	for deadline := time.Now().Add(2 * time.Second); !strings.Contains(ipcGet(t, dev1), "dropped_source_not_allowed=1\n"); {
+		if time.Now().After(deadline) {
+			t.Fatalf("drop not counted:\n%s", ipcGet(t, dev1))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := ipcSet(dev1, "reset_stats=true\n"); err != nil {
+		t.Fatal(err)
+	}
+	if drops := dev1.Metrics().Drops; drops != [DropReasons]uint64{} {
+		t.Errorf("drops not reset: %v", drops)
+	}
+}
+
+func TestDropFiltered(t *testing.T) {
+	dst, src := net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")
+	dev1, peer, tun1, dev2 := newProcessPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+	drop := func(wgcfg.Key, []byte) FilterVerdict { return FilterDrop }
+
+	msg := dev2.processOutbound(tuntest.Ping(dst, src))
+	if msg == nil {
+		t.Fatal("packet not sent")
+	}
+	dev1.SetInboundFilter(drop)
+	dev1.processInbound(peer, msg)
+	select {
+	case <-tun1.Inbound:
+		t.Error("filtered packet written to TUN")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if drops := dev1.Metrics().Drops; drops[DropFiltered] != 1 {
+		t.Errorf("inbound filter drop not counted: %v", drops)
+	}
+
+	dev2.SetOutboundFilter(drop)
+	if dev2.processOutbound(tuntest.Ping(dst, src)) != nil {
+		t.Error("filtered packet sent")
+	}
+	if drops := dev2.Metrics().Drops; drops[DropFiltered] != 1 {
+		t.Errorf("outbound filter drop not counted: %v", drops)
+	}
+}
+
+func TestDropECN(t *testing.T) {
+	dst, src := net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")
+	dev1, peer, _, dev2 := newProcessPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+	dev1.ecn.Set(true)
+
+	// congestion marked outside a packet which cannot carry the mark
+
+	msg := dev2.processOutbound(tuntest.Ping(dst, src))
+	if msg == nil {
+		t.Fatal("packet not sent")
+	}
+	dev1.processInboundDS(peer, msg, ecnCE)
+	if drops := dev1.Metrics().Drops; drops[DropECN] != 1 {
+		t.Errorf("drop of a CE marked Not-ECT packet not counted: %v", drops)
+	}
+}
+
+func TestDropTUNRead(t *testing.T) {
+	dev1, _, _, dev2 := newProcessPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	// empty reads, and reads filling the buffer, as from a TUN device with
+	// a larger MTU than buffers are sized for
+
+	elem := dev2.NewOutboundElement()
+	if dev2.routeOutbound(elem, 0) != nil || dev2.routeOutbound(elem, len(elem.buffer)) != nil {
+		t.Error("read of no or too many bytes routed")
+	}
+	dev2.PutMessageBuffer(elem.buffer)
+	dev2.PutOutboundElement(elem)
+	if drops := dev2.Metrics().Drops; drops[DropMalformed] != 1 || drops[DropMTU] != 1 {
+		t.Errorf("wrong drop counts: %v", drops)
+	}
+}
+
+func TestDropMalformed(t *testing.T) {
+	dst, src := net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")
+	dev1, peer, tun1, dev2 := newProcessPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	// datagrams too short for their message type, or of no known type
+
+	for _, msg := range [][]byte{
+		{byte(MessageTransportType), 0, 0, 0},
+		make([]byte, MessageInitiationSize-1),
+		append([]byte{byte(MessageInitiationType), 0, 0, 0}, make([]byte, MessageInitiationSize-5)...),
+		append([]byte{byte(MessageCookieReplyType), 0, 0, 0}, make([]byte, MessageCookieReplySize-5)...),
+	} {
+		buffer := dev1.GetMessageBuffer()
+		if dev1.handleIncoming(buffer, copy(buffer, msg), nil, addr, 0) {
+			t.Errorf("malformed datagram %x queued", msg)
+		}
+	}
+	if drops := dev1.Metrics().Drops[DropMalformed]; drops != 4 {
+		t.Errorf("%d malformed datagrams dropped, want 4", drops)
+	}
+
+	// transport messages carrying packets shorter than their IP header has it
+
+	ping := tuntest.Ping(dst, src)
+	ping[IPv4offsetTotalLength], ping[IPv4offsetTotalLength+1] = 0xff, 0xff
+	go func() {
+		for range tun1.Inbound {
+		}
+	}()
+	if !dev1.processInbound(peer, dev2.processOutbound(ping)) {
+		t.Fatal("transport message dropped")
+	}
+	if drops := dev1.Metrics().Drops[DropMalformed]; drops != 5 {
+		t.Errorf("%d malformed datagrams dropped, want 5", drops)
+	}
+}
@@ -0,0 +1,93 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* ECN codepoints, the two low bits of the DS field (RFC 3168)
+ */
+const (
+	ecnNotECT = 0x0
+	ecnECT1   = 0x1
+	ecnECT0   = 0x2
+	ecnCE     = 0x3
+	ecnMask   = 0x3
+)
+
+/* Returns the ECN codepoint of the inner packet, copied to the outer
+ * header on encapsulation (RFC 6040 normal mode).
+ */
+func innerECN(packet []byte) byte {
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		if len(packet) < ipv4.HeaderLen {
+			return ecnNotECT
+		}
+		return packet[IPv4offsetTOS] & ecnMask
+	case ipv6.Version:
+		if len(packet) < ipv6.HeaderLen {
+			return ecnNotECT
+		}
+		return packet[1] >> 4 & ecnMask
+	default:
+		return ecnNotECT
+	}
+}
+
+/* Combines the ECN codepoint of the outer header into the inner packet
+ * on decapsulation, following RFC 6040 section 4.2:
+ *
+ *   inner \ outer  Not-ECT  ECT(0)  ECT(1)  CE
+ *   Not-ECT        Not-ECT  Not-ECT Not-ECT drop
+ *   ECT(0)         ECT(0)   ECT(0)  ECT(1)  CE
+ *   ECT(1)         ECT(1)   ECT(1)  ECT(1)  CE
+ *   CE             CE       CE      CE      CE
+ *
+ * The packet must have been validated as IPv4 or IPv6.
+ * Returns false if the packet must be dropped.
+ */
+func ecnDecapsulate(outer byte, packet []byte) bool {
+	outer &= ecnMask
+	inner := innerECN(packet)
+
+	var ecn byte
+	switch {
+	case outer == ecnCE && inner == ecnNotECT:
+		return false
+	case outer == ecnCE:
+		ecn = ecnCE
+	case outer == ecnECT1 && inner == ecnECT0:
+		ecn = ecnECT1
+	default:
+		return true
+	}
+	if ecn == inner {
+		return true
+	}
+
+	if packet[0]>>4 == ipv6.Version {
+		packet[1] = packet[1]&^(ecnMask<<4) | ecn<<4
+		return true
+	}
+
+	// update the IPv4 header checksum incrementally (RFC 1624)
+
+	old := binary.BigEndian.Uint16(packet[0:2])
+	packet[IPv4offsetTOS] = packet[IPv4offsetTOS]&^ecnMask | ecn
+	new := binary.BigEndian.Uint16(packet[0:2])
+
+	field := packet[IPv4offsetChecksum : IPv4offsetChecksum+2]
+	sum := uint32(^binary.BigEndian.Uint16(field)) + uint32(^old) + uint32(new)
+	sum = sum&0xffff + sum>>16
+	sum = sum&0xffff + sum>>16
+	binary.BigEndian.PutUint16(field, ^uint16(sum))
+	return true
+}
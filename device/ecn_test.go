@@ -0,0 +1,93 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+func ipv4Checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+func TestECNDecapsulate(t *testing.T) {
+	const drop = 0xff
+	want := [4][4]byte{ // [inner][outer]
+		ecnNotECT: {ecnNotECT, ecnNotECT, ecnNotECT, drop},
+		ecnECT1:   {ecnECT1, ecnECT1, ecnECT1, ecnCE},
+		ecnECT0:   {ecnECT0, ecnECT1, ecnECT0, ecnCE},
+		ecnCE:     {ecnCE, ecnCE, ecnCE, ecnCE},
+	}
+
+	for inner := byte(0); inner < 4; inner++ {
+		for outer := byte(0); outer < 4; outer++ {
+			ping4 := tuntest.Ping(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"))
+			ping4[IPv4offsetTOS] = 0xb8 | inner
+			binary.BigEndian.PutUint16(ping4[IPv4offsetChecksum:], 0)
+			binary.BigEndian.PutUint16(ping4[IPv4offsetChecksum:], ipv4Checksum(ping4[:20]))
+
+			ping6 := make([]byte, 40)
+			ping6[0] = 0x60 | 0x0b // version 6, DSCP EF
+			ping6[1] = 0x80 | inner<<4
+
+			w := want[inner][outer]
+			for _, packet := range [][]byte{ping4, ping6} {
+				ok := ecnDecapsulate(0xb8|outer, packet)
+				if w == drop {
+					if ok {
+						t.Errorf("inner %d, outer %d: packet not dropped", inner, outer)
+					}
+					continue
+				}
+				if !ok {
+					t.Errorf("inner %d, outer %d: packet dropped", inner, outer)
+					continue
+				}
+				if got := innerECN(packet); got != w {
+					t.Errorf("inner %d, outer %d: got %d, want %d", inner, outer, got, w)
+				}
+				if got := innerDSCP(packet); got != 0xb8 {
+					t.Errorf("inner %d, outer %d: DSCP changed to %#x", inner, outer, got)
+				}
+			}
+			if ipv4Checksum(ping4[:20]) != 0 {
+				t.Errorf("inner %d, outer %d: invalid IPv4 checksum", inner, outer)
+			}
+		}
+	}
+}
+
+func TestUAPIECN(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev: "),
+	})
+	defer device.Close()
+
+	if strings.Contains(ipcGet(t, device), "ecn") {
+		t.Error("ecn reported while disabled")
+	}
+	if err := ipcSet(device, "ecn=true\n"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(ipcGet(t, device), "ecn=true\n") {
+		t.Error("ecn not reported while enabled")
+	}
+	if err := ipcSet(device, "ecn=1\n"); err == nil {
+		t.Error("invalid ecn value accepted")
+	}
+}
@@ -0,0 +1,187 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+/* Application callbacks are run on a dedicated goroutine, in the order
+ * the events occurred, so that a slow handler never blocks packet processing.
+ * If the handlers fall too far behind, the oldest pending events are dropped.
+ */
+
+// EndpointChangeHandler is called when a peer roams to a new remote address.
+// Endpoints are updated in place, so the old and new addresses are given
+// in their DstToString form.
+type EndpointChangeHandler func(peerKey wgcfg.Key, old, new string)
+
+// SetEndpointChangeHandler registers a handler invoked whenever a peer's
+// endpoint is updated to a different remote address. A nil handler
+// disables the notification. It is safe to call concurrently.
+func (device *Device) SetEndpointChangeHandler(handler EndpointChangeHandler) {
+	device.events.Lock()
+	device.events.endpointChange = handler
+	device.events.Unlock()
+}
+
+func (device *Device) endpointChangeHandler() EndpointChangeHandler {
+	device.events.RLock()
+	defer device.events.RUnlock()
+	return device.events.endpointChange
+}
+
+// PathMTUChangeHandler is called when path MTU discovery changes the
+// inner MTU of packets sent to a peer.
+type PathMTUChangeHandler func(peerKey wgcfg.Key, mtu int)
+
+// SetPathMTUChangeHandler registers a handler invoked whenever path MTU
+// discovery changes a peer's MTU. A nil handler disables the notification.
+// It is safe to call concurrently.
+func (device *Device) SetPathMTUChangeHandler(handler PathMTUChangeHandler) {
+	device.events.Lock()
+	device.events.pathMTUChange = handler
+	device.events.Unlock()
+}
+
+func (peer *Peer) pathMTUEvent() {
+	device := peer.device
+	device.events.RLock()
+	handler := device.events.pathMTUChange
+	device.events.RUnlock()
+
+	key := peer.handshake.remoteStatic
+	mtu := peer.mtu()
+	device.publishEvent(UAPIEventJSON{
+		Event:     UAPIEventPathMTU,
+		PublicKey: key.HexString(),
+		MTU:       mtu,
+	})
+
+	if handler == nil {
+		return
+	}
+	device.queueEvent(func() {
+		handler(key, mtu)
+	})
+}
+
+type HandshakeEventReason int
+
+const (
+	HandshakeCompleted            HandshakeEventReason = iota // handshake completed
+	HandshakeRetrying                                         // no response, sending another initiation
+	HandshakeTimeout                                          // stopped hearing back from the peer, starting a new handshake
+	HandshakeGaveUp                                           // no response after MaxTimerHandshakes attempts
+	HandshakePeerRemoved                                      // nothing received within the idle timeout, peer removed
+	HandshakeUnreachable                                      // nothing received within the unreachable timeout after sending data
+	HandshakeTransportUnreachable                             // sends failing, the OS having no route to the peer
+	HandshakeClockJump                                        // the wall clock jumped back, the peer may refuse our initiations as replays
+	HandshakePostQuantumFallback                              // hybrid initiations went unanswered, falling back to classic ones
+)
+
+func (reason HandshakeEventReason) String() string {
+	switch reason {
+	case HandshakeCompleted:
+		return "completed"
+	case HandshakeRetrying:
+		return "retrying"
+	case HandshakeTimeout:
+		return "timeout"
+	case HandshakeGaveUp:
+		return "gave up"
+	case HandshakePeerRemoved:
+		return "peer removed"
+	case HandshakeUnreachable:
+		return "unreachable"
+	case HandshakeTransportUnreachable:
+		return "transport unreachable"
+	case HandshakeClockJump:
+		return "clock jump"
+	case HandshakePostQuantumFallback:
+		return "post-quantum fallback"
+	default:
+		return "unknown"
+	}
+}
+
+type HandshakeEvent struct {
+	PeerKey wgcfg.Key
+	Reason  HandshakeEventReason
+	Attempt uint32 // number of initiations sent for this handshake
+}
+
+// SetHandshakeEventHandler registers a handler invoked on handshake
+// progress and failures. A nil handler disables the notification.
+// It is safe to call concurrently.
+func (device *Device) SetHandshakeEventHandler(handler func(HandshakeEvent)) {
+	device.events.Lock()
+	device.events.handshake = handler
+	device.events.Unlock()
+}
+
+func (peer *Peer) handshakeEvent(reason HandshakeEventReason, attempt uint32) {
+	device := peer.device
+	device.events.RLock()
+	handler := device.events.handshake
+	device.events.RUnlock()
+
+	event := HandshakeEvent{
+		PeerKey: peer.handshake.remoteStatic,
+		Reason:  reason,
+		Attempt: attempt,
+	}
+	device.publishEvent(UAPIEventJSON{
+		Event:     UAPIEventHandshake,
+		PublicKey: event.PeerKey.HexString(),
+		Reason:    reason.String(),
+		Attempt:   attempt,
+	})
+
+	if handler == nil {
+		return
+	}
+	device.queueEvent(func() {
+		handler(event)
+	})
+}
+
+/* Queues fn to be run on the event goroutine, never blocking.
+ * If the queue is full, the oldest event is dropped.
+ */
+func (device *Device) queueEvent(fn func()) {
+	for {
+		select {
+		case device.events.queue <- fn:
+			return
+		default:
+		}
+		select {
+		case <-device.events.queue:
+			device.log.Verbosef("Event queue full, dropping oldest event")
+		default:
+		}
+	}
+}
+
+func (device *Device) RoutineEvents() {
+	defer func() {
+		device.log.Verbosef("Routine: event dispatcher - stopped")
+		device.state.stopping.Done()
+	}()
+
+	device.log.Verbosef("Routine: event dispatcher - started")
+	device.state.starting.Done()
+
+	for {
+		select {
+		case <-device.signals.stop:
+			return
+		case fn := <-device.events.queue:
+			fn()
+		}
+	}
+}
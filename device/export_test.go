@@ -0,0 +1,104 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+/* Synchronous counterparts of the receive and send paths, for fuzzing and
+ * benchmarking them without the queues and workers in between. They run
+ * the same steps as the workers do, on the calling goroutine, and so
+ * must not be used on a peer whose packets are in flight concurrently.
+ */
+
+var processPadding = newPaddingSource()
+
+// processInbound runs a datagram as received from the endpoint of peer
+// through the receive path: a transport message is decrypted, checked
+// and its packet written to the TUN device. Returns false if the datagram
+// was dropped before being decrypted.
+func (device *Device) processInbound(peer *Peer, buf []byte) bool {
+	return device.processInboundDS(peer, buf, 0)
+}
+
+// processInboundDS is processInbound for a datagram received with the DS
+// field ds in its outer header.
+func (device *Device) processInboundDS(peer *Peer, buf []byte, ds byte) bool {
+	buffer := device.GetMessageBuffer()
+	packet := buffer[:copy(buffer, buf)]
+	if len(packet) < MinMessageSize || binary.LittleEndian.Uint32(packet[:4]) != MessageTransportType {
+		device.PutMessageBuffer(buffer)
+		return false
+	}
+
+	peer.RLock()
+	endpoint := peer.endpoint
+	peer.RUnlock()
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	if endpoint != nil {
+		if endpointAddr, err := net.ResolveUDPAddr("udp", endpoint.DstToString()); err == nil {
+			addr = endpointAddr
+		}
+	}
+
+	elem, from := device.newInboundElement(buffer, packet, endpoint, addr, ds)
+	if elem == nil || from != peer {
+		if elem != nil {
+			device.PutInboundElement(elem)
+		}
+		device.PutMessageBuffer(buffer)
+		return false
+	}
+
+	var nonce [chacha20poly1305.NonceSize]byte
+	device.decrypt(elem, &nonce)
+	if !elem.IsDropped() {
+		peer.receive(elem)
+		device.PutMessageBuffer(elem.buffer)
+	}
+	device.PutInboundElement(elem)
+	return true
+}
+
+// processOutbound runs a packet as read from the TUN device through the
+// send path, returning the transport message it is sent to its peer as,
+// or nil if it was dropped or its peer has no session to send it with.
+func (device *Device) processOutbound(packet []byte) []byte {
+	elem := device.NewOutboundElement()
+	defer func() {
+		device.PutMessageBuffer(elem.buffer)
+		device.PutOutboundElement(elem)
+	}()
+
+	size := copy(elem.buffer[device.pool.packetOffset:len(elem.buffer)-messageBufferOverhead+MessageTransportHeaderSize], packet)
+	if size < len(packet) {
+		return nil
+	}
+	peer := device.routeOutbound(elem, size)
+	if peer == nil {
+		return nil
+	}
+	keypair := peer.sendingKeypair()
+	if keypair == nil {
+		return nil
+	}
+	elem.peer = peer
+	elem.keypair = keypair
+	elem.nonce = atomic.AddUint64(&keypair.sendNonce, 1) - 1
+	if elem.nonce >= RejectAfterMessages {
+		atomic.StoreUint64(&keypair.sendNonce, RejectAfterMessages)
+		return nil
+	}
+
+	var nonce [chacha20poly1305.NonceSize]byte
+	device.encrypt(elem, &nonce, processPadding)
+	return append([]byte(nil), elem.packet...)
+}
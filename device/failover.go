@@ -0,0 +1,96 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"github.com/tailscale/wireguard-go/conn"
+)
+
+/* A peer may be given several candidate endpoints, by repeating endpoint=
+ * in its configuration, such as the addresses of a server reachable over
+ * more than one ISP. Handshakes are sent to the first candidate, and after
+ * EndpointFailover attempts without a response, to the next one, wrapping
+ * around until the handshake completes or is given up on. A completed
+ * handshake leaves the peer on the candidate it completed over.
+ *
+ * Candidates are kept as configured, so a candidate given by hostname is
+ * resolved again when failed over to.
+ */
+
+/* Moves the endpoint of the peer on to the next candidate, if it has
+ * several, skipping candidates which fail to resolve. Candidates are
+ * resolved without holding the peer lock, which the data path takes, so
+ * the result is dropped if the peer was reconfigured or failed over
+ * meanwhile.
+ */
+func (peer *Peer) failoverEndpoint() {
+	device := peer.device
+	handler := device.endpointChangeHandler()
+
+	peer.RLock()
+	candidates := peer.endpointCandidates
+	current := peer.endpointCandidate
+	peer.RUnlock()
+	if len(candidates) < 2 {
+		return
+	}
+
+	var (
+		endpoint, race conn.Endpoint
+		host           string
+		next           = current
+	)
+	for range candidates {
+		next = (next + 1) % len(candidates)
+		var err error
+		endpoint, race, host, err = device.createEndpointResolving(peer.handshake.remoteStatic, candidates[next], device.listenFamily())
+		if err == nil {
+			break
+		}
+		device.log.Verbosef("%v - Failed to fail over to endpoint %s: %v", peer, candidates[next], err)
+	}
+	if endpoint == nil {
+		return
+	}
+
+	peer.Lock()
+	if peer.endpointCandidate != current || !stringsEqual(peer.endpointCandidates, candidates) {
+		peer.Unlock()
+		return
+	}
+	var old string
+	if peer.endpoint != nil {
+		old = peer.endpoint.DstToString()
+	}
+	peer.endpointCandidate = next
+	peer.endpoint = endpoint
+	peer.endpointRace = race
+	peer.endpointHost = host
+	peer.endpointResolved = endpoint.DstToString()
+	new := peer.endpointResolved
+	peer.Unlock()
+
+	if new != old {
+		device.log.Verbosef("%v - Handshake did not complete, failing over from endpoint %s to %s", peer, old, new)
+		peer.timers.natObserved.Set(false)
+		peer.endpointChanged(handler, old, new)
+	}
+	if host != "" {
+		peer.timersResolveEndpoint()
+	}
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,58 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+func TestEndpointFailover(t *testing.T) {
+	dev1, tun1, dev2, tun2 := newBindTestPair(t, bindtest.NewNetwork(1))
+	defer dev1.Close()
+	defer dev2.Close()
+
+	// a single endpoint has no candidates
+
+	if get := ipcGet(t, dev2); strings.Contains(get, "endpoint_candidate=") {
+		t.Errorf("candidates of a single endpoint:\n%s", get)
+	}
+
+	// nothing listens on the first candidate
+
+	pk := "public_key=49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427\n"
+	err := ipcSet(dev2, "rekey_timeout=100\nrekey_jitter_max=50\nhandshake_backoff_max=100\n"+pk+"endpoint=127.0.0.1:53599\nendpoint=127.0.0.1:53511\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := ipcGet(t, dev2)
+	for _, line := range []string{"\nendpoint=127.0.0.1:53599\n", "endpoint_candidate=127.0.0.1:53599\nendpoint_candidate=127.0.0.1:53511\n"} {
+		if !strings.Contains(get, line) {
+			t.Errorf("%q missing from get:\n%s", line, get)
+		}
+	}
+
+	tun2.Outbound <- tuntest.Ping(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"))
+	select {
+	case <-tun1.Inbound:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ping did not transit after failing over")
+	}
+	if attempts := dev2.Metrics().HandshakeAttempts; attempts != EndpointFailover+1 {
+		t.Errorf("%d handshake attempts, want %d", attempts, EndpointFailover+1)
+	}
+
+	// the endpoint the handshake completed over is kept
+
+	if get := ipcGet(t, dev2); !strings.Contains(get, "\nendpoint=127.0.0.1:53511\n") {
+		t.Errorf("endpoint not failed over:\n%s", get)
+	}
+}
@@ -0,0 +1,120 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"net"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* One address family may be disabled with disable_ipv4=true or
+ * disable_ipv6=true, for hosts where it is broken or unwanted: the native
+ * bind then only opens a socket of the other family, and only its
+ * receiving routine runs. Endpoints of the disabled family are refused,
+ * however they are set, as is a listen_address of it; an endpoint given
+ * by hostname keeps to the addresses of the enabled family, when resolved
+ * again too. Endpoints of peers of the family being disabled are replaced
+ * by those they were raced against, if of the other family, or cleared.
+ * The TCP and SOCKS5 binds are left as they are, but for their endpoints.
+ */
+
+var errFamilyDisabled = errors.New("address family disabled")
+
+/* Returns the address family of ip, by IP version.
+ */
+func addressFamily(ip net.IP) int {
+	if ip.To4() != nil {
+		return ipv4.Version
+	}
+	return ipv6.Version
+}
+
+/* Returns the only address family listened on, 0 for both.
+ */
+func (device *Device) listenFamily() int {
+	device.net.RLock()
+	defer device.net.RUnlock()
+	return device.net.family
+}
+
+/* Keeps the addresses of family, 0 for any.
+ */
+func addrsOfFamily(family int, addrs []*net.UDPAddr) []*net.UDPAddr {
+	if family == 0 {
+		return addrs
+	}
+	var kept []*net.UDPAddr
+	for _, addr := range addrs {
+		if addressFamily(addr.IP) == family {
+			kept = append(kept, addr)
+		}
+	}
+	return kept
+}
+
+/* Keeps the configured endpoints of family, 0 for any, and those given by
+ * hostname, which are resolved by the endpoint.
+ */
+func configEndpointsOfFamily(family int, endpoints []wgcfg.Endpoint) []wgcfg.Endpoint {
+	if family == 0 {
+		return endpoints
+	}
+	var kept []wgcfg.Endpoint
+	for _, endpoint := range endpoints {
+		if ip := net.ParseIP(endpoint.Host); ip == nil || addressFamily(ip) == family {
+			kept = append(kept, endpoint)
+		}
+	}
+	return kept
+}
+
+/* Returns whether the endpoint is of family, 0 for any. Endpoints without
+ * a single address are taken to be of any.
+ */
+func endpointOfFamily(family int, endpoint conn.Endpoint) bool {
+	ip := endpoint.DstIP()
+	return family == 0 || ip == nil || addressFamily(ip) == family
+}
+
+/* Replaces the endpoints of peers of other families than family, the only
+ * one now listened on, by those they were raced against if of family, or
+ * else clears them.
+ */
+func (device *Device) clearEndpointsOfOtherFamilies(family int) {
+	if family == 0 {
+		return
+	}
+	handler := device.endpointChangeHandler()
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	for _, peer := range device.peers.keyMap {
+		peer.Lock()
+		if peer.endpointRace != nil && !endpointOfFamily(family, peer.endpointRace) {
+			peer.endpointRace = nil
+		}
+		if peer.endpoint == nil || endpointOfFamily(family, peer.endpoint) {
+			peer.Unlock()
+			continue
+		}
+		old, new := peer.endpoint.DstToString(), ""
+		peer.endpoint, peer.endpointRace = peer.endpointRace, nil
+		if peer.endpoint != nil {
+			new = peer.endpoint.DstToString()
+			peer.endpointResolved = new
+		}
+		peer.Unlock()
+
+		device.log.Verbosef("%v - Endpoint %s of a disabled address family replaced by %q", peer, old, new)
+		peer.endpointChanged(handler, old, new)
+	}
+}
@@ -0,0 +1,109 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+func TestCreateEndpointOfFamily(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev: "),
+		LookupHost: func(host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}, nil
+		},
+	})
+	defer device.Close()
+
+	for _, test := range []struct {
+		family       int
+		s            string
+		wantEndpoint string
+		wantRace     string
+		wantErr      bool
+	}{
+		{0, "example.com:51820", "[2001:db8::1]:51820", "192.0.2.1:51820", false},
+		{4, "example.com:51820", "192.0.2.1:51820", "", false},
+		{6, "example.com:51820", "[2001:db8::1]:51820", "", false},
+		{4, "192.0.2.2:51820", "192.0.2.2:51820", "", false},
+		{6, "192.0.2.2:51820", "", "", true},
+		{4, "[2001:db8::2]:51820", "", "", true},
+	} {
+		endpoint, race, _, err := device.createEndpointResolving(wgcfg.Key{}, test.s, test.family)
+		var gotEndpoint, gotRace string
+		if endpoint != nil {
+			gotEndpoint = endpoint.DstToString()
+		}
+		if race != nil {
+			gotRace = race.DstToString()
+		}
+		if gotEndpoint != test.wantEndpoint || gotRace != test.wantRace || (err != nil) != test.wantErr {
+			t.Errorf("IPv%d of %s: %q racing %q, %v", test.family, test.s, gotEndpoint, gotRace, err)
+		}
+	}
+
+	endpoints := []wgcfg.Endpoint{{Host: "192.0.2.1", Port: 1}, {Host: "2001:db8::1", Port: 1}, {Host: "example.com", Port: 1}}
+	if kept := configEndpointsOfFamily(6, endpoints); len(kept) != 2 || kept[0] != endpoints[1] || kept[1] != endpoints[2] {
+		t.Errorf("IPv6 endpoints of %v: %v", endpoints, kept)
+	}
+}
+
+func TestUAPIDisableFamily(t *testing.T) {
+	dev1, tun1, dev2, tun2 := newBindTestPair(t, bindtest.NewNetwork(1))
+	defer dev1.Close()
+	defer dev2.Close()
+
+	const pk = "public_key=49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427\n"
+
+	// endpoints of a family being disabled are cleared
+
+	if err := ipcSet(dev2, pk+"endpoint=[::1]:53511\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipcSet(dev2, "disable_ipv6=true\n"); err != nil {
+		t.Fatal(err)
+	}
+	if get := ipcGet(t, dev2); strings.Contains(get, "endpoint=") {
+		t.Errorf("endpoint of a disabled family kept:\n%s", get)
+	}
+	if err := ipcSet(dev2, pk+"endpoint=127.0.0.1:53511\n"); err != nil {
+		t.Fatal(err)
+	}
+	for _, cfg := range []string{
+		"disable_ipv4=true\n",
+		"listen_address=::1\n",
+		pk + "endpoint=[::1]:53511\n",
+		"disable_ipv6=false\ndisable_ipv4=true\n" + pk + "endpoint=127.0.0.1:53511\n",
+	} {
+		if err := ipcSet(dev2, cfg); err == nil {
+			t.Errorf("%q accepted", cfg)
+		}
+	}
+	if get := ipcGet(t, dev2); !strings.Contains(get, "\ndisable_ipv6=true\n") || strings.Contains(get, "disable_ipv4") {
+		t.Errorf("get output of disabled IPv6:\n%s", get)
+	}
+
+	tun2.Outbound <- tuntest.Ping(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"))
+	select {
+	case <-tun1.Inbound:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ping did not transit")
+	}
+
+	if err := ipcSet(dev2, "disable_ipv6=false\n"); err != nil {
+		t.Fatal(err)
+	}
+	if get := ipcGet(t, dev2); strings.Contains(get, "disable_ipv") {
+		t.Errorf("get output of both families:\n%s", get)
+	}
+}
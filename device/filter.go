@@ -0,0 +1,45 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+// FilterVerdict is what a PacketFilter decides on a packet.
+type FilterVerdict int
+
+const (
+	FilterPass   FilterVerdict = iota // forward the packet as it is
+	FilterDrop                        // drop the packet
+	FilterModify                      // forward the packet, which the filter rewrote in place
+)
+
+// PacketFilter inspects an inner IP packet exchanged with the peer with
+// the given public key, and returns a verdict on it. The packet may only
+// be rewritten in place, keeping its length, and with FilterModify
+// returned; fixing up checksums is left to the filter. The packet must
+// not be retained after the filter returns.
+//
+// Filters run on the goroutines processing packets, concurrently for
+// different peers, so they must be safe for concurrent use and fast.
+type PacketFilter func(peerKey wgcfg.Key, packet []byte) FilterVerdict
+
+// SetInboundFilter registers a filter run on each packet received from a
+// peer, after decryption and the check of its source against the peer's
+// allowed IPs, before it is written to the TUN device. A nil filter
+// removes it. It is safe to call concurrently.
+func (device *Device) SetInboundFilter(filter PacketFilter) {
+	device.filters.inbound.Store(filter)
+}
+
+// SetOutboundFilter registers a filter run on each packet read from the
+// TUN device, after the peer it is sent to is looked up, before it is
+// encrypted. A packet rewritten by the filter is routed again by its
+// destination. A nil filter removes it. It is safe to call concurrently.
+func (device *Device) SetOutboundFilter(filter PacketFilter) {
+	device.filters.outbound.Store(filter)
+}
@@ -0,0 +1,83 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+func TestPacketFilters(t *testing.T) {
+	dev1, tun1, dev2, tun2 := newBindTestPair(t, bindtest.NewNetwork(1))
+	defer dev1.Close()
+	defer dev2.Close()
+	dst, src := net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")
+
+	transit := func() []byte {
+		t.Helper()
+		tun2.Outbound <- tuntest.Ping(dst, src)
+		select {
+		case packet := <-tun1.Inbound:
+			return packet
+		case <-time.After(time.Second):
+			return nil
+		}
+	}
+	if transit() == nil {
+		t.Fatal("ping did not transit without filters")
+	}
+
+	// the outbound filter sees the peer and may drop
+
+	var dropped int32
+	dev2.SetOutboundFilter(func(peerKey wgcfg.Key, packet []byte) FilterVerdict {
+		if peerKey != dev1.staticIdentity.publicKey {
+			t.Errorf("outbound filter given peer %v", peerKey.ShortString())
+		}
+		atomic.AddInt32(&dropped, 1)
+		return FilterDrop
+	})
+	tun2.Outbound <- tuntest.Ping(dst, src)
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&dropped) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("outbound filter not run")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-tun1.Inbound:
+		t.Fatal("packet dropped by the outbound filter transited")
+	case <-time.After(100 * time.Millisecond):
+	}
+	dev2.SetOutboundFilter(nil)
+
+	// the inbound filter may rewrite in place
+
+	dev1.SetInboundFilter(func(peerKey wgcfg.Key, packet []byte) FilterVerdict {
+		packet[8]-- // TTL, leaving the checksum to the test
+		return FilterModify
+	})
+	if packet := transit(); packet == nil {
+		t.Fatal("ping did not transit the inbound filter")
+	} else if want := tuntest.Ping(dst, src)[8] - 1; packet[8] != want {
+		t.Errorf("TTL %d after the inbound filter, want %d", packet[8], want)
+	}
+
+	dev1.SetInboundFilter(func(wgcfg.Key, []byte) FilterVerdict { return FilterDrop })
+	if transit() != nil {
+		t.Error("packet dropped by the inbound filter transited")
+	}
+	dev1.SetInboundFilter(nil)
+	if transit() == nil {
+		t.Error("ping did not transit after removing the filters")
+	}
+}
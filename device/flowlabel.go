@@ -0,0 +1,124 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* Flow label hashing, enabled with flow_label_hashing=true, sets the flow
+ * label of outer IPv6 datagrams from the inner packets they carry. All the
+ * datagrams of a peer share their outer addresses and ports, so routers
+ * balancing over equal-cost paths (ECMP) by those keep a peer on a single
+ * path; routers which take the flow label into account can spread its
+ * inner flows over several.
+ *
+ * The label is a hash of the peer and of the addresses, protocol and ports
+ * of the inner packet, so the packets of an inner flow keep to one path and
+ * are not reordered against each other. Packets of different flows may
+ * overtake each other, which the replay window takes. Keepalives and
+ * handshake messages carry no label. Outer IPv4 datagrams have no flow
+ * label, so the setting does nothing for peers reached over IPv4, nor on
+ * binds which cannot set it.
+ */
+
+const (
+	fnvOffset = 2166136261
+	fnvPrime  = 16777619
+)
+
+/* The addresses, protocol and ports of an inner packet, which tell its
+ * flow. Ports are only taken where they directly follow the IP header,
+ * for protocols which have them, and for the first fragment.
+ */
+type packetFlow struct {
+	src, dst []byte
+	protocol byte
+	ports    []byte // source and destination port, nil if none
+}
+
+/* Parses the flow of the inner packet, or returns false if it is not a
+ * valid IP packet.
+ */
+func parsePacketFlow(packet []byte) (flow packetFlow, ok bool) {
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		if len(packet) < ipv4.HeaderLen {
+			return flow, false
+		}
+		flow.protocol = packet[9]
+		flow.src = packet[IPv4offsetSrc : IPv4offsetSrc+net.IPv4len]
+		flow.dst = packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len]
+		headerLen := int(packet[0]&0x0f) * 4
+		fragment := binary.BigEndian.Uint16(packet[IPv4offsetFlags:]) & (ipv4FlagMoreFragments | ipv4FragmentOffset)
+		if fragment == 0 && len(packet) >= headerLen+4 {
+			flow.ports = packet[headerLen : headerLen+4]
+		}
+	case ipv6.Version:
+		if len(packet) < ipv6.HeaderLen {
+			return flow, false
+		}
+		flow.protocol = packet[6]
+		flow.src = packet[IPv6offsetSrc : IPv6offsetSrc+net.IPv6len]
+		flow.dst = packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len]
+		if len(packet) >= ipv6.HeaderLen+4 {
+			flow.ports = packet[ipv6.HeaderLen : ipv6.HeaderLen+4]
+		}
+	default:
+		return flow, false
+	}
+
+	switch flow.protocol {
+	case 6, 17, 33, 132, 136: // TCP, UDP, DCCP, SCTP, UDP-Lite
+	default:
+		flow.ports = nil
+	}
+	return flow, true
+}
+
+/* Returns the flow label of the inner packet, sent to the peer with key
+ * seed, never 0.
+ */
+func innerFlowLabel(seed uint32, packet []byte) uint32 {
+	h := uint32(fnvOffset)
+	add := func(b []byte) {
+		for _, c := range b {
+			h ^= uint32(c)
+			h *= fnvPrime
+		}
+	}
+
+	var seedBytes [4]byte
+	binary.LittleEndian.PutUint32(seedBytes[:], seed)
+	add(seedBytes[:])
+
+	flow, _ := parsePacketFlow(packet)
+	add(flow.src)
+	add(flow.dst)
+	h ^= uint32(flow.protocol)
+	h *= fnvPrime
+	add(flow.ports)
+
+	label := (h ^ h>>20) & 0xfffff
+	if label == 0 {
+		label = 1
+	}
+	return label
+}
+
+/* Returns the flow label of the inner packet sent to the peer,
+ * 0 if flow label hashing is disabled.
+ */
+func (peer *Peer) flowLabel(packet []byte) uint32 {
+	if !peer.device.flowLabelHashing.Get() {
+		return 0
+	}
+	return innerFlowLabel(binary.LittleEndian.Uint32(peer.handshake.remoteStatic[:]), packet)
+}
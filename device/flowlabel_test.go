@@ -0,0 +1,159 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+func udp4Packet(src, dst string, sport, dport uint16, payload byte) []byte {
+	packet := make([]byte, 20+8+1)
+	packet[0] = 0x45
+	packet[9] = 17
+	copy(packet[IPv4offsetSrc:], net.ParseIP(src).To4())
+	copy(packet[IPv4offsetDst:], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(packet[20:], sport)
+	binary.BigEndian.PutUint16(packet[22:], dport)
+	packet[28] = payload
+	return packet
+}
+
+func TestInnerFlowLabel(t *testing.T) {
+	flow := udp4Packet("10.0.0.1", "10.0.0.2", 1000, 53, 0)
+	label := innerFlowLabel(1, flow)
+	if label == 0 || label > 0xfffff {
+		t.Fatalf("invalid label %#x", label)
+	}
+	if got := innerFlowLabel(1, udp4Packet("10.0.0.1", "10.0.0.2", 1000, 53, 1)); got != label {
+		t.Errorf("payload changed the label: %#x, want %#x", got, label)
+	}
+	for _, other := range [][]byte{
+		udp4Packet("10.0.0.1", "10.0.0.2", 1001, 53, 0),
+		udp4Packet("10.0.0.1", "10.0.0.3", 1000, 53, 0),
+	} {
+		if got := innerFlowLabel(1, other); got == label {
+			t.Errorf("other flow labeled alike: %#x", got)
+		}
+	}
+	if got := innerFlowLabel(2, flow); got == label {
+		t.Errorf("other peer labeled alike: %#x", got)
+	}
+
+	// fragments of a datagram are labeled alike, their ports unseen
+
+	first := udp4Packet("10.0.0.1", "10.0.0.2", 1000, 53, 0)
+	binary.BigEndian.PutUint16(first[IPv4offsetFlags:], ipv4FlagMoreFragments)
+	last := udp4Packet("10.0.0.1", "10.0.0.2", 0xdead, 0xbeef, 0)
+	binary.BigEndian.PutUint16(last[IPv4offsetFlags:], 1)
+	if innerFlowLabel(1, first) != innerFlowLabel(1, last) {
+		t.Error("fragments labeled apart")
+	}
+
+	short := []byte{0x60, 0, 0, 0}
+	if got := innerFlowLabel(1, short); got == 0 {
+		t.Error("truncated packet labeled 0")
+	}
+}
+
+/* A batching bind recording the flow labels it sends with.
+ */
+type flowLabelBind struct {
+	conn.Bind
+	mu     sync.Mutex
+	labels []uint32
+}
+
+func (bind *flowLabelBind) ReceiveIPv6Batch(packets []conn.Packet) (int, error) {
+	return bind.receiveBatch(bind.ReceiveIPv6, packets)
+}
+
+func (bind *flowLabelBind) ReceiveIPv4Batch(packets []conn.Packet) (int, error) {
+	return bind.receiveBatch(bind.ReceiveIPv4, packets)
+}
+
+func (bind *flowLabelBind) receiveBatch(receive func([]byte) (int, conn.Endpoint, *net.UDPAddr, error), packets []conn.Packet) (int, error) {
+	var err error
+	packets[0].N, packets[0].Endpoint, packets[0].Addr, err = receive(packets[0].Buffer)
+	if err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+func (bind *flowLabelBind) SendBatch(packets []conn.Packet) error {
+	for _, packet := range packets {
+		bind.mu.Lock()
+		bind.labels = append(bind.labels, packet.FlowLabel)
+		bind.mu.Unlock()
+		if err := bind.Send(packet.Buffer[:packet.N], packet.Endpoint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestFlowLabelHashing(t *testing.T) {
+	network := bindtest.NewNetwork(1)
+	var bind2 *flowLabelBind
+	tun1 := tuntest.NewChannelTUN()
+	dev1 := NewDevice(tun1.TUN(), &DeviceOptions{
+		Logger:         NewLogger(LogLevelError, "dev1: "),
+		CreateBind:     network.CreateBind,
+		CreateEndpoint: network.CreateEndpoint,
+	})
+	defer dev1.Close()
+	dev1.Up()
+	if err := ipcSet(dev1, cfg1); err != nil {
+		t.Fatal(err)
+	}
+	tun2 := tuntest.NewChannelTUN()
+	dev2 := NewDevice(tun2.TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev2: "),
+		CreateBind: func(port uint16) (conn.Bind, uint16, error) {
+			bind, port, err := network.CreateBind(port)
+			if err != nil {
+				return nil, 0, err
+			}
+			bind2 = &flowLabelBind{Bind: bind}
+			return bind2, port, nil
+		},
+		CreateEndpoint: network.CreateEndpoint,
+	})
+	defer dev2.Close()
+	dev2.Up()
+	if err := ipcSet(dev2, "flow_label_hashing=true\n"+cfg2); err != nil {
+		t.Fatal(err)
+	}
+	if get := ipcGet(t, dev2); !strings.Contains(get, "flow_label_hashing=true\n") {
+		t.Errorf("flow_label_hashing missing from get:\n%s", get)
+	}
+
+	ping := tuntest.Ping(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"))
+	for i := 0; i < 2; i++ {
+		tun2.Outbound <- ping
+		select {
+		case <-tun1.Inbound:
+		case <-time.After(2 * time.Second):
+			t.Fatal("ping did not transit")
+		}
+	}
+
+	want := innerFlowLabel(binary.LittleEndian.Uint32(dev1.staticIdentity.publicKey[:]), ping)
+	bind2.mu.Lock()
+	defer bind2.mu.Unlock()
+	if len(bind2.labels) != 2 || bind2.labels[0] != want || bind2.labels[1] != want {
+		t.Errorf("sent with flow labels %#x, want %#x twice", bind2.labels, want)
+	}
+}
@@ -0,0 +1,205 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"container/list"
+	"encoding/binary"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+/* Flow tracking, enabled with SetFlowTracking, keeps a table of the inner
+ * flows traversing each peer: packets sharing their addresses, protocol
+ * and, for TCP, UDP, DCCP, SCTP and UDP-Lite, ports. Both directions of a
+ * flow share an entry, with the local side being that of the TUN device.
+ * The table holds a bounded number of flows, evicting the least recently
+ * seen to make room, and the flows of a peer are dropped with it.
+ *
+ * Tracking is off by default: when on, every packet takes a lock over the
+ * whole table and a map lookup, which shows on fast links.
+ */
+
+// Flow is a point-in-time copy of the counters of an inner flow.
+type Flow struct {
+	Peer       wgcfg.Key // peer the flow traverses
+	Protocol   uint8     // IP protocol number
+	LocalIP    net.IP    // address on the side of the TUN device
+	RemoteIP   net.IP    // address on the side of the peer
+	LocalPort  uint16    // zero for protocols without ports
+	RemotePort uint16    // zero for protocols without ports
+	TxPackets  uint64    // packets sent to the peer
+	TxBytes    uint64    // bytes of inner packets sent to the peer
+	RxPackets  uint64    // packets received from the peer
+	RxBytes    uint64    // bytes of inner packets received from the peer
+	LastSeen   time.Time // when a packet of the flow was last seen
+}
+
+type flowKey struct {
+	peer       *Peer
+	protocol   uint8
+	local      [net.IPv6len]byte // IPv4 addresses in the first four bytes
+	remote     [net.IPv6len]byte
+	localPort  uint16
+	remotePort uint16
+	ipv6       bool
+}
+
+type flowEntry struct {
+	key  flowKey
+	flow Flow
+}
+
+type flowTable struct {
+	sync.Mutex
+	max     int
+	entries map[flowKey]*list.Element // of *flowEntry
+	lru     list.List                 // most recently seen first
+}
+
+// SetFlowTracking enables tracking the inner flows of each peer, in a
+// table of at most maxEntries flows, or disables it if maxEntries is
+// zero. Changing the size drops the flows tracked so far.
+func (device *Device) SetFlowTracking(maxEntries int) {
+	if maxEntries <= 0 {
+		device.flows.Store((*flowTable)(nil))
+		return
+	}
+	device.flows.Store(&flowTable{
+		max:     maxEntries,
+		entries: make(map[flowKey]*list.Element),
+	})
+}
+
+// Flows returns the flows tracked, grouped by peer, most recently seen
+// first, or nil if flow tracking is disabled.
+func (device *Device) Flows() []Flow {
+	table, _ := device.flows.Load().(*flowTable)
+	if table == nil {
+		return nil
+	}
+	table.Lock()
+	flows := make([]Flow, 0, table.lru.Len())
+	for e := table.lru.Front(); e != nil; e = e.Next() {
+		flows = append(flows, e.Value.(*flowEntry).flow)
+	}
+	table.Unlock()
+
+	sort.SliceStable(flows, func(i, j int) bool {
+		return flows[i].Peer.LessThan(&flows[j].Peer)
+	})
+	return flows
+}
+
+/* Counts the inner packet, sent to the peer or received from it, against
+ * its flow, if flow tracking is enabled.
+ */
+func (device *Device) trackFlow(peer *Peer, packet []byte, received bool) {
+	table, _ := device.flows.Load().(*flowTable)
+	if table == nil {
+		return
+	}
+	key, ok := parseFlowKey(packet, received)
+	if !ok {
+		return
+	}
+	key.peer = peer
+	now := time.Now()
+
+	table.Lock()
+	defer table.Unlock()
+
+	var entry *flowEntry
+	if e, ok := table.entries[key]; ok {
+		table.lru.MoveToFront(e)
+		entry = e.Value.(*flowEntry)
+	} else {
+		if table.lru.Len() >= table.max {
+			oldest := table.lru.Back()
+			delete(table.entries, oldest.Value.(*flowEntry).key)
+			table.lru.Remove(oldest)
+		}
+		entry = &flowEntry{key: key, flow: key.flow()}
+		table.entries[key] = table.lru.PushFront(entry)
+	}
+	if received {
+		entry.flow.RxPackets++
+		entry.flow.RxBytes += uint64(len(packet))
+	} else {
+		entry.flow.TxPackets++
+		entry.flow.TxBytes += uint64(len(packet))
+	}
+	entry.flow.LastSeen = now
+}
+
+/* Drops the flows of the peer, as it is removed.
+ */
+func (device *Device) forgetFlows(peer *Peer) {
+	table, _ := device.flows.Load().(*flowTable)
+	if table == nil {
+		return
+	}
+	table.Lock()
+	defer table.Unlock()
+	for e := table.lru.Front(); e != nil; {
+		next := e.Next()
+		if entry := e.Value.(*flowEntry); entry.key.peer == peer {
+			delete(table.entries, entry.key)
+			table.lru.Remove(e)
+		}
+		e = next
+	}
+}
+
+/* Returns the key of the flow of the inner packet, oriented with the TUN
+ * device on the local side, or false if it is not a valid IP packet.
+ */
+func parseFlowKey(packet []byte, received bool) (key flowKey, ok bool) {
+	flow, ok := parsePacketFlow(packet)
+	if !ok {
+		return key, false
+	}
+	key.protocol = flow.protocol
+	key.ipv6 = len(flow.src) == net.IPv6len
+
+	var srcPort, dstPort uint16
+	if flow.ports != nil {
+		srcPort = binary.BigEndian.Uint16(flow.ports[0:])
+		dstPort = binary.BigEndian.Uint16(flow.ports[2:])
+	}
+
+	if received {
+		copy(key.local[:], flow.dst)
+		copy(key.remote[:], flow.src)
+		key.localPort, key.remotePort = dstPort, srcPort
+	} else {
+		copy(key.local[:], flow.src)
+		copy(key.remote[:], flow.dst)
+		key.localPort, key.remotePort = srcPort, dstPort
+	}
+	return key, true
+}
+
+/* Returns a flow with the addresses and ports of the key, and no counts.
+ */
+func (key *flowKey) flow() Flow {
+	size := net.IPv4len
+	if key.ipv6 {
+		size = net.IPv6len
+	}
+	return Flow{
+		Peer:       key.peer.handshake.remoteStatic,
+		Protocol:   key.protocol,
+		LocalIP:    append(net.IP(nil), key.local[:size]...),
+		RemoteIP:   append(net.IP(nil), key.remote[:size]...),
+		LocalPort:  key.localPort,
+		RemotePort: key.remotePort,
+	}
+}
@@ -0,0 +1,97 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+func TestTrackFlow(t *testing.T) {
+	device := &Device{}
+	peer := &Peer{device: device}
+	peer.handshake.remoteStatic[0] = 1
+
+	device.trackFlow(peer, udp4Packet("10.0.0.1", "10.0.0.2", 1000, 53, 0), false)
+	if flows := device.Flows(); flows != nil {
+		t.Fatalf("tracked while disabled: %v", flows)
+	}
+
+	// both directions of a flow share an entry
+
+	device.SetFlowTracking(2)
+	device.trackFlow(peer, udp4Packet("10.0.0.1", "10.0.0.2", 1000, 53, 0), false)
+	device.trackFlow(peer, udp4Packet("10.0.0.2", "10.0.0.1", 53, 1000, 0), true)
+	device.trackFlow(peer, udp4Packet("10.0.0.2", "10.0.0.1", 53, 1000, 0), true)
+	flows := device.Flows()
+	if len(flows) != 1 {
+		t.Fatalf("%d flows, want 1: %v", len(flows), flows)
+	}
+	flow := flows[0]
+	if !flow.LocalIP.Equal(net.ParseIP("10.0.0.1")) || !flow.RemoteIP.Equal(net.ParseIP("10.0.0.2")) || flow.LocalPort != 1000 || flow.RemotePort != 53 || flow.Protocol != 17 {
+		t.Errorf("flow misoriented: %+v", flow)
+	}
+	if flow.TxPackets != 1 || flow.RxPackets != 2 || flow.TxBytes != 29 || flow.RxBytes != 58 || flow.Peer != peer.handshake.remoteStatic || flow.LastSeen.IsZero() {
+		t.Errorf("flow miscounted: %+v", flow)
+	}
+
+	// the least recently seen flow is evicted
+
+	device.trackFlow(peer, udp4Packet("10.0.0.1", "10.0.0.3", 1000, 53, 0), false)
+	device.trackFlow(peer, udp4Packet("10.0.0.1", "10.0.0.2", 1000, 53, 0), false)
+	device.trackFlow(peer, udp4Packet("10.0.0.1", "10.0.0.4", 1000, 53, 0), false)
+	flows = device.Flows()
+	if len(flows) != 2 || !flows[0].RemoteIP.Equal(net.ParseIP("10.0.0.4")) || !flows[1].RemoteIP.Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("wrong flows kept: %v", flows)
+	}
+
+	device.forgetFlows(peer)
+	if flows := device.Flows(); len(flows) != 0 {
+		t.Errorf("flows of a removed peer kept: %v", flows)
+	}
+	device.SetFlowTracking(0)
+	if flows := device.Flows(); flows != nil {
+		t.Errorf("flows after disabling: %v", flows)
+	}
+}
+
+func TestFlowTracking(t *testing.T) {
+	dst, src := net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")
+	dev1, tun1, dev2, tun2 := newBindTestPair(t, bindtest.NewNetwork(1))
+	defer dev1.Close()
+	defer dev2.Close()
+	dev1.SetFlowTracking(16)
+
+	tun2.Outbound <- tuntest.Ping(dst, src)
+	select {
+	case <-tun1.Inbound:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ping did not transit")
+	}
+	tun1.Outbound <- tuntest.Ping(src, dst)
+	select {
+	case <-tun2.Inbound:
+	case <-time.After(2 * time.Second):
+		t.Fatal("return ping did not transit")
+	}
+
+	flows := dev1.Flows()
+	if len(flows) != 1 {
+		t.Fatalf("%d flows, want 1: %v", len(flows), flows)
+	}
+	if flow := flows[0]; flow.Peer != dev2.staticIdentity.publicKey || !flow.RemoteIP.Equal(src) || flow.RxPackets != 1 || flow.TxPackets != 1 {
+		t.Errorf("wrong flow: %+v", flow)
+	}
+
+	dev1.RemoveAllPeers()
+	if flows := dev1.Flows(); len(flows) != 0 {
+		t.Errorf("flows of removed peers kept: %v", flows)
+	}
+}
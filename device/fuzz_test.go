@@ -0,0 +1,77 @@
+// +build go1.18
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+	"golang.org/x/net/ipv4"
+)
+
+/* Feeds arbitrary datagrams to the receive path of a device with an
+ * established session, which must drop, rather than panic on, those it
+ * cannot parse. Run with go test -fuzz=FuzzReceive ./device.
+ */
+func FuzzReceive(f *testing.F) {
+	dev1, peer, tun1, dev2 := newProcessPair(f)
+	defer dev1.Close()
+	defer dev2.Close()
+	go func() {
+		for range tun1.Inbound {
+		}
+	}()
+
+	// seed with messages of each type, and transport messages from the
+	// session, which carry packets of arbitrary content once decrypted
+
+	ping := tuntest.Ping(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"))
+	f.Add(dev2.processOutbound(ping), false)
+	f.Add(ping, true)
+	for _, size := range []int{MessageInitiationSize, MessageResponseSize, MessageCookieReplySize, MessageHybridInitiationSize, MessageHybridResponseSize} {
+		f.Add(make([]byte, size), false)
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	f.Fuzz(func(t *testing.T, data []byte, encrypt bool) {
+
+		// packets to encrypt are addressed to the peer, so that the
+		// session carries them
+
+		if encrypt {
+			if len(data) < ipv4.HeaderLen {
+				return
+			}
+			packet := append([]byte(nil), data...)
+			packet[0] = ipv4.Version<<4 | packet[0]&0xf
+			copy(packet[IPv4offsetDst:], net.IPv4(1, 0, 0, 1).To4())
+			if msg := dev2.processOutbound(packet); msg != nil {
+				dev1.processInbound(peer, msg)
+			}
+			return
+		}
+
+		// transport messages are taken synchronously, the workers of the
+		// device not to be raced with for the session
+
+		dev1.processInbound(peer, data)
+		if len(data) >= MinMessageSize && binary.LittleEndian.Uint32(data) == MessageTransportType {
+			return
+		}
+		buffer := dev1.GetMessageBuffer()
+		if len(data) > len(buffer) {
+			dev1.PutMessageBuffer(buffer)
+			return
+		}
+		if !dev1.handleIncoming(buffer, copy(buffer, data), nil, addr, 0) {
+			dev1.PutMessageBuffer(buffer)
+		}
+	})
+}
@@ -0,0 +1,96 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+)
+
+/* Creating or consuming a handshake message takes several Curve25519
+ * operations, and an ML-KEM one if it is hybrid, far more than anything
+ * done per transport packet. The rate limiter bounds the handshakes of
+ * each source under load, but a flood from many sources may still keep
+ * every CPU busy with them. The gate bounds how many handshake messages
+ * are computed at once, across the handshake workers and the timers of
+ * all peers: the others wait their turn, the handshake queue filling up
+ * and dropping behind the workers as it does under load.
+ *
+ * The default is the number of handshake workers, as many handshakes as
+ * there are CPUs to compute them: handshakes created by the timers of
+ * peers wait their turn alongside the workers, rather than adding to
+ * them.
+ */
+
+type handshakeGate struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	workers int // number of handshake workers, the default limit
+	limit   int // zero for workers
+	active  int
+	limited uint64 // handshakes which had to wait at the gate
+}
+
+func (gate *handshakeGate) init(workers int) {
+	gate.cond = sync.NewCond(&gate.mutex)
+	gate.workers = workers
+}
+
+func (gate *handshakeGate) capacity() int {
+	if gate.limit == 0 {
+		return gate.workers
+	}
+	return gate.limit
+}
+
+/* Waits until fewer handshakes than the limit are computed, and counts
+ * the caller among them until it calls leave.
+ */
+func (gate *handshakeGate) enter() {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	if gate.active >= gate.capacity() {
+		gate.limited++
+		for gate.active >= gate.capacity() {
+			gate.cond.Wait()
+		}
+	}
+	gate.active++
+}
+
+func (gate *handshakeGate) leave() {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	gate.active--
+	gate.cond.Signal()
+}
+
+/* Sets the number of handshakes computed at once, zero for the default,
+ * letting in those waiting if it was raised.
+ */
+func (gate *handshakeGate) setLimit(limit int) {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	gate.limit = limit
+	gate.cond.Broadcast()
+}
+
+func (gate *handshakeGate) getLimit() int {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	return gate.limit
+}
+
+func (gate *handshakeGate) limitedCount() uint64 {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	return gate.limited
+}
+
+func (gate *handshakeGate) resetLimited() {
+	gate.mutex.Lock()
+	gate.limited = 0
+	gate.mutex.Unlock()
+}
@@ -0,0 +1,102 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+func TestHandshakeGate(t *testing.T) {
+	var gate handshakeGate
+	gate.init(2) // two handshake workers, the default limit
+	gate.enter()
+	gate.enter()
+
+	entered := make(chan struct{})
+	go func() {
+		gate.enter()
+		close(entered)
+	}()
+	select {
+	case <-entered:
+		t.Fatal("entered a full gate")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if n := gate.limitedCount(); n != 1 {
+		t.Errorf("limited %d times, want 1", n)
+	}
+
+	gate.leave()
+	select {
+	case <-entered:
+	case <-time.After(time.Second):
+		t.Fatal("not let in once the gate was left")
+	}
+
+	// raising the limit lets in those waiting
+
+	entered = make(chan struct{})
+	go func() {
+		gate.enter()
+		gate.leave()
+		close(entered)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	gate.setLimit(3)
+	select {
+	case <-entered:
+	case <-time.After(time.Second):
+		t.Fatal("not let in once the limit was raised")
+	}
+	gate.leave()
+}
+
+func TestUAPIHandshakeConcurrency(t *testing.T) {
+	dst, src := net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")
+	dev1, tun1, dev2, tun2 := newBindTestPair(t, bindtest.NewNetwork(1))
+	defer dev1.Close()
+	defer dev2.Close()
+
+	if strings.Contains(ipcGet(t, dev1), "handshake_concurrency=") {
+		t.Error("default handshake_concurrency reported")
+	}
+	if err := ipcSet(dev1, "handshake_concurrency=70000\n"); err == nil {
+		t.Error("handshake_concurrency over the maximum accepted")
+	}
+
+	// a single handshake at a time still completes handshakes
+
+	for _, dev := range []*Device{dev1, dev2} {
+		if err := ipcSet(dev, "handshake_concurrency=1\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tun2.Outbound <- tuntest.Ping(dst, src)
+	select {
+	case <-tun1.Inbound:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ping did not transit")
+	}
+
+	get := ipcGet(t, dev1)
+	for _, line := range []string{"\nhandshake_concurrency=1\n", "\nhandshake_concurrency_limited=0\n"} {
+		if !strings.Contains(get, line) {
+			t.Errorf("get output missing %q:\n%s", line, get)
+		}
+	}
+	if err := ipcSet(dev1, "handshake_concurrency=0\n"); err != nil {
+		t.Fatal(err)
+	}
+	if limit, workers := dev1.handshakeGate.capacity(), workerCount(0); limit != workers {
+		t.Errorf("handshake concurrency %d after reset, want the %d handshake workers", limit, workers)
+	}
+}
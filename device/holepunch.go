@@ -0,0 +1,227 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+/* Hole punching helps the handshake through NATs which map each
+ * destination to a different port (symmetric NATs), where initiations
+ * sent to the endpoint of the peer alone seldom pass. A signaling layer
+ * outside the device, such as a rendezvous server, gives each side
+ * candidate addresses of the other with punch_candidate=, repeated, each
+ * an address and port or an inclusive range of predicted ports, as in
+ * 198.51.100.7:40000-40063. An empty punch_candidate= stops punching.
+ *
+ * Each initiation sent to the peer is then also sent to every candidate,
+ * punch_burst times over, one send every punch_interval. Each send opens
+ * a mapping in our NAT towards a candidate, which lets in the initiations
+ * of the peer punching towards us at the same time. All are the same
+ * initiation, so the responder takes the first to arrive and drops the
+ * others as replays, as with racing endpoints (see race.go).
+ *
+ * The first handshake message authenticated from the peer ends punching.
+ * If it came from a candidate, the candidate becomes the endpoint of the
+ * peer, even if the endpoint is locked, as it was configured. Either way
+ * the signaling layer is told the endpoint the handshake went through by
+ * the punched UAPI event and the HolePunchHandler. Punching is
+ * best-effort: it goes on with every initiation until one passes, the
+ * handshake being given up on as without it.
+ */
+
+type holePunch struct {
+	candidates []string        // as configured
+	endpoints  []conn.Endpoint // one for each port of the candidates
+}
+
+// HolePunchHandler is called when hole punching ends with a handshake
+// message from the peer, with the endpoint it came through.
+type HolePunchHandler func(peerKey wgcfg.Key, endpoint string)
+
+// SetHolePunchHandler registers a handler invoked whenever hole punching
+// to a peer succeeds. A nil handler disables the notification. It is safe
+// to call concurrently.
+func (device *Device) SetHolePunchHandler(handler HolePunchHandler) {
+	device.events.Lock()
+	device.events.holePunch = handler
+	device.events.Unlock()
+}
+
+/* Adds the candidate s of the peer with key to punch, an address and a
+ * port or an inclusive range of ports.
+ */
+func (device *Device) addPunchCandidate(punch *holePunch, key wgcfg.Key, s string) error {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("invalid address %s", host)
+	}
+	low, high := port, port
+	if i := strings.IndexByte(port, '-'); i >= 0 {
+		low, high = port[:i], port[i+1:]
+	}
+	first, err := strconv.ParseUint(low, 10, 16)
+	if err != nil {
+		return err
+	}
+	last, err := strconv.ParseUint(high, 10, 16)
+	if err != nil {
+		return err
+	}
+	if first == 0 {
+		return errors.New("port 0 cannot be punched")
+	}
+	if last < first {
+		return fmt.Errorf("empty port range %s", port)
+	}
+	if len(punch.endpoints)+int(last-first)+1 > MaxPunchPorts {
+		return fmt.Errorf("more than %d ports to punch", MaxPunchPorts)
+	}
+	for p := first; p <= last; p++ {
+		endpoint, err := device.createEndpoint(key, (&net.UDPAddr{IP: ip, Port: int(p)}).String())
+		if err != nil {
+			return err
+		}
+		punch.endpoints = append(punch.endpoints, endpoint)
+	}
+	punch.candidates = append(punch.candidates, s)
+	return nil
+}
+
+/* Sends the initiation packet to the candidates of the peer, if it is
+ * punching, in a burst paced by its punch interval. The burst supersedes
+ * that of the previous initiation, as each retransmission starts another,
+ * and lasts no longer than the rekey timeout after which the next one is
+ * sent. It stops early if punching ends or the candidates change.
+ */
+func (peer *Peer) punchHandshakeInitiation(packet []byte) {
+	peer.RLock()
+	punch := peer.punch
+	interval, burst := peer.punchInterval, peer.punchBurst
+	peer.RUnlock()
+	if punch == nil {
+		return
+	}
+	if interval == 0 {
+		interval = PunchInterval
+	}
+	if burst == 0 {
+		burst = PunchBurst
+	}
+
+	packet = append([]byte(nil), packet...)
+	generation := atomic.AddUint32(&peer.punchGeneration, 1)
+	deadline := time.Now().Add(peer.device.rekeyTimeout())
+	peer.device.log.Verbosef("%v - Punching handshake init to %d candidate ports", peer, len(punch.endpoints))
+	go func() {
+		for round := 0; round < burst; round++ {
+			for _, endpoint := range punch.endpoints {
+				if !peer.sendPunch(punch, generation, packet, endpoint) {
+					return
+				}
+				if time.Until(deadline) < interval {
+					return
+				}
+				time.Sleep(interval)
+			}
+		}
+	}()
+}
+
+func (peer *Peer) sendPunch(punch *holePunch, generation uint32, packet []byte, endpoint conn.Endpoint) bool {
+	if atomic.LoadUint32(&peer.punchGeneration) != generation {
+		return false
+	}
+
+	device := peer.device
+	device.net.RLock()
+	defer device.net.RUnlock()
+	if device.net.bind == nil {
+		return false
+	}
+
+	peer.RLock()
+	punching := peer.punch == punch
+	peer.RUnlock()
+	if !punching {
+		return false
+	}
+	if err := device.net.bind.Send(packet, endpoint); err != nil {
+		device.log.Verbosef("%v - Failed to punch handshake initiation to %v: %v", peer, endpoint.DstToString(), err)
+	}
+	return true
+}
+
+/* Ends hole punching to the peer with a handshake message authenticated
+ * from addr, taking the candidate at addr as its endpoint, if any.
+ */
+func (peer *Peer) commitHolePunch(addr *net.UDPAddr) {
+	device := peer.device
+	handler := device.endpointChangeHandler()
+
+	peer.Lock()
+	punch := peer.punch
+	if punch == nil {
+		peer.Unlock()
+		return
+	}
+	peer.punch = nil
+	var old string
+	if peer.endpoint != nil {
+		old = peer.endpoint.DstToString()
+	}
+	new := addr.String()
+	candidate := false
+	for _, endpoint := range punch.endpoints {
+		if endpoint.DstToString() == new {
+			peer.endpoint = endpoint
+			peer.endpointResolved = new
+			candidate = true
+			break
+		}
+	}
+	peer.Unlock()
+
+	device.log.Verbosef("%v - Hole punched through to %v", peer, new)
+	if candidate && new != old {
+		peer.endpointChanged(handler, old, new)
+	}
+	peer.holePunchEvent(new)
+}
+
+func (peer *Peer) holePunchEvent(endpoint string) {
+	device := peer.device
+	device.events.RLock()
+	handler := device.events.holePunch
+	device.events.RUnlock()
+
+	key := peer.handshake.remoteStatic
+	device.publishEvent(UAPIEventJSON{
+		Event:     UAPIEventPunched,
+		PublicKey: key.HexString(),
+		Endpoint:  endpoint,
+	})
+
+	if handler == nil {
+		return
+	}
+	device.queueEvent(func() {
+		handler(key, endpoint)
+	})
+}
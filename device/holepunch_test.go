@@ -0,0 +1,104 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+func TestHolePunch(t *testing.T) {
+	dst, src := net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")
+	dev1, tun1, dev2, tun2 := newBindTestPair(t, bindtest.NewNetwork(1))
+	defer dev1.Close()
+	defer dev2.Close()
+
+	punched := make(chan string, 1)
+	dev2.SetHolePunchHandler(func(_ wgcfg.Key, endpoint string) {
+		punched <- endpoint
+	})
+
+	const pk = "public_key=49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427\n"
+	for _, cfg := range []string{
+		"punch_candidate=127.0.0.1:0\n",
+		"punch_candidate=127.0.0.1:2-1\n",
+		"punch_candidate=localhost:1\n",
+		"punch_candidate=127.0.0.1:1-1025\n",
+		"punch_burst=17\n",
+	} {
+		if err := ipcSet(dev2, pk+cfg); err == nil {
+			t.Errorf("%q accepted", cfg)
+		}
+	}
+
+	// the endpoint is of no use, the peer is only reached at a candidate
+
+	if err := ipcSet(dev2, pk+"endpoint=127.0.0.1:53600\npunch_candidate=127.0.0.1:53500-53511\npunch_candidate=[::1]:53511\npunch_interval=1\n"); err != nil {
+		t.Fatal(err)
+	}
+	get := ipcGet(t, dev2)
+	for _, line := range []string{"\npunch_candidate=127.0.0.1:53500-53511\n", "\npunch_candidate=[::1]:53511\n", "\npunch_interval=1\n"} {
+		if !strings.Contains(get, line) {
+			t.Errorf("get output missing %q:\n%s", line, get)
+		}
+	}
+
+	tun2.Outbound <- tuntest.Ping(dst, src)
+	select {
+	case <-tun1.Inbound:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ping did not transit")
+	}
+	select {
+	case endpoint := <-punched:
+		if endpoint != "127.0.0.1:53511" {
+			t.Errorf("punched through to %s", endpoint)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("hole punching not reported")
+	}
+
+	get = ipcGet(t, dev2)
+	if !strings.Contains(get, "\nendpoint=127.0.0.1:53511\n") {
+		t.Errorf("endpoint not taken from the candidate:\n%s", get)
+	}
+	if strings.Contains(get, "punch_candidate=") {
+		t.Errorf("still punching:\n%s", get)
+	}
+}
+
+func TestHolePunchSuperseded(t *testing.T) {
+	dev1, _, dev2, _ := newBindTestPair(t, bindtest.NewNetwork(1))
+	defer dev1.Close()
+	defer dev2.Close()
+
+	const pk = "public_key=49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427\n"
+	if err := ipcSet(dev2, pk+"punch_candidate=127.0.0.1:53500\n"); err != nil {
+		t.Fatal(err)
+	}
+	peer := dev2.LookupPeer(dev1.staticIdentity.publicKey)
+	peer.RLock()
+	punch := peer.punch
+	peer.RUnlock()
+	endpoint := punch.endpoints[0]
+
+	packet := make([]byte, MessageInitiationSize)
+	generation := atomic.AddUint32(&peer.punchGeneration, 1)
+	if !peer.sendPunch(punch, generation, packet, endpoint) {
+		t.Fatal("burst stopped before being superseded")
+	}
+	peer.punchHandshakeInitiation(packet)
+	if peer.sendPunch(punch, generation, packet, endpoint) {
+		t.Error("burst not superseded by the next initiation")
+	}
+}
@@ -7,8 +7,11 @@ package device
 
 import (
 	"crypto/rand"
+	"sort"
 	"sync"
 	"unsafe"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
 )
 
 type IndexTableEntry struct {
@@ -95,3 +98,73 @@ func (table *IndexTable) Lookup(id uint32) IndexTableEntry {
 	defer table.RUnlock()
 	return table.table[id]
 }
+
+// IndexRole is what an index of the index table belongs to.
+type IndexRole int
+
+const (
+	IndexHandshake IndexRole = iota // a handshake in progress
+	IndexCurrent                    // the current keypair of the peer
+	IndexPrevious                   // the previous keypair of the peer
+	IndexNext                       // the next keypair of the peer, not yet confirmed
+	IndexStale                      // a keypair the peer no longer holds
+)
+
+func (role IndexRole) String() string {
+	switch role {
+	case IndexHandshake:
+		return "handshake"
+	case IndexCurrent:
+		return "current"
+	case IndexPrevious:
+		return "previous"
+	case IndexNext:
+		return "next"
+	case IndexStale:
+		return "stale"
+	}
+	return "unknown"
+}
+
+// Index is an entry of the index table: a receiver index, the peer
+// owning it and what it belongs to. It carries no key material.
+type Index struct {
+	Index uint32
+	Peer  wgcfg.Key
+	Role  IndexRole
+}
+
+// Entries returns all indices in use, in ascending order, taken at a
+// single point in time.
+func (table *IndexTable) Entries() []Index {
+	type snapshot struct {
+		index uint32
+		entry IndexTableEntry
+	}
+
+	table.RLock()
+	snapshots := make([]snapshot, 0, len(table.table))
+	for index, entry := range table.table {
+		snapshots = append(snapshots, snapshot{index, entry})
+	}
+	table.RUnlock()
+
+	/* The roles of keypairs are found without holding the table, as
+	 * keypairs are deleted from it while their peer's keypairs are held.
+	 */
+	entries := make([]Index, 0, len(snapshots))
+	for _, s := range snapshots {
+		if s.entry.peer == nil {
+			continue
+		}
+		entries = append(entries, Index{
+			Index: s.index,
+			Peer:  s.entry.peer.handshake.remoteStatic,
+			Role:  s.entry.peer.keypairs.role(s.entry.keypair),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Index < entries[j].Index
+	})
+	return entries
+}
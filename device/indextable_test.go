@@ -0,0 +1,72 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+)
+
+func TestDumpIndexTable(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer1, err := dev2.NewPeer(dev1.staticIdentity.privateKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer2, err := dev1.NewPeer(dev2.staticIdentity.privateKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entries := dev1.DumpIndexTable(); len(entries) != 0 {
+		t.Fatalf("index table of a new device: %v", entries)
+	}
+
+	msg1, err := dev1.CreateMessageInitiation(peer2)
+	assertNil(t, err)
+	want := []Index{{msg1.Sender, peer2.handshake.remoteStatic, IndexHandshake}}
+	assertIndices(t, dev1.DumpIndexTable(), want)
+
+	if dev2.ConsumeMessageInitiation(msg1) == nil {
+		t.Fatal("handshake failed at initiation message")
+	}
+	msg2, err := dev2.CreateMessageResponse(peer1)
+	assertNil(t, err)
+	if dev1.ConsumeMessageResponse(msg2) == nil {
+		t.Fatal("handshake failed at response message")
+	}
+	assertNil(t, peer1.BeginSymmetricSession())
+	assertNil(t, peer2.BeginSymmetricSession())
+
+	want[0].Role = IndexCurrent
+	assertIndices(t, dev1.DumpIndexTable(), want)
+	assertIndices(t, dev2.DumpIndexTable(), []Index{{msg2.Sender, peer1.handshake.remoteStatic, IndexNext}})
+
+	// confirming the keypair makes it current
+
+	peer1.ReceivedWithKeypair(peer1.keypairs.next)
+	assertIndices(t, dev2.DumpIndexTable(), []Index{{msg2.Sender, peer1.handshake.remoteStatic, IndexCurrent}})
+
+	peer2.ZeroAndFlushAll()
+	if entries := dev1.DumpIndexTable(); len(entries) != 0 {
+		t.Errorf("index table after zeroing keys: %v", entries)
+	}
+}
+
+func assertIndices(t *testing.T, got, want []Index) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("index table %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("index table entry %d is %v, want %v", i, got[i], want[i])
+		}
+	}
+}
@@ -10,13 +10,38 @@ import (
 )
 
 const (
+	IPv4offsetTOS         = 1
 	IPv4offsetTotalLength = 2
+	IPv4offsetFlags       = 6
+	IPv4offsetChecksum    = 10
 	IPv4offsetSrc         = 12
 	IPv4offsetDst         = IPv4offsetSrc + net.IPv4len
 )
 
+const (
+	ipv4FlagDontFragment  = 0x4000
+	ipv4FlagMoreFragments = 0x2000
+	ipv4FragmentOffset    = 0x1fff
+)
+
 const (
 	IPv6offsetPayloadLength = 4
 	IPv6offsetSrc           = 8
 	IPv6offsetDst           = IPv6offsetSrc + net.IPv6len
 )
+
+/* Returns the ones' complement sum of b, starting from initial (RFC 1071).
+ */
+func checksum(b []byte, initial uint32) uint16 {
+	sum := initial
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return uint16(sum)
+}
@@ -0,0 +1,28 @@
+// +build !go1.24
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+)
+
+/* ML-KEM is available in the standard library from Go 1.24 on,
+ * older toolchains only build the classic handshake.
+ */
+
+const kemSupported = false
+
+var errKEMUnsupported = errors.New("hybrid handshake not supported by this build")
+
+func newKEMPrivateKey() (kemPrivateKey, error) {
+	return nil, errKEMUnsupported
+}
+
+func kemEncapsulate(publicKey []byte) (secret, ciphertext []byte, err error) {
+	return nil, nil, errKEMUnsupported
+}
@@ -0,0 +1,47 @@
+// +build go1.24
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/mlkem"
+)
+
+const kemSupported = true
+
+// the message layout depends on these sizes
+var (
+	_ [KEMPublicKeySize - mlkem.EncapsulationKeySize768]byte
+	_ [mlkem.EncapsulationKeySize768 - KEMPublicKeySize]byte
+	_ [KEMCiphertextSize - mlkem.CiphertextSize768]byte
+	_ [mlkem.CiphertextSize768 - KEMCiphertextSize]byte
+)
+
+type mlkemPrivateKey struct {
+	*mlkem.DecapsulationKey768
+}
+
+func (key mlkemPrivateKey) PublicKey() []byte {
+	return key.EncapsulationKey().Bytes()
+}
+
+func newKEMPrivateKey() (kemPrivateKey, error) {
+	key, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, err
+	}
+	return mlkemPrivateKey{key}, nil
+}
+
+func kemEncapsulate(publicKey []byte) (secret, ciphertext []byte, err error) {
+	key, err := mlkem.NewEncapsulationKey768(publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, ciphertext = key.Encapsulate()
+	return secret, ciphertext, nil
+}
@@ -21,14 +21,19 @@ import (
  */
 
 type Keypair struct {
-	sendNonce    uint64
-	send         cipher.AEAD
-	receive      cipher.AEAD
-	replayFilter replay.ReplayFilter
-	isInitiator  bool
-	created      time.Time
-	localIndex   uint32
-	remoteIndex  uint32
+	sendNonce        uint64
+	send             cipher.AEAD
+	receive          cipher.AEAD
+	replayFilter     replay.ReplayFilter
+	isInitiator      bool
+	nextPresharedKey bool       // derived under the psk being rotated in
+	hybrid           bool       // derived from a hybrid handshake
+	aesGCM           bool       // AES-GCM rather than ChaCha20-Poly1305
+	confirmed        AtomicBool // a transport message was received under the keypair
+	lossCounted      uint64     // missing counters of replayFilter counted in the loss estimate
+	created          time.Time
+	localIndex       uint32
+	remoteIndex      uint32
 }
 
 type Keypairs struct {
@@ -38,14 +43,69 @@ type Keypairs struct {
 	next     *Keypair
 }
 
+/* Returns which of the keypairs of the peer keypair is, with the
+ * handshake it comes from if nil.
+ */
+func (kp *Keypairs) role(keypair *Keypair) IndexRole {
+	if keypair == nil {
+		return IndexHandshake
+	}
+
+	kp.RLock()
+	defer kp.RUnlock()
+
+	switch keypair {
+	case kp.current:
+		return IndexCurrent
+	case kp.previous:
+		return IndexPrevious
+	case kp.next:
+		return IndexNext
+	}
+	return IndexStale
+}
+
 func (kp *Keypairs) Current() *Keypair {
 	kp.RLock()
 	defer kp.RUnlock()
 	return kp.current
 }
 
+/* Returns whether the peer has a keypair, and whether the newest of them
+ * was confirmed by a transport message received under it. A handshake may
+ * complete while nothing comes back under the keypair it derived: the
+ * responder's keypair waits as next, and the initiator's is current but
+ * unconfirmed, until the first one arrives.
+ */
+func (kp *Keypairs) newestConfirmed() (exists, confirmed bool) {
+	kp.RLock()
+	defer kp.RUnlock()
+	if kp.next != nil {
+		return true, false
+	}
+	if kp.current == nil {
+		return false, false
+	}
+	return true, kp.current.confirmed.Get()
+}
+
 func (device *Device) DeleteKeypair(key *Keypair) {
 	if key != nil {
 		device.indexTable.Delete(key.localIndex)
 	}
 }
+
+/* Checks the counter of a transport message received under the keypair
+ * against its replay filter. With disable_replay_protection, messages
+ * behind the replay window are accepted rather than dropped, for links
+ * which reorder packets further than any window; only messages within the
+ * window are still accepted once. An attacker can then replay any message
+ * older than the window, so this trades away part of the protection
+ * against replay for delivery on such links.
+ */
+func (peer *Peer) validateCounter(keypair *Keypair, counter uint64) bool {
+	if peer.replayUnprotected.Get() {
+		return keypair.replayFilter.ValidateCounterBehind(counter, RejectAfterMessages)
+	}
+	return keypair.replayFilter.ValidateCounter(counter, RejectAfterMessages)
+}
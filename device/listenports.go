@@ -0,0 +1,99 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/tailscale/wireguard-go/conn"
+)
+
+/* A device listens on the port set with listen_port, and on any further
+ * ports given by repeating listen_port in the same operation, or by a
+ * range such as listen_port=51820-51823. Datagrams are accepted on all of
+ * them, and peers are replied to from the port they were last heard on, so
+ * that a peer switching ports to get around a blocked one stays connected.
+ * Peers are first contacted from the first port.
+ */
+
+/* Roams the peer to the source addr of an authenticated datagram, received
+ * from end, and has the bind reply from the port the datagram arrived on.
+ */
+func (peer *Peer) heardFrom(end conn.Endpoint, addr *net.UDPAddr) {
+	if end, ok := end.(conn.HeardEndpoint); ok {
+		end.Heard()
+	}
+	peer.setEndpointAddress(addr, end)
+}
+
+/* Returns the listening port datagrams from end were received on. Must be
+ * called with device.net read locked.
+ */
+func (device *Device) receivedPort(end conn.Endpoint) uint16 {
+	if end, ok := end.(conn.MultiPortEndpoint); ok {
+		if i := end.BindIndex(); i > 0 && i <= len(device.net.ports) {
+			return device.net.ports[i-1]
+		}
+	}
+	return device.net.port
+}
+
+/* Parses the value of listen_port, a port or an inclusive range of ports.
+ */
+func parseListenPorts(value string) ([]uint16, error) {
+	first, last := value, value
+	if i := strings.IndexByte(value, '-'); i >= 0 {
+		first, last = value[:i], value[i+1:]
+	}
+	low, err := strconv.ParseUint(first, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	high, err := strconv.ParseUint(last, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	if high < low {
+		return nil, fmt.Errorf("empty port range %s", value)
+	}
+	if high-low >= MaxListenPorts {
+		return nil, fmt.Errorf("more than %d ports in %s", MaxListenPorts, value)
+	}
+	ports := make([]uint16, 0, high-low+1)
+	for port := low; port <= high; port++ {
+		ports = append(ports, uint16(port))
+	}
+	return ports, nil
+}
+
+/* Appends the ports more to the listening ports ports, which must remain
+ * distinct and, if there are several, fixed.
+ */
+func addListenPorts(ports, more []uint16) ([]uint16, error) {
+	for _, port := range more {
+		for _, existing := range ports {
+			if port == existing {
+				return nil, fmt.Errorf("port %d listened on twice", port)
+			}
+		}
+		ports = append(ports, port)
+	}
+	if len(ports) > MaxListenPorts {
+		return nil, fmt.Errorf("more than %d listening ports", MaxListenPorts)
+	}
+	if len(ports) > 1 {
+		for _, port := range ports {
+			if port == 0 {
+				return nil, errors.New("port 0 among several listening ports")
+			}
+		}
+	}
+	return ports, nil
+}
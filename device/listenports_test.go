@@ -0,0 +1,117 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+func TestParseListenPorts(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  []uint16
+	}{
+		{"51820", []uint16{51820}},
+		{"0", []uint16{0}},
+		{"51820-51823", []uint16{51820, 51821, 51822, 51823}},
+		{"51820-51820", []uint16{51820}},
+		{"51823-51820", nil},
+		{"1-65535", nil},
+		{"51820-", nil},
+		{"65536", nil},
+	} {
+		ports, err := parseListenPorts(test.value)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s parsed as %v", test.value, ports)
+			}
+		} else if err != nil || !reflect.DeepEqual(ports, test.want) {
+			t.Errorf("%s parsed as %v, %v, want %v", test.value, ports, err, test.want)
+		}
+	}
+
+	if _, err := addListenPorts([]uint16{51820}, []uint16{51821, 51820}); err == nil {
+		t.Error("port listened on twice")
+	}
+	if _, err := addListenPorts([]uint16{51820}, []uint16{0}); err == nil {
+		t.Error("port 0 among several")
+	}
+}
+
+func TestListenPorts(t *testing.T) {
+	dst, src := net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")
+	dev1, tun1, dev2, tun2 := newBindTestPair(t, bindtest.NewNetwork(1))
+	defer dev1.Close()
+	defer dev2.Close()
+	ping := func(from, to *tuntest.ChannelTUN, dst, src net.IP) {
+		t.Helper()
+		from.Outbound <- tuntest.Ping(dst, src)
+		select {
+		case <-to.Inbound:
+		case <-time.After(2 * time.Second):
+			t.Fatal("ping did not transit")
+		}
+	}
+
+	if err := ipcSet(dev1, "listen_port=53511\nlisten_port=53521-53522\n"); err != nil {
+		t.Fatal(err)
+	}
+	if get := ipcGet(t, dev1); !strings.Contains(get, "listen_port=53511\nlisten_port=53521\nlisten_port=53522\n") {
+		t.Errorf("ports missing from get:\n%s", get)
+	}
+	ping(tun2, tun1, dst, src)
+	ping(tun1, tun2, src, dst)
+
+	// the peer switches to another port mid-session, and is replied to from it
+
+	if err := ipcSet(dev2, "public_key=49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427\nendpoint=127.0.0.1:53522\n"); err != nil {
+		t.Fatal(err)
+	}
+	ping(tun2, tun1, dst, src)
+	ping(tun1, tun2, src, dst)
+	if get := ipcGet(t, dev2); !strings.Contains(get, "\nendpoint=127.0.0.1:53522\n") {
+		t.Errorf("reply not from the port switched to:\n%s", get)
+	}
+	if get := ipcGet(t, dev1); !strings.Contains(get, "\nlocal_endpoint=127.0.0.1:53522\n") {
+		t.Errorf("local_endpoint not the port switched to:\n%s", get)
+	}
+	if completed := dev2.Metrics().HandshakesCompleted; completed != 1 {
+		t.Errorf("%d handshakes completed, want the session kept", completed)
+	}
+
+	// back to a single port
+
+	if err := ipcSet(dev1, "listen_port=53511\n"); err != nil {
+		t.Fatal(err)
+	}
+	if get := ipcGet(t, dev1); strings.Contains(get, "listen_port=53521") {
+		t.Errorf("port still listened on:\n%s", get)
+	}
+	if err := ipcSet(dev1, "listen_port=53511\nlisten_port=0\n"); err == nil {
+		t.Error("port 0 among several set")
+	}
+
+	// a further port in use leaves no bind behind
+
+	dev1.net.Lock()
+	dev1.net.ports = []uint16{dev2.net.port}
+	dev1.net.Unlock()
+	if err := dev1.BindUpdate(); err == nil {
+		t.Fatal("port in use listened on")
+	}
+	dev1.net.RLock()
+	if dev1.net.bind != nil || dev1.net.port != 0 {
+		t.Errorf("bind kept on port %d", dev1.net.port)
+	}
+	dev1.net.RUnlock()
+}
@@ -6,12 +6,16 @@
 package device
 
 import (
-	"io"
-	"io/ioutil"
 	"log"
 	"os"
 )
 
+/* Log levels of the default Logger.
+ *
+ * There are only two kinds of messages, so LogLevelInfo and LogLevelDebug
+ * both enable verbose logging.
+ */
+
 const (
 	LogLevelSilent = iota
 	LogLevelError
@@ -19,41 +23,56 @@ const (
 	LogLevelDebug
 )
 
-type Logger struct {
-	Debug *log.Logger
-	Info  *log.Logger
-	Error *log.Logger
+// A Logger receives the log messages of a Device.
+//
+// Verbosef is used for informational and debug messages,
+// Errorf for errors. Implementations must be safe for concurrent use.
+type Logger interface {
+	Verbosef(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Silence is a Logger which discards everything.
+type Silence struct{}
+
+func (s Silence) Verbosef(format string, args ...interface{}) {}
+func (s Silence) Errorf(format string, args ...interface{})   {}
+
+type stdLogger struct {
+	verbose *log.Logger // nil if disabled
+	err     *log.Logger
 }
 
-func NewLogger(level int, prepend string) *Logger {
+func (l *stdLogger) Verbosef(format string, args ...interface{}) {
+	if l.verbose != nil {
+		l.verbose.Printf(format, args...)
+	}
+}
+
+func (l *stdLogger) Errorf(format string, args ...interface{}) {
+	l.err.Printf(format, args...)
+}
+
+// NewLogger returns a Logger writing to stdout using the standard
+// library's log package, discarding messages below level.
+func NewLogger(level int, prepend string) Logger {
 	output := os.Stdout
-	logger := new(Logger)
-
-	logErr, logInfo, logDebug := func() (io.Writer, io.Writer, io.Writer) {
-		if level >= LogLevelDebug {
-			return output, output, output
-		}
-		if level >= LogLevelInfo {
-			return output, output, ioutil.Discard
-		}
-		if level >= LogLevelError {
-			return output, ioutil.Discard, ioutil.Discard
-		}
-		return ioutil.Discard, ioutil.Discard, ioutil.Discard
-	}()
-
-	logger.Debug = log.New(logDebug,
-		"DEBUG: "+prepend,
-		log.Ldate|log.Ltime,
-	)
-
-	logger.Info = log.New(logInfo,
-		"INFO: "+prepend,
-		log.Ldate|log.Ltime,
-	)
-	logger.Error = log.New(logErr,
-		"ERROR: "+prepend,
-		log.Ldate|log.Ltime,
-	)
+
+	if level <= LogLevelSilent {
+		return Silence{}
+	}
+
+	logger := &stdLogger{
+		err: log.New(output,
+			"ERROR: "+prepend,
+			log.Ldate|log.Ltime,
+		),
+	}
+	if level >= LogLevelInfo {
+		logger.verbose = log.New(output,
+			"DEBUG: "+prepend,
+			log.Ldate|log.Ltime,
+		)
+	}
 	return logger
 }
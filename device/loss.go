@@ -0,0 +1,82 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"time"
+)
+
+/* The receive loss of a peer is estimated from the gaps in the counters
+ * of the transport messages it sends, which it increments with every
+ * message, as counted by the replay filter of each keypair: counters
+ * skipped over are taken as lost, unless they arrive late. The estimate
+ * is of the messages received over the last LossWindow, give or take
+ * half of it, and is only as good as the counters: it measures the
+ * direction from the peer alone, counts messages reordered further than
+ * the replay window, or dropped as replays, as lost, and misses losses
+ * at the end of a keypair, whose counters are never skipped over.
+ */
+
+type lossEstimate struct {
+	sync.Mutex
+	start    time.Time // of the current half of the window
+	received [2]uint64 // messages received in the current and the previous half
+	missing  [2]int64  // counters skipped over, less those arriving late, likewise
+}
+
+/* Moves the window on to now.
+ */
+func (loss *lossEstimate) rotate(now time.Time) {
+	elapsed := now.Sub(loss.start)
+	switch {
+	case elapsed < LossWindow/2:
+		return
+	case elapsed < LossWindow:
+		loss.received[1], loss.missing[1] = loss.received[0], loss.missing[0]
+	default:
+		loss.received[1], loss.missing[1] = 0, 0
+	}
+	loss.received[0], loss.missing[0] = 0, 0
+	loss.start = now
+}
+
+/* Counts a message received under keypair, once validated by its replay
+ * filter. It must only be called from the sequential receiver of the
+ * peer, which owns the replay filters.
+ */
+func (loss *lossEstimate) count(keypair *Keypair) {
+	missing := keypair.replayFilter.Missing()
+	skipped := int64(missing - keypair.lossCounted) // negative as messages arrive late
+	keypair.lossCounted = missing
+
+	loss.Lock()
+	defer loss.Unlock()
+	loss.rotate(time.Now())
+	loss.received[0]++
+	loss.missing[0] += skipped
+}
+
+/* Returns the estimated percentage of messages lost.
+ */
+func (loss *lossEstimate) percent(now time.Time) float64 {
+	loss.Lock()
+	defer loss.Unlock()
+	loss.rotate(now)
+	received := loss.received[0] + loss.received[1]
+	missing := loss.missing[0] + loss.missing[1]
+	if missing <= 0 {
+		return 0
+	}
+	return 100 * float64(missing) / float64(received+uint64(missing))
+}
+
+func (loss *lossEstimate) reset() {
+	loss.Lock()
+	defer loss.Unlock()
+	loss.received = [2]uint64{}
+	loss.missing = [2]int64{}
+}
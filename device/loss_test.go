@@ -0,0 +1,61 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLossEstimate(t *testing.T) {
+	var loss lossEstimate
+	keypair := new(Keypair)
+	keypair.replayFilter.Init()
+	receive := func(keypair *Keypair, counters ...uint64) {
+		for _, counter := range counters {
+			if keypair.replayFilter.ValidateCounter(counter, RejectAfterMessages) {
+				loss.count(keypair)
+			}
+		}
+	}
+	expect := func(want float64) {
+		t.Helper()
+		if got := loss.percent(time.Now()); got != want {
+			t.Errorf("loss of %v%%, want %v%%", got, want)
+		}
+	}
+
+	expect(0)
+	receive(keypair, 0, 1, 2, 3)
+	expect(0)
+
+	// 4 and 5 lost, 7 arriving late
+
+	receive(keypair, 6, 8, 9, 7)
+	expect(20)
+
+	// a new keypair starts its counters over
+
+	next := new(Keypair)
+	next.replayFilter.Init()
+	receive(next, 0, 1, 2, 3, 4, 5, 6, 7)
+	receive(keypair, 10)
+	expect(2.0 / 19 * 100)
+
+	// the window moves on, with half of it, then all of it
+
+	loss.start = loss.start.Add(-LossWindow / 2)
+	receive(next, 9)
+	expect(3.0 / 21 * 100)
+	loss.start = loss.start.Add(-LossWindow / 2)
+	expect(1.0 / 2 * 100)
+	loss.start = loss.start.Add(-LossWindow)
+	expect(0)
+
+	receive(next, 11)
+	loss.reset()
+	expect(0)
+}
@@ -0,0 +1,235 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/tailscale/wireguard-go/tun"
+)
+
+// HandshakeLatencyBounds are the upper bounds of the buckets of
+// HandshakeLatency, below the last bucket, which takes the rest.
+var HandshakeLatencyBounds = [...]time.Duration{
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// HandshakeLatency counts handshakes completed as initiator by the time
+// from their first initiation, retransmits included, to their completion.
+// Bucket i counts handshakes taking less than HandshakeLatencyBounds[i],
+// and not less than the bound before it.
+type HandshakeLatency [len(HandshakeLatencyBounds) + 1]uint64
+
+/* Counts a handshake taking d, without locking.
+ */
+func (h *HandshakeLatency) add(d time.Duration) {
+	i := 0
+	for i < len(HandshakeLatencyBounds) && d >= HandshakeLatencyBounds[i] {
+		i++
+	}
+	atomic.AddUint64(&h[i], 1)
+}
+
+func (h *HandshakeLatency) load() (counts HandshakeLatency) {
+	for i := range h {
+		counts[i] = atomic.LoadUint64(&h[i])
+	}
+	return counts
+}
+
+func (h *HandshakeLatency) reset() {
+	for i := range h {
+		atomic.StoreUint64(&h[i], 0)
+	}
+}
+
+// PeerMetrics is a point-in-time copy of the counters of a single peer.
+type PeerMetrics struct {
+	Name                string           // name of the peer, "" if it has none
+	HandshakeAttempts   uint64           // handshake initiations sent
+	HandshakesCompleted uint64           // handshakes completed, as initiator or responder
+	HandshakeLatency    HandshakeLatency // handshakes completed as initiator, by latency
+	RxBytes             uint64           // bytes received from peer
+	TxBytes             uint64           // bytes sent to peer
+	RxPackets           uint64           // packets received from peer
+	RxLoss              float64          // estimated percentage of messages from peer lost, over the last LossWindow
+	TxPackets           uint64           // packets sent to peer
+	KeypairAge          time.Duration    // age of the current keypair, zero if there is none
+	KeypairLocalIndex   uint32           // index the peer sends to under the current keypair
+	KeypairRemoteIndex  uint32           // index sent to the peer under the current keypair
+	KeypairMessages     uint64           // messages sent under the current keypair
+	RekeyImminent       bool             // the current keypair is older than RekeyAfterTime, or past the rekey message threshold
+	KeypairConfirmed    bool             // a transport message was received under the newest keypair
+	MTU                 int              // inner MTU of packets to the peer, lowered by path MTU discovery
+	PendingTimers       int              // number of armed peer timers
+	NonceQueue          QueueDepth       // packets awaiting a nonce, or a keypair
+	OutboundQueue       QueueDepth       // packets awaiting encryption or sending, in order
+	InboundQueue        QueueDepth       // packets awaiting decryption or delivery, in order
+}
+
+// DeviceMetrics is a point-in-time copy of the counters of a device,
+// suitable for exporting to a metrics system.
+type DeviceMetrics struct {
+	Time                 time.Time              // when the snapshot was taken
+	HandshakeAttempts    uint64                 // sum over all peers
+	HandshakesCompleted  uint64                 // sum over all peers
+	HandshakeLatency     HandshakeLatency       // sum over all peers
+	RxBytes              uint64                 // sum over all peers
+	TxBytes              uint64                 // sum over all peers
+	RxPackets            uint64                 // sum over all peers
+	TxPackets            uint64                 // sum over all peers
+	PendingTimers        int                    // sum over all peers
+	CookieRepliesSent    uint64                 // cookie replies sent under load
+	CookieRepliesLimited uint64                 // cookie replies withheld by the per-source rate limit
+	CookieRotations      uint64                 // cookie secrets replaced
+	InvalidMACs          uint64                 // handshake messages with an invalid mac1
+	HandshakesRejected   uint64                 // handshake messages refused under load
+	HandshakesGated      uint64                 // handshake messages which waited on the concurrency limit
+	RekeyAfterMessages   uint64                 // messages sent under a keypair before the peer is rekeyed
+	Drops                [DropReasons]uint64    // packets dropped, indexed by DropReason
+	Peers                map[string]PeerMetrics // keyed by base64 public key
+	EncryptionQueue      QueueDepth             // packets of all peers awaiting encryption
+	DecryptionQueue      QueueDepth             // packets of all peers awaiting decryption
+	HandshakeQueue       QueueDepth             // handshake messages awaiting processing
+	TUN                  *tun.Statistics        // counters of the TUN interface, nil if unavailable
+}
+
+// Metrics returns a snapshot of the device and per-peer counters.
+// The snapshot is taken under the peers lock, so the peer set is consistent.
+func (device *Device) Metrics() DeviceMetrics {
+	var tunStats *tun.Statistics
+	if statsDevice, ok := device.tun.device.(tun.StatisticsDevice); ok {
+		if stats, err := statsDevice.Statistics(); err == nil {
+			tunStats = &stats
+		}
+	}
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	now := time.Now()
+	metrics := DeviceMetrics{
+		Time:                 now,
+		CookieRepliesSent:    atomic.LoadUint64(&device.stats.cookieRepliesSent),
+		CookieRepliesLimited: atomic.LoadUint64(&device.stats.cookieRepliesLimited),
+		CookieRotations:      device.cookieChecker.Rotations(),
+		InvalidMACs:          atomic.LoadUint64(&device.stats.invalidMACs),
+		HandshakesRejected:   atomic.LoadUint64(&device.stats.rejectedUnderLoad),
+		HandshakesGated:      device.handshakeGate.limitedCount(),
+		RekeyAfterMessages:   device.rekeyAfterMessages(),
+		Drops:                device.dropCounts(),
+		Peers:                make(map[string]PeerMetrics, len(device.peers.keyMap)),
+		TUN:                  tunStats,
+	}
+	metrics.EncryptionQueue, metrics.DecryptionQueue, metrics.HandshakeQueue = device.queueDepths()
+
+	for key, peer := range device.peers.keyMap {
+		pm := peer.metrics(now)
+		metrics.HandshakeAttempts += pm.HandshakeAttempts
+		metrics.HandshakesCompleted += pm.HandshakesCompleted
+		for i, n := range pm.HandshakeLatency {
+			metrics.HandshakeLatency[i] += n
+		}
+		metrics.RxBytes += pm.RxBytes
+		metrics.TxBytes += pm.TxBytes
+		metrics.RxPackets += pm.RxPackets
+		metrics.TxPackets += pm.TxPackets
+		metrics.PendingTimers += pm.PendingTimers
+		metrics.Peers[key.Base64()] = pm
+	}
+
+	return metrics
+}
+
+/* Zeroes the counters of the device and of all its peers.
+ */
+func (device *Device) resetStats() {
+	atomic.StoreUint64(&device.stats.cookieRepliesSent, 0)
+	atomic.StoreUint64(&device.stats.cookieRepliesLimited, 0)
+	atomic.StoreUint64(&device.stats.invalidMACs, 0)
+	atomic.StoreUint64(&device.stats.rejectedUnderLoad, 0)
+	for i := range device.stats.dropped {
+		atomic.StoreUint64(&device.stats.dropped[i], 0)
+	}
+	device.cookieChecker.resetRotations()
+	device.handshakeGate.resetLimited()
+	device.queue.encryptionHigh.reset()
+	device.queue.decryptionHigh.reset()
+	device.queue.handshakeHigh.reset()
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.keyMap {
+		peer.resetStats()
+	}
+}
+
+/* Zeroes the transfer and handshake counters of the peer, leaving the
+ * times of its last handshake and transfers alone. Each counter is
+ * zeroed atomically, so an update racing with the reset either lands
+ * before it, and is discarded with the rest of the period, or after it,
+ * and counts towards the next. A concurrent reader may still see some
+ * counters reset and others not yet.
+ */
+func (peer *Peer) resetStats() {
+	atomic.StoreUint64(&peer.stats.txBytes, 0)
+	atomic.StoreUint64(&peer.stats.rxBytes, 0)
+	atomic.StoreUint64(&peer.stats.txPackets, 0)
+	atomic.StoreUint64(&peer.stats.rxPackets, 0)
+	atomic.StoreUint64(&peer.stats.handshakeAttempts, 0)
+	atomic.StoreUint64(&peer.stats.handshakesCompleted, 0)
+	peer.stats.handshakeLatency.reset()
+	peer.stats.rxLoss.reset()
+	peer.queue.nonceHigh.reset()
+	peer.queue.outboundHigh.reset()
+	peer.queue.inboundHigh.reset()
+}
+
+func (peer *Peer) metrics(now time.Time) PeerMetrics {
+	pm := PeerMetrics{
+		Name:                peer.Name(),
+		HandshakeAttempts:   atomic.LoadUint64(&peer.stats.handshakeAttempts),
+		HandshakesCompleted: atomic.LoadUint64(&peer.stats.handshakesCompleted),
+		HandshakeLatency:    peer.stats.handshakeLatency.load(),
+		RxBytes:             atomic.LoadUint64(&peer.stats.rxBytes),
+		TxBytes:             atomic.LoadUint64(&peer.stats.txBytes),
+		RxPackets:           atomic.LoadUint64(&peer.stats.rxPackets),
+		TxPackets:           atomic.LoadUint64(&peer.stats.txPackets),
+		RxLoss:              peer.stats.rxLoss.percent(now),
+		MTU:                 peer.mtu(),
+	}
+
+	if keypair := peer.keypairs.Current(); keypair != nil {
+		pm.KeypairAge = now.Sub(keypair.created)
+		pm.KeypairLocalIndex = keypair.localIndex
+		pm.KeypairRemoteIndex = keypair.remoteIndex
+		pm.KeypairMessages = atomic.LoadUint64(&keypair.sendNonce)
+		pm.RekeyImminent = pm.KeypairAge > RekeyAfterTime || pm.KeypairMessages > peer.device.rekeyAfterMessages()
+	}
+	_, pm.KeypairConfirmed = peer.keypairs.newestConfirmed()
+	pm.NonceQueue, pm.OutboundQueue, pm.InboundQueue = peer.queueDepths()
+
+	for _, timer := range []*Timer{
+		peer.timers.retransmitHandshake,
+		peer.timers.sendKeepalive,
+		peer.timers.newHandshake,
+		peer.timers.zeroKeyMaterial,
+		peer.timers.persistentKeepalive,
+		peer.timers.idle,
+		peer.timers.unreachable,
+		peer.timers.pathMTUProbe,
+	} {
+		if timer != nil && timer.IsPending() {
+			pm.PendingTimers++
+		}
+	}
+
+	return pm
+}
@@ -0,0 +1,108 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/* A network change, as reported by NetworkChanged, is handled as the
+ * kernel module handles route changes: the bind is recreated, so that
+ * datagrams leave from an address of the new network, cached source
+ * addresses are cleared, and peers with a session or waiting for one
+ * are sent a handshake at once, rather than when their timers next
+ * expire, so that the peers learn the new endpoint and NATs map it.
+ *
+ * Changes are debounced: the first is handled at once, and any reported
+ * within NetworkChangeDebounce of it are handled together at the end of
+ * that window. A change reported while the device is paused is handled
+ * when it resumes.
+ */
+
+// NetworkChanged tells the device that the network it is reached over has
+// changed, as when a mobile device moves from WiFi to cellular. It rebinds,
+// clears cached source addresses and initiates handshakes with the peers
+// which have a session. It may be called as often as changes are seen.
+func (device *Device) NetworkChanged() {
+	nc := &device.networkChange
+	nc.Lock()
+	if nc.timer != nil {
+		nc.again = true
+		nc.Unlock()
+		return
+	}
+	nc.timer = time.AfterFunc(NetworkChangeDebounce, device.networkChangeSettled)
+	nc.Unlock()
+
+	device.handleNetworkChange()
+}
+
+/* Called at the end of a debounce window, handling the changes reported
+ * within it, in a window of their own.
+ */
+func (device *Device) networkChangeSettled() {
+	nc := &device.networkChange
+	nc.Lock()
+	if !nc.again {
+		nc.timer = nil
+		nc.Unlock()
+		return
+	}
+	nc.again = false
+	nc.timer.Reset(NetworkChangeDebounce)
+	nc.Unlock()
+
+	device.handleNetworkChange()
+}
+
+func (device *Device) handleNetworkChange() {
+	device.state.Lock()
+	defer device.state.Unlock()
+
+	if device.isClosed.Get() || !device.state.current {
+		return
+	}
+	if device.isPaused.Get() {
+		device.networkChange.whilePaused.Set(true)
+		return
+	}
+	device.log.Verbosef("Network changed, rebinding")
+
+	if err := device.BindUpdate(); err != nil {
+		device.log.Errorf("Failed to rebind after network change: %v", err)
+	}
+	device.peers.RLock()
+	for _, peer := range device.peers.keyMap {
+		peer.Lock()
+		peer.clearSrc()
+		peer.Unlock()
+		peer.handshakeAfterNetworkChange()
+	}
+	device.peers.RUnlock()
+}
+
+/* Initiates a handshake with the peer if it has a session or is waiting
+ * for one, regardless of the rekey timeout, unless one was just sent.
+ */
+func (peer *Peer) handshakeAfterNetworkChange() {
+	if !peer.timersActive() {
+		return
+	}
+	if peer.keypairs.Current() == nil && !peer.queue.packetInNonceQueueIsAwaitingKey.Get() && !peer.timers.retransmitHandshake.IsPending() {
+		return
+	}
+
+	peer.handshake.mutex.RLock()
+	recent := time.Since(peer.handshake.lastSentHandshake) < HandshakeInitationRate
+	peer.handshake.mutex.RUnlock()
+	if recent {
+		return
+	}
+
+	atomic.StoreUint32(&peer.timers.handshakeAttempts, 0)
+	peer.SendHandshakeInitiation(true)
+}
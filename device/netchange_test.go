@@ -0,0 +1,104 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+func TestNetworkChanged(t *testing.T) {
+	network := bindtest.NewNetwork(1)
+	tun1 := tuntest.NewChannelTUN()
+	dev1 := NewDevice(tun1.TUN(), &DeviceOptions{
+		Logger:         NewLogger(LogLevelError, "dev1: "),
+		CreateBind:     network.CreateBind,
+		CreateEndpoint: network.CreateEndpoint,
+	})
+	defer dev1.Close()
+	dev1.Up()
+	if err := ipcSet(dev1, cfg1); err != nil {
+		t.Fatal(err)
+	}
+
+	var binds int32
+	tun2 := tuntest.NewChannelTUN()
+	dev2 := NewDevice(tun2.TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev2: "),
+		CreateBind: func(port uint16) (conn.Bind, uint16, error) {
+			atomic.AddInt32(&binds, 1)
+			return network.CreateBind(port)
+		},
+		CreateEndpoint: network.CreateEndpoint,
+	})
+	defer dev2.Close()
+	dev2.Up()
+	if err := ipcSet(dev2, cfg2); err != nil {
+		t.Fatal(err)
+	}
+
+	ping := func() {
+		t.Helper()
+		tun2.Outbound <- tuntest.Ping(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"))
+		select {
+		case <-tun1.Inbound:
+		case <-time.After(2 * time.Second):
+			t.Fatal("ping did not transit")
+		}
+	}
+	ping()
+	time.Sleep(2 * HandshakeInitationRate) // closer initiations are taken for a flood
+
+	// the first change is handled at once
+
+	bound, attempts := atomic.LoadInt32(&binds), dev2.Metrics().HandshakeAttempts
+	dev2.NetworkChanged()
+	if n := atomic.LoadInt32(&binds); n != bound+1 {
+		t.Fatalf("%d binds, want %d", n, bound+1)
+	}
+	if n := dev2.Metrics().HandshakeAttempts; n != attempts+1 {
+		t.Errorf("%d handshake attempts, want %d", n, attempts+1)
+	}
+	ping()
+
+	// changes within the debounce window are handled together at its end
+
+	time.Sleep(NetworkChangeDebounce * 2)
+	bound = atomic.LoadInt32(&binds)
+	for i := 0; i < 5; i++ {
+		dev2.NetworkChanged()
+	}
+	if n := atomic.LoadInt32(&binds); n != bound+1 {
+		t.Errorf("%d binds within the window, want %d", n, bound+1)
+	}
+	time.Sleep(NetworkChangeDebounce * 3)
+	if n := atomic.LoadInt32(&binds); n != bound+2 {
+		t.Errorf("%d binds after the window, want %d", n, bound+2)
+	}
+	ping()
+
+	// a change while paused is handled on resume
+
+	dev2.Pause()
+	bound, attempts = atomic.LoadInt32(&binds), dev2.Metrics().HandshakeAttempts
+	dev2.NetworkChanged()
+	if n := atomic.LoadInt32(&binds); n != bound {
+		t.Errorf("%d binds while paused, want %d", n, bound)
+	}
+	if err := dev2.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if n := dev2.Metrics().HandshakeAttempts; n != attempts+1 {
+		t.Errorf("%d handshake attempts on resume, want %d", n, attempts+1)
+	}
+	ping()
+}
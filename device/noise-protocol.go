@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tailscale/wireguard-go/device/tokenbucket"
@@ -54,20 +55,43 @@ const (
 )
 
 const (
-	MessageInitiationType  = 1
-	MessageResponseType    = 2
-	MessageCookieReplyType = 3
-	MessageTransportType   = 4
+	MessageInitiationType       = 1
+	MessageResponseType         = 2
+	MessageCookieReplyType      = 3
+	MessageTransportType        = 4
+	MessageHybridInitiationType = 5
+	MessageHybridResponseType   = 6
 )
 
 const (
-	MessageInitiationSize      = 148                                           // size of handshake initiation message
-	MessageResponseSize        = 92                                            // size of response message
-	MessageCookieReplySize     = 64                                            // size of cookie reply message
-	MessageTransportHeaderSize = 16                                            // size of data preceding content in transport message
-	MessageTransportSize       = MessageTransportHeaderSize + poly1305.TagSize // size of empty transport
-	MessageKeepaliveSize       = MessageTransportSize                          // size of keepalive
-	MessageHandshakeSize       = MessageInitiationSize                         // size of largest handshake related message
+	KEMPublicKeySize  = 1184 // size of an ML-KEM-768 encapsulation key
+	KEMCiphertextSize = 1088 // size of an ML-KEM-768 ciphertext
+
+	MessageFlagPostQuantum = 1 << 9 // in the type of handshake messages: hybrid handshakes are taken
+)
+
+/* A preshared key is rotated by setting next_preshared_key on both peers,
+ * in either order. Initiators advertise holding a next key with
+ * MessageFlagNextPresharedKey, and responders answer with theirs only
+ * then, the initiator trying both of its keys on the response, so no
+ * handshake is lost while only one side holds the next key. The first
+ * handshake under the next key ends the rotation on both sides.
+ */
+
+const (
+	MessageFlagNextPresharedKey = 1 << 10 // in the type of initiations: the initiator holds a next preshared key
+)
+
+const (
+	MessageInitiationSize       = 148                                           // size of handshake initiation message
+	MessageResponseSize         = 92                                            // size of response message
+	MessageCookieReplySize      = 64                                            // size of cookie reply message
+	MessageTransportHeaderSize  = 16                                            // size of data preceding content in transport message
+	MessageTransportSize        = MessageTransportHeaderSize + poly1305.TagSize // size of empty transport
+	MessageKeepaliveSize        = MessageTransportSize                          // size of keepalive
+	MessageHybridInitiationSize = MessageInitiationSize + KEMPublicKeySize      // size of hybrid handshake initiation message
+	MessageHybridResponseSize   = MessageResponseSize + KEMCiphertextSize       // size of hybrid response message
+	MessageHandshakeSize        = MessageHybridInitiationSize                   // size of largest handshake related message
 )
 
 const (
@@ -102,6 +126,46 @@ type MessageResponse struct {
 	MAC2      [blake2s.Size128]byte
 }
 
+/* The hybrid handshake messages extend the classic ones by an ephemeral
+ * ML-KEM encapsulation key and the ciphertext encapsulated to it. Both are
+ * mixed into the transcript hash, the key before the static key and the
+ * timestamp are encrypted so that it is authenticated along with them, and
+ * the encapsulated secret into the chaining key, so the session keys stay
+ * secret as long as either the X25519 or the ML-KEM exchange is unbroken.
+ *
+ * Devices with post_quantum=true advertise that they take hybrid
+ * handshakes with MessageFlagPostQuantum in the type of their initiations,
+ * and of their responses to initiations advertising it. Peers which
+ * advertised it are sent hybrid initiations from then on, others classic
+ * ones, as are peers whose hybrid initiation went unanswered. Like those
+ * advertising AES-GCM, an initiation advertising hybrid handshakes which
+ * goes unanswered is retried without the flag, for classic implementations
+ * drop it. Peers set post_quantum=true are always sent hybrid initiations,
+ * and classic ones of them are refused.
+ */
+
+type MessageHybridInitiation struct {
+	Type      uint32
+	Sender    uint32
+	Ephemeral wgcfg.Key
+	Static    [wgcfg.KeySize + poly1305.TagSize]byte
+	Timestamp [tai64n.TimestampSize + poly1305.TagSize]byte
+	KEM       [KEMPublicKeySize]byte
+	MAC1      [blake2s.Size128]byte
+	MAC2      [blake2s.Size128]byte
+}
+
+type MessageHybridResponse struct {
+	Type      uint32
+	Sender    uint32
+	Receiver  uint32
+	Ephemeral wgcfg.Key
+	KEM       [KEMCiphertextSize]byte
+	Empty     [poly1305.TagSize]byte
+	MAC1      [blake2s.Size128]byte
+	MAC2      [blake2s.Size128]byte
+}
+
 type MessageTransport struct {
 	Type     uint32
 	Receiver uint32
@@ -122,6 +186,11 @@ type Handshake struct {
 	hash                      [blake2s.Size]byte  // hash value
 	chainKey                  [blake2s.Size]byte  // chain key
 	presharedKey              wgcfg.SymmetricKey  // psk
+	nextPresharedKey          wgcfg.SymmetricKey  // psk being rotated in (zero = none)
+	usedNextPresharedKey      bool                // the response was authenticated under nextPresharedKey
+	nextPresharedKeyOffered   bool                // the initiation created advertised nextPresharedKey
+	nextPresharedKeyRefused   bool                // an initiation advertising nextPresharedKey went unanswered
+	remoteNextPresharedKey    bool                // the initiation consumed advertised a next preshared key
 	localEphemeral            wgcfg.PrivateKey    // ephemeral secret key
 	localIndex                uint32              // used to clear hash-table
 	remoteIndex               uint32              // index for sending
@@ -132,6 +201,24 @@ type Handshake struct {
 	initiationLimit           tokenbucket.TokenBucket
 	lastInitiationConsumption time.Time
 	lastSentHandshake         time.Time
+	postQuantum               bool          // the peer takes hybrid handshakes, refuse classic ones
+	postQuantumAdvertised     bool          // the initiation created advertised hybrid handshakes
+	postQuantumRefused        bool          // an initiation advertising hybrid handshakes went unanswered
+	remotePostQuantum         bool          // the peer advertised hybrid handshakes in its last handshake message
+	postQuantumUnanswered     int           // hybrid initiations unanswered in a row
+	postQuantumCompleted      bool          // a hybrid handshake completed with the peer, so never fall back
+	localKEM                  kemPrivateKey // ephemeral KEM key of a hybrid initiation
+	remoteKEM                 []byte        // KEM public key of a consumed hybrid initiation
+	hybrid                    bool          // a KEM secret was mixed into the chaining key
+	aesGCMAdvertised          bool          // the initiation created advertised AES-GCM
+	aesGCMRefused             bool          // an initiation advertising AES-GCM went unanswered, see aesgcm.go
+	remoteAESGCM              bool          // the initiation consumed advertised AES-GCM
+	aesGCM                    bool          // AES-GCM transport keys were agreed on
+}
+
+type kemPrivateKey interface {
+	PublicKey() []byte
+	Decapsulate(ciphertext []byte) (secret []byte, err error)
 }
 
 var (
@@ -152,11 +239,28 @@ func mixHash(dst *[blake2s.Size]byte, h *[blake2s.Size]byte, data []byte) {
 	hash.Reset()
 }
 
+/* Mixes the KEM ciphertext into the hash and the secret
+ * encapsulated in it into the chaining key.
+ */
+func mixKEM(hash *[blake2s.Size]byte, chainKey *[blake2s.Size]byte, ciphertext []byte, secret []byte) {
+	mixHash(hash, hash, ciphertext)
+	mixKey(chainKey, chainKey, secret)
+}
+
 func (h *Handshake) Clear() {
 	setZero(h.localEphemeral[:])
 	setZero(h.remoteEphemeral[:])
 	setZero(h.chainKey[:])
 	setZero(h.hash[:])
+	h.localKEM = nil
+	h.remoteKEM = nil
+	h.hybrid = false
+	h.postQuantumAdvertised = false
+	h.aesGCMAdvertised = false
+	h.remoteAESGCM = false
+	h.nextPresharedKeyOffered = false
+	h.remoteNextPresharedKey = false
+	h.aesGCM = false
 	h.localIndex = 0
 	h.state = HandshakeZeroed
 }
@@ -177,6 +281,27 @@ func init() {
 }
 
 func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, error) {
+	return device.createMessageInitiation(peer, nil)
+}
+
+func (device *Device) CreateMessageHybridInitiation(peer *Peer) (*MessageHybridInitiation, error) {
+	var msg MessageHybridInitiation
+	initiation, err := device.createMessageInitiation(peer, msg.KEM[:])
+	if err != nil {
+		return nil, err
+	}
+	msg.Type = MessageHybridInitiationType | initiation.Type&messageFlags
+	msg.Sender = initiation.Sender
+	msg.Ephemeral = initiation.Ephemeral
+	msg.Static = initiation.Static
+	msg.Timestamp = initiation.Timestamp
+	return &msg, nil
+}
+
+/* Creates an initiation, a hybrid one if kemPublicKey is not nil,
+ * which is then filled with the KEM public key.
+ */
+func (device *Device) createMessageInitiation(peer *Peer, kemPublicKey []byte) (*MessageInitiation, error) {
 
 	device.staticIdentity.RLock()
 	defer device.staticIdentity.RUnlock()
@@ -215,10 +340,35 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 		Ephemeral: handshake.localEphemeral.Public(),
 		Sender:    handshake.localIndex,
 	}
+	handshake.aesGCMAdvertised = device.aesGCM.Get() && aesGCMSupported && !handshake.aesGCMRefused
+	if handshake.aesGCMAdvertised {
+		msg.Type |= MessageFlagAESGCM
+	}
+	handshake.postQuantumAdvertised = kemPublicKey != nil || device.postQuantum.Get() && kemSupported && !handshake.postQuantumRefused
+	if handshake.postQuantumAdvertised {
+		msg.Type |= MessageFlagPostQuantum
+	}
+	handshake.nextPresharedKeyOffered = !handshake.nextPresharedKey.IsZero() && !handshake.nextPresharedKeyRefused
+	if handshake.nextPresharedKeyOffered {
+		msg.Type |= MessageFlagNextPresharedKey
+	}
 
 	handshake.mixKey(msg.Ephemeral[:])
 	handshake.mixHash(msg.Ephemeral[:])
 
+	// add ephemeral KEM key
+
+	handshake.localKEM = nil
+	if kemPublicKey != nil {
+		key, err := newKEMPrivateKey()
+		if err != nil {
+			return nil, err
+		}
+		copy(kemPublicKey, key.PublicKey())
+		handshake.mixHash(kemPublicKey)
+		handshake.localKEM = key
+	}
+
 	// encrypt static key
 
 	func() {
@@ -251,18 +401,40 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 	}()
 
 	handshake.mixHash(msg.Timestamp[:])
+	mixFlags(&handshake.hash, msg.Type)
+
 	handshake.state = HandshakeInitiationCreated
 	return &msg, nil
 }
 
 func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
+	return device.consumeMessageInitiation(msg, nil)
+}
+
+func (device *Device) ConsumeMessageHybridInitiation(msg *MessageHybridInitiation) *Peer {
+	if msg.Type&^messageFlags != MessageHybridInitiationType {
+		device.log.Verbosef("ConsumeMessageHybridInitiation: not a hybrid initiation message")
+		return nil
+	}
+	return device.consumeMessageInitiation(&MessageInitiation{
+		Type:      MessageInitiationType | msg.Type&messageFlags,
+		Sender:    msg.Sender,
+		Ephemeral: msg.Ephemeral,
+		Static:    msg.Static,
+		Timestamp: msg.Timestamp,
+	}, msg.KEM[:])
+}
+
+/* Consumes an initiation, a hybrid one if kemPublicKey is not nil.
+ */
+func (device *Device) consumeMessageInitiation(msg *MessageInitiation, kemPublicKey []byte) *Peer {
 	var (
 		hash     [blake2s.Size]byte
 		chainKey [blake2s.Size]byte
 	)
 
-	if msg.Type != MessageInitiationType {
-		device.log.Debug.Printf("ConsumeMessageInitiation: not an initiation message")
+	if msg.Type&^messageFlags != MessageInitiationType {
+		device.log.Verbosef("ConsumeMessageInitiation: not an initiation message")
 		return nil
 	}
 
@@ -272,6 +444,9 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	mixHash(&hash, &InitialHash, device.staticIdentity.publicKey[:])
 	mixHash(&hash, &hash, msg.Ephemeral[:])
 	mixKey(&chainKey, &InitialChainKey, msg.Ephemeral[:])
+	if kemPublicKey != nil {
+		mixHash(&hash, &hash, kemPublicKey)
+	}
 
 	// decrypt static key
 
@@ -294,13 +469,13 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	peer := device.LookupPeer(peerPK)
 	if peer == nil {
 		k := wgcfg.Key(peerPK)
-		device.log.Debug.Printf("ConsumeMessageInitiation: could not find peer by public key: %s", k.ShortString())
+		device.log.Verbosef("ConsumeMessageInitiation: could not find peer by public key: %s", k.ShortString())
 		return nil
 	}
 
 	handshake := &peer.handshake
 	if isZero(handshake.precomputedStaticStatic[:]) {
-		device.log.Debug.Printf("ConsumeMessageInitiation: zero precomputed static")
+		device.log.Verbosef("ConsumeMessageInitiation: zero precomputed static")
 		return nil
 	}
 
@@ -320,23 +495,29 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	_, err = aead.Open(timestamp[:0], ZeroNonce[:], msg.Timestamp[:], hash[:])
 	if err != nil {
 		handshake.mutex.RUnlock()
-		device.log.Debug.Printf("ConsumeMessageInitiation: handshake decrypt failed")
+		device.log.Verbosef("ConsumeMessageInitiation: handshake decrypt failed")
 		return nil
 	}
 	mixHash(&hash, &hash, msg.Timestamp[:])
+	mixFlags(&hash, msg.Type)
 
-	// protect against replay & flood
+	// protect against replay & flood, and downgrades of hybrid peers
 
 	replay := !timestamp.After(handshake.lastTimestamp)
 	now := time.Now()
 	flood := !handshake.initiationLimit.CanTake(now)
+	downgrade := kemPublicKey == nil && handshake.postQuantum && device.postQuantum.Get()
 	handshake.mutex.RUnlock()
+	if downgrade {
+		device.log.Verbosef("%v - ConsumeMessageInitiation: classic handshake refused, peer is post-quantum\n", peer)
+		return nil
+	}
 	if replay {
-		device.log.Debug.Printf("%v - ConsumeMessageInitiation: handshake replay @ %v\n", peer, timestamp)
+		device.log.Verbosef("%v - ConsumeMessageInitiation: handshake replay @ %v\n", peer, timestamp)
 		return nil
 	}
 	if flood {
-		device.log.Debug.Printf("%v - ConsumeMessageInitiation: handshake flood\n", peer)
+		device.log.Verbosef("%v - ConsumeMessageInitiation: handshake flood\n", peer)
 		return nil
 	}
 
@@ -353,9 +534,26 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 			handshake.lastTimestamp = timestamp
 		}
 		handshake.initiationLimit.Take(now)
+		handshake.localKEM = nil
+		handshake.remoteKEM = nil
+		if kemPublicKey != nil {
+			handshake.remoteKEM = append([]byte(nil), kemPublicKey...)
+		}
+		handshake.remoteAESGCM = msg.Type&MessageFlagAESGCM != 0
+		if handshake.remoteAESGCM {
+			handshake.aesGCMRefused = false
+		}
+		handshake.remotePostQuantum = kemPublicKey != nil || msg.Type&MessageFlagPostQuantum != 0
+		if handshake.remotePostQuantum {
+			handshake.postQuantumRefused = false
+		}
+		handshake.remoteNextPresharedKey = msg.Type&MessageFlagNextPresharedKey != 0
+		if handshake.remoteNextPresharedKey {
+			handshake.nextPresharedKeyRefused = false
+		}
 		handshake.state = HandshakeInitiationConsumed
 	} else {
-		device.log.Debug.Printf("%v - race: remote initiation IGNORED.\n", peer)
+		device.log.Verbosef("%v - race: remote initiation IGNORED.\n", peer)
 	}
 
 	handshake.mutex.Unlock()
@@ -367,6 +565,27 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 }
 
 func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error) {
+	return device.createMessageResponse(peer, nil)
+}
+
+func (device *Device) CreateMessageHybridResponse(peer *Peer) (*MessageHybridResponse, error) {
+	var msg MessageHybridResponse
+	response, err := device.createMessageResponse(peer, msg.KEM[:])
+	if err != nil {
+		return nil, err
+	}
+	msg.Type = MessageHybridResponseType | response.Type&messageFlags
+	msg.Sender = response.Sender
+	msg.Receiver = response.Receiver
+	msg.Ephemeral = response.Ephemeral
+	msg.Empty = response.Empty
+	return &msg, nil
+}
+
+/* Creates a response, a hybrid one if kemCiphertext is not nil, which is
+ * then filled with the ciphertext. It must match the consumed initiation.
+ */
+func (device *Device) createMessageResponse(peer *Peer, kemCiphertext []byte) (*MessageResponse, error) {
 	handshake := &peer.handshake
 	handshake.mutex.Lock()
 	defer handshake.mutex.Unlock()
@@ -374,6 +593,19 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 	if handshake.state != HandshakeInitiationConsumed {
 		return nil, errors.New("handshake initiation must be consumed first")
 	}
+	if (kemCiphertext != nil) != (handshake.remoteKEM != nil) {
+		return nil, errors.New("response must be hybrid exactly if the initiation was")
+	}
+
+	// during a rotation, answer with the next psk if the initiator holds
+	// one too, as it tries both, and with the current one otherwise
+
+	presharedKey := handshake.presharedKey
+	handshake.usedNextPresharedKey = false
+	if !handshake.nextPresharedKey.IsZero() && handshake.remoteNextPresharedKey {
+		presharedKey = handshake.nextPresharedKey
+		handshake.usedNextPresharedKey = true
+	}
 
 	// assign index
 
@@ -387,6 +619,13 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 	var msg MessageResponse
 	msg.Type = MessageResponseType
 	msg.Sender = handshake.localIndex
+	handshake.aesGCM = handshake.remoteAESGCM && device.aesGCM.Get() && aesGCMSupported
+	if handshake.aesGCM {
+		msg.Type |= MessageFlagAESGCM
+	}
+	if handshake.remotePostQuantum && device.postQuantum.Get() && kemSupported {
+		msg.Type |= MessageFlagPostQuantum
+	}
 	msg.Receiver = handshake.remoteIndex
 
 	// create ephemeral key
@@ -406,6 +645,21 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 		handshake.mixKey(ss[:])
 	}()
 
+	// encapsulate to the initiator's KEM key
+
+	if kemCiphertext != nil {
+		secret, ciphertext, err := kemEncapsulate(handshake.remoteKEM)
+		if err != nil {
+			return nil, err
+		}
+		copy(kemCiphertext, ciphertext)
+		mixKEM(&handshake.hash, &handshake.chainKey, kemCiphertext, secret)
+		setZero(secret)
+		handshake.remoteKEM = nil
+	}
+	handshake.hybrid = kemCiphertext != nil
+	mixFlags(&handshake.hash, msg.Type)
+
 	// add preshared key
 
 	var tau [blake2s.Size]byte
@@ -416,7 +670,7 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 		&tau,
 		&key,
 		handshake.chainKey[:],
-		handshake.presharedKey[:],
+		presharedKey[:],
 	)
 
 	handshake.mixHash(tau[:])
@@ -433,9 +687,29 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 }
 
 func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
-	if msg.Type != MessageResponseType {
+	if msg.Type&^messageFlags != MessageResponseType {
 		return nil
 	}
+	return device.consumeMessageResponse(msg, nil)
+}
+
+func (device *Device) ConsumeMessageHybridResponse(msg *MessageHybridResponse) *Peer {
+	if msg.Type&^messageFlags != MessageHybridResponseType {
+		return nil
+	}
+	return device.consumeMessageResponse(&MessageResponse{
+		Type:      MessageResponseType | msg.Type&messageFlags,
+		Sender:    msg.Sender,
+		Receiver:  msg.Receiver,
+		Ephemeral: msg.Ephemeral,
+		Empty:     msg.Empty,
+	}, msg.KEM[:])
+}
+
+/* Consumes a response, a hybrid one if kemCiphertext is not nil.
+ * It must match the initiation created.
+ */
+func (device *Device) consumeMessageResponse(msg *MessageResponse, kemCiphertext []byte) *Peer {
 
 	// lookup handshake by receiver
 
@@ -448,6 +722,7 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 	var (
 		hash     [blake2s.Size]byte
 		chainKey [blake2s.Size]byte
+		usedNext bool
 	)
 
 	ok := func() bool {
@@ -460,6 +735,15 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 		if handshake.state != HandshakeInitiationCreated {
 			return false
 		}
+		if (kemCiphertext != nil) != (handshake.localKEM != nil) {
+			return false
+		}
+		if msg.Type&MessageFlagAESGCM != 0 && !handshake.aesGCMAdvertised {
+			return false
+		}
+		if msg.Type&MessageFlagPostQuantum != 0 && !handshake.postQuantumAdvertised {
+			return false
+		}
 
 		// lock private key for reading
 
@@ -483,28 +767,52 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 			setZero(ss[:])
 		}()
 
-		// add preshared key (psk)
+		// decapsulate the KEM secret
 
-		var tau [blake2s.Size]byte
-		var key [chacha20poly1305.KeySize]byte
-		KDF3(
-			&chainKey,
-			&tau,
-			&key,
-			chainKey[:],
-			handshake.presharedKey[:],
-		)
-		mixHash(&hash, &hash, tau[:])
+		if kemCiphertext != nil {
+			secret, err := handshake.localKEM.Decapsulate(kemCiphertext)
+			if err != nil {
+				return false
+			}
+			mixKEM(&hash, &chainKey, kemCiphertext, secret)
+			setZero(secret)
+		}
+		mixFlags(&hash, msg.Type)
 
-		// authenticate transcript
+		// add preshared key (psk), trying the next one first during a rotation
 
-		aead, _ := chacha20poly1305.New(key[:])
-		_, err := aead.Open(nil, ZeroNonce[:], msg.Empty[:], hash[:])
-		if err != nil {
-			return false
+		presharedKeys := []wgcfg.SymmetricKey{handshake.presharedKey}
+		if !handshake.nextPresharedKey.IsZero() {
+			presharedKeys = []wgcfg.SymmetricKey{handshake.nextPresharedKey, handshake.presharedKey}
+		}
+
+		for i, presharedKey := range presharedKeys {
+			var tau [blake2s.Size]byte
+			var key [chacha20poly1305.KeySize]byte
+			var pskHash [blake2s.Size]byte
+			var pskChainKey [blake2s.Size]byte
+			KDF3(
+				&pskChainKey,
+				&tau,
+				&key,
+				chainKey[:],
+				presharedKey[:],
+			)
+			mixHash(&pskHash, &hash, tau[:])
+
+			// authenticate transcript
+
+			aead, _ := chacha20poly1305.New(key[:])
+			_, err := aead.Open(nil, ZeroNonce[:], msg.Empty[:], pskHash[:])
+			if err != nil {
+				continue
+			}
+			mixHash(&hash, &pskHash, msg.Empty[:])
+			chainKey = pskChainKey
+			usedNext = len(presharedKeys) > 1 && i == 0
+			return true
 		}
-		mixHash(&hash, &hash, msg.Empty[:])
-		return true
+		return false
 	}()
 
 	if !ok {
@@ -518,7 +826,15 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 	handshake.hash = hash
 	handshake.chainKey = chainKey
 	handshake.remoteIndex = msg.Sender
+	handshake.usedNextPresharedKey = usedNext
 	handshake.state = HandshakeResponseConsumed
+	handshake.hybrid = handshake.localKEM != nil
+	handshake.localKEM = nil
+	handshake.aesGCM = msg.Type&MessageFlagAESGCM != 0
+	handshake.remotePostQuantum = handshake.hybrid || msg.Type&MessageFlagPostQuantum != 0
+	if handshake.remotePostQuantum {
+		handshake.postQuantumRefused = false
+	}
 
 	handshake.mutex.Unlock()
 
@@ -573,19 +889,34 @@ func (peer *Peer) BeginSymmetricSession() error {
 	// create AEAD instances
 
 	keypair := new(Keypair)
-	keypair.send, _ = chacha20poly1305.New(sendKey[:])
-	keypair.receive, _ = chacha20poly1305.New(recvKey[:])
+	keypair.send = newTransportAEAD(&sendKey, handshake.aesGCM)
+	keypair.receive = newTransportAEAD(&recvKey, handshake.aesGCM)
+	keypair.aesGCM = handshake.aesGCM
+	handshake.aesGCM = false
 
 	setZero(sendKey[:])
 	setZero(recvKey[:])
 
 	keypair.created = time.Now()
 	keypair.sendNonce = 0
-	keypair.replayFilter.Init()
+	keypair.replayFilter.InitWindow(uint64(atomic.LoadUint32(&device.replayWindow)))
 	keypair.isInitiator = isInitiator
+	keypair.nextPresharedKey = handshake.usedNextPresharedKey
+	keypair.hybrid = handshake.hybrid
+	if handshake.hybrid {
+		handshake.postQuantumCompleted = true
+	}
+	handshake.hybrid = false
+	handshake.postQuantumUnanswered = 0
 	keypair.localIndex = peer.handshake.localIndex
 	keypair.remoteIndex = peer.handshake.remoteIndex
 
+	// the responder proved to hold the next psk, so the rotation is done
+
+	if isInitiator && handshake.usedNextPresharedKey {
+		handshake.promoteNextPresharedKey()
+	}
+
 	// remap index
 
 	device.indexTable.SwapIndexForKeypair(handshake.localIndex, keypair)
@@ -621,6 +952,18 @@ func (peer *Peer) BeginSymmetricSession() error {
 	return nil
 }
 
+/* Replaces the preshared key by the next one, ending a rotation.
+ * The handshake mutex must be held.
+ */
+func (handshake *Handshake) promoteNextPresharedKey() {
+	if handshake.nextPresharedKey.IsZero() {
+		return
+	}
+	handshake.presharedKey = handshake.nextPresharedKey
+	setZero(handshake.nextPresharedKey[:])
+	handshake.usedNextPresharedKey = false
+}
+
 func (peer *Peer) ReceivedWithKeypair(receivedKeypair *Keypair) bool {
 	keypairs := &peer.keypairs
 	keypairs.Lock()
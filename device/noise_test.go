@@ -8,7 +8,12 @@ package device
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"testing"
+
+	"github.com/tailscale/wireguard-go/tai64n"
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"golang.org/x/crypto/blake2s"
 )
 
 func TestNoiseHandshake(t *testing.T) {
@@ -130,3 +135,215 @@ func TestNoiseHandshake(t *testing.T) {
 		assertEqual(t, out, testMsg)
 	}()
 }
+
+func TestPresharedKeyRotation(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer1, err := dev2.NewPeer(dev1.staticIdentity.privateKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer2, err := dev1.NewPeer(dev2.staticIdentity.privateKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var current, next wgcfg.SymmetricKey
+	current[0], next[0] = 1, 2
+	peer1.handshake.presharedKey = current
+	peer2.handshake.presharedKey = current
+
+	// dev1 initiates to dev2, which answers, returns whether dev1 accepted
+
+	handshake := func() bool {
+		t.Helper()
+		peer1.handshake.lastTimestamp = tai64n.Timestamp{}
+		msg1, err := dev1.CreateMessageInitiation(peer2)
+		assertNil(t, err)
+		if dev2.ConsumeMessageInitiation(msg1) == nil {
+			t.Fatal("handshake failed at initiation message")
+		}
+		msg2, err := dev2.CreateMessageResponse(peer1)
+		assertNil(t, err)
+		assertNil(t, peer1.BeginSymmetricSession())
+		if dev1.ConsumeMessageResponse(msg2) == nil {
+			return false
+		}
+		assertNil(t, peer2.BeginSymmetricSession())
+		return true
+	}
+
+	// only the responder knows the next key: the initiator does not
+	// advertise one, so it answers with the current key
+
+	peer1.handshake.nextPresharedKey = next
+	for i := 0; i < 2; i++ {
+		if !handshake() {
+			t.Fatal("responder did not answer with the current psk")
+		}
+		if peer1.keypairs.next.nextPresharedKey || peer2.keypairs.current.nextPresharedKey {
+			t.Fatal("handshake marked as using the next psk")
+		}
+		peer1.ReceivedWithKeypair(peer1.keypairs.next)
+	}
+
+	// the initiator advertises a next key other than that of the
+	// responder: the response fails, and once the initiation went
+	// unanswered, it is no longer advertised
+
+	var other wgcfg.SymmetricKey
+	other[0] = 3
+	peer2.handshake.nextPresharedKey = other
+	if handshake() {
+		t.Fatal("initiator accepted a response under an unknown psk")
+	}
+	peer2.handshake.nextPresharedKeyRefused = true
+	if !handshake() {
+		t.Fatal("responder did not fall back to the current psk")
+	}
+	peer1.ReceivedWithKeypair(peer1.keypairs.next)
+
+	// both know the next key: the handshake uses it and the initiator
+	// promotes it at once
+
+	peer2.handshake.nextPresharedKey = next
+	peer2.handshake.nextPresharedKeyRefused = false
+	if !handshake() {
+		t.Fatal("handshake under the next psk failed")
+	}
+	if !peer1.keypairs.next.nextPresharedKey {
+		t.Fatal("responder keypair not marked as using the next psk")
+	}
+	if peer2.handshake.presharedKey != next || !peer2.handshake.nextPresharedKey.IsZero() {
+		t.Fatal("initiator did not promote the next psk")
+	}
+
+	// the responder promotes once the initiator confirms the keypair,
+	// after which the single psk handshake works as before
+
+	peer1.handshake.promoteNextPresharedKey()
+	if peer1.handshake.presharedKey != next || !peer1.handshake.nextPresharedKey.IsZero() {
+		t.Fatal("responder did not promote the next psk")
+	}
+	if !handshake() {
+		t.Fatal("handshake after rotation failed")
+	}
+}
+
+func TestMixKEM(t *testing.T) {
+	ciphertext := make([]byte, KEMCiphertextSize)
+	for i := range ciphertext {
+		ciphertext[i] = byte(i % 251)
+	}
+	secret := make([]byte, 32)
+	for i := range secret {
+		secret[i] = byte(i)
+	}
+
+	tests := []struct {
+		hash, chainKey     [blake2s.Size]byte
+		ciphertext, secret []byte
+		wantHash           string
+		wantChainKey       string
+	}{
+		{
+			ciphertext:   make([]byte, KEMCiphertextSize),
+			secret:       make([]byte, 32),
+			wantHash:     "c3685161fec33b858d5173388a8a8cd8964a4ce6edd4fdca214a14e01b76868d",
+			wantChainKey: "1090894613df8aef670b0b867e222daebc0d3e436cdddbc16c65855ab93cc91a",
+		},
+		{
+			hash:         blake2s.Sum256([]byte("hash")),
+			chainKey:     blake2s.Sum256([]byte("chain key")),
+			ciphertext:   ciphertext,
+			secret:       secret,
+			wantHash:     "3bf35b935218e88ecb39580e9eadb0c015ff8e76c1bb6a0b0c9dd8efedacd63d",
+			wantChainKey: "ac2ad3685accc8dccc749bad3846aeab5a6101e25de31859bfb46dbfd84d25ad",
+		},
+	}
+
+	for _, test := range tests {
+		hash, chainKey := test.hash, test.chainKey
+		mixKEM(&hash, &chainKey, test.ciphertext, test.secret)
+		assertEquals(t, hex.EncodeToString(hash[:]), test.wantHash)
+		assertEquals(t, hex.EncodeToString(chainKey[:]), test.wantChainKey)
+	}
+}
+
+func TestHybridHandshake(t *testing.T) {
+	if !kemSupported {
+		t.Skip("hybrid handshake not supported by this build")
+	}
+
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+
+	defer dev1.Close()
+	defer dev2.Close()
+
+	dev2.postQuantum.Set(true)
+
+	peer1, err := dev2.NewPeer(dev1.staticIdentity.privateKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer2, err := dev1.NewPeer(dev2.staticIdentity.privateKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the KEM key is authenticated by the initiation
+
+	msg1, err := dev1.CreateMessageHybridInitiation(peer2)
+	assertNil(t, err)
+	tampered := *msg1
+	tampered.KEM[0] ^= 1
+	if dev2.ConsumeMessageHybridInitiation(&tampered) != nil {
+		t.Fatal("responder accepted an initiation with a tampered KEM key")
+	}
+
+	// a hybrid handshake derives matching keys
+
+	if dev2.ConsumeMessageHybridInitiation(msg1) == nil {
+		t.Fatal("handshake failed at hybrid initiation message")
+	}
+	if _, err := dev2.CreateMessageResponse(peer1); err == nil {
+		t.Fatal("classic response to a hybrid initiation created")
+	}
+	msg2, err := dev2.CreateMessageHybridResponse(peer1)
+	assertNil(t, err)
+	if dev1.ConsumeMessageResponse(&MessageResponse{
+		Type:      MessageResponseType,
+		Sender:    msg2.Sender,
+		Receiver:  msg2.Receiver,
+		Ephemeral: msg2.Ephemeral,
+		Empty:     msg2.Empty,
+	}) != nil {
+		t.Fatal("initiator accepted a classic response to a hybrid initiation")
+	}
+	if dev1.ConsumeMessageHybridResponse(msg2) == nil {
+		t.Fatal("handshake failed at hybrid response message")
+	}
+	assertEqual(t, peer1.handshake.chainKey[:], peer2.handshake.chainKey[:])
+	assertEqual(t, peer1.handshake.hash[:], peer2.handshake.hash[:])
+
+	assertNil(t, peer1.BeginSymmetricSession())
+	assertNil(t, peer2.BeginSymmetricSession())
+	if !peer1.keypairs.next.hybrid || !peer2.keypairs.current.hybrid {
+		t.Fatal("keypairs not marked as hybrid")
+	}
+
+	// post-quantum peers are refused classic handshakes
+
+	peer1.handshake.postQuantum = true
+	peer1.handshake.lastTimestamp = tai64n.Timestamp{}
+	msg3, err := dev1.CreateMessageInitiation(peer2)
+	assertNil(t, err)
+	if dev2.ConsumeMessageInitiation(msg3) != nil {
+		t.Fatal("classic initiation of a post-quantum peer accepted")
+	}
+}
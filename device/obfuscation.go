@@ -0,0 +1,47 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/tailscale/wireguard-go/conn"
+)
+
+/* Obfuscation, enabled with obfuscation=<name>:<hex key>, wraps the bind
+ * in a conn.Obfuscator registered under name, such as the reference
+ * "stream" obfuscator, keyed by the shared secret. Peers without the same
+ * setting cannot exchange messages with the device at all, so it is set
+ * per device rather than per peer. See conn/obfuscate.go.
+ */
+
+type obfuscation struct {
+	name       string
+	key        []byte
+	obfuscator conn.Obfuscator
+}
+
+func parseObfuscation(s string) (*obfuscation, error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return nil, errors.New("missing obfuscation key")
+	}
+	key, err := hex.DecodeString(s[i+1:])
+	if err != nil {
+		return nil, err
+	}
+	obfuscator, err := conn.NewObfuscator(s[:i], key)
+	if err != nil {
+		return nil, err
+	}
+	return &obfuscation{name: s[:i], key: key, obfuscator: obfuscator}, nil
+}
+
+func (obfuscation *obfuscation) String() string {
+	return obfuscation.name + ":" + hex.EncodeToString(obfuscation.key)
+}
@@ -0,0 +1,128 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+/* A bind recording the message types seen on the wire.
+ */
+type typeBind struct {
+	conn.Bind
+	mu    sync.Mutex
+	types map[uint32]bool
+}
+
+func (bind *typeBind) Send(buff []byte, end conn.Endpoint) error {
+	bind.mu.Lock()
+	bind.types[binary.LittleEndian.Uint32(buff)] = true
+	bind.mu.Unlock()
+	return bind.Bind.Send(buff, end)
+}
+
+func TestObfuscation(t *testing.T) {
+	const key = "obfuscation=stream:0123456789abcdef\n"
+	dst, src := net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")
+
+	for _, test := range []struct {
+		name     string
+		key2     string
+		transits bool
+	}{
+		{"same key", key, true},
+		{"other key", "obfuscation=stream:fedcba9876543210\n", false},
+		{"one side", "", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			network := bindtest.NewNetwork(1)
+			binds := make([]*typeBind, 2)
+			var devs [2]*Device
+			var tuns [2]*tuntest.ChannelTUN
+			for i, cfg := range []string{key + cfg1, test.key2 + cfg2} {
+				i := i
+				tuns[i] = tuntest.NewChannelTUN()
+				devs[i] = NewDevice(tuns[i].TUN(), &DeviceOptions{
+					Logger: NewLogger(LogLevelError, "dev: "),
+					CreateBind: func(port uint16) (conn.Bind, uint16, error) {
+						bind, port, err := network.CreateBind(port)
+						if err != nil {
+							return nil, 0, err
+						}
+						binds[i] = &typeBind{Bind: bind, types: make(map[uint32]bool)}
+						return binds[i], port, nil
+					},
+					CreateEndpoint: network.CreateEndpoint,
+				})
+				defer devs[i].Close()
+				devs[i].Up()
+				if err := ipcSet(devs[i], cfg); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tuns[1].Outbound <- tuntest.Ping(dst, src)
+			select {
+			case <-tuns[0].Inbound:
+				if !test.transits {
+					t.Fatal("ping transited")
+				}
+			case <-time.After(time.Second):
+				if test.transits {
+					t.Fatal("ping did not transit")
+				}
+				return
+			}
+
+			for i, bind := range binds {
+				bind.mu.Lock()
+				for _, msgType := range []uint32{MessageInitiationType, MessageResponseType, MessageTransportType} {
+					if bind.types[msgType] {
+						t.Errorf("dev%d sent message type %d in the clear", i+1, msgType)
+					}
+				}
+				bind.mu.Unlock()
+			}
+		})
+	}
+}
+
+func TestUAPIObfuscation(t *testing.T) {
+	network := bindtest.NewNetwork(1)
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger:         NewLogger(LogLevelSilent, "dev: "),
+		CreateBind:     network.CreateBind,
+		CreateEndpoint: network.CreateEndpoint,
+	})
+	defer device.Close()
+
+	if err := ipcSet(device, "obfuscation=stream:00ff\n"); err != nil {
+		t.Fatal(err)
+	}
+	if get := ipcGet(t, device); !strings.Contains(get, "obfuscation=stream:00ff\n") {
+		t.Errorf("obfuscation missing from get:\n%s", get)
+	}
+	for _, value := range []string{"stream", "stream:", "stream:xyz", "unknown:00ff"} {
+		if err := ipcSet(device, "obfuscation="+value+"\n"); err == nil {
+			t.Errorf("obfuscation=%s accepted", value)
+		}
+	}
+	if err := ipcSet(device, "obfuscation=\n"); err != nil {
+		t.Fatal(err)
+	}
+	if get := ipcGet(t, device); strings.Contains(get, "obfuscation=") {
+		t.Errorf("obfuscation not disabled:\n%s", get)
+	}
+}
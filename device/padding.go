@@ -0,0 +1,156 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+/* Padding, enabled with padding=fixed or padding=random, hides the fixed
+ * lengths of WireGuard messages from passive observers.
+ *
+ * Transport messages are padded inside the encrypted payload, as they are
+ * to a multiple of 16 already, and receivers take the length of the inner
+ * packet from its IP header, so any receiver takes them. They are padded to
+ * at most the MTU. Handshake messages are padded with random bytes after
+ * mac2, outside the MACs, since their contents are fixed by the protocol.
+ * Receivers without padding drop handshake messages of the wrong length,
+ * so padding must be enabled at both ends; a device with padding enabled
+ * takes padded and unpadded handshake messages alike, stripping padding
+ * before the MACs are checked.
+ *
+ * With padding=fixed, messages are padded to padding_size bytes, hiding
+ * which kind of message they are, and the length of small packets. With
+ * padding=random, up to padding_size random bytes are added, blurring
+ * lengths at a lower average cost. Either way, padding costs bandwidth:
+ * fixed padding of 1280 bytes makes a 32-byte keepalive forty times its
+ * size, and an interactive session of small packets several times its
+ * size. Bulk transfers of full-sized packets are barely affected.
+ */
+
+type paddingScheme int
+
+const (
+	paddingNone paddingScheme = iota
+	paddingFixed
+	paddingRandom
+)
+
+const paddingHandshakeMax = 1280 // longest padded handshake message, fitting the IPv6 minimum MTU
+
+type paddingConfig struct {
+	scheme paddingScheme
+	size   int // target message size for paddingFixed, most bytes added for paddingRandom
+}
+
+func (scheme paddingScheme) String() string {
+	switch scheme {
+	case paddingFixed:
+		return "fixed"
+	case paddingRandom:
+		return "random"
+	}
+	return "none"
+}
+
+func parsePaddingScheme(s string) (paddingScheme, error) {
+	switch s {
+	case "none":
+		return paddingNone, nil
+	case "fixed":
+		return paddingFixed, nil
+	case "random":
+		return paddingRandom, nil
+	}
+	return paddingNone, errors.New("invalid padding scheme: " + s)
+}
+
+func (device *Device) paddingConfig() paddingConfig {
+	config, _ := device.padding.Load().(paddingConfig)
+	return config
+}
+
+/* Returns a source of transport padding lengths for a single worker.
+ */
+func newPaddingSource() *rand.Rand {
+	var seed [8]byte
+	if _, err := crand.Read(seed[:]); err != nil {
+		binary.LittleEndian.PutUint64(seed[:], uint64(time.Now().UnixNano()))
+	}
+	return rand.New(rand.NewSource(int64(binary.LittleEndian.Uint64(seed[:]))))
+}
+
+/* Returns the length to pad the content of a transport message of length
+ * size to, rounded up to a multiple of PaddingMultiple, and padded further
+ * by the padding scheme, up to mtu.
+ */
+func (device *Device) transportPaddedSize(size, mtu int, source *rand.Rand) int {
+	if mtu == 0 {
+		return (size + PaddingMultiple - 1) & ^(PaddingMultiple - 1)
+	}
+	lastUnit := size
+	if lastUnit > mtu {
+		lastUnit %= mtu
+	}
+	paddedSize := (lastUnit + PaddingMultiple - 1) & ^(PaddingMultiple - 1)
+
+	switch config := device.paddingConfig(); config.scheme {
+	case paddingFixed:
+		if target := config.size - MessageTransportSize; paddedSize < target {
+			paddedSize = target
+		}
+	case paddingRandom:
+		paddedSize += source.Intn(config.size + 1)
+	}
+
+	if paddedSize > mtu {
+		paddedSize = mtu
+	}
+	return paddedSize
+}
+
+/* Appends random padding to the handshake message packet, as the padding
+ * scheme has it, returning the padded message.
+ */
+func (device *Device) padHandshake(packet []byte) []byte {
+	config := device.paddingConfig()
+	var padding int
+	switch config.scheme {
+	case paddingFixed:
+		padding = config.size - len(packet)
+	case paddingRandom:
+		var b [4]byte
+		crand.Read(b[:])
+		padding = int(binary.LittleEndian.Uint32(b[:]) % uint32(config.size+1))
+	}
+	if max := paddingHandshakeMax - len(packet); padding > max {
+		padding = max
+	}
+	if padding <= 0 {
+		return packet
+	}
+	n := len(packet)
+	packet = append(packet, make([]byte, padding)...)
+	crand.Read(packet[n:])
+	return packet
+}
+
+/* Returns the handshake message packet without its padding, and whether
+ * it is of the length size, once stripped.
+ */
+func (device *Device) unpadHandshake(packet []byte, size int) ([]byte, bool) {
+	if len(packet) == size {
+		return packet, true
+	}
+	if len(packet) < size || device.paddingConfig().scheme == paddingNone {
+		return packet, false
+	}
+	return packet[:size], true
+}
@@ -0,0 +1,146 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+func TestTransportPaddedSize(t *testing.T) {
+	device := &Device{}
+	source := rand.New(rand.NewSource(1))
+
+	tests := []struct {
+		padding         paddingConfig
+		size, mtu, want int
+	}{
+		{paddingConfig{}, 0, 1420, 0},
+		{paddingConfig{}, 1, 1420, 16},
+		{paddingConfig{}, 1419, 1420, 1420},
+		{paddingConfig{}, 1, 0, 16},
+		{paddingConfig{paddingFixed, 1200}, 0, 1420, 1200 - MessageTransportSize},
+		{paddingConfig{paddingFixed, 1200}, 1300, 1420, 1312},
+		{paddingConfig{paddingFixed, 1500}, 1, 1420, 1420},
+		{paddingConfig{paddingRandom, 0}, 1, 1420, 16},
+	}
+	for _, tt := range tests {
+		device.padding.Store(tt.padding)
+		if got := device.transportPaddedSize(tt.size, tt.mtu, source); got != tt.want {
+			t.Errorf("%+v: padded %d to %d, want %d", tt.padding, tt.size, got, tt.want)
+		}
+	}
+
+	device.padding.Store(paddingConfig{paddingRandom, 100})
+	for i := 0; i < 100; i++ {
+		if got := device.transportPaddedSize(1, 1420, source); got < 16 || got > 116 {
+			t.Fatalf("randomly padded 1 to %d", got)
+		}
+	}
+}
+
+func TestPadHandshake(t *testing.T) {
+	device := &Device{}
+	message := make([]byte, MessageInitiationSize)
+
+	if padded := device.padHandshake(message); len(padded) != MessageInitiationSize {
+		t.Errorf("padded to %d without padding", len(padded))
+	}
+	if _, ok := device.unpadHandshake(make([]byte, MessageInitiationSize+1), MessageInitiationSize); ok {
+		t.Error("padded message taken without padding")
+	}
+
+	device.padding.Store(paddingConfig{paddingFixed, 2000})
+	padded := device.padHandshake(message)
+	if len(padded) != paddingHandshakeMax {
+		t.Errorf("padded to %d, want %d", len(padded), paddingHandshakeMax)
+	}
+	for _, packet := range [][]byte{padded, message} {
+		if unpadded, ok := device.unpadHandshake(packet, MessageInitiationSize); !ok || len(unpadded) != MessageInitiationSize {
+			t.Errorf("%d bytes unpadded to %d, %t", len(packet), len(unpadded), ok)
+		}
+	}
+	if _, ok := device.unpadHandshake(message[:MessageInitiationSize-1], MessageInitiationSize); ok {
+		t.Error("truncated message taken")
+	}
+}
+
+/* A bind recording the lengths of the datagrams it sends.
+ */
+type lengthBind struct {
+	conn.Bind
+	mu      sync.Mutex
+	lengths map[int]bool
+}
+
+func (bind *lengthBind) Send(buff []byte, end conn.Endpoint) error {
+	bind.mu.Lock()
+	bind.lengths[len(buff)] = true
+	bind.mu.Unlock()
+	return bind.Bind.Send(buff, end)
+}
+
+func TestPadding(t *testing.T) {
+	network := bindtest.NewNetwork(1)
+	binds := make([]*lengthBind, 2)
+	var devs [2]*Device
+	var tuns [2]*tuntest.ChannelTUN
+	for i, cfg := range []string{cfg1, cfg2} {
+		i := i
+		tuns[i] = tuntest.NewChannelTUN()
+		devs[i] = NewDevice(tuns[i].TUN(), &DeviceOptions{
+			Logger: NewLogger(LogLevelError, "dev: "),
+			CreateBind: func(port uint16) (conn.Bind, uint16, error) {
+				bind, port, err := network.CreateBind(port)
+				if err != nil {
+					return nil, 0, err
+				}
+				binds[i] = &lengthBind{Bind: bind, lengths: make(map[int]bool)}
+				return binds[i], port, nil
+			},
+			CreateEndpoint: network.CreateEndpoint,
+		})
+		defer devs[i].Close()
+		devs[i].Up()
+		if err := ipcSet(devs[i], "padding=fixed\npadding_size=1200\n"+cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if get := ipcGet(t, devs[0]); !strings.Contains(get, "padding=fixed\npadding_size=1200\n") {
+		t.Errorf("padding missing from get:\n%s", get)
+	}
+
+	// every message is of the same length
+
+	dst, src := net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")
+	tuns[1].Outbound <- tuntest.Ping(dst, src)
+	select {
+	case <-tuns[0].Inbound:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ping did not transit")
+	}
+	tuns[0].Outbound <- tuntest.Ping(src, dst)
+	select {
+	case <-tuns[1].Inbound:
+	case <-time.After(2 * time.Second):
+		t.Fatal("return ping did not transit")
+	}
+	for i, bind := range binds {
+		bind.mu.Lock()
+		if len(bind.lengths) != 1 || !bind.lengths[1200] {
+			t.Errorf("dev%d sent datagrams of lengths %v, want 1200", i+1, bind.lengths)
+		}
+		bind.mu.Unlock()
+	}
+}
@@ -8,11 +8,13 @@ package device
 import (
 	"errors"
 	"net"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/tun"
 	"github.com/tailscale/wireguard-go/wgcfg"
 )
 
@@ -27,10 +29,23 @@ type Peer struct {
 	// atomically-accessed fields up front, so that they can share in
 	// this alignment before smaller fields throw it off.
 	stats struct {
-		txBytes           uint64 // bytes send to peer (endpoint)
-		rxBytes           uint64 // bytes received from peer
-		lastRXNano        int64  // time.Now().UnixNano() of last rxBytes increment
-		lastHandshakeNano int64  // nano seconds since epoch
+		txBytes                  uint64 // bytes send to peer (endpoint)
+		rxBytes                  uint64 // bytes received from peer
+		txPackets                uint64 // packets sent to peer
+		rxPackets                uint64 // packets received from peer
+		handshakeAttempts        uint64 // handshake initiations sent
+		handshakesCompleted      uint64 // handshakes completed, as initiator or responder
+		lastRXNano               int64  // time.Now().UnixNano() of last rxBytes increment
+		lastHandshakeNano        int64  // nano seconds since epoch
+		lastHandshakeFailureNano int64  // nano seconds since epoch of the last abandoned handshake, zero after a success
+		lastKeepaliveNano        int64  // time.Now().UnixNano() of the last persistent keepalive since the handshake, 0 if none
+		handshakeStartedNano     int64  // time.Now().UnixNano() of the first initiation of the pending handshake, 0 if none
+		handshakeLatency         HandshakeLatency
+		rxLoss                   lossEstimate // see loss.go
+	}
+	lifecycle struct {
+		createdNano  int64 // time.Now().UnixNano() of the peer being added
+		modifiedNano int64 // time.Now().UnixNano() of the configuration of the peer last being set
 	}
 	// This field is only 32 bits wide, but is still aligned to 64
 	// bits. Don't place other atomic fields after this one.
@@ -42,7 +57,38 @@ type Peer struct {
 	handshake                   Handshake
 	device                      *Device
 	endpoint                    conn.Endpoint
+	endpointHost                string        // hostname and port the endpoint is resolved from, "" if configured by address
+	endpointResolved            string        // endpoint last resolved from endpointHost
+	endpointRace                conn.Endpoint // endpoint of the other address family raced against endpoint, nil once committed
+	endpointCandidates          []string      // endpoints failed over between, in order, nil if only one
+	endpointCandidate           int           // index of the current endpoint in endpointCandidates
+	endpointLocked              bool          // never roam from the configured endpoint
+	endpointReceived            conn.Endpoint // endpoint of the last datagram heard from the peer, for its source address; nil once cleared
+	allowedEndpoints            []*net.IPNet  // prefixes the peer may roam to, nil for any
+	punch                       *holePunch    // candidates hole punching sends initiations to, nil unless punching
+	punchInterval               time.Duration // pace of hole punching bursts, 0 for PunchInterval
+	punchBurst                  int           // sends to each candidate port per burst, 0 for PunchBurst
+	punchGeneration             uint32        // bursts of hole punching started, each superseding the last; atomic
+	tunQueue                    tun.Queue     // TUN queue received packets are written to
+	pathMTU                     int32         // inner MTU learnt by path MTU discovery, 0 if not below the TUN MTU; atomic
 	persistentKeepaliveInterval uint16
+	adaptiveKeepalive           bool   // widen the persistent keepalive interval while idle
+	adaptiveKeepaliveMax        uint16 // ceiling of the adaptive interval in seconds, 0 for default
+	noNAT                       bool   // the path has no NAT, so persistent keepalives may be suppressed
+
+	transport struct {
+		errors      uint32     // sends failed in a row as unreachable, see unreachable.go; atomic
+		unreachable AtomicBool // errors reached TransportUnreachableErrors
+	}
+
+	replayUnprotected AtomicBool // accept counters behind the replay window, see disable_replay_protection
+
+	name atomic.Value // string shown for the peer in logs and metrics rather than its key, "" for the key
+
+	rateLimit struct {
+		tx tokenBucket // outbound bytes per second
+		rx tokenBucket // inbound bytes per second
+	}
 
 	timers struct {
 		retransmitHandshake     *Timer
@@ -50,7 +96,17 @@ type Peer struct {
 		newHandshake            *Timer
 		zeroKeyMaterial         *Timer
 		persistentKeepalive     *Timer
+		idle                    *Timer
+		unreachable             *Timer
+		pathMTUProbe            *Timer
+		resolveEndpoint         *Timer
 		handshakeAttempts       uint32
+		keepaliveInterval       uint32 // current adaptive persistent keepalive interval in seconds
+		idleTimeout             uint32 // remove the peer after this many seconds without authenticated packets, 0 to disable
+		unreachableTimeout      uint32 // report the peer unreachable after this many seconds without a reply to data, 0 to disable
+		unreachableClearSrc     AtomicBool
+		pathMTUProbed           AtomicBool // a probe was sent at the last expiry of pathMTUProbe
+		natObserved             AtomicBool // the peer roamed, so its path may have NAT
 		needAnotherKeepalive    AtomicBool
 		sentLastMinuteHandshake AtomicBool
 	}
@@ -65,6 +121,10 @@ type Peer struct {
 		outbound                        chan *QueueOutboundElement // sequential ordering of work
 		inbound                         chan *QueueInboundElement  // sequential ordering of work
 		packetInNonceQueueIsAwaitingKey AtomicBool
+		current                         atomic.Value // peerQueues, for reading their depths
+		nonceHigh                       queueWatermark
+		outboundHigh                    queueWatermark
+		inboundHigh                     queueWatermark
 	}
 
 	routines struct {
@@ -105,7 +165,11 @@ func (device *Device) NewPeer(pk wgcfg.Key) (*Peer, error) {
 
 	peer.cookieGenerator.Init(pk)
 	peer.device = device
+	peer.tunQueue = device.tun.queues[device.tun.nextQueue]
+	device.tun.nextQueue = (device.tun.nextQueue + 1) % len(device.tun.queues)
 	peer.isRunning.Set(false)
+	peer.lifecycle.createdNano = time.Now().UnixNano()
+	peer.lifecycle.modifiedNano = peer.lifecycle.createdNano
 
 	// map public key
 
@@ -137,6 +201,8 @@ func (device *Device) NewPeer(pk wgcfg.Key) (*Peer, error) {
 		return nil, nil
 	}
 
+	device.publishPeerEvent(UAPIEventPeerAdded, pk)
+
 	// start peer
 
 	if peer.device.isUp.Get() {
@@ -181,16 +247,83 @@ func (peer *Peer) SendBuffer(buffer []byte) error {
 	}
 
 	err := peer.device.net.bind.Send(buffer, peer.endpoint)
+	peer.transportSendResult(err)
 	if err == nil {
 		atomic.AddUint64(&peer.stats.txBytes, uint64(len(buffer)))
+		atomic.AddUint64(&peer.stats.txPackets, 1)
 	}
 	return err
 }
 
+/* Sends several packets to the peer, in a single batch if the bind supports it.
+ * The endpoint of each packet is set to the peer's endpoint.
+ */
+func (peer *Peer) SendPackets(batch []conn.Packet) error {
+	peer.device.net.RLock()
+	defer peer.device.net.RUnlock()
+
+	bind := peer.device.net.bind
+	if bind == nil {
+		return errors.New("no bind")
+	}
+
+	peer.RLock()
+	defer peer.RUnlock()
+
+	if peer.endpoint == nil {
+		return errors.New("no known endpoint for peer")
+	}
+
+	var (
+		err     error
+		sent    uint64
+		packets uint64
+	)
+
+	if batchBind, ok := bind.(conn.BatchBind); ok {
+		for i := range batch {
+			batch[i].Endpoint = peer.endpoint
+		}
+		err = batchBind.SendBatch(batch)
+		if err == nil {
+			for _, packet := range batch {
+				sent += uint64(packet.N)
+			}
+			packets = uint64(len(batch))
+		}
+	} else {
+		for _, packet := range batch {
+			if e := bind.Send(packet.Buffer[:packet.N], peer.endpoint); e != nil {
+				if err == nil {
+					err = e
+				}
+			} else {
+				sent += uint64(packet.N)
+				packets++
+			}
+		}
+	}
+
+	atomic.AddUint64(&peer.stats.txBytes, sent)
+	atomic.AddUint64(&peer.stats.txPackets, packets)
+	peer.transportSendResult(err)
+	return err
+}
+
 func (peer *Peer) String() string {
+	if name, _ := peer.name.Load().(string); name != "" {
+		return name
+	}
 	return peer.handshake.remoteStatic.ShortString()
 }
 
+/* Returns the name of the peer, "" if it has none.
+ */
+func (peer *Peer) Name() string {
+	name, _ := peer.name.Load().(string)
+	return name
+}
+
 func (peer *Peer) Start() {
 
 	// should never start a peer on a closed device
@@ -209,7 +342,7 @@ func (peer *Peer) Start() {
 	}
 
 	device := peer.device
-	device.log.Debug.Println(peer, "- Starting...")
+	device.log.Verbosef("%v - Starting...", peer)
 
 	// reset routine state
 
@@ -221,9 +354,22 @@ func (peer *Peer) Start() {
 
 	// prepare queues
 
-	peer.queue.nonce = make(chan *QueueOutboundElement, QueueOutboundSize)
+	/* The nonce queue holds the packets awaiting a keypair while a
+	 * handshake completes, and those bursting ahead of the nonce worker.
+	 * An empty slot costs a pointer, but each packet queued holds a
+	 * message buffer of MaxMessageSize, so a full queue of the default
+	 * size pins some 64 MiB on most platforms. Shrinking it with
+	 * nonce_queue_size bounds that for devices with many peers, at the
+	 * price of dropping the oldest packets of bursts which overflow it;
+	 * growing it lets bursty peers ride out a handshake, at the price of
+	 * the memory. The size applies to peers as they start, so peers
+	 * already running keep theirs until the device is next brought up.
+	 */
+
+	peer.queue.nonce = make(chan *QueueOutboundElement, atomic.LoadUint32(&device.nonceQueueSize))
 	peer.queue.outbound = make(chan *QueueOutboundElement, QueueOutboundSize)
 	peer.queue.inbound = make(chan *QueueInboundElement, QueueInboundSize)
+	peer.queue.current.Store(peerQueues{peer.queue.nonce, peer.queue.outbound, peer.queue.inbound})
 
 	peer.timersInit()
 	// TODO(apenwarr): This doesn't seem necessary.
@@ -241,9 +387,28 @@ func (peer *Peer) Start() {
 
 	peer.routines.starting.Wait()
 	peer.isRunning.Set(true)
+
+	// the caller may hold the peer and peers locks, so arm directly
+
+	if idleTimeout := atomic.LoadUint32(&peer.timers.idleTimeout); idleTimeout > 0 {
+		peer.timers.idle.Mod(time.Duration(idleTimeout) * time.Second)
+	}
+
+	// armed whether or not the endpoint has a hostname, see expiredResolveEndpoint
+
+	if interval := device.endpointResolveInterval(); interval > 0 {
+		peer.timers.resolveEndpoint.Mod(interval)
+	}
 }
 
 func (peer *Peer) ZeroAndFlushAll() {
+	peer.clearKeys()
+	peer.FlushNonceQueue()
+}
+
+/* Clears the key pairs and handshake state of the peer.
+ */
+func (peer *Peer) clearKeys() {
 	device := peer.device
 
 	// clear key pairs
@@ -265,8 +430,27 @@ func (peer *Peer) ZeroAndFlushAll() {
 	device.indexTable.Delete(handshake.localIndex)
 	handshake.Clear()
 	handshake.mutex.Unlock()
+}
 
-	peer.FlushNonceQueue()
+/* Drops the sessions and pending handshake of the peer, keeping its
+ * configuration, so that the next packet to it initiates a handshake
+ * afresh. Packets awaiting a session are kept for the next one.
+ */
+func (peer *Peer) zeroKeys() {
+	if peer.timersActive() {
+		peer.timers.retransmitHandshake.Del()
+		peer.timers.sendKeepalive.Del()
+		peer.timers.newHandshake.Del()
+		peer.timers.zeroKeyMaterial.Del()
+	}
+	atomic.StoreUint32(&peer.timers.handshakeAttempts, 0)
+	atomic.StoreInt64(&peer.stats.handshakeStartedNano, 0)
+
+	peer.clearKeys()
+
+	peer.handshake.mutex.Lock()
+	peer.handshake.lastSentHandshake = time.Now().Add(-peer.device.rekeyTimeout())
+	peer.handshake.mutex.Unlock()
 }
 
 func (peer *Peer) ExpireCurrentKeypairs() {
@@ -275,7 +459,7 @@ func (peer *Peer) ExpireCurrentKeypairs() {
 	peer.device.indexTable.Delete(handshake.localIndex)
 	handshake.Clear()
 	handshake.mutex.Unlock()
-	peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+	peer.handshake.lastSentHandshake = time.Now().Add(-(peer.device.rekeyTimeout() + time.Second))
 
 	keypairs := &peer.keypairs
 	keypairs.Lock()
@@ -301,7 +485,7 @@ func (peer *Peer) Stop() {
 	peer.routines.Lock()
 	defer peer.routines.Unlock()
 
-	peer.device.log.Debug.Println(peer, "- Stopping...")
+	peer.device.log.Verbosef("%v - Stopping...", peer)
 
 	peer.timersStop()
 
@@ -321,21 +505,109 @@ func (peer *Peer) Stop() {
 
 var RoamingDisabled bool
 
+/* Returns whether the peer may roam to ip, under its lock.
+ */
+func (peer *Peer) roamingAllowed(ip net.IP) bool {
+	if peer.endpointLocked {
+		return false
+	}
+	if peer.allowedEndpoints == nil {
+		return true
+	}
+	for _, network := range peer.allowedEndpoints {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func (peer *Peer) SetEndpointAddress(addr *net.UDPAddr) {
+	peer.setEndpointAddress(addr, nil)
+}
+
+/* Roams the peer to addr, the source of an authenticated datagram received
+ * from the endpoint received, if not nil, which gives the local address the
+ * datagram arrived at.
+ */
+func (peer *Peer) setEndpointAddress(addr *net.UDPAddr, received conn.Endpoint) {
 	if RoamingDisabled {
 		return
 	}
 	if p := peer.device.allowedips.LookupIP(addr.IP); p != nil {
-		peer.device.log.Debug.Printf("%v - SetEndPointAddress: %v owned by %v, skipping", peer, addr, p)
+		peer.device.log.Verbosef("%v - SetEndPointAddress: %v owned by %v, skipping", peer, addr, p)
 		return
 	}
 
+	handler := peer.device.endpointChangeHandler()
+	notify := handler != nil || peer.device.eventSubscribed()
+
 	peer.Lock()
+	if !peer.roamingAllowed(addr.IP) {
+		if peer.endpoint != nil && !peer.endpointLocked && peer.endpoint.DstToString() != addr.String() {
+			peer.device.log.Verbosef("%v - SetEndpointAddress: %v not an allowed endpoint, skipping", peer, addr)
+		}
+		peer.Unlock()
+		return
+	}
+	if received != nil {
+		peer.endpointReceived = received
+	}
 	if peer.endpoint != nil {
+		track := notify || peer.noNAT
+		var old string
+		if track {
+			old = peer.endpoint.DstToString()
+		}
 		err := peer.endpoint.UpdateDst(addr)
 		if err != nil {
-			peer.device.log.Debug.Printf("%v - SetEndpointAddress: %v", peer, err)
+			peer.device.log.Verbosef("%v - SetEndpointAddress: %v", peer, err)
+		} else if track {
+			if new := peer.endpoint.DstToString(); new != old {
+				peer.timers.natObserved.Set(true)
+				peer.endpointChanged(handler, old, new)
+			}
 		}
 	}
 	peer.Unlock()
 }
+
+/* Notifies of the endpoint of the peer changing from old to new, calling
+ * handler if not nil.
+ */
+func (peer *Peer) endpointChanged(handler EndpointChangeHandler, old, new string) {
+	key := peer.handshake.remoteStatic
+	peer.device.publishEndpointEvent(key, old, new)
+	if handler != nil {
+		peer.device.queueEvent(func() {
+			handler(key, old, new)
+		})
+	}
+}
+
+/* Clears the source address cached for the endpoint of the peer, in case
+ * it is the cause of trouble, and the one learnt from received datagrams.
+ * The peer lock must be held.
+ */
+func (peer *Peer) clearSrc() {
+	if peer.endpoint != nil {
+		peer.endpoint.ClearSrc()
+	}
+	peer.endpointReceived = nil
+}
+
+/* Returns the local address and port datagrams from the peer were last
+ * received at, or "" if unknown. The peer lock must be held, and
+ * device.net read locked.
+ */
+func (peer *Peer) localEndpoint() string {
+	if peer.endpointReceived == nil {
+		return ""
+	}
+	src := peer.endpointReceived.SrcIP()
+	if src == nil || src.IsUnspecified() {
+		return ""
+	}
+	port := peer.device.receivedPort(peer.endpointReceived)
+	return net.JoinHostPort(src.String(), strconv.Itoa(int(port)))
+}
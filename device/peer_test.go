@@ -6,8 +6,14 @@
 package device
 
 import (
+	"net"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 	"unsafe"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
 )
 
 func checkAlignment(t *testing.T, name string, offset uintptr) {
@@ -27,3 +33,204 @@ func TestPeerAlignment(t *testing.T) {
 	checkAlignment(t, "Peer.stats", unsafe.Offsetof(p.stats))
 	checkAlignment(t, "Peer.isRunning", unsafe.Offsetof(p.isRunning))
 }
+
+func TestDeviceAlignment(t *testing.T) {
+	var d Device
+	checkAlignment(t, "Device.timers", unsafe.Offsetof(d.timers))
+}
+
+func TestEndpointChangeHandler(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev: "),
+	})
+	defer device.Close()
+
+	if err := ipcSet(device, cfg1); err != nil {
+		t.Fatal(err)
+	}
+	key, err := wgcfg.ParseHexKey("f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := device.LookupPeer(key)
+
+	type change struct {
+		key      wgcfg.Key
+		old, new string
+	}
+	changes := make(chan change, 1)
+	device.SetEndpointChangeHandler(func(key wgcfg.Key, old, new string) {
+		changes <- change{key, old, new}
+	})
+
+	// same address, no event
+	peer.SetEndpointAddress(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53512})
+	peer.SetEndpointAddress(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53513})
+
+	select {
+	case c := <-changes:
+		want := change{key, "127.0.0.1:53512", "127.0.0.1:53513"}
+		if c != want {
+			t.Errorf("got %+v, want %+v", c, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("endpoint change handler not called")
+	}
+}
+
+func TestHandshakeEventHandler(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev: "),
+	})
+	defer device.Close()
+
+	if err := ipcSet(device, cfg1); err != nil {
+		t.Fatal(err)
+	}
+	key, err := wgcfg.ParseHexKey("f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := device.LookupPeer(key)
+
+	events := make(chan HandshakeEvent, 1)
+	device.SetHandshakeEventHandler(func(event HandshakeEvent) {
+		events <- event
+	})
+
+	atomic.StoreUint32(&peer.timers.handshakeAttempts, 2)
+	peer.timersHandshakeComplete()
+
+	select {
+	case event := <-events:
+		want := HandshakeEvent{PeerKey: key, Reason: HandshakeCompleted, Attempt: 3}
+		if event != want {
+			t.Errorf("got %+v, want %+v", event, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handshake event handler not called")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev: "),
+	})
+	defer device.Close()
+	device.Up()
+
+	if err := ipcSet(device, cfg1+"\nidle_timeout=1\n"); err != nil {
+		t.Fatal(err)
+	}
+	key, err := wgcfg.ParseHexKey("f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan HandshakeEvent, 1)
+	device.SetHandshakeEventHandler(func(event HandshakeEvent) {
+		if event.Reason == HandshakePeerRemoved {
+			events <- event
+		}
+	})
+
+	select {
+	case event := <-events:
+		if event.PeerKey != key {
+			t.Errorf("removed peer %v, want %v", event.PeerKey, key)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("idle peer not removed")
+	}
+
+	for i := 0; device.LookupPeer(key) != nil; i++ {
+		if i == 100 {
+			t.Fatal("idle peer still configured")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ip := net.IPv4(1, 0, 0, 2); device.allowedips.LookupIPv4(ip.To4()) != nil {
+		t.Error("allowed IPs of idle peer still routed")
+	}
+}
+
+func TestRemovePeerReplaced(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev: "),
+	})
+	defer device.Close()
+
+	if err := ipcSet(device, cfg1); err != nil {
+		t.Fatal(err)
+	}
+	key, err := wgcfg.ParseHexKey("f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := device.LookupPeer(key)
+
+	// removing a peer replaced since leaves its replacement be
+
+	if err := device.RemovePeer(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipcSet(device, cfg1); err != nil {
+		t.Fatal(err)
+	}
+	device.removePeer(old)
+	if device.LookupPeer(key) == nil {
+		t.Fatal("replacement of a removed peer removed")
+	}
+	device.removePeer(device.LookupPeer(key))
+	if device.LookupPeer(key) != nil {
+		t.Error("peer not removed")
+	}
+}
+
+func TestUnreachableTimeout(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev: "),
+	})
+	defer device.Close()
+	device.Up()
+
+	if err := ipcSet(device, cfg1+"\nunreachable_timeout=1\nunreachable_clear_src=true\n"); err != nil {
+		t.Fatal(err)
+	}
+	key, err := wgcfg.ParseHexKey("f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := device.LookupPeer(key)
+	if get := ipcGet(t, device); !strings.Contains(get, "unreachable_timeout=1\nunreachable_clear_src=true\n") {
+		t.Errorf("get output missing unreachable settings:\n%s", get)
+	}
+
+	events := make(chan HandshakeEvent, 1)
+	device.SetHandshakeEventHandler(func(event HandshakeEvent) {
+		if event.Reason == HandshakeUnreachable {
+			events <- event
+		}
+	})
+
+	// a reply in time disarms the probe
+
+	peer.timersDataSent()
+	if !peer.timers.unreachable.IsPending() {
+		t.Fatal("unreachable timer not armed by sent data")
+	}
+	peer.timersAnyAuthenticatedPacketReceived()
+	if peer.timers.unreachable.IsPending() {
+		t.Fatal("unreachable timer still armed after a reply")
+	}
+
+	peer.timersDataSent()
+	select {
+	case event := <-events:
+		if event.PeerKey != key {
+			t.Errorf("unreachable peer %v, want %v", event.PeerKey, key)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("unreachable peer not reported")
+	}
+}
@@ -0,0 +1,268 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* Path MTU discovery, enabled with path_mtu_discovery=true, forbids the
+ * fragmentation of outer packets and mirrors the path MTU the OS learns
+ * for a peer's endpoint, from ICMP "packet too big" messages, into the
+ * inner MTU of packets sent to that peer.
+ *
+ * So that routers on a narrower path report it, every PathMTUProbeInterval
+ * each peer is sent a keepalive padded to its MTU, and the learnt path MTU
+ * is read back PathMTUProbeTimeout later. Sends failing for exceeding the
+ * path MTU also have it read back at once.
+ *
+ * Inner IPv4 packets without the DF bit which exceed the peer's MTU are
+ * split into fragments, the outer packets no longer being fragmented on
+ * their behalf. Others are refused as any oversized packet, see
+ * handleOversize.
+ */
+
+/* Returns the inner MTU of packets sent to peer: the MTU of the TUN
+ * device, lowered to the path MTU learnt for the peer, if any.
+ */
+func (peer *Peer) mtu() int {
+	mtu := int(atomic.LoadInt32(&peer.device.tun.mtu))
+	if pmtu := int(atomic.LoadInt32(&peer.pathMTU)); pmtu > 0 && pmtu < mtu {
+		mtu = pmtu
+	}
+	return mtu
+}
+
+/* Reads the path MTU the OS has learnt for peer's endpoint and updates the
+ * inner MTU of the peer accordingly. Returns whether it changed.
+ */
+func (peer *Peer) updatePathMTU() bool {
+	device := peer.device
+	if !device.pathMTUDiscovery.Get() {
+		return false
+	}
+
+	device.net.RLock()
+	bind, ok := device.net.bind.(conn.PathMTUBind)
+	device.net.RUnlock()
+	if !ok {
+		return false
+	}
+
+	peer.RLock()
+	endpoint := peer.endpoint
+	peer.RUnlock()
+	if endpoint == nil {
+		return false
+	}
+
+	mtu, err := bind.PathMTU(endpoint)
+	if err != nil {
+		device.log.Verbosef("%v - Failed to read path MTU: %v", peer, err)
+		return false
+	}
+
+	// strip the outer IP and UDP headers and the transport message overhead
+
+	if endpoint.DstIP().To4() != nil {
+		mtu -= ipv4.HeaderLen
+	} else {
+		mtu -= ipv6.HeaderLen
+	}
+	mtu -= 8 + MessageTransportSize
+	if mtu < PathMTUMin {
+		mtu = PathMTUMin
+	}
+	if mtu >= int(atomic.LoadInt32(&device.tun.mtu)) {
+		mtu = 0
+	}
+
+	if int(atomic.SwapInt32(&peer.pathMTU, int32(mtu))) == mtu {
+		return false
+	}
+	device.log.Verbosef("%v - Path MTU changed, sending packets of up to %d bytes", peer, peer.mtu())
+	peer.pathMTUEvent()
+	return true
+}
+
+/* Turns path MTU discovery on or off, for the current bind and all peers.
+ */
+func (device *Device) setPathMTUDiscovery(enabled bool) {
+	device.pathMTUDiscovery.Set(enabled)
+
+	device.net.RLock()
+	if bind, ok := device.net.bind.(conn.PathMTUBind); ok {
+		if err := bind.SetDontFragment(enabled); err != nil {
+			device.log.Errorf("Failed to set path MTU discovery: %v", err)
+		}
+	} else if enabled && device.net.bind != nil {
+		device.log.Verbosef("Path MTU discovery is not supported by the bind")
+	}
+	device.net.RUnlock()
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.keyMap {
+		if enabled {
+			if peer.keypairs.Current() != nil {
+				peer.timersPathMTUProbe()
+			}
+			continue
+		}
+		peer.timers.pathMTUProbe.Del()
+		if atomic.SwapInt32(&peer.pathMTU, 0) != 0 {
+			peer.pathMTUEvent()
+		}
+	}
+}
+
+func expiredPathMTUProbe(peer *Peer) {
+	if !peer.device.pathMTUDiscovery.Get() {
+		return
+	}
+
+	// a probe sent at the last expiry has had time to draw an ICMP reply
+
+	changed := peer.updatePathMTU()
+	if peer.timers.pathMTUProbed.Get() && !changed {
+		peer.timers.pathMTUProbed.Set(false)
+		if peer.timersActive() {
+			peer.timers.pathMTUProbe.Mod(PathMTUProbeInterval)
+		}
+		return
+	}
+
+	// probing stops with the session, the next handshake restarts it
+
+	if !peer.sendPathMTUProbe() {
+		peer.timers.pathMTUProbed.Set(false)
+		return
+	}
+	peer.timers.pathMTUProbed.Set(true)
+	if peer.timersActive() {
+		peer.timers.pathMTUProbe.Mod(PathMTUProbeTimeout)
+	}
+}
+
+/* Queues a keepalive padded with zeros to the MTU of peer. As with
+ * SendKeepalive, nothing is queued while other packets are, nor without
+ * a current keypair.
+ */
+func (peer *Peer) sendPathMTUProbe() bool {
+	device := peer.device
+	if len(peer.queue.nonce) != 0 || peer.queue.packetInNonceQueueIsAwaitingKey.Get() || !peer.isRunning.Get() {
+		return false
+	}
+	keypair := peer.keypairs.Current()
+	if keypair == nil || time.Since(keypair.created) > device.rejectAfterTime() {
+		return false
+	}
+
+	elem := device.NewOutboundElement()
+	size := peer.mtu()
+	if room := len(elem.buffer) - messageBufferOverhead - device.headroom(); size > room {
+		size = room
+	}
+	offset := device.pool.packetOffset
+	elem.packet = elem.buffer[offset : offset+size]
+	for i := range elem.packet {
+		elem.packet[i] = 0
+	}
+	elem.probe = true
+	select {
+	case peer.queue.nonce <- elem:
+		return true
+	default:
+		device.PutMessageBuffer(elem.buffer)
+		device.PutOutboundElement(elem)
+		return false
+	}
+}
+
+/* Reports whether a decrypted packet is a path MTU probe, a keepalive
+ * padded with zeros, rather than data.
+ */
+func isPathMTUProbe(packet []byte) bool {
+	for _, b := range packet {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+/* Queues an IPv4 packet read from the TUN device for peer as fragments
+ * fitting mtu. The element is left for the caller to reuse.
+ */
+func (device *Device) queueFragments(peer *Peer, elem *QueueOutboundElement, mtu int) {
+	var frags []*QueueOutboundElement
+	ok := fragmentIPv4(elem.packet, mtu, func(size int) []byte {
+		frag := device.NewOutboundElement()
+		frag.ds = elem.ds
+		offset := device.pool.packetOffset
+		frag.packet = frag.buffer[offset : offset+size]
+		frags = append(frags, frag)
+		return frag.packet
+	})
+	for _, frag := range frags {
+		if ok {
+			device.capturePacket(frag.packet)
+		}
+		if !ok || !device.queueOutbound(peer, frag) {
+			device.PutMessageBuffer(frag.buffer)
+			device.PutOutboundElement(frag)
+		}
+	}
+}
+
+/* Splits an IPv4 packet into fragments of at most mtu bytes. The space for
+ * each fragment is obtained from next, in order, and filled in. Returns
+ * false if the packet is malformed or mtu leaves no room for a fragment.
+ */
+func fragmentIPv4(packet []byte, mtu int, next func(size int) []byte) bool {
+	if len(packet) < ipv4.HeaderLen {
+		return false
+	}
+	ihl := int(packet[0]&0x0f) * 4
+	length := int(binary.BigEndian.Uint16(packet[IPv4offsetTotalLength:]))
+	if ihl < ipv4.HeaderLen || length < ihl || length > len(packet) {
+		return false
+	}
+	chunk := (mtu - ihl) &^ 7
+	if chunk <= 0 {
+		return false
+	}
+
+	flags := binary.BigEndian.Uint16(packet[IPv4offsetFlags:])
+	offset := int(flags&ipv4FragmentOffset) * 8
+	payload := packet[ihl:length]
+	for len(payload) > 0 {
+		n := len(payload)
+		more := flags & ipv4FlagMoreFragments
+		if n > chunk {
+			n = chunk
+			more = ipv4FlagMoreFragments
+		}
+
+		frag := next(ihl + n)
+		copy(frag, packet[:ihl])
+		copy(frag[ihl:], payload[:n])
+		binary.BigEndian.PutUint16(frag[IPv4offsetTotalLength:], uint16(ihl+n))
+		binary.BigEndian.PutUint16(frag[IPv4offsetFlags:], more|uint16(offset/8))
+		binary.BigEndian.PutUint16(frag[IPv4offsetChecksum:], 0)
+		binary.BigEndian.PutUint16(frag[IPv4offsetChecksum:], ^checksum(frag[:ihl], 0))
+
+		payload = payload[n:]
+		offset += n
+	}
+	return true
+}
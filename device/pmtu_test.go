@@ -0,0 +1,383 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+/* Returns an IPv4 UDP packet of the given size, with a counting payload.
+ */
+func testIPv4Packet(dst, src net.IP, size int, df bool) []byte {
+	packet := make([]byte, size)
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[IPv4offsetTotalLength:], uint16(size))
+	binary.BigEndian.PutUint16(packet[4:], 0x1234)
+	if df {
+		binary.BigEndian.PutUint16(packet[IPv4offsetFlags:], ipv4FlagDontFragment)
+	}
+	packet[8] = 64
+	packet[9] = 17
+	copy(packet[IPv4offsetSrc:], src.To4())
+	copy(packet[IPv4offsetDst:], dst.To4())
+	binary.BigEndian.PutUint16(packet[IPv4offsetChecksum:], ^checksum(packet[:20], 0))
+	for i := 20; i < size; i++ {
+		packet[i] = byte(i)
+	}
+	return packet
+}
+
+func TestFragmentIPv4(t *testing.T) {
+	packet := testIPv4Packet(net.IPv4(1, 0, 0, 1), net.IPv4(1, 0, 0, 2), 1000, false)
+
+	var frags [][]byte
+	ok := fragmentIPv4(packet, 400, func(size int) []byte {
+		frags = append(frags, make([]byte, size))
+		return frags[len(frags)-1]
+	})
+	if !ok {
+		t.Fatal("packet not fragmented")
+	}
+	if len(frags) != 3 {
+		t.Fatalf("got %d fragments, want 3", len(frags))
+	}
+
+	var payload []byte
+	for i, frag := range frags {
+		if len(frag) > 400 {
+			t.Errorf("fragment %d is %d bytes", i, len(frag))
+		}
+		if checksum(frag[:20], 0) != 0xffff {
+			t.Errorf("fragment %d has a bad header checksum", i)
+		}
+		if int(binary.BigEndian.Uint16(frag[IPv4offsetTotalLength:])) != len(frag) {
+			t.Errorf("fragment %d has a bad total length", i)
+		}
+		flags := binary.BigEndian.Uint16(frag[IPv4offsetFlags:])
+		if int(flags&ipv4FragmentOffset)*8 != len(payload) {
+			t.Errorf("fragment %d has offset %d, want %d", i, int(flags&ipv4FragmentOffset)*8, len(payload))
+		}
+		if more := flags&ipv4FlagMoreFragments != 0; more != (i < len(frags)-1) {
+			t.Errorf("fragment %d has more fragments = %v", i, more)
+		}
+		if !bytes.Equal(frag[4:6], packet[4:6]) || !bytes.Equal(frag[IPv4offsetSrc:20], packet[IPv4offsetSrc:20]) {
+			t.Errorf("fragment %d does not keep the identification and addresses", i)
+		}
+		payload = append(payload, frag[20:]...)
+	}
+	if !bytes.Equal(payload, packet[20:]) {
+		t.Error("fragments do not reassemble to the packet")
+	}
+
+	if fragmentIPv4(packet, 24, func(size int) []byte { return make([]byte, size) }) {
+		t.Error("fragmented with no room for a fragment")
+	}
+}
+
+func TestIsPathMTUProbe(t *testing.T) {
+	probe := make([]byte, 1420)
+	if !isPathMTUProbe(probe) {
+		t.Error("zero padding not taken for a probe")
+	}
+	probe[len(probe)-1] = 1
+	if isPathMTUProbe(probe) {
+		t.Error("packet starting with a zero byte taken for a probe")
+	}
+}
+
+func TestPacketTooBig(t *testing.T) {
+	buff := make([]byte, MaxMessageSize)
+	dst, src := net.IPv4(1, 0, 0, 1), net.IPv4(1, 0, 0, 2)
+
+	packet := testIPv4Packet(dst, src, 1400, true)
+	n := packetTooBig(buff, packet, 1200)
+	if n != ipv4MinReassembly {
+		t.Fatalf("IPv4 reply is %d bytes, want %d", n, ipv4MinReassembly)
+	}
+	reply := buff[:n]
+	if checksum(reply[:20], 0) != 0xffff || checksum(reply[20:], 0) != 0xffff {
+		t.Error("IPv4 reply has a bad checksum")
+	}
+	if !net.IP(reply[IPv4offsetSrc:IPv4offsetDst]).Equal(dst) || !net.IP(reply[IPv4offsetDst:20]).Equal(src) {
+		t.Error("IPv4 reply is not addressed back to the source")
+	}
+	if reply[20] != icmpv4DestinationUnreachable || reply[21] != icmpv4FragmentationNeeded || binary.BigEndian.Uint16(reply[26:]) != 1200 {
+		t.Errorf("IPv4 reply is not fragmentation needed with MTU 1200: % x", reply[20:28])
+	}
+	if !bytes.Equal(reply[28:], packet[:n-28]) {
+		t.Error("IPv4 reply does not quote the packet")
+	}
+
+	binary.BigEndian.PutUint16(packet[IPv4offsetFlags:], ipv4FlagDontFragment|10)
+	if packetTooBig(buff, packet, 1200) != 0 {
+		t.Error("non-initial fragment answered")
+	}
+	if packetTooBig(buff, reply, 500) != 0 {
+		t.Error("ICMP error answered")
+	}
+
+	packet = make([]byte, 1400)
+	packet[0] = 0x60
+	binary.BigEndian.PutUint16(packet[IPv6offsetPayloadLength:], 1400-40)
+	packet[6] = 17
+	packet[IPv6offsetSrc+15] = 2
+	packet[IPv6offsetDst+15] = 1
+	n = packetTooBig(buff, packet, 1300)
+	if n != 1280 {
+		t.Fatalf("IPv6 reply is %d bytes, want 1280", n)
+	}
+	reply = buff[:n]
+	if reply[6] != 58 || reply[40] != icmpv6PacketTooBig || binary.BigEndian.Uint32(reply[44:]) != 1300 {
+		t.Errorf("IPv6 reply is not packet too big with MTU 1300: % x", reply[40:48])
+	}
+	if reply[IPv6offsetSrc+15] != 1 || reply[IPv6offsetDst+15] != 2 {
+		t.Error("IPv6 reply is not addressed back to the source")
+	}
+	pseudo := uint32(checksum(reply[IPv6offsetSrc:40], 0)) + uint32(n-40) + 58
+	if checksum(reply[40:], pseudo) != 0xffff {
+		t.Error("IPv6 reply has a bad checksum")
+	}
+}
+
+/* A bind acting as if the path MTU were mtu, with fragmentation forbidden.
+ */
+type pathMTUTestBind struct {
+	conn.Bind
+	mtu int
+}
+
+func (bind *pathMTUTestBind) SetDontFragment(enabled bool) error { return nil }
+
+func (bind *pathMTUTestBind) PathMTU(end conn.Endpoint) (int, error) { return bind.mtu, nil }
+
+func (bind *pathMTUTestBind) Send(buff []byte, end conn.Endpoint) error {
+	if len(buff)+28 > bind.mtu {
+		return conn.ErrMessageTooBig
+	}
+	return bind.Bind.Send(buff, end)
+}
+
+func TestPathMTUDiscovery(t *testing.T) {
+	tun1 := tuntest.NewChannelTUN()
+	dev1 := NewDevice(tun1.TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev1: "),
+	})
+	dev1.Up()
+	defer dev1.Close()
+	if err := ipcSet(dev1, cfg1); err != nil {
+		t.Fatal(err)
+	}
+
+	tun2 := tuntest.NewChannelTUN()
+	dev2 := NewDevice(tun2.TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev2: "),
+		CreateBind: func(port uint16) (conn.Bind, uint16, error) {
+			bind, port, err := conn.CreateBind(port, nil)
+			if err != nil {
+				return nil, 0, err
+			}
+			return &pathMTUTestBind{Bind: bind, mtu: 1000}, port, nil
+		},
+	})
+	dev2.Up()
+	defer dev2.Close()
+	if err := ipcSet(dev2, "path_mtu_discovery=true\n"+cfg2); err != nil {
+		t.Fatal(err)
+	}
+	changes := make(chan int, 4)
+	dev2.SetPathMTUChangeHandler(func(key wgcfg.Key, mtu int) {
+		changes <- mtu
+	})
+
+	dst, src := net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")
+	tun2.Outbound <- tuntest.Ping(dst, src)
+	select {
+	case <-tun1.Inbound:
+	case <-time.After(time.Second):
+		t.Fatal("ping did not transit")
+	}
+
+	// the probe after the handshake reads back the path MTU
+
+	want := 1000 - 20 - 8 - MessageTransportSize
+	select {
+	case mtu := <-changes:
+		if mtu != want {
+			t.Fatalf("path MTU changed to %d, want %d", mtu, want)
+		}
+	case <-time.After(5 * PathMTUProbeTimeout):
+		t.Fatal("path MTU not discovered")
+	}
+	if get := ipcGet(t, dev2); !strings.Contains(get, "path_mtu_discovery=true\n") || !strings.Contains(get, fmt.Sprintf("path_mtu=%d\n", want)) {
+		t.Errorf("get output missing path MTU discovery:\n%s", get)
+	}
+
+	// packets which may not be fragmented are refused with ICMP
+
+	tun2.Outbound <- testIPv4Packet(dst, src, 1200, true)
+	select {
+	case reply := <-tun2.Inbound:
+		if len(reply) < 28 || reply[20] != icmpv4DestinationUnreachable || reply[21] != icmpv4FragmentationNeeded || int(binary.BigEndian.Uint16(reply[26:])) != want {
+			t.Errorf("unexpected reply to oversized packet: % x", reply)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no ICMP reply to oversized packet")
+	}
+
+	// others are fragmented to fit
+
+	packet := testIPv4Packet(dst, src, 1200, false)
+	tun2.Outbound <- packet
+	var payload []byte
+	for len(payload) < len(packet)-20 {
+		select {
+		case frag := <-tun1.Inbound:
+			if len(frag) > want {
+				t.Errorf("fragment of %d bytes exceeds path MTU", len(frag))
+			}
+			payload = append(payload, frag[20:]...)
+		case <-time.After(time.Second):
+			t.Fatal("fragments did not transit")
+		}
+	}
+	if !bytes.Equal(payload, packet[20:]) {
+		t.Error("fragments do not reassemble to the packet")
+	}
+
+	// probes are keepalives to the receiver
+
+	peer1 := dev1.LookupPeer(mustParseHexKey(t, "f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725"))
+	peer2 := dev2.LookupPeer(mustParseHexKey(t, "49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427"))
+	rx := atomic.LoadUint64(&peer1.stats.rxPackets)
+	if !peer2.sendPathMTUProbe() {
+		t.Fatal("probe not sent")
+	}
+	for deadline := time.Now().Add(time.Second); atomic.LoadUint64(&peer1.stats.rxPackets) == rx; {
+		if time.Now().After(deadline) {
+			t.Fatal("probe not received")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case packet := <-tun1.Inbound:
+		t.Errorf("probe delivered to the TUN device: % x", packet)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// disabling restores the TUN MTU
+
+	if err := ipcSet(dev2, "path_mtu_discovery=false\n"); err != nil {
+		t.Fatal(err)
+	}
+	if mtu := <-changes; mtu != DefaultMTU {
+		t.Errorf("MTU restored to %d, want %d", mtu, DefaultMTU)
+	}
+}
+
+func TestOversizeICMP(t *testing.T) {
+	tun1 := tuntest.NewChannelTUN()
+	dev1 := NewDevice(tun1.TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev1: "),
+	})
+	dev1.Up()
+	defer dev1.Close()
+	if err := ipcSet(dev1, cfg1); err != nil {
+		t.Fatal(err)
+	}
+
+	tun2 := tuntest.NewChannelTUN()
+	dev2 := NewDevice(tun2.TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev2: "),
+	})
+	dev2.Up()
+	defer dev2.Close()
+	if err := ipcSet(dev2, cfg2+"\nallowed_ip=fd00::1/128\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, src := net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")
+	size := DefaultMTU + 80
+
+	// packets allowed to be fragmented are sent as they are
+
+	packet := testIPv4Packet(dst, src, size, false)
+	tun2.Outbound <- packet
+	select {
+	case got := <-tun1.Inbound:
+		if !bytes.Equal(got, packet) {
+			t.Error("oversized packet altered in transit")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("oversized packet did not transit")
+	}
+
+	// others are answered with ICMP reporting the TUN MTU
+
+	tun2.Outbound <- testIPv4Packet(dst, src, size, true)
+	select {
+	case reply := <-tun2.Inbound:
+		if len(reply) < 28 || reply[20] != icmpv4DestinationUnreachable || reply[21] != icmpv4FragmentationNeeded || int(binary.BigEndian.Uint16(reply[26:])) != DefaultMTU {
+			t.Errorf("unexpected reply to oversized IPv4 packet: % x", reply)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no ICMP reply to oversized IPv4 packet")
+	}
+
+	packet = make([]byte, size)
+	packet[0] = 0x60
+	binary.BigEndian.PutUint16(packet[IPv6offsetPayloadLength:], uint16(size-40))
+	packet[6] = 17
+	copy(packet[IPv6offsetSrc:], net.ParseIP("fd00::2"))
+	copy(packet[IPv6offsetDst:], net.ParseIP("fd00::1"))
+	tun2.Outbound <- packet
+	select {
+	case reply := <-tun2.Inbound:
+		if len(reply) < 48 || reply[40] != icmpv6PacketTooBig || int(binary.BigEndian.Uint32(reply[44:])) != DefaultMTU {
+			t.Errorf("unexpected reply to oversized IPv6 packet: % x", reply)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no ICMP reply to oversized IPv6 packet")
+	}
+	select {
+	case got := <-tun1.Inbound:
+		t.Errorf("oversized packet transited: % x", got)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// replies are rate limited
+
+	dev2.rate.icmp.Lock()
+	dev2.rate.icmp.limit.Fill = time.Hour
+	dev2.rate.icmp.Unlock()
+	go func() {
+		for i := 0; i < 2*ICMPErrorBurst; i++ {
+			tun2.Outbound <- testIPv4Packet(dst, src, size, true)
+		}
+	}()
+	replies := 0
+	for done := false; !done; {
+		select {
+		case <-tun2.Inbound:
+			replies++
+		case <-time.After(100 * time.Millisecond):
+			done = true
+		}
+	}
+	if replies >= 2*ICMPErrorBurst {
+		t.Errorf("got %d replies to a burst of %d", replies, 2*ICMPErrorBurst)
+	}
+}
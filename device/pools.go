@@ -5,15 +5,76 @@
 
 package device
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+)
+
+/* Message buffers fit the packets of the MTU the TUN device had when they
+ * were handed out, with room for the transport header, padding and the
+ * authentication tag, rather than the largest possible datagram. Buffers
+ * are slices, so that the size can follow the MTU, kept on a free list
+ * rather than a sync.Pool, which would allocate to hold each slice.
+ * Datagrams which fill a buffer, from peers with a larger MTU still, may
+ * have been truncated by the bind, and are counted as DropTruncated.
+ *
+ * Packets are read from and written to the TUN device at the packet
+ * offset of the device into buffers, MessageTransportHeaderSize unless
+ * set otherwise with DeviceOptions.PacketOffset. The transport header is
+ * written just before the packet, which is encrypted in place, so the
+ * transport message starts at the headroom, the offset less the header,
+ * and the same holds of datagrams received. Buffers are larger than
+ * messageBufferSize by the headroom.
+ */
+
+const (
+	messageBufferOverhead = MessageTransportSize + PaddingMultiple
+	messageBufferMinMTU   = 1500 // that of Ethernet, which peers not using jumbo frames stay within
+)
+
+/* Returns the size of message buffers for mtu, no smaller than for
+ * messageBufferMinMTU so that packets of peers with a larger MTU than ours
+ * still fit, unless they use jumbo frames. A TUN device may report an MTU
+ * above MaxMTU, which only limits the MTU set, so buffers grow up to
+ * MaxMessageSize for it.
+ */
+func messageBufferSize(mtu int) int {
+	if mtu < messageBufferMinMTU {
+		mtu = messageBufferMinMTU
+	}
+	if mtu > MaxMessageSize-messageBufferOverhead {
+		mtu = MaxMessageSize - messageBufferOverhead
+	}
+	return mtu + messageBufferOverhead
+}
+
+/* Sizes the message buffers handed out from now on for mtu, unless they
+ * are already larger: buffers stay sized for the largest MTU seen, as
+ * peers keep sending packets of the previous MTU until reconfigured, and
+ * packets already queued by the TUN device may be of it. Smaller buffers
+ * are replaced as they are next handed out, or renewed by the readers
+ * holding them, which take one more packet into them first.
+ */
+func (device *Device) resizeMessageBuffers(mtu int) {
+	size := int32(messageBufferSize(mtu) + device.headroom())
+	for {
+		old := atomic.LoadInt32(&device.pool.messageBufferSize)
+		if old >= size || atomic.CompareAndSwapInt32(&device.pool.messageBufferSize, old, size) {
+			return
+		}
+	}
+}
+
+/* Returns the bytes before the transport header in message buffers.
+ */
+func (device *Device) headroom() int {
+	return device.pool.packetOffset - MessageTransportHeaderSize
+}
 
 func (device *Device) PopulatePools() {
+	size := int(atomic.LoadInt32(&device.pool.messageBufferSize))
 	if PreallocatedBuffersPerPool == 0 {
-		device.pool.messageBufferPool = &sync.Pool{
-			New: func() interface{} {
-				return new([MaxMessageSize]byte)
-			},
-		}
+		device.pool.messageBufferReuseChan = make(chan []byte, MessageBuffersKept)
 		device.pool.inboundElementPool = &sync.Pool{
 			New: func() interface{} {
 				return new(QueueInboundElement)
@@ -25,9 +86,9 @@ func (device *Device) PopulatePools() {
 			},
 		}
 	} else {
-		device.pool.messageBufferReuseChan = make(chan *[MaxMessageSize]byte, PreallocatedBuffersPerPool)
+		device.pool.messageBufferReuseChan = make(chan []byte, PreallocatedBuffersPerPool)
 		for i := 0; i < PreallocatedBuffersPerPool; i += 1 {
-			device.pool.messageBufferReuseChan <- new([MaxMessageSize]byte)
+			device.pool.messageBufferReuseChan <- make([]byte, size)
 		}
 		device.pool.inboundElementReuseChan = make(chan *QueueInboundElement, PreallocatedBuffersPerPool)
 		for i := 0; i < PreallocatedBuffersPerPool; i += 1 {
@@ -40,17 +101,40 @@ func (device *Device) PopulatePools() {
 	}
 }
 
-func (device *Device) GetMessageBuffer() *[MaxMessageSize]byte {
+func (device *Device) GetMessageBuffer() []byte {
+	var msg []byte
 	if PreallocatedBuffersPerPool == 0 {
-		return device.pool.messageBufferPool.Get().(*[MaxMessageSize]byte)
+		select {
+		case msg = <-device.pool.messageBufferReuseChan:
+		default:
+		}
 	} else {
-		return <-device.pool.messageBufferReuseChan
+		msg = <-device.pool.messageBufferReuseChan
 	}
+	size := int(atomic.LoadInt32(&device.pool.messageBufferSize))
+	if cap(msg) < size {
+		msg = make([]byte, size)
+	}
+	return msg[:size]
 }
 
-func (device *Device) PutMessageBuffer(msg *[MaxMessageSize]byte) {
+/* Returns msg, or a buffer in its place if the MTU was raised beyond its
+ * size since it was handed out.
+ */
+func (device *Device) renewMessageBuffer(msg []byte) []byte {
+	if len(msg) >= int(atomic.LoadInt32(&device.pool.messageBufferSize)) {
+		return msg
+	}
+	device.PutMessageBuffer(msg)
+	return device.GetMessageBuffer()
+}
+
+func (device *Device) PutMessageBuffer(msg []byte) {
 	if PreallocatedBuffersPerPool == 0 {
-		device.pool.messageBufferPool.Put(msg)
+		select {
+		case device.pool.messageBufferReuseChan <- msg:
+		default:
+		}
 	} else {
 		device.pool.messageBufferReuseChan <- msg
 	}
@@ -81,6 +165,10 @@ func (device *Device) GetOutboundElement() *QueueOutboundElement {
 }
 
 func (device *Device) PutOutboundElement(msg *QueueOutboundElement) {
+	if msg.done != nil {
+		close(msg.done)
+		msg.done = nil
+	}
 	if PreallocatedBuffersPerPool == 0 {
 		device.pool.outboundElementPool.Put(msg)
 	} else {
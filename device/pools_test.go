@@ -0,0 +1,233 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+func TestMessageBufferSize(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelSilent, "dev: "),
+	})
+	defer device.Close()
+
+	tests := []struct {
+		mtu, want int
+	}{
+		{MinMTU, messageBufferMinMTU + messageBufferOverhead},
+		{9000, 9000 + messageBufferOverhead},
+		{MaxMTU, MaxMTU + messageBufferOverhead},
+	}
+	for _, tt := range tests {
+		device.resizeMessageBuffers(tt.mtu)
+		if got := len(device.GetMessageBuffer()); got != tt.want {
+			t.Errorf("MTU %d: buffer of %d bytes, want %d", tt.mtu, got, tt.want)
+		}
+	}
+
+	// buffers are reused, unless too small for a raised MTU
+
+	device.resizeMessageBuffers(9000)
+	buffer := device.GetMessageBuffer()
+	device.PutMessageBuffer(buffer)
+	if reused := device.GetMessageBuffer(); &reused[0] != &buffer[0] {
+		t.Error("buffer not reused")
+	} else {
+		device.PutMessageBuffer(reused)
+	}
+	device.resizeMessageBuffers(MaxMTU)
+	if got := len(device.GetMessageBuffer()); got != MaxMTU+messageBufferOverhead {
+		t.Errorf("buffer of %d bytes after raising the MTU", got)
+	}
+
+	// the hot path allocates nothing once buffers are in circulation
+
+	device.resizeMessageBuffers(9000)
+	allocs := testing.AllocsPerRun(100, func() {
+		device.PutMessageBuffer(device.GetMessageBuffer())
+	})
+	if allocs != 0 {
+		t.Errorf("%v allocations per buffer", allocs)
+	}
+}
+
+func TestMessageBufferSizeOverMaxMTU(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelSilent, "dev: "),
+	})
+	defer device.Close()
+
+	// a TUN device may report an MTU above those which may be set
+
+	device.updateMTU(16000)
+	if got := len(device.GetMessageBuffer()) - device.headroom(); got != 16000+messageBufferOverhead {
+		t.Errorf("buffer of %d bytes for MTU 16000", got)
+	}
+	device.updateMTU(1 << 16)
+	if got := len(device.GetMessageBuffer()) - device.headroom(); got != MaxMessageSize {
+		t.Errorf("buffer of %d bytes for MTU %d, want %d", got, 1<<16, MaxMessageSize)
+	}
+}
+
+func TestTruncatedDatagram(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelSilent, "dev: "),
+	})
+	defer device.Close()
+
+	// a datagram filling the buffer is taken to be cut short
+
+	buffer := device.GetMessageBuffer()
+	room := len(buffer) - device.headroom()
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	if device.handleIncoming(buffer, room, nil, addr, 0) {
+		t.Fatal("datagram filling the buffer queued")
+	}
+	if drops := device.Metrics().Drops[DropTruncated]; drops != 1 {
+		t.Errorf("%d datagrams dropped as truncated, want 1", drops)
+	}
+	device.PutMessageBuffer(buffer)
+}
+
+func TestJumboFrames(t *testing.T) {
+	for _, mtu := range []int{9000, 16000} {
+		network := bindtest.NewNetwork(1)
+		var devs [2]*Device
+		var tuns [2]*tuntest.ChannelTUN
+		for i, cfg := range []string{cfg1, cfg2} {
+			tuns[i] = tuntest.NewChannelTUN()
+			tunDevice := tuns[i].TUN()
+			if err := tunDevice.(tun.MTUDevice).SetMTU(mtu); err != nil {
+				t.Fatal(err)
+			}
+			devs[i] = NewDevice(tunDevice, &DeviceOptions{
+				Logger:         NewLogger(LogLevelError, "dev: "),
+				CreateBind:     network.CreateBind,
+				CreateEndpoint: network.CreateEndpoint,
+			})
+			defer devs[i].Close()
+			devs[i].Up()
+			if err := ipcSet(devs[i], cfg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tun1, tun2 := tuns[0], tuns[1]
+
+		packet := testIPv4Packet(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"), mtu, true)
+		tun2.Outbound <- packet
+		select {
+		case got := <-tun1.Inbound:
+			if !bytes.Equal(got, packet) {
+				t.Errorf("jumbo frame of %d bytes altered in transit", mtu)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("jumbo frame of %d bytes did not transit", mtu)
+		}
+	}
+}
+
+func BenchmarkMessageBufferJumbo(b *testing.B) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelSilent, "dev: "),
+	})
+	defer device.Close()
+	device.resizeMessageBuffers(9000)
+
+	b.ReportAllocs()
+	b.SetBytes(9000)
+	for i := 0; i < b.N; i++ {
+		buffer := device.GetMessageBuffer()
+		buffer[MessageTransportHeaderSize] = byte(i)
+		device.PutMessageBuffer(buffer)
+	}
+}
+
+/* A TUN device checking the packet offset of the buffers it is passed,
+ * and writing over the headroom before it, which it owns.
+ */
+type offsetTUN struct {
+	tun.Device
+	offset int
+	wrong  int32 // atomic, count of reads and writes at another offset
+}
+
+func (t *offsetTUN) check(buff []byte, offset int) {
+	if offset != t.offset {
+		atomic.AddInt32(&t.wrong, 1)
+		return
+	}
+	for i := range buff[:offset] {
+		buff[i] = 0xff
+	}
+}
+
+func (t *offsetTUN) Read(buff []byte, offset int) (int, error) {
+	t.check(buff, offset)
+	return t.Device.Read(buff, offset)
+}
+
+func (t *offsetTUN) Write(buff []byte, offset int) (int, error) {
+	t.check(buff, offset)
+	return t.Device.Write(buff, offset)
+}
+
+func TestPacketOffset(t *testing.T) {
+	network := bindtest.NewNetwork(1)
+	var devs [2]*Device
+	var tuns [2]*tuntest.ChannelTUN
+	offsetDevice := &offsetTUN{offset: 64}
+	for i, cfg := range []string{cfg1, cfg2} {
+		tuns[i] = tuntest.NewChannelTUN()
+		tunDevice := tuns[i].TUN()
+		packetOffset := 0
+		if i == 1 {
+			offsetDevice.Device = tunDevice
+			tunDevice, packetOffset = offsetDevice, offsetDevice.offset
+		}
+		devs[i] = NewDevice(tunDevice, &DeviceOptions{
+			Logger:         NewLogger(LogLevelError, "dev: "),
+			CreateBind:     network.CreateBind,
+			CreateEndpoint: network.CreateEndpoint,
+			PacketOffset:   packetOffset,
+		})
+		defer devs[i].Close()
+		devs[i].Up()
+		if err := ipcSet(devs[i], cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tun1, tun2 := tuns[0], tuns[1]
+	mtu, _ := tun1.TUN().MTU()
+
+	// packets of the MTU transit both ways, between devices of either offset
+
+	transit := func(from, to *tuntest.ChannelTUN, packet []byte) {
+		t.Helper()
+		from.Outbound <- packet
+		select {
+		case got := <-to.Inbound:
+			if !bytes.Equal(got, packet) {
+				t.Error("packet altered in transit")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("packet did not transit")
+		}
+	}
+	transit(tun2, tun1, testIPv4Packet(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"), mtu, true))
+	transit(tun1, tun2, testIPv4Packet(net.ParseIP("1.0.0.2"), net.ParseIP("1.0.0.1"), mtu, true))
+	if wrong := atomic.LoadInt32(&offsetDevice.wrong); wrong != 0 {
+		t.Errorf("%d packets at another offset", wrong)
+	}
+}
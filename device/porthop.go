@@ -0,0 +1,105 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"time"
+)
+
+/* Port hopping, enabled with port_hop_interval, moves the device to a new
+ * ephemeral source port at every interval, so that middleboxes blocking
+ * long-lived UDP flows see a succession of short ones. At each hop the
+ * bind is recreated on a port of the system's choosing, and the peers with
+ * a session are sent a keepalive from it at once: the keepalive is
+ * authenticated, so the far side roams to the new port on receiving it,
+ * and NATs on the way map the new flow. Peers without a session handshake
+ * from the new port when they next have something to send.
+ *
+ * The listening port is replaced at each hop, so hopping suits devices
+ * which initiate to their peers, not those reached at a known port; any
+ * further ports listened on are kept. Every hop costs a keepalive per
+ * peer, and a handshake for those whose NAT mapping must be made anew,
+ * so short intervals add traffic. Hopping only defeats blocking keyed on
+ * the lifetime of a flow: it does nothing against blocking by content.
+ */
+
+func (device *Device) portHopInterval() time.Duration {
+	device.portHop.Lock()
+	defer device.portHop.Unlock()
+	return device.portHop.interval
+}
+
+/* Sets the port hop interval, rearming the hop timer. Zero disables
+ * hopping.
+ */
+func (device *Device) setPortHopInterval(interval time.Duration) {
+	ph := &device.portHop
+	ph.Lock()
+	defer ph.Unlock()
+	if ph.interval == interval {
+		return
+	}
+	ph.interval = interval
+	if ph.timer != nil {
+		ph.timer.Stop()
+		ph.timer = nil
+	}
+	if interval > 0 {
+		ph.timer = time.AfterFunc(interval, device.portHopExpired)
+	}
+}
+
+func (device *Device) portHopExpired() {
+	device.hopPort()
+
+	ph := &device.portHop
+	ph.Lock()
+	defer ph.Unlock()
+	if ph.timer != nil && !device.isClosed.Get() {
+		ph.timer.Reset(ph.interval)
+	}
+}
+
+/* Rebinds to a new ephemeral port, and sends a keepalive to the peers with
+ * a session, so that they roam to it. Returns whether the device hopped.
+ */
+func (device *Device) hopPort() bool {
+	device.state.Lock()
+	defer device.state.Unlock()
+
+	if device.isClosed.Get() || !device.state.current || device.isPaused.Get() {
+		return false
+	}
+
+	device.net.Lock()
+	old := device.net.port
+	device.net.port = 0
+	device.net.lastPort = 0 // not sticky
+	device.net.Unlock()
+
+	if err := device.BindUpdate(); err != nil {
+		device.log.Errorf("Failed to hop from port %d: %v", old, err)
+		device.net.Lock()
+		device.net.port = old
+		device.net.Unlock()
+		if err := device.BindUpdate(); err != nil {
+			device.log.Errorf("Failed to restore bind: %v", err)
+		}
+		return false
+	}
+	device.net.RLock()
+	device.log.Verbosef("Hopped from port %d to %d", old, device.net.port)
+	device.net.RUnlock()
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.keyMap {
+		if peer.timersActive() && peer.keypairs.Current() != nil {
+			peer.SendKeepalive()
+		}
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+func TestPortHop(t *testing.T) {
+	dst, src := net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")
+	dev1, tun1, dev2, tun2 := newBindTestPair(t, bindtest.NewNetwork(1))
+	defer dev1.Close()
+	defer dev2.Close()
+
+	if err := ipcSet(dev2, "port_hop_interval=500\n"); err == nil {
+		t.Error("interval below the minimum set")
+	}
+	if err := ipcSet(dev2, "port_hop_interval=60000\n"); err != nil {
+		t.Fatal(err)
+	}
+	if get := ipcGet(t, dev2); !strings.Contains(get, "port_hop_interval=60000\n") {
+		t.Errorf("port_hop_interval missing from get:\n%s", get)
+	}
+
+	tun2.Outbound <- tuntest.Ping(dst, src)
+	select {
+	case <-tun1.Inbound:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ping did not transit")
+	}
+
+	// the far side follows the hop on the keepalive sent from the new port
+
+	if !dev2.hopPort() {
+		t.Fatal("did not hop")
+	}
+	port := dev2.net.port
+	if port == 53512 {
+		t.Fatal("hopped to the same port")
+	}
+	want := fmt.Sprintf("\nendpoint=127.0.0.1:%d\n", port)
+	for deadline := time.Now().Add(2 * time.Second); !strings.Contains(ipcGet(t, dev1), want); {
+		if time.Now().After(deadline) {
+			t.Fatalf("peer did not roam to port %d:\n%s", port, ipcGet(t, dev1))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tun1.Outbound <- tuntest.Ping(src, dst)
+	select {
+	case <-tun2.Inbound:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ping did not transit after the hop")
+	}
+	if completed := dev2.Metrics().HandshakesCompleted; completed != 1 {
+		t.Errorf("%d handshakes completed, want the session kept", completed)
+	}
+
+	if err := ipcSet(dev2, "port_hop_interval=0\n"); err != nil {
+		t.Fatal(err)
+	}
+	if get := ipcGet(t, dev2); strings.Contains(get, "port_hop_interval") {
+		t.Errorf("port hopping still enabled:\n%s", get)
+	}
+}
@@ -0,0 +1,110 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+/* Returns a pair of devices which have completed a handshake, with the
+ * peer of the first for the second, and the TUN the first writes to.
+ */
+func newProcessPair(tb testing.TB) (*Device, *Peer, *tuntest.ChannelTUN, *Device) {
+	dst, src := net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")
+	dev1, tun1, dev2, tun2 := newBindTestPair(tb, bindtest.NewNetwork(1))
+	tun2.Outbound <- tuntest.Ping(dst, src)
+	select {
+	case <-tun1.Inbound:
+	case <-time.After(2 * time.Second):
+		tb.Fatal("ping did not transit")
+	}
+	return dev1, dev1.LookupPeer(dev2.staticIdentity.publicKey), tun1, dev2
+}
+
+func TestProcessPacket(t *testing.T) {
+	dst, src := net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")
+	dev1, peer, tun1, dev2 := newProcessPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	ping := tuntest.Ping(dst, src)
+	msg := dev2.processOutbound(ping)
+	if msg == nil {
+		t.Fatal("packet not sent")
+	}
+	if dev2.processOutbound(tuntest.Ping(net.ParseIP("192.0.2.1"), src)) != nil {
+		t.Error("packet to no peer sent")
+	}
+
+	received := make(chan []byte, 1)
+	go func() { received <- <-tun1.Inbound }()
+	if !dev1.processInbound(peer, msg) {
+		t.Fatal("transport message dropped")
+	}
+	select {
+	case packet := <-received:
+		if !bytes.Equal(packet, ping) {
+			t.Errorf("received %x, want %x", packet, ping)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("packet not written to TUN")
+	}
+
+	// replays and malformed messages never reach the TUN
+
+	dev1.processInbound(peer, msg)
+	corrupt := append([]byte(nil), msg...)
+	corrupt[len(corrupt)-1] ^= 1
+	dev1.processInbound(peer, corrupt)
+	if dev1.processInbound(peer, msg[:MessageTransportSize-1]) {
+		t.Error("short transport message not dropped")
+	}
+	drops := dev1.Metrics().Drops
+	if drops[DropReplay] != 1 || drops[DropDecrypt] != 1 {
+		t.Errorf("wrong drop counts: %v", drops)
+	}
+}
+
+func BenchmarkProcessOutbound(b *testing.B) {
+	dev1, _, _, dev2 := newProcessPair(b)
+	defer dev1.Close()
+	defer dev2.Close()
+	ping := tuntest.Ping(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"))
+
+	b.SetBytes(int64(len(ping)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dev2.processOutbound(ping)
+	}
+}
+
+func BenchmarkProcessInbound(b *testing.B) {
+	dev1, peer, tun1, dev2 := newProcessPair(b)
+	defer dev1.Close()
+	defer dev2.Close()
+	ping := tuntest.Ping(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"))
+
+	msgs := make([][]byte, b.N)
+	for i := range msgs {
+		msgs[i] = dev2.processOutbound(ping)
+	}
+	go func() {
+		for range tun1.Inbound {
+		}
+	}()
+
+	b.SetBytes(int64(len(ping)))
+	b.ResetTimer()
+	for _, msg := range msgs {
+		dev1.processInbound(peer, msg)
+	}
+}
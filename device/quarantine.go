@@ -0,0 +1,191 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* Quarantine, enabled with quarantine_threshold=<failures>, drops the
+ * datagrams of a source address which failed authentication that many
+ * times within quarantine_window, for the next quarantine_window, as soon
+ * as they are received and before any cryptography. Failures are
+ * handshake messages with an invalid mac1 and transport messages which
+ * fail to decrypt, so that floods of either cost little. The handshake rate
+ * limiter does not help with them, as it only limits valid handshakes.
+ *
+ * Failures are counted from the first one of a source, for a window,
+ * after which the count starts over, so that legitimate peers failing now
+ * and then, as on a lost session, are never quarantined. Those which are
+ * are let in again after a window. Sources are tracked by address, in a
+ * table of at most MaxQuarantineAddrs, whose expired entries are
+ * collected as failures are counted. Once it is full, further sources are
+ * not tracked until entries expire.
+ *
+ * A source address may be forged, so a flood sent in the name of a peer
+ * quarantines it too. Thresholds should be set with that in mind.
+ */
+
+type quarantineSource struct {
+	start    time.Time // first failure of the current window
+	failures int       // failures since start
+	until    time.Time // end of the quarantine, zero if not quarantined
+}
+
+type quarantine struct {
+	sync.Mutex
+	threshold   int           // failures within window quarantining a source, 0 to never
+	window      time.Duration // zero for QuarantineWindow
+	sources     map[[net.IPv6len]byte]*quarantineSource
+	collected   time.Time // when expired sources were last collected
+	quarantined int32     // sources with an end of quarantine set; atomic, to skip lookups while none are
+}
+
+func quarantineKey(ip net.IP) (key [net.IPv6len]byte) {
+	copy(key[:], ip.To16())
+	return key
+}
+
+func (q *quarantine) windowLocked() time.Duration {
+	if q.window == 0 {
+		return QuarantineWindow
+	}
+	return q.window
+}
+
+/* Reports whether datagrams from ip are to be dropped.
+ */
+func (q *quarantine) holds(ip net.IP) bool {
+	if atomic.LoadInt32(&q.quarantined) == 0 {
+		return false
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	key := quarantineKey(ip)
+	source := q.sources[key]
+	if source == nil || source.until.IsZero() {
+		return false
+	}
+	if time.Now().Before(source.until) {
+		return true
+	}
+	delete(q.sources, key)
+	atomic.AddInt32(&q.quarantined, -1)
+	return false
+}
+
+/* Counts an authentication failure of ip. Returns whether it quarantined
+ * ip.
+ */
+func (q *quarantine) fail(ip net.IP) bool {
+	q.Lock()
+	defer q.Unlock()
+	if q.threshold == 0 {
+		return false
+	}
+
+	now := time.Now()
+	window := q.windowLocked()
+	if now.Sub(q.collected) > window {
+		q.collect(now, window)
+	}
+
+	key := quarantineKey(ip)
+	source := q.sources[key]
+	if source == nil {
+		if len(q.sources) >= MaxQuarantineAddrs {
+			return false
+		}
+		if q.sources == nil {
+			q.sources = make(map[[net.IPv6len]byte]*quarantineSource)
+		}
+		source = &quarantineSource{start: now}
+		q.sources[key] = source
+	}
+	if !source.until.IsZero() {
+		return false
+	}
+	if now.Sub(source.start) > window {
+		source.start = now
+		source.failures = 0
+	}
+	source.failures++
+	if source.failures < q.threshold {
+		return false
+	}
+	source.until = now.Add(window)
+	atomic.AddInt32(&q.quarantined, 1)
+	return true
+}
+
+/* Deletes the sources whose window and quarantine are over.
+ */
+func (q *quarantine) collect(now time.Time, window time.Duration) {
+	for key, source := range q.sources {
+		if source.until.IsZero() {
+			if now.Sub(source.start) > window {
+				delete(q.sources, key)
+			}
+		} else if !now.Before(source.until) {
+			delete(q.sources, key)
+			atomic.AddInt32(&q.quarantined, -1)
+		}
+	}
+	q.collected = now
+}
+
+/* Sets the failures within window which quarantine a source, zero to
+ * never, which releases all sources.
+ */
+func (q *quarantine) setLimits(threshold int, window time.Duration) {
+	q.Lock()
+	defer q.Unlock()
+	q.threshold = threshold
+	q.window = window
+	if threshold == 0 {
+		q.sources = nil
+		atomic.StoreInt32(&q.quarantined, 0)
+	}
+}
+
+func (q *quarantine) limits() (threshold int, window time.Duration) {
+	q.Lock()
+	defer q.Unlock()
+	return q.threshold, q.window
+}
+
+/* Returns the number of sources currently quarantined.
+ */
+func (q *quarantine) count() int {
+	q.Lock()
+	defer q.Unlock()
+	now := time.Now()
+	n := 0
+	for _, source := range q.sources {
+		if now.Before(source.until) {
+			n++
+		}
+	}
+	return n
+}
+
+/* Counts an authentication failure of the source addr, logging it if it
+ * is quarantined for it.
+ */
+func (device *Device) authenticationFailed(addr *net.UDPAddr) {
+	if addr == nil || !device.quarantine.fail(addr.IP) {
+		return
+	}
+	_, window := device.quarantine.limits()
+	if window == 0 {
+		window = QuarantineWindow
+	}
+	device.log.Verbosef("Quarantining %v for %v after repeated authentication failures", addr.IP, window)
+}
@@ -0,0 +1,118 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+func TestQuarantine(t *testing.T) {
+	var q quarantine
+	ip, other := net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")
+	if q.fail(ip) || q.holds(ip) {
+		t.Fatal("quarantined while disabled")
+	}
+
+	q.setLimits(3, 50*time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if q.fail(ip) {
+			t.Fatalf("quarantined after %d failures", i+1)
+		}
+	}
+	if !q.fail(ip) {
+		t.Fatal("not quarantined at the threshold")
+	}
+	if !q.holds(ip) || q.holds(other) || q.count() != 1 {
+		t.Errorf("holds %v, %v, count %d", q.holds(ip), q.holds(other), q.count())
+	}
+	time.Sleep(60 * time.Millisecond)
+	if q.holds(ip) || q.count() != 0 {
+		t.Error("quarantine did not expire")
+	}
+
+	// failures spread over more than a window never add up
+
+	for i := 0; i < 2; i++ {
+		q.fail(other)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if q.fail(other) || q.fail(other) {
+		t.Error("quarantined for failures of an earlier window")
+	}
+}
+
+func TestUAPIQuarantine(t *testing.T) {
+	network := bindtest.NewNetwork(1)
+	dev1, tun1, dev2, tun2 := newBindTestPair(t, network)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	if err := ipcSet(dev1, "quarantine_threshold=2\nquarantine_window=60000\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipcSet(dev1, "quarantine_window=0\n"); err == nil {
+		t.Error("zero quarantine_window accepted")
+	}
+
+	// initiations with an invalid mac1, from the address of the peer
+
+	bind, _, err := network.CreateBind(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+	endpoint, err := bindtest.CreateEndpoint("127.0.0.1:53511")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := make([]byte, MessageInitiationSize)
+	binary.LittleEndian.PutUint32(forged, MessageInitiationType)
+	send := func() {
+		if err := bind.Send(forged, endpoint); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send()
+	send()
+	for deadline := time.Now().Add(time.Second); dev1.quarantine.count() != 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("address not quarantined")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	send()
+	for deadline := time.Now().Add(time.Second); dev1.Metrics().Drops[DropQuarantined] != 1; {
+		if time.Now().After(deadline) {
+			t.Fatalf("quarantine not applied: %v", dev1.Metrics().Drops)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	get := ipcGet(t, dev1)
+	for _, line := range []string{"\nquarantine_threshold=2\n", "\nquarantine_window=60000\n", "\nquarantined_sources=1\n", "\ninvalid_mac_packets=2\n"} {
+		if !strings.Contains(get, line) {
+			t.Errorf("get output missing %q:\n%s", line, get)
+		}
+	}
+
+	// disabling quarantine releases the address, and the peer with it
+
+	if err := ipcSet(dev1, "quarantine_threshold=0\n"); err != nil {
+		t.Fatal(err)
+	}
+	tun2.Outbound <- tuntest.Ping(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"))
+	select {
+	case <-tun1.Inbound:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ping did not transit")
+	}
+}
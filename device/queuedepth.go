@@ -0,0 +1,74 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+)
+
+/* The depth of each queue is read off its channel, and its high
+ * watermark is raised by whoever queues to it, after queueing. Queues
+ * consistently near their capacity show the workers draining them are
+ * not keeping up: the crypto queues are drained by one worker per CPU,
+ * the peer queues by a single worker each.
+ */
+
+// QueueDepth is the length of a queue at a point in time.
+type QueueDepth struct {
+	Len  int // elements queued
+	High int // most elements queued at once, since the stats were last reset
+	Cap  int // capacity of the queue
+}
+
+type queueWatermark uint32
+
+func (w *queueWatermark) observe(depth int) {
+	for {
+		high := atomic.LoadUint32((*uint32)(w))
+		if uint32(depth) <= high || atomic.CompareAndSwapUint32((*uint32)(w), high, uint32(depth)) {
+			return
+		}
+	}
+}
+
+func (w *queueWatermark) load() int {
+	return int(atomic.LoadUint32((*uint32)(w)))
+}
+
+func (w *queueWatermark) reset() {
+	atomic.StoreUint32((*uint32)(w), 0)
+}
+
+/* Returns the depths of the encryption, decryption and handshake queues
+ * of the device.
+ */
+func (device *Device) queueDepths() (encryption, decryption, handshake QueueDepth) {
+	q := &device.queue
+	encryption = QueueDepth{len(q.encryption), q.encryptionHigh.load(), cap(q.encryption)}
+	decryption = QueueDepth{len(q.decryption), q.decryptionHigh.load(), cap(q.decryption)}
+	handshake = QueueDepth{len(q.handshake), q.handshakeHigh.load(), cap(q.handshake)}
+	return
+}
+
+/* The queues of a peer, stored as the peer starts, so that their depths
+ * can be read without racing with the peer making them anew.
+ */
+type peerQueues struct {
+	nonce    chan *QueueOutboundElement
+	outbound chan *QueueOutboundElement
+	inbound  chan *QueueInboundElement
+}
+
+/* Returns the depths of the nonce, outbound and inbound queues of the
+ * peer, which are all empty if it was never started.
+ */
+func (peer *Peer) queueDepths() (nonce, outbound, inbound QueueDepth) {
+	q, _ := peer.queue.current.Load().(peerQueues)
+	nonce = QueueDepth{len(q.nonce), peer.queue.nonceHigh.load(), cap(q.nonce)}
+	outbound = QueueDepth{len(q.outbound), peer.queue.outboundHigh.load(), cap(q.outbound)}
+	inbound = QueueDepth{len(q.inbound), peer.queue.inboundHigh.load(), cap(q.inbound)}
+	return
+}
@@ -0,0 +1,74 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+func TestQueueWatermark(t *testing.T) {
+	var w queueWatermark
+	for _, depth := range []int{3, 1, 7, 5} {
+		w.observe(depth)
+	}
+	if high := w.load(); high != 7 {
+		t.Errorf("high watermark %d, want 7", high)
+	}
+	w.reset()
+	if high := w.load(); high != 0 {
+		t.Errorf("high watermark %d after reset", high)
+	}
+}
+
+func TestQueueDepths(t *testing.T) {
+	dst, src := net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")
+	dev1, _, dev2, tun2 := newBindTestPair(t, bindtest.NewNetwork(1))
+	defer dev1.Close()
+	defer dev2.Close()
+
+	// a passive device holds packets in the nonce queue until the peer
+	// reaches out, the first of them in the hands of the nonce worker
+
+	if err := ipcSet(dev2, "passive=true\n"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		tun2.Outbound <- tuntest.Ping(dst, src)
+	}
+	key := dev1.staticIdentity.publicKey.Base64()
+	for deadline := time.Now().Add(2 * time.Second); dev2.Metrics().Peers[key].NonceQueue.Len != 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("nonce queue not filled: %+v", dev2.Metrics().Peers[key].NonceQueue)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	metrics := dev2.Metrics()
+	if nonce := metrics.Peers[key].NonceQueue; nonce.High < 2 || nonce.Cap != QueueOutboundSize {
+		t.Errorf("wrong nonce queue depth: %+v", nonce)
+	}
+	if metrics.EncryptionQueue.Cap != QueueOutboundSize || metrics.HandshakeQueue.Cap != QueueHandshakeSize {
+		t.Errorf("wrong device queue capacities: %+v, %+v", metrics.EncryptionQueue, metrics.HandshakeQueue)
+	}
+	get := ipcGet(t, dev2)
+	for _, line := range []string{"\nnonce_queue_len=2\n", "\nencryption_queue_len=0\n", "\nhandshake_queue_high="} {
+		if !strings.Contains(get, line) {
+			t.Errorf("get output missing %q:\n%s", line, get)
+		}
+	}
+
+	if err := ipcSet(dev2, "reset_stats=true\n"); err != nil {
+		t.Fatal(err)
+	}
+	if nonce := dev2.Metrics().Peers[key].NonceQueue; nonce.High != 0 || nonce.Len != 2 {
+		t.Errorf("wrong nonce queue depth after reset: %+v", nonce)
+	}
+}
@@ -0,0 +1,125 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"time"
+)
+
+/* A packet read from the TUN device for a peer whose nonce queue is full,
+ * as it fills while packets await the keypair of a handshake, is dealt
+ * with by the nonce queue policy of the device, nonce_queue_policy:
+ *
+ *   drop-head  the oldest queued packet is dropped to make room, so that
+ *              the freshest packets of interactive traffic are sent once
+ *              the handshake completes; the default
+ *   drop-tail  the packet itself is dropped, keeping the queued ones
+ *   block      the packet waits for room up to nonce_queue_timeout, and
+ *              is dropped after it; meanwhile nothing else is read from
+ *              the TUN queue it came from, pushing back on its senders
+ *
+ * Either way the dropped packet is counted as DropQueueFull. Keepalives
+ * queued on stopping a peer always take the place of the oldest packet.
+ */
+
+type nonceQueueMode int
+
+const (
+	nonceQueueDropHead nonceQueueMode = iota
+	nonceQueueDropTail
+	nonceQueueBlock
+)
+
+type nonceQueuePolicy struct {
+	mode    nonceQueueMode
+	timeout time.Duration // longest a packet waits for room with nonceQueueBlock, zero for NonceQueueTimeout
+}
+
+func (mode nonceQueueMode) String() string {
+	switch mode {
+	case nonceQueueDropTail:
+		return "drop-tail"
+	case nonceQueueBlock:
+		return "block"
+	}
+	return "drop-head"
+}
+
+func parseNonceQueueMode(s string) (nonceQueueMode, error) {
+	switch s {
+	case "drop-head":
+		return nonceQueueDropHead, nil
+	case "drop-tail":
+		return nonceQueueDropTail, nil
+	case "block":
+		return nonceQueueBlock, nil
+	}
+	return nonceQueueDropHead, errors.New("invalid nonce queue policy: " + s)
+}
+
+func (device *Device) nonceQueuePolicy() nonceQueuePolicy {
+	policy, _ := device.nonceQueue.Load().(nonceQueuePolicy)
+	return policy
+}
+
+/* Inserts elem into the nonce queue of peer, following the nonce queue
+ * policy if it is full. Returns true if the element was queued, false if
+ * it was dropped and may be reused.
+ */
+func (peer *Peer) queueNonce(elem *QueueOutboundElement) bool {
+	select {
+	case peer.queue.nonce <- elem:
+		return true
+	default:
+	}
+
+	device := peer.device
+	policy := device.nonceQueuePolicy()
+	switch policy.mode {
+	case nonceQueueDropTail:
+		device.drop(DropQueueFull, peer)
+		return false
+
+	case nonceQueueBlock:
+
+		// the queue is not closed under us while the peer is stopped
+
+		peer.routines.Lock()
+		defer peer.routines.Unlock()
+		if !peer.isRunning.Get() {
+			return false
+		}
+		timeout := policy.timeout
+		if timeout == 0 {
+			timeout = NonceQueueTimeout
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case peer.queue.nonce <- elem:
+			return true
+		case <-timer.C:
+			device.drop(DropQueueFull, peer)
+			return false
+		}
+	}
+
+	for {
+		select {
+		case peer.queue.nonce <- elem:
+			return true
+		default:
+			select {
+			case old := <-peer.queue.nonce:
+				device.PutMessageBuffer(old.buffer)
+				device.PutOutboundElement(old)
+				device.drop(DropQueueFull, peer)
+			default:
+			}
+		}
+	}
+}
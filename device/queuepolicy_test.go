@@ -0,0 +1,130 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+func TestNonceQueuePolicy(t *testing.T) {
+	network := bindtest.NewNetwork(1)
+	device := NewDevice(tuntest.NewChannelTUN().TUN(), &DeviceOptions{
+		Logger:         NewLogger(LogLevelError, "dev: "),
+		CreateBind:     network.CreateBind,
+		CreateEndpoint: network.CreateEndpoint,
+	})
+	defer device.Close()
+	device.Up()
+
+	// the peer never answers, so packets queue up awaiting its keypair
+
+	if err := ipcSet(device, "nonce_queue_size=2\n"+cfg2); err != nil {
+		t.Fatal(err)
+	}
+	key, err := wgcfg.ParseHexKey("49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := device.LookupPeer(key)
+
+	next := byte(0)
+	queue := func() bool {
+		elem := device.NewOutboundElement()
+		elem.packet = elem.buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+1]
+		elem.packet[0] = next
+		next++
+		return device.queueOutbound(peer, elem)
+	}
+	queued := func() (packets []byte) {
+		for len(peer.queue.nonce) != 0 {
+			elem := <-peer.queue.nonce
+			packets = append(packets, elem.packet[0])
+			device.PutMessageBuffer(elem.buffer)
+			device.PutOutboundElement(elem)
+		}
+		return packets
+	}
+	queueFull := func() uint64 {
+		return device.Metrics().Drops[DropQueueFull]
+	}
+
+	// the first packet is held by the nonce routine, the others fill the queue
+
+	queue()
+	for deadline := time.Now().Add(time.Second); !peer.queue.packetInNonceQueueIsAwaitingKey.Get(); {
+		if time.Now().After(deadline) {
+			t.Fatal("packet not taken by the nonce routine")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	queue()
+	queue()
+
+	// drop-head, by default
+
+	if !queue() || queueFull() != 1 {
+		t.Errorf("drop-head: packet not queued, or %d dropped", queueFull())
+	}
+	if packets := queued(); string(packets) != "\x02\x03" {
+		t.Errorf("drop-head: queued %v", packets)
+	}
+
+	// drop-tail
+
+	queue()
+	queue()
+	if err := ipcSet(device, "nonce_queue_policy=drop-tail\n"); err != nil {
+		t.Fatal(err)
+	}
+	if queue() || queueFull() != 2 {
+		t.Errorf("drop-tail: packet queued, or %d dropped", queueFull())
+	}
+	if packets := queued(); string(packets) != "\x04\x05" {
+		t.Errorf("drop-tail: queued %v", packets)
+	}
+
+	// block, until room is made or the timeout
+
+	queue()
+	queue()
+	if err := ipcSet(device, "nonce_queue_policy=block\nnonce_queue_timeout=20\n"); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if queue() || queueFull() != 3 {
+		t.Errorf("block: packet queued, or %d dropped", queueFull())
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Errorf("block: dropped after %v", waited)
+	}
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		elem := <-peer.queue.nonce
+		device.PutMessageBuffer(elem.buffer)
+		device.PutOutboundElement(elem)
+	}()
+	if !queue() {
+		t.Error("block: packet not queued once room was made")
+	}
+
+	get := ipcGet(t, device)
+	for _, line := range []string{"\nnonce_queue_policy=block\n", "\nnonce_queue_timeout=20\n", "\ndropped_queue_full=3\n"} {
+		if !strings.Contains(get, line) {
+			t.Errorf("get output missing %q:\n%s", line, get)
+		}
+	}
+	for _, cfg := range []string{"nonce_queue_policy=drop-middle\n", "nonce_queue_timeout=0\n", "nonce_queue_timeout=1001\n"} {
+		if err := ipcSet(device, cfg); err == nil {
+			t.Errorf("%q accepted", cfg)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"time"
+)
+
+/* An endpoint given by a hostname with both IPv4 and IPv6 addresses is
+ * raced, in the manner of Happy Eyeballs (RFC 8305): each initiation is
+ * sent to the IPv6 address, and EndpointRaceDelay later to the IPv4
+ * address, until a response arrives. The address family the response came
+ * from is committed to, and the race is over.
+ *
+ * Both addresses are sent the same initiation, so the responder takes
+ * whichever arrives first and drops the other as a replay, leaving a single
+ * handshake, and a single keypair.
+ */
+
+/* Returns the address endpoints are raced from, the first IPv6 address,
+ * and the address raced against it, the first IPv4 address. If addrs are
+ * all of one family, returns the first of them, and nil.
+ */
+func raceAddrs(addrs []*net.UDPAddr) (addr, race *net.UDPAddr) {
+	var ipv4, ipv6 *net.UDPAddr
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			if ipv4 == nil {
+				ipv4 = addr
+			}
+		} else if ipv6 == nil {
+			ipv6 = addr
+		}
+	}
+	if ipv4 == nil || ipv6 == nil {
+		return addrs[0], nil
+	}
+	return ipv6, ipv4
+}
+
+/* Sends the initiation packet to the endpoint raced against that of the
+ * peer, after EndpointRaceDelay, unless the race is over by then.
+ */
+func (peer *Peer) raceHandshakeInitiation(packet []byte) {
+	peer.RLock()
+	race := peer.endpointRace
+	peer.RUnlock()
+	if race == nil {
+		return
+	}
+
+	packet = append([]byte(nil), packet...)
+	time.AfterFunc(EndpointRaceDelay, func() {
+		device := peer.device
+		device.net.RLock()
+		defer device.net.RUnlock()
+		if device.net.bind == nil {
+			return
+		}
+
+		peer.RLock()
+		defer peer.RUnlock()
+		if peer.endpointRace != race {
+			return
+		}
+		device.log.Verbosef("%v - Racing handshake init to %v", peer, race.DstToString())
+		if err := device.net.bind.Send(packet, race); err != nil {
+			device.log.Verbosef("%v - Failed to race handshake initiation: %v", peer, err)
+		}
+	})
+}
+
+/* Ends the race of the endpoint of the peer with the response from addr,
+ * committing to the endpoint of the family of addr.
+ */
+func (peer *Peer) commitEndpointRace(addr *net.UDPAddr) {
+	device := peer.device
+	handler := device.endpointChangeHandler()
+
+	peer.Lock()
+	race := peer.endpointRace
+	if race == nil {
+		peer.Unlock()
+		return
+	}
+	peer.endpointRace = nil
+	if !sameFamily(race.DstIP(), addr.IP) {
+		peer.Unlock()
+		return
+	}
+	old := peer.endpoint.DstToString()
+	peer.endpoint = race
+	peer.endpointResolved = race.DstToString()
+	peer.Unlock()
+
+	device.log.Verbosef("%v - Endpoint race won by %v", peer, race.DstToString())
+	peer.endpointChanged(handler, old, race.DstToString())
+}
+
+func sameFamily(a, b net.IP) bool {
+	return (a.To4() == nil) == (b.To4() == nil)
+}
@@ -0,0 +1,104 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+/* A bind without IPv6 connectivity.
+ */
+type ipv4OnlyBind struct {
+	conn.Bind
+}
+
+func (bind ipv4OnlyBind) Send(buff []byte, end conn.Endpoint) error {
+	if end.DstIP().To4() == nil {
+		return nil
+	}
+	return bind.Bind.Send(buff, end)
+}
+
+func TestEndpointRace(t *testing.T) {
+	dst, src := net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")
+	lookupHost := func(string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")}, nil
+	}
+	cfg := strings.Replace(cfg2, "endpoint=127.0.0.1:53511", "endpoint=peer.test:53511", 1)
+
+	for _, test := range []struct {
+		name   string
+		broken bool
+		want   string
+	}{
+		{"ipv6", false, "[::1]:53511"},
+		{"broken ipv6", true, "127.0.0.1:53511"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			network := bindtest.NewNetwork(1)
+			tun1 := tuntest.NewChannelTUN()
+			dev1 := NewDevice(tun1.TUN(), &DeviceOptions{
+				Logger:         NewLogger(LogLevelError, "dev1: "),
+				CreateBind:     network.CreateBind,
+				CreateEndpoint: network.CreateEndpoint,
+			})
+			defer dev1.Close()
+			dev1.Up()
+			if err := ipcSet(dev1, cfg1); err != nil {
+				t.Fatal(err)
+			}
+
+			tun2 := tuntest.NewChannelTUN()
+			dev2 := NewDevice(tun2.TUN(), &DeviceOptions{
+				Logger: NewLogger(LogLevelError, "dev2: "),
+				CreateBind: func(port uint16) (conn.Bind, uint16, error) {
+					bind, port, err := network.CreateBind(port)
+					if err != nil || !test.broken {
+						return bind, port, err
+					}
+					return ipv4OnlyBind{bind}, port, nil
+				},
+				CreateEndpoint: network.CreateEndpoint,
+				LookupHost:     lookupHost,
+			})
+			defer dev2.Close()
+			dev2.Up()
+			if err := ipcSet(dev2, cfg); err != nil {
+				t.Fatal(err)
+			}
+
+			tun2.Outbound <- tuntest.Ping(dst, src)
+			select {
+			case <-tun1.Inbound:
+			case <-time.After(2 * time.Second):
+				t.Fatal("ping did not transit")
+			}
+			if attempts := dev2.Metrics().HandshakeAttempts; attempts != 1 {
+				t.Errorf("%d handshake attempts, want 1", attempts)
+			}
+			if get := ipcGet(t, dev2); !strings.Contains(get, "\nendpoint="+test.want+"\n") {
+				t.Errorf("endpoint is not %s:\n%s", test.want, get)
+			}
+
+			// the initiation raced to both families makes a single session
+
+			time.Sleep(2 * EndpointRaceDelay)
+			peer := dev1.LookupPeer(dev2.staticIdentity.publicKey)
+			peer.keypairs.RLock()
+			defer peer.keypairs.RUnlock()
+			if peer.keypairs.previous != nil {
+				t.Error("responder derived two sessions")
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"time"
+)
+
+/* A token bucket limiting the throughput of a single peer in bytes per second.
+ * Each peer has its own buckets, so limited peers never contend with each other.
+ * The bucket holds up to one second of traffic, but at least one full message,
+ * so that rates below the MTU still let packets through.
+ */
+
+type tokenBucket struct {
+	sync.Mutex
+	rate   uint64    // bytes per second, 0 for unlimited
+	tokens int64     // bytes available as of last, negative when reserved ahead
+	last   time.Time // last time tokens were added
+}
+
+/* Sets the rate and refills the bucket.
+ */
+func (tb *tokenBucket) setRate(rate uint64) {
+	tb.Lock()
+	defer tb.Unlock()
+	tb.rate = rate
+	tb.tokens = tb.burst()
+	tb.last = time.Now()
+}
+
+func (tb *tokenBucket) getRate() uint64 {
+	tb.Lock()
+	defer tb.Unlock()
+	return tb.rate
+}
+
+func (tb *tokenBucket) burst() int64 {
+	if tb.rate < MaxMessageSize {
+		return MaxMessageSize
+	}
+	return int64(tb.rate)
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	burst := tb.burst()
+	added := now.Sub(tb.last).Seconds() * float64(tb.rate)
+	tb.last = now
+	if added >= float64(burst-tb.tokens) {
+		tb.tokens = burst
+	} else {
+		tb.tokens += int64(added)
+	}
+}
+
+/* Takes n bytes from the bucket if they are available.
+ */
+func (tb *tokenBucket) allow(n int) bool {
+	tb.Lock()
+	defer tb.Unlock()
+
+	if tb.rate == 0 {
+		return true
+	}
+	tb.refill(time.Now())
+	if tb.tokens < int64(n) {
+		return false
+	}
+	tb.tokens -= int64(n)
+	return true
+}
+
+/* Takes n bytes from the bucket, possibly ahead of time.
+ * Returns how long the caller must wait before sending,
+ * or false if that would be longer than max.
+ */
+func (tb *tokenBucket) reserve(n int, max time.Duration) (time.Duration, bool) {
+	tb.Lock()
+	defer tb.Unlock()
+
+	if tb.rate == 0 {
+		return 0, true
+	}
+	tb.refill(time.Now())
+	tb.tokens -= int64(n)
+	if tb.tokens >= 0 {
+		return 0, true
+	}
+	wait := time.Duration(uint64(-tb.tokens) * uint64(time.Second) / tb.rate)
+	if wait > max {
+		tb.tokens += int64(n)
+		return 0, false
+	}
+	return wait, true
+}
@@ -0,0 +1,104 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var tb tokenBucket
+
+	// unlimited
+	for i := 0; i < 1000; i++ {
+		if !tb.allow(MaxMessageSize) {
+			t.Fatal("unlimited bucket dropped a packet")
+		}
+	}
+
+	tb.setRate(100000)
+	if !tb.allow(100000) {
+		t.Fatal("full bucket refused its burst")
+	}
+	if tb.allow(1000) {
+		t.Fatal("empty bucket allowed a packet")
+	}
+
+	// refill at the configured rate
+	tb.last = tb.last.Add(-10 * time.Millisecond)
+	if !tb.allow(900) {
+		t.Fatal("bucket did not refill")
+	}
+
+	// reserving ahead returns the wait, up to the maximum
+	wait, ok := tb.reserve(1000, RateLimitMaxDelay)
+	if !ok || wait <= 0 || wait > RateLimitMaxDelay {
+		t.Fatalf("reserve = %v, %v", wait, ok)
+	}
+	if _, ok := tb.reserve(100000, RateLimitMaxDelay); ok {
+		t.Fatal("reserve beyond the maximum delay succeeded")
+	}
+
+	// rates below the MTU still pass a full message
+	tb.setRate(100)
+	if !tb.allow(MaxMessageSize) {
+		t.Fatal("slow bucket refused a full message")
+	}
+}
+
+func TestUAPIRateLimit(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev: "),
+	})
+	defer device.Close()
+
+	if err := ipcSet(device, cfg1+"\ntx_rate_limit=125000\nrx_rate_limit=250000\n"); err != nil {
+		t.Fatal(err)
+	}
+	get := ipcGet(t, device)
+	for _, line := range []string{"tx_rate_limit=125000\n", "rx_rate_limit=250000\n"} {
+		if !strings.Contains(get, line) {
+			t.Errorf("get output missing %q:\n%s", line, get)
+		}
+	}
+
+	set := "public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725\ntx_rate_limit=0\nrx_rate_limit=0\n"
+	if err := ipcSet(device, set); err != nil {
+		t.Fatal(err)
+	}
+	if get := ipcGet(t, device); strings.Contains(get, "rate_limit=") {
+		t.Errorf("rate limits not cleared:\n%s", get)
+	}
+}
+
+func TestRxRateLimitBeforeDecryption(t *testing.T) {
+	dst, src := net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")
+	dev1, peer, _, dev2 := newProcessPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer.rateLimit.rx.setRate(1)
+	peer.rateLimit.rx.Lock()
+	peer.rateLimit.rx.tokens = 0
+	peer.rateLimit.rx.Unlock()
+
+	rxPackets := atomic.LoadUint64(&peer.stats.rxPackets)
+	if dev1.processInbound(peer, dev2.processOutbound(tuntest.Ping(dst, src))) {
+		t.Error("transport message over the rate limit decrypted")
+	}
+	if got := atomic.LoadUint64(&peer.stats.rxPackets); got != rxPackets {
+		t.Errorf("%d packets received over the rate limit", got-rxPackets)
+	}
+	if drops := dev1.Metrics().Drops[DropRateLimited]; drops != 1 {
+		t.Errorf("%d datagrams dropped as rate limited, want 1", drops)
+	}
+}
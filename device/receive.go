@@ -9,7 +9,6 @@ import (
 	"bytes"
 	"encoding/binary"
 	"net"
-	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -17,6 +16,7 @@ import (
 	"github.com/tailscale/wireguard-go/conn"
 	"github.com/tailscale/wireguard-go/wgcfg"
 	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/poly1305"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
 )
@@ -26,18 +26,20 @@ type QueueHandshakeElement struct {
 	packet   []byte
 	endpoint conn.Endpoint
 	addr     *net.UDPAddr
-	buffer   *[MaxMessageSize]byte
+	buffer   []byte
 }
 
 type QueueInboundElement struct {
 	dropped int32
 	sync.Mutex
-	buffer   *[MaxMessageSize]byte
+	buffer   []byte
 	packet   []byte
 	counter  uint64
 	keypair  *Keypair
+	peer     *Peer // the peer of the keypair
 	endpoint conn.Endpoint
 	addr     *net.UDPAddr
+	ds       byte // DS field of the outer header, if reported by the bind
 }
 
 func (elem *QueueInboundElement) Drop() {
@@ -83,7 +85,7 @@ func (peer *Peer) keepKeyFreshReceiving() {
 		return
 	}
 	keypair := peer.keypairs.Current()
-	if keypair != nil && keypair.isInitiator && time.Since(keypair.created) > (RejectAfterTime-KeepaliveTimeout-RekeyTimeout) {
+	if keypair != nil && keypair.isInitiator && time.Since(keypair.created) > (peer.device.rejectAfterTime()-peer.device.keepaliveTimeout()-peer.device.rekeyTimeout()) {
 		peer.timers.sentLastMinuteHandshake.Set(true)
 		peer.SendHandshakeInitiation(false)
 	}
@@ -98,33 +100,42 @@ func (device *Device) RoutineReceiveIncoming(IP int, bind conn.Bind) {
 
 	logDebug := Silence{}
 	defer func() {
-		logDebug.Println("Routine: receive incoming IPv" + strconv.Itoa(IP) + " - stopped")
+		logDebug.Verbosef("Routine: receive incoming IPv%d - stopped", IP)
 		device.net.stopping.Done()
 	}()
 
-	logDebug.Println("Routine: receive incoming IPv" + strconv.Itoa(IP) + " - started")
+	logDebug.Verbosef("Routine: receive incoming IPv%d - started", IP)
 	device.net.starting.Done()
 
+	if batchBind, ok := bind.(conn.BatchBind); ok {
+		device.receiveIncomingBatches(IP, batchBind)
+		return
+	}
+
 	// receive datagrams until conn is closed
 
 	buffer := device.GetMessageBuffer()
+	headroom := device.headroom()
 
 	var (
 		err      error
 		size     int
 		endpoint conn.Endpoint
 		addr     *net.UDPAddr
+		pin      workerPin
 	)
 
 	for {
+		device.pinWorker(&pin)
+		buffer = device.renewMessageBuffer(buffer)
 
 		// read next datagram
 
 		switch IP {
 		case ipv4.Version:
-			size, endpoint, addr, err = bind.ReceiveIPv4(buffer[:])
+			size, endpoint, addr, err = bind.ReceiveIPv4(buffer[headroom:])
 		case ipv6.Version:
-			size, endpoint, addr, err = bind.ReceiveIPv6(buffer[:])
+			size, endpoint, addr, err = bind.ReceiveIPv6(buffer[headroom:])
 		default:
 			panic("invalid IP version")
 		}
@@ -134,111 +145,244 @@ func (device *Device) RoutineReceiveIncoming(IP int, bind conn.Bind) {
 			return
 		}
 
-		if size < MinMessageSize {
-			continue
+		if device.handleIncoming(buffer, size, endpoint, addr, 0) {
+			buffer = device.GetMessageBuffer()
 		}
+	}
+}
 
-		// check size of packet
-
-		packet := buffer[:size]
-		msgType := binary.LittleEndian.Uint32(packet[:4])
+/* Receives datagrams in batches until conn is closed
+ */
+func (device *Device) receiveIncomingBatches(IP int, bind conn.BatchBind) {
+	var (
+		buffers [conn.MaxBatchSize][]byte
+		packets [conn.MaxBatchSize]conn.Packet
+		err     error
+		n       int
+		pin     workerPin
+	)
+	headroom := device.headroom()
 
-		var okay bool
+	for i := range buffers {
+		buffers[i] = device.GetMessageBuffer()
+		packets[i].Buffer = buffers[i][headroom:]
+	}
 
-		switch msgType {
+	for {
+		device.pinWorker(&pin)
+		for i := range buffers {
+			if buffer := device.renewMessageBuffer(buffers[i]); len(buffer) != len(buffers[i]) {
+				buffers[i] = buffer
+				packets[i].Buffer = buffer[headroom:]
+			}
+		}
 
-		// check if transport
+		// read next batch of datagrams
 
-		case MessageTransportType:
+		switch IP {
+		case ipv4.Version:
+			n, err = bind.ReceiveIPv4Batch(packets[:])
+		case ipv6.Version:
+			n, err = bind.ReceiveIPv6Batch(packets[:])
+		default:
+			panic("invalid IP version")
+		}
 
-			// check size
+		if err != nil {
+			for _, buffer := range buffers {
+				device.PutMessageBuffer(buffer)
+			}
+			return
+		}
 
-			if len(packet) < MessageTransportSize {
-				continue
+		for i := 0; i < n; i++ {
+			if device.handleIncoming(buffers[i], packets[i].N, packets[i].Endpoint, packets[i].Addr, packets[i].DS) {
+				buffers[i] = device.GetMessageBuffer()
 			}
+			packets[i] = conn.Packet{Buffer: buffers[i][headroom:]}
+		}
+	}
+}
 
-			// lookup key pair
+/* Dispatches a received datagram to the decryption or handshake queues.
+ * Returns true if the buffer was consumed, in which case the caller
+ * must use a new buffer for the next datagram.
+ */
+func (device *Device) handleIncoming(buffer []byte, size int, endpoint conn.Endpoint, addr *net.UDPAddr, ds byte) bool {
 
-			receiver := binary.LittleEndian.Uint32(
-				packet[MessageTransportOffsetReceiver:MessageTransportOffsetCounter],
-			)
-			value := device.indexTable.Lookup(receiver)
-			keypair := value.keypair
-			if keypair == nil {
-				continue
-			}
+	logDebug := Silence{}
 
-			// check keypair expiry
+	// check size of packet, every message being at least as long as a
+	// keepalive, which holds the type field
 
-			if keypair.created.Add(RejectAfterTime).Before(time.Now()) {
-				continue
-			}
+	headroom := device.headroom()
+	if size < MinMessageSize || size > len(buffer)-headroom {
+		device.drop(DropMalformed, nil)
+		return false
+	}
 
-			// create work element
-			peer := value.peer
-			elem := device.GetInboundElement()
-			elem.packet = packet
-			elem.buffer = buffer
-			elem.keypair = keypair
-			elem.dropped = AtomicFalse
-			elem.endpoint = endpoint
-			elem.addr = addr
-			elem.counter = 0
-			elem.Mutex = sync.Mutex{}
-			elem.Lock()
-
-			// add to decryption queues
-
-			if peer.isRunning.Get() {
-				if device.addToInboundAndDecryptionQueues(peer.queue.inbound, device.queue.decryption, elem) {
-					buffer = device.GetMessageBuffer()
-				}
-			}
+	// buffers fit datagrams of our MTU, so one filling the buffer may have
+	// been cut short, coming from a peer with a larger MTU: drop it rather
+	// than have it fail to authenticate, quarantining the peer
 
-			continue
+	if size == len(buffer)-headroom && size < MaxMessageSize {
+		device.drop(DropTruncated, nil)
+		return false
+	}
 
-		// otherwise it is a fixed size & handshake related packet
+	if addr != nil && device.quarantine.holds(addr.IP) {
+		device.drop(DropQuarantined, nil)
+		return false
+	}
 
-		case MessageInitiationType:
-			okay = len(packet) == MessageInitiationSize
+	packet := buffer[headroom : headroom+size]
+	msgType := messageType(binary.LittleEndian.Uint32(packet[:4]))
 
-		case MessageResponseType:
-			okay = len(packet) == MessageResponseSize
+	var okay bool
 
-		case MessageCookieReplyType:
-			okay = len(packet) == MessageCookieReplySize
+	switch msgType {
 
-		default:
-			logDebug.Printf("Received message with unknown type from %v", addr)
-		}
-
-		if okay {
-			if (device.addToHandshakeQueue(
-				device.queue.handshake,
-				QueueHandshakeElement{
-					msgType:  msgType,
-					buffer:   buffer,
-					packet:   packet,
-					endpoint: endpoint,
-					addr:     addr,
-				},
-			)) {
-				buffer = device.GetMessageBuffer()
-			}
+	// check if transport
+
+	case MessageTransportType:
+		elem, peer := device.newInboundElement(buffer, packet, endpoint, addr, ds)
+		if elem == nil {
+			return false
+		}
+
+		// add to decryption queues
+
+		if peer.isRunning.Get() {
+			queued := device.addToInboundAndDecryptionQueues(peer.queue.inbound, device.queue.decryption, elem)
+			peer.queue.inboundHigh.observe(len(peer.queue.inbound))
+			device.queue.decryptionHigh.observe(len(device.queue.decryption))
+			return queued
 		}
+
+		return false
+
+	// otherwise it is a fixed size & handshake related packet
+
+	case MessageInitiationType:
+		packet, okay = device.unpadHandshake(packet, MessageInitiationSize)
+
+	case MessageResponseType:
+		packet, okay = device.unpadHandshake(packet, MessageResponseSize)
+
+	case MessageHybridInitiationType:
+		if !device.postQuantum.Get() {
+			return false
+		}
+		packet, okay = device.unpadHandshake(packet, MessageHybridInitiationSize)
+
+	case MessageHybridResponseType:
+		packet, okay = device.unpadHandshake(packet, MessageHybridResponseSize)
+
+	case MessageCookieReplyType:
+		packet, okay = device.unpadHandshake(packet, MessageCookieReplySize)
+
+	default:
+		logDebug.Verbosef("Received message with unknown type from %v", addr)
+	}
+
+	if !okay {
+		device.drop(DropMalformed, nil)
+		return false
+	}
+
+	queued := device.addToHandshakeQueue(
+		device.queue.handshake,
+		QueueHandshakeElement{
+			msgType:  msgType,
+			buffer:   buffer,
+			packet:   packet,
+			endpoint: endpoint,
+			addr:     addr,
+		},
+	)
+	device.queue.handshakeHigh.observe(len(device.queue.handshake))
+	return queued
+}
+
+/* Splits a transport message into its fields, the content aliasing the
+ * packet. Returns false if the message is too short to hold its header
+ * and the authentication tag of its content.
+ */
+func parseTransport(packet []byte, msg *MessageTransport) bool {
+	if len(packet) < MessageTransportSize {
+		return false
+	}
+	msg.Type = binary.LittleEndian.Uint32(packet[:MessageTransportOffsetReceiver])
+	msg.Receiver = binary.LittleEndian.Uint32(packet[MessageTransportOffsetReceiver:MessageTransportOffsetCounter])
+	msg.Counter = binary.LittleEndian.Uint64(packet[MessageTransportOffsetCounter:MessageTransportOffsetContent])
+	msg.Content = packet[MessageTransportOffsetContent:]
+	return true
+}
+
+/* Looks up the keypair of a transport message, returning a locked work
+ * element for it and the peer it is from, or nil if the message is to be
+ * dropped.
+ */
+func (device *Device) newInboundElement(buffer []byte, packet []byte, endpoint conn.Endpoint, addr *net.UDPAddr, ds byte) (*QueueInboundElement, *Peer) {
+
+	var msg MessageTransport
+	if !parseTransport(packet, &msg) {
+		device.drop(DropMalformed, nil)
+		return nil, nil
 	}
+
+	// lookup key pair
+
+	value := device.indexTable.Lookup(msg.Receiver)
+	keypair := value.keypair
+	if keypair == nil {
+		device.drop(DropNoKeypair, nil)
+		return nil, nil
+	}
+
+	// check keypair expiry
+
+	if keypair.created.Add(device.rejectAfterTime()).Before(time.Now()) {
+		device.drop(DropNoKeypair, value.peer)
+		return nil, nil
+	}
+
+	// drop data over the inbound rate limit before spending work on it,
+	// rather than queueing it, keepalives aside
+
+	if size := len(msg.Content) - poly1305.TagSize; size > 0 && !value.peer.rateLimit.rx.allow(size) {
+		device.drop(DropRateLimited, value.peer)
+		return nil, nil
+	}
+
+	// create work element
+
+	elem := device.GetInboundElement()
+	elem.packet = packet
+	elem.buffer = buffer
+	elem.keypair = keypair
+	elem.peer = value.peer
+	elem.dropped = AtomicFalse
+	elem.endpoint = endpoint
+	elem.addr = addr
+	elem.ds = ds
+	elem.counter = 0
+	elem.Mutex = sync.Mutex{}
+	elem.Lock()
+	return elem, value.peer
 }
 
 func (device *Device) RoutineDecryption() {
 
 	var nonce [chacha20poly1305.NonceSize]byte
+	var pin workerPin
 
 	logDebug := Silence{}
 	defer func() {
-		logDebug.Println("Routine: decryption worker - stopped")
+		logDebug.Verbosef("Routine: decryption worker - stopped")
 		device.state.stopping.Done()
 	}()
-	logDebug.Println("Routine: decryption worker - started")
+	logDebug.Verbosef("Routine: decryption worker - started")
 	device.state.starting.Done()
 
 	for {
@@ -251,6 +395,7 @@ func (device *Device) RoutineDecryption() {
 			if !ok {
 				return
 			}
+			device.pinWorker(&pin)
 
 			// check if dropped
 
@@ -258,39 +403,43 @@ func (device *Device) RoutineDecryption() {
 				continue
 			}
 
-			// split message into fields
-
-			counter := elem.packet[MessageTransportOffsetCounter:MessageTransportOffsetContent]
-			content := elem.packet[MessageTransportOffsetContent:]
+			device.decrypt(elem, &nonce)
+			elem.Unlock()
+		}
+	}
+}
 
-			// expand nonce
+/* Decrypts the transport message of the element in place, dropping it
+ * if it fails to authenticate.
+ */
+func (device *Device) decrypt(elem *QueueInboundElement, nonce *[chacha20poly1305.NonceSize]byte) {
 
-			nonce[0x4] = counter[0x0]
-			nonce[0x5] = counter[0x1]
-			nonce[0x6] = counter[0x2]
-			nonce[0x7] = counter[0x3]
+	// split message into fields and expand nonce
 
-			nonce[0x8] = counter[0x4]
-			nonce[0x9] = counter[0x5]
-			nonce[0xa] = counter[0x6]
-			nonce[0xb] = counter[0x7]
+	var msg MessageTransport
+	if !parseTransport(elem.packet, &msg) {
+		device.drop(DropMalformed, nil)
+		elem.Drop()
+		device.PutMessageBuffer(elem.buffer)
+		return
+	}
+	binary.LittleEndian.PutUint64(nonce[4:], msg.Counter)
 
-			// decrypt and release to consumer
+	// decrypt in place
 
-			var err error
-			elem.counter = binary.LittleEndian.Uint64(counter)
-			elem.packet, err = elem.keypair.receive.Open(
-				content[:0],
-				nonce[:],
-				content,
-				nil,
-			)
-			if err != nil {
-				elem.Drop()
-				device.PutMessageBuffer(elem.buffer)
-			}
-			elem.Unlock()
-		}
+	var err error
+	elem.counter = msg.Counter
+	elem.packet, err = elem.keypair.receive.Open(
+		msg.Content[:0],
+		nonce[:],
+		msg.Content,
+		nil,
+	)
+	if err != nil {
+		device.drop(DropDecrypt, elem.peer)
+		device.authenticationFailed(elem.addr)
+		elem.Drop()
+		device.PutMessageBuffer(elem.buffer)
 	}
 }
 
@@ -308,22 +457,18 @@ func addrToBytes(addr *net.UDPAddr) []byte {
  */
 func (device *Device) RoutineHandshake() {
 
-	logInfo := device.log.Info
-	logError := device.log.Error
-	logDebug := device.log.Debug
-
 	var elem QueueHandshakeElement
 	var ok bool
 
 	defer func() {
-		//logDebug.Println("Routine: handshake worker - stopped")
+		//device.log.Verbosef("Routine: handshake worker - stopped")
 		device.state.stopping.Done()
 		if elem.buffer != nil {
 			device.PutMessageBuffer(elem.buffer)
 		}
 	}()
 
-	//logDebug.Println("Routine: handshake worker - started")
+	//device.log.Verbosef("Routine: handshake worker - started")
 	device.state.starting.Done()
 
 	for {
@@ -354,8 +499,9 @@ func (device *Device) RoutineHandshake() {
 			reader := bytes.NewReader(elem.packet)
 			err := binary.Read(reader, binary.LittleEndian, &reply)
 			if err != nil {
-				logDebug.Println("Failed to decode cookie reply")
-				return
+				device.log.Verbosef("Failed to decode cookie reply")
+				device.drop(DropMalformed, nil)
+				continue
 			}
 
 			// lookup peer from index
@@ -369,20 +515,22 @@ func (device *Device) RoutineHandshake() {
 			// consume reply
 
 			if peer := entry.peer; peer.isRunning.Get() {
-				logDebug.Printf("Receiving cookie response from %v", elem.addr)
+				device.log.Verbosef("Receiving cookie response from %v", elem.addr)
 				if !peer.cookieGenerator.ConsumeReply(&reply) {
-					logDebug.Println("Could not decrypt invalid cookie response")
+					device.log.Verbosef("Could not decrypt invalid cookie response")
 				}
 			}
 
 			continue
 
-		case MessageInitiationType, MessageResponseType:
+		case MessageInitiationType, MessageResponseType, MessageHybridInitiationType, MessageHybridResponseType:
 
 			// check mac fields and maybe ratelimit
 
 			if !device.cookieChecker.CheckMAC1(elem.packet) {
-				logDebug.Printf("Received packet with invalid mac1 from %v", elem.addr)
+				device.log.Verbosef("Received packet with invalid mac1 from %v", elem.addr)
+				atomic.AddUint64(&device.stats.invalidMACs, 1)
+				device.authenticationFailed(elem.addr)
 				continue
 			}
 
@@ -393,42 +541,63 @@ func (device *Device) RoutineHandshake() {
 				// verify MAC2 field
 
 				if !device.cookieChecker.CheckMAC2(elem.packet, addrToBytes(elem.addr)) {
-					device.SendHandshakeCookie(&elem)
+					atomic.AddUint64(&device.stats.rejectedUnderLoad, 1)
+
+					// the source may be spoofed, so replies are ratelimited too
+
+					if device.rate.cookieLimiter.Allow(elem.addr.IP) {
+						device.SendHandshakeCookie(&elem)
+					} else {
+						atomic.AddUint64(&device.stats.cookieRepliesLimited, 1)
+					}
 					continue
 				}
 
 				// check ratelimiter
 
 				if !device.rate.limiter.Allow(elem.addr.IP) {
+					atomic.AddUint64(&device.stats.rejectedUnderLoad, 1)
 					continue
 				}
 			}
 
 		default:
-			logError.Println("Invalid packet ended up in the handshake queue")
+			device.log.Errorf("Invalid packet ended up in the handshake queue")
 			continue
 		}
 
 		// handle handshake initiation/response content
 
 		switch elem.msgType {
-		case MessageInitiationType:
+		case MessageInitiationType, MessageHybridInitiationType:
 
-			// unmarshal
+			// unmarshal & consume initiation
 
-			var msg MessageInitiation
+			var peer *Peer
 			reader := bytes.NewReader(elem.packet)
-			err := binary.Read(reader, binary.LittleEndian, &msg)
-			if err != nil {
-				logError.Println("Failed to decode initiation message")
-				continue
+			if elem.msgType == MessageHybridInitiationType {
+				var msg MessageHybridInitiation
+				if err := binary.Read(reader, binary.LittleEndian, &msg); err != nil {
+					device.log.Errorf("Failed to decode initiation message")
+					device.drop(DropMalformed, nil)
+					continue
+				}
+				device.handshakeGate.enter()
+				peer = device.ConsumeMessageHybridInitiation(&msg)
+				device.handshakeGate.leave()
+			} else {
+				var msg MessageInitiation
+				if err := binary.Read(reader, binary.LittleEndian, &msg); err != nil {
+					device.log.Errorf("Failed to decode initiation message")
+					device.drop(DropMalformed, nil)
+					continue
+				}
+				device.handshakeGate.enter()
+				peer = device.ConsumeMessageInitiation(&msg)
+				device.handshakeGate.leave()
 			}
-
-			// consume initiation
-
-			peer := device.ConsumeMessageInitiation(&msg)
 			if peer == nil {
-				logInfo.Printf("Received invalid initiation message from %v", elem.addr)
+				device.log.Verbosef("Received invalid initiation message from %v", elem.addr)
 				continue
 			}
 
@@ -438,11 +607,13 @@ func (device *Device) RoutineHandshake() {
 			peer.timersAnyAuthenticatedPacketReceived()
 
 			// update endpoint
-			peer.SetEndpointAddress(elem.addr)
+			peer.commitHolePunch(elem.addr)
+			peer.heardFrom(elem.endpoint, elem.addr)
 
-			logDebug.Printf("%v - Received handshake init from %v\n",
+			device.log.Verbosef("%v - Received handshake init from %v\n",
 				peer, elem.addr)
 			atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)))
+			atomic.AddUint64(&peer.stats.rxPackets, 1)
 
 			peer.handshake.mutex.Lock()
 			phs := peer.handshake.state
@@ -451,35 +622,50 @@ func (device *Device) RoutineHandshake() {
 			if phs == HandshakeInitiationConsumed {
 				peer.SendHandshakeResponse()
 			} else {
-				logDebug.Printf("%v - SKIPPING response.\n", peer)
+				device.log.Verbosef("%v - SKIPPING response.\n", peer)
 			}
 
-		case MessageResponseType:
+		case MessageResponseType, MessageHybridResponseType:
 
-			// unmarshal
+			// unmarshal & consume response
 
-			var msg MessageResponse
+			var peer *Peer
 			reader := bytes.NewReader(elem.packet)
-			err := binary.Read(reader, binary.LittleEndian, &msg)
-			if err != nil {
-				logError.Println("Failed to decode response message")
-				continue
+			if elem.msgType == MessageHybridResponseType {
+				var msg MessageHybridResponse
+				if err := binary.Read(reader, binary.LittleEndian, &msg); err != nil {
+					device.log.Errorf("Failed to decode response message")
+					device.drop(DropMalformed, nil)
+					continue
+				}
+				device.handshakeGate.enter()
+				peer = device.ConsumeMessageHybridResponse(&msg)
+				device.handshakeGate.leave()
+			} else {
+				var msg MessageResponse
+				if err := binary.Read(reader, binary.LittleEndian, &msg); err != nil {
+					device.log.Errorf("Failed to decode response message")
+					device.drop(DropMalformed, nil)
+					continue
+				}
+				device.handshakeGate.enter()
+				peer = device.ConsumeMessageResponse(&msg)
+				device.handshakeGate.leave()
 			}
-
-			// consume response
-
-			peer := device.ConsumeMessageResponse(&msg)
 			if peer == nil {
-				logInfo.Printf("Received invalid response message from %v", elem.addr)
+				device.log.Verbosef("Received invalid response message from %v", elem.addr)
 				continue
 			}
 
 			// update endpoint
-			peer.SetEndpointAddress(elem.addr)
+			peer.commitEndpointRace(elem.addr)
+			peer.commitHolePunch(elem.addr)
+			peer.heardFrom(elem.endpoint, elem.addr)
 
-			logDebug.Printf("%v - Received handshake response from %v\n",
+			device.log.Verbosef("%v - Received handshake response from %v\n",
 				peer, elem.addr)
 			atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)))
+			atomic.AddUint64(&peer.stats.rxPackets, 1)
 
 			// update timers
 
@@ -488,10 +674,10 @@ func (device *Device) RoutineHandshake() {
 
 			// derive keypair
 
-			err = peer.BeginSymmetricSession()
+			err := peer.BeginSymmetricSession()
 
 			if err != nil {
-				logError.Println(peer, "- Failed to derive keypair:", err)
+				device.log.Errorf("%v - Failed to derive keypair: %v", peer, err)
 				continue
 			}
 
@@ -509,14 +695,12 @@ func (device *Device) RoutineHandshake() {
 func (peer *Peer) RoutineSequentialReceiver() {
 
 	device := peer.device
-	logInfo := device.log.Info
-	logError := device.log.Error
-	logDebug := device.log.Debug
 
 	var elem *QueueInboundElement
+	var pin workerPin
 
 	defer func() {
-		//logDebug.Println(peer, "- Routine: sequential receiver - stopped")
+		//device.log.Verbosef("%v - Routine: sequential receiver - stopped", peer)
 		peer.routines.stopping.Done()
 		if elem != nil {
 			if !elem.IsDropped() {
@@ -526,7 +710,7 @@ func (peer *Peer) RoutineSequentialReceiver() {
 		}
 	}()
 
-	//logDebug.Println(peer, "- Routine: sequential receiver - started")
+	//device.log.Verbosef("%v - Routine: sequential receiver - started", peer)
 
 	peer.routines.starting.Done()
 
@@ -548,6 +732,7 @@ func (peer *Peer) RoutineSequentialReceiver() {
 				return
 			}
 		}
+		device.pinWorker(&pin)
 
 		// wait for decryption
 
@@ -557,112 +742,165 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			continue
 		}
 
-		// update endpoint
-		peer.SetEndpointAddress(elem.addr)
+		peer.receive(elem)
+	}
+}
 
-		// check for replay
-		if !elem.keypair.replayFilter.ValidateCounter(elem.counter, RejectAfterMessages) {
-			continue
-		}
+/* Handles a decrypted transport message from the peer: checks it against
+ * replay, updates the timers and session of the peer, and writes the
+ * packet it carries to the TUN device, if its source is allowed.
+ */
+func (peer *Peer) receive(elem *QueueInboundElement) {
+	device := peer.device
 
-		// check if using new keypair
-		if peer.ReceivedWithKeypair(elem.keypair) {
-			peer.timersHandshakeComplete()
-			select {
-			case peer.signals.newKeypairArrived <- struct{}{}:
-			default:
-			}
-		}
+	// update endpoint
+	peer.heardFrom(elem.endpoint, elem.addr)
 
-		peer.keepKeyFreshReceiving()
-		peer.timersAnyAuthenticatedPacketTraversal()
-		peer.timersAnyAuthenticatedPacketReceived()
-		atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)+MinMessageSize))
+	// check for replay
+	if !peer.validateCounter(elem.keypair, elem.counter) {
+		device.drop(DropReplay, peer)
+		return
+	}
+	peer.stats.rxLoss.count(elem.keypair)
 
-		// check for keepalive
+	if !elem.keypair.confirmed.Get() {
+		elem.keypair.confirmed.Set(true)
+	}
 
-		if len(elem.packet) == 0 {
-			logDebug.Printf("%v - Received keepalive from %v\n",
-				peer, elem.addr)
-			continue
+	// check if using new keypair
+	if peer.ReceivedWithKeypair(elem.keypair) {
+		if elem.keypair.nextPresharedKey {
+			peer.handshake.mutex.Lock()
+			peer.handshake.promoteNextPresharedKey()
+			peer.handshake.mutex.Unlock()
 		}
-		peer.timersDataReceived()
+		peer.timersHandshakeComplete()
+		select {
+		case peer.signals.newKeypairArrived <- struct{}{}:
+		default:
+		}
+	}
 
-		// verify source and strip padding
+	peer.keepKeyFreshReceiving()
+	peer.timersAnyAuthenticatedPacketTraversal()
+	peer.timersAnyAuthenticatedPacketReceived()
+	atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)+MinMessageSize))
+	atomic.AddUint64(&peer.stats.rxPackets, 1)
 
-		switch elem.packet[0] >> 4 {
-		case ipv4.Version:
+	// check for keepalive
 
-			// strip padding
+	if len(elem.packet) == 0 {
+		device.log.Verbosef("%v - Received keepalive from %v\n",
+			peer, elem.addr)
+		return
+	}
+	if isPathMTUProbe(elem.packet) {
+		return
+	}
+	peer.timersDataReceived()
 
-			if len(elem.packet) < ipv4.HeaderLen {
-				continue
-			}
+	// verify source and strip padding
 
-			field := elem.packet[IPv4offsetTotalLength : IPv4offsetTotalLength+2]
-			length := binary.BigEndian.Uint16(field)
-			if int(length) > len(elem.packet) || int(length) < ipv4.HeaderLen {
-				continue
-			}
+	switch elem.packet[0] >> 4 {
+	case ipv4.Version:
 
-			elem.packet = elem.packet[:length]
+		// strip padding
 
-			// verify IPv4 source
+		if len(elem.packet) < ipv4.HeaderLen {
+			device.drop(DropMalformed, peer)
+			return
+		}
 
-			src := elem.packet[IPv4offsetSrc : IPv4offsetSrc+net.IPv4len]
-			if device.allowedips.LookupIPv4(src) != peer {
-				ip := wgcfg.IPv4(src[0], src[1], src[2], src[3])
-				key := (*wgcfg.Key)(&peer.handshake.remoteStatic)
-				device.unexpectedip(key, ip)
-				continue
-			}
+		field := elem.packet[IPv4offsetTotalLength : IPv4offsetTotalLength+2]
+		length := binary.BigEndian.Uint16(field)
+		if int(length) > len(elem.packet) || int(length) < ipv4.HeaderLen {
+			device.drop(DropMalformed, peer)
+			return
+		}
 
-		case ipv6.Version:
+		elem.packet = elem.packet[:length]
 
-			// strip padding
+		// verify IPv4 source
 
-			if len(elem.packet) < ipv6.HeaderLen {
-				continue
-			}
+		src := elem.packet[IPv4offsetSrc : IPv4offsetSrc+net.IPv4len]
+		if device.allowedips.LookupIPv4(src) != peer {
+			ip := wgcfg.IPv4(src[0], src[1], src[2], src[3])
+			key := (*wgcfg.Key)(&peer.handshake.remoteStatic)
+			device.unexpectedip(key, ip)
+			device.drop(DropNotAllowed, peer)
+			return
+		}
 
-			field := elem.packet[IPv6offsetPayloadLength : IPv6offsetPayloadLength+2]
-			length := binary.BigEndian.Uint16(field)
-			length += ipv6.HeaderLen
-			if int(length) > len(elem.packet) {
-				continue
-			}
+	case ipv6.Version:
 
-			elem.packet = elem.packet[:length]
+		// strip padding
 
-			// verify IPv6 source
+		if len(elem.packet) < ipv6.HeaderLen {
+			device.drop(DropMalformed, peer)
+			return
+		}
 
-			src := elem.packet[IPv6offsetSrc : IPv6offsetSrc+net.IPv6len]
-			if device.allowedips.LookupIPv6(src) != peer {
-				ip := wgcfg.IPv4(src[0], src[1], src[2], src[3])
-				key := (*wgcfg.Key)(&peer.handshake.remoteStatic)
-				device.unexpectedip(key, ip)
-				continue
-			}
+		// the length is summed as an int, as a payload length near the
+		// maximum would wrap around past the header as a uint16
 
-		default:
-			logInfo.Println("Packet with invalid IP version from", peer)
-			continue
+		field := elem.packet[IPv6offsetPayloadLength : IPv6offsetPayloadLength+2]
+		length := int(binary.BigEndian.Uint16(field)) + ipv6.HeaderLen
+		if length > len(elem.packet) {
+			device.drop(DropMalformed, peer)
+			return
 		}
 
-		// write to tun device
+		elem.packet = elem.packet[:length]
 
-		offset := MessageTransportOffsetContent
-		atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)))
-		atomic.StoreInt64(&peer.stats.lastRXNano, time.Now().UnixNano())
-		_, err := device.tun.device.Write(elem.buffer[:offset+len(elem.packet)], offset)
-		if len(peer.queue.inbound) == 0 {
-			err = device.tun.device.Flush()
-			if err != nil {
-				peer.device.log.Error.Printf("Unable to flush packets: %v", err)
-			}
+		// verify IPv6 source
+
+		src := elem.packet[IPv6offsetSrc : IPv6offsetSrc+net.IPv6len]
+		if device.allowedips.LookupIPv6(src) != peer {
+			ip := wgcfg.IPv4(src[0], src[1], src[2], src[3])
+			key := (*wgcfg.Key)(&peer.handshake.remoteStatic)
+			device.unexpectedip(key, ip)
+			device.drop(DropNotAllowed, peer)
+			return
+		}
+
+	default:
+		device.log.Verbosef("Packet with invalid IP version from %v", peer)
+		device.drop(DropMalformed, peer)
+		return
+	}
+
+	// let the inbound filter drop or rewrite the packet
+
+	if filter, _ := device.filters.inbound.Load().(PacketFilter); filter != nil {
+		if filter(peer.handshake.remoteStatic, elem.packet) == FilterDrop {
+			device.drop(DropFiltered, peer)
+			return
 		}
-		if err != nil && !device.isClosed.Get() {
-			logError.Println("Failed to write packet to TUN device:", err)
+	}
+
+	// reflect congestion marks of the outer header
+
+	if device.ecn.Get() && !ecnDecapsulate(elem.ds, elem.packet) {
+		device.drop(DropECN, peer)
+		return
+	}
+
+	device.trackFlow(peer, elem.packet, true)
+	device.capturePacket(elem.packet)
+
+	// write to tun device
+
+	offset := device.pool.packetOffset
+	atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)))
+	atomic.StoreInt64(&peer.stats.lastRXNano, time.Now().UnixNano())
+	_, err := peer.tunQueue.Write(elem.buffer[:offset+len(elem.packet)], offset)
+	if len(peer.queue.inbound) == 0 {
+		err = peer.tunQueue.Flush()
+		if err != nil {
+			peer.device.log.Errorf("Unable to flush packets: %v", err)
 		}
 	}
+	if err != nil && !device.isClosed.Get() {
+		device.log.Errorf("Failed to write packet to TUN device: %v", err)
+	}
 }
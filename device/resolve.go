@@ -0,0 +1,226 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+/* Endpoints may be configured by hostname. The hostname is resolved when
+ * the endpoint is set, and again at each endpoint resolve interval, so
+ * that the peer follows changes to its DNS records. A failed resolution
+ * keeps the last address. A peer which roamed away from the resolved
+ * address is left where it is while it is active, as it is evidently
+ * reachable there.
+ */
+
+func (device *Device) endpointResolveInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&device.timers.endpointResolve))
+}
+
+/* Sets the endpoint resolve interval, rearming the timers of the peers with
+ * endpoints given by hostname. Zero disables resolving endpoints again.
+ */
+func (device *Device) setEndpointResolveInterval(interval time.Duration) {
+	atomic.StoreInt64(&device.timers.endpointResolve, int64(interval))
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	for _, peer := range device.peers.keyMap {
+		peer.RLock()
+		host := peer.endpointHost
+		peer.RUnlock()
+		if host == "" {
+			continue
+		}
+		if interval > 0 {
+			peer.timersResolveEndpoint()
+		} else {
+			peer.timers.resolveEndpoint.Del()
+		}
+	}
+}
+
+/* Arms the timer resolving the endpoint of the peer again, unless
+ * disabled.
+ */
+func (peer *Peer) timersResolveEndpoint() {
+	if interval := peer.device.endpointResolveInterval(); interval > 0 && peer.timersActive() {
+		peer.timers.resolveEndpoint.Mod(interval)
+	}
+}
+
+/* Returns whether the endpoint s is given by hostname rather than by IP
+ * address.
+ */
+func endpointIsHostname(s string) bool {
+	host, _, err := net.SplitHostPort(s)
+	if err != nil || host == "" {
+		return false
+	}
+	if net.ParseIP(host) != nil {
+		return false
+	}
+	for i := 0; i < len(host); i++ {
+		if host[i] == ':' || host[i] == '%' {
+			return false
+		}
+	}
+	return true
+}
+
+/* Creates the endpoint s of the peer with key, resolving it first if given
+ * by hostname, of the address family family, 0 for any. Returns the
+ * hostname endpoint, or "" if s is an address, and the endpoint of the
+ * other address family the endpoint is raced against, if the hostname has
+ * addresses of both.
+ */
+func (device *Device) createEndpointResolving(key wgcfg.Key, s string, family int) (endpoint, race conn.Endpoint, host string, err error) {
+	if !endpointIsHostname(s) {
+		endpoint, err = device.createEndpoint(key, s)
+		if err == nil && !endpointOfFamily(family, endpoint) {
+			return nil, nil, "", errFamilyDisabled
+		}
+		return endpoint, nil, "", err
+	}
+	addrs, err := device.lookupEndpoint(s, family)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	addr, raceAddr := raceAddrs(addrs)
+	endpoint, err = device.createEndpoint(key, addr.String())
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if raceAddr != nil {
+		race, err = device.createEndpoint(key, raceAddr.String())
+		if err != nil {
+			return nil, nil, "", err
+		}
+	}
+	return endpoint, race, s, nil
+}
+
+/* Checks the form of the hostname endpoint s, a host and a port, without
+ * resolving it.
+ */
+func checkHostnameEndpoint(s string) error {
+	_, portString, err := net.SplitHostPort(s)
+	if err != nil {
+		return err
+	}
+	_, err = strconv.ParseUint(portString, 10, 16)
+	return err
+}
+
+/* Resolves the hostname endpoint s to its addresses of family, 0 for any.
+ */
+func (device *Device) lookupEndpoint(s string, family int) ([]*net.UDPAddr, error) {
+	host, portString, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := device.lookupHost(host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("no addresses for " + host)
+	}
+	addrs := make([]*net.UDPAddr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = &net.UDPAddr{IP: ip, Port: int(port)}
+	}
+	if addrs = addrsOfFamily(family, addrs); len(addrs) == 0 {
+		return nil, errors.New("no addresses of the enabled address family for " + host)
+	}
+	return addrs, nil
+}
+
+/* Resolves the hostname endpoint s to an address of family, 0 for any,
+ * keeping prefer if it is still among the addresses of the hostname.
+ */
+func (device *Device) resolveEndpoint(s string, prefer net.IP, family int) (*net.UDPAddr, error) {
+	addrs, err := device.lookupEndpoint(s, family)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if addr.IP.Equal(prefer) {
+			return addr, nil
+		}
+	}
+	return addrs[0], nil
+}
+
+/* Resolves the hostname of the endpoint of the peer again, updating the
+ * endpoint if the address changed, then rearms itself. The timer is armed
+ * for peers without a hostname too, and stops at the first expiry.
+ */
+func expiredResolveEndpoint(peer *Peer) {
+	device := peer.device
+
+	peer.RLock()
+	host := peer.endpointHost
+	resolved := peer.endpointResolved
+	var current *net.UDPAddr
+	if peer.endpoint != nil {
+		current, _ = net.ResolveUDPAddr("udp", peer.endpoint.DstToString())
+	}
+	peer.RUnlock()
+
+	if host == "" || current == nil {
+		return
+	}
+	defer peer.timersResolveEndpoint()
+
+	// leave a peer which roamed while it is active
+
+	lastRX := time.Unix(0, atomic.LoadInt64(&peer.stats.lastRXNano))
+	if current.String() != resolved && time.Since(lastRX) < device.keepaliveTimeout()+device.rekeyTimeout() {
+		return
+	}
+
+	addr, err := device.resolveEndpoint(host, current.IP, device.listenFamily())
+	if err != nil {
+		device.log.Verbosef("%v - Failed to resolve endpoint %s, keeping %v: %v", peer, host, current, err)
+		return
+	}
+
+	handler := device.endpointChangeHandler()
+
+	peer.Lock()
+	if peer.endpointHost != host || peer.endpoint == nil {
+		peer.Unlock() // reconfigured meanwhile
+		return
+	}
+	old := peer.endpoint.DstToString()
+	if err := peer.endpoint.UpdateDst(addr); err != nil {
+		peer.Unlock()
+		device.log.Verbosef("%v - Failed to update endpoint %s: %v", peer, host, err)
+		return
+	}
+	new := peer.endpoint.DstToString()
+	peer.endpointResolved = new
+	peer.Unlock()
+
+	if new != old {
+		device.log.Verbosef("%v - Endpoint %s resolved to %s", peer, host, new)
+		peer.endpointChanged(handler, old, new)
+	}
+}
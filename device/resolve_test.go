@@ -0,0 +1,120 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+func TestEndpointIsHostname(t *testing.T) {
+	for s, want := range map[string]bool{
+		"peer.example.com:51820": true,
+		"localhost:51820":        true,
+		"gw01:51820":             true,
+		"10.in-addr.arpa:51820":  true,
+		"127.0.0.1:51820":        false,
+		"[::1]:51820":            false,
+		"[fe80::1%eth0]:51820":   false,
+		"peer.example.com":       false,
+		":51820":                 false,
+	} {
+		if got := endpointIsHostname(s); got != want {
+			t.Errorf("endpointIsHostname(%q) = %v, want %v", s, got, want)
+		}
+	}
+}
+
+func TestResolveEndpoint(t *testing.T) {
+	var mu sync.Mutex
+	hosts := map[string][]net.IP{"peer.test": {net.IPv4(127, 0, 0, 1)}}
+	network := bindtest.NewNetwork(1)
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger:         NewLogger(LogLevelError, "dev: "),
+		CreateBind:     network.CreateBind,
+		CreateEndpoint: network.CreateEndpoint,
+		LookupHost: func(host string) ([]net.IP, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if ips, ok := hosts[host]; ok {
+				return ips, nil
+			}
+			return nil, errors.New("no such host")
+		},
+	})
+	defer device.Close()
+	device.Up()
+
+	key := mustParseHexKey(t, "f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725")
+	cfg := strings.Replace(cfg1, "endpoint=127.0.0.1:53512", "endpoint=peer.test:53512", 1)
+	if err := ipcSet(device, "endpoint_resolve_interval=20\n"+cfg); err != nil {
+		t.Fatal(err)
+	}
+	get := ipcGet(t, device)
+	for _, line := range []string{"endpoint=127.0.0.1:53512\n", "endpoint_hostname=peer.test:53512\n", "endpoint_resolve_interval=20\n"} {
+		if !strings.Contains(get, line) {
+			t.Errorf("%q missing from get:\n%s", line, get)
+		}
+	}
+
+	if err := ipcSet(device, "public_key="+key.HexString()+"\nendpoint=unknown.test:53512\n"); err == nil {
+		t.Error("unresolvable endpoint accepted")
+	}
+
+	changes := make(chan string, 1)
+	device.SetEndpointChangeHandler(func(_ wgcfg.Key, _, new string) {
+		changes <- new
+	})
+
+	// a new address is followed
+
+	mu.Lock()
+	hosts["peer.test"] = []net.IP{net.IPv4(127, 0, 0, 2), net.IPv4(127, 0, 0, 3)}
+	mu.Unlock()
+	select {
+	case new := <-changes:
+		if new != "127.0.0.2:53512" {
+			t.Errorf("endpoint changed to %s, want 127.0.0.2:53512", new)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("endpoint not resolved again")
+	}
+
+	// failures, and the current address among others, keep the address
+
+	mu.Lock()
+	delete(hosts, "peer.test")
+	mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	hosts["peer.test"] = []net.IP{net.IPv4(127, 0, 0, 3), net.IPv4(127, 0, 0, 2)}
+	mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case new := <-changes:
+		t.Errorf("endpoint changed to %s", new)
+	default:
+	}
+	if get := ipcGet(t, device); !strings.Contains(get, "endpoint=127.0.0.2:53512\n") {
+		t.Errorf("endpoint not kept:\n%s", get)
+	}
+
+	// an address clears the hostname
+
+	if err := ipcSet(device, "public_key="+key.HexString()+"\nendpoint=127.0.0.4:53512\n"); err != nil {
+		t.Fatal(err)
+	}
+	if get := ipcGet(t, device); strings.Contains(get, "endpoint_hostname=") {
+		t.Errorf("hostname kept:\n%s", get)
+	}
+}
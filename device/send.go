@@ -9,16 +9,28 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"math/rand"
 	"net"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/tun"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
 )
 
+const (
+	icmpv4DestinationUnreachable = 3
+	icmpv4FragmentationNeeded    = 4
+	icmpv6PacketTooBig           = 2
+	icmpHeaderLen                = 8
+	ipv4MinReassembly            = 576  // largest ICMPv4 error every host accepts
+	ipv6MinMTU                   = 1280 // largest ICMPv6 error every host accepts
+)
+
 /* Outbound flow
  *
  * 1. TUN queue
@@ -46,11 +58,15 @@ import (
 type QueueOutboundElement struct {
 	dropped int32
 	sync.Mutex
-	buffer  *[MaxMessageSize]byte // slice holding the packet data
-	packet  []byte                // slice of "buffer" (always!)
-	nonce   uint64                // nonce for encryption
-	keypair *Keypair              // keypair for encryption
-	peer    *Peer                 // related peer
+	buffer  []byte        // slice holding the packet data
+	packet  []byte        // slice of "buffer" (always!)
+	nonce   uint64        // nonce for encryption
+	keypair *Keypair      // keypair for encryption
+	peer    *Peer         // related peer
+	ds      byte          // DS field for the outer header
+	label   uint32        // flow label for the outer header, 0 for none
+	done    chan struct{} // closed when the element is released, if set
+	probe   bool          // keepalive padded to probe the path MTU
 }
 
 func (device *Device) NewOutboundElement() *QueueOutboundElement {
@@ -61,6 +77,10 @@ func (device *Device) NewOutboundElement() *QueueOutboundElement {
 	elem.nonce = 0
 	elem.keypair = nil
 	elem.peer = nil
+	elem.ds = 0
+	elem.label = 0
+	elem.done = nil
+	elem.probe = false
 	return elem
 }
 
@@ -105,6 +125,33 @@ func addToOutboundAndEncryptionQueues(outboundQueue chan *QueueOutboundElement,
 	}
 }
 
+/* Queues a keepalive behind the packets already queued for peer,
+ * returning a channel closed once it has been sent or dropped. This
+ * is done if peer has a current keypair or packets awaiting one,
+ * otherwise nil is returned.
+ */
+func (peer *Peer) queueFinalKeepalive() <-chan struct{} {
+	peer.routines.Lock()
+	defer peer.routines.Unlock()
+
+	if !peer.isRunning.Get() {
+		return nil
+	}
+	if len(peer.queue.nonce) == 0 && !peer.queue.packetInNonceQueueIsAwaitingKey.Get() {
+		keypair := peer.keypairs.Current()
+		if keypair == nil || time.Since(keypair.created) > peer.device.rejectAfterTime() {
+			return nil
+		}
+	}
+	elem := peer.device.NewOutboundElement()
+	elem.packet = nil
+	done := make(chan struct{})
+	elem.done = done
+	addToNonceQueue(peer.queue.nonce, elem, peer.device)
+	peer.queue.nonceHigh.observe(len(peer.queue.nonce))
+	return done
+}
+
 /* Queues a keepalive if no packets are queued for peer
  */
 func (peer *Peer) SendKeepalive() bool {
@@ -115,7 +162,7 @@ func (peer *Peer) SendKeepalive() bool {
 	elem.packet = nil
 	select {
 	case peer.queue.nonce <- elem:
-		//peer.device.log.Debug.Println(peer, "- Sending keepalive packet")
+		//peer.device.log.Verbosef("%v - Sending keepalive packet", peer)
 		return true
 	default:
 		peer.device.PutMessageBuffer(elem.buffer)
@@ -125,51 +172,89 @@ func (peer *Peer) SendKeepalive() bool {
 }
 
 func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
+	if peer.device.isPaused.Get() {
+		return nil
+	}
+	if peer.device.passive.Get() {
+		return errors.New("device is passive; skipped")
+	}
+
+	// a handshake under way is left to its retransmit timer, which backs
+	// off; others wait out the backoff reached by the last handshake
+
+	var interval time.Duration
 	if !isRetry {
-		atomic.StoreUint32(&peer.timers.handshakeAttempts, 0)
+		if peer.timersActive() && peer.timers.retransmitHandshake.IsPending() {
+			return nil
+		}
+		interval = peer.handshakeRetransmitTimeout()
 	}
 
 	peer.handshake.mutex.RLock()
-	if !isRetry && time.Since(peer.handshake.lastSentHandshake) < RekeyTimeout {
+	if !isRetry && time.Since(peer.handshake.lastSentHandshake) < interval {
 		peer.handshake.mutex.RUnlock()
 		return nil
 	}
 	peer.handshake.mutex.RUnlock()
 
 	peer.handshake.mutex.Lock()
-	if !isRetry && time.Since(peer.handshake.lastSentHandshake) < RekeyTimeout {
+	if !isRetry && time.Since(peer.handshake.lastSentHandshake) < interval {
 		peer.handshake.mutex.Unlock()
 		return nil
 	}
 	peer.handshake.lastSentHandshake = time.Now()
 	peer.handshake.mutex.Unlock()
 
+	// a new handshake, the last having completed or been given up on
+
+	if !isRetry {
+		atomic.StoreUint32(&peer.timers.handshakeAttempts, 0)
+	}
+
 	if peer.endpoint == nil {
 		return errors.New("no peer endpoint; skipped")
 	}
 
-	peer.device.log.Debug.Printf("%v - %v Send handshake init %v", peer, peer.device, peer.endpoint)
+	peer.device.log.Verbosef("%v - %v Send handshake init %v", peer, peer.device, peer.endpoint)
+
+	// hybrid with post-quantum peers, and those which advertised it, if enabled
+
+	peer.handshake.mutex.RLock()
+	hybrid := (peer.handshake.postQuantum || peer.handshake.remotePostQuantum) && peer.device.postQuantum.Get()
+	peer.handshake.mutex.RUnlock()
 
-	msg, err := peer.device.CreateMessageInitiation(peer)
+	var msg interface{}
+	var err error
+	peer.device.handshakeGate.enter()
+	if hybrid {
+		msg, err = peer.device.CreateMessageHybridInitiation(peer)
+	} else {
+		msg, err = peer.device.CreateMessageInitiation(peer)
+	}
+	peer.device.handshakeGate.leave()
 	if err != nil {
-		peer.device.log.Error.Println(peer, "- Failed to create initiation message:", err)
+		peer.device.log.Errorf("%v - Failed to create initiation message: %v", peer, err)
 		return err
 	}
 
-	var buff [MessageInitiationSize]byte
+	var buff [MessageHybridInitiationSize]byte
 	writer := bytes.NewBuffer(buff[:0])
 	binary.Write(writer, binary.LittleEndian, msg)
 	packet := writer.Bytes()
 	peer.cookieGenerator.AddMacs(packet)
+	packet = peer.device.padHandshake(packet)
 
 	peer.timersAnyAuthenticatedPacketTraversal()
 	peer.timersAnyAuthenticatedPacketSent()
 
 	err = peer.SendBuffer(packet)
 	if err != nil {
-		peer.device.log.Error.Println(peer, "- Failed to send handshake initiation:", err)
+		peer.device.log.Errorf("%v - Failed to send handshake initiation: %v", peer, err)
 	}
+	peer.raceHandshakeInitiation(packet)
+	peer.punchHandshakeInitiation(packet)
 	peer.timersHandshakeInitiated()
+	atomic.AddUint64(&peer.stats.handshakeAttempts, 1)
 
 	return err
 }
@@ -181,24 +266,39 @@ func (peer *Peer) SendHandshakeResponse() error {
 
 	// We have to hold the peer lock to read peer.endpoint.
 	peer.RLock()
-	peer.device.log.Debug.Printf("%v - Send handshake response %v", peer, peer.endpoint)
+	peer.device.log.Verbosef("%v - Send handshake response %v", peer, peer.endpoint)
 	peer.RUnlock()
 
-	response, err := peer.device.CreateMessageResponse(peer)
+	// answer hybrid initiations in kind
+
+	peer.handshake.mutex.RLock()
+	hybrid := peer.handshake.remoteKEM != nil
+	peer.handshake.mutex.RUnlock()
+
+	var response interface{}
+	var err error
+	peer.device.handshakeGate.enter()
+	if hybrid {
+		response, err = peer.device.CreateMessageHybridResponse(peer)
+	} else {
+		response, err = peer.device.CreateMessageResponse(peer)
+	}
+	peer.device.handshakeGate.leave()
 	if err != nil {
-		peer.device.log.Error.Println(peer, "- Failed to create response message:", err)
+		peer.device.log.Errorf("%v - Failed to create response message: %v", peer, err)
 		return err
 	}
 
-	var buff [MessageResponseSize]byte
+	var buff [MessageHybridResponseSize]byte
 	writer := bytes.NewBuffer(buff[:0])
 	binary.Write(writer, binary.LittleEndian, response)
 	packet := writer.Bytes()
 	peer.cookieGenerator.AddMacs(packet)
+	packet = peer.device.padHandshake(packet)
 
 	err = peer.BeginSymmetricSession()
 	if err != nil {
-		peer.device.log.Error.Println(peer, "- Failed to derive keypair:", err)
+		peer.device.log.Errorf("%v - Failed to derive keypair: %v", peer, err)
 		return err
 	}
 
@@ -208,26 +308,29 @@ func (peer *Peer) SendHandshakeResponse() error {
 
 	err = peer.SendBuffer(packet)
 	if err != nil {
-		peer.device.log.Error.Println(peer, "- Failed to send handshake response", err)
+		peer.device.log.Errorf("%v - Failed to send handshake response %v", peer, err)
 	}
 	return err
 }
 
 func (device *Device) SendHandshakeCookie(initiatingElem *QueueHandshakeElement) error {
 
-	device.log.Debug.Println("Sending cookie response for denied handshake message for", initiatingElem.addr)
+	device.log.Verbosef("Sending cookie response for denied handshake message for %v", initiatingElem.addr)
 
 	sender := binary.LittleEndian.Uint32(initiatingElem.packet[4:8])
 	reply, err := device.cookieChecker.CreateReply(initiatingElem.packet, sender, initiatingElem.endpoint.DstToBytes())
 	if err != nil {
-		device.log.Error.Println("Failed to create cookie reply:", err)
+		device.log.Errorf("Failed to create cookie reply: %v", err)
 		return err
 	}
 
 	var buff [MessageCookieReplySize]byte
 	writer := bytes.NewBuffer(buff[:0])
 	binary.Write(writer, binary.LittleEndian, reply)
-	device.net.bind.Send(writer.Bytes(), initiatingElem.endpoint)
+	if err := device.net.bind.Send(device.padHandshake(writer.Bytes()), initiatingElem.endpoint); err != nil {
+		return err
+	}
+	atomic.AddUint64(&device.stats.cookieRepliesSent, 1)
 	return nil
 }
 
@@ -237,18 +340,17 @@ func (peer *Peer) keepKeyFreshSending() {
 		return
 	}
 	nonce := atomic.LoadUint64(&keypair.sendNonce)
-	if nonce > RekeyAfterMessages || (keypair.isInitiator && time.Since(keypair.created) > RekeyAfterTime) {
+	if nonce > peer.device.rekeyAfterMessages() || (keypair.isInitiator && time.Since(keypair.created) > RekeyAfterTime) {
 		peer.SendHandshakeInitiation(false)
 	}
 }
 
-/* Reads packets from the TUN and inserts
+/* Reads packets from a TUN queue and inserts
  * into nonce queue for peer
  *
- * Obs. Single instance per TUN device
+ * Obs. Single instance per TUN queue
  */
-func (device *Device) RoutineReadFromTUN() {
-	logError := device.log.Error
+func (device *Device) RoutineReadFromTUN(queue tun.Queue) {
 
 	defer func() {
 		//logDebug.Println("Routine: TUN reader - stopped")
@@ -258,51 +360,286 @@ func (device *Device) RoutineReadFromTUN() {
 	//logDebug.Println("Routine: TUN reader - started")
 	device.state.starting.Done()
 
-	var elem *QueueOutboundElement
+	// read several packets per call if the queue supports it
+
+	batchReader, ok := queue.(tun.BatchReader)
+	batchSize := 1
+	if ok {
+		batchSize = conn.MaxBatchSize
+	}
+
+	elems := make([]*QueueOutboundElement, batchSize)
+	buffs := make([][]byte, batchSize)
+	sizes := make([]int, batchSize)
+	offset := device.pool.packetOffset
 
 	for {
-		if elem != nil {
-			device.PutMessageBuffer(elem.buffer)
-			device.PutOutboundElement(elem)
+		for i := range elems {
+			if elems[i] == nil {
+				elems[i] = device.NewOutboundElement()
+			} else {
+				elems[i].buffer = device.renewMessageBuffer(elems[i].buffer)
+			}
+			buffs[i] = elems[i].buffer[:len(elems[i].buffer)-messageBufferOverhead+MessageTransportHeaderSize]
 		}
-		elem = device.NewOutboundElement()
 
-		// read packet
-
-		offset := MessageTransportHeaderSize
-		size, err := device.tun.device.Read(elem.buffer[:], offset)
+		// read packets
+
+		var (
+			count int
+			err   error
+		)
+		if batchReader != nil {
+			count, err = batchReader.ReadBatch(buffs, sizes, offset)
+		} else {
+			sizes[0], err = queue.Read(buffs[0], offset)
+			count = 1
+		}
 
 		if err != nil {
 			if !device.isClosed.Get() {
-				logError.Println("Failed to read packet from TUN device:", err)
+				device.log.Errorf("Failed to read packet from TUN device: %v", err)
 				device.Close()
 			}
-			device.PutMessageBuffer(elem.buffer)
-			device.PutOutboundElement(elem)
+			for _, elem := range elems {
+				device.PutMessageBuffer(elem.buffer)
+				device.PutOutboundElement(elem)
+			}
 			return
 		}
 
-		if size == 0 || size > MaxContentSize {
-			continue
+		for i := 0; i < count; i++ {
+			if device.handleOutbound(elems[i], sizes[i]) {
+				elems[i] = nil
+			}
 		}
+	}
+}
 
-		elem.packet = elem.buffer[offset : offset+size]
+/* Routes a packet read from the TUN to its peer.
+ * Returns true if the element was queued, false if it may be reused.
+ */
+func (device *Device) handleOutbound(elem *QueueOutboundElement, size int) bool {
+	peer := device.routeOutbound(elem, size)
+	if peer == nil {
+		return false
+	}
+	return device.queueOutbound(peer, elem)
+}
 
-		peer := device.lookupPeer(elem.packet)
-		if peer == nil {
-			continue
-		}
+/* Finds the peer of a packet read from the TUN, after the outbound
+ * filter, and marks the element for its outer header. Returns nil if the
+ * packet is to be dropped, or has been answered as too large.
+ */
+func (device *Device) routeOutbound(elem *QueueOutboundElement, size int) *Peer {
+	if size == 0 {
+		device.drop(DropMalformed, nil)
+		return nil
+	}
+	if size > len(elem.buffer)-messageBufferOverhead-device.headroom() {
+		device.drop(DropMTU, nil)
+		return nil
+	}
 
-		// insert into nonce/pre-handshake queue
+	offset := device.pool.packetOffset
+	elem.packet = elem.buffer[offset : offset+size]
 
-		if peer.isRunning.Get() {
-			if peer.queue.packetInNonceQueueIsAwaitingKey.Get() {
-				peer.SendHandshakeInitiation(false)
+	peer := device.lookupPeer(elem.packet)
+	if peer == nil {
+		device.drop(DropNoPeer, nil)
+		return nil
+	}
+
+	// let the outbound filter drop or rewrite the packet, routing it anew if rewritten
+
+	if filter, _ := device.filters.outbound.Load().(PacketFilter); filter != nil {
+		switch filter(peer.handshake.remoteStatic, elem.packet) {
+		case FilterDrop:
+			device.drop(DropFiltered, peer)
+			return nil
+		case FilterModify:
+			if peer = device.lookupPeer(elem.packet); peer == nil {
+				device.drop(DropNoPeer, nil)
+				return nil
 			}
-			addToNonceQueue(peer.queue.nonce, elem, device)
-			elem = nil
 		}
 	}
+
+	elem.ds = 0
+	if device.dscpPassthrough.Get() {
+		elem.ds = innerDSCP(elem.packet)
+	}
+	if device.ecn.Get() {
+		elem.ds |= innerECN(elem.packet)
+	}
+	elem.label = peer.flowLabel(elem.packet)
+	device.trackFlow(peer, elem.packet, false)
+
+	// fit the MTU of the peer, as lowered by path MTU discovery
+
+	if mtu := peer.mtu(); mtu > 0 && size > mtu && device.handleOversize(peer, elem, mtu) {
+		return nil
+	}
+
+	device.capturePacket(elem.packet)
+	return peer
+}
+
+/* Inserts a packet read from the TUN into the nonce queue of its peer.
+ * Returns true if the element was queued, false if it may be reused.
+ */
+func (device *Device) queueOutbound(peer *Peer, elem *QueueOutboundElement) bool {
+	if !peer.isRunning.Get() || device.isShuttingDown.Get() || device.isPaused.Get() {
+		return false
+	}
+	if peer.queue.packetInNonceQueueIsAwaitingKey.Get() {
+		peer.SendHandshakeInitiation(false)
+	}
+	if !peer.queueNonce(elem) {
+		return false
+	}
+	peer.queue.nonceHigh.observe(len(peer.queue.nonce))
+	return true
+}
+
+/* Handles a packet read from the TUN device which exceeds the MTU of its
+ * peer. Returns false if the packet is to be sent regardless, as IPv4
+ * packets without the DF bit are, unless path MTU discovery has them
+ * fragmented here instead. Packets which may not be fragmented are
+ * dropped and answered with an ICMP "packet too big" towards their
+ * source, as a router on the path would, within the ICMP rate limit.
+ */
+func (device *Device) handleOversize(peer *Peer, elem *QueueOutboundElement, mtu int) bool {
+	packet := elem.packet
+	if packet[0]>>4 == ipv4.Version && binary.BigEndian.Uint16(packet[IPv4offsetFlags:])&ipv4FlagDontFragment == 0 {
+		if atomic.LoadInt32(&peer.pathMTU) == 0 {
+			return false
+		}
+		device.queueFragments(peer, elem, mtu)
+		return true
+	}
+	device.drop(DropMTU, peer)
+
+	buffer := device.GetMessageBuffer()
+	defer device.PutMessageBuffer(buffer)
+	offset := device.pool.packetOffset
+	size := packetTooBig(buffer[offset:], packet, mtu)
+	if size == 0 {
+		return true
+	}
+
+	device.rate.icmp.Lock()
+	allowed := device.rate.icmp.limit.Take(time.Now())
+	device.rate.icmp.Unlock()
+	if !allowed {
+		return true
+	}
+	_, err := peer.tunQueue.Write(buffer[:offset+size], offset)
+	if err == nil {
+		err = peer.tunQueue.Flush()
+	}
+	if err != nil && !device.isClosed.Get() {
+		device.log.Errorf("Failed to write packet to TUN device: %v", err)
+	}
+	return true
+}
+
+/* Writes into buff an ICMP "packet too big" answering packet, reporting
+ * mtu, and returns its size. Returns 0 if the packet must not be answered:
+ * ICMP errors and non-initial fragments never are.
+ */
+func packetTooBig(buff []byte, packet []byte, mtu int) int {
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		if len(packet) < ipv4.HeaderLen {
+			return 0
+		}
+		ihl := int(packet[0]&0x0f) * 4
+		if ihl < ipv4.HeaderLen || ihl > len(packet) {
+			return 0
+		}
+		if binary.BigEndian.Uint16(packet[IPv4offsetFlags:])&ipv4FragmentOffset != 0 {
+			return 0
+		}
+		if packet[9] == 1 && len(packet) > ihl && isICMPv4Error(packet[ihl]) {
+			return 0
+		}
+
+		quote := len(packet)
+		if max := ipv4MinReassembly - ipv4.HeaderLen - icmpHeaderLen; quote > max {
+			quote = max
+		}
+		size := ipv4.HeaderLen + icmpHeaderLen + quote
+
+		reply := buff[:size]
+		reply[0] = ipv4.Version<<4 | ipv4.HeaderLen/4
+		reply[IPv4offsetTOS] = 0
+		binary.BigEndian.PutUint16(reply[IPv4offsetTotalLength:], uint16(size))
+		binary.BigEndian.PutUint32(reply[4:], 0) // identification and flags
+		reply[8] = 64                            // TTL
+		reply[9] = 1                             // ICMP
+		copy(reply[IPv4offsetSrc:IPv4offsetSrc+net.IPv4len], packet[IPv4offsetDst:IPv4offsetDst+net.IPv4len])
+		copy(reply[IPv4offsetDst:IPv4offsetDst+net.IPv4len], packet[IPv4offsetSrc:IPv4offsetSrc+net.IPv4len])
+		binary.BigEndian.PutUint16(reply[IPv4offsetChecksum:], 0)
+		binary.BigEndian.PutUint16(reply[IPv4offsetChecksum:], ^checksum(reply[:ipv4.HeaderLen], 0))
+
+		icmp := reply[ipv4.HeaderLen:]
+		icmp[0] = icmpv4DestinationUnreachable
+		icmp[1] = icmpv4FragmentationNeeded
+		binary.BigEndian.PutUint32(icmp[2:], 0) // checksum and unused
+		binary.BigEndian.PutUint16(icmp[6:], uint16(mtu))
+		copy(icmp[icmpHeaderLen:], packet[:quote])
+		binary.BigEndian.PutUint16(icmp[2:], ^checksum(icmp, 0))
+		return size
+
+	case ipv6.Version:
+		if len(packet) < ipv6.HeaderLen {
+			return 0
+		}
+		if packet[6] == 58 && len(packet) > ipv6.HeaderLen && packet[ipv6.HeaderLen] < 128 {
+			return 0
+		}
+
+		quote := len(packet)
+		if max := ipv6MinMTU - ipv6.HeaderLen - icmpHeaderLen; quote > max {
+			quote = max
+		}
+		size := ipv6.HeaderLen + icmpHeaderLen + quote
+
+		reply := buff[:size]
+		binary.BigEndian.PutUint32(reply[0:], ipv6.Version<<28)
+		binary.BigEndian.PutUint16(reply[IPv6offsetPayloadLength:], uint16(icmpHeaderLen+quote))
+		reply[6] = 58 // ICMPv6
+		reply[7] = 64 // hop limit
+		copy(reply[IPv6offsetSrc:IPv6offsetSrc+net.IPv6len], packet[IPv6offsetDst:IPv6offsetDst+net.IPv6len])
+		copy(reply[IPv6offsetDst:IPv6offsetDst+net.IPv6len], packet[IPv6offsetSrc:IPv6offsetSrc+net.IPv6len])
+
+		icmp := reply[ipv6.HeaderLen:]
+		icmp[0] = icmpv6PacketTooBig
+		icmp[1] = 0
+		binary.BigEndian.PutUint16(icmp[2:], 0)
+		binary.BigEndian.PutUint32(icmp[4:], uint32(mtu))
+		copy(icmp[icmpHeaderLen:], packet[:quote])
+
+		// the checksum covers a pseudo-header of the addresses, length and protocol
+
+		pseudo := uint32(checksum(reply[IPv6offsetSrc:IPv6offsetDst+net.IPv6len], 0))
+		pseudo += uint32(len(icmp)) + 58
+		binary.BigEndian.PutUint16(icmp[2:], ^checksum(icmp, pseudo))
+		return size
+
+	default:
+		return 0
+	}
+}
+
+func isICMPv4Error(icmpType byte) bool {
+	switch icmpType {
+	case 3, 4, 5, 11, 12: // unreachable, source quench, redirect, time exceeded, parameter problem
+		return true
+	default:
+		return false
+	}
 }
 
 func (device *Device) lookupPeer(packet []byte) *Peer {
@@ -320,11 +657,30 @@ func (device *Device) lookupPeer(packet []byte) *Peer {
 		dst := packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len]
 		return device.allowedips.LookupIPv6(dst)
 	default:
-		device.log.Debug.Println("Received packet with unknown IP version")
+		device.log.Verbosef("Received packet with unknown IP version")
 		return nil
 	}
 }
 
+/* Returns the DSCP bits of the inner packet, leaving out ECN.
+ */
+func innerDSCP(packet []byte) byte {
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		if len(packet) < ipv4.HeaderLen {
+			return 0
+		}
+		return packet[IPv4offsetTOS] &^ 0x3
+	case ipv6.Version:
+		if len(packet) < ipv6.HeaderLen {
+			return 0
+		}
+		return (packet[0]<<4 | packet[1]>>4) &^ 0x3
+	default:
+		return 0
+	}
+}
+
 func (peer *Peer) FlushNonceQueue() {
 	select {
 	case peer.signals.flushNonceQueue <- struct{}{}:
@@ -345,6 +701,19 @@ func (peer *Peer) handshakeDoneCallback() {
 	peer.device.handshakeDone(key, allowedIPs)
 }
 
+/* Returns the current keypair of the peer if packets may still be sent
+ * with it, otherwise nil.
+ */
+func (peer *Peer) sendingKeypair() *Keypair {
+	keypair := peer.keypairs.Current()
+	if keypair != nil && atomic.LoadUint64(&keypair.sendNonce) < RejectAfterMessages {
+		if time.Since(keypair.created) < peer.device.rejectAfterTime() {
+			return keypair
+		}
+	}
+	return nil
+}
+
 /* Queues packets when there is no handshake.
  * Then assigns nonces to packets sequentially
  * and creates "work" structs for workers
@@ -355,12 +724,14 @@ func (peer *Peer) RoutineNonce() {
 	var keypair *Keypair
 
 	device := peer.device
-	logDebug := device.log.Debug
 
-	flush := func() {
+	flush := func(noKeypair bool) {
 		for {
 			select {
 			case elem := <-peer.queue.nonce:
+				if noKeypair {
+					device.drop(DropNoKeypair, peer)
+				}
 				device.PutMessageBuffer(elem.buffer)
 				device.PutOutboundElement(elem)
 			default:
@@ -370,14 +741,14 @@ func (peer *Peer) RoutineNonce() {
 	}
 
 	defer func() {
-		flush()
-		//logDebug.Println(peer, "- Routine: nonce worker - stopped")
+		flush(false)
+		//device.log.Verbosef("%v - Routine: nonce worker - stopped", peer)
 		peer.queue.packetInNonceQueueIsAwaitingKey.Set(false)
 		peer.routines.stopping.Done()
 	}()
 
 	peer.routines.starting.Done()
-	//logDebug.Println(peer, "- Routine: nonce worker - started")
+	//device.log.Verbosef("%v - Routine: nonce worker - started", peer)
 
 	for {
 	NextPacket:
@@ -388,7 +759,7 @@ func (peer *Peer) RoutineNonce() {
 			return
 
 		case <-peer.signals.flushNonceQueue:
-			flush()
+			flush(true)
 			goto NextPacket
 
 		case elem, ok := <-peer.queue.nonce:
@@ -403,11 +774,9 @@ func (peer *Peer) RoutineNonce() {
 
 				// check validity of newest key pair
 
-				keypair = peer.keypairs.Current()
-				if keypair != nil && keypair.sendNonce < RejectAfterMessages {
-					if time.Since(keypair.created) < RejectAfterTime {
-						break
-					}
+				keypair = peer.sendingKeypair()
+				if keypair != nil {
+					break
 				}
 				peer.queue.packetInNonceQueueIsAwaitingKey.Set(true)
 
@@ -422,17 +791,18 @@ func (peer *Peer) RoutineNonce() {
 
 				// wait for key to be established
 
-				//logDebug.Println(peer, "- Awaiting keypair")
+				//device.log.Verbosef("%v - Awaiting keypair", peer)
 
 				select {
 				case <-peer.signals.newKeypairArrived:
-					logDebug.Println(peer, "- Obtained awaited keypair")
+					device.log.Verbosef("%v - Obtained awaited keypair", peer)
 					peer.handshakeDoneCallback()
 
 				case <-peer.signals.flushNonceQueue:
+					device.drop(DropNoKeypair, peer)
 					device.PutMessageBuffer(elem.buffer)
 					device.PutOutboundElement(elem)
-					flush()
+					flush(true)
 					goto NextPacket
 
 				case <-peer.routines.stop:
@@ -463,6 +833,8 @@ func (peer *Peer) RoutineNonce() {
 
 			// add to parallel and sequential queue
 			addToOutboundAndEncryptionQueues(peer.queue.outbound, device.queue.encryption, elem)
+			peer.queue.outboundHigh.observe(len(peer.queue.outbound))
+			device.queue.encryptionHigh.observe(len(device.queue.encryption))
 		}
 	}
 }
@@ -475,8 +847,8 @@ func (peer *Peer) RoutineNonce() {
 func (device *Device) RoutineEncryption() {
 
 	var nonce [chacha20poly1305.NonceSize]byte
-
-	//logDebug := device.log.Debug
+	var pin workerPin
+	padding := newPaddingSource()
 
 	defer func() {
 		for {
@@ -492,11 +864,11 @@ func (device *Device) RoutineEncryption() {
 			}
 		}
 	out:
-		//logDebug.Println("Routine: encryption worker - stopped")
+		//device.log.Verbosef("Routine: encryption worker - stopped")
 		device.state.stopping.Done()
 	}()
 
-	//logDebug.Println("Routine: encryption worker - started")
+	//device.log.Verbosef("Routine: encryption worker - started")
 	device.state.starting.Done()
 
 	for {
@@ -512,6 +884,7 @@ func (device *Device) RoutineEncryption() {
 			if !ok {
 				return
 			}
+			device.pinWorker(&pin)
 
 			// check if dropped
 
@@ -519,50 +892,45 @@ func (device *Device) RoutineEncryption() {
 				continue
 			}
 
-			// populate header fields
-
-			header := elem.buffer[:MessageTransportHeaderSize]
+			device.encrypt(elem, &nonce, padding)
+			elem.Unlock()
+		}
+	}
+}
 
-			fieldType := header[0:4]
-			fieldReceiver := header[4:8]
-			fieldNonce := header[8:16]
+/* Fills in the header of the transport message of the element, and pads
+ * and encrypts its packet in place.
+ */
+func (device *Device) encrypt(elem *QueueOutboundElement, nonce *[chacha20poly1305.NonceSize]byte, padding *rand.Rand) {
+	// populate header fields
 
-			binary.LittleEndian.PutUint32(fieldType, MessageTransportType)
-			binary.LittleEndian.PutUint32(fieldReceiver, elem.keypair.remoteIndex)
-			binary.LittleEndian.PutUint64(fieldNonce, elem.nonce)
+	headroom := device.headroom()
+	header := elem.buffer[headroom : headroom+MessageTransportHeaderSize]
 
-			// pad content to multiple of 16
+	fieldType := header[0:4]
+	fieldReceiver := header[4:8]
+	fieldNonce := header[8:16]
 
-			mtu := int(atomic.LoadInt32(&device.tun.mtu))
-			var paddedSize int
-			if mtu == 0 {
-				paddedSize = (len(elem.packet) + PaddingMultiple - 1) & ^(PaddingMultiple - 1)
-			} else {
-				lastUnit := len(elem.packet)
-				if lastUnit > mtu {
-					lastUnit %= mtu
-				}
-				paddedSize := (lastUnit + PaddingMultiple - 1) & ^(PaddingMultiple - 1)
-				if paddedSize > mtu {
-					paddedSize = mtu
-				}
-			}
-			for i := len(elem.packet); i < paddedSize; i++ {
-				elem.packet = append(elem.packet, 0)
-			}
+	binary.LittleEndian.PutUint32(fieldType, MessageTransportType)
+	binary.LittleEndian.PutUint32(fieldReceiver, elem.keypair.remoteIndex)
+	binary.LittleEndian.PutUint64(fieldNonce, elem.nonce)
 
-			// encrypt content and release to consumer
+	// pad content to multiple of 16, and as the padding scheme has it, within the MTU of the peer
 
-			binary.LittleEndian.PutUint64(nonce[4:], elem.nonce)
-			elem.packet = elem.keypair.send.Seal(
-				header,
-				nonce[:],
-				elem.packet,
-				nil,
-			)
-			elem.Unlock()
-		}
+	paddedSize := device.transportPaddedSize(len(elem.packet), elem.peer.mtu(), padding)
+	for i := len(elem.packet); i < paddedSize; i++ {
+		elem.packet = append(elem.packet, 0)
 	}
+
+	// encrypt content in place
+
+	binary.LittleEndian.PutUint64(nonce[4:], elem.nonce)
+	elem.packet = elem.keypair.send.Seal(
+		header,
+		nonce[:],
+		elem.packet,
+		nil,
+	)
 }
 
 /* Sequentially reads packets from queue and sends to endpoint
@@ -574,9 +942,6 @@ func (peer *Peer) RoutineSequentialSender() {
 
 	device := peer.device
 
-	//logDebug := device.log.Debug
-	logError := device.log.Error
-
 	defer func() {
 		for {
 			select {
@@ -593,14 +958,18 @@ func (peer *Peer) RoutineSequentialSender() {
 			}
 		}
 	out:
-		//logDebug.Println(peer, "- Routine: sequential sender - stopped")
+		//device.log.Verbosef("%v - Routine: sequential sender - stopped", peer)
 		peer.routines.stopping.Done()
 	}()
 
-	//logDebug.Println(peer, "- Routine: sequential sender - started")
+	//device.log.Verbosef("%v - Routine: sequential sender - started", peer)
 
 	peer.routines.starting.Done()
 
+	elems := make([]*QueueOutboundElement, 0, conn.MaxBatchSize)
+	packets := make([]conn.Packet, 0, conn.MaxBatchSize)
+	var pin workerPin
+
 	for {
 		select {
 
@@ -612,30 +981,91 @@ func (peer *Peer) RoutineSequentialSender() {
 			if !ok {
 				return
 			}
+			device.pinWorker(&pin)
 
-			elem.Lock()
-			if elem.IsDropped() {
-				device.PutOutboundElement(elem)
-				continue
-			}
+			// gather whatever else is already queued into one batch
 
-			peer.timersAnyAuthenticatedPacketTraversal()
-			peer.timersAnyAuthenticatedPacketSent()
+			elems = append(elems[:0], elem)
+			closed := false
+		gather:
+			for len(elems) < cap(elems) {
+				select {
+				case elem, ok := <-peer.queue.outbound:
+					if !ok {
+						closed = true
+						break gather
+					}
+					elems = append(elems, elem)
+				default:
+					break gather
+				}
+			}
 
-			// send message and return buffer to pool
+			sending := elems[:0]
+			packets = packets[:0]
+			dataSent := false
+			var delay time.Duration
+			for _, elem := range elems {
+				elem.Lock()
+				if elem.IsDropped() {
+					device.PutOutboundElement(elem)
+					continue
+				}
+				if len(elem.packet) != MessageKeepaliveSize && !elem.probe {
+					wait, ok := peer.rateLimit.tx.reserve(len(elem.packet), RateLimitMaxDelay)
+					if !ok {
+						device.drop(DropRateLimited, peer)
+						device.PutMessageBuffer(elem.buffer)
+						device.PutOutboundElement(elem)
+						continue
+					}
+					if wait > delay {
+						delay = wait
+					}
+				}
+				sending = append(sending, elem)
+				packets = append(packets, conn.Packet{
+					Buffer:    elem.packet,
+					N:         len(elem.packet),
+					DS:        elem.ds,
+					FlowLabel: elem.label,
+				})
+				if len(elem.packet) != MessageKeepaliveSize && !elem.probe {
+					dataSent = true
+				}
+			}
 
-			err := peer.SendBuffer(elem.packet)
-			if len(elem.packet) != MessageKeepaliveSize {
-				peer.timersDataSent()
+			if delay > 0 {
+				time.Sleep(delay)
 			}
-			device.PutMessageBuffer(elem.buffer)
-			device.PutOutboundElement(elem)
-			if err != nil {
-				logError.Println(peer, "- Failed to send data packet", err)
-				continue
+
+			if len(packets) > 0 {
+				peer.timersAnyAuthenticatedPacketTraversal()
+				peer.timersAnyAuthenticatedPacketSent()
+
+				// send messages and return buffers to pool
+
+				err := peer.SendPackets(packets)
+				if dataSent {
+					peer.timersDataSent()
+				}
+				for _, elem := range sending {
+					device.PutMessageBuffer(elem.buffer)
+					device.PutOutboundElement(elem)
+				}
+				if err == conn.ErrMessageTooBig {
+					peer.updatePathMTU()
+				}
+				if err != nil {
+					device.log.Errorf("%v - Failed to send data packet %v", peer, err)
+				} else {
+					peer.keepKeyFreshSending()
+				}
 			}
 
-			peer.keepKeyFreshSending()
+			if closed {
+				return
+			}
 		}
 	}
 }
@@ -0,0 +1,60 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+/* Exported state carries the configuration of the device as Config has
+ * it: the private key and listening port, and for each peer its keys,
+ * allowed IPs, endpoints and persistent keepalive. It is versioned, so
+ * that a process can refuse state written by a later one it does not
+ * understand.
+ *
+ * Sessions are not carried over: their keys live inside the AEADs made
+ * from them, and migrating them would need the indices and replay
+ * windows of each keypair besides. Peers of an imported device
+ * handshake anew, within a round trip of their next packet.
+ */
+
+const stateVersion = 1
+
+type deviceState struct {
+	Version int
+	Config  *wgcfg.Config
+}
+
+// ExportState serializes the configuration of the device, so that
+// ImportState can restore it into another device, as when handing over
+// to a new process. The state includes the private key of the device,
+// and must be kept as secret as it is.
+func (device *Device) ExportState() ([]byte, error) {
+	return json.Marshal(&deviceState{
+		Version: stateVersion,
+		Config:  device.Config(),
+	})
+}
+
+// ImportState replaces the configuration of the device with that
+// serialized by ExportState.
+func (device *Device) ImportState(state []byte) error {
+	var s deviceState
+	if err := json.Unmarshal(state, &s); err != nil {
+		return fmt.Errorf("invalid device state: %v", err)
+	}
+	if s.Version != stateVersion {
+		return fmt.Errorf("unsupported device state version %d", s.Version)
+	}
+	if s.Config == nil {
+		return errors.New("device state without configuration")
+	}
+	return device.Reconfig(s.Config)
+}
@@ -0,0 +1,52 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+func TestExportImportState(t *testing.T) {
+	network := bindtest.NewNetwork(1)
+	dev1, _, dev2, _ := newBindTestPair(t, network)
+	defer dev1.Close()
+	defer dev2.Close()
+	if err := ipcSet(dev1, "public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725\npersistent_keepalive_interval=25\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := dev1.ExportState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := dev1.Config()
+	dev1.Close()
+
+	tun := tuntest.NewChannelTUN()
+	dev3 := NewDevice(tun.TUN(), &DeviceOptions{
+		Logger:         NewLogger(LogLevelError, "dev3: "),
+		CreateBind:     network.CreateBind,
+		CreateEndpoint: network.CreateEndpoint,
+	})
+	defer dev3.Close()
+	dev3.Up()
+	if err := dev3.ImportState(state); err != nil {
+		t.Fatal(err)
+	}
+	if got := dev3.Config(); !reflect.DeepEqual(want, got) {
+		t.Errorf("imported config differs:\nwant %+v\ngot  %+v", want, got)
+	}
+
+	for _, bad := range []string{"", "{}", `{"Version":1}`, `{"Version":2,"Config":{}}`} {
+		if err := dev3.ImportState([]byte(bad)); err == nil {
+			t.Errorf("imported %q", bad)
+		}
+	}
+}
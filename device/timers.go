@@ -8,6 +8,8 @@
 package device
 
 import (
+	crand "crypto/rand"
+	"encoding/binary"
 	"math/rand"
 	"sync"
 	"sync/atomic"
@@ -82,7 +84,7 @@ func (peer *Peer) timersActive() bool {
 	device := peer.device
 	peer.RUnlock()
 
-	if device == nil || !device.isUp.Get() {
+	if device == nil || !device.isUp.Get() || device.isPaused.Get() {
 		return false
 	}
 
@@ -92,9 +94,104 @@ func (peer *Peer) timersActive() bool {
 	return len(device.peers.keyMap) > 0
 }
 
+func (device *Device) rekeyTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&device.timers.rekeyTimeout))
+}
+
+func (device *Device) keepaliveTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&device.timers.keepaliveTimeout))
+}
+
+func (device *Device) rejectAfterTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&device.timers.rejectAfterTime))
+}
+
+func (device *Device) handshakeBackoffMax() time.Duration {
+	return time.Duration(atomic.LoadInt64(&device.timers.handshakeBackoff))
+}
+
+func (device *Device) rekeyJitterMax() time.Duration {
+	return time.Duration(atomic.LoadInt64(&device.timers.jitterMax))
+}
+
+/* Returns the number of messages sent under a keypair after which the
+ * peer is rekeyed, RekeyAfterMessages unless lowered by
+ * rekey_after_messages.
+ */
+func (device *Device) rekeyAfterMessages() uint64 {
+	return uint64(atomic.LoadInt64(&device.timers.rekeyMessages))
+}
+
+// SetJitterSource replaces the source of the random jitter added to the
+// handshake timers, so that tests may seed it and predict their intervals.
+// A nil source restores the default, seeded from crypto/rand.
+func (device *Device) SetJitterSource(source *rand.Rand) {
+	if source == nil {
+		var seed [8]byte
+		if _, err := crand.Read(seed[:]); err != nil {
+			binary.LittleEndian.PutUint64(seed[:], uint64(time.Now().UnixNano()))
+		}
+		source = rand.New(rand.NewSource(int64(binary.LittleEndian.Uint64(seed[:]))))
+	}
+	device.timers.jitter.Lock()
+	device.timers.jitter.rand = source
+	device.timers.jitter.Unlock()
+}
+
+/* Returns a random jitter of up to the jitter maximum of the device,
+ * RekeyTimeoutJitterMaxMs unless set by rekey_jitter_max, in whole
+ * milliseconds.
+ */
+func (device *Device) timerJitter() time.Duration {
+	max := int32(device.rekeyJitterMax() / time.Millisecond)
+	if max <= 0 {
+		return 0
+	}
+	device.timers.jitter.Lock()
+	defer device.timers.jitter.Unlock()
+	return time.Millisecond * time.Duration(device.timers.jitter.rand.Int31n(max))
+}
+
+/* Returns the retransmit timeout for the given handshake attempt, excluding jitter.
+ * The timeout starts at the rekey timeout and doubles with each attempt,
+ * up to the device's backoff ceiling.
+ */
+func (device *Device) handshakeRetransmitTimeout(attempts uint32) time.Duration {
+	timeout := device.rekeyTimeout()
+	max := device.handshakeBackoffMax()
+	if max < timeout {
+		return timeout
+	}
+	for ; attempts > 0 && timeout < max; attempts-- {
+		timeout *= 2
+	}
+	if timeout > max {
+		timeout = max
+	}
+	return timeout
+}
+
+/* Returns the retransmit timeout for the pending handshake of the peer,
+ * excluding jitter. While the transport of the peer is unreachable, that
+ * is the backoff ceiling, so as not to keep failing against a dead network.
+ */
+func (peer *Peer) handshakeRetransmitTimeout() time.Duration {
+	timeout := peer.device.handshakeRetransmitTimeout(atomic.LoadUint32(&peer.timers.handshakeAttempts))
+	if max := peer.device.handshakeBackoffMax(); peer.transport.unreachable.Get() && max > timeout {
+		timeout = max
+	}
+	return timeout
+}
+
 func expiredRetransmitHandshake(peer *Peer) {
+	if peer.device.passive.Get() {
+		return
+	}
 	if atomic.LoadUint32(&peer.timers.handshakeAttempts) > MaxTimerHandshakes {
-		peer.device.log.Debug.Printf("%s - Handshake did not complete after %d attempts, giving up\n", peer, MaxTimerHandshakes+2)
+		peer.device.log.Verbosef("%s - Handshake did not complete after %d attempts, giving up\n", peer, MaxTimerHandshakes+2)
+		peer.handshakeEvent(HandshakeGaveUp, MaxTimerHandshakes+2)
+		atomic.StoreInt64(&peer.stats.lastHandshakeFailureNano, time.Now().UnixNano())
+		atomic.StoreInt64(&peer.stats.handshakeStartedNano, 0)
 
 		if peer.timersActive() {
 			peer.timers.sendKeepalive.Del()
@@ -109,21 +206,68 @@ func expiredRetransmitHandshake(peer *Peer) {
 		 * of a partial exchange.
 		 */
 		if peer.timersActive() && !peer.timers.zeroKeyMaterial.IsPending() {
-			peer.timers.zeroKeyMaterial.Mod(RejectAfterTime * 3)
+			peer.timers.zeroKeyMaterial.Mod(peer.device.rejectAfterTime() * 3)
 		}
 	} else {
-		atomic.AddUint32(&peer.timers.handshakeAttempts, 1)
+		attempts := atomic.AddUint32(&peer.timers.handshakeAttempts, 1)
 		if false {
-			peer.device.log.Debug.Printf("%s - Handshake did not complete after %d seconds, retrying (try %d)\n", peer, int(RekeyTimeout.Seconds()), atomic.LoadUint32(&peer.timers.handshakeAttempts)+1)
+			peer.device.log.Verbosef("%s - Handshake did not complete after %d seconds, retrying (try %d)\n", peer, int(peer.device.handshakeRetransmitTimeout(attempts-1).Seconds()), attempts+1)
+		}
+		peer.handshakeEvent(HandshakeRetrying, attempts+1)
+
+		/* We try the next candidate endpoint, if there are several, in
+		 * case the current one is unreachable.
+		 */
+		if attempts%EndpointFailover == 0 {
+			peer.failoverEndpoint()
 		}
 
 		/* We clear the endpoint address src address, in case this is the cause of trouble. */
 		peer.Lock()
-		if peer.endpoint != nil {
-			peer.endpoint.ClearSrc()
-		}
+		peer.clearSrc()
 		peer.Unlock()
 
+		/* Classic implementations drop initiations advertising AES-GCM or
+		 * a next preshared key, so we retry without advertising them. A
+		 * peer whose next preshared key differs from ours fails the
+		 * response, and is answered with the current one once not
+		 * advertised to.
+		 *
+		 * They drop hybrid initiations, and those advertising hybrid
+		 * handshakes, too, but so may an attacker to downgrade the
+		 * session. We fall back to classic initiations only after
+		 * HybridFallbackAttempts went unanswered in a row, never for a
+		 * peer which completed a hybrid handshake before, and not at all
+		 * for one set to take hybrid handshakes.
+		 */
+		peer.handshake.mutex.Lock()
+		if peer.handshake.aesGCMAdvertised {
+			peer.handshake.aesGCMRefused = true
+		}
+		if peer.handshake.nextPresharedKeyOffered {
+			peer.handshake.nextPresharedKeyRefused = true
+		}
+		fallback := false
+		if (peer.handshake.postQuantumAdvertised || peer.handshake.localKEM != nil) && !peer.handshake.postQuantumCompleted {
+			peer.handshake.postQuantumUnanswered++
+			if peer.handshake.postQuantumUnanswered >= HybridFallbackAttempts {
+				peer.handshake.postQuantumUnanswered = 0
+				if peer.handshake.postQuantumAdvertised {
+					peer.handshake.postQuantumRefused = true
+				}
+				if peer.handshake.localKEM != nil {
+					peer.handshake.remotePostQuantum = false
+				}
+				fallback = !peer.handshake.postQuantum
+			}
+		}
+		peer.handshake.mutex.Unlock()
+
+		if fallback {
+			peer.device.log.Errorf("%v - Hybrid handshake unanswered after %d attempts, falling back to classic", peer, HybridFallbackAttempts)
+			peer.handshakeEvent(HandshakePostQuantumFallback, attempts+1)
+		}
+
 		peer.SendHandshakeInitiation(true)
 	}
 }
@@ -133,50 +277,149 @@ func expiredSendKeepalive(peer *Peer) {
 	if peer.timers.needAnotherKeepalive.Get() {
 		peer.timers.needAnotherKeepalive.Set(false)
 		if peer.timersActive() {
-			peer.timers.sendKeepalive.Mod(KeepaliveTimeout)
+			peer.timers.sendKeepalive.Mod(peer.device.keepaliveTimeout())
 		}
 	}
 }
 
 func expiredNewHandshake(peer *Peer) {
-	peer.device.log.Debug.Printf("%s - Retrying handshake because we stopped hearing back after %d seconds\n", peer, int((KeepaliveTimeout + RekeyTimeout).Seconds()))
+	if peer.device.passive.Get() {
+		return
+	}
+	peer.device.log.Verbosef("%s - Retrying handshake because we stopped hearing back after %d seconds\n", peer, int((peer.device.keepaliveTimeout() + peer.device.rekeyTimeout()).Seconds()))
+	peer.handshakeEvent(HandshakeTimeout, 1)
 	/* We clear the endpoint address src address, in case this is the cause of trouble. */
 	peer.Lock()
-	if peer.endpoint != nil {
-		peer.endpoint.ClearSrc()
-	}
+	peer.clearSrc()
 	peer.Unlock()
 	peer.SendHandshakeInitiation(false)
 
 }
 
 func expiredZeroKeyMaterial(peer *Peer) {
-	peer.device.log.Debug.Printf("%s - Removing all keys, since we haven't received a new one in %d seconds\n", peer, int((RejectAfterTime * 3).Seconds()))
+	peer.device.log.Verbosef("%s - Removing all keys, since we haven't received a new one in %d seconds\n", peer, int((peer.device.rejectAfterTime() * 3).Seconds()))
 	peer.ZeroAndFlushAll()
 }
 
+func expiredIdle(peer *Peer) {
+	peer.device.log.Verbosef("%s - Removing peer, since we haven't received an authenticated packet in %d seconds\n", peer, atomic.LoadUint32(&peer.timers.idleTimeout))
+	peer.handshakeEvent(HandshakePeerRemoved, 0)
+
+	/* Removal stops the peer's timers, including this one, so it cannot run here.
+	 * By then the peer may have been removed and added anew, which is left be.
+	 */
+	go peer.device.removePeer(peer)
+}
+
+func expiredUnreachable(peer *Peer) {
+	peer.device.log.Verbosef("%s - Peer unreachable, nothing received within %d seconds of sending data\n", peer, atomic.LoadUint32(&peer.timers.unreachableTimeout))
+	peer.handshakeEvent(HandshakeUnreachable, 0)
+
+	if peer.timers.unreachableClearSrc.Get() {
+		peer.Lock()
+		peer.clearSrc()
+		peer.Unlock()
+	}
+}
+
 func expiredPersistentKeepalive(peer *Peer) {
 	peer.RLock()
 	persistentKeepaliveInterval := peer.persistentKeepaliveInterval
+	adaptive := peer.adaptiveKeepalive
+	max := peer.adaptiveKeepaliveMax
+	noNAT := peer.noNAT
 	peer.RUnlock()
 
 	if persistentKeepaliveInterval > 0 {
+		if noNAT && peer.keepaliveSuppressed() {
+			if peer.timersActive() {
+				peer.timers.persistentKeepalive.Mod(time.Duration(persistentKeepaliveInterval) * time.Second)
+			}
+			return
+		}
+		if adaptive {
+			peer.widenPersistentKeepalive(persistentKeepaliveInterval, max)
+		}
+		atomic.StoreInt64(&peer.stats.lastKeepaliveNano, time.Now().UnixNano())
 		peer.SendKeepalive()
 	}
 }
 
+/* Returns whether a persistent keepalive may be left out, for a peer
+ * without NAT on its path: one has been sent since the handshake, and
+ * either data was received or a keepalive was sent within
+ * SuppressedKeepalive. Peers seen roaming may be behind NAT, whose
+ * binding would expire, so they are always sent keepalives.
+ */
+func (peer *Peer) keepaliveSuppressed() bool {
+	if peer.timers.natObserved.Get() {
+		return false
+	}
+	lastKeepalive := atomic.LoadInt64(&peer.stats.lastKeepaliveNano)
+	if lastKeepalive == 0 {
+		return false
+	}
+	now := time.Now().UnixNano()
+	if now-lastKeepalive < int64(SuppressedKeepalive) {
+		return true
+	}
+	return now-atomic.LoadInt64(&peer.stats.lastRXNano) < int64(SuppressedKeepalive)
+}
+
+/* Doubles the adaptive persistent keepalive interval, never exceeding the
+ * configured maximum so that NAT bindings are kept alive.
+ */
+func (peer *Peer) widenPersistentKeepalive(base, max uint16) {
+	ceiling := uint32(AdaptiveKeepaliveMax / time.Second)
+	if max != 0 {
+		ceiling = uint32(max)
+	}
+	interval := atomic.LoadUint32(&peer.timers.keepaliveInterval)
+	if interval < uint32(base) {
+		interval = uint32(base)
+	}
+	interval *= 2
+	if interval > ceiling {
+		interval = ceiling
+	}
+	if interval < uint32(base) {
+		interval = uint32(base)
+	}
+	atomic.StoreUint32(&peer.timers.keepaliveInterval, interval)
+}
+
+/* Snaps the adaptive persistent keepalive interval back to the configured one. */
+func (peer *Peer) resetPersistentKeepalive() {
+	if atomic.SwapUint32(&peer.timers.keepaliveInterval, 0) == 0 {
+		return
+	}
+
+	peer.RLock()
+	persistentKeepaliveInterval := peer.persistentKeepaliveInterval
+	peer.RUnlock()
+
+	if persistentKeepaliveInterval > 0 && peer.timersActive() && peer.timers.persistentKeepalive.IsPending() {
+		peer.timers.persistentKeepalive.Mod(time.Duration(persistentKeepaliveInterval) * time.Second)
+	}
+}
+
 /* Should be called after an authenticated data packet is sent. */
 func (peer *Peer) timersDataSent() {
+	peer.resetPersistentKeepalive()
 	if peer.timersActive() && !peer.timers.newHandshake.IsPending() {
-		peer.timers.newHandshake.Mod(KeepaliveTimeout + RekeyTimeout + time.Millisecond*time.Duration(rand.Int31n(RekeyTimeoutJitterMaxMs)))
+		peer.timers.newHandshake.Mod(peer.device.keepaliveTimeout() + peer.device.rekeyTimeout() + peer.device.timerJitter())
+	}
+	if timeout := atomic.LoadUint32(&peer.timers.unreachableTimeout); timeout > 0 && peer.timersActive() && !peer.timers.unreachable.IsPending() {
+		peer.timers.unreachable.Mod(time.Duration(timeout) * time.Second)
 	}
 }
 
 /* Should be called after an authenticated data packet is received. */
 func (peer *Peer) timersDataReceived() {
+	peer.resetPersistentKeepalive()
 	if peer.timersActive() {
 		if !peer.timers.sendKeepalive.IsPending() {
-			peer.timers.sendKeepalive.Mod(KeepaliveTimeout)
+			peer.timers.sendKeepalive.Mod(peer.device.keepaliveTimeout())
 		} else {
 			peer.timers.needAnotherKeepalive.Set(true)
 		}
@@ -194,21 +437,28 @@ func (peer *Peer) timersAnyAuthenticatedPacketSent() {
 func (peer *Peer) timersAnyAuthenticatedPacketReceived() {
 	if peer.timersActive() {
 		peer.timers.newHandshake.Del()
+		peer.timers.unreachable.Del()
+	}
+	peer.timersIdleReset()
+}
+
+/* Should be called when the idle timeout changes or an authenticated packet is received. */
+func (peer *Peer) timersIdleReset() {
+	if !peer.timersActive() {
+		return
+	}
+	if idleTimeout := atomic.LoadUint32(&peer.timers.idleTimeout); idleTimeout > 0 {
+		peer.timers.idle.Mod(time.Duration(idleTimeout) * time.Second)
+	} else {
+		peer.timers.idle.Del()
 	}
 }
 
 /* Should be called after a handshake initiation message is sent. */
 func (peer *Peer) timersHandshakeInitiated() {
+	atomic.CompareAndSwapInt64(&peer.stats.handshakeStartedNano, 0, time.Now().UnixNano())
 	if peer.timersActive() {
-		timeout := RekeyTimeout
-		attempts := atomic.LoadUint32(&peer.timers.handshakeAttempts)
-		if attempts == 0 {
-			attempts = 1
-		}
-		if t := time.Duration(attempts) * time.Second; t < timeout {
-			timeout = t
-		}
-		peer.timers.retransmitHandshake.Mod(timeout + time.Millisecond*time.Duration(rand.Int31n(RekeyTimeoutJitterMaxMs)))
+		peer.timers.retransmitHandshake.Mod(peer.handshakeRetransmitTimeout() + peer.device.timerJitter())
 	}
 }
 
@@ -217,15 +467,32 @@ func (peer *Peer) timersHandshakeComplete() {
 	if peer.timersActive() {
 		peer.timers.retransmitHandshake.Del()
 	}
-	atomic.StoreUint32(&peer.timers.handshakeAttempts, 0)
+	attempts := atomic.SwapUint32(&peer.timers.handshakeAttempts, 0)
+	peer.handshakeEvent(HandshakeCompleted, attempts+1)
+	atomic.StoreUint32(&peer.timers.keepaliveInterval, 0)
+	atomic.StoreInt64(&peer.stats.lastKeepaliveNano, 0)
 	peer.timers.sentLastMinuteHandshake.Set(false)
 	atomic.StoreInt64(&peer.stats.lastHandshakeNano, time.Now().UnixNano())
+	atomic.StoreInt64(&peer.stats.lastHandshakeFailureNano, 0)
+	atomic.AddUint64(&peer.stats.handshakesCompleted, 1)
+	if started := atomic.SwapInt64(&peer.stats.handshakeStartedNano, 0); started != 0 {
+		peer.stats.handshakeLatency.add(time.Duration(time.Now().UnixNano() - started))
+	}
+	peer.timersPathMTUProbe()
+}
+
+/* Should be called after a handshake completes or path MTU discovery is enabled, to start probing the path. */
+func (peer *Peer) timersPathMTUProbe() {
+	if peer.device.pathMTUDiscovery.Get() && peer.timersActive() && !peer.timers.pathMTUProbe.IsPending() {
+		peer.timers.pathMTUProbed.Set(false)
+		peer.timers.pathMTUProbe.Mod(PathMTUProbeTimeout)
+	}
 }
 
 /* Should be called after an ephemeral key is created, which is before sending a handshake response or after receiving a handshake response. */
 func (peer *Peer) timersSessionDerived() {
 	if peer.timersActive() {
-		peer.timers.zeroKeyMaterial.Mod(RejectAfterTime * 3)
+		peer.timers.zeroKeyMaterial.Mod(peer.device.rejectAfterTime() * 3)
 	}
 }
 
@@ -236,10 +503,16 @@ func (peer *Peer) timersAnyAuthenticatedPacketTraversal() {
 	}
 
 	peer.RLock()
-	persistentKeepaliveInterval := peer.persistentKeepaliveInterval
+	persistentKeepaliveInterval := uint32(peer.persistentKeepaliveInterval)
+	adaptive := peer.adaptiveKeepalive
 	peer.RUnlock()
 
 	if persistentKeepaliveInterval > 0 {
+		if adaptive {
+			if interval := atomic.LoadUint32(&peer.timers.keepaliveInterval); interval > persistentKeepaliveInterval {
+				persistentKeepaliveInterval = interval
+			}
+		}
 		peer.timers.persistentKeepalive.Mod(time.Duration(persistentKeepaliveInterval) * time.Second)
 	}
 }
@@ -250,15 +523,68 @@ func (peer *Peer) timersInit() {
 	peer.timers.newHandshake = peer.NewTimer(expiredNewHandshake)
 	peer.timers.zeroKeyMaterial = peer.NewTimer(expiredZeroKeyMaterial)
 	peer.timers.persistentKeepalive = peer.NewTimer(expiredPersistentKeepalive)
+	peer.timers.idle = peer.NewTimer(expiredIdle)
+	peer.timers.unreachable = peer.NewTimer(expiredUnreachable)
+	peer.timers.pathMTUProbe = peer.NewTimer(expiredPathMTUProbe)
+	peer.timers.resolveEndpoint = peer.NewTimer(expiredResolveEndpoint)
 	atomic.StoreUint32(&peer.timers.handshakeAttempts, 0)
+	atomic.StoreUint32(&peer.timers.keepaliveInterval, 0)
 	peer.timers.sentLastMinuteHandshake.Set(false)
 	peer.timers.needAnotherKeepalive.Set(false)
 }
 
+/* Should be called when the device resumes, re-arming the timers stopped
+ * while it was paused.
+ */
+func (peer *Peer) timersResume() {
+	if !peer.timersActive() {
+		return
+	}
+
+	if peer.keypairs.Current() != nil {
+		peer.timersSessionDerived()
+		peer.timersPathMTUProbe()
+	}
+	peer.timersIdleReset()
+
+	if peer.queue.packetInNonceQueueIsAwaitingKey.Get() {
+		peer.SendHandshakeInitiation(false)
+		return
+	}
+
+	/* Rather than all sending a keepalive at once, peers with persistent
+	 * keepalives send their first at their phase within the interval.
+	 */
+	peer.RLock()
+	keepalive := time.Duration(peer.persistentKeepaliveInterval) * time.Second
+	peer.RUnlock()
+
+	if keepalive > 0 {
+		peer.timers.persistentKeepalive.Mod(peer.keepalivePhase(keepalive))
+	}
+}
+
+/* Returns the phase of the persistent keepalives of the peer within the
+ * interval, derived from its public key so that the keepalives of many
+ * peers spread evenly across the interval, and shorter than the interval
+ * so that NAT bindings are kept alive.
+ */
+func (peer *Peer) keepalivePhase(interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return 0
+	}
+	key := peer.handshake.remoteStatic
+	return time.Duration(binary.LittleEndian.Uint64(key[:8]) % uint64(interval))
+}
+
 func (peer *Peer) timersStop() {
 	peer.timers.retransmitHandshake.DelSync()
 	peer.timers.sendKeepalive.DelSync()
 	peer.timers.newHandshake.DelSync()
 	peer.timers.zeroKeyMaterial.DelSync()
 	peer.timers.persistentKeepalive.DelSync()
+	peer.timers.idle.DelSync()
+	peer.timers.unreachable.DelSync()
+	peer.timers.pathMTUProbe.DelSync()
+	peer.timers.resolveEndpoint.DelSync()
 }
@@ -0,0 +1,244 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+func TestHandshakeRetransmitTimeout(t *testing.T) {
+	device := &Device{}
+	atomic.StoreInt64(&device.timers.rekeyTimeout, int64(RekeyTimeout))
+	atomic.StoreInt64(&device.timers.handshakeBackoff, int64(HandshakeBackoffMax))
+
+	tests := []struct {
+		attempts uint32
+		want     time.Duration
+	}{
+		{0, 5 * time.Second},
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{4, 60 * time.Second},
+		{MaxTimerHandshakes, 60 * time.Second},
+		{1 << 31, 60 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := device.handshakeRetransmitTimeout(tt.attempts); got != tt.want {
+			t.Errorf("attempts=%d: got %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+
+	// A ceiling below the rekey timeout disables the backoff.
+	atomic.StoreInt64(&device.timers.handshakeBackoff, int64(time.Second))
+	if got := device.handshakeRetransmitTimeout(3); got != RekeyTimeout {
+		t.Errorf("ceiling below rekey timeout: got %v, want %v", got, RekeyTimeout)
+	}
+}
+
+func TestHandshakeBackoffUnderTraffic(t *testing.T) {
+	dev1, _, dev2, tun2 := newBindTestPair(t, bindtest.NewNetwork(1))
+	defer dev1.Close()
+	defer dev2.Close()
+
+	// nothing listens at the endpoint of the peer, which keeps being sent to
+
+	err := ipcSet(dev2, "rekey_timeout=50\nrekey_jitter_max=0\nhandshake_backoff_max=2000\n"+
+		"public_key=49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427\nendpoint=127.0.0.1:53599\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case tun2.Outbound <- tuntest.Ping(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")):
+			case <-stop:
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+
+	var sent []time.Time
+	for deadline := time.Now().Add(2 * time.Second); len(sent) < 5; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d handshake initiations sent, want 5", len(sent))
+		}
+		if attempts := dev2.Metrics().HandshakeAttempts; attempts > uint64(len(sent)) {
+			sent = append(sent, time.Now())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 2; i < len(sent); i++ {
+		if gap, last := sent[i].Sub(sent[i-1]), sent[i-1].Sub(sent[i-2]); gap <= last {
+			t.Errorf("initiation %d sent %v after the last, which was %v after its own", i, gap, last)
+		}
+	}
+}
+
+func TestAdaptivePersistentKeepalive(t *testing.T) {
+	peer := &Peer{}
+
+	var got []uint32
+	for i := 0; i < 5; i++ {
+		peer.widenPersistentKeepalive(25, 150)
+		got = append(got, atomic.LoadUint32(&peer.timers.keepaliveInterval))
+	}
+	want := []uint32{50, 100, 150, 150, 150}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("intervals = %v, want %v", got, want)
+		}
+	}
+
+	// default ceiling
+	atomic.StoreUint32(&peer.timers.keepaliveInterval, 100)
+	peer.widenPersistentKeepalive(25, 0)
+	if got := atomic.LoadUint32(&peer.timers.keepaliveInterval); got != uint32(AdaptiveKeepaliveMax/time.Second) {
+		t.Errorf("interval = %d, want %d", got, AdaptiveKeepaliveMax/time.Second)
+	}
+
+	// a ceiling below the base interval never lowers it
+	atomic.StoreUint32(&peer.timers.keepaliveInterval, 0)
+	peer.widenPersistentKeepalive(25, 10)
+	if got := atomic.LoadUint32(&peer.timers.keepaliveInterval); got != 25 {
+		t.Errorf("interval = %d, want 25", got)
+	}
+
+	peer.resetPersistentKeepalive()
+	if got := atomic.LoadUint32(&peer.timers.keepaliveInterval); got != 0 {
+		t.Errorf("interval after reset = %d, want 0", got)
+	}
+}
+
+func TestKeepalivePhase(t *testing.T) {
+	const interval = 25 * time.Second
+	var buckets [5]int
+	for i := 0; i < 1000; i++ {
+		peer := &Peer{}
+		rand.Read(peer.handshake.remoteStatic[:])
+		phase := peer.keepalivePhase(interval)
+		if phase < 0 || phase >= interval {
+			t.Fatalf("phase %v outside the interval", phase)
+		}
+		if again := peer.keepalivePhase(interval); again != phase {
+			t.Fatalf("phase %v, then %v", phase, again)
+		}
+		buckets[phase*time.Duration(len(buckets))/interval]++
+	}
+	for i, n := range buckets {
+		if n < 100 {
+			t.Errorf("%d of 1000 phases in fifth %d of the interval: %v", n, i, buckets)
+		}
+	}
+	if phase := (&Peer{}).keepalivePhase(0); phase != 0 {
+		t.Errorf("phase %v of a zero interval", phase)
+	}
+}
+
+func TestTimerJitterSource(t *testing.T) {
+	device := &Device{}
+	device.timers.jitterMax = int64(RekeyTimeoutJitterMaxMs * time.Millisecond)
+	device.SetJitterSource(rand.New(rand.NewSource(7)))
+
+	want := rand.New(rand.NewSource(7))
+	for i := 0; i < 16; i++ {
+		jitter := device.timerJitter()
+		if jitter != time.Millisecond*time.Duration(want.Int31n(RekeyTimeoutJitterMaxMs)) {
+			t.Fatalf("jitter %d = %v, not drawn from the seeded source", i, jitter)
+		}
+		if jitter < 0 || jitter >= RekeyTimeoutJitterMaxMs*time.Millisecond {
+			t.Fatalf("jitter %d = %v out of range", i, jitter)
+		}
+	}
+
+	// a narrower maximum bounds the jitter, and a zero one disables it
+
+	device.timers.jitterMax = int64(10 * time.Millisecond)
+	for i := 0; i < 16; i++ {
+		if jitter := device.timerJitter(); jitter < 0 || jitter >= 10*time.Millisecond {
+			t.Fatalf("jitter %v over a maximum of 10ms", jitter)
+		}
+	}
+	device.timers.jitterMax = 0
+	if jitter := device.timerJitter(); jitter != 0 {
+		t.Errorf("jitter %v with jitter disabled", jitter)
+	}
+}
+
+func TestKeepaliveSuppressed(t *testing.T) {
+	peer := &Peer{}
+	now := time.Now().UnixNano()
+	recently := now - int64(time.Second)
+	idle := now - int64(SuppressedKeepalive) - int64(time.Second)
+
+	tests := []struct {
+		lastKeepalive, lastRX int64
+		natObserved           bool
+		want                  bool
+	}{
+		{0, recently, false, false},       // first keepalive after the handshake
+		{recently, idle, false, true},     // keepalive sent recently
+		{idle, recently, false, true},     // data received recently
+		{idle, idle, false, false},        // idle, liveness is verified
+		{recently, recently, true, false}, // roamed, so maybe behind NAT
+	}
+	for i, tt := range tests {
+		atomic.StoreInt64(&peer.stats.lastKeepaliveNano, tt.lastKeepalive)
+		atomic.StoreInt64(&peer.stats.lastRXNano, tt.lastRX)
+		peer.timers.natObserved.Set(tt.natObserved)
+		if got := peer.keepaliveSuppressed(); got != tt.want {
+			t.Errorf("%d: suppressed %t, want %t", i, got, tt.want)
+		}
+	}
+}
+
+func TestHandshakeLatency(t *testing.T) {
+	var h HandshakeLatency
+	for _, d := range []time.Duration{0, 49 * time.Millisecond, 50 * time.Millisecond, 999 * time.Millisecond, time.Second, time.Minute} {
+		h.add(d)
+	}
+	if want := (HandshakeLatency{2, 1, 0, 1, 2}); h != want {
+		t.Errorf("buckets %v, want %v", h, want)
+	}
+
+	device := randDevice(t)
+	defer device.Close()
+	sk, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := device.NewPeer(sk.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// timed from the first initiation, not the retransmit
+
+	atomic.StoreInt64(&peer.stats.handshakeStartedNano, time.Now().Add(-200*time.Millisecond).UnixNano())
+	peer.timersHandshakeInitiated()
+	peer.timersHandshakeComplete()
+	if want := (HandshakeLatency{0, 0, 1, 0, 0}); peer.metrics(time.Now()).HandshakeLatency != want {
+		t.Errorf("buckets %v, want %v", peer.metrics(time.Now()).HandshakeLatency, want)
+	}
+
+	// completed as responder, without an initiation
+
+	peer.timersHandshakeComplete()
+	if m := device.Metrics(); m.HandshakeLatency != (HandshakeLatency{0, 0, 1, 0, 0}) || m.HandshakesCompleted != 2 {
+		t.Errorf("device buckets %v after %d handshakes", m.HandshakeLatency, m.HandshakesCompleted)
+	}
+}
@@ -6,51 +6,88 @@
 package device
 
 import (
+	"errors"
 	"sync/atomic"
 
 	"github.com/tailscale/wireguard-go/tun"
 )
 
-const DefaultMTU = 1420
+const (
+	DefaultMTU = 1420
+	MinMTU     = 1280 // smallest MTU which may be set, the minimum of IPv6
+	MaxMTU     = 9216 // largest MTU which may be set, that of jumbo frames
+)
+
+/* Changes the MTU of the TUN device, and with it that of the packets sent
+ * through it.
+ */
+func (device *Device) setMTU(mtu int) error {
+	tunDevice, ok := device.tun.device.(tun.MTUDevice)
+	if !ok {
+		return errors.New("TUN device does not support changing its MTU")
+	}
+	if err := tunDevice.SetMTU(mtu); err != nil {
+		return err
+	}
+	device.updateMTU(mtu)
+	return nil
+}
+
+/* Takes mtu as that of the TUN device, whether set through the device or
+ * changed underneath it: message buffers are sized for it, and the MTU of
+ * packets sent to each peer recomputed, a learnt path MTU having been
+ * ignored if it was no lower than the previous MTU.
+ */
+func (device *Device) updateMTU(mtu int) {
+	device.resizeMessageBuffers(mtu)
+	if int(atomic.SwapInt32(&device.tun.mtu, int32(mtu))) == mtu {
+		return
+	}
+	if mtu > MaxMTU {
+		device.log.Verbosef("MTU updated: %v (too large)", mtu)
+	} else {
+		device.log.Verbosef("MTU updated: %v", mtu)
+	}
+	device.publishEvent(UAPIEventJSON{
+		Event: UAPIEventMTU,
+		MTU:   mtu,
+	})
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.keyMap {
+		peer.updatePathMTU()
+	}
+}
 
 func (device *Device) RoutineTUNEventReader() {
 	setUp := false
-	logDebug := device.log.Debug
-	logInfo := device.log.Info
-	logError := device.log.Error
 
-	logDebug.Println("Routine: event worker - started")
+	device.log.Verbosef("Routine: event worker - started")
 	device.state.starting.Done()
 
 	for event := range device.tun.device.Events() {
 		if event&tun.EventMTUUpdate != 0 {
-			mtu, err := device.tun.device.MTU()
-			old := atomic.LoadInt32(&device.tun.mtu)
-			if err != nil {
-				logError.Println("Failed to load updated MTU of device:", err)
-			} else if int(old) != mtu {
-				if mtu+MessageTransportSize > MaxMessageSize {
-					logInfo.Println("MTU updated:", mtu, "(too large)")
-				} else {
-					logInfo.Println("MTU updated:", mtu)
-				}
-				atomic.StoreInt32(&device.tun.mtu, int32(mtu))
+			if mtu, err := device.tun.device.MTU(); err != nil {
+				device.log.Errorf("Failed to load updated MTU of device: %v", err)
+			} else {
+				device.updateMTU(mtu)
 			}
 		}
 
 		if event&tun.EventUp != 0 && !setUp {
-			logInfo.Println("Interface set up")
+			device.log.Verbosef("Interface set up")
 			setUp = true
 			device.Up()
 		}
 
 		if event&tun.EventDown != 0 && setUp {
-			logInfo.Println("Interface set down")
+			device.log.Verbosef("Interface set down")
 			setUp = false
 			device.Down()
 		}
 	}
 
-	logDebug.Println("Routine: event worker - stopped")
+	device.log.Verbosef("Routine: event worker - stopped")
 	device.state.stopping.Done()
 }
@@ -8,6 +8,9 @@ package device
 import (
 	"errors"
 	"os"
+	"sync/atomic"
+	"testing"
+	"time"
 
 	"github.com/tailscale/wireguard-go/tun"
 )
@@ -54,3 +57,36 @@ func (d *dummyTUN) Write(b []byte, offset int) (int, error) {
 	d.packets <- b[offset:]
 	return len(b), nil
 }
+
+func TestTUNMTUUpdate(t *testing.T) {
+	dummy := newDummyTUN("dummy").(*dummyTUN)
+	dummy.mtu = DefaultMTU
+	device := NewDevice(dummy, &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev: "),
+	})
+	defer device.Close()
+	sub := device.subscribeEvents()
+	defer device.unsubscribeEvents(sub)
+
+	// changes of the MTU underneath the device are taken live, buffers
+	// staying sized for the largest MTU seen
+
+	for _, mtu := range []int{9000, MinMTU} {
+		dummy.mtu = mtu
+		dummy.events <- tun.EventMTUUpdate
+		select {
+		case event := <-sub.events:
+			if event.Event != UAPIEventMTU || event.MTU != mtu {
+				t.Errorf("got event %+v, want MTU %d", event, mtu)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("MTU %d not taken", mtu)
+		}
+		if got := int(atomic.LoadInt32(&device.tun.mtu)); got != mtu {
+			t.Errorf("MTU %d, want %d", got, mtu)
+		}
+		if got := len(device.GetMessageBuffer()); got != 9000+messageBufferOverhead {
+			t.Errorf("MTU %d: buffer of %d bytes, want %d", mtu, got, 9000+messageBufferOverhead)
+		}
+	}
+}
@@ -7,16 +7,24 @@ package device
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/tailscale/wireguard-go/conn"
 	"github.com/tailscale/wireguard-go/ipc"
+	"github.com/tailscale/wireguard-go/replay"
 	"github.com/tailscale/wireguard-go/wgcfg"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 type IPCError struct {
@@ -59,345 +67,2183 @@ func (device *Device) IpcGetOperation(socket *bufio.Writer) *IPCError {
 		if device.net.port != 0 {
 			send(fmt.Sprintf("listen_port=%d", device.net.port))
 		}
+		for _, port := range device.net.ports {
+			send(fmt.Sprintf("listen_port=%d", port))
+		}
+
+		if device.net.address != nil {
+			send("listen_address=" + device.net.address.String())
+		}
+
+		switch device.net.family {
+		case ipv4.Version:
+			send("disable_ipv6=true")
+		case ipv6.Version:
+			send("disable_ipv4=true")
+		}
+
+		if device.net.fwmark != 0 {
+			send(fmt.Sprintf("fwmark=%d", device.net.fwmark))
+		}
+
+		send(fmt.Sprintf("mtu=%d", atomic.LoadInt32(&device.tun.mtu)))
+
+		if device.net.proxy != nil {
+			send("proxy=" + device.net.proxy.String())
+		}
+
+		if device.net.tcp {
+			send("transport=tcp")
+		}
+
+		if device.net.obfuscation != nil {
+			send("obfuscation=" + device.net.obfuscation.String())
+		}
+
+		send(fmt.Sprintf("rekey_timeout=%d", device.rekeyTimeout()/time.Millisecond))
+		send(fmt.Sprintf("keepalive_timeout=%d", device.keepaliveTimeout()/time.Millisecond))
+		send(fmt.Sprintf("reject_after_time=%d", device.rejectAfterTime()/time.Millisecond))
+		send(fmt.Sprintf("handshake_backoff_max=%d", device.handshakeBackoffMax()/time.Millisecond))
+		send(fmt.Sprintf("rekey_jitter_max=%d", device.rekeyJitterMax()/time.Millisecond))
+
+		if device.dscpPassthrough.Get() {
+			send("dscp_passthrough=true")
+		}
+
+		if device.ecn.Get() {
+			send("ecn=true")
+		}
+
+		if device.flowLabelHashing.Get() {
+			send("flow_label_hashing=true")
+		}
+
+		if device.strictAllowedIPs.Get() {
+			send("strict_allowed_ips=true")
+		}
+
+		if device.stickyPort.Get() {
+			send("sticky_port=true")
+		}
+
+		if device.passive.Get() {
+			send("passive=true")
+		}
+
+		if device.eagerHandshake.Get() {
+			send("eager_handshake=true")
+		}
+
+		if device.clockHandshake.Get() {
+			send("clock_jump_handshake=true")
+		}
+
+		if device.postQuantum.Get() {
+			send("post_quantum=true")
+		}
+
+		if device.aesGCM.Get() {
+			send("aes_gcm=true")
+		}
+
+		if device.pathMTUDiscovery.Get() {
+			send("path_mtu_discovery=true")
+		}
+
+		if padding := device.paddingConfig(); padding.scheme != paddingNone {
+			send("padding=" + padding.scheme.String())
+			send(fmt.Sprintf("padding_size=%d", padding.size))
+		}
+
+		if window := atomic.LoadUint32(&device.replayWindow); window != replay.CounterBitsTotal {
+			send(fmt.Sprintf("replay_window=%d", window))
+		}
+
+		if size := atomic.LoadUint32(&device.nonceQueueSize); size != QueueOutboundSize {
+			send(fmt.Sprintf("nonce_queue_size=%d", size))
+		}
+
+		queuePolicy := device.nonceQueuePolicy()
+		if queuePolicy.mode != nonceQueueDropHead {
+			send("nonce_queue_policy=" + queuePolicy.mode.String())
+		}
+		if queuePolicy.timeout != 0 && queuePolicy.timeout != NonceQueueTimeout {
+			send(fmt.Sprintf("nonce_queue_timeout=%d", queuePolicy.timeout/time.Millisecond))
+		}
+
+		threshold, window := device.quarantine.limits()
+		if threshold != 0 {
+			send(fmt.Sprintf("quarantine_threshold=%d", threshold))
+		}
+		if window != 0 && window != QuarantineWindow {
+			send(fmt.Sprintf("quarantine_window=%d", window/time.Millisecond))
+		}
+
+		if sample := atomic.LoadUint32(&device.dropLogSample); sample != 0 {
+			send(fmt.Sprintf("log_drops=%d", sample))
+		}
+
+		if interval := device.endpointResolveInterval(); interval != EndpointResolveInterval {
+			send(fmt.Sprintf("endpoint_resolve_interval=%d", interval/time.Millisecond))
+		}
+
+		if interval := device.portHopInterval(); interval != 0 {
+			send(fmt.Sprintf("port_hop_interval=%d", interval/time.Millisecond))
+		}
+
+		if interval := device.cookieChecker.RotationInterval(); interval != CookieRefreshTime {
+			send(fmt.Sprintf("cookie_rotation_interval=%d", interval/time.Millisecond))
+		}
+
+		if messages := device.rekeyAfterMessages(); messages != RekeyAfterMessages {
+			send(fmt.Sprintf("rekey_after_messages=%d", messages))
+		}
+
+		if limit := device.handshakeGate.getLimit(); limit != 0 {
+			send(fmt.Sprintf("handshake_concurrency=%d", limit))
+		}
+
+		if prefix4, prefix6 := device.rate.limiter.PrefixLengths(); prefix4 != 8*net.IPv4len || prefix6 != 8*net.IPv6len {
+			send(fmt.Sprintf("handshake_rate_limit_prefix_ipv4=%d", prefix4))
+			send(fmt.Sprintf("handshake_rate_limit_prefix_ipv6=%d", prefix6))
+		}
+
+		// handshake counters, read-only
+
+		send(fmt.Sprintf("cookie_replies_sent=%d", atomic.LoadUint64(&device.stats.cookieRepliesSent)))
+		send(fmt.Sprintf("cookie_replies_rate_limited=%d", atomic.LoadUint64(&device.stats.cookieRepliesLimited)))
+		send(fmt.Sprintf("cookie_secret_rotations=%d", device.cookieChecker.Rotations()))
+		send(fmt.Sprintf("invalid_mac_packets=%d", atomic.LoadUint64(&device.stats.invalidMACs)))
+		send(fmt.Sprintf("handshakes_rejected_under_load=%d", atomic.LoadUint64(&device.stats.rejectedUnderLoad)))
+		send(fmt.Sprintf("handshake_concurrency_limited=%d", device.handshakeGate.limitedCount()))
+		send(fmt.Sprintf("quarantined_sources=%d", device.quarantine.count()))
+
+		// queue depths, read-only
+
+		encryption, decryption, handshake := device.queueDepths()
+		ipcSendQueueDepth(send, "encryption", encryption)
+		ipcSendQueueDepth(send, "decryption", decryption)
+		ipcSendQueueDepth(send, "handshake", handshake)
+
+		// packets dropped, by reason, read-only
+
+		for reason, count := range device.dropCounts() {
+			send(fmt.Sprintf("dropped_%v=%d", DropReason(reason), count))
+		}
+
+		// serialize each peer state
+
+		for _, peer := range device.peers.keyMap {
+			device.ipcGetPeer(send, peer)
+		}
+	}()
+
+	// send lines (does not require resource locks)
+
+	for _, line := range lines {
+		_, err := socket.WriteString(line + "\n")
+		if err != nil {
+			return &IPCError{ipc.IpcErrorIO}
+		}
+	}
+
+	return nil
+}
+
+/* Serializes the state of peer, starting with its public key. Must be
+ * called with device.net and device.peers read locked.
+ */
+func (device *Device) ipcGetPeer(send func(string), peer *Peer) {
+	peer.RLock()
+	defer peer.RUnlock()
+
+	send("public_key=" + peer.handshake.remoteStatic.HexString())
+	send("preshared_key=" + peer.handshake.presharedKey.HexString())
+	if !peer.handshake.nextPresharedKey.IsZero() {
+		send("next_preshared_key=" + peer.handshake.nextPresharedKey.HexString())
+	}
+	send("protocol_version=1")
+	if name := peer.Name(); name != "" {
+		send("name=" + name)
+	}
+	if peer.handshake.postQuantum {
+		send("post_quantum=true")
+	}
+	if peer.endpoint != nil {
+		send("endpoint=" + peer.endpoint.DstToString())
+	}
+	if local := peer.localEndpoint(); local != "" {
+		send("local_endpoint=" + local)
+	}
+	if peer.endpointHost != "" {
+		send("endpoint_hostname=" + peer.endpointHost)
+	}
+	for _, candidate := range peer.endpointCandidates {
+		send("endpoint_candidate=" + candidate)
+	}
+	if peer.endpointLocked {
+		send("endpoint_lock=true")
+	}
+	if peer.allowedEndpoints != nil {
+		networks := make([]string, len(peer.allowedEndpoints))
+		for i, network := range peer.allowedEndpoints {
+			networks[i] = network.String()
+		}
+		send("allowed_endpoints=" + strings.Join(networks, ","))
+	}
+	if peer.punch != nil {
+		for _, candidate := range peer.punch.candidates {
+			send("punch_candidate=" + candidate)
+		}
+	}
+	if peer.punchInterval != 0 {
+		send(fmt.Sprintf("punch_interval=%d", peer.punchInterval/time.Millisecond))
+	}
+	if peer.punchBurst != 0 {
+		send(fmt.Sprintf("punch_burst=%d", peer.punchBurst))
+	}
+
+	nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano)
+	secs := nano / time.Second.Nanoseconds()
+	nano %= time.Second.Nanoseconds()
+
+	send(fmt.Sprintf("last_handshake_time_sec=%d", secs))
+	send(fmt.Sprintf("last_handshake_time_nsec=%d", nano))
+	send(fmt.Sprintf("last_handshake_failure_time=%d", atomic.LoadInt64(&peer.stats.lastHandshakeFailureNano)/time.Second.Nanoseconds()))
+	send(fmt.Sprintf("created_time=%d", atomic.LoadInt64(&peer.lifecycle.createdNano)/time.Second.Nanoseconds()))
+	send(fmt.Sprintf("modified_time=%d", atomic.LoadInt64(&peer.lifecycle.modifiedNano)/time.Second.Nanoseconds()))
+	send(fmt.Sprintf("tx_bytes=%d", atomic.LoadUint64(&peer.stats.txBytes)))
+	send(fmt.Sprintf("rx_bytes=%d", atomic.LoadUint64(&peer.stats.rxBytes)))
+	send(fmt.Sprintf("persistent_keepalive_interval=%d", peer.persistentKeepaliveInterval))
+	if peer.adaptiveKeepalive {
+		send("adaptive_keepalive=true")
+		if peer.adaptiveKeepaliveMax != 0 {
+			send(fmt.Sprintf("adaptive_keepalive_max=%d", peer.adaptiveKeepaliveMax))
+		}
+	}
+	if peer.noNAT {
+		send("no_nat=true")
+	}
+
+	if idleTimeout := atomic.LoadUint32(&peer.timers.idleTimeout); idleTimeout != 0 {
+		send(fmt.Sprintf("idle_timeout=%d", idleTimeout))
+	}
+	if unreachableTimeout := atomic.LoadUint32(&peer.timers.unreachableTimeout); unreachableTimeout != 0 {
+		send(fmt.Sprintf("unreachable_timeout=%d", unreachableTimeout))
+		if peer.timers.unreachableClearSrc.Get() {
+			send("unreachable_clear_src=true")
+		}
+	}
+	if peer.replayUnprotected.Get() {
+		send("disable_replay_protection=true")
+	}
+	if rate := peer.rateLimit.tx.getRate(); rate != 0 {
+		send(fmt.Sprintf("tx_rate_limit=%d", rate))
+	}
+	if rate := peer.rateLimit.rx.getRate(); rate != 0 {
+		send(fmt.Sprintf("rx_rate_limit=%d", rate))
+	}
+
+	// timer state, read-only
+
+	pending := func(key string, timer *Timer) {
+		if timer != nil && timer.IsPending() {
+			send(key + "_pending=1")
+		} else {
+			send(key + "_pending=0")
+		}
+	}
+	pending("retransmit_handshake", peer.timers.retransmitHandshake)
+	pending("send_keepalive", peer.timers.sendKeepalive)
+	pending("new_handshake", peer.timers.newHandshake)
+	pending("zero_key_material", peer.timers.zeroKeyMaterial)
+	pending("persistent_keepalive", peer.timers.persistentKeepalive)
+	pending("idle", peer.timers.idle)
+	pending("unreachable", peer.timers.unreachable)
+	send(fmt.Sprintf("handshake_attempts=%d", atomic.LoadUint32(&peer.timers.handshakeAttempts)))
+
+	// current keypair, without key material
+
+	if keypair := peer.keypairs.Current(); keypair != nil {
+		age := time.Since(keypair.created)
+		send(fmt.Sprintf("keypair_local_index=%d", keypair.localIndex))
+		send(fmt.Sprintf("keypair_remote_index=%d", keypair.remoteIndex))
+		messages := atomic.LoadUint64(&keypair.sendNonce)
+		send(fmt.Sprintf("keypair_age_msec=%d", age/time.Millisecond))
+		send(fmt.Sprintf("keypair_messages=%d", messages))
+		send(fmt.Sprintf("rekey_imminent=%t", age > RekeyAfterTime || messages > device.rekeyAfterMessages()))
+		if keypair.aesGCM {
+			send("keypair_cipher=aes-256-gcm")
+		} else {
+			send("keypair_cipher=chacha20-poly1305")
+		}
+	}
+	if exists, confirmed := peer.keypairs.newestConfirmed(); exists {
+		send(fmt.Sprintf("keypair_confirmed=%t", confirmed))
+	}
+
+	if device.pathMTUDiscovery.Get() {
+		send(fmt.Sprintf("path_mtu=%d", peer.mtu()))
+	}
+
+	nonce, outbound, inbound := peer.queueDepths()
+	ipcSendQueueDepth(send, "nonce", nonce)
+	ipcSendQueueDepth(send, "outbound", outbound)
+	ipcSendQueueDepth(send, "inbound", inbound)
+
+	for _, ip := range device.allowedips.EntriesForPeer(peer) {
+		send("allowed_ip=" + ip.String())
+	}
+}
+
+func ipcSendQueueDepth(send func(string), queue string, depth QueueDepth) {
+	send(fmt.Sprintf("%s_queue_len=%d", queue, depth.Len))
+	send(fmt.Sprintf("%s_queue_high=%d", queue, depth.High))
+}
+
+/* Reports the public key of the peer packets to ip would be sent to,
+ * nothing if there is none.
+ */
+func (device *Device) IpcLookupOperation(socket *bufio.Writer, ip string) *IPCError {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		device.log.Errorf("Failed to parse lookup address: %v", ip)
+		return &IPCError{ipc.IpcErrorInvalid}
+	}
+
+	peer, ok := device.LookupPeerByIP(addr)
+	if !ok {
+		return nil
+	}
+	if _, err := socket.WriteString("public_key=" + peer.handshake.remoteStatic.HexString() + "\n"); err != nil {
+		return &IPCError{ipc.IpcErrorIO}
+	}
+	return nil
+}
+
+/* Reports the state of the peer with the public key key, as get reports
+ * it, or nothing if there is no such peer. The key is given in hex, as
+ * elsewhere in the UAPI, or in base64.
+ */
+func (device *Device) IpcGetPeerOperation(socket *bufio.Writer, key string) *IPCError {
+	publicKey, err := parseIpcPeerKey(key)
+	if err != nil {
+		device.log.Errorf("Failed to parse peer key: %v", err)
+		return &IPCError{ipc.IpcErrorInvalid}
+	}
+	return device.ipcSendPeers(socket, func(send func(string)) []*Peer {
+		if peer, ok := device.peers.keyMap[publicKey]; ok {
+			return []*Peer{peer}
+		}
+		return nil
+	})
+}
+
+/* Reports the state of at most limit peers, all if limit is zero, after
+ * the first offset, the page being given as <offset>,<limit>. Peers are
+ * ordered by public key, so that successive pages cover each peer once
+ * while none are added or removed. The number of peers of the device is
+ * sent first, as peer_count.
+ */
+func (device *Device) IpcGetPeersOperation(socket *bufio.Writer, page string) *IPCError {
+	parts := strings.Split(page, ",")
+	if len(parts) != 2 {
+		device.log.Errorf("Failed to parse peer page: %v", page)
+		return &IPCError{ipc.IpcErrorInvalid}
+	}
+	offset, err := strconv.ParseUint(parts[0], 10, 31)
+	if err != nil {
+		device.log.Errorf("Failed to parse peer offset: %v", err)
+		return &IPCError{ipc.IpcErrorInvalid}
+	}
+	limit, err := strconv.ParseUint(parts[1], 10, 31)
+	if err != nil {
+		device.log.Errorf("Failed to parse peer limit: %v", err)
+		return &IPCError{ipc.IpcErrorInvalid}
+	}
+
+	return device.ipcSendPeers(socket, func(send func(string)) []*Peer {
+		send(fmt.Sprintf("peer_count=%d", len(device.peers.keyMap)))
+		if int(offset) >= len(device.peers.keyMap) {
+			return nil
+		}
+		keys := make([]wgcfg.Key, 0, len(device.peers.keyMap))
+		for key := range device.peers.keyMap {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].LessThan(&keys[j])
+		})
+		keys = keys[offset:]
+		if limit != 0 && int(limit) < len(keys) {
+			keys = keys[:limit]
+		}
+		peers := make([]*Peer, len(keys))
+		for i, key := range keys {
+			peers[i] = device.peers.keyMap[key]
+		}
+		return peers
+	})
+}
+
+/* Serializes the peers chosen by selectPeers, which may send lines before
+ * them, with the locks get holds.
+ */
+func (device *Device) ipcSendPeers(socket *bufio.Writer, selectPeers func(send func(string)) []*Peer) *IPCError {
+	var lines []string
+	send := func(line string) {
+		lines = append(lines, line)
+	}
+
+	func() {
+		device.net.RLock()
+		defer device.net.RUnlock()
+		device.peers.RLock()
+		defer device.peers.RUnlock()
+
+		for _, peer := range selectPeers(send) {
+			device.ipcGetPeer(send, peer)
+		}
+	}()
+
+	for _, line := range lines {
+		if _, err := socket.WriteString(line + "\n"); err != nil {
+			return &IPCError{ipc.IpcErrorIO}
+		}
+	}
+	return nil
+}
+
+/* Checks that name is printable and not too long to be shown for a peer.
+ */
+func checkPeerName(name string) error {
+	if len(name) > MaxPeerNameLength {
+		return fmt.Errorf("name longer than %d bytes", MaxPeerNameLength)
+	}
+	if !utf8.ValidString(name) {
+		return errors.New("name is not valid UTF-8")
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return fmt.Errorf("name with unprintable character %q", r)
+		}
+	}
+	return nil
+}
+
+func parseIpcPeerKey(s string) (wgcfg.Key, error) {
+	if key, err := wgcfg.ParseKey(s); err == nil {
+		return *key, nil
+	}
+	return wgcfg.ParseHexKey(s)
+}
+
+/* A set operation is read and validated as a whole before any of it is
+ * applied, so that a malformed request, such as replace_peers followed by
+ * an invalid peer, leaves the device as it was. Only failures of the
+ * system itself, like the listen port being in use, remain possible
+ * while applying; a failed rebind restores the previous network settings.
+ *
+ * With dry_run=true among the device keys, the operation is only read
+ * and validated, and its outcome returned, leaving the device untouched,
+ * as for linting configurations. Failures of the system are then not
+ * found, as nothing is applied, and hostname endpoints are not resolved.
+ */
+
+type ipcSetConfig struct {
+	privateKey *wgcfg.PrivateKey
+
+	// network settings, applied with a single rebind
+
+	rebind  bool
+	port    uint16
+	ports   []uint16 // further listening ports
+	address *net.IPAddr
+	family  int // only address family listened on, by IP version, 0 for both
+	proxy   *conn.SOCKS5Proxy
+	tcp     bool
+	obfs    *obfuscation
+	fwmark  *uint32
+
+	// timer settings are validated against each other
+
+	timers struct {
+		set              bool
+		rekeyTimeout     time.Duration
+		keepaliveTimeout time.Duration
+		rejectAfterTime  time.Duration
+		handshakeBackoff time.Duration
+		jitterMax        time.Duration
+	}
+
+	dscpPassthrough  *bool
+	ecn              *bool
+	flowLabelHashing *bool
+	strictAllowedIPs *bool
+	stickyPort       *bool
+	passive          *bool
+	eagerHandshake   *bool
+	clockHandshake   *bool
+	postQuantum      *bool
+	aesGCM           *bool
+	pathMTUDiscovery *bool
+	padding          *paddingScheme
+	paddingSize      *int
+	nonceQueueMode   *nonceQueueMode
+	nonceQueueWait   *time.Duration
+	quarantine       *int
+	quarantineWindow *time.Duration
+	replayWindow     uint32 // rounded by replay.WindowBits, zero if unset
+	mtu              int    // zero if unset
+	endpointResolve  *time.Duration
+	portHop          *time.Duration
+	cookieRotation   *time.Duration
+	handshakeLimit   *int
+	rekeyMessages    uint64 // zero if unset
+	logDrops         *uint32
+	nonceQueueSize   uint32 // zero if unset
+	resetStats       bool
+
+	ratePrefix struct {
+		set  bool
+		ipv4 int
+		ipv6 int
+	}
+
+	replacePeers bool
+	dryRun       bool // only validate, see above
+	peers        []*ipcSetPeer
+}
+
+type ipcSetPeer struct {
+	publicKey  wgcfg.Key
+	dummy      bool // the device's own key, or a peer not to be created
+	updateOnly bool
+	remove     bool
+
+	presharedKey         *wgcfg.SymmetricKey
+	nextPresharedKey     *wgcfg.SymmetricKey
+	name                 *string
+	endpoint             conn.Endpoint
+	endpointRace         conn.Endpoint
+	endpointHost         string   // "" if the endpoint was given by address
+	endpointCandidates   []string // every endpoint given, in order
+	endpointLock         *bool
+	allowedEndpoints     *[]*net.IPNet
+	punch                *holePunch // nil if unset, without candidates to stop punching
+	punchInterval        *time.Duration
+	punchBurst           *int
+	persistentKeepalive  *uint16
+	adaptiveKeepalive    *bool
+	postQuantum          *bool
+	adaptiveKeepaliveMax *uint16
+	noNAT                *bool
+	idleTimeout          *uint32
+	unreachableTimeout   *uint32
+	unreachableClearSrc  *bool
+	replayUnprotected    *bool
+	txRateLimit          *uint64
+	rxRateLimit          *uint64
+	replaceAllowedIPs    bool
+	allowedIPs           []*net.IPNet
+	removeAllowedIPs     []*net.IPNet
+	zeroKeys             bool
+	resetStats           bool
+	triggerHandshake     bool
+	eagerHandshake       *bool // overrides that of the device for the peer being added
+}
+
+/* Reports whether the operation sets the configuration of the peer, rather
+ * than only acting on it, as zeroing its keys or resetting its stats do.
+ */
+func (p *ipcSetPeer) modifies() bool {
+	return p.presharedKey != nil || p.nextPresharedKey != nil || p.name != nil || p.endpoint != nil ||
+		p.endpointLock != nil || p.allowedEndpoints != nil || p.persistentKeepalive != nil ||
+		p.adaptiveKeepalive != nil || p.postQuantum != nil || p.adaptiveKeepaliveMax != nil ||
+		p.noNAT != nil || p.idleTimeout != nil || p.unreachableTimeout != nil ||
+		p.unreachableClearSrc != nil || p.replayUnprotected != nil || p.txRateLimit != nil ||
+		p.rxRateLimit != nil || p.punch != nil || p.punchInterval != nil || p.punchBurst != nil ||
+		p.replaceAllowedIPs || len(p.allowedIPs) > 0 || len(p.removeAllowedIPs) > 0
+}
+
+func sameIPNet(a, b *net.IPNet) bool {
+	aOnes, _ := a.Mask.Size()
+	bOnes, _ := b.Mask.Size()
+	return aOnes == bOnes && a.IP.Equal(b.IP)
+}
+
+/* Returns networks without the entries for the same prefix as network.
+ */
+func withoutIPNet(networks []*net.IPNet, network *net.IPNet) []*net.IPNet {
+	kept := networks[:0]
+	for _, n := range networks {
+		if !sameIPNet(n, network) {
+			kept = append(kept, n)
+		}
+	}
+	return kept
+}
+
+/* In strict mode, checks that no peer is given a prefix assigned to a
+ * different peer, either already or by the same operation. Prefixes
+ * containing or contained in it do not conflict. A prefix may be
+ * reassigned if the operation first releases it from its owner, through
+ * replace_peers, remove, replace_allowed_ips or remove_allowed_ip.
+ */
+func (device *Device) checkAllowedIPConflicts(peers []*ipcSetPeer, replacePeers bool) error {
+	released := func(owner wgcfg.Key, network *net.IPNet, before int) bool {
+		if replacePeers {
+			return true
+		}
+		for _, p := range peers[:before+1] {
+			if !p.publicKey.Equal(owner) {
+				continue
+			}
+			if p.remove || p.replaceAllowedIPs {
+				return true
+			}
+			for _, n := range p.removeAllowedIPs {
+				if sameIPNet(n, network) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	claimed := make(map[string]wgcfg.Key)
+	for i, p := range peers {
+		if p.dummy {
+			continue
+		}
+		for _, network := range p.allowedIPs {
+			owner, ok := claimed[network.String()]
+			if !ok {
+				ones, _ := network.Mask.Size()
+				if peer := device.allowedips.Owner(network.IP, uint(ones)); peer != nil {
+					owner, ok = peer.handshake.remoteStatic, !released(peer.handshake.remoteStatic, network, i)
+				}
+			}
+			if ok && !owner.Equal(p.publicKey) {
+				device.log.Errorf("Allowed IP %v of peer %v already assigned to peer %v", network, p.publicKey.ShortString(), owner.ShortString())
+				return &IPCError{ipc.IpcErrorInvalid}
+			}
+			claimed[network.String()] = p.publicKey
+		}
+	}
+	return nil
+}
+
+func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
+	config, err := device.ipcParseSet(socket)
+	if err != nil {
+		return err
+	}
+	if config.dryRun {
+		device.log.Verbosef("UAPI: Dry run, configuration is valid")
+		return nil
+	}
+	return device.ipcApplySet(config)
+}
+
+func parseIpcTimer(value string) (time.Duration, error) {
+	ms, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	if ms == 0 {
+		return 0, errors.New("timer must be non-zero")
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+func parseIpcBool(value string) (bool, error) {
+	switch value {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid value: %v", value)
+}
+
+/* Reads a set operation up to the first empty line or the end of input,
+ * without modifying the device.
+ */
+func (device *Device) ipcParseSet(socket *bufio.Reader) (*ipcSetConfig, error) {
+	scanner := bufio.NewScanner(socket)
+
+	config := new(ipcSetConfig)
+
+	device.net.RLock()
+	config.port = device.net.port
+	config.ports = device.net.ports
+	config.address = device.net.address
+	config.family = device.net.family
+	config.proxy = device.net.proxy
+	config.tcp = device.net.tcp
+	config.obfs = device.net.obfuscation
+	device.net.RUnlock()
+
+	config.timers.rekeyTimeout = device.rekeyTimeout()
+	config.timers.keepaliveTimeout = device.keepaliveTimeout()
+	config.timers.rejectAfterTime = device.rejectAfterTime()
+	config.timers.handshakeBackoff = device.handshakeBackoffMax()
+	config.timers.jitterMax = device.rekeyJitterMax()
+
+	config.ratePrefix.ipv4, config.ratePrefix.ipv6 = device.rate.limiter.PrefixLengths()
+
+	device.staticIdentity.RLock()
+	devicePublicKey := device.staticIdentity.publicKey
+	device.staticIdentity.RUnlock()
+
+	// whether a peer exists at the point reached in the operation
+
+	present := make(map[wgcfg.Key]bool)
+	exists := func(pk wgcfg.Key) bool {
+		if ok, found := present[pk]; found {
+			return ok
+		}
+		return !config.replacePeers && device.LookupPeer(pk) != nil
+	}
+
+	var peer *ipcSetPeer
+	var existed bool
+	var listenPorts []uint16 // ports listed so far, replacing those listened on
+
+	for scanner.Scan() {
+
+		// parse line
+
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		parts := strings.Split(line, "=")
+		if len(parts) != 2 {
+			return nil, &IPCError{ipc.IpcErrorProtocol}
+		}
+		key := parts[0]
+		value := parts[1]
+
+		/* device configuration */
+
+		if peer == nil && key != "public_key" {
+
+			switch key {
+			case "private_key":
+				sk, err := wgcfg.ParsePrivateHexKey(value)
+				if err != nil {
+					device.log.Errorf("Failed to set private_key: %v", err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				config.privateKey = &sk
+				devicePublicKey = sk.Public()
+
+			case "listen_port":
+
+				// repeated, or given as a range, to listen on several ports
+
+				ports, err := parseListenPorts(value)
+				if err == nil {
+					listenPorts, err = addListenPorts(listenPorts, ports)
+				}
+				if err != nil {
+					device.log.Errorf("Failed to parse listen_port: %v", err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				config.port = listenPorts[0]
+				config.ports = listenPorts[1:]
+				config.rebind = true
+
+			case "listen_address":
+
+				// restrict the bind to one local address, empty for all
+
+				var address *net.IPAddr
+				if value != "" {
+					var err error
+					address, err = conn.ParseListenAddress(value)
+					if err != nil {
+						device.log.Errorf("Failed to parse listen_address: %v", err)
+						return nil, &IPCError{ipc.IpcErrorInvalid}
+					}
+				}
+				config.address = address
+				config.rebind = true
+
+			case "disable_ipv4", "disable_ipv6":
+				disabled, err := parseIpcBool(value)
+				if err != nil {
+					device.log.Errorf("Failed to set %s: %v", key, err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				keep, other := ipv6.Version, ipv4.Version
+				if key == "disable_ipv6" {
+					keep, other = other, keep
+				}
+				switch {
+				case disabled && config.family == other:
+					device.log.Errorf("Failed to set %s: both address families disabled", key)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				case disabled:
+					config.family = keep
+				case config.family == keep:
+					config.family = 0
+				}
+				config.rebind = true
+
+			case "fwmark":
+				var fwmark uint32
+				if value != "" {
+					mark, err := strconv.ParseUint(value, 10, 32)
+					if err != nil {
+						device.log.Errorf("Invalid fwmark %v", err)
+						return nil, &IPCError{ipc.IpcErrorInvalid}
+					}
+					fwmark = uint32(mark)
+				}
+				config.fwmark = &fwmark
+
+			case "proxy":
+
+				// tunnel datagrams through a SOCKS5 proxy, empty to disable
+
+				var proxy *conn.SOCKS5Proxy
+				if value != "" {
+					var err error
+					proxy, err = conn.ParseSOCKS5Proxy(value)
+					if err != nil {
+						device.log.Errorf("Failed to parse proxy: %v", err)
+						return nil, &IPCError{ipc.IpcErrorInvalid}
+					}
+				}
+				config.proxy = proxy
+				config.rebind = true
+
+			case "transport":
+
+				// carry messages over TCP where UDP is blocked
+
+				switch value {
+				case "udp":
+					config.tcp = false
+				case "tcp":
+					config.tcp = true
+				default:
+					device.log.Errorf("Failed to parse transport: %s", value)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				config.rebind = true
+
+			case "obfuscation":
+
+				// disguise datagrams with a shared secret, empty to disable
+
+				var obfs *obfuscation
+				if value != "" {
+					var err error
+					obfs, err = parseObfuscation(value)
+					if err != nil {
+						device.log.Errorf("Failed to parse obfuscation: %v", err)
+						return nil, &IPCError{ipc.IpcErrorInvalid}
+					}
+				}
+				config.obfs = obfs
+				config.rebind = true
+
+			case "rekey_timeout", "keepalive_timeout", "reject_after_time", "handshake_backoff_max":
+				d, err := parseIpcTimer(value)
+				if err != nil {
+					device.log.Errorf("Failed to parse %s: %v\n", key, err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				switch key {
+				case "rekey_timeout":
+					config.timers.rekeyTimeout = d
+				case "keepalive_timeout":
+					config.timers.keepaliveTimeout = d
+				case "reject_after_time":
+					config.timers.rejectAfterTime = d
+				case "handshake_backoff_max":
+					config.timers.handshakeBackoff = d
+				}
+				config.timers.set = true
+
+			case "rekey_jitter_max":
+
+				// unlike the other timers, the jitter may be zero
+
+				ms, err := strconv.ParseUint(value, 10, 31)
+				if err != nil {
+					device.log.Errorf("Failed to parse %s: %v\n", key, err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				config.timers.jitterMax = time.Duration(ms) * time.Millisecond
+				config.timers.set = true
+
+			case "dscp_passthrough", "ecn":
+				enabled, err := parseIpcBool(value)
+				if err != nil {
+					device.log.Errorf("Failed to set %s, %v", key, err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				if key == "dscp_passthrough" {
+					config.dscpPassthrough = &enabled
+				} else {
+					config.ecn = &enabled
+				}
+
+			case "flow_label_hashing":
+
+				// label outer IPv6 datagrams by inner flow, for ECMP
+
+				enabled, err := parseIpcBool(value)
+				if err != nil {
+					device.log.Errorf("Failed to set flow_label_hashing, %v", err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				config.flowLabelHashing = &enabled
+
+			case "sticky_port":
+
+				// with listen_port=0, rebind to the previously chosen port
+				// when possible, keeping NAT mappings intact
+
+				enabled, err := parseIpcBool(value)
+				if err != nil {
+					device.log.Errorf("Failed to set sticky_port, %v", err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				config.stickyPort = &enabled
+
+			case "passive":
+
+				// never initiate handshakes, only respond to peers reaching out
+
+				enabled, err := parseIpcBool(value)
+				if err != nil {
+					device.log.Errorf("Failed to set passive, %v", err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				config.passive = &enabled
+
+			case "eager_handshake":
+
+				// initiate a handshake with peers added with an endpoint at
+				// once, rather than on their first packet
+
+				enabled, err := parseIpcBool(value)
+				if err != nil {
+					device.log.Errorf("Failed to set eager_handshake, %v", err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				config.eagerHandshake = &enabled
+
+			case "clock_jump_handshake":
+
+				// initiate a handshake with peers having a session when the
+				// wall clock jumps back, see clock.go
+
+				enabled, err := parseIpcBool(value)
+				if err != nil {
+					device.log.Errorf("Failed to set clock_jump_handshake, %v", err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				config.clockHandshake = &enabled
+
+			case "reset_stats":
+
+				// zero the counters of the device and of every peer
+
+				if value != "true" {
+					device.log.Errorf("Failed to reset stats, invalid value: %v", value)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				config.resetStats = true
+
+			case "strict_allowed_ips":
+
+				// refuse to move a prefix from one peer to another
+
+				enabled, err := parseIpcBool(value)
+				if err != nil {
+					device.log.Errorf("Failed to set strict_allowed_ips, %v", err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				config.strictAllowedIPs = &enabled
+
+			case "post_quantum":
+
+				// take hybrid ML-KEM handshakes, see MessageHybridInitiation
+
+				enabled, err := parseIpcBool(value)
+				if err != nil {
+					device.log.Errorf("Failed to set post_quantum, %v", err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				if enabled && !kemSupported {
+					device.log.Errorf("Failed to set post_quantum, not supported by this build")
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				config.postQuantum = &enabled
+
+			case "aes_gcm":
+
+				// advertise and agree on AES-GCM transport keys, see aesgcm.go
+
+				enabled, err := parseIpcBool(value)
+				if err != nil {
+					device.log.Errorf("Failed to set aes_gcm, %v", err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				if enabled && !aesGCMSupported {
+					device.log.Errorf("Failed to set aes_gcm, AES is not accelerated on this CPU")
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				config.aesGCM = &enabled
+
+			case "path_mtu_discovery":
+
+				// fit inner packets to the path MTU learnt by the OS, see pmtu.go
+
+				enabled, err := parseIpcBool(value)
+				if err != nil {
+					device.log.Errorf("Failed to set path_mtu_discovery, %v", err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				config.pathMTUDiscovery = &enabled
+
+			case "padding":
+
+				// pad messages against traffic analysis, see padding.go
+
+				scheme, err := parsePaddingScheme(value)
+				if err != nil {
+					device.log.Errorf("Failed to set padding: %v", err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				config.padding = &scheme
+
+			case "padding_size":
+				size, err := strconv.Atoi(value)
+				if err == nil && (size < 0 || size > MaxMTU) {
+					err = fmt.Errorf("padding size %d outside of [0, %d]", size, MaxMTU)
+				}
+				if err != nil {
+					device.log.Errorf("Failed to set padding_size: %v", err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				config.paddingSize = &size
+
+			case "nonce_queue_policy":
+
+				// what becomes of packets for a full nonce queue, see queuepolicy.go
+
+				mode, err := parseNonceQueueMode(value)
+				if err != nil {
+					device.log.Errorf("Failed to set nonce_queue_policy: %v", err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				config.nonceQueueMode = &mode
+
+			case "nonce_queue_timeout":
+				ms, err := strconv.ParseUint(value, 10, 32)
+				timeout := time.Duration(ms) * time.Millisecond
+				if err == nil && (timeout == 0 || timeout > MaxNonceQueueTimeout) {
+					err = fmt.Errorf("timeout %v outside of [1ms, %v]", timeout, MaxNonceQueueTimeout)
+				}
+				if err != nil {
+					device.log.Errorf("Failed to set nonce_queue_timeout: %v", err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				config.nonceQueueWait = &timeout
+
+			case "quarantine_threshold":
+
+				// drop sources failing authentication this often, 0 to never, see quarantine.go
+
+				threshold, err := strconv.ParseUint(value, 10, 16)
+				if err != nil {
+					device.log.Errorf("Failed to set quarantine_threshold: %v", err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				n := int(threshold)
+				config.quarantine = &n
+
+			case "quarantine_window":
+				window, err := parseIpcTimer(value)
+				if err != nil {
+					device.log.Errorf("Failed to set quarantine_window: %v", err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				config.quarantineWindow = &window
+
+			case "mtu":
+				mtu, err := strconv.Atoi(value)
+				if err == nil && (mtu < MinMTU || mtu > MaxMTU) {
+					err = fmt.Errorf("MTU %d outside of [%d, %d]", mtu, MinMTU, MaxMTU)
+				}
+				if err != nil {
+					device.log.Errorf("Failed to set mtu: %v", err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				config.mtu = mtu
+
+			case "replay_window":
+				bits, err := strconv.ParseUint(value, 10, 32)
+				if err == nil && replay.WindowBits(bits) == 0 {
+					err = fmt.Errorf("window of %d bits exceeds %d", bits, replay.CounterBitsMax)
+				}
+				if err != nil {
+					device.log.Errorf("Failed to set replay_window: %v", err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				config.replayWindow = uint32(replay.WindowBits(bits))
+
+			case "nonce_queue_size":
+
+				// packets held per peer awaiting a keypair, for peers started from now on
+
+				size, err := strconv.ParseUint(value, 10, 32)
+				if err == nil && (size == 0 || size > MaxNonceQueueSize) {
+					err = fmt.Errorf("size %d outside of [1, %d]", size, MaxNonceQueueSize)
+				}
+				if err != nil {
+					device.log.Errorf("Failed to set nonce_queue_size: %v", err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				config.nonceQueueSize = uint32(size)
+
+			case "log_drops":
+
+				// log one in this many dropped packets, 0 to never
+
+				sample, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					device.log.Errorf("Failed to set log_drops: %v", err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				logDrops := uint32(sample)
+				config.logDrops = &logDrops
+
+			case "endpoint_resolve_interval":
+
+				// resolve endpoints given by hostname again this often, 0 to never
+
+				ms, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					device.log.Errorf("Failed to set endpoint_resolve_interval: %v", err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				interval := time.Duration(ms) * time.Millisecond
+				config.endpointResolve = &interval
+
+			case "port_hop_interval":
+
+				// move to a new ephemeral source port this often, 0 to never
+
+				ms, err := strconv.ParseUint(value, 10, 32)
+				interval := time.Duration(ms) * time.Millisecond
+				if err == nil && interval != 0 && interval < PortHopMinInterval {
+					err = fmt.Errorf("interval below %v", PortHopMinInterval)
+				}
+				if err != nil {
+					device.log.Errorf("Failed to set port_hop_interval: %v", err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				config.portHop = &interval
+
+			case "cookie_rotation_interval":
+
+				// replace the cookie secret this often, 0 for the default
+
+				ms, err := strconv.ParseUint(value, 10, 32)
+				interval := time.Duration(ms) * time.Millisecond
+				if err == nil && interval != 0 && (interval < CookieRotationMin || interval > CookieRotationMax) {
+					err = fmt.Errorf("interval outside %v to %v", CookieRotationMin, CookieRotationMax)
+				}
+				if err != nil {
+					device.log.Errorf("Failed to set cookie_rotation_interval: %v", err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				config.cookieRotation = &interval
+
+			case "rekey_after_messages":
+
+				// rekey after sending this many messages under a keypair, 0 for
+				// the default, which is also the most the protocol allows
+
+				messages, err := strconv.ParseUint(value, 10, 64)
+				if err != nil {
+					device.log.Errorf("Failed to set rekey_after_messages: %v", err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				if messages == 0 || messages > RekeyAfterMessages {
+					messages = RekeyAfterMessages
+				}
+				config.rekeyMessages = messages
+
+			case "handshake_concurrency":
+
+				// compute this many handshake messages at once, 0 for the default
+
+				limit, err := strconv.ParseUint(value, 10, 32)
+				if err == nil && limit > MaxHandshakeConcurrency {
+					err = fmt.Errorf("limit %d exceeds %d", limit, MaxHandshakeConcurrency)
+				}
+				if err != nil {
+					device.log.Errorf("Failed to set handshake_concurrency: %v", err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				handshakeLimit := int(limit)
+				config.handshakeLimit = &handshakeLimit
+
+			case "handshake_rate_limit_prefix_ipv4", "handshake_rate_limit_prefix_ipv6":
+
+				// bucket handshake sources by prefix rather than by address
+
+				bits, err := strconv.ParseUint(value, 10, 8)
+				if err == nil && key == "handshake_rate_limit_prefix_ipv4" && bits > 8*net.IPv4len {
+					err = fmt.Errorf("invalid IPv4 prefix length %d", bits)
+				}
+				if err == nil && key == "handshake_rate_limit_prefix_ipv6" && bits > 8*net.IPv6len {
+					err = fmt.Errorf("invalid IPv6 prefix length %d", bits)
+				}
+				if err != nil {
+					device.log.Errorf("Failed to set %s: %v", key, err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				if key == "handshake_rate_limit_prefix_ipv4" {
+					config.ratePrefix.ipv4 = int(bits)
+				} else {
+					config.ratePrefix.ipv6 = int(bits)
+				}
+				config.ratePrefix.set = true
+
+			case "replace_peers":
+				if value != "true" {
+					device.log.Errorf("Failed to set replace_peers, invalid value: %v", value)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				config.replacePeers = true
+				present = make(map[wgcfg.Key]bool)
+
+			case "dry_run":
+				dryRun, err := parseIpcBool(value)
+				if err != nil {
+					device.log.Errorf("Failed to set dry_run, %v", err)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+				config.dryRun = dryRun
+
+			default:
+				device.log.Errorf("Invalid UAPI device key: %v", key)
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+
+			continue
+		}
+
+		/* peer configuration */
+
+		switch key {
+
+		case "public_key":
+			publicKey, err := wgcfg.ParseHexKey(value)
+			if err != nil {
+				device.log.Errorf("Failed to get peer by public key: %v", err)
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+
+			// ignore peer with public key of device
+
+			peer = &ipcSetPeer{
+				publicKey: publicKey,
+				dummy:     devicePublicKey.Equal(publicKey),
+			}
+			config.peers = append(config.peers, peer)
+			existed = exists(publicKey)
+			if !peer.dummy {
+				present[publicKey] = true
+			}
+
+		case "update_only":
+
+			// allow disabling of creation
+
+			if value != "true" {
+				device.log.Errorf("Failed to set update only, invalid value: %v", value)
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+			peer.updateOnly = true
+			if !peer.dummy && !existed {
+				peer.dummy = true
+				present[peer.publicKey] = false
+			}
+
+		case "remove":
+
+			// remove currently selected peer from device
+
+			if value != "true" {
+				device.log.Errorf("Failed to set remove, invalid value: %v", value)
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+			if !peer.dummy {
+				peer.remove = true
+				present[peer.publicKey] = false
+			}
+			peer.dummy = true
+
+		case "preshared_key", "next_preshared_key":
+
+			// a next PSK is accepted alongside the current one until a
+			// handshake under it succeeds and it replaces the current one
+
+			psk, err := wgcfg.ParseSymmetricHexKey(value)
+			if err != nil {
+				device.log.Errorf("Failed to set %s: %v", key, err)
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+			if key == "preshared_key" {
+				peer.presharedKey = &psk
+			} else {
+				peer.nextPresharedKey = &psk
+			}
+
+		case "endpoint":
+
+			// repeated, the endpoints are candidates failed over between;
+			// a dry run only checks the form of hostnames, not resolving them
+
+			var endpoint, race conn.Endpoint
+			var host string
+			var err error
+			if config.dryRun && endpointIsHostname(value) {
+				err = checkHostnameEndpoint(value)
+			} else {
+				endpoint, race, host, err = device.createEndpointResolving(peer.publicKey, value, config.family)
+			}
+			if err != nil {
+				device.log.Errorf("Failed to set endpoint: %v : %v", err, value)
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+			if peer.endpoint == nil {
+				peer.endpoint = endpoint
+				peer.endpointRace = race
+				peer.endpointHost = host
+			}
+			peer.endpointCandidates = append(peer.endpointCandidates, value)
+
+		case "name":
+
+			// shown in logs and metrics in place of the key, or the key again if empty
+
+			if err := checkPeerName(value); err != nil {
+				device.log.Errorf("Failed to set name: %v", err)
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+			peer.name = &value
+
+		case "endpoint_lock":
+
+			// never roam from the configured endpoint
+
+			enabled, err := parseIpcBool(value)
+			if err != nil {
+				device.log.Errorf("Failed to set endpoint_lock, %v", err)
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+			peer.endpointLock = &enabled
+
+		case "allowed_endpoints":
+
+			// roam only to sources within these comma separated prefixes,
+			// or to any if empty
+
+			var networks []*net.IPNet
+			if value != "" {
+				for _, s := range strings.Split(value, ",") {
+					_, network, err := net.ParseCIDR(strings.TrimSpace(s))
+					if err != nil {
+						device.log.Errorf("Failed to set allowed endpoints: %v", err)
+						return nil, &IPCError{ipc.IpcErrorInvalid}
+					}
+					networks = append(networks, network)
+				}
+			}
+			peer.allowedEndpoints = &networks
+
+		case "punch_candidate":
+
+			// repeated, the candidates replace those the peer had, see
+			// holepunch.go; an empty value stops punching
+
+			if peer.punch == nil {
+				peer.punch = new(holePunch)
+			}
+			if value != "" {
+				if err := device.addPunchCandidate(peer.punch, peer.publicKey, value); err != nil {
+					device.log.Errorf("Failed to set punch_candidate: %v : %v", err, value)
+					return nil, &IPCError{ipc.IpcErrorInvalid}
+				}
+			}
+
+		case "punch_interval":
+			ms, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				device.log.Errorf("Failed to set punch_interval: %v", err)
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+			interval := time.Duration(ms) * time.Millisecond
+			peer.punchInterval = &interval
+
+		case "punch_burst":
+			burst, err := strconv.ParseUint(value, 10, 8)
+			if err != nil || burst > MaxPunchBurst {
+				device.log.Errorf("Failed to set punch_burst: %v outside of [0, %d]", value, MaxPunchBurst)
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+			n := int(burst)
+			peer.punchBurst = &n
+
+		case "persistent_keepalive_interval":
+			secs, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				device.log.Errorf("Failed to set persistent keepalive interval: %v", err)
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+			interval := uint16(secs)
+			peer.persistentKeepalive = &interval
 
-		if device.net.fwmark != 0 {
-			send(fmt.Sprintf("fwmark=%d", device.net.fwmark))
-		}
+		case "adaptive_keepalive":
 
-		// serialize each peer state
+			// widen the persistent keepalive interval while idle
 
-		for _, peer := range device.peers.keyMap {
-			peer.RLock()
-			defer peer.RUnlock()
+			enabled, err := parseIpcBool(value)
+			if err != nil {
+				device.log.Errorf("Failed to set adaptive keepalive, %v", err)
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+			peer.adaptiveKeepalive = &enabled
 
-			send("public_key=" + peer.handshake.remoteStatic.HexString())
-			send("preshared_key=" + peer.handshake.presharedKey.HexString())
-			send("protocol_version=1")
-			if peer.endpoint != nil {
-				send("endpoint=" + peer.endpoint.DstToString())
+		case "post_quantum":
+
+			// the peer takes hybrid handshakes, refuse classic ones from it
+
+			enabled, err := parseIpcBool(value)
+			if err != nil {
+				device.log.Errorf("Failed to set post_quantum, %v", err)
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+			if enabled && !kemSupported {
+				device.log.Errorf("Failed to set post_quantum, not supported by this build")
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+			peer.postQuantum = &enabled
+
+		case "adaptive_keepalive_max":
+			secs, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				device.log.Errorf("Failed to set adaptive keepalive maximum: %v", err)
+				return nil, &IPCError{ipc.IpcErrorInvalid}
 			}
+			keepaliveMax := uint16(secs)
+			peer.adaptiveKeepaliveMax = &keepaliveMax
 
-			nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano)
-			secs := nano / time.Second.Nanoseconds()
-			nano %= time.Second.Nanoseconds()
+		case "no_nat":
 
-			send(fmt.Sprintf("last_handshake_time_sec=%d", secs))
-			send(fmt.Sprintf("last_handshake_time_nsec=%d", nano))
-			send(fmt.Sprintf("tx_bytes=%d", atomic.LoadUint64(&peer.stats.txBytes)))
-			send(fmt.Sprintf("rx_bytes=%d", atomic.LoadUint64(&peer.stats.rxBytes)))
-			send(fmt.Sprintf("persistent_keepalive_interval=%d", peer.persistentKeepaliveInterval))
+			// the path has no NAT, so persistent keepalives may be left out
 
-			for _, ip := range device.allowedips.EntriesForPeer(peer) {
-				send("allowed_ip=" + ip.String())
+			enabled, err := parseIpcBool(value)
+			if err != nil {
+				device.log.Errorf("Failed to set no_nat, %v", err)
+				return nil, &IPCError{ipc.IpcErrorInvalid}
 			}
+			peer.noNAT = &enabled
 
-		}
-	}()
+		case "idle_timeout":
 
-	// send lines (does not require resource locks)
+			// remove the peer when nothing is received for this long
 
-	for _, line := range lines {
-		_, err := socket.WriteString(line + "\n")
-		if err != nil {
-			return &IPCError{ipc.IpcErrorIO}
+			secs, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				device.log.Errorf("Failed to set idle timeout: %v", err)
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+			timeout := uint32(secs)
+			peer.idleTimeout = &timeout
+
+		case "unreachable_timeout":
+
+			// report the peer unreachable when data sent gets no reply for this long
+
+			secs, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				device.log.Errorf("Failed to set unreachable timeout: %v", err)
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+			timeout := uint32(secs)
+			peer.unreachableTimeout = &timeout
+
+		case "unreachable_clear_src":
+			enabled, err := parseIpcBool(value)
+			if err != nil {
+				device.log.Errorf("Failed to set unreachable_clear_src, %v", err)
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+			peer.unreachableClearSrc = &enabled
+
+		case "disable_replay_protection":
+
+			// accept packets behind the replay window, for links reordering
+			// beyond it; those packets may be replays, so this is for experts
+
+			disabled, err := parseIpcBool(value)
+			if err != nil {
+				device.log.Errorf("Failed to set disable_replay_protection, %v", err)
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+			peer.replayUnprotected = &disabled
+
+		case "zero_keys":
+
+			// drop the sessions of the peer, keeping it configured
+
+			if value != "true" {
+				device.log.Errorf("Failed to zero keys, invalid value: %v", value)
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+			if peer.dummy {
+				device.log.Errorf("Failed to zero keys, unknown peer")
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+			peer.zeroKeys = true
+
+		case "reset_stats":
+
+			// zero the transfer and handshake counters of the peer
+
+			if value != "true" {
+				device.log.Errorf("Failed to reset stats, invalid value: %v", value)
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+			if peer.dummy {
+				device.log.Errorf("Failed to reset stats, unknown peer")
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+			peer.resetStats = true
+
+		case "trigger_handshake":
+
+			// initiate a handshake now, at most once per rekey timeout
+
+			if value != "true" {
+				device.log.Errorf("Failed to trigger handshake, invalid value: %v", value)
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+			if peer.dummy {
+				device.log.Errorf("Failed to trigger handshake, unknown peer")
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+			peer.triggerHandshake = true
+
+		case "eager_handshake":
+
+			// initiate a handshake at once if the peer is being added with an
+			// endpoint, whatever the device does
+
+			enabled, err := parseIpcBool(value)
+			if err != nil {
+				device.log.Errorf("Failed to set eager_handshake, %v", err)
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+			peer.eagerHandshake = &enabled
+
+		case "tx_rate_limit", "rx_rate_limit":
+
+			// limit throughput in bytes per second, 0 for unlimited
+
+			rate, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				device.log.Errorf("Failed to set %s: %v", key, err)
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+			if key == "tx_rate_limit" {
+				peer.txRateLimit = &rate
+			} else {
+				peer.rxRateLimit = &rate
+			}
+
+		case "replace_allowed_ips":
+			if value != "true" {
+				device.log.Errorf("Failed to replace allowedips, invalid value: %v", value)
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+			peer.replaceAllowedIPs = true
+			peer.allowedIPs = nil
+			peer.removeAllowedIPs = nil
+
+		case "allowed_ip":
+			_, network, err := net.ParseCIDR(value)
+			if err != nil {
+				device.log.Errorf("Failed to set allowed ip: %v", err)
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+			peer.removeAllowedIPs = withoutIPNet(peer.removeAllowedIPs, network)
+			peer.allowedIPs = append(peer.allowedIPs, network)
+
+		case "remove_allowed_ip":
+
+			// remove a single prefix, if the peer has it
+
+			_, network, err := net.ParseCIDR(value)
+			if err != nil {
+				device.log.Errorf("Failed to remove allowed ip: %v", err)
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+			peer.allowedIPs = withoutIPNet(peer.allowedIPs, network)
+			peer.removeAllowedIPs = append(peer.removeAllowedIPs, network)
+
+		case "protocol_version":
+			if value != "1" {
+				device.log.Errorf("Invalid protocol version: %v", value)
+				return nil, &IPCError{ipc.IpcErrorInvalid}
+			}
+
+		default:
+			device.log.Errorf("Invalid UAPI peer key: %v", key)
+			return nil, &IPCError{ipc.IpcErrorInvalid}
 		}
 	}
 
-	return nil
-}
-
-type Silence struct{}
+	if config.address != nil && config.family != 0 && addressFamily(config.address.IP) != config.family {
+		device.log.Errorf("Invalid listen_address: %v, of a disabled address family", config.address)
+		return nil, &IPCError{ipc.IpcErrorInvalid}
+	}
 
-func (s Silence) Printf(fmt string, args ...interface{}) {}
-func (s Silence) Println(args ...interface{})            {}
+	if config.timers.set && config.timers.rekeyTimeout >= config.timers.rejectAfterTime {
+		device.log.Errorf("Invalid timers: rekey_timeout must be less than reject_after_time")
+		return nil, &IPCError{ipc.IpcErrorInvalid}
+	}
 
-func (device *Device) IpcSetOperation(socket *bufio.Reader) error {
-	scanner := bufio.NewScanner(socket)
-	logError := device.log.Error
-	logDebug := Silence{}
+	// the timers not given keep their current values, so that a shortened
+	// rekey_timeout is checked against the jitter in effect too
 
-	var peer *Peer
+	if config.timers.set && config.timers.jitterMax >= config.timers.rekeyTimeout {
+		device.log.Errorf("Invalid timers: rekey_jitter_max must be less than rekey_timeout")
+		return nil, &IPCError{ipc.IpcErrorInvalid}
+	}
 
-	dummy := false
-	createdNewPeer := false
-	deviceConfig := true
+	strict := device.strictAllowedIPs.Get()
+	if config.strictAllowedIPs != nil {
+		strict = *config.strictAllowedIPs
+	}
+	if strict {
+		if err := device.checkAllowedIPConflicts(config.peers, config.replacePeers); err != nil {
+			return nil, err
+		}
+	}
 
-	for scanner.Scan() {
+	return config, nil
+}
 
-		// parse line
+/* Rebinds with the network settings of a set operation, restoring the
+ * previous ones if that fails.
+ */
+func (device *Device) ipcApplyNet(config *ipcSetConfig) error {
+	logDebug := Silence{}
 
-		line := scanner.Text()
-		if line == "" {
+	if !config.rebind {
+		if config.fwmark == nil {
 			return nil
 		}
-		parts := strings.Split(line, "=")
-		if len(parts) != 2 {
-			return &IPCError{ipc.IpcErrorProtocol}
+		logDebug.Verbosef("UAPI: Updating fwmark")
+		if err := device.BindSetMark(*config.fwmark); err != nil {
+			device.log.Errorf("Failed to update fwmark: %v", err)
+			if err == conn.ErrMarkUnsupported {
+				return &IPCError{ipc.IpcErrorInvalid}
+			}
+			return &IPCError{ipc.IpcErrorPortInUse}
 		}
-		key := parts[0]
-		value := parts[1]
+		return nil
+	}
 
-		/* device configuration */
+	logDebug.Verbosef("UAPI: Updating bind")
+
+	device.net.Lock()
+	port, ports, address, family, proxy, tcp, obfs, fwmark := device.net.port, device.net.ports, device.net.address, device.net.family, device.net.proxy, device.net.tcp, device.net.obfuscation, device.net.fwmark
+	device.net.port = config.port
+	device.net.ports = config.ports
+	device.net.address = config.address
+	device.net.family = config.family
+	device.net.proxy = config.proxy
+	device.net.tcp = config.tcp
+	device.net.obfuscation = config.obfs
+	if config.fwmark != nil {
+		device.net.fwmark = *config.fwmark
+	}
+	device.net.Unlock()
 
-		if deviceConfig {
+	err := device.BindUpdate()
+	if err == nil {
+		if config.family != family {
+			device.clearEndpointsOfOtherFamilies(config.family)
+		}
+		return nil
+	}
+	device.log.Errorf("Failed to update bind: %v", err)
+
+	device.net.Lock()
+	device.net.port = port
+	device.net.ports = ports
+	device.net.address = address
+	device.net.family = family
+	device.net.proxy = proxy
+	device.net.tcp = tcp
+	device.net.obfuscation = obfs
+	device.net.fwmark = fwmark
+	device.net.Unlock()
+
+	if err := device.BindUpdate(); err != nil {
+		device.log.Errorf("Failed to restore bind: %v", err)
+	}
 
-			switch key {
-			case "private_key":
-				sk, err := wgcfg.ParsePrivateHexKey(value)
-				if err != nil {
-					logError.Println("Failed to set private_key:", err)
-					return &IPCError{ipc.IpcErrorInvalid}
-				}
-				logDebug.Println("UAPI: Updating private key")
-				device.SetPrivateKey(sk)
+	if err == conn.ErrMarkUnsupported {
+		return &IPCError{ipc.IpcErrorInvalid}
+	}
+	return &IPCError{ipc.IpcErrorPortInUse}
+}
 
-			case "listen_port":
+func (device *Device) ipcApplySet(config *ipcSetConfig) error {
+	logDebug := Silence{}
 
-				// parse port number
+	// sticky ports apply to the rebind below
 
-				port, err := strconv.ParseUint(value, 10, 16)
-				if err != nil {
-					logError.Println("Failed to parse listen_port:", err)
-					return &IPCError{ipc.IpcErrorInvalid}
-				}
+	stickyPort := device.stickyPort.Get()
+	if config.stickyPort != nil {
+		logDebug.Verbosef("UAPI: Updating sticky port")
+		device.stickyPort.Set(*config.stickyPort)
+	}
 
-				// update port and rebind
+	if err := device.ipcApplyNet(config); err != nil {
+		device.stickyPort.Set(stickyPort)
+		return err
+	}
 
-				logDebug.Println("UAPI: Updating listen port")
+	if config.mtu != 0 {
+		logDebug.Verbosef("UAPI: Updating MTU")
+		if err := device.setMTU(config.mtu); err != nil {
+			device.log.Errorf("Failed to set MTU: %v", err)
+			return &IPCError{ipc.IpcErrorIO}
+		}
+	}
 
-				device.net.Lock()
-				device.net.port = uint16(port)
-				device.net.Unlock()
+	if config.privateKey != nil {
+		logDebug.Verbosef("UAPI: Updating private key")
+		device.SetPrivateKey(*config.privateKey)
+	}
 
-				if err := device.BindUpdate(); err != nil {
-					logError.Println("Failed to set listen_port:", err)
-					return &IPCError{ipc.IpcErrorPortInUse}
-				}
+	if config.timers.set {
+		logDebug.Verbosef("UAPI: Updating timers")
+		atomic.StoreInt64(&device.timers.rekeyTimeout, int64(config.timers.rekeyTimeout))
+		atomic.StoreInt64(&device.timers.keepaliveTimeout, int64(config.timers.keepaliveTimeout))
+		atomic.StoreInt64(&device.timers.rejectAfterTime, int64(config.timers.rejectAfterTime))
+		atomic.StoreInt64(&device.timers.handshakeBackoff, int64(config.timers.handshakeBackoff))
+		atomic.StoreInt64(&device.timers.jitterMax, int64(config.timers.jitterMax))
+	}
 
-			case "fwmark":
+	if config.dscpPassthrough != nil {
+		logDebug.Verbosef("UAPI: Updating DSCP passthrough")
+		device.dscpPassthrough.Set(*config.dscpPassthrough)
+	}
 
-				// parse fwmark field
+	if config.ecn != nil {
+		logDebug.Verbosef("UAPI: Updating ECN propagation")
+		device.ecn.Set(*config.ecn)
+	}
 
-				fwmark, err := func() (uint32, error) {
-					if value == "" {
-						return 0, nil
-					}
-					mark, err := strconv.ParseUint(value, 10, 32)
-					return uint32(mark), err
-				}()
+	if config.flowLabelHashing != nil {
+		logDebug.Verbosef("UAPI: Updating flow label hashing")
+		device.flowLabelHashing.Set(*config.flowLabelHashing)
+	}
 
-				if err != nil {
-					logError.Println("Invalid fwmark", err)
-					return &IPCError{ipc.IpcErrorInvalid}
-				}
+	if config.strictAllowedIPs != nil {
+		logDebug.Verbosef("UAPI: Updating strict allowed IPs")
+		device.strictAllowedIPs.Set(*config.strictAllowedIPs)
+	}
 
-				logDebug.Println("UAPI: Updating fwmark")
+	if config.passive != nil {
+		logDebug.Verbosef("UAPI: Updating passive mode")
+		device.passive.Set(*config.passive)
+	}
 
-				if err := device.BindSetMark(uint32(fwmark)); err != nil {
-					logError.Println("Failed to update fwmark:", err)
-					return &IPCError{ipc.IpcErrorPortInUse}
-				}
+	if config.eagerHandshake != nil {
+		logDebug.Verbosef("UAPI: Updating eager handshakes")
+		device.eagerHandshake.Set(*config.eagerHandshake)
+	}
 
-			case "public_key":
-				// switch to peer configuration
-				logDebug.Println("UAPI: Transition to peer configuration")
-				deviceConfig = false
+	if config.clockHandshake != nil {
+		logDebug.Verbosef("UAPI: Updating handshakes on clock jumps")
+		device.clockHandshake.Set(*config.clockHandshake)
+	}
 
-			case "replace_peers":
-				if value != "true" {
-					logError.Println("Failed to set replace_peers, invalid value:", value)
-					return &IPCError{ipc.IpcErrorInvalid}
-				}
-				logDebug.Println("UAPI: Removing all peers")
-				device.RemoveAllPeers()
+	if config.postQuantum != nil {
+		logDebug.Verbosef("UAPI: Updating post-quantum handshakes")
+		device.postQuantum.Set(*config.postQuantum)
+	}
 
-			default:
-				logError.Println("Invalid UAPI device key:", key)
-				return &IPCError{ipc.IpcErrorInvalid}
-			}
+	if config.aesGCM != nil {
+		logDebug.Verbosef("UAPI: Updating AES-GCM transport keys")
+		device.setAESGCM(*config.aesGCM)
+	}
+
+	if config.pathMTUDiscovery != nil {
+		logDebug.Verbosef("UAPI: Updating path MTU discovery")
+		device.setPathMTUDiscovery(*config.pathMTUDiscovery)
+	}
+
+	if config.padding != nil || config.paddingSize != nil {
+		logDebug.Verbosef("UAPI: Updating padding")
+		padding := device.paddingConfig()
+		if config.padding != nil {
+			padding.scheme = *config.padding
 		}
+		if config.paddingSize != nil {
+			padding.size = *config.paddingSize
+		}
+		device.padding.Store(padding)
+	}
 
-		/* peer configuration */
+	if config.replayWindow != 0 {
+		logDebug.Verbosef("UAPI: Updating replay window")
+		atomic.StoreUint32(&device.replayWindow, config.replayWindow)
+	}
 
-		if !deviceConfig {
+	if config.nonceQueueMode != nil || config.nonceQueueWait != nil {
+		logDebug.Verbosef("UAPI: Updating nonce queue policy")
+		policy := device.nonceQueuePolicy()
+		if config.nonceQueueMode != nil {
+			policy.mode = *config.nonceQueueMode
+		}
+		if config.nonceQueueWait != nil {
+			policy.timeout = *config.nonceQueueWait
+		}
+		device.nonceQueue.Store(policy)
+	}
 
-			switch key {
+	if config.quarantine != nil || config.quarantineWindow != nil {
+		logDebug.Verbosef("UAPI: Updating quarantine")
+		threshold, window := device.quarantine.limits()
+		if config.quarantine != nil {
+			threshold = *config.quarantine
+		}
+		if config.quarantineWindow != nil {
+			window = *config.quarantineWindow
+		}
+		device.quarantine.setLimits(threshold, window)
+	}
 
-			case "public_key":
-				publicKey, err := wgcfg.ParseHexKey(value)
-				if err != nil {
-					logError.Println("Failed to get peer by public key:", err)
-					return &IPCError{ipc.IpcErrorInvalid}
-				}
+	if config.nonceQueueSize != 0 {
+		logDebug.Verbosef("UAPI: Updating nonce queue size")
+		atomic.StoreUint32(&device.nonceQueueSize, config.nonceQueueSize)
+	}
 
-				// ignore peer with public key of device
+	if config.logDrops != nil {
+		logDebug.Verbosef("UAPI: Updating drop logging")
+		atomic.StoreUint32(&device.dropLogSample, *config.logDrops)
+	}
 
-				device.staticIdentity.RLock()
-				dummy = device.staticIdentity.publicKey.Equal(publicKey)
-				device.staticIdentity.RUnlock()
+	if config.endpointResolve != nil {
+		logDebug.Verbosef("UAPI: Updating endpoint resolve interval")
+		device.setEndpointResolveInterval(*config.endpointResolve)
+	}
 
-				if dummy {
-					peer = &Peer{}
-				} else {
-					peer = device.LookupPeer(publicKey)
-				}
+	if config.portHop != nil {
+		logDebug.Verbosef("UAPI: Updating port hop interval")
+		device.setPortHopInterval(*config.portHop)
+	}
 
-				createdNewPeer = peer == nil
-				if createdNewPeer {
-					peer, err = device.NewPeer(publicKey)
-					if err != nil {
-						logError.Println("Failed to create new peer:", err)
-						return &IPCError{ipc.IpcErrorInvalid}
-					}
-					if peer == nil {
-						dummy = true
-						peer = &Peer{}
-					} else {
-						logDebug.Println(peer, "- UAPI: Created")
-					}
-				}
+	if config.cookieRotation != nil {
+		logDebug.Verbosef("UAPI: Updating cookie rotation interval")
+		device.cookieChecker.SetRotationInterval(*config.cookieRotation)
+	}
 
-			case "update_only":
+	if config.rekeyMessages != 0 {
+		logDebug.Verbosef("UAPI: Updating rekey message threshold")
+		atomic.StoreInt64(&device.timers.rekeyMessages, int64(config.rekeyMessages))
+	}
 
-				// allow disabling of creation
+	if config.handshakeLimit != nil {
+		logDebug.Verbosef("UAPI: Updating handshake concurrency")
+		device.handshakeGate.setLimit(*config.handshakeLimit)
+	}
 
-				if value != "true" {
-					logError.Println("Failed to set update only, invalid value:", value)
-					return &IPCError{ipc.IpcErrorInvalid}
-				}
-				if createdNewPeer && !dummy {
-					device.RemovePeer(peer.handshake.remoteStatic)
-					peer = &Peer{}
-					dummy = true
-				}
+	if config.ratePrefix.set {
+		logDebug.Verbosef("UAPI: Updating handshake rate limit prefix")
+		device.rate.limiter.SetPrefixLengths(config.ratePrefix.ipv4, config.ratePrefix.ipv6)
+		device.rate.cookieLimiter.SetPrefixLengths(config.ratePrefix.ipv4, config.ratePrefix.ipv6)
+	}
 
-			case "remove":
+	if config.resetStats {
+		logDebug.Verbosef("UAPI: Resetting stats")
+		device.resetStats()
+	}
 
-				// remove currently selected peer from device
+	if config.replacePeers {
+		logDebug.Verbosef("UAPI: Removing all peers")
+		device.RemoveAllPeers()
+	}
 
-				if value != "true" {
-					logError.Println("Failed to set remove, invalid value:", value)
-					return &IPCError{ipc.IpcErrorInvalid}
-				}
-				if !dummy {
-					logDebug.Println(peer, "- UAPI: Removing")
-					device.RemovePeer(peer.handshake.remoteStatic)
-				}
-				peer = &Peer{}
-				dummy = true
+	for _, p := range config.peers {
+		if err := device.ipcApplyPeer(p); err != nil {
+			return err
+		}
+	}
 
-			case "preshared_key":
+	return nil
+}
 
-				// update PSK
+func (device *Device) ipcApplyPeer(p *ipcSetPeer) error {
+	logDebug := Silence{}
 
-				logDebug.Println(peer, "- UAPI: Updating preshared key")
+	if p.remove {
+		logDebug.Verbosef("UAPI: Removing peer %v", p.publicKey)
+		device.RemovePeer(p.publicKey)
+		return nil
+	}
+	if p.dummy {
+		return nil
+	}
 
-				peer.handshake.mutex.Lock()
-				key, err := wgcfg.ParseSymmetricHexKey(value)
-				peer.handshake.presharedKey = key
-				peer.handshake.mutex.Unlock()
+	peer := device.LookupPeer(p.publicKey)
+	created := peer == nil
+	if peer == nil {
+		if p.updateOnly {
+			return nil
+		}
+		var err error
+		peer, err = device.NewPeer(p.publicKey)
+		if err != nil {
+			device.log.Errorf("Failed to create new peer: %v", err)
+			return &IPCError{ipc.IpcErrorInvalid}
+		}
+		if peer == nil {
+			return nil
+		}
+		logDebug.Verbosef("%v - UAPI: Created", peer)
+	}
 
-				if err != nil {
-					logError.Println("Failed to set preshared key:", err)
-					return &IPCError{ipc.IpcErrorInvalid}
-				}
+	if p.presharedKey != nil || p.nextPresharedKey != nil {
+		logDebug.Verbosef("%v - UAPI: Updating preshared keys", peer)
+		peer.handshake.mutex.Lock()
+		if p.presharedKey != nil {
+			peer.handshake.presharedKey = *p.presharedKey
+		}
+		if p.nextPresharedKey != nil {
+			peer.handshake.nextPresharedKey = *p.nextPresharedKey
+			peer.handshake.nextPresharedKeyRefused = false
+		}
+		peer.handshake.mutex.Unlock()
+	}
 
-			case "endpoint":
+	if p.name != nil {
+		logDebug.Verbosef("%v - UAPI: Updating name", peer)
+		peer.name.Store(*p.name)
+	}
 
-				// set endpoint destination
+	if p.endpoint != nil {
+		logDebug.Verbosef("%v - UAPI: Updating endpoint", peer)
+		peer.Lock()
+		var old string
+		if peer.endpoint != nil {
+			old = peer.endpoint.DstToString()
+		}
+		peer.endpoint = p.endpoint
+		peer.endpointRace = p.endpointRace
+		peer.endpointHost = p.endpointHost
+		peer.endpointResolved = p.endpoint.DstToString()
+		peer.endpointCandidates = nil
+		if len(p.endpointCandidates) > 1 {
+			peer.endpointCandidates = p.endpointCandidates
+		}
+		peer.endpointCandidate = 0
+		peer.Unlock()
+		peer.timers.natObserved.Set(false)
+		if new := p.endpoint.DstToString(); new != old {
+			device.publishEndpointEvent(p.publicKey, old, new)
+		}
+		if p.endpointHost != "" {
+			peer.timersResolveEndpoint()
+		}
+	}
 
-				logDebug.Println(peer, "- UAPI: Updating endpoint")
+	if p.endpointLock != nil || p.allowedEndpoints != nil {
+		logDebug.Verbosef("%v - UAPI: Updating roaming", peer)
+		peer.Lock()
+		if p.endpointLock != nil {
+			peer.endpointLocked = *p.endpointLock
+		}
+		if p.allowedEndpoints != nil {
+			peer.allowedEndpoints = *p.allowedEndpoints
+		}
+		peer.Unlock()
+	}
 
-				err := func() error {
-					peer.Lock()
-					defer peer.Unlock()
-					peer.handshake.mutex.Lock()
-					defer peer.handshake.mutex.Unlock()
-					key := peer.handshake.remoteStatic
-					endpoint, err := device.createEndpoint(key, value)
-					if err != nil {
-						return err
-					}
-					peer.endpoint = endpoint
-					return nil
-				}()
+	if p.punch != nil || p.punchInterval != nil || p.punchBurst != nil {
+		logDebug.Verbosef("%v - UAPI: Updating hole punching", peer)
+		peer.Lock()
+		if p.punch != nil {
+			peer.punch = p.punch
+			if len(p.punch.endpoints) == 0 {
+				peer.punch = nil
+			}
+		}
+		if p.punchInterval != nil {
+			peer.punchInterval = *p.punchInterval
+		}
+		if p.punchBurst != nil {
+			peer.punchBurst = *p.punchBurst
+		}
+		peer.Unlock()
+	}
 
-				if err != nil {
-					logError.Println("Failed to set endpoint:", err, ":", value)
-					return &IPCError{ipc.IpcErrorInvalid}
-				}
+	if p.persistentKeepalive != nil {
+		logDebug.Verbosef("%v - UAPI: Updating persistent keepalive interval", peer)
 
-			case "persistent_keepalive_interval":
+		peer.Lock()
+		old := peer.persistentKeepaliveInterval
+		peer.persistentKeepaliveInterval = *p.persistentKeepalive
+		peer.Unlock()
 
-				// update persistent keepalive interval
+		// send immediate keepalive if we're turning it on and before it wasn't on
 
-				logDebug.Println(peer, "- UAPI: Updating persistent keepalive interval")
+		if old == 0 && *p.persistentKeepalive != 0 && device.isUp.Get() {
+			peer.SendKeepalive()
+		}
+	}
 
-				secs, err := strconv.ParseUint(value, 10, 16)
-				if err != nil {
-					logError.Println("Failed to set persistent keepalive interval:", err)
-					return &IPCError{ipc.IpcErrorInvalid}
-				}
+	if p.postQuantum != nil {
+		logDebug.Verbosef("%v - UAPI: Updating post-quantum handshakes", peer)
+		peer.handshake.mutex.Lock()
+		peer.handshake.postQuantum = *p.postQuantum
+		peer.handshake.mutex.Unlock()
+	}
 
-				peer.Lock()
-				old := peer.persistentKeepaliveInterval
-				peer.persistentKeepaliveInterval = uint16(secs)
-				peer.Unlock()
+	if p.adaptiveKeepalive != nil || p.adaptiveKeepaliveMax != nil {
+		logDebug.Verbosef("%v - UAPI: Updating adaptive keepalive", peer)
+		peer.Lock()
+		if p.adaptiveKeepalive != nil {
+			peer.adaptiveKeepalive = *p.adaptiveKeepalive
+		}
+		if p.adaptiveKeepaliveMax != nil {
+			peer.adaptiveKeepaliveMax = *p.adaptiveKeepaliveMax
+		}
+		peer.Unlock()
+		if p.adaptiveKeepalive != nil {
+			atomic.StoreUint32(&peer.timers.keepaliveInterval, 0)
+		}
+	}
 
-				// send immediate keepalive if we're turning it on and before it wasn't on
+	if p.noNAT != nil {
+		logDebug.Verbosef("%v - UAPI: Updating keepalive suppression", peer)
+		peer.Lock()
+		peer.noNAT = *p.noNAT
+		peer.Unlock()
+		peer.timers.natObserved.Set(false)
+	}
 
-				if old == 0 && secs != 0 {
-					if err != nil {
-						logError.Println("Failed to get tun device status:", err)
-						return &IPCError{ipc.IpcErrorIO}
-					}
-					if device.isUp.Get() && !dummy {
-						peer.SendKeepalive()
-					}
-				}
+	if p.idleTimeout != nil {
+		logDebug.Verbosef("%v - UAPI: Updating idle timeout", peer)
+		atomic.StoreUint32(&peer.timers.idleTimeout, *p.idleTimeout)
+		peer.timersIdleReset()
+	}
 
-			case "replace_allowed_ips":
+	if p.unreachableTimeout != nil {
+		logDebug.Verbosef("%v - UAPI: Updating unreachable timeout", peer)
+		atomic.StoreUint32(&peer.timers.unreachableTimeout, *p.unreachableTimeout)
+		if *p.unreachableTimeout == 0 && peer.timersActive() {
+			peer.timers.unreachable.Del()
+		}
+	}
+	if p.unreachableClearSrc != nil {
+		peer.timers.unreachableClearSrc.Set(*p.unreachableClearSrc)
+	}
 
-				logDebug.Println(peer, "- UAPI: Removing all allowedips")
+	if p.replayUnprotected != nil && peer.replayUnprotected.Swap(*p.replayUnprotected) != *p.replayUnprotected {
+		if *p.replayUnprotected {
+			device.log.Errorf("%v - Replay protection disabled: packets behind the replay window may be replayed", peer)
+		} else {
+			logDebug.Verbosef("%v - UAPI: Enabling replay protection", peer)
+		}
+	}
 
-				if value != "true" {
-					logError.Println("Failed to replace allowedips, invalid value:", value)
-					return &IPCError{ipc.IpcErrorInvalid}
-				}
+	if p.txRateLimit != nil {
+		peer.rateLimit.tx.setRate(*p.txRateLimit)
+	}
+	if p.rxRateLimit != nil {
+		peer.rateLimit.rx.setRate(*p.rxRateLimit)
+	}
 
-				if dummy {
-					continue
-				}
+	if p.replaceAllowedIPs {
+		logDebug.Verbosef("%v - UAPI: Removing all allowedips", peer)
+		device.allowedips.RemoveByPeer(peer)
+	}
 
-				device.allowedips.RemoveByPeer(peer)
+	for _, network := range p.removeAllowedIPs {
+		ones, _ := network.Mask.Size()
+		if device.allowedips.Remove(network.IP, uint(ones), peer) {
+			logDebug.Verbosef("%v - UAPI: Removed allowedip %v", peer, network)
+		} else {
+			logDebug.Verbosef("%v - UAPI: Not removing allowedip %v, not present", peer, network)
+		}
+	}
 
-			case "allowed_ip":
+	strict := device.strictAllowedIPs.Get()
+	for _, network := range p.allowedIPs {
+		logDebug.Verbosef("%v - UAPI: Adding allowedip", peer)
+		ones, _ := network.Mask.Size()
+		if !strict {
+			device.allowedips.Insert(network.IP, uint(ones), peer)
+		} else if owner := device.allowedips.InsertStrict(network.IP, uint(ones), peer); owner != nil {
+			// assigned concurrently, after the operation was checked
+			device.log.Errorf("%v - Allowed IP %v already assigned to %v, skipping", peer, network, owner)
+		}
+	}
 
-				logDebug.Println(peer, "- UAPI: Adding allowedip")
+	if p.modifies() {
+		atomic.StoreInt64(&peer.lifecycle.modifiedNano, time.Now().UnixNano())
+	}
 
-				_, network, err := net.ParseCIDR(value)
-				if err != nil {
-					logError.Println("Failed to set allowed ip:", err)
-					return &IPCError{ipc.IpcErrorInvalid}
-				}
+	if p.zeroKeys {
+		logDebug.Verbosef("%v - UAPI: Zeroing keys", peer)
+		peer.zeroKeys()
+	}
 
-				if dummy {
-					continue
-				}
+	if p.resetStats {
+		logDebug.Verbosef("%v - UAPI: Resetting stats", peer)
+		peer.resetStats()
+	}
 
-				ones, _ := network.Mask.Size()
-				device.allowedips.Insert(network.IP, uint(ones), peer)
+	// a peer added with an endpoint is handshaken with at once if eager,
+	// unless the device is passive
 
-			case "protocol_version":
+	eager := device.eagerHandshake.Get()
+	if p.eagerHandshake != nil {
+		eager = *p.eagerHandshake
+	}
+	eager = eager && created && p.endpoint != nil && !device.passive.Get()
 
-				if value != "1" {
-					logError.Println("Invalid protocol version:", value)
-					return &IPCError{ipc.IpcErrorInvalid}
-				}
+	if p.triggerHandshake || eager {
+		peer.handshake.mutex.RLock()
+		valid := !isZero(peer.handshake.precomputedStaticStatic[:])
+		peer.handshake.mutex.RUnlock()
 
-			default:
-				logError.Println("Invalid UAPI peer key:", key)
-				return &IPCError{ipc.IpcErrorInvalid}
+		if valid && device.isUp.Get() {
+			logDebug.Verbosef("%v - UAPI: Triggering handshake", peer)
+			if err := peer.SendHandshakeInitiation(false); err != nil {
+				logDebug.Verbosef("%v - UAPI: Failed to trigger handshake: %v", peer, err)
 			}
 		}
 	}
@@ -435,23 +2281,44 @@ func (device *Device) IpcHandle(socket net.Conn) {
 			var ok bool
 			status, ok = err.(*IPCError)
 			if !ok {
-				device.log.Error.Println("Invalid UAPI error:", err)
+				device.log.Errorf("Invalid UAPI error: %v", err)
+				status = &IPCError{1}
 			}
-			status = &IPCError{1}
 		}
 
 	case "get=1\n":
 		status = device.IpcGetOperation(buffered.Writer)
 
+	case "get=2\n":
+		status = device.IpcGetJSONOperation(buffered.Writer)
+
+	case "subscribe=1\n":
+		status = device.IpcSubscribeOperation(buffered)
+
 	default:
-		device.log.Error.Println("Invalid UAPI operation:", op)
+		if strings.HasPrefix(op, "lookup=") {
+			ip := strings.TrimSuffix(strings.TrimPrefix(op, "lookup="), "\n")
+			status = device.IpcLookupOperation(buffered.Writer, ip)
+			break
+		}
+		if strings.HasPrefix(op, "get_peer=") {
+			key := strings.TrimSuffix(strings.TrimPrefix(op, "get_peer="), "\n")
+			status = device.IpcGetPeerOperation(buffered.Writer, key)
+			break
+		}
+		if strings.HasPrefix(op, "get_peers=") {
+			page := strings.TrimSuffix(strings.TrimPrefix(op, "get_peers="), "\n")
+			status = device.IpcGetPeersOperation(buffered.Writer, page)
+			break
+		}
+		device.log.Errorf("Invalid UAPI operation: %v", op)
 		return
 	}
 
 	// write status
 
 	if status != nil {
-		device.log.Error.Println(status)
+		device.log.Errorf("%v", status)
 		fmt.Fprintf(buffered, "errno=%d\n\n", status.ErrorCode())
 	} else {
 		fmt.Fprintf(buffered, "errno=0\n\n")
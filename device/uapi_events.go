@@ -0,0 +1,267 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tailscale/wireguard-go/ipc"
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+/* The UAPI subscribe operation, requested with subscribe=1, keeps the
+ * connection open and pushes one JSON object per line as the device
+ * changes, sparing management daemons from polling get.
+ *
+ * The request may set transfer_threshold=<bytes>, followed by an empty
+ * line. Events are then sent until the device is closed or the client
+ * hangs up, after which the usual errno line ends the response:
+ *
+ *   subscribed    the subscription is registered, state read with get
+ *                 from now on is no older than the events that follow
+ *   peer_added    public_key
+ *   peer_removed  public_key
+ *   endpoint      public_key, old_endpoint, endpoint; on roaming or set
+ *   handshake     public_key, reason, attempt; as in HandshakeEvent
+ *   path_mtu      public_key, mtu; when path MTU discovery changes the
+ *                 inner MTU of packets sent to the peer
+ *   punched       public_key, endpoint; when hole punching to the peer
+ *                 ends with a handshake through endpoint
+ *   mtu           mtu; when the MTU of the TUN device changes, set or
+ *                 changed underneath the device
+ *   transfer      public_key, rx_bytes, tx_bytes; sent when a counter
+ *                 crosses a multiple of transfer_threshold, checked
+ *                 once per UAPIEventTransferInterval
+ *   dropped       dropped; events were lost because the client read too
+ *                 slowly, it should resynchronise with get
+ *
+ * Events of one peer are sent in the order they occurred. The device
+ * never waits on subscribers: when a subscriber's queue is full, further
+ * events are counted and reported by the next dropped event instead.
+ */
+
+const (
+	UAPIEventSubscribed  = "subscribed"
+	UAPIEventPeerAdded   = "peer_added"
+	UAPIEventPeerRemoved = "peer_removed"
+	UAPIEventEndpoint    = "endpoint"
+	UAPIEventHandshake   = "handshake"
+	UAPIEventPathMTU     = "path_mtu"
+	UAPIEventPunched     = "punched"
+	UAPIEventMTU         = "mtu"
+	UAPIEventTransfer    = "transfer"
+	UAPIEventDropped     = "dropped"
+
+	UAPIEventTransferInterval = time.Second
+)
+
+type UAPIEventJSON struct {
+	Event       string `json:"event"`
+	Version     int    `json:"version,omitempty"`
+	PublicKey   string `json:"public_key,omitempty"`
+	OldEndpoint string `json:"old_endpoint,omitempty"`
+	Endpoint    string `json:"endpoint,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+	Attempt     uint32 `json:"attempt,omitempty"`
+	MTU         int    `json:"mtu,omitempty"`
+	RxBytes     uint64 `json:"rx_bytes,omitempty"`
+	TxBytes     uint64 `json:"tx_bytes,omitempty"`
+	Dropped     uint32 `json:"dropped,omitempty"`
+}
+
+type eventSubscriber struct {
+	events  chan UAPIEventJSON
+	dropped uint32 // atomic, events lost since the last dropped event
+
+	sync.Mutex
+	reported map[*Peer][2]uint64 // transfer counters last reported per peer, in multiples of threshold
+}
+
+func (device *Device) subscribeEvents() *eventSubscriber {
+	sub := &eventSubscriber{
+		events:   make(chan UAPIEventJSON, QueueSubscriberSize),
+		reported: make(map[*Peer][2]uint64),
+	}
+	device.events.Lock()
+	if device.events.subscribers == nil {
+		device.events.subscribers = make(map[*eventSubscriber]struct{})
+	}
+	device.events.subscribers[sub] = struct{}{}
+	device.events.Unlock()
+	return sub
+}
+
+func (device *Device) unsubscribeEvents(sub *eventSubscriber) {
+	device.events.Lock()
+	delete(device.events.subscribers, sub)
+	device.events.Unlock()
+}
+
+func (device *Device) eventSubscribed() bool {
+	device.events.RLock()
+	defer device.events.RUnlock()
+	return len(device.events.subscribers) != 0
+}
+
+/* Forgets the transfer counters reported of a removed peer.
+ *
+ * Must hold device.peers.Mutex
+ */
+func (device *Device) forgetEventPeer(peer *Peer) {
+	device.events.RLock()
+	defer device.events.RUnlock()
+	for sub := range device.events.subscribers {
+		sub.Lock()
+		delete(sub.reported, peer)
+		sub.Unlock()
+	}
+}
+
+/* Hands event to every subscriber, never blocking.
+ */
+func (device *Device) publishEvent(event UAPIEventJSON) {
+	device.events.RLock()
+	defer device.events.RUnlock()
+	for sub := range device.events.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			atomic.AddUint32(&sub.dropped, 1)
+		}
+	}
+}
+
+func (device *Device) publishPeerEvent(event string, key wgcfg.Key) {
+	device.publishEvent(UAPIEventJSON{
+		Event:     event,
+		PublicKey: key.HexString(),
+	})
+}
+
+func (device *Device) publishEndpointEvent(key wgcfg.Key, old, new string) {
+	device.publishEvent(UAPIEventJSON{
+		Event:       UAPIEventEndpoint,
+		PublicKey:   key.HexString(),
+		OldEndpoint: old,
+		Endpoint:    new,
+	})
+}
+
+func (device *Device) IpcSubscribeOperation(socket *bufio.ReadWriter) *IPCError {
+
+	// parse subscription options
+
+	var threshold uint64
+	for {
+		line, err := socket.ReadString('\n')
+		if err != nil {
+			return &IPCError{ipc.IpcErrorIO}
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			break
+		}
+		parts := strings.Split(line, "=")
+		if len(parts) != 2 {
+			return &IPCError{ipc.IpcErrorProtocol}
+		}
+		switch parts[0] {
+		case "transfer_threshold":
+			threshold, err = strconv.ParseUint(parts[1], 10, 64)
+			if err != nil {
+				device.log.Errorf("Failed to parse transfer_threshold: %v", err)
+				return &IPCError{ipc.IpcErrorInvalid}
+			}
+		default:
+			device.log.Errorf("Invalid UAPI subscribe key: %v", parts[0])
+			return &IPCError{ipc.IpcErrorInvalid}
+		}
+	}
+
+	sub := device.subscribeEvents()
+	defer device.unsubscribeEvents(sub)
+
+	// the client sends nothing more, reading only detects it hanging up
+
+	hangup := make(chan struct{})
+	go func() {
+		socket.ReadByte()
+		close(hangup)
+	}()
+
+	send := func(event UAPIEventJSON) bool {
+		if dropped := atomic.SwapUint32(&sub.dropped, 0); dropped != 0 {
+			buf, _ := json.Marshal(&UAPIEventJSON{Event: UAPIEventDropped, Dropped: dropped})
+			if _, err := socket.Write(append(buf, '\n')); err != nil {
+				return false
+			}
+		}
+		buf, _ := json.Marshal(&event)
+		_, err := socket.Write(append(buf, '\n'))
+		return err == nil
+	}
+
+	if !send(UAPIEventJSON{Event: UAPIEventSubscribed, Version: UAPIJSONVersion}) || socket.Flush() != nil {
+		return nil
+	}
+
+	transfers := func() bool {
+		device.peers.RLock()
+		defer device.peers.RUnlock()
+		sub.Lock()
+		defer sub.Unlock()
+		for _, peer := range device.peers.keyMap {
+			rx := atomic.LoadUint64(&peer.stats.rxBytes)
+			tx := atomic.LoadUint64(&peer.stats.txBytes)
+			now := [2]uint64{rx / threshold, tx / threshold}
+			last, ok := sub.reported[peer]
+			sub.reported[peer] = now
+			if !ok || now == last {
+				continue
+			}
+			if !send(UAPIEventJSON{
+				Event:     UAPIEventTransfer,
+				PublicKey: peer.handshake.remoteStatic.HexString(),
+				RxBytes:   rx,
+				TxBytes:   tx,
+			}) {
+				return false
+			}
+		}
+		return true
+	}
+
+	var tick <-chan time.Time
+	if threshold != 0 {
+		ticker := time.NewTicker(UAPIEventTransferInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+		transfers()
+	}
+
+	for {
+		ok := true
+		select {
+		case <-device.signals.stop:
+			return nil
+		case <-hangup:
+			return nil
+		case event := <-sub.events:
+			ok = send(event)
+		case <-tick:
+			ok = transfers()
+		}
+		if !ok || socket.Flush() != nil {
+			return nil
+		}
+	}
+}
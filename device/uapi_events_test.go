@@ -0,0 +1,103 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+func TestUAPISubscribe(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev: "),
+	})
+	defer device.Close()
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		device.IpcHandle(server)
+		close(done)
+	}()
+	if _, err := client.Write([]byte("subscribe=1\n\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	events := bufio.NewScanner(client)
+	next := func() UAPIEventJSON {
+		t.Helper()
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if !events.Scan() {
+			t.Fatalf("subscription ended: %v", events.Err())
+		}
+		var event UAPIEventJSON
+		if err := json.Unmarshal(events.Bytes(), &event); err != nil {
+			t.Fatalf("%v: %q", err, events.Text())
+		}
+		return event
+	}
+
+	if event := next(); event.Event != UAPIEventSubscribed || event.Version != UAPIJSONVersion {
+		t.Fatalf("first event = %+v", event)
+	}
+
+	const pk = "f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725"
+	go ipcSet(device, cfg1)
+	if event := next(); event.Event != UAPIEventPeerAdded || event.PublicKey != pk {
+		t.Errorf("got %+v, want peer_added", event)
+	}
+	if event := next(); event.Event != UAPIEventEndpoint || event.Endpoint != "127.0.0.1:53512" {
+		t.Errorf("got %+v, want endpoint", event)
+	}
+
+	key, err := wgcfg.ParseHexKey(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go device.LookupPeer(key).timersHandshakeComplete()
+	if event := next(); event.Event != UAPIEventHandshake || event.Reason != HandshakeCompleted.String() || event.Attempt != 1 {
+		t.Errorf("got %+v, want handshake", event)
+	}
+
+	go ipcSet(device, "public_key="+pk+"\nremove=true\n")
+	if event := next(); event.Event != UAPIEventPeerRemoved || event.PublicKey != pk {
+		t.Errorf("got %+v, want peer_removed", event)
+	}
+
+	// hanging up ends the subscription
+
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription not ended by client")
+	}
+	if device.eventSubscribed() {
+		t.Error("subscriber not removed")
+	}
+}
+
+func TestUAPISubscribeForgetsRemovedPeer(t *testing.T) {
+	dev1, peer, _, dev2 := newProcessPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	sub := dev1.subscribeEvents()
+	defer dev1.unsubscribeEvents(sub)
+	sub.reported[peer] = [2]uint64{1, 1}
+
+	if err := dev1.RemovePeer(peer.handshake.remoteStatic); err != nil {
+		t.Fatal(err)
+	}
+	if len(sub.reported) != 0 {
+		t.Errorf("transfer counters of a removed peer kept: %v", sub.reported)
+	}
+}
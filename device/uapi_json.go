@@ -0,0 +1,128 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"encoding/json"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/tailscale/wireguard-go/ipc"
+)
+
+/* The JSON form of the UAPI get operation, requested with get=2.
+ *
+ * The fields are the base ones of the key=value form, with keys in hex:
+ * its further settings and counters are left to get=1. The private key is
+ * never included; the public key is reported instead and preshared keys
+ * are reduced to whether one is set. Peers are sorted by public key.
+ * Fields are only ever added within a schema version.
+ */
+
+const UAPIJSONVersion = 1
+
+type UAPIDeviceJSON struct {
+	Version       int            `json:"version"`
+	PublicKey     string         `json:"public_key,omitempty"`
+	ListenPort    uint16         `json:"listen_port,omitempty"`
+	ListenAddress string         `json:"listen_address,omitempty"`
+	Fwmark        uint32         `json:"fwmark,omitempty"`
+	Peers         []UAPIPeerJSON `json:"peers"`
+}
+
+type UAPIPeerJSON struct {
+	PublicKey                   string   `json:"public_key"`
+	Name                        string   `json:"name,omitempty"`
+	PresharedKey                bool     `json:"preshared_key"`
+	ProtocolVersion             int      `json:"protocol_version"`
+	Endpoint                    string   `json:"endpoint,omitempty"`
+	AllowedIPs                  []string `json:"allowed_ips"`
+	LastHandshakeTimeSec        int64    `json:"last_handshake_time_sec"`
+	LastHandshakeTimeNsec       int64    `json:"last_handshake_time_nsec"`
+	TxBytes                     uint64   `json:"tx_bytes"`
+	RxBytes                     uint64   `json:"rx_bytes"`
+	PersistentKeepaliveInterval uint16   `json:"persistent_keepalive_interval"`
+}
+
+func (device *Device) IpcGetJSONOperation(socket *bufio.Writer) *IPCError {
+	state := UAPIDeviceJSON{
+		Version: UAPIJSONVersion,
+		Peers:   []UAPIPeerJSON{},
+	}
+
+	func() {
+
+		// lock required resources
+
+		device.net.RLock()
+		defer device.net.RUnlock()
+
+		device.staticIdentity.RLock()
+		defer device.staticIdentity.RUnlock()
+
+		device.peers.RLock()
+		defer device.peers.RUnlock()
+
+		// serialize device related values
+
+		if !device.staticIdentity.privateKey.IsZero() {
+			state.PublicKey = device.staticIdentity.publicKey.HexString()
+		}
+		state.ListenPort = device.net.port
+		if device.net.address != nil {
+			state.ListenAddress = device.net.address.String()
+		}
+		state.Fwmark = device.net.fwmark
+
+		// serialize each peer state
+
+		for _, peer := range device.peers.keyMap {
+			peer.RLock()
+			defer peer.RUnlock()
+
+			p := UAPIPeerJSON{
+				PublicKey:                   peer.handshake.remoteStatic.HexString(),
+				Name:                        peer.Name(),
+				PresharedKey:                !peer.handshake.presharedKey.IsZero(),
+				ProtocolVersion:             1,
+				AllowedIPs:                  []string{},
+				TxBytes:                     atomic.LoadUint64(&peer.stats.txBytes),
+				RxBytes:                     atomic.LoadUint64(&peer.stats.rxBytes),
+				PersistentKeepaliveInterval: peer.persistentKeepaliveInterval,
+			}
+			if peer.endpoint != nil {
+				p.Endpoint = peer.endpoint.DstToString()
+			}
+
+			nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano)
+			p.LastHandshakeTimeSec = nano / time.Second.Nanoseconds()
+			p.LastHandshakeTimeNsec = nano % time.Second.Nanoseconds()
+
+			for _, ip := range device.allowedips.EntriesForPeer(peer) {
+				p.AllowedIPs = append(p.AllowedIPs, ip.String())
+			}
+
+			state.Peers = append(state.Peers, p)
+		}
+	}()
+
+	sort.Slice(state.Peers, func(i, j int) bool {
+		return state.Peers[i].PublicKey < state.Peers[j].PublicKey
+	})
+
+	// send a single line (does not require resource locks)
+
+	buf, err := json.Marshal(&state)
+	if err != nil {
+		return &IPCError{ipc.IpcErrorInvalid}
+	}
+	if _, err := socket.Write(append(buf, '\n')); err != nil {
+		return &IPCError{ipc.IpcErrorIO}
+	}
+	return nil
+}
@@ -0,0 +1,1493 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/ipc"
+	"github.com/tailscale/wireguard-go/replay"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+func ipcSet(device *Device, cfg string) error {
+	return device.IpcSetOperation(bufio.NewReader(strings.NewReader(cfg)))
+}
+
+func ipcGet(t *testing.T, device *Device) string {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := device.IpcGetOperation(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+	return buf.String()
+}
+
+func TestUAPITimers(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev: "),
+	})
+	defer device.Close()
+
+	if got := device.rekeyTimeout(); got != RekeyTimeout {
+		t.Errorf("default rekey_timeout = %v, want %v", got, RekeyTimeout)
+	}
+
+	err := ipcSet(device, "rekey_timeout=15000\nkeepalive_timeout=30000\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := device.rekeyTimeout(); got != 15*time.Second {
+		t.Errorf("rekey_timeout = %v, want 15s", got)
+	}
+	if got := device.keepaliveTimeout(); got != 30*time.Second {
+		t.Errorf("keepalive_timeout = %v, want 30s", got)
+	}
+
+	get := ipcGet(t, device)
+	for _, line := range []string{
+		"rekey_timeout=15000\n",
+		"keepalive_timeout=30000\n",
+		"reject_after_time=180000\n",
+	} {
+		if !strings.Contains(get, line) {
+			t.Errorf("get output missing %q:\n%s", line, get)
+		}
+	}
+
+	// rekey_timeout must be strictly less than reject_after_time
+	if err := ipcSet(device, "rekey_timeout=5000\nreject_after_time=5000\n"); err == nil {
+		t.Error("rekey_timeout == reject_after_time accepted")
+	}
+	if err := ipcSet(device, "reject_after_time=10000\n"); err == nil {
+		t.Error("reject_after_time below rekey_timeout accepted")
+	}
+	if err := ipcSet(device, "rekey_timeout=0\n"); err == nil {
+		t.Error("zero rekey_timeout accepted")
+	}
+	if got := device.rekeyTimeout(); got != 15*time.Second {
+		t.Errorf("rekey_timeout changed by rejected set: %v", got)
+	}
+
+	// the jitter may be zero, but must stay below rekey_timeout
+	if got := device.rekeyJitterMax(); got != RekeyTimeoutJitterMaxMs*time.Millisecond {
+		t.Errorf("default rekey_jitter_max = %v, want %vms", got, RekeyTimeoutJitterMaxMs)
+	}
+	if err := ipcSet(device, "rekey_jitter_max=2000\n"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(ipcGet(t, device), "rekey_jitter_max=2000\n") {
+		t.Error("get output missing rekey_jitter_max=2000")
+	}
+	if err := ipcSet(device, "rekey_timeout=1000\n"); err == nil {
+		t.Error("rekey_timeout below the rekey_jitter_max in effect accepted")
+	}
+	if err := ipcSet(device, "rekey_jitter_max=0\n"); err != nil {
+		t.Errorf("zero rekey_jitter_max rejected: %v", err)
+	}
+	if err := ipcSet(device, "rekey_jitter_max=15000\n"); err == nil {
+		t.Error("rekey_jitter_max == rekey_timeout accepted")
+	}
+	if err := ipcSet(device, "rekey_jitter_max=1000\nrekey_timeout=500\n"); err == nil {
+		t.Error("rekey_timeout below rekey_jitter_max accepted")
+	}
+	if err := ipcSet(device, "rekey_jitter_max=-1\n"); err == nil {
+		t.Error("negative rekey_jitter_max accepted")
+	}
+	if got := device.rekeyJitterMax(); got != 0 {
+		t.Errorf("rekey_jitter_max changed by rejected set: %v", got)
+	}
+}
+
+func TestUAPIRekeyAfterMessages(t *testing.T) {
+	dst, src := net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")
+	dev1, tun1, dev2, tun2 := newBindTestPair(t, bindtest.NewNetwork(1))
+	defer dev1.Close()
+	defer dev2.Close()
+
+	if err := ipcSet(dev2, "rekey_timeout=100\nrekey_jitter_max=50\nrekey_after_messages=3\n"); err != nil {
+		t.Fatal(err)
+	}
+	ping := func() {
+		tun2.Outbound <- tuntest.Ping(dst, src)
+		select {
+		case <-tun1.Inbound:
+		case <-time.After(2 * time.Second):
+			t.Fatal("ping did not transit")
+		}
+	}
+	ping()
+	time.Sleep(150 * time.Millisecond)
+
+	// sending past the threshold initiates a new handshake
+
+	key := dev1.staticIdentity.publicKey.Base64()
+	for i := 0; i < 4; i++ {
+		ping()
+	}
+	for deadline := time.Now().Add(2 * time.Second); dev2.Metrics().Peers[key].HandshakesCompleted < 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("not rekeyed after 5 messages: %+v", dev2.Metrics().Peers[key])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if metrics := dev2.Metrics(); metrics.RekeyAfterMessages != 3 || metrics.Peers[key].KeypairMessages > 3 {
+		t.Errorf("wrong rekey threshold %d or keypair messages %d", metrics.RekeyAfterMessages, metrics.Peers[key].KeypairMessages)
+	}
+	get := ipcGet(t, dev2)
+	for _, line := range []string{"\nrekey_after_messages=3\n", "\nkeypair_messages="} {
+		if !strings.Contains(get, line) {
+			t.Errorf("get output missing %q:\n%s", line, get)
+		}
+	}
+
+	// thresholds beyond the protocol limit are clamped to it
+
+	if err := ipcSet(dev2, fmt.Sprintf("rekey_after_messages=%d\n", uint64(RekeyAfterMessages)+1)); err != nil {
+		t.Fatal(err)
+	}
+	if messages := dev2.rekeyAfterMessages(); messages != RekeyAfterMessages {
+		t.Errorf("rekey threshold %d, want %d", messages, uint64(RekeyAfterMessages))
+	}
+	if strings.Contains(ipcGet(t, dev2), "rekey_after_messages=") {
+		t.Error("default rekey_after_messages reported")
+	}
+}
+
+func TestUAPITimerState(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev: "),
+	})
+	defer device.Close()
+
+	if err := ipcSet(device, cfg1); err != nil {
+		t.Fatal(err)
+	}
+
+	get := ipcGet(t, device)
+	for _, line := range []string{
+		"retransmit_handshake_pending=0\n",
+		"send_keepalive_pending=0\n",
+		"new_handshake_pending=0\n",
+		"zero_key_material_pending=0\n",
+		"persistent_keepalive_pending=0\n",
+		"handshake_attempts=0\n",
+	} {
+		if !strings.Contains(get, line) {
+			t.Errorf("get output missing %q:\n%s", line, get)
+		}
+	}
+
+	// timer state is read-only
+	set := "public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725\nhandshake_attempts=3\n"
+	if err := ipcSet(device, set); err == nil {
+		t.Error("set of handshake_attempts accepted")
+	}
+}
+
+func TestUAPIHandshakeFailureTime(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev: "),
+	})
+	defer device.Close()
+
+	if err := ipcSet(device, cfg1); err != nil {
+		t.Fatal(err)
+	}
+	if get := ipcGet(t, device); !strings.Contains(get, "last_handshake_failure_time=0\n") {
+		t.Errorf("get output missing zero failure time:\n%s", get)
+	}
+
+	key, err := wgcfg.ParseHexKey("f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := device.LookupPeer(key)
+	atomic.StoreUint32(&peer.timers.handshakeAttempts, MaxTimerHandshakes+1)
+	expiredRetransmitHandshake(peer)
+
+	if get := ipcGet(t, device); !strings.Contains(get, "last_handshake_failure_time=") || strings.Contains(get, "last_handshake_failure_time=0\n") {
+		t.Errorf("failure time not recorded:\n%s", get)
+	}
+
+	// a successful handshake clears the failure
+	peer.timersHandshakeComplete()
+	if get := ipcGet(t, device); !strings.Contains(get, "last_handshake_failure_time=0\n") {
+		t.Errorf("failure time not cleared:\n%s", get)
+	}
+}
+
+func TestUAPIDSCPPassthrough(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev: "),
+	})
+	defer device.Close()
+
+	if strings.Contains(ipcGet(t, device), "dscp_passthrough") {
+		t.Error("dscp_passthrough reported while disabled")
+	}
+	if err := ipcSet(device, "dscp_passthrough=true\n"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(ipcGet(t, device), "dscp_passthrough=true\n") {
+		t.Error("dscp_passthrough not reported while enabled")
+	}
+	if err := ipcSet(device, "dscp_passthrough=yes\n"); err == nil {
+		t.Error("invalid dscp_passthrough value accepted")
+	}
+}
+
+func TestUAPIPeerLifecycle(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev: "),
+	})
+	defer device.Close()
+
+	before := time.Now()
+	if err := ipcSet(device, cfg1); err != nil {
+		t.Fatal(err)
+	}
+	key, err := wgcfg.ParseHexKey("f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := device.LookupPeer(key)
+	created := atomic.LoadInt64(&peer.lifecycle.createdNano)
+	modified := atomic.LoadInt64(&peer.lifecycle.modifiedNano)
+	if created < before.UnixNano() || modified < created {
+		t.Errorf("peer created at %d, modified at %d, before %d", created, modified, before.UnixNano())
+	}
+	if line := fmt.Sprintf("\ncreated_time=%d\n", created/int64(time.Second)); !strings.Contains(ipcGet(t, device), line) {
+		t.Errorf("get output missing %q", line)
+	}
+
+	// acting on the peer leaves it unmodified, configuring it does not
+
+	pk := "public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725\n"
+	if err := ipcSet(device, pk+"reset_stats=true\n"); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt64(&peer.lifecycle.modifiedNano); got != modified {
+		t.Errorf("peer modified by resetting its stats")
+	}
+	time.Sleep(time.Millisecond)
+	if err := ipcSet(device, pk+"persistent_keepalive_interval=25\n"); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt64(&peer.lifecycle.modifiedNano); got <= modified {
+		t.Errorf("peer not modified by setting its keepalive")
+	}
+	if got := atomic.LoadInt64(&peer.lifecycle.createdNano); got != created {
+		t.Errorf("creation time changed from %d to %d", created, got)
+	}
+}
+
+func TestUAPITriggerHandshake(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev: "),
+	})
+	defer device.Close()
+
+	if err := ipcSet(device, cfg1); err != nil {
+		t.Fatal(err)
+	}
+	key, err := wgcfg.ParseHexKey("f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := device.LookupPeer(key)
+	trigger := "public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725\ntrigger_handshake=true\n"
+
+	// no-op while the device is down
+	if err := ipcSet(device, trigger); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadUint64(&peer.stats.handshakeAttempts); n != 0 {
+		t.Fatalf("down device sent %d initiations", n)
+	}
+
+	device.Up()
+	if err := ipcSet(device, trigger); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadUint64(&peer.stats.handshakeAttempts); n != 1 {
+		t.Fatalf("sent %d initiations, want 1", n)
+	}
+
+	// rate limited to one per rekey timeout
+	if err := ipcSet(device, trigger); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadUint64(&peer.stats.handshakeAttempts); n != 1 {
+		t.Fatalf("sent %d initiations after repeated trigger, want 1", n)
+	}
+
+	unknown := "public_key=49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427\nupdate_only=true\ntrigger_handshake=true\n"
+	if err := ipcSet(device, unknown); err == nil {
+		t.Error("trigger for unknown peer accepted")
+	}
+}
+
+func TestUAPIZeroKeys(t *testing.T) {
+	dev1, tun1, dev2, tun2 := newBindTestPair(t, bindtest.NewNetwork(1))
+	defer dev1.Close()
+	defer dev2.Close()
+	ping := func() {
+		t.Helper()
+		tun2.Outbound <- tuntest.Ping(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"))
+		select {
+		case <-tun1.Inbound:
+		case <-time.After(2 * time.Second):
+			t.Fatal("ping did not transit")
+		}
+	}
+	ping()
+	time.Sleep(2 * HandshakeInitationRate) // closer initiations are taken for a flood
+
+	pk := "public_key=49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427\n"
+	if err := ipcSet(dev2, pk+"zero_keys=true\n"); err != nil {
+		t.Fatal(err)
+	}
+	peer := dev2.LookupPeer(dev1.staticIdentity.publicKey)
+	if peer.keypairs.Current() != nil || peer.timers.sendKeepalive.IsPending() || peer.timers.newHandshake.IsPending() {
+		t.Fatal("session not dropped")
+	}
+	if get := ipcGet(t, dev2); !strings.Contains(get, "allowed_ip=1.0.0.1/32\n") {
+		t.Fatalf("peer configuration lost:\n%s", get)
+	}
+
+	// the next packet handshakes afresh
+
+	completed := dev2.Metrics().HandshakesCompleted
+	ping()
+	if n := dev2.Metrics().HandshakesCompleted; n != completed+1 {
+		t.Errorf("%d handshakes completed, want %d", n, completed+1)
+	}
+
+	unknown := "public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725\nupdate_only=true\nzero_keys=true\n"
+	if err := ipcSet(dev2, unknown); err == nil {
+		t.Error("zero_keys for unknown peer accepted")
+	}
+}
+
+func TestUAPIResetStats(t *testing.T) {
+	dev1, tun1, dev2, tun2 := newBindTestPair(t, bindtest.NewNetwork(1))
+	defer dev1.Close()
+	defer dev2.Close()
+	tun2.Outbound <- tuntest.Ping(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"))
+	select {
+	case <-tun1.Inbound:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ping did not transit")
+	}
+
+	pk := "public_key=49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427\n"
+	peer := dev2.LookupPeer(dev1.staticIdentity.publicKey)
+	lastHandshake := atomic.LoadInt64(&peer.stats.lastHandshakeNano)
+	if m := dev2.Metrics(); m.TxBytes == 0 || m.HandshakesCompleted == 0 {
+		t.Fatalf("nothing counted: %+v", m)
+	}
+	if err := ipcSet(dev2, pk+"reset_stats=true\n"); err != nil {
+		t.Fatal(err)
+	}
+	m := dev2.Metrics()
+	if m.TxBytes != 0 || m.RxBytes != 0 || m.TxPackets != 0 || m.RxPackets != 0 || m.HandshakesCompleted != 0 || m.HandshakeLatency != (HandshakeLatency{}) {
+		t.Errorf("counters not reset: %+v", m)
+	}
+	if atomic.LoadInt64(&peer.stats.lastHandshakeNano) != lastHandshake {
+		t.Error("last handshake time reset")
+	}
+
+	// the device-wide key resets every peer
+
+	if m := dev1.Metrics(); m.RxBytes == 0 {
+		t.Fatalf("nothing counted: %+v", m)
+	}
+	if err := ipcSet(dev1, "reset_stats=true\n"); err != nil {
+		t.Fatal(err)
+	}
+	if m := dev1.Metrics(); m.RxBytes != 0 || m.RxPackets != 0 || m.HandshakesCompleted != 0 {
+		t.Errorf("counters not reset: %+v", m)
+	}
+
+	unknown := "public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725\nupdate_only=true\nreset_stats=true\n"
+	if err := ipcSet(dev2, unknown); err == nil {
+		t.Error("reset_stats for unknown peer accepted")
+	}
+	if err := ipcSet(dev2, "reset_stats=false\n"); err == nil {
+		t.Error("reset_stats=false accepted")
+	}
+}
+
+func TestUAPIKeypairConfirmed(t *testing.T) {
+	dst, src := net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")
+	dev1, tun1, dev2, tun2 := newBindTestPair(t, bindtest.NewNetwork(1))
+	defer dev1.Close()
+	defer dev2.Close()
+	if get := ipcGet(t, dev2); strings.Contains(get, "keypair_confirmed") {
+		t.Errorf("keypair_confirmed without a keypair:\n%s", get)
+	}
+
+	// the responder has data under the keypair, the initiator nothing yet
+
+	tun2.Outbound <- tuntest.Ping(dst, src)
+	select {
+	case <-tun1.Inbound:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ping did not transit")
+	}
+	key1, key2 := dev1.staticIdentity.publicKey.Base64(), dev2.staticIdentity.publicKey.Base64()
+	if get := ipcGet(t, dev2); !strings.Contains(get, "keypair_confirmed=false\n") {
+		t.Errorf("initiator keypair confirmed:\n%s", get)
+	}
+	if dev2.Metrics().Peers[key1].KeypairConfirmed {
+		t.Error("initiator keypair confirmed in metrics")
+	}
+	if get := ipcGet(t, dev1); !strings.Contains(get, "keypair_confirmed=true\n") {
+		t.Errorf("responder keypair not confirmed:\n%s", get)
+	}
+
+	tun1.Outbound <- tuntest.Ping(src, dst)
+	select {
+	case <-tun2.Inbound:
+	case <-time.After(2 * time.Second):
+		t.Fatal("return ping did not transit")
+	}
+	if !dev2.Metrics().Peers[key1].KeypairConfirmed || !dev1.Metrics().Peers[key2].KeypairConfirmed {
+		t.Error("keypair not confirmed after return traffic")
+	}
+}
+
+func TestUAPILocalEndpoint(t *testing.T) {
+	dev1, tun1, dev2, tun2 := newBindTestPair(t, bindtest.NewNetwork(1))
+	defer dev1.Close()
+	defer dev2.Close()
+	if get := ipcGet(t, dev1); strings.Contains(get, "local_endpoint=") {
+		t.Errorf("local_endpoint before any packet:\n%s", get)
+	}
+
+	tun2.Outbound <- tuntest.Ping(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"))
+	select {
+	case <-tun1.Inbound:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ping did not transit")
+	}
+	if get := ipcGet(t, dev1); !strings.Contains(get, "\nlocal_endpoint=127.0.0.1:53511\n") {
+		t.Errorf("local_endpoint missing from get:\n%s", get)
+	}
+
+	// cleared with the source address of the endpoint
+
+	peer := dev1.LookupPeer(dev2.staticIdentity.publicKey)
+	peer.Lock()
+	peer.clearSrc()
+	peer.Unlock()
+	if get := ipcGet(t, dev1); strings.Contains(get, "local_endpoint=") {
+		t.Errorf("local_endpoint after clearing:\n%s", get)
+	}
+}
+
+func TestUAPIPassive(t *testing.T) {
+	dst, src := net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")
+	dev1, tun1, dev2, tun2 := newBindTestPair(t, bindtest.NewNetwork(1))
+	defer dev1.Close()
+	defer dev2.Close()
+	if err := ipcSet(dev2, "passive=true\n"); err != nil {
+		t.Fatal(err)
+	}
+	if get := ipcGet(t, dev2); !strings.Contains(get, "passive=true\n") {
+		t.Errorf("passive missing from get:\n%s", get)
+	}
+
+	// a passive device holds its packets until the peer reaches out
+
+	tun2.Outbound <- tuntest.Ping(dst, src)
+	select {
+	case <-tun1.Inbound:
+		t.Fatal("passive device initiated a handshake")
+	case <-time.After(200 * time.Millisecond):
+	}
+	if attempts := dev2.Metrics().HandshakeAttempts; attempts != 0 {
+		t.Errorf("passive device made %d handshake attempts", attempts)
+	}
+
+	tun1.Outbound <- tuntest.Ping(src, dst)
+	for received := 0; received < 2; received++ {
+		select {
+		case <-tun1.Inbound:
+		case <-tun2.Inbound:
+		case <-time.After(2 * time.Second):
+			t.Fatal("pings did not transit once the peer initiated")
+		}
+	}
+
+	if err := ipcSet(dev2, "passive=false\n"); err != nil {
+		t.Fatal(err)
+	}
+	if get := ipcGet(t, dev2); strings.Contains(get, "passive") {
+		t.Errorf("passive mode still enabled:\n%s", get)
+	}
+}
+
+func TestUAPIListenAddress(t *testing.T) {
+	tun := tuntest.NewChannelTUN()
+	device := NewDevice(tun.TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev: "),
+	})
+	device.Up()
+	defer device.Close()
+
+	if err := ipcSet(device, "listen_address=127.0.0.1\n"); err != nil {
+		t.Fatal(err)
+	}
+	if get := ipcGet(t, device); !strings.Contains(get, "listen_address=127.0.0.1\n") {
+		t.Errorf("get output missing listen_address:\n%s", get)
+	}
+	if _, _, _, err := device.net.bind.ReceiveIPv6(nil); err != syscall.EAFNOSUPPORT {
+		t.Errorf("IPv6 receive on an IPv4 address: %v", err)
+	}
+
+	// documentation addresses are never local, and IPv4 has no zones
+
+	for _, bad := range []string{"192.0.2.1", "127.0.0.1%lo", "localhost"} {
+		if err := ipcSet(device, "listen_address="+bad+"\n"); err == nil {
+			t.Errorf("listen_address=%s accepted", bad)
+		}
+	}
+
+	if err := ipcSet(device, "listen_address=\n"); err != nil {
+		t.Fatal(err)
+	}
+	if get := ipcGet(t, device); strings.Contains(get, "listen_address=") {
+		t.Errorf("listen_address not cleared:\n%s", get)
+	}
+}
+
+func TestUAPIHandshakeRateLimitPrefix(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev: "),
+	})
+	defer device.Close()
+
+	if strings.Contains(ipcGet(t, device), "handshake_rate_limit_prefix") {
+		t.Error("default prefix lengths reported")
+	}
+	if err := ipcSet(device, "handshake_rate_limit_prefix_ipv4=24\nhandshake_rate_limit_prefix_ipv6=64\n"); err != nil {
+		t.Fatal(err)
+	}
+	get := ipcGet(t, device)
+	for _, line := range []string{"handshake_rate_limit_prefix_ipv4=24\n", "handshake_rate_limit_prefix_ipv6=64\n"} {
+		if !strings.Contains(get, line) {
+			t.Errorf("get output missing %q:\n%s", line, get)
+		}
+	}
+	for _, bad := range []string{"handshake_rate_limit_prefix_ipv4=33\n", "handshake_rate_limit_prefix_ipv6=-1\n"} {
+		if err := ipcSet(device, bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestUAPICookieRotationInterval(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev: "),
+	})
+	defer device.Close()
+
+	get := ipcGet(t, device)
+	if strings.Contains(get, "cookie_rotation_interval") || !strings.Contains(get, "cookie_secret_rotations=0\n") {
+		t.Errorf("unexpected cookie rotation state:\n%s", get)
+	}
+	if err := ipcSet(device, "cookie_rotation_interval=30000\n"); err != nil {
+		t.Fatal(err)
+	}
+	if get := ipcGet(t, device); !strings.Contains(get, "cookie_rotation_interval=30000\n") {
+		t.Errorf("cookie_rotation_interval missing from get:\n%s", get)
+	}
+	for _, bad := range []string{"cookie_rotation_interval=9999\n", "cookie_rotation_interval=3600001\n", "cookie_rotation_interval=-1\n"} {
+		if err := ipcSet(device, bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+	if err := ipcSet(device, "cookie_rotation_interval=0\n"); err != nil {
+		t.Fatal(err)
+	}
+	if get := ipcGet(t, device); strings.Contains(get, "cookie_rotation_interval") {
+		t.Errorf("default interval reported:\n%s", get)
+	}
+}
+
+func TestUAPINonceQueueSize(t *testing.T) {
+	dev1, _, dev2, _ := newBindTestPair(t, bindtest.NewNetwork(1))
+	defer dev1.Close()
+	defer dev2.Close()
+	key := dev2.staticIdentity.publicKey.Base64()
+
+	if get := ipcGet(t, dev1); strings.Contains(get, "nonce_queue_size") {
+		t.Errorf("default nonce queue size reported:\n%s", get)
+	}
+	for _, bad := range []string{"nonce_queue_size=0\n", "nonce_queue_size=65537\n"} {
+		if err := ipcSet(dev1, bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+	if err := ipcSet(dev1, "nonce_queue_size=8\n"); err != nil {
+		t.Fatal(err)
+	}
+	if get := ipcGet(t, dev1); !strings.Contains(get, "nonce_queue_size=8\n") {
+		t.Errorf("nonce_queue_size missing from get:\n%s", get)
+	}
+
+	// running peers keep their queue until they start again
+
+	if size := dev1.Metrics().Peers[key].NonceQueue.Cap; size != QueueOutboundSize {
+		t.Errorf("running peer given a nonce queue of %d", size)
+	}
+	dev1.Down()
+	dev1.Up()
+	if size := dev1.Metrics().Peers[key].NonceQueue.Cap; size != 8 {
+		t.Errorf("restarted peer given a nonce queue of %d, want 8", size)
+	}
+}
+
+func TestUAPIReplayWindow(t *testing.T) {
+	tun1 := tuntest.NewChannelTUN()
+	dev1 := NewDevice(tun1.TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev1: "),
+	})
+	dev1.Up()
+	defer dev1.Close()
+
+	if strings.Contains(ipcGet(t, dev1), "replay_window") {
+		t.Error("default replay window reported")
+	}
+	if err := ipcSet(dev1, "replay_window=5000\n"+cfg1); err != nil {
+		t.Fatal(err)
+	}
+	if get := ipcGet(t, dev1); !strings.Contains(get, "replay_window=8192\n") {
+		t.Errorf("get output missing rounded replay_window:\n%s", get)
+	}
+	for _, bad := range []string{"replay_window=65537\n", "replay_window=-1\n"} {
+		if err := ipcSet(dev1, bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+
+	// new keypairs are given the configured window
+
+	tun2 := tuntest.NewChannelTUN()
+	dev2 := NewDevice(tun2.TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev2: "),
+	})
+	dev2.Up()
+	defer dev2.Close()
+	if err := ipcSet(dev2, cfg2); err != nil {
+		t.Fatal(err)
+	}
+	tun2.Outbound <- tuntest.Ping(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"))
+	select {
+	case <-tun1.Inbound:
+	case <-time.After(time.Second):
+		t.Fatal("ping did not transit")
+	}
+	key, _ := wgcfg.ParseHexKey("f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725")
+	if window := dev1.LookupPeer(key).keypairs.Current().replayFilter.WindowSize(); window != 8192-replay.CounterRedundantBits {
+		t.Errorf("keypair replay window = %d, want %d", window, 8192-replay.CounterRedundantBits)
+	}
+
+	if err := ipcSet(dev1, "replay_window=0\n"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(ipcGet(t, dev1), "replay_window") {
+		t.Error("replay window not reset to the default")
+	}
+}
+
+/* A bind holding back the next transport message sent, once armed,
+ * until released.
+ */
+type holdBind struct {
+	conn.Bind
+	mu    sync.Mutex
+	armed bool
+	held  []byte
+	end   conn.Endpoint
+}
+
+func (bind *holdBind) Send(buff []byte, end conn.Endpoint) error {
+	bind.mu.Lock()
+	if bind.armed && len(buff) > 0 && buff[0] == MessageTransportType {
+		bind.armed = false
+		bind.held = append([]byte(nil), buff...)
+		bind.end = end
+		bind.mu.Unlock()
+		return nil
+	}
+	bind.mu.Unlock()
+	return bind.Bind.Send(buff, end)
+}
+
+func (bind *holdBind) release() error {
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+	return bind.Bind.Send(bind.held, bind.end)
+}
+
+func TestUAPIDisableReplayProtection(t *testing.T) {
+	dst, src := net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")
+	pk := "public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725\n"
+
+	for _, unprotected := range []bool{false, true} {
+		t.Run(fmt.Sprintf("disabled=%t", unprotected), func(t *testing.T) {
+			network := bindtest.NewNetwork(1)
+			var hold *holdBind
+			var devs [2]*Device
+			var tuns [2]*tuntest.ChannelTUN
+			for i, cfg := range []string{cfg1, cfg2} {
+				i := i
+				tuns[i] = tuntest.NewChannelTUN()
+				devs[i] = NewDevice(tuns[i].TUN(), &DeviceOptions{
+					Logger: NewLogger(LogLevelSilent, ""),
+					CreateBind: func(port uint16) (conn.Bind, uint16, error) {
+						bind, port, err := network.CreateBind(port)
+						if err != nil || i == 0 {
+							return bind, port, err
+						}
+						hold = &holdBind{Bind: bind}
+						return hold, port, nil
+					},
+					CreateEndpoint: network.CreateEndpoint,
+				})
+				defer devs[i].Close()
+				devs[i].Up()
+				if err := ipcSet(devs[i], cfg); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := ipcSet(devs[0], pk+fmt.Sprintf("disable_replay_protection=%t\n", unprotected)); err != nil {
+				t.Fatal(err)
+			}
+			if get := ipcGet(t, devs[0]); strings.Contains(get, "disable_replay_protection=true\n") != unprotected {
+				t.Errorf("disable_replay_protection not reported as %t:\n%s", unprotected, get)
+			}
+
+			marked := tuntest.Ping(dst, src)
+			marked[len(marked)-1] ^= 0xff
+			tuns[1].Outbound <- tuntest.Ping(dst, src)
+			select {
+			case <-tuns[0].Inbound:
+			case <-time.After(2 * time.Second):
+				t.Fatal("ping did not transit")
+			}
+			delivered := make(chan struct{}, 1)
+			go func() {
+				for packet := range tuns[0].Inbound {
+					if bytes.Equal(packet, marked) {
+						delivered <- struct{}{}
+					}
+				}
+			}()
+
+			// the marked packet is overtaken by a whole window of others
+
+			hold.mu.Lock()
+			hold.armed = true
+			hold.mu.Unlock()
+			tuns[1].Outbound <- marked
+			keypair := devs[1].LookupPeer(devs[0].staticIdentity.publicKey).keypairs.Current()
+			for atomic.LoadUint64(&keypair.sendNonce) < replay.CounterWindowSize+16 {
+				tuns[1].Outbound <- tuntest.Ping(dst, src)
+			}
+			time.Sleep(50 * time.Millisecond)
+			if err := hold.release(); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case <-delivered:
+				if !unprotected {
+					t.Error("packet behind the replay window delivered")
+				}
+			case <-time.After(500 * time.Millisecond):
+				if unprotected {
+					t.Error("packet behind the replay window dropped")
+				}
+			}
+		})
+	}
+}
+
+func TestUAPIMTU(t *testing.T) {
+	tun1 := tuntest.NewChannelTUN()
+	dev1 := NewDevice(tun1.TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev1: "),
+	})
+	dev1.Up()
+	defer dev1.Close()
+	if err := ipcSet(dev1, cfg1); err != nil {
+		t.Fatal(err)
+	}
+
+	tun2 := tuntest.NewChannelTUN()
+	dev2 := NewDevice(tun2.TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev2: "),
+	})
+	dev2.Up()
+	defer dev2.Close()
+	if err := ipcSet(dev2, cfg2); err != nil {
+		t.Fatal(err)
+	}
+
+	if get := ipcGet(t, dev2); !strings.Contains(get, fmt.Sprintf("mtu=%d\n", DefaultMTU)) {
+		t.Errorf("get output missing default mtu:\n%s", get)
+	}
+	for _, bad := range []string{"mtu=1279\n", fmt.Sprintf("mtu=%d\n", MaxContentSize+1), "mtu=x\n"} {
+		if err := ipcSet(dev2, bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+
+	if err := ipcSet(dev2, "mtu=1300\n"); err != nil {
+		t.Fatal(err)
+	}
+	if mtu, _ := tun2.TUN().MTU(); mtu != 1300 {
+		t.Errorf("TUN device MTU = %d, want 1300", mtu)
+	}
+	if get := ipcGet(t, dev2); !strings.Contains(get, "mtu=1300\n") {
+		t.Errorf("get output missing mtu:\n%s", get)
+	}
+
+	// the send path takes the new MTU at once
+
+	dst, src := net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")
+	tun2.Outbound <- testIPv4Packet(dst, src, 1350, true)
+	select {
+	case reply := <-tun2.Inbound:
+		if len(reply) < 28 || reply[20] != icmpv4DestinationUnreachable || binary.BigEndian.Uint16(reply[26:]) != 1300 {
+			t.Errorf("unexpected reply to oversized packet: % x", reply)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no ICMP reply to oversized packet")
+	}
+	tun2.Outbound <- testIPv4Packet(dst, src, 1300, true)
+	select {
+	case <-tun1.Inbound:
+	case <-time.After(time.Second):
+		t.Fatal("packet of the new MTU did not transit")
+	}
+
+	// devices without a settable MTU refuse it
+
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelSilent, "dev: "),
+	})
+	defer device.Close()
+	if err := ipcSet(device, "mtu=1300\n"); err == nil {
+		t.Error("mtu set on a TUN device without SetMTU")
+	}
+}
+
+func TestUAPINextPresharedKey(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev: "),
+	})
+	defer device.Close()
+
+	psk := strings.Repeat("ab", 32)
+	set := cfg1 + "\nnext_preshared_key=" + psk + "\n"
+	if err := ipcSet(device, set); err != nil {
+		t.Fatal(err)
+	}
+	if get := ipcGet(t, device); !strings.Contains(get, "next_preshared_key="+psk+"\n") {
+		t.Errorf("get output missing next_preshared_key:\n%s", get)
+	}
+
+	set = "public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725\nnext_preshared_key=" + strings.Repeat("00", 32) + "\n"
+	if err := ipcSet(device, set); err != nil {
+		t.Fatal(err)
+	}
+	if get := ipcGet(t, device); strings.Contains(get, "next_preshared_key=") {
+		t.Errorf("next_preshared_key not cleared:\n%s", get)
+	}
+}
+
+func TestUAPIGetJSON(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev: "),
+	})
+	defer device.Close()
+	if err := ipcSet(device, cfg1); err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := net.Pipe()
+	go device.IpcHandle(server)
+	if _, err := client.Write([]byte("get=2\n")); err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(out), "\n")
+	if len(lines) != 4 || lines[1] != "errno=0" {
+		t.Fatalf("unexpected response:\n%s", out)
+	}
+
+	var state UAPIDeviceJSON
+	if err := json.Unmarshal([]byte(lines[0]), &state); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(lines[0], "481eb0d8") {
+		t.Error("private key leaked")
+	}
+	if state.Version != UAPIJSONVersion || state.ListenPort != 53511 || len(state.Peers) != 1 {
+		t.Fatalf("unexpected state: %+v", state)
+	}
+	peer := state.Peers[0]
+	if peer.PublicKey != "f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725" ||
+		peer.Endpoint != "127.0.0.1:53512" ||
+		len(peer.AllowedIPs) != 1 || peer.AllowedIPs[0] != "1.0.0.2/32" {
+		t.Errorf("unexpected peer: %+v", peer)
+	}
+}
+
+func TestUAPISetAtomic(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelSilent, "dev: "),
+	})
+	defer device.Close()
+
+	if err := ipcSet(device, cfg1); err != nil {
+		t.Fatal(err)
+	}
+	before := ipcGet(t, device)
+
+	// a malformed peer after replace_peers leaves the existing peers in place
+
+	set := "replace_peers=true\n" +
+		"keepalive_timeout=5000\n" +
+		"public_key=49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427\n" +
+		"allowed_ip=10.0.0.1/32\n" +
+		"public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725\n" +
+		"allowed_ip=10.0.0.256/32\n"
+	if err := ipcSet(device, set); err == nil {
+		t.Fatal("malformed allowed_ip accepted")
+	}
+	if after := ipcGet(t, device); after != before {
+		t.Errorf("failed set changed the device:\n%s\nwant:\n%s", after, before)
+	}
+
+	// so do an invalid endpoint and conflicting timers
+
+	for _, set := range []string{
+		"replace_peers=true\npublic_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725\nendpoint=[::1:51820\n",
+		"rekey_timeout=10000\nreject_after_time=5000\nreplace_peers=true\n",
+	} {
+		if err := ipcSet(device, set); err == nil {
+			t.Errorf("invalid set accepted: %q", set)
+		}
+		if after := ipcGet(t, device); after != before {
+			t.Errorf("failed set %q changed the device", set)
+		}
+	}
+}
+
+func TestUAPIRemoveAllowedIP(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev: "),
+	})
+	defer device.Close()
+
+	const pk = "public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725\n"
+	set := pk + "allowed_ip=10.0.0.0/8\nallowed_ip=10.1.0.0/16\nallowed_ip=fd00::/64\n"
+	if err := ipcSet(device, set); err != nil {
+		t.Fatal(err)
+	}
+
+	// absent prefixes are ignored, a prefix added and removed in the
+	// same operation is not added
+
+	set = pk + "remove_allowed_ip=10.1.0.0/16\nremove_allowed_ip=10.2.0.0/16\n" +
+		"allowed_ip=192.168.0.0/24\nremove_allowed_ip=192.168.0.0/24\n"
+	if err := ipcSet(device, set); err != nil {
+		t.Fatal(err)
+	}
+	get := ipcGet(t, device)
+	if !strings.Contains(get, "allowed_ip=10.0.0.0/8\n") || !strings.Contains(get, "allowed_ip=fd00::/64\n") {
+		t.Errorf("remaining prefixes removed:\n%s", get)
+	}
+	if strings.Contains(get, "10.1.0.0/16") || strings.Contains(get, "192.168.0.0/24") {
+		t.Errorf("prefix not removed:\n%s", get)
+	}
+
+	if err := ipcSet(device, pk+"remove_allowed_ip=10.0.0.0\n"); err == nil {
+		t.Error("invalid prefix accepted")
+	}
+}
+
+func TestUAPILookup(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelSilent, "dev: "),
+	})
+	defer device.Close()
+
+	const pk = "f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725"
+	if err := ipcSet(device, "public_key="+pk+"\nallowed_ip=10.0.0.0/24\nallowed_ip=fd00::/64\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ip := range []string{"10.0.0.5", "fd00::5"} {
+		if peer, ok := device.LookupPeerByIP(net.ParseIP(ip)); !ok || peer.handshake.remoteStatic.HexString() != pk {
+			t.Errorf("LookupPeerByIP(%s) = %v, %v", ip, peer, ok)
+		}
+	}
+	if peer, ok := device.LookupPeerByIP(net.ParseIP("10.0.1.5")); ok || peer != nil {
+		t.Errorf("LookupPeerByIP(10.0.1.5) = %v, %v", peer, ok)
+	}
+	if _, ok := device.LookupPeerByIP(nil); ok {
+		t.Error("LookupPeerByIP(nil) matched")
+	}
+
+	lookup := func(op string) string {
+		client, server := net.Pipe()
+		go device.IpcHandle(server)
+		if _, err := client.Write([]byte(op)); err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out)
+	}
+	if out := lookup("lookup=10.0.0.5\n"); out != "public_key="+pk+"\nerrno=0\n\n" {
+		t.Errorf("unexpected response:\n%s", out)
+	}
+	if out := lookup("lookup=192.168.0.1\n"); out != "errno=0\n\n" {
+		t.Errorf("unexpected response:\n%s", out)
+	}
+	if out := lookup("lookup=nonsense\n"); out == "errno=0\n\n" {
+		t.Errorf("invalid address accepted")
+	}
+}
+
+func TestUAPIGetPeers(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelSilent, "dev: "),
+	})
+	defer device.Close()
+
+	var keys []string
+	for i := 0; i < 5; i++ {
+		sk, err := wgcfg.NewPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := sk.Public()
+		keys = append(keys, key.HexString())
+		if err := ipcSet(device, "public_key="+key.HexString()+"\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort.Strings(keys) // ordered as the keys' bytes
+
+	query := func(op string) string {
+		client, server := net.Pipe()
+		go device.IpcHandle(server)
+		if _, err := client.Write([]byte(op)); err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out)
+	}
+	publicKeys := func(out string) []string {
+		var found []string
+		for _, line := range strings.Split(out, "\n") {
+			if strings.HasPrefix(line, "public_key=") {
+				found = append(found, strings.TrimPrefix(line, "public_key="))
+			}
+		}
+		return found
+	}
+
+	key, err := wgcfg.ParseHexKey(keys[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range []string{"get_peer=" + keys[2] + "\n", "get_peer=" + key.Base64() + "\n"} {
+		out := query(op)
+		if got := publicKeys(out); len(got) != 1 || got[0] != keys[2] {
+			t.Errorf("%q: got peers %v", op, got)
+		}
+		if !strings.HasSuffix(out, "\nerrno=0\n\n") || !strings.Contains(out, "\nrx_bytes=0\n") {
+			t.Errorf("%q: unexpected response:\n%s", op, out)
+		}
+	}
+	if out := query("get_peer=" + strings.Repeat("00", 32) + "\n"); out != "errno=0\n\n" {
+		t.Errorf("unknown peer: unexpected response:\n%s", out)
+	}
+	if out := query("get_peer=nonsense\n"); out == "errno=0\n\n" {
+		t.Error("invalid key accepted")
+	}
+
+	// pages cover the peers in order
+
+	var paged []string
+	for offset := 0; offset < len(keys); offset += 2 {
+		out := query(fmt.Sprintf("get_peers=%d,2\n", offset))
+		if !strings.HasPrefix(out, "peer_count=5\n") {
+			t.Errorf("offset %d: unexpected response:\n%s", offset, out)
+		}
+		paged = append(paged, publicKeys(out)...)
+	}
+	if !reflect.DeepEqual(paged, keys) {
+		t.Errorf("paged peers %v, want %v", paged, keys)
+	}
+	if got := publicKeys(query("get_peers=1,0\n")); !reflect.DeepEqual(got, keys[1:]) {
+		t.Errorf("unlimited page: got %v, want %v", got, keys[1:])
+	}
+	if out := query("get_peers=5,2\n"); out != "peer_count=5\nerrno=0\n\n" {
+		t.Errorf("page past the end: unexpected response:\n%s", out)
+	}
+	for _, page := range []string{"1", "-1,2", "1,x"} {
+		if out := query("get_peers=" + page + "\n"); out == "errno=0\n\n" || strings.Contains(out, "peer_count") {
+			t.Errorf("invalid page %q accepted", page)
+		}
+	}
+}
+
+func TestUAPIStrictAllowedIPs(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelSilent, "dev: "),
+	})
+	defer device.Close()
+
+	const (
+		pk1 = "public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725\n"
+		pk2 = "public_key=49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427\n"
+	)
+	if err := ipcSet(device, "strict_allowed_ips=true\n"+pk1+"allowed_ip=10.0.0.0/16\n"); err != nil {
+		t.Fatal(err)
+	}
+	if get := ipcGet(t, device); !strings.Contains(get, "strict_allowed_ips=true\n") {
+		t.Errorf("strict_allowed_ips not reported:\n%s", get)
+	}
+
+	for _, set := range []string{
+		pk2 + "allowed_ip=10.0.0.0/16\n",
+		pk2 + "allowed_ip=10.0.2.0/24\n" + pk1 + "allowed_ip=10.0.2.0/24\n",
+		pk2 + "allowed_ip=10.0.0.0/16\n" + pk1 + "remove=true\n",
+	} {
+		if err := ipcSet(device, set); err == nil {
+			t.Errorf("conflicting set accepted:\n%s", set)
+		}
+	}
+	if device.LookupPeer(mustParseHexKey(t, pk2)) != nil {
+		t.Fatal("rejected set created a peer")
+	}
+
+	for _, set := range []string{
+		pk2 + "allowed_ip=10.0.1.0/24\nallowed_ip=10.0.0.0/8\n",
+		pk1 + "remove_allowed_ip=10.0.0.0/16\n" + pk2 + "allowed_ip=10.0.0.0/16\n",
+	} {
+		if err := ipcSet(device, set); err != nil {
+			t.Errorf("set rejected: %v\n%s", err, set)
+		}
+	}
+	if peer, _ := device.LookupPeerByIP(net.ParseIP("10.0.5.5")); peer == nil || peer != device.LookupPeer(mustParseHexKey(t, pk2)) {
+		t.Error("released prefix not reassigned")
+	}
+
+	// without strict mode the last assignment wins
+
+	if err := ipcSet(device, "strict_allowed_ips=false\n"+pk1+"allowed_ip=10.0.0.0/16\n"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustParseHexKey(t *testing.T, line string) wgcfg.Key {
+	t.Helper()
+	key, err := wgcfg.ParseHexKey(strings.TrimSuffix(strings.TrimPrefix(line, "public_key="), "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestUAPIStickyPort(t *testing.T) {
+	tun := tuntest.NewChannelTUN()
+	device := NewDevice(tun.TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelError, "dev: "),
+	})
+	device.Up()
+	defer device.Close()
+
+	port := func() int {
+		device.net.RLock()
+		defer device.net.RUnlock()
+		return int(device.net.port)
+	}
+
+	if err := ipcSet(device, "sticky_port=true\nlisten_address=127.0.0.1\nlisten_port=0\n"); err != nil {
+		t.Fatal(err)
+	}
+	chosen := port()
+	if get := ipcGet(t, device); !strings.Contains(get, "sticky_port=true\n") || !strings.Contains(get, fmt.Sprintf("listen_port=%d\n", chosen)) {
+		t.Errorf("get output missing sticky_port or the chosen port:\n%s", get)
+	}
+
+	// asking for an ephemeral port again keeps the chosen one
+
+	if err := ipcSet(device, "listen_port=0\n"); err != nil {
+		t.Fatal(err)
+	}
+	if port() != chosen {
+		t.Errorf("rebound to port %d, want %d", port(), chosen)
+	}
+
+	// unless it has been taken in the meantime
+
+	device.Down()
+	if err := ipcSet(device, "listen_port=0\n"); err != nil {
+		t.Fatal(err)
+	}
+	taken, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: chosen})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	device.Up()
+	if p := port(); p == 0 || p == chosen {
+		t.Errorf("bound to port %d with %d taken", p, chosen)
+	}
+}
+
+func TestUAPIRoaming(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelSilent, "dev: "),
+	})
+	defer device.Close()
+
+	const pk = "f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725"
+	if err := ipcSet(device, "public_key="+pk+"\nendpoint=192.0.2.1:51820\nallowed_endpoints=192.0.2.0/24, 2001:db8::/32\n"); err != nil {
+		t.Fatal(err)
+	}
+	peer := device.LookupPeer(mustParseHexKey(t, pk))
+	roam := func(addr, want string) {
+		t.Helper()
+		peer.SetEndpointAddress(&net.UDPAddr{IP: net.ParseIP(addr), Port: 4242})
+		if got := ipcGet(t, device); !strings.Contains(got, "\nendpoint="+want+"\n") {
+			t.Errorf("roaming to %s: want endpoint %s in\n%s", addr, want, got)
+		}
+	}
+
+	// roaming is restricted to the allowed endpoints
+
+	roam("192.0.2.7", "192.0.2.7:4242")
+	roam("198.51.100.1", "192.0.2.7:4242")
+	if got := ipcGet(t, device); !strings.Contains(got, "\nallowed_endpoints=192.0.2.0/24,2001:db8::/32\n") {
+		t.Errorf("allowed endpoints missing from\n%s", got)
+	}
+
+	// the lock keeps the endpoint, and clearing the list allows any
+
+	if err := ipcSet(device, "public_key="+pk+"\nendpoint_lock=true\nallowed_endpoints=\n"); err != nil {
+		t.Fatal(err)
+	}
+	roam("192.0.2.8", "192.0.2.7:4242")
+	if got := ipcGet(t, device); !strings.Contains(got, "\nendpoint_lock=true\n") || strings.Contains(got, "allowed_endpoints=") {
+		t.Errorf("unexpected roaming settings in\n%s", got)
+	}
+	if err := ipcSet(device, "public_key="+pk+"\nendpoint_lock=false\n"); err != nil {
+		t.Fatal(err)
+	}
+	roam("198.51.100.1", "198.51.100.1:4242")
+
+	// roaming marks a peer without NAT as maybe behind NAT after all
+
+	if err := ipcSet(device, "public_key="+pk+"\nno_nat=true\n"); err != nil {
+		t.Fatal(err)
+	}
+	if got := ipcGet(t, device); !strings.Contains(got, "\nno_nat=true\n") {
+		t.Errorf("no_nat missing from\n%s", got)
+	}
+	roam("198.51.100.1", "198.51.100.1:4242")
+	if peer.timers.natObserved.Get() {
+		t.Error("NAT observed without roaming")
+	}
+	roam("198.51.100.2", "198.51.100.2:4242")
+	if !peer.timers.natObserved.Get() {
+		t.Error("NAT not observed after roaming")
+	}
+
+	if err := ipcSet(device, "public_key="+pk+"\nallowed_endpoints=nonsense\n"); err == nil {
+		t.Error("invalid allowed endpoints accepted")
+	}
+}
+
+func TestUAPIDryRun(t *testing.T) {
+	lookups := 0
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelSilent, "dev: "),
+		LookupHost: func(host string) ([]net.IP, error) {
+			lookups++
+			return nil, errors.New("no resolver")
+		},
+	})
+	defer device.Close()
+
+	const pk = "public_key=f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725\n"
+	if err := ipcSet(device, pk+"allowed_ip=10.0.0.0/24\n"); err != nil {
+		t.Fatal(err)
+	}
+	before := ipcGet(t, device)
+
+	set := func(cfg string) string {
+		client, server := net.Pipe()
+		go device.IpcHandle(server)
+		if _, err := client.Write([]byte("set=1\n" + cfg + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out)
+	}
+	if out := set("dry_run=true\nlisten_port=53599\nreplace_peers=true\n" + pk + "allowed_ip=10.1.0.0/16\n"); out != "errno=0\n\n" {
+		t.Errorf("valid dry run: %q", out)
+	}
+	if out := set("dry_run=true\n" + pk + "endpoint=vpn.example.com:51820\n"); out != "errno=0\n\n" || lookups != 0 {
+		t.Errorf("dry run with a hostname endpoint: %q, %d lookups", out, lookups)
+	}
+	invalid := fmt.Sprintf("errno=%d\n\n", ipc.IpcErrorInvalid)
+	for _, cfg := range []string{
+		"dry_run=true\n" + pk + "allowed_ip=10.0.0.0/33\n",
+		"dry_run=true\n" + pk + "endpoint=nowhere\n",
+		"dry_run=true\n" + pk + "endpoint=vpn.example.com:port\n",
+		"dry_run=maybe\n",
+	} {
+		if out := set(cfg); out != invalid {
+			t.Errorf("dry run of %q: %q", cfg, out)
+		}
+	}
+	if after := ipcGet(t, device); after != before {
+		t.Errorf("device changed by dry runs:\n%s\nwas:\n%s", after, before)
+	}
+}
+
+func TestUAPIPeerName(t *testing.T) {
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger: NewLogger(LogLevelSilent, "dev: "),
+	})
+	defer device.Close()
+
+	const pk = "f70dbb6b1b92a1dde1c783b297016af3f572fef13b0abb16a2623d89a58e9725"
+	if err := ipcSet(device, "public_key="+pk+"\nname=office-laptop\n"); err != nil {
+		t.Fatal(err)
+	}
+	key, err := wgcfg.ParseHexKey(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := device.LookupPeer(key)
+	if peer.String() != "office-laptop" {
+		t.Errorf("peer shown as %q", peer.String())
+	}
+	if name := device.Metrics().Peers[key.Base64()].Name; name != "office-laptop" {
+		t.Errorf("metrics name %q", name)
+	}
+	if get := ipcGet(t, device); !strings.Contains(get, "\nname=office-laptop\n") {
+		t.Errorf("get output missing name:\n%s", get)
+	}
+
+	for _, name := range []string{"tab\there", strings.Repeat("x", MaxPeerNameLength+1), "\xff"} {
+		if err := ipcSet(device, "public_key="+pk+"\nname="+name+"\n"); err == nil {
+			t.Errorf("name %q accepted", name)
+		}
+	}
+
+	if err := ipcSet(device, "public_key="+pk+"\nname=\n"); err != nil {
+		t.Fatal(err)
+	}
+	if peer.String() != key.ShortString() {
+		t.Errorf("unnamed peer shown as %q", peer.String())
+	}
+	if get := ipcGet(t, device); strings.Contains(get, "name=") {
+		t.Errorf("get output of an unnamed peer:\n%s", get)
+	}
+}
+
+func TestUAPIEagerHandshake(t *testing.T) {
+	dev1, _, dev2, _ := newBindTestPair(t, bindtest.NewNetwork(1))
+	defer dev1.Close()
+	defer dev2.Close()
+
+	key, err := wgcfg.ParseHexKey("49e80929259cebdda4f322d6d2b1a6fad819d603acd26fd5d845e7a123036427")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshaken := func(wait time.Duration) bool {
+		for deadline := time.Now().Add(wait); ; time.Sleep(5 * time.Millisecond) {
+			if peer := dev2.LookupPeer(key); peer != nil && atomic.LoadInt64(&peer.stats.lastHandshakeNano) != 0 {
+				return true
+			}
+			if time.Now().After(deadline) {
+				return false
+			}
+		}
+	}
+
+	// lazy by default, and when passive or overridden for the peer
+
+	for _, cfg := range []string{
+		"",
+		"eager_handshake=true\npassive=true\n" + cfg2,
+		"passive=false\n" + cfg2 + "\neager_handshake=false\n",
+	} {
+		if cfg != "" {
+			if err := ipcSet(dev2, cfg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if handshaken(50 * time.Millisecond) {
+			t.Fatalf("handshake initiated after %q", cfg)
+		}
+	}
+
+	if err := ipcSet(dev2, cfg2); err != nil {
+		t.Fatal(err)
+	}
+	if !handshaken(2 * time.Second) {
+		t.Fatal("no eager handshake")
+	}
+	if get := ipcGet(t, dev2); !strings.Contains(get, "\neager_handshake=true\n") {
+		t.Errorf("get output missing eager_handshake:\n%s", get)
+	}
+}
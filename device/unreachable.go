@@ -0,0 +1,85 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+)
+
+/* Sends fail with errors such as ENETUNREACH while the OS has no route to
+ * a peer, as when the WiFi it was reached over dropped. These are counted
+ * per peer, a batch of datagrams counting as a single send, and after
+ * TransportUnreachableErrors of them in a row, the transport of the peer
+ * is taken to be unreachable: a handshake event with reason
+ * HandshakeTransportUnreachable is raised, once, and handshakes are
+ * retransmitted at the backoff ceiling rather than on the usual schedule.
+ * The peer is taken to be reachable again once a send succeeds, or the
+ * bind is updated for a network change.
+ *
+ * Other send errors, such as ENOBUFS while the socket buffer is full, are
+ * transient; they are neither counted nor break a run of unreachable ones.
+ */
+
+var unreachableErrnos = []syscall.Errno{
+	syscall.ENETUNREACH,
+	syscall.EHOSTUNREACH,
+	syscall.ENETDOWN,
+	syscall.EADDRNOTAVAIL,
+}
+
+/* Returns whether err, as returned by a bind, says that the destination
+ * cannot be reached from this host at all.
+ */
+func isUnreachableError(err error) bool {
+	for {
+		switch e := err.(type) {
+		case *net.OpError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		case syscall.Errno:
+			for _, errno := range unreachableErrnos {
+				if e == errno {
+					return true
+				}
+			}
+			return false
+		default:
+			return false
+		}
+	}
+}
+
+/* Should be called with the outcome of every send to the peer.
+ */
+func (peer *Peer) transportSendResult(err error) {
+	if err == nil {
+		if atomic.LoadUint32(&peer.transport.errors) != 0 {
+			atomic.StoreUint32(&peer.transport.errors, 0)
+			if peer.transport.unreachable.Swap(false) {
+				peer.device.log.Verbosef("%v - Transport reachable again", peer)
+			}
+		}
+		return
+	}
+	if !isUnreachableError(err) {
+		return
+	}
+	if atomic.AddUint32(&peer.transport.errors, 1) >= TransportUnreachableErrors && !peer.transport.unreachable.Swap(true) {
+		peer.device.log.Errorf("%v - Transport unreachable, sends failing: %v", peer, err)
+		peer.handshakeEvent(HandshakeTransportUnreachable, 0)
+	}
+}
+
+/* Forgets the send errors of the peer, as after a network change.
+ */
+func (peer *Peer) transportReset() {
+	atomic.StoreUint32(&peer.transport.errors, 0)
+	peer.transport.unreachable.Set(false)
+}
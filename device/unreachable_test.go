@@ -0,0 +1,134 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/conn/bindtest"
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+)
+
+func TestIsUnreachableError(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{syscall.ENETUNREACH, true},
+		{&net.OpError{Op: "write", Err: os.NewSyscallError("sendto", syscall.EHOSTUNREACH)}, true},
+		{syscall.ENOBUFS, false},
+		{&net.OpError{Op: "write", Err: os.NewSyscallError("sendto", syscall.EAGAIN)}, false},
+		{errors.New("no bind"), false},
+	} {
+		if got := isUnreachableError(tt.err); got != tt.want {
+			t.Errorf("%v: unreachable %t, want %t", tt.err, got, tt.want)
+		}
+	}
+}
+
+/* A bind failing every send while it is down.
+ */
+type unreachableBind struct {
+	conn.Bind
+	down AtomicBool
+}
+
+func (bind *unreachableBind) Send(buff []byte, end conn.Endpoint) error {
+	if bind.down.Get() {
+		return &net.OpError{Op: "write", Err: os.NewSyscallError("sendmsg", syscall.ENETUNREACH)}
+	}
+	return bind.Bind.Send(buff, end)
+}
+
+func TestTransportUnreachable(t *testing.T) {
+	network := bindtest.NewNetwork(1)
+	tun1 := tuntest.NewChannelTUN()
+	dev1 := NewDevice(tun1.TUN(), &DeviceOptions{
+		Logger:         NewLogger(LogLevelError, "dev1: "),
+		CreateBind:     network.CreateBind,
+		CreateEndpoint: network.CreateEndpoint,
+	})
+	defer dev1.Close()
+	dev1.Up()
+	if err := ipcSet(dev1, cfg1); err != nil {
+		t.Fatal(err)
+	}
+
+	bind2 := new(unreachableBind)
+	tun2 := tuntest.NewChannelTUN()
+	dev2 := NewDevice(tun2.TUN(), &DeviceOptions{
+		Logger: NewLogger(LogLevelSilent, "dev2: "),
+		CreateBind: func(port uint16) (conn.Bind, uint16, error) {
+			bind, port, err := network.CreateBind(port)
+			bind2.Bind = bind
+			return bind2, port, err
+		},
+		CreateEndpoint: network.CreateEndpoint,
+	})
+	defer dev2.Close()
+	events := make(chan HandshakeEvent, 16)
+	dev2.SetHandshakeEventHandler(func(event HandshakeEvent) {
+		if event.Reason == HandshakeTransportUnreachable {
+			events <- event
+		}
+	})
+	dev2.Up()
+	if err := ipcSet(dev2, cfg2); err != nil {
+		t.Fatal(err)
+	}
+
+	ping := tuntest.Ping(net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2"))
+	tun2.Outbound <- ping
+	select {
+	case <-tun1.Inbound:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ping did not transit")
+	}
+
+	// a run of failing sends is reported once
+
+	bind2.down.Set(true)
+	for i := 0; i < TransportUnreachableErrors+2; i++ {
+		tun2.Outbound <- ping
+		time.Sleep(20 * time.Millisecond) // each in a send of its own
+	}
+	select {
+	case <-events:
+	case <-time.After(2 * time.Second):
+		t.Fatal("transport unreachable not reported")
+	}
+	select {
+	case <-events:
+		t.Error("transport unreachable reported twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+	peer := dev2.LookupPeer(dev1.staticIdentity.publicKey)
+	if timeout := peer.handshakeRetransmitTimeout(); timeout != HandshakeBackoffMax {
+		t.Errorf("handshakes retransmitted after %v, want %v", timeout, HandshakeBackoffMax)
+	}
+
+	// the first successful send ends it
+
+	bind2.down.Set(false)
+	tun2.Outbound <- ping
+	select {
+	case <-tun1.Inbound:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ping did not transit")
+	}
+	if peer.transport.unreachable.Get() {
+		t.Error("transport still unreachable")
+	}
+	if timeout := peer.handshakeRetransmitTimeout(); timeout != RekeyTimeout {
+		t.Errorf("handshakes retransmitted after %v, want %v", timeout, RekeyTimeout)
+	}
+}
@@ -0,0 +1,19 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"syscall"
+)
+
+func init() {
+	unreachableErrnos = append(unreachableErrnos,
+		syscall.Errno(10049), // WSAEADDRNOTAVAIL
+		syscall.Errno(10050), // WSAENETDOWN
+		syscall.Errno(10051), // WSAENETUNREACH
+		syscall.Errno(10065), // WSAEHOSTUNREACH
+	)
+}
@@ -0,0 +1,58 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// WorkersAuto has DeviceOptions.Workers follow the CPU quota of the
+// process's cgroup, where there is one, rather than the host's CPUs.
+const WorkersAuto = -1
+
+/* Returns the number of each of the encryption, decryption and handshake
+ * workers to start, for DeviceOptions.Workers.
+ */
+func workerCount(workers int) int {
+	cpus := runtime.NumCPU()
+	switch {
+	case workers > 0:
+		return workers
+	case workers == WorkersAuto:
+		if quota, ok := cpuQuota(); ok && quota < cpus {
+			return quota
+		}
+	}
+	return cpus
+}
+
+/* Parses the cpu.max file of cgroup v2, "$MAX $PERIOD", into the number of
+ * CPUs the quota amounts to, rounded up. Returns false if there is no quota.
+ */
+func parseCgroupCPUMax(s string) (int, bool) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 || fields[0] == "max" {
+		return 0, false
+	}
+	return quotaCPUs(fields[0], fields[1])
+}
+
+/* Returns the number of CPUs a CFS quota and period amount to, rounded up,
+ * or false if there is no quota.
+ */
+func quotaCPUs(quota, period string) (int, bool) {
+	q, err := strconv.ParseInt(strings.TrimSpace(quota), 10, 64)
+	if err != nil || q <= 0 {
+		return 0, false
+	}
+	p, err := strconv.ParseInt(strings.TrimSpace(period), 10, 64)
+	if err != nil || p <= 0 {
+		return 0, false
+	}
+	return int((q + p - 1) / p), true
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+func cpuQuota() (int, bool) {
+	return 0, false
+}
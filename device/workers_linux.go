@@ -0,0 +1,28 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"io/ioutil"
+)
+
+/* Returns the CPU quota of the cgroup the process runs in, as mounted in
+ * containers, trying cgroup v2 before v1.
+ */
+func cpuQuota() (int, bool) {
+	if max, err := ioutil.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		return parseCgroupCPUMax(string(max))
+	}
+	quota, err := ioutil.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+	if err != nil {
+		return 0, false
+	}
+	period, err := ioutil.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+	if err != nil {
+		return 0, false
+	}
+	return quotaCPUs(string(quota), string(period))
+}
@@ -0,0 +1,59 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestCgroupCPUQuota(t *testing.T) {
+	for _, tc := range []struct {
+		max  string
+		cpus int
+		ok   bool
+	}{
+		{"max 100000\n", 0, false},
+		{"100000 100000\n", 1, true},
+		{"150000 100000\n", 2, true},
+		{"50000 100000", 1, true},
+		{"400000 100000\n", 4, true},
+		{"", 0, false},
+		{"x 100000", 0, false},
+		{"100000 0", 0, false},
+	} {
+		if cpus, ok := parseCgroupCPUMax(tc.max); cpus != tc.cpus || ok != tc.ok {
+			t.Errorf("parseCgroupCPUMax(%q) = %d, %v, want %d, %v", tc.max, cpus, ok, tc.cpus, tc.ok)
+		}
+	}
+
+	// cgroup v1 marks the absence of a quota with -1
+
+	if _, ok := quotaCPUs("-1\n", "100000\n"); ok {
+		t.Error("quota of -1 taken")
+	}
+	if cpus, ok := quotaCPUs("250000\n", "100000\n"); !ok || cpus != 3 {
+		t.Errorf("quotaCPUs = %d, %v, want 3", cpus, ok)
+	}
+}
+
+func TestWorkerCount(t *testing.T) {
+	if n := workerCount(0); n != runtime.NumCPU() {
+		t.Errorf("default workers = %d, want %d", n, runtime.NumCPU())
+	}
+	if n := workerCount(3); n != 3 {
+		t.Errorf("explicit workers = %d, want 3", n)
+	}
+	if n := workerCount(WorkersAuto); n < 1 || n > runtime.NumCPU() {
+		t.Errorf("auto workers = %d, want within [1, %d]", n, runtime.NumCPU())
+	}
+
+	device := NewDevice(newNilTun(), &DeviceOptions{
+		Logger:  NewLogger(LogLevelError, "dev: "),
+		Workers: 1,
+	})
+	device.Close()
+}
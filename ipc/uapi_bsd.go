@@ -201,3 +201,15 @@ func UAPIOpen(name string) (*os.File, error) {
 
 	return listener.File()
 }
+
+var errAbstractUnsupported = errors.New("abstract unix sockets are only supported on Linux")
+
+// UAPIOpenAbstract is only supported on Linux.
+func UAPIOpenAbstract(name string) (*os.File, error) {
+	return nil, errAbstractUnsupported
+}
+
+// UAPIListenAbstract is only supported on Linux.
+func UAPIListenAbstract(file *os.File) (net.Listener, error) {
+	return nil, errAbstractUnsupported
+}
@@ -198,3 +198,77 @@ func UAPIOpen(name string) (*os.File, error) {
 
 	return listener.File()
 }
+
+/* The UAPI may be served on an abstract unix socket instead, which lives
+ * in the network namespace rather than on the filesystem, so that it is
+ * reached from containers sharing the namespace without sharing a
+ * directory. Abstract sockets have no permissions of their own, so
+ * connections are only accepted from processes of the same user, or of
+ * root, as told by their credentials.
+ */
+
+type abstractListener struct {
+	*net.UnixListener
+}
+
+// UAPIOpenAbstract listens for the UAPI on the abstract unix socket
+// "@wireguard/<name>.sock", returning the socket as a file for
+// UAPIListenAbstract, possibly in another process.
+func UAPIOpenAbstract(name string) (*os.File, error) {
+	addr := &net.UnixAddr{
+		Name: "@wireguard/" + fmt.Sprintf(socketName, name),
+		Net:  "unix",
+	}
+	listener, err := net.ListenUnix("unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+	return listener.File()
+}
+
+// UAPIListenAbstract serves the UAPI on the abstract unix socket of file,
+// as opened by UAPIOpenAbstract, to processes of the same user or root.
+func UAPIListenAbstract(file *os.File) (net.Listener, error) {
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, err
+	}
+	unixListener, ok := listener.(*net.UnixListener)
+	if !ok {
+		listener.Close()
+		return nil, errors.New("UAPI socket is not a unix socket")
+	}
+	return abstractListener{unixListener}, nil
+}
+
+func (l abstractListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return nil, err
+		}
+		if peerPermitted(conn) {
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
+
+/* Reports whether the process at the other end of conn runs as root or
+ * as the user of this one.
+ */
+func peerPermitted(conn *net.UnixConn) bool {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var cred *unix.Ucred
+	raw.Control(func(fd uintptr) {
+		cred, err = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil || cred == nil {
+		return false
+	}
+	return cred.Uid == 0 || int(cred.Uid) == os.Geteuid()
+}
@@ -0,0 +1,38 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package ipc
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestUAPIListenAbstract(t *testing.T) {
+	name := fmt.Sprintf("wgtest%d", os.Getpid())
+	file, err := UAPIOpenAbstract(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	listener, err := UAPIListenAbstract(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	conn, err := net.Dial("unix", "@wireguard/"+name+".sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.Close()
+}
@@ -0,0 +1,166 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package ipc
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	UAPITCPHandshakeTimeout = 10 * time.Second // for the TLS handshake of a client to complete
+	UAPITCPMaxConns         = 16               // clients served at once, the others wait to be accepted
+)
+
+/* The UAPI may be served over TCP for managing a device from another
+ * host, but only with mutual TLS: the configuration gets and sets private
+ * keys, so clients must present a certificate issued by one of the CAs
+ * given, and the listener refuses to start without them.
+ *
+ * The TLS handshake of a client is completed before Accept returns its
+ * connection, within UAPITCPHandshakeTimeout, so that clients which fail
+ * or stall it are never served. At most UAPITCPMaxConns connections are
+ * open or being handshaken at once; no more are accepted from the socket
+ * until one is closed.
+ */
+
+// UAPIOpenTCP listens on the TCP address addr for the UAPI, returning the
+// socket as a file for UAPIListenTCP, possibly in another process.
+func UAPIOpenTCP(addr string) (*os.File, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+	return listener.(*net.TCPListener).File()
+}
+
+// UAPIListenTCP serves the UAPI on the TCP socket of file, as opened by
+// UAPIOpenTCP, over mutual TLS. The config must hold the certificate of
+// the server and the CAs of its clients, ClientCAs; clients are then
+// required to present a certificate verified against them.
+func UAPIListenTCP(file *os.File, config *tls.Config) (net.Listener, error) {
+	if config == nil || (len(config.Certificates) == 0 && config.GetCertificate == nil) {
+		return nil, errors.New("UAPI over TCP requires a server certificate")
+	}
+	if config.ClientCAs == nil {
+		return nil, errors.New("UAPI over TCP requires client CAs, for mutual TLS")
+	}
+	config = config.Clone()
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	if config.MinVersion < tls.VersionTLS12 {
+		config.MinVersion = tls.VersionTLS12
+	}
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := listener.(*net.TCPListener); !ok {
+		listener.Close()
+		return nil, errors.New("UAPI socket is not a TCP socket")
+	}
+	l := &tcpListener{
+		listener: listener,
+		config:   config,
+		slots:    make(chan struct{}, UAPITCPMaxConns),
+		connNew:  make(chan net.Conn),
+		connErr:  make(chan error, 1),
+		closed:   make(chan struct{}),
+	}
+	go l.accept()
+	return l, nil
+}
+
+type tcpListener struct {
+	listener  net.Listener // TCP socket listener
+	config    *tls.Config
+	slots     chan struct{} // one for each connection open or being handshaken
+	connNew   chan net.Conn
+	connErr   chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+/* Accepts connections while there are slots for them, handshaking each
+ * concurrently, so that a stalled client holds up no other.
+ */
+func (l *tcpListener) accept() {
+	for {
+		select {
+		case l.slots <- struct{}{}:
+		case <-l.closed:
+			return
+		}
+		conn, err := l.listener.Accept()
+		if err != nil {
+			<-l.slots
+			l.connErr <- err
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *tcpListener) handshake(conn net.Conn) {
+	tlsConn := tls.Server(conn, l.config)
+	tlsConn.SetDeadline(time.Now().Add(UAPITCPHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		tlsConn.Close()
+		<-l.slots
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+	select {
+	case l.connNew <- &tcpConn{Conn: tlsConn, slots: l.slots}:
+	case <-l.closed:
+		tlsConn.Close()
+		<-l.slots
+	}
+}
+
+func (l *tcpListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connNew:
+		return conn, nil
+	case err := <-l.connErr:
+		return nil, err
+	case <-l.closed:
+		return nil, errors.New("UAPI listener closed")
+	}
+}
+
+func (l *tcpListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return l.listener.Close()
+}
+
+func (l *tcpListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+/* A connection accepted by tcpListener, which gives back its slot once
+ * closed.
+ */
+type tcpConn struct {
+	*tls.Conn
+	slots     chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *tcpConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		<-c.slots
+	})
+	return err
+}
@@ -0,0 +1,117 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package ipc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+/* Issues a certificate for name, by parent, or self-signed if nil.
+ */
+func issue(t *testing.T, name string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestUAPIListenTCP(t *testing.T) {
+	ca := issue(t, "ca", nil)
+	server, client, stranger := issue(t, "server", &ca), issue(t, "client", &ca), issue(t, "stranger", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	file, err := UAPIOpenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := UAPIListenTCP(file, &tls.Config{Certificates: []tls.Certificate{server}}); err == nil {
+		t.Fatal("listening without client CAs")
+	}
+	listener, err := UAPIListenTCP(file, &tls.Config{Certificates: []tls.Certificate{server}, ClientCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.Write([]byte("errno=0\n\n"))
+				conn.Close()
+			}()
+		}
+	}()
+
+	dial := func(certificates []tls.Certificate) (string, error) {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: pool, Certificates: certificates})
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		b, err := ioutil.ReadAll(conn)
+		return string(b), err
+	}
+
+	// a client stalling its handshake holds up no other
+
+	stalled, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+
+	if reply, err := dial([]tls.Certificate{client}); err != nil || reply != "errno=0\n\n" {
+		t.Errorf("client with a certificate of the CA: %q, %v", reply, err)
+	}
+	for name, certificates := range map[string][]tls.Certificate{
+		"without a certificate":          nil,
+		"with a certificate of other CA": {stranger},
+	} {
+		if reply, err := dial(certificates); err == nil {
+			t.Errorf("client %s served %q", name, reply)
+		}
+	}
+}
@@ -8,11 +8,17 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/signal"
 	"runtime"
 	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/tailscale/wireguard-go/device"
@@ -29,6 +35,10 @@ const (
 	ENV_WG_TUN_FD             = "WG_TUN_FD"
 	ENV_WG_UAPI_FD            = "WG_UAPI_FD"
 	ENV_WG_PROCESS_FOREGROUND = "WG_PROCESS_FOREGROUND"
+	ENV_WG_UAPI_LISTEN        = "WG_UAPI_LISTEN"        // "abstract" or "tcp:<address>", instead of the unix socket
+	ENV_WG_UAPI_TLS_CERT      = "WG_UAPI_TLS_CERT"      // PEM certificate of the UAPI over TCP
+	ENV_WG_UAPI_TLS_KEY       = "WG_UAPI_TLS_KEY"       // PEM key of the certificate
+	ENV_WG_UAPI_TLS_CLIENT_CA = "WG_UAPI_TLS_CLIENT_CA" // PEM CAs client certificates must be issued by
 )
 
 func printUsage() {
@@ -36,6 +46,28 @@ func printUsage() {
 	fmt.Printf("%s [-f/--foreground] INTERFACE-NAME\n", os.Args[0])
 }
 
+/* Loads the mutual TLS configuration of the UAPI over TCP from the files
+ * named by the environment.
+ */
+func uapiTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(os.Getenv(ENV_WG_UAPI_TLS_CERT), os.Getenv(ENV_WG_UAPI_TLS_KEY))
+	if err != nil {
+		return nil, err
+	}
+	pem, err := ioutil.ReadFile(os.Getenv(ENV_WG_UAPI_TLS_CLIENT_CA))
+	if err != nil {
+		return nil, err
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no client CA certificates in " + os.Getenv(ENV_WG_UAPI_TLS_CLIENT_CA))
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+	}, nil
+}
+
 func warning() {
 	if runtime.GOOS != "linux" || os.Getenv(ENV_WG_PROCESS_FOREGROUND) == "1" {
 		return
@@ -145,12 +177,28 @@ func main() {
 		fmt.Sprintf("(%s) ", interfaceName),
 	)
 
-	logger.Info.Println("Starting wireguard-go version", device.WireGuardGoVersion)
+	logger.Verbosef("Starting wireguard-go version %s", device.WireGuardGoVersion)
 
-	logger.Debug.Println("Debug log enabled")
+	logger.Verbosef("Debug log enabled")
 
 	if err != nil {
-		logger.Error.Println("Failed to create TUN device:", err)
+		logger.Errorf("Failed to create TUN device: %v", err)
+		os.Exit(ExitSetupFailed)
+	}
+
+	// serve the UAPI on an abstract socket or over TCP, rather than on the
+	// unix socket, if asked to; TCP takes mutual TLS
+
+	uapiListen := os.Getenv(ENV_WG_UAPI_LISTEN)
+	var uapiTLS *tls.Config
+	if strings.HasPrefix(uapiListen, "tcp:") {
+		uapiTLS, err = uapiTLSConfig()
+		if err != nil {
+			logger.Errorf("UAPI TLS configuration error: %v", err)
+			os.Exit(ExitSetupFailed)
+		}
+	} else if uapiListen != "" && uapiListen != "abstract" {
+		logger.Errorf("Invalid %s: %s", ENV_WG_UAPI_LISTEN, uapiListen)
 		os.Exit(ExitSetupFailed)
 	}
 
@@ -159,6 +207,12 @@ func main() {
 	fileUAPI, err := func() (*os.File, error) {
 		uapiFdStr := os.Getenv(ENV_WG_UAPI_FD)
 		if uapiFdStr == "" {
+			switch {
+			case uapiListen == "abstract":
+				return ipc.UAPIOpenAbstract(interfaceName)
+			case uapiTLS != nil:
+				return ipc.UAPIOpenTCP(strings.TrimPrefix(uapiListen, "tcp:"))
+			}
 			return ipc.UAPIOpen(interfaceName)
 		}
 
@@ -173,7 +227,7 @@ func main() {
 	}()
 
 	if err != nil {
-		logger.Error.Println("UAPI listen error:", err)
+		logger.Errorf("UAPI listen error: %v", err)
 		os.Exit(ExitSetupFailed)
 		return
 	}
@@ -208,7 +262,7 @@ func main() {
 
 		path, err := os.Executable()
 		if err != nil {
-			logger.Error.Println("Failed to determine executable:", err)
+			logger.Errorf("Failed to determine executable: %v", err)
 			os.Exit(ExitSetupFailed)
 		}
 
@@ -218,7 +272,7 @@ func main() {
 			attr,
 		)
 		if err != nil {
-			logger.Error.Println("Failed to daemonize:", err)
+			logger.Errorf("Failed to daemonize: %v", err)
 			os.Exit(ExitSetupFailed)
 		}
 		process.Release()
@@ -229,14 +283,22 @@ func main() {
 		Logger: logger,
 	})
 
-	logger.Info.Println("Device started")
+	logger.Verbosef("Device started")
 
 	errs := make(chan error)
 	term := make(chan os.Signal, 1)
 
-	uapi, err := ipc.UAPIListen(interfaceName, fileUAPI)
+	var uapi net.Listener
+	switch {
+	case uapiListen == "abstract":
+		uapi, err = ipc.UAPIListenAbstract(fileUAPI)
+	case uapiTLS != nil:
+		uapi, err = ipc.UAPIListenTCP(fileUAPI, uapiTLS)
+	default:
+		uapi, err = ipc.UAPIListen(interfaceName, fileUAPI)
+	}
 	if err != nil {
-		logger.Error.Println("Failed to listen on uapi socket:", err)
+		logger.Errorf("Failed to listen on uapi socket: %v", err)
 		os.Exit(ExitSetupFailed)
 	}
 
@@ -251,7 +313,7 @@ func main() {
 		}
 	}()
 
-	logger.Info.Println("UAPI listener started")
+	logger.Verbosef("UAPI listener started")
 
 	// wait for program to terminate
 
@@ -269,5 +331,5 @@ func main() {
 	uapi.Close()
 	device.Close()
 
-	logger.Info.Println("Shutting down")
+	logger.Verbosef("Shutting down")
 }
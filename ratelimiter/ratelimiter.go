@@ -5,9 +5,15 @@
 
 // Package ratelimiter implements an IP-based token bucket rate
 // limiter with hardcoded rates.
+//
+// Sources are bucketed by address prefix, by default one bucket per
+// address. The number of buckets is bounded: once the table is full,
+// new sources share a single overflow bucket until old buckets are
+// garbage collected.
 package ratelimiter
 
 import (
+	"fmt"
 	"net"
 	"sync"
 	"time"
@@ -19,6 +25,7 @@ const (
 	garbageCollectTime = time.Second
 	packetCost         = int64(time.Second) / packetsPerSecond
 	maxTokens          = packetCost * packetsBurstable
+	maxBuckets         = 1 << 16 // per address family
 )
 
 var timeNow = time.Now
@@ -33,17 +40,21 @@ type bucket struct {
 	tokens   int64     // remaining tokens as of lastTime.
 }
 
-// Ratelimiter is a per-IP token bucket rate limiter with hardcoded
+// Ratelimiter is a per-IP or per-prefix token bucket rate limiter with hardcoded
 // settings.
 type Ratelimiter struct {
 	ticker *time.Ticker
 	once   sync.Once // gates lazy initialization
 
+	overflow bucket // shared by new sources while the table is full
+
 	sync.RWMutex
-	closed bool
+	closed  bool
+	prefix4 int // leading bits of IPv4 sources sharing a bucket
+	prefix6 int // leading bits of IPv6 sources sharing a bucket
 	// Send a struct{}{} to signal to the GC goroutine to start
 	// collecting old token buckets. Close the channel to shut down
-	// the goroutine.
+	// the goroutine. It holds one pending signal, see startGC.
 	stopReset chan struct{}
 	tableIPv4 map[[net.IPv4len]byte]*bucket
 	tableIPv6 map[[net.IPv6len]byte]*bucket
@@ -69,9 +80,13 @@ func (rate *Ratelimiter) init() {
 	rate.Lock()
 	defer rate.Unlock()
 
-	rate.stopReset = make(chan struct{})
+	rate.stopReset = make(chan struct{}, 1)
 	rate.tableIPv4 = make(map[[net.IPv4len]byte]*bucket)
 	rate.tableIPv6 = make(map[[net.IPv6len]byte]*bucket)
+	rate.prefix4 = 8 * net.IPv4len
+	rate.prefix6 = 8 * net.IPv6len
+	rate.overflow.tokens = maxTokens
+	rate.overflow.lastTime = timeNow()
 
 	// start garbage collection routine
 	rate.ticker = time.NewTicker(time.Second)
@@ -83,11 +98,14 @@ func (rate *Ratelimiter) init() {
 		for {
 			select {
 			case _, ok := <-rate.stopReset:
+				rate.Lock()
 				rate.ticker.Stop()
 				if !ok {
+					rate.Unlock()
 					return
 				}
 				rate.ticker = time.NewTicker(time.Second)
+				rate.Unlock()
 			case <-rate.ticker.C:
 				rate.cleanup()
 			}
@@ -95,6 +113,44 @@ func (rate *Ratelimiter) init() {
 	}()
 }
 
+// maskPrefix clears all but the leading bits of an address in place.
+func maskPrefix(addr []byte, bits int) {
+	for i := range addr {
+		switch {
+		case bits >= 8:
+			bits -= 8
+		case bits > 0:
+			addr[i] &^= 0xff >> uint(bits)
+			bits = 0
+		default:
+			addr[i] = 0
+		}
+	}
+}
+
+// newBucket returns a bucket for a new source, with the cost of its
+// first packet already deducted.
+func newBucket() *bucket {
+	return &bucket{
+		tokens:   maxTokens - packetCost,
+		lastTime: timeNow(),
+	}
+}
+
+// startGC signals the GC goroutine to start collecting old token
+// buckets. It never blocks, as it is called with rate locked, which
+// the GC goroutine may be waiting for; a signal already pending will
+// do.
+func (rate *Ratelimiter) startGC() {
+	if rate.closed {
+		return
+	}
+	select {
+	case rate.stopReset <- struct{}{}:
+	default:
+	}
+}
+
 // cleanup deletes token buckets that have not been accessed for at
 // least garbageCollectTime.
 func (rate *Ratelimiter) cleanup() {
@@ -124,6 +180,48 @@ func (rate *Ratelimiter) cleanup() {
 	}
 }
 
+// SetPrefixLengths sets how many leading bits of a source address
+// select its token bucket, so that all sources within a prefix share
+// one bucket. The defaults, 32 and 128, give each address its own bucket.
+func (rate *Ratelimiter) SetPrefixLengths(ipv4, ipv6 int) error {
+	if ipv4 < 0 || ipv4 > 8*net.IPv4len {
+		return fmt.Errorf("invalid IPv4 prefix length %d", ipv4)
+	}
+	if ipv6 < 0 || ipv6 > 8*net.IPv6len {
+		return fmt.Errorf("invalid IPv6 prefix length %d", ipv6)
+	}
+
+	rate.once.Do(rate.init)
+
+	rate.Lock()
+	defer rate.Unlock()
+
+	if rate.prefix4 != ipv4 {
+		rate.prefix4 = ipv4
+		rate.tableIPv4 = make(map[[net.IPv4len]byte]*bucket)
+	}
+	if rate.prefix6 != ipv6 {
+		rate.prefix6 = ipv6
+		rate.tableIPv6 = make(map[[net.IPv6len]byte]*bucket)
+	}
+
+	// As in cleanup, nothing is left to collect once both tables are
+	// empty. The next token bucket created restarts the ticker.
+	if len(rate.tableIPv4) == 0 && len(rate.tableIPv6) == 0 {
+		rate.ticker.Stop()
+	}
+	return nil
+}
+
+// PrefixLengths returns the prefix lengths set by SetPrefixLengths.
+func (rate *Ratelimiter) PrefixLengths() (ipv4, ipv6 int) {
+	rate.once.Do(rate.init)
+
+	rate.RLock()
+	defer rate.RUnlock()
+	return rate.prefix4, rate.prefix6
+}
+
 func (rate *Ratelimiter) Allow(ip net.IP) bool {
 	rate.once.Do(rate.init)
 
@@ -141,36 +239,50 @@ func (rate *Ratelimiter) Allow(ip net.IP) bool {
 	rate.RLock()
 	if IPv4 != nil {
 		copy(keyIPv4[:], IPv4)
+		maskPrefix(keyIPv4[:], rate.prefix4)
 		entry = rate.tableIPv4[keyIPv4]
 	} else {
 		copy(keyIPv6[:], IPv6)
+		maskPrefix(keyIPv6[:], rate.prefix6)
 		entry = rate.tableIPv6[keyIPv6]
 	}
 	rate.RUnlock()
 
 	if entry == nil {
-		// Need a new bucket, with the current packet's cost already
-		// deducted.
-		entry = &bucket{
-			tokens:   maxTokens - packetCost,
-			lastTime: timeNow(),
-		}
 		rate.Lock()
 		if IPv4 != nil {
-			rate.tableIPv4[keyIPv4] = entry
-			// First bucket, start GCing
-			if len(rate.tableIPv4) == 1 && len(rate.tableIPv6) == 0 {
-				rate.stopReset <- struct{}{}
+			entry = rate.tableIPv4[keyIPv4]
+			if entry == nil && len(rate.tableIPv4) < maxBuckets {
+				entry = newBucket()
+				rate.tableIPv4[keyIPv4] = entry
+				// First bucket, start GCing
+				if len(rate.tableIPv4) == 1 && len(rate.tableIPv6) == 0 {
+					rate.startGC()
+				}
+				rate.Unlock()
+				return true
 			}
 		} else {
-			rate.tableIPv6[keyIPv6] = entry
-			// First bucket, start GCing
-			if len(rate.tableIPv6) == 1 && len(rate.tableIPv4) == 0 {
-				rate.stopReset <- struct{}{}
+			entry = rate.tableIPv6[keyIPv6]
+			if entry == nil && len(rate.tableIPv6) < maxBuckets {
+				entry = newBucket()
+				rate.tableIPv6[keyIPv6] = entry
+				// First bucket, start GCing
+				if len(rate.tableIPv6) == 1 && len(rate.tableIPv4) == 0 {
+					rate.startGC()
+				}
+				rate.Unlock()
+				return true
 			}
 		}
 		rate.Unlock()
-		return true
+
+		// The table is full, which is likely a flood from spoofed
+		// sources. Rather than growing without bound, rate limit
+		// all new sources together.
+		if entry == nil {
+			entry = &rate.overflow
+		}
 	}
 
 	entry.Lock()
@@ -107,3 +107,121 @@ func TestRatelimiter(t *testing.T) {
 		}
 	}
 }
+
+func freezeTime() func() {
+	now := time.Now()
+	timeNow = func() time.Time {
+		return now
+	}
+	return func() {
+		timeNow = time.Now
+	}
+}
+
+func TestRatelimiterPrefix(t *testing.T) {
+	defer freezeTime()()
+
+	var ratelimiter Ratelimiter
+	defer ratelimiter.Close()
+	if err := ratelimiter.SetPrefixLengths(24, 64); err != nil {
+		t.Fatal(err)
+	}
+	if v4, v6 := ratelimiter.PrefixLengths(); v4 != 24 || v6 != 64 {
+		t.Fatalf("PrefixLengths() = %d, %d", v4, v6)
+	}
+
+	for _, tc := range []struct {
+		noisy []string // sources within one prefix
+		other string   // source in another prefix
+	}{
+		{
+			noisy: []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4", "192.0.2.5", "192.0.2.200"},
+			other: "198.51.100.1",
+		},
+		{
+			noisy: []string{"2001:db8::1", "2001:db8::2", "2001:db8::3", "2001:db8::4", "2001:db8::5", "2001:db8::ffff:1"},
+			other: "2001:db8:0:1::1",
+		},
+	} {
+		for i, src := range tc.noisy {
+			want := i < packetsBurstable
+			if got := ratelimiter.Allow(net.ParseIP(src)); got != want {
+				t.Errorf("%s: got %v, want %v", src, got, want)
+			}
+		}
+		if !ratelimiter.Allow(net.ParseIP(tc.other)) {
+			t.Errorf("%s: throttled by a different prefix", tc.other)
+		}
+	}
+
+	for _, bad := range [][2]int{{-1, 64}, {33, 64}, {24, 129}} {
+		if err := ratelimiter.SetPrefixLengths(bad[0], bad[1]); err == nil {
+			t.Errorf("SetPrefixLengths(%d, %d) succeeded", bad[0], bad[1])
+		}
+	}
+}
+
+func TestRatelimiterBounded(t *testing.T) {
+	defer freezeTime()()
+
+	var ratelimiter Ratelimiter
+	defer ratelimiter.Close()
+
+	// a flood from distinct sources fills the table
+
+	ip := make(net.IP, net.IPv4len)
+	for i := 0; i < maxBuckets; i++ {
+		ip[0], ip[1], ip[2], ip[3] = 10, byte(i>>16), byte(i>>8), byte(i)
+		if !ratelimiter.Allow(ip) {
+			t.Fatalf("%v: first packet refused", ip)
+		}
+	}
+
+	// further sources share the overflow bucket
+
+	for i := 0; i < 2*packetsBurstable; i++ {
+		ip[0], ip[1], ip[2], ip[3] = 172, 16, 0, byte(i)
+		want := i < packetsBurstable
+		if got := ratelimiter.Allow(ip); got != want {
+			t.Errorf("%v: got %v, want %v", ip, got, want)
+		}
+	}
+
+	ratelimiter.RLock()
+	size := len(ratelimiter.tableIPv4)
+	ratelimiter.RUnlock()
+	if size != maxBuckets {
+		t.Errorf("table holds %d buckets, want %d", size, maxBuckets)
+	}
+}
+
+func TestRatelimiterStartWhileCollecting(t *testing.T) {
+	var ratelimiter Ratelimiter
+	defer ratelimiter.Close()
+
+	// The first bucket starts the GC ticker.
+
+	if !ratelimiter.Allow(net.ParseIP("192.0.2.1")) {
+		t.Fatal("first packet refused")
+	}
+
+	// Holding the lock past a tick leaves the GC goroutine waiting for
+	// it in cleanup. Starting collection then must not wait for the
+	// GC goroutine in turn.
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ratelimiter.Lock()
+		defer ratelimiter.Unlock()
+		time.Sleep(garbageCollectTime * 3 / 2)
+		ratelimiter.startGC()
+		ratelimiter.startGC()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("deadlocked with the GC goroutine")
+	}
+}
@@ -27,6 +27,7 @@ const (
 
 const (
 	BacktrackWords = CounterBitsTotal / _WordSize
+	CounterBitsMax = 1 << 16 // largest backtrack accepted by InitWindow
 )
 
 func minUint64(a uint64, b uint64) uint64 {
@@ -38,40 +39,123 @@ func minUint64(a uint64, b uint64) uint64 {
 
 type ReplayFilter struct {
 	counter   uint64
-	backtrack [BacktrackWords]uintptr
+	window    uint64
+	missing   uint64 // counters skipped over and not validated since
+	backtrack []uintptr
 }
 
+// WindowBits rounds a requested backtrack size in bits up to the size
+// InitWindow allocates: a power of two no smaller than CounterBitsTotal.
+// It returns zero if the request exceeds CounterBitsMax.
+func WindowBits(bits uint64) uint64 {
+	if bits > CounterBitsMax {
+		return 0
+	}
+	n := uint64(CounterBitsTotal)
+	for n < bits {
+		n <<= 1
+	}
+	return n
+}
+
+// Init resets the filter with the default backtrack of CounterBitsTotal,
+// accepting counters up to CounterWindowSize behind the highest seen.
 func (filter *ReplayFilter) Init() {
+	filter.InitWindow(CounterBitsTotal)
+}
+
+// InitWindow resets the filter with a backtrack of the given size in bits,
+// rounded by WindowBits. Larger windows tolerate more reordering, at the
+// cost of one bit of memory per counter.
+func (filter *ReplayFilter) InitWindow(bits uint64) {
+	bits = WindowBits(bits)
+	if bits == 0 {
+		bits = CounterBitsMax
+	}
+	words := bits / _WordSize
+	if uint64(len(filter.backtrack)) == words {
+		for i := range filter.backtrack {
+			filter.backtrack[i] = 0
+		}
+	} else {
+		filter.backtrack = make([]uintptr, words)
+	}
 	filter.counter = 0
-	filter.backtrack[0] = 0
+	filter.missing = 0
+	filter.window = bits - CounterRedundantBits
+}
+
+// WindowSize returns how far behind the highest counter seen a counter may
+// be and still be accepted.
+func (filter *ReplayFilter) WindowSize() uint64 {
+	if filter.backtrack == nil {
+		return CounterWindowSize
+	}
+	return filter.window
 }
 
+// Missing returns the number of counters skipped over by those validated
+// so far, less those validated late. Senders increment their counter with
+// every message, so it estimates the messages lost on the way; messages
+// reordered are counted as missing until they arrive.
+func (filter *ReplayFilter) Missing() uint64 {
+	return filter.missing
+}
+
+/* Counts a counter behind the highest validated as no longer missing.
+ */
+func (filter *ReplayFilter) found() {
+	if filter.missing > 0 {
+		filter.missing--
+	}
+}
+
+// ValidateCounterBehind is ValidateCounter for links reordering packets
+// further than any window: counters behind the window are accepted, as
+// they can no longer be told apart from replays. Counters inside the
+// window are still accepted only once.
+func (filter *ReplayFilter) ValidateCounterBehind(counter uint64, limit uint64) bool {
+	if counter < limit && counter <= filter.counter && filter.counter-counter > filter.window {
+		filter.found()
+		return true
+	}
+	return filter.ValidateCounter(counter, limit)
+}
+
+// ValidateCounter reports whether counter, below limit, has not been seen
+// and is within the window, marking it seen. The zero value of the filter
+// validates with the default backtrack, as after Init.
 func (filter *ReplayFilter) ValidateCounter(counter uint64, limit uint64) bool {
 	if counter >= limit {
 		return false
 	}
+	if filter.backtrack == nil {
+		filter.Init()
+	}
 
 	indexWord := counter >> CounterRedundantBitsLog
+	words := uint64(len(filter.backtrack))
 
 	if counter > filter.counter {
 
 		// move window forward
 
 		current := filter.counter >> CounterRedundantBitsLog
-		diff := minUint64(indexWord-current, BacktrackWords)
+		diff := minUint64(indexWord-current, words)
 		for i := uint64(1); i <= diff; i++ {
-			filter.backtrack[(current+i)%BacktrackWords] = 0
+			filter.backtrack[(current+i)%words] = 0
 		}
+		filter.missing += counter - filter.counter - 1
 		filter.counter = counter
 
-	} else if filter.counter-counter > CounterWindowSize {
+	} else if filter.counter-counter > filter.window {
 
 		// behind current window
 
 		return false
 	}
 
-	indexWord %= BacktrackWords
+	indexWord %= words
 	indexBit := counter & uint64(CounterRedundantBits-1)
 
 	// check and set bit
@@ -79,5 +163,11 @@ func (filter *ReplayFilter) ValidateCounter(counter uint64, limit uint64) bool {
 	oldValue := filter.backtrack[indexWord]
 	newValue := oldValue | (1 << indexBit)
 	filter.backtrack[indexWord] = newValue
-	return oldValue != newValue
+	if oldValue == newValue {
+		return false
+	}
+	if counter < filter.counter {
+		filter.found()
+	}
+	return true
 }
@@ -117,3 +117,128 @@ func TestReplay(t *testing.T) {
 	T(0, true)
 	T(CounterWindowSize+1, true)
 }
+
+func TestReplayWindowSize(t *testing.T) {
+	for _, tc := range []struct {
+		bits, want uint64
+	}{
+		{0, CounterBitsTotal},
+		{1, CounterBitsTotal},
+		{CounterBitsTotal, CounterBitsTotal},
+		{CounterBitsTotal + 1, 2 * CounterBitsTotal},
+		{5000, 8192},
+		{CounterBitsMax, CounterBitsMax},
+		{CounterBitsMax + 1, 0},
+	} {
+		if got := WindowBits(tc.bits); got != tc.want {
+			t.Errorf("WindowBits(%d) = %d, want %d", tc.bits, got, tc.want)
+		}
+	}
+
+	var filter ReplayFilter
+	for _, bits := range []uint64{CounterBitsTotal, 8192, CounterBitsMax} {
+		filter.InitWindow(bits)
+		window := filter.WindowSize()
+		if window != bits-CounterRedundantBits {
+			t.Fatalf("window for %d bits = %d", bits, window)
+		}
+
+		// reordered counters right at the edge of the window
+
+		top := 3 * bits
+		if !filter.ValidateCounter(top, RejectAfterMessages) {
+			t.Fatalf("%d bits: top counter rejected", bits)
+		}
+		if filter.ValidateCounter(top-window-1, RejectAfterMessages) {
+			t.Errorf("%d bits: counter just behind window accepted", bits)
+		}
+		if !filter.ValidateCounter(top-window, RejectAfterMessages) {
+			t.Errorf("%d bits: counter at window edge rejected", bits)
+		}
+		if filter.ValidateCounter(top-window, RejectAfterMessages) {
+			t.Errorf("%d bits: replayed counter at window edge accepted", bits)
+		}
+		for i := top - 1; i > top-window; i-- {
+			if !filter.ValidateCounter(i, RejectAfterMessages) {
+				t.Fatalf("%d bits: counter %d inside window rejected", bits, i)
+			}
+		}
+	}
+
+	// a counter beyond the default window is only taken by the larger one
+
+	late := 2 * CounterWindowSize
+	filter.Init()
+	filter.ValidateCounter(late+1, RejectAfterMessages)
+	if filter.ValidateCounter(0, RejectAfterMessages) {
+		t.Error("default window accepted a counter behind it")
+	}
+	filter.InitWindow(8192)
+	filter.ValidateCounter(late+1, RejectAfterMessages)
+	if !filter.ValidateCounter(0, RejectAfterMessages) {
+		t.Error("larger window rejected a counter inside it")
+	}
+}
+
+func TestReplayBehind(t *testing.T) {
+	var filter ReplayFilter
+	filter.Init()
+
+	top := 4 * CounterWindowSize
+	if !filter.ValidateCounterBehind(top, RejectAfterMessages) {
+		t.Fatal("top counter rejected")
+	}
+	for i := 0; i < 2; i++ {
+		if !filter.ValidateCounterBehind(0, RejectAfterMessages) {
+			t.Error("counter behind window rejected")
+		}
+	}
+	if !filter.ValidateCounterBehind(top-1, RejectAfterMessages) {
+		t.Error("counter inside window rejected")
+	}
+	if filter.ValidateCounterBehind(top-1, RejectAfterMessages) {
+		t.Error("replayed counter inside window accepted")
+	}
+	if filter.ValidateCounterBehind(RejectAfterMessages, RejectAfterMessages) {
+		t.Error("counter at limit accepted")
+	}
+}
+
+func TestReplayMissing(t *testing.T) {
+	var filter ReplayFilter
+	filter.Init()
+
+	validate := func(counter uint64, missing uint64) {
+		t.Helper()
+		filter.ValidateCounter(counter, RejectAfterMessages)
+		if filter.Missing() != missing {
+			t.Errorf("after %d, %d missing, want %d", counter, filter.Missing(), missing)
+		}
+	}
+	validate(0, 0)
+	validate(1, 0)
+	validate(5, 3)
+	validate(3, 2) // late
+	validate(3, 2) // replayed
+	validate(6, 2)
+	validate(6+CounterWindowSize*2, 2+CounterWindowSize*2-1)
+	validate(6, 2+CounterWindowSize*2-1) // behind the window, dropped
+
+	filter.Init()
+	if filter.Missing() != 0 {
+		t.Errorf("%d missing after Init", filter.Missing())
+	}
+}
+
+func TestReplayZeroValue(t *testing.T) {
+	var filter ReplayFilter
+	if filter.WindowSize() != CounterWindowSize {
+		t.Errorf("zero value window is %d, want %d", filter.WindowSize(), CounterWindowSize)
+	}
+	if !filter.ValidateCounter(0, RejectAfterMessages) || filter.ValidateCounter(0, RejectAfterMessages) {
+		t.Error("zero value did not accept a counter exactly once")
+	}
+	if !filter.ValidateCounter(CounterWindowSize+1, RejectAfterMessages) || filter.ValidateCounter(0, RejectAfterMessages) {
+		t.Error("zero value does not have the default window")
+	}
+}
@@ -0,0 +1,60 @@
+// +build !linux
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package tun
+
+import (
+	"sync/atomic"
+)
+
+/* Counts packets in the read and write wrappers, for platforms
+ * where the kernel interface counters are not readily accessible.
+ */
+
+type statsCounter struct {
+	rxPackets uint64
+	txPackets uint64
+	rxBytes   uint64
+	txBytes   uint64
+	rxErrors  uint64
+	txErrors  uint64
+	rxDropped uint64
+}
+
+func (stats *statsCounter) countRead(n int, err error) {
+	if err != nil {
+		atomic.AddUint64(&stats.txErrors, 1)
+		return
+	}
+	atomic.AddUint64(&stats.txPackets, 1)
+	atomic.AddUint64(&stats.txBytes, uint64(n))
+}
+
+func (stats *statsCounter) countWrite(n int, err error) {
+	if err != nil {
+		atomic.AddUint64(&stats.rxErrors, 1)
+		return
+	}
+	if n == 0 {
+		atomic.AddUint64(&stats.rxDropped, 1)
+		return
+	}
+	atomic.AddUint64(&stats.rxPackets, 1)
+	atomic.AddUint64(&stats.rxBytes, uint64(n))
+}
+
+func (stats *statsCounter) snapshot() Statistics {
+	return Statistics{
+		RxPackets: atomic.LoadUint64(&stats.rxPackets),
+		TxPackets: atomic.LoadUint64(&stats.txPackets),
+		RxBytes:   atomic.LoadUint64(&stats.rxBytes),
+		TxBytes:   atomic.LoadUint64(&stats.txBytes),
+		RxErrors:  atomic.LoadUint64(&stats.rxErrors),
+		TxErrors:  atomic.LoadUint64(&stats.txErrors),
+		RxDropped: atomic.LoadUint64(&stats.rxDropped),
+	}
+}
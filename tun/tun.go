@@ -27,3 +27,54 @@ type Device interface {
 	Events() chan Event             // returns a constant channel of events related to the device
 	Close() error                   // stops the device and closes the event channel
 }
+
+// Statistics are the packet counters of a device, from the point of view
+// of the network interface: received packets were written to the device,
+// transmitted packets were read from it.
+type Statistics struct {
+	RxPackets uint64
+	TxPackets uint64
+	RxBytes   uint64
+	TxBytes   uint64
+	RxErrors  uint64
+	TxErrors  uint64
+	RxDropped uint64
+	TxDropped uint64
+}
+
+// StatisticsDevice is implemented by devices that report their counters.
+// Statistics is cheap enough to be polled every second.
+type StatisticsDevice interface {
+	Statistics() (Statistics, error)
+}
+
+// MTUDevice is implemented by devices whose MTU can be changed once
+// created. SetMTU changes the MTU of the interface, which is then reported
+// by MTU.
+type MTUDevice interface {
+	SetMTU(mtu int) error
+}
+
+// Queue is a single packet queue of a device.
+type Queue interface {
+	Read([]byte, int) (int, error)  // read a packet from the queue (without any additional headers)
+	Write([]byte, int) (int, error) // writes a packet to the queue (without any additional headers)
+	Flush() error                   // flush all previous writes to the queue
+}
+
+// BatchReader is implemented by devices and queues that can read several
+// packets in one call. ReadBatch reads into buffs[i][offset:], stores the
+// packet sizes in sizes, and returns the number of packets read. It blocks
+// until at least one packet is available. A batch need not take a single
+// system call: the Linux TUN device still takes one read per packet.
+type BatchReader interface {
+	ReadBatch(buffs [][]byte, sizes []int, offset int) (int, error)
+}
+
+// MultiQueueDevice is implemented by devices opened with several packet
+// queues, which can be read and written in parallel. The first queue is
+// the Device itself; closing the Device closes all of its queues.
+type MultiQueueDevice interface {
+	Device
+	Queues() []Queue
+}
@@ -0,0 +1,168 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package tun
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+/* A channel TUN is a virtual device exchanging packets with Go code in
+ * the same process rather than with the kernel, so that a userspace
+ * network stack can be embedded where creating TUN devices is not allowed.
+ */
+
+const ChannelMTU = 1420
+
+var errChannelClosed = errors.New("tun: channel device closed")
+
+type channelTUN struct {
+	inbound  chan []byte // decrypted packets, written by the device
+	outbound chan []byte // packets to encrypt, read by the device
+	events   chan Event
+	mtu      int32 // atomic
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	writers   sync.RWMutex // held for writing while closing inbound and events
+}
+
+// NewChannelTUN creates a Device backed by channels. Packets the device
+// writes, the decrypted packets received from peers, are delivered on
+// inbound; packets sent on outbound are read by the device, encrypted
+// and sent to peers.
+//
+// The MTU starts at ChannelMTU, outbound packets exceeding it are
+// dropped. The device is up from the start and reports no further events
+// but MTU updates.
+// Closing the device closes inbound; outbound is left to its owner.
+func NewChannelTUN() (Device, chan []byte, chan []byte) {
+	tun := &channelTUN{
+		inbound:  make(chan []byte, 128),
+		outbound: make(chan []byte, 128),
+		events:   make(chan Event, 1),
+		closed:   make(chan struct{}),
+		mtu:      ChannelMTU,
+	}
+	tun.events <- EventUp
+	return tun, tun.inbound, tun.outbound
+}
+
+func (tun *channelTUN) File() *os.File { return nil }
+
+func (tun *channelTUN) Flush() error { return nil }
+
+func (tun *channelTUN) MTU() (int, error) { return int(atomic.LoadInt32(&tun.mtu)), nil }
+
+func (tun *channelTUN) SetMTU(mtu int) error {
+	if mtu <= 0 {
+		return errors.New("tun: invalid MTU")
+	}
+	atomic.StoreInt32(&tun.mtu, int32(mtu))
+
+	tun.writers.RLock()
+	defer tun.writers.RUnlock()
+	select {
+	case <-tun.closed:
+		return errChannelClosed
+	case tun.events <- EventMTUUpdate:
+	default:
+	}
+	return nil
+}
+
+func (tun *channelTUN) Name() (string, error) { return "channel", nil }
+
+func (tun *channelTUN) Events() chan Event { return tun.events }
+
+/* Waits for the next outbound packet within the MTU.
+ */
+func (tun *channelTUN) next() ([]byte, error) {
+	for {
+		select {
+		case <-tun.closed:
+			return nil, errChannelClosed
+		case packet, ok := <-tun.outbound:
+			if !ok {
+				return nil, io.EOF
+			}
+			if len(packet) <= int(atomic.LoadInt32(&tun.mtu)) {
+				return packet, nil
+			}
+		}
+	}
+}
+
+func (tun *channelTUN) Read(buff []byte, offset int) (int, error) {
+	packet, err := tun.next()
+	if err != nil {
+		return 0, err
+	}
+	return copy(buff[offset:], packet), nil
+}
+
+// ReadBatch waits for one outbound packet, then takes those already queued.
+func (tun *channelTUN) ReadBatch(buffs [][]byte, sizes []int, offset int) (int, error) {
+	n, err := tun.Read(buffs[0], offset)
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+	for i := 1; i < len(buffs); i++ {
+		select {
+		case packet, ok := <-tun.outbound:
+			if !ok {
+				return i, nil
+			}
+			if len(packet) > int(atomic.LoadInt32(&tun.mtu)) {
+				i--
+				continue
+			}
+			sizes[i] = copy(buffs[i][offset:], packet)
+		default:
+			return i, nil
+		}
+	}
+	return len(buffs), nil
+}
+
+func (tun *channelTUN) Write(buff []byte, offset int) (int, error) {
+	packet := make([]byte, len(buff)-offset)
+	copy(packet, buff[offset:])
+
+	tun.writers.RLock()
+	defer tun.writers.RUnlock()
+
+	select {
+	case <-tun.closed:
+		return 0, errChannelClosed
+	default:
+	}
+
+	select {
+	case <-tun.closed:
+		return 0, errChannelClosed
+	case tun.inbound <- packet:
+		return len(packet), nil
+	}
+}
+
+func (tun *channelTUN) Close() error {
+	tun.closeOnce.Do(func() {
+		close(tun.closed)
+
+		// writers blocked on inbound return once closed is closed
+
+		tun.writers.Lock()
+		close(tun.events)
+		close(tun.inbound)
+		tun.writers.Unlock()
+	})
+	return nil
+}
@@ -0,0 +1,86 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package tun
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChannelTUN(t *testing.T) {
+	tun, inbound, outbound := NewChannelTUN()
+
+	if event := <-tun.Events(); event != EventUp {
+		t.Fatalf("first event = %v, want up", event)
+	}
+	if mtu, err := tun.MTU(); err != nil || mtu != ChannelMTU {
+		t.Fatalf("MTU() = %d, %v", mtu, err)
+	}
+
+	// written packets are delivered without the offset
+
+	const offset = 16
+	packet := bytes.Repeat([]byte{0x45}, 100)
+	buff := append(make([]byte, offset), packet...)
+	if n, err := tun.Write(buff, offset); err != nil || n != len(packet) {
+		t.Fatalf("Write() = %d, %v", n, err)
+	}
+	if got := <-inbound; !bytes.Equal(got, packet) {
+		t.Fatalf("inbound got %d bytes, want %d", len(got), len(packet))
+	}
+
+	// outbound packets are read in batches, dropping those over the MTU
+
+	outbound <- []byte{1}
+	outbound <- make([]byte, ChannelMTU+1)
+	outbound <- []byte{2, 2}
+	buffs := make([][]byte, 4)
+	for i := range buffs {
+		buffs[i] = make([]byte, offset+ChannelMTU)
+	}
+	sizes := make([]int, len(buffs))
+	n, err := tun.(BatchReader).ReadBatch(buffs, sizes, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || sizes[0] != 1 || sizes[1] != 2 || buffs[1][offset] != 2 {
+		t.Fatalf("ReadBatch() = %d, sizes %v", n, sizes[:n])
+	}
+
+	// a lowered MTU is reported and drops packets exceeding it
+
+	if err := tun.(MTUDevice).SetMTU(1000); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-tun.Events(); event != EventMTUUpdate {
+		t.Fatalf("event = %v, want MTU update", event)
+	}
+	if mtu, _ := tun.MTU(); mtu != 1000 {
+		t.Fatalf("MTU() = %d after SetMTU(1000)", mtu)
+	}
+	outbound <- make([]byte, 1001)
+	outbound <- []byte{3}
+	if n, err := tun.Read(buffs[0], offset); err != nil || n != 1 {
+		t.Fatalf("Read() = %d, %v", n, err)
+	}
+
+	// closing ends reads and writes and closes inbound
+
+	tun.Close()
+	if _, err := tun.Read(buffs[0], offset); err == nil {
+		t.Error("Read() succeeded after close")
+	}
+	if _, err := tun.Write(buff, offset); err == nil {
+		t.Error("Write() succeeded after close")
+	}
+	if _, ok := <-inbound; ok {
+		t.Error("inbound not closed")
+	}
+	if _, ok := <-tun.Events(); ok {
+		t.Error("events not closed")
+	}
+	tun.Close()
+}
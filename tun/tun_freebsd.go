@@ -77,6 +77,7 @@ type in6_ndireq struct {
 }
 
 type NativeTun struct {
+	stats       statsCounter // must be first, for 64-bit alignment
 	name        string
 	tunFile     *os.File
 	events      chan Event
@@ -430,6 +431,12 @@ func (tun *NativeTun) Events() chan Event {
 }
 
 func (tun *NativeTun) Read(buff []byte, offset int) (int, error) {
+	n, err := tun.read(buff, offset)
+	tun.stats.countRead(n, err)
+	return n, err
+}
+
+func (tun *NativeTun) read(buff []byte, offset int) (int, error) {
 	select {
 	case err := <-tun.errors:
 		return 0, err
@@ -444,6 +451,16 @@ func (tun *NativeTun) Read(buff []byte, offset int) (int, error) {
 }
 
 func (tun *NativeTun) Write(buff []byte, offset int) (int, error) {
+	n, err := tun.write(buff, offset)
+	tun.stats.countWrite(n, err)
+	return n, err
+}
+
+func (tun *NativeTun) Statistics() (Statistics, error) {
+	return tun.stats.snapshot(), nil
+}
+
+func (tun *NativeTun) write(buff []byte, offset int) (int, error) {
 
 	// reserve space for header
 
@@ -528,6 +545,10 @@ func (tun *NativeTun) setMTU(n int) error {
 	return nil
 }
 
+func (tun *NativeTun) SetMTU(mtu int) error {
+	return tun.setMTU(mtu)
+}
+
 func (tun *NativeTun) MTU() (int, error) {
 	// open datagram socket
 
@@ -30,6 +30,7 @@ const (
 
 type NativeTun struct {
 	tunFile                 *os.File
+	queueFiles              []*os.File // additional IFF_MULTI_QUEUE queues
 	index                   int32      // if index
 	errors                  chan error // async error handling
 	events                  chan Event // device related events
@@ -243,6 +244,10 @@ func (tun *NativeTun) setMTU(n int) error {
 	return nil
 }
 
+func (tun *NativeTun) SetMTU(mtu int) error {
+	return tun.setMTU(mtu)
+}
+
 func (tun *NativeTun) MTU() (int, error) {
 	name, err := tun.Name()
 	if err != nil {
@@ -279,6 +284,87 @@ func (tun *NativeTun) MTU() (int, error) {
 	return int(*(*int32)(unsafe.Pointer(&ifr[unix.IFNAMSIZ]))), nil
 }
 
+/* Reads the interface counters from the kernel with an RTM_GETLINK request.
+ */
+func (tun *NativeTun) Statistics() (Statistics, error) {
+	index := tun.index
+	if index == 0 {
+		name, err := tun.Name()
+		if err != nil {
+			return Statistics{}, err
+		}
+		index, err = getIFIndex(name)
+		if err != nil {
+			return Statistics{}, err
+		}
+	}
+
+	sock, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return Statistics{}, err
+	}
+	defer unix.Close(sock)
+
+	var req [unix.NLMSG_HDRLEN + unix.SizeofIfInfomsg]byte
+	hdr := (*unix.NlMsghdr)(unsafe.Pointer(&req[0]))
+	hdr.Len = uint32(len(req))
+	hdr.Type = unix.RTM_GETLINK
+	hdr.Flags = unix.NLM_F_REQUEST
+	hdr.Seq = 1
+	info := (*unix.IfInfomsg)(unsafe.Pointer(&req[unix.NLMSG_HDRLEN]))
+	info.Family = unix.AF_UNSPEC
+	info.Index = index
+
+	err = unix.Sendto(sock, req[:], 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+	if err != nil {
+		return Statistics{}, err
+	}
+
+	var buff [1 << 14]byte
+	n, _, err := unix.Recvfrom(sock, buff[:], 0)
+	if err != nil {
+		return Statistics{}, err
+	}
+
+	msgs, err := syscall.ParseNetlinkMessage(buff[:n])
+	if err != nil {
+		return Statistics{}, err
+	}
+	for _, msg := range msgs {
+		switch msg.Header.Type {
+		case unix.NLMSG_ERROR:
+			if len(msg.Data) >= 4 {
+				if errno := -*(*int32)(unsafe.Pointer(&msg.Data[0])); errno != 0 {
+					return Statistics{}, syscall.Errno(errno)
+				}
+			}
+		case unix.RTM_NEWLINK:
+			attrs, err := syscall.ParseNetlinkRouteAttr(&msg)
+			if err != nil {
+				return Statistics{}, err
+			}
+			for _, attr := range attrs {
+				if attr.Attr.Type != unix.IFLA_STATS64 || len(attr.Value) < 8*8 {
+					continue
+				}
+				var stats [8]uint64 // leading fields of struct rtnl_link_stats64
+				copy((*[8 * 8]byte)(unsafe.Pointer(&stats))[:], attr.Value)
+				return Statistics{
+					RxPackets: stats[0],
+					TxPackets: stats[1],
+					RxBytes:   stats[2],
+					TxBytes:   stats[3],
+					RxErrors:  stats[4],
+					TxErrors:  stats[5],
+					RxDropped: stats[6],
+					TxDropped: stats[7],
+				}, nil
+			}
+		}
+	}
+	return Statistics{}, errors.New("no link statistics in netlink response")
+}
+
 func (tun *NativeTun) Name() (string, error) {
 	tun.nameOnce.Do(tun.initNameCache)
 	return tun.nameCache, tun.nameErr
@@ -317,6 +403,10 @@ func (tun *NativeTun) nameSlow() (string, error) {
 }
 
 func (tun *NativeTun) Write(buff []byte, offset int) (int, error) {
+	return tun.write(tun.tunFile, buff, offset)
+}
+
+func (tun *NativeTun) write(file *os.File, buff []byte, offset int) (int, error) {
 
 	if tun.nopi {
 		buff = buff[offset:]
@@ -341,7 +431,7 @@ func (tun *NativeTun) Write(buff []byte, offset int) (int, error) {
 
 	// write
 
-	return tun.tunFile.Write(buff)
+	return file.Write(buff)
 }
 
 func (tun *NativeTun) Flush() error {
@@ -354,17 +444,117 @@ func (tun *NativeTun) Read(buff []byte, offset int) (int, error) {
 	case err := <-tun.errors:
 		return 0, err
 	default:
-		if tun.nopi {
-			return tun.tunFile.Read(buff[offset:])
-		} else {
-			buff := buff[offset-4:]
-			n, err := tun.tunFile.Read(buff[:])
-			if n < 4 {
-				return 0, err
+		return tun.read(tun.tunFile, buff, offset)
+	}
+}
+
+func (tun *NativeTun) read(file *os.File, buff []byte, offset int) (int, error) {
+	if tun.nopi {
+		return file.Read(buff[offset:])
+	} else {
+		buff := buff[offset-4:]
+		n, err := file.Read(buff[:])
+		if n < 4 {
+			return 0, err
+		}
+		return n - 4, err
+	}
+}
+
+func (tun *NativeTun) ReadBatch(buffs [][]byte, sizes []int, offset int) (int, error) {
+	select {
+	case err := <-tun.errors:
+		return 0, err
+	default:
+		return tun.readBatch(tun.tunFile, buffs, sizes, offset)
+	}
+}
+
+/* Waits for the first packet, then keeps reading until the queue
+ * is drained or the batch is full, all within a single poller wakeup.
+ * A TUN device is no socket, so recvmmsg(2) does not apply, and each
+ * packet still takes a read(2) of its own: batching only saves the
+ * wakeups and the passes through the read loop of the caller.
+ */
+func (tun *NativeTun) readBatch(file *os.File, buffs [][]byte, sizes []int, offset int) (int, error) {
+	rawConn, err := file.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		n       int
+		readErr error
+	)
+	err = rawConn.Read(func(fd uintptr) bool {
+		for n < len(buffs) {
+			buff := buffs[n][offset:]
+			if !tun.nopi {
+				buff = buffs[n][offset-4:]
+			}
+			size, err := unix.Read(int(fd), buff)
+			if err == unix.EINTR {
+				continue
+			}
+			if err == unix.EAGAIN {
+				return n > 0
+			}
+			if err != nil {
+				readErr = err
+				return true
 			}
-			return n - 4, err
+			if !tun.nopi {
+				if size < 4 {
+					size = 4
+				}
+				size -= 4
+			}
+			sizes[n] = size
+			n++
 		}
+		return true
+	})
+
+	// errors after a partial batch are reported by the next call
+
+	if n > 0 {
+		return n, nil
 	}
+	if err != nil {
+		return 0, err
+	}
+	return 0, readErr
+}
+
+/* An additional queue of a multiqueue device.
+ */
+type nativeQueue struct {
+	tun  *NativeTun
+	file *os.File
+}
+
+func (queue *nativeQueue) Read(buff []byte, offset int) (int, error) {
+	return queue.tun.read(queue.file, buff, offset)
+}
+
+func (queue *nativeQueue) ReadBatch(buffs [][]byte, sizes []int, offset int) (int, error) {
+	return queue.tun.readBatch(queue.file, buffs, sizes, offset)
+}
+
+func (queue *nativeQueue) Write(buff []byte, offset int) (int, error) {
+	return queue.tun.write(queue.file, buff, offset)
+}
+
+func (queue *nativeQueue) Flush() error {
+	return nil
+}
+
+func (tun *NativeTun) Queues() []Queue {
+	queues := []Queue{tun}
+	for _, file := range tun.queueFiles {
+		queues = append(queues, &nativeQueue{tun: tun, file: file})
+	}
+	return queues
 }
 
 func (tun *NativeTun) Events() chan Event {
@@ -382,6 +572,9 @@ func (tun *NativeTun) Close() error {
 		close(tun.events)
 	}
 	err2 := tun.tunFile.Close()
+	for _, file := range tun.queueFiles {
+		file.Close()
+	}
 
 	if err1 != nil {
 		return err1
@@ -390,21 +583,71 @@ func (tun *NativeTun) Close() error {
 }
 
 func CreateTUN(name string, mtu int) (Device, error) {
+	return CreateMultiQueueTUN(name, mtu, 1)
+}
+
+/* Creates a TUN device with the given number of packet queues, using
+ * IFF_MULTI_QUEUE when more than one is requested. If the kernel does not
+ * support multiqueue devices, a single queue device is created instead.
+ */
+func CreateMultiQueueTUN(name string, mtu int, queues int) (Device, error) {
+	nameBytes := []byte(name)
+	if len(nameBytes) >= unix.IFNAMSIZ {
+		return nil, errors.New("interface name too long")
+	}
+
+	var flags uint16 = unix.IFF_TUN // | unix.IFF_NO_PI (disabled for TUN status hack)
+	if queues > 1 {
+		flags |= unix.IFF_MULTI_QUEUE
+	}
+
+	file, name, err := openTUNQueue(name, flags)
+	if err == unix.EINVAL && flags&unix.IFF_MULTI_QUEUE != 0 {
+		flags &^= unix.IFF_MULTI_QUEUE
+		queues = 1
+		file, name, err = openTUNQueue(name, flags)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// attach the remaining queues to the interface by its assigned name
+
+	var queueFiles []*os.File
+	for i := 1; i < queues; i++ {
+		queueFile, _, err := openTUNQueue(name, flags)
+		if err != nil {
+			for _, f := range queueFiles {
+				f.Close()
+			}
+			file.Close()
+			return nil, err
+		}
+		queueFiles = append(queueFiles, queueFile)
+	}
+
+	tun, err := CreateTUNFromFile(file, mtu)
+	if err != nil {
+		for _, f := range queueFiles {
+			f.Close()
+		}
+		return nil, err
+	}
+	tun.(*NativeTun).queueFiles = queueFiles
+	return tun, nil
+}
+
+func openTUNQueue(name string, flags uint16) (*os.File, string, error) {
 	nfd, err := unix.Open(cloneDevicePath, os.O_RDWR, 0)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("can't create TUN device; %s does not exist", cloneDevicePath)
+			return nil, "", fmt.Errorf("can't create TUN device; %s does not exist", cloneDevicePath)
 		}
-		return nil, err
+		return nil, "", err
 	}
 
 	var ifr [ifReqSize]byte
-	var flags uint16 = unix.IFF_TUN // | unix.IFF_NO_PI (disabled for TUN status hack)
-	nameBytes := []byte(name)
-	if len(nameBytes) >= unix.IFNAMSIZ {
-		return nil, errors.New("interface name too long")
-	}
-	copy(ifr[:], nameBytes)
+	copy(ifr[:], name)
 	*(*uint16)(unsafe.Pointer(&ifr[unix.IFNAMSIZ])) = flags
 
 	_, _, errno := unix.Syscall(
@@ -414,27 +657,110 @@ func CreateTUN(name string, mtu int) (Device, error) {
 		uintptr(unsafe.Pointer(&ifr[0])),
 	)
 	if errno != 0 {
-		return nil, errno
+		unix.Close(nfd)
+		return nil, "", errno
 	}
 	err = unix.SetNonblock(nfd, true)
+	if err != nil {
+		unix.Close(nfd)
+		return nil, "", err
+	}
 
 	// Note that the above -- open,ioctl,nonblock -- must happen prior to handing it to netpoll as below this line.
 
-	fd := os.NewFile(uintptr(nfd), cloneDevicePath)
+	name = string(ifr[:bytes.IndexByte(ifr[:unix.IFNAMSIZ], 0)])
+	return os.NewFile(uintptr(nfd), cloneDevicePath), name, nil
+}
+
+func CreateTUNFromFile(file *os.File, mtu int) (Device, error) {
+	tun, err := monitorTUN(file, false)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tun.setMTU(mtu)
 	if err != nil {
+		unix.Close(tun.netlinkSock)
 		return nil, err
 	}
 
-	return CreateTUNFromFile(fd, mtu)
+	return tun, nil
 }
 
-func CreateTUNFromFile(file *os.File, mtu int) (Device, error) {
+// Files returns the files of the queues of the device, the first being
+// that returned by File, so that they can be passed to another process,
+// which adopts them with CreateTUNFromFD.
+func (tun *NativeTun) Files() []*os.File {
+	return append([]*os.File{tun.tunFile}, tun.queueFiles...)
+}
+
+// CreateTUNFromFD adopts the file descriptors of the queues of an
+// existing TUN device, the first being its primary queue, as when taking
+// over the device from another process. Unlike CreateTUNFromFile, it
+// leaves the interface as it is, not setting its MTU, and reads from the
+// queues whether they carry packet information. The descriptors belong
+// to the device from then on, and are closed with it, or on failure.
+func CreateTUNFromFD(fd int, queueFDs ...int) (Device, error) {
+	fds := append([]int{fd}, queueFDs...)
+	var nopi bool
+	for i, f := range fds {
+		flags, err := tunFlags(f)
+		if err == nil {
+			err = unix.SetNonblock(f, true)
+		}
+		if err == nil && i > 0 && (flags&unix.IFF_NO_PI != 0) != nopi {
+			err = errors.New("TUN queues differ in carrying packet information")
+		}
+		if err != nil {
+			for _, f := range fds {
+				unix.Close(f)
+			}
+			return nil, err
+		}
+		nopi = flags&unix.IFF_NO_PI != 0
+	}
+
+	var files []*os.File
+	for _, f := range fds {
+		files = append(files, os.NewFile(uintptr(f), cloneDevicePath))
+	}
+	tun, err := monitorTUN(files[0], nopi)
+	if err != nil {
+		for _, file := range files {
+			file.Close()
+		}
+		return nil, err
+	}
+	tun.queueFiles = files[1:]
+	return tun, nil
+}
+
+/* Returns the flags the TUN device of fd was created with.
+ */
+func tunFlags(fd int) (uint16, error) {
+	var ifr [ifReqSize]byte
+	_, _, errno := unix.Syscall(
+		unix.SYS_IOCTL,
+		uintptr(fd),
+		uintptr(unix.TUNGETIFF),
+		uintptr(unsafe.Pointer(&ifr[0])),
+	)
+	if errno != 0 {
+		return 0, errors.New("failed to get flags of TUN device: " + errno.Error())
+	}
+	return *(*uint16)(unsafe.Pointer(&ifr[unix.IFNAMSIZ])), nil
+}
+
+/* Wraps the primary queue of a TUN device, starting the listeners for
+ * the events of its interface.
+ */
+func monitorTUN(file *os.File, nopi bool) (*NativeTun, error) {
 	tun := &NativeTun{
 		tunFile:                 file,
 		events:                  make(chan Event, 5),
 		errors:                  make(chan error, 5),
 		statusListenersShutdown: make(chan struct{}),
-		nopi:                    false,
+		nopi:                    nopi,
 	}
 
 	name, err := tun.Name()
@@ -463,12 +789,6 @@ func CreateTUNFromFile(file *os.File, mtu int) (Device, error) {
 	go tun.routineNetlinkListener()
 	go tun.routineHackListener() // cross namespace
 
-	err = tun.setMTU(mtu)
-	if err != nil {
-		unix.Close(tun.netlinkSock)
-		return nil, err
-	}
-
 	return tun, nil
 }
 
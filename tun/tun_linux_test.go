@@ -0,0 +1,251 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2019 WireGuard LLC. All Rights Reserved.
+ */
+
+package tun
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func setLinkUp(tb testing.TB, tun Device) {
+	tb.Helper()
+	name, err := tun.Name()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer unix.Close(fd)
+
+	var ifr [ifReqSize]byte
+	copy(ifr[:], name)
+	*(*uint16)(unsafe.Pointer(&ifr[unix.IFNAMSIZ])) = unix.IFF_UP
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(unix.SIOCSIFFLAGS), uintptr(unsafe.Pointer(&ifr[0])))
+	if errno != 0 {
+		tb.Fatal(errno)
+	}
+}
+
+func setAddress(tb testing.TB, tun Device, addr, mask [4]byte) {
+	tb.Helper()
+	name, err := tun.Name()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer unix.Close(fd)
+
+	for _, req := range []struct {
+		ioctl uintptr
+		addr  [4]byte
+	}{{unix.SIOCSIFADDR, addr}, {unix.SIOCSIFNETMASK, mask}} {
+		var ifr [ifReqSize]byte
+		copy(ifr[:], name)
+		sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(&ifr[unix.IFNAMSIZ]))
+		sa.Family = unix.AF_INET
+		sa.Addr = req.addr
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), req.ioctl, uintptr(unsafe.Pointer(&ifr[0])))
+		if errno != 0 {
+			tb.Fatal(errno)
+		}
+	}
+}
+
+func TestReadBatch(t *testing.T) {
+	tun, err := CreateTUN("", 1420)
+	if err != nil {
+		t.Skipf("cannot create TUN device: %v", err)
+	}
+	defer tun.Close()
+	setAddress(t, tun, [4]byte{198, 18, 7, 1}, [4]byte{255, 255, 255, 0})
+	setLinkUp(t, tun)
+
+	sock, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(198, 18, 7, 2), Port: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+
+	const count = 8
+	for i := 0; i < count; i++ {
+		if _, err := sock.Write([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const offset = 16
+	buffs := make([][]byte, count)
+	sizes := make([]int, count)
+	for i := range buffs {
+		buffs[i] = make([]byte, offset+1500)
+	}
+	udp := 0
+	for udp < count {
+		n, err := tun.(BatchReader).ReadBatch(buffs, sizes, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			packet := buffs[i][offset : offset+sizes[i]]
+			// skip router solicitations and other noise from bringing the link up
+			if len(packet) == 29 && packet[0] == 0x45 && packet[9] == unix.IPPROTO_UDP {
+				if packet[28] != byte(udp) {
+					t.Fatalf("packet %d carries payload %d", udp, packet[28])
+				}
+				udp++
+			}
+		}
+	}
+}
+
+func TestMultiQueueTUN(t *testing.T) {
+	tun, err := CreateMultiQueueTUN("", 1420, 4)
+	if err != nil {
+		t.Skipf("cannot create TUN device: %v", err)
+	}
+	defer tun.Close()
+
+	queues := tun.(MultiQueueDevice).Queues()
+	if len(queues) != 4 && len(queues) != 1 {
+		t.Fatalf("got %d queues, want 4 or 1 without kernel support", len(queues))
+	}
+	if queues[0] != tun {
+		t.Error("first queue is not the device itself")
+	}
+}
+
+func TestCreateTUNFromFD(t *testing.T) {
+	tun, err := CreateMultiQueueTUN("", 1420, 2)
+	if err != nil {
+		t.Skipf("cannot create TUN device: %v", err)
+	}
+	defer tun.Close()
+	name, _ := tun.Name()
+
+	// a process taking over receives duplicates of the queues
+
+	var fds []int
+	for _, file := range tun.(*NativeTun).Files() {
+		fd, err := unix.Dup(int(file.Fd()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fds = append(fds, fd)
+	}
+	adopted, err := CreateTUNFromFD(fds[0], fds[1:]...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer adopted.Close()
+	if adoptedName, err := adopted.Name(); err != nil || adoptedName != name {
+		t.Errorf("adopted %q, %v, want %q", adoptedName, err, name)
+	}
+	if mtu, err := adopted.MTU(); err != nil || mtu != 1420 {
+		t.Errorf("adopted MTU %d, %v, want 1420", mtu, err)
+	}
+	if queues := len(adopted.(*NativeTun).Files()); queues != len(fds) {
+		t.Errorf("adopted %d queues, want %d", queues, len(fds))
+	}
+
+	// the file is closed on failure, so it is given a duplicate of its own
+
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	fd, err := unix.Dup(int(null.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateTUNFromFD(fd); err == nil {
+		t.Error("adopted a file which is not a TUN device")
+	}
+}
+
+// A minimal IPv4/UDP packet to a documentation address, which the kernel
+// accepts from the TUN queue and then drops for lack of a route.
+var benchPacket = []byte{
+	0x45, 0x00, 0x00, 0x20, 0x00, 0x00, 0x40, 0x00, 0x40, 0x11, 0x00, 0x00,
+	192, 0, 2, 2,
+	192, 0, 2, 1,
+	0x30, 0x39, 0x30, 0x39, 0x00, 0x0c, 0x00, 0x00,
+	0xde, 0xad, 0xbe, 0xef,
+}
+
+func benchmarkQueues(b *testing.B, queues int) {
+	tun, err := CreateMultiQueueTUN("", 1420, queues)
+	if err != nil {
+		b.Skipf("cannot create TUN device: %v", err)
+	}
+	defer tun.Close()
+	setLinkUp(b, tun)
+
+	all := tun.(MultiQueueDevice).Queues()
+	var next uint32
+
+	b.SetBytes(int64(len(benchPacket)))
+	b.SetParallelism(queues)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		queue := all[int(atomic.AddUint32(&next, 1)-1)%len(all)]
+		const offset = 16
+		buf := make([]byte, offset+len(benchPacket))
+		for pb.Next() {
+			copy(buf[offset:], benchPacket)
+			if _, err := queue.Write(buf, offset); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkWriteQueues(b *testing.B) {
+	for _, queues := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("queues=%d", queues), func(b *testing.B) {
+			benchmarkQueues(b, queues)
+		})
+	}
+}
+
+func TestStatistics(t *testing.T) {
+	tun, err := CreateTUN("", 1420)
+	if err != nil {
+		t.Skipf("cannot create TUN device: %v", err)
+	}
+	defer tun.Close()
+	setLinkUp(t, tun)
+
+	const count = 5
+	const offset = 16
+	buf := make([]byte, offset+len(benchPacket))
+	for i := 0; i < count; i++ {
+		copy(buf[offset:], benchPacket)
+		if _, err := tun.Write(buf, offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := tun.(StatisticsDevice).Statistics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.RxPackets < count || stats.RxBytes < count*uint64(len(benchPacket)) {
+		t.Errorf("got %+v, want at least %d packets received", stats, count)
+	}
+}
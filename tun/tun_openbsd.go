@@ -27,6 +27,7 @@ type ifreq_mtu struct {
 const _TUNSIFMODE = 0x8004745d
 
 type NativeTun struct {
+	stats       statsCounter // must be first, for 64-bit alignment
 	name        string
 	tunFile     *os.File
 	events      chan Event
@@ -213,6 +214,12 @@ func (tun *NativeTun) Events() chan Event {
 }
 
 func (tun *NativeTun) Read(buff []byte, offset int) (int, error) {
+	n, err := tun.read(buff, offset)
+	tun.stats.countRead(n, err)
+	return n, err
+}
+
+func (tun *NativeTun) read(buff []byte, offset int) (int, error) {
 	select {
 	case err := <-tun.errors:
 		return 0, err
@@ -227,6 +234,16 @@ func (tun *NativeTun) Read(buff []byte, offset int) (int, error) {
 }
 
 func (tun *NativeTun) Write(buff []byte, offset int) (int, error) {
+	n, err := tun.write(buff, offset)
+	tun.stats.countWrite(n, err)
+	return n, err
+}
+
+func (tun *NativeTun) Statistics() (Statistics, error) {
+	return tun.stats.snapshot(), nil
+}
+
+func (tun *NativeTun) write(buff []byte, offset int) (int, error) {
 
 	// reserve space for header
 
@@ -307,6 +324,10 @@ func (tun *NativeTun) setMTU(n int) error {
 	return nil
 }
 
+func (tun *NativeTun) SetMTU(mtu int) error {
+	return tun.setMTU(mtu)
+}
+
 func (tun *NativeTun) MTU() (int, error) {
 	// open datagram socket
 
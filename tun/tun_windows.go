@@ -33,6 +33,7 @@ type rateJuggler struct {
 }
 
 type NativeTun struct {
+	stats     statsCounter // must be first, for 64-bit alignment
 	wt        *wintun.Interface
 	handle    windows.Handle
 	close     bool
@@ -147,6 +148,12 @@ func (tun *NativeTun) MTU() (int, error) {
 	return tun.forcedMTU, nil
 }
 
+// SetMTU only changes the MTU reported, the OS owning that of the adapter.
+func (tun *NativeTun) SetMTU(mtu int) error {
+	tun.ForceMTU(mtu)
+	return nil
+}
+
 // TODO: This is a temporary hack. We really need to be monitoring the interface in real time and adapting to MTU changes.
 func (tun *NativeTun) ForceMTU(mtu int) {
 	tun.forcedMTU = mtu
@@ -155,6 +162,12 @@ func (tun *NativeTun) ForceMTU(mtu int) {
 // Note: Read() and Write() assume the caller comes only from a single thread; there's no locking.
 
 func (tun *NativeTun) Read(buff []byte, offset int) (int, error) {
+	n, err := tun.read(buff, offset)
+	tun.stats.countRead(n, err)
+	return n, err
+}
+
+func (tun *NativeTun) read(buff []byte, offset int) (int, error) {
 retry:
 	select {
 	case err := <-tun.errors:
@@ -218,6 +231,16 @@ func (tun *NativeTun) Flush() error {
 }
 
 func (tun *NativeTun) Write(buff []byte, offset int) (int, error) {
+	n, err := tun.write(buff, offset)
+	tun.stats.countWrite(n, err)
+	return n, err
+}
+
+func (tun *NativeTun) Statistics() (Statistics, error) {
+	return tun.stats.snapshot(), nil
+}
+
+func (tun *NativeTun) write(buff []byte, offset int) (int, error) {
 	if tun.close {
 		return 0, os.ErrClosed
 	}
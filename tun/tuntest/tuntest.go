@@ -10,6 +10,7 @@ import (
 	"io"
 	"net"
 	"os"
+	"sync/atomic"
 
 	"github.com/tailscale/wireguard-go/tun"
 )
@@ -98,6 +99,7 @@ func NewChannelTUN() *ChannelTUN {
 		events:   make(chan tun.Event, 1),
 	}
 	c.tun.c = c
+	c.tun.mtu = DefaultMTU
 	c.events <- tun.EventUp
 	return c
 }
@@ -107,7 +109,8 @@ func (c *ChannelTUN) TUN() tun.Device {
 }
 
 type chTun struct {
-	c *ChannelTUN
+	c   *ChannelTUN
+	mtu int32 // atomic
 }
 
 func (t *chTun) File() *os.File { return nil }
@@ -121,6 +124,24 @@ func (t *chTun) Read(data []byte, offset int) (int, error) {
 	}
 }
 
+// ReadBatch waits for one outbound packet, then takes whatever else is already queued.
+func (t *chTun) ReadBatch(buffs [][]byte, sizes []int, offset int) (int, error) {
+	n, err := t.Read(buffs[0], offset)
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+	for i := 1; i < len(buffs); i++ {
+		select {
+		case msg := <-t.c.Outbound:
+			sizes[i] = copy(buffs[i][offset:], msg)
+		default:
+			return i, nil
+		}
+	}
+	return len(buffs), nil
+}
+
 // Write is called by the wireguard device to deliver a packet for routing.
 func (t *chTun) Write(data []byte, offset int) (int, error) {
 	if offset == -1 {
@@ -141,9 +162,13 @@ func (t *chTun) Write(data []byte, offset int) (int, error) {
 const DefaultMTU = 1420
 
 func (t *chTun) Flush() error           { return nil }
-func (t *chTun) MTU() (int, error)      { return DefaultMTU, nil }
+func (t *chTun) MTU() (int, error)      { return int(atomic.LoadInt32(&t.mtu)), nil }
 func (t *chTun) Name() (string, error)  { return "loopbackTun1", nil }
 func (t *chTun) Events() chan tun.Event { return t.c.events }
+func (t *chTun) SetMTU(mtu int) error {
+	atomic.StoreInt32(&t.mtu, int32(mtu))
+	return nil
+}
 func (t *chTun) Close() error {
 	t.Write(nil, -1)
 	return nil